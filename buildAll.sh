@@ -1,15 +1,23 @@
 #!/bin/bash
 
 export VERSION="`cat VERSION`-`git rev-parse --short HEAD`"
+# Set KSSH_RELEASE_SIGNER to the Keybase user of the CA bot to pin the signer of kssh --self-update releases into kssh
 
 # Linux
-go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/kssh-linux src/cmd/kssh/kssh.go
+go build -ldflags "-X main.VersionNumber=$VERSION -X main.ReleaseSigner=$KSSH_RELEASE_SIGNER" -o bin/kssh-linux src/cmd/kssh/kssh.go
+GOOS=linux GOARCH=arm64 go build -ldflags "-X main.VersionNumber=$VERSION -X main.ReleaseSigner=$KSSH_RELEASE_SIGNER" -o bin/kssh-linux-arm64 src/cmd/kssh/kssh.go
+go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/ksshd-agent-linux src/cmd/ksshd-agent/ksshd-agent.go
 go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/keybaseca-linux src/cmd/keybaseca/keybaseca.go
+go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/keybaseca-sudo-verify-linux src/cmd/keybaseca-sudo-verify/keybaseca-sudo-verify.go
+go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/kssh-authcheck-linux src/cmd/kssh-authcheck/kssh-authcheck.go
+go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/kssh-server-check-linux src/cmd/kssh-server-check/kssh-server-check.go
 
 # Mac
-GOOS=darwin GOARCH=amd64 go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/kssh-mac src/cmd/kssh/kssh.go
+GOOS=darwin GOARCH=amd64 go build -ldflags "-X main.VersionNumber=$VERSION -X main.ReleaseSigner=$KSSH_RELEASE_SIGNER" -o bin/kssh-mac src/cmd/kssh/kssh.go
+GOOS=darwin GOARCH=amd64 go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/ksshd-agent-mac src/cmd/ksshd-agent/ksshd-agent.go
 GOOS=darwin GOARCH=amd64 go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/keybaseca-mac src/cmd/keybaseca/keybaseca.go
 
 # Windows
-GOOS=windows GOARCH=amd64 go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/kssh-windows src/cmd/kssh/kssh.go
+GOOS=windows GOARCH=amd64 go build -ldflags "-X main.VersionNumber=$VERSION -X main.ReleaseSigner=$KSSH_RELEASE_SIGNER" -o bin/kssh-windows src/cmd/kssh/kssh.go
+GOOS=windows GOARCH=amd64 go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/ksshd-agent-windows src/cmd/ksshd-agent/ksshd-agent.go
 GOOS=windows GOARCH=amd64 go build -ldflags "-X main.VersionNumber=$VERSION" -o bin/keybaseca-windows src/cmd/keybaseca/keybaseca.go
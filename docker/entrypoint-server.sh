@@ -10,6 +10,7 @@ sudo -i -u keybase bash << EOF
 export "TEAMS=$TEAMS"
 export "KEYBASE_USERNAME=$KEYBASE_USERNAME"
 export "KEYBASE_PAPERKEY=$KEYBASE_PAPERKEY"
+export "HTTP_LISTEN_ADDRESS=$HTTP_LISTEN_ADDRESS"
 nohup bash -c "KEYBASE_RUN_MODE=prod kbfsfuse /keybase | grep -v 'ERROR Mounting the filesystem failed' &"
 sleep ${KEYBASE_TIMEOUT:-5}
 keybase oneshot
@@ -0,0 +1,28 @@
+#!/bin/bash
+set -euo pipefail
+IFS=$'\n\t'
+
+# Builds bin/kssh_<version>_<arch>.deb from the binaries built by buildAll.sh. Run from the root of the repository
+# after buildAll.sh.
+
+VERSION="`cat VERSION`"
+
+build() {
+  local arch=$1 kssh=$2 agent=$3
+  local root
+  root=$(mktemp -d)
+  trap "rm -rf $root" RETURN
+
+  install -D -m 0755 "$kssh" "$root/usr/bin/kssh"
+  install -D -m 0755 "$agent" "$root/usr/bin/ksshd-agent"
+  mkdir -p "$root/usr/share/bash-completion/completions"
+  "$kssh" --completion bash > "$root/usr/share/bash-completion/completions/kssh"
+
+  mkdir -p "$root/DEBIAN"
+  sed -e "s/VERSION/$VERSION/" -e "s/ARCH/$arch/" packaging/debian/control > "$root/DEBIAN/control"
+  install -m 0755 packaging/debian/postinst "$root/DEBIAN/postinst"
+
+  dpkg-deb --root-owner-group --build "$root" "bin/kssh_${VERSION}_${arch}.deb"
+}
+
+build amd64 bin/kssh-linux bin/ksshd-agent-linux
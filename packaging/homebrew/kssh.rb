@@ -0,0 +1,29 @@
+# Homebrew formula for kssh. Copy this into a tap (eg `brew tap-new acme/kssh`) and fill in the url and sha256 of the
+# release tarball.
+class Kssh < Formula
+  desc "ssh wrapper that provisions short lived certificates from a Keybase SSH CA bot"
+  homepage "https://github.com/keybase/bot-sshca"
+  url "https://github.com/keybase/bot-sshca/archive/vVERSION.tar.gz"
+  sha256 "SHA256"
+  license "BSD-3-Clause"
+
+  depends_on "go" => :build
+
+  def install
+    system "go", "build", "-ldflags", "-X main.VersionNumber=#{version}", "-o", bin/"kssh", "./src/cmd/kssh"
+    system "go", "build", "-ldflags", "-X main.VersionNumber=#{version}", "-o", bin/"ksshd-agent", "./src/cmd/ksshd-agent"
+    (bash_completion/"kssh").write Utils.safe_popen_read(bin/"kssh", "--completion", "bash")
+  end
+
+  def caveats
+    <<~EOS
+      Run the following once to set up shell completion and git to use kssh:
+        kssh --install-integration
+      Add --proxy-hosts '*.internal.example.com' to also use kssh as the ProxyCommand for those hosts.
+    EOS
+  end
+
+  test do
+    assert_match "kssh", shell_output("#{bin}/kssh --help")
+  end
+end
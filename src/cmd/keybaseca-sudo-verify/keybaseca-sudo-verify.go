@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/sudoverify"
+
+	"github.com/urfave/cli"
+)
+
+var VersionNumber = "master"
+
+// keybaseca-sudo-verify is run by sudo's PAM stack via pam_exec. It exits 0 (allowing sudo without a password) if the
+// ssh-agent of the user running sudo holds a keybaseca certificate that permits sudo, and exits 1 otherwise so that
+// PAM falls through to the next authentication method. See docs/sudo.md.
+func main() {
+	app := cli.NewApp()
+	app.Name = "keybaseca-sudo-verify"
+	app.Usage = "Authenticate sudo with a keybaseca certificate in the forwarded ssh-agent (run via pam_exec)"
+	app.Version = VersionNumber
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "ca",
+			Value: "/etc/ssh/ca.pub",
+			Usage: "The file containing the CA public key(s)",
+		},
+		cli.StringFlag{
+			Name:  "principal",
+			Usage: "If set, the certificate must include this principal (eg an elevated principal such as prod-sudo)",
+		},
+		cli.StringFlag{
+			Name:  "revoked-keys",
+			Usage: "If set, reject certificates listed in this revocation list (an OpenSSH KRL or a list of public keys, eg the RevokedKeys file of sshd)",
+		},
+		cli.BoolTFlag{
+			Name:  "require-extension",
+			Usage: "Require the permit-sudo@keybase.io certificate extension (enabled by default)",
+		},
+	}
+	app.Action = verifyAction
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "keybaseca-sudo-verify: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func verifyAction(c *cli.Context) error {
+	// pam_exec sets PAM_RUSER to the user running sudo. PAM_USER is the target user (eg root).
+	username := os.Getenv("PAM_RUSER")
+	if username == "" {
+		return fmt.Errorf("PAM_RUSER is not set (keybaseca-sudo-verify must be run via pam_exec)")
+	}
+	caKeys, err := sudoverify.ReadCAPublicKeys(c.String("ca"))
+	if err != nil {
+		return err
+	}
+	socket, err := sudoverify.FindAgentSocket()
+	if err != nil {
+		return err
+	}
+	agentClient, closeAgent, err := sudoverify.ConnectToAgent(socket, username)
+	if err != nil {
+		return err
+	}
+	defer closeAgent()
+	cert, err := sudoverify.Verify(agentClient, sudoverify.Options{
+		CAPublicKeys:     caKeys,
+		Principal:        c.String("principal"),
+		RequireExtension: c.BoolT("require-extension"),
+		RevokedKeys:      c.String("revoked-keys"),
+	}, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "keybaseca-sudo-verify: authenticated %s with the certificate %s\n", username, cert.KeyId)
+	return nil
+}
@@ -1,29 +1,56 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/user"
+	"sort"
+	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/bot"
+	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"github.com/keybase/bot-sshca/src/keybaseca/canary"
 	"github.com/keybase/bot-sshca/src/keybaseca/constants"
 
 	"github.com/google/uuid"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/dualcontrol"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/keybaseca/inventory"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
 	klog "github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/keybaseca/release"
+	"github.com/keybase/bot-sshca/src/keybaseca/retention"
+	"github.com/keybase/bot-sshca/src/keybaseca/serversetup"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshdconfig"
 	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/keybaseca/store"
+	"github.com/keybase/bot-sshca/src/keybaseca/vault"
+	"github.com/keybase/bot-sshca/src/keybaseca/webhook"
+	"github.com/keybase/bot-sshca/src/kssh"
 	"github.com/keybase/bot-sshca/src/shared"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
 )
 
 var VersionNumber = "master"
 
 func main() {
+	// The audit log and webhooks are driven by the events published by the CA. Certificates are recorded in the
+	// issuance store on the signing path instead (see store.RecordIssuance).
+	events.Subscribe(klog.HandleEvent)
+	events.Subscribe(webhook.HandleEvent)
+
 	app := cli.NewApp()
 	app.Name = "keybaseca"
 	app.Usage = "An SSH CA built on top of Keybase"
@@ -57,18 +84,127 @@ func main() {
 			Action: generateAction,
 			Before: beforeAction,
 		},
+		{
+			Name:  "import-key",
+			Usage: "Use an existing private key (eg from a previous SSH CA) as the CA key so that servers that already trust it keep working",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "path",
+					Usage:    "The private key to import",
+					Required: true,
+				},
+				cli.StringFlag{
+					Name:  "passphrase-file",
+					Usage: "A file containing the passphrase of the private key if it is encrypted",
+				},
+				cli.StringFlag{
+					Name:  "vault-mount",
+					Usage: "The path of a HashiCorp Vault SSH secrets engine (eg ssh-client-signer) whose CA public key the private key must match. Vault never returns the private key so it must still be given with --path",
+				},
+				cli.StringFlag{
+					Name:   "vault-addr",
+					Usage:  "The address of the Vault server. The token and namespace are read from VAULT_TOKEN and VAULT_NAMESPACE",
+					EnvVar: "VAULT_ADDR",
+				},
+			},
+			Action: importKeyAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "issue-intermediate",
+			Usage: "Certify an intermediate CA key with the offline root CA key. Run on the machine that holds the root CA key, does not use the config",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "root-key",
+					Usage:    "The path to the root CA private key",
+					Required: true,
+				},
+				cli.StringFlag{
+					Name:     "public-key, pubkey",
+					Usage:    "The path to the intermediate CA public key (printed by `keybaseca rotate-intermediate`)",
+					Required: true,
+				},
+				cli.StringFlag{
+					Name:     "principals",
+					Usage:    "A comma separated list of the teams or team patterns that the intermediate CA key may issue certificates for. Eg `acme.ssh.prod,acme.ssh.prod.*`",
+					Required: true,
+				},
+				cli.StringFlag{
+					Name:  "validity",
+					Value: "+30d",
+					Usage: "How long the intermediate certificate is valid for, in the format of ssh-keygen -V",
+				},
+				cli.StringFlag{
+					Name:  "key-id",
+					Usage: "The key ID of the intermediate certificate. Defaults to keybaseca-intermediate:<date>",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Usage: "Write the certificate to this file rather than stdout",
+				},
+			},
+			Action: issueIntermediateAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "rotate-intermediate",
+			Usage: "Generate the next intermediate CA key, or with --cert install its certificate and start signing with it",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "cert",
+					Usage: "The intermediate certificate issued with `keybaseca issue-intermediate`. May also be a re-issued certificate for the current key",
+				},
+			},
+			Action: rotateIntermediateAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "threshold-split",
+			Usage: "Encrypt the CA key with a secret that is split between several keybaseca instances for threshold signing",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:     "shares",
+					Usage:    "The number of keybaseca instances to split the secret between",
+					Required: true,
+				},
+				cli.IntFlag{
+					Name:     "threshold",
+					Usage:    "The number of instances that must cooperate to sign a certificate",
+					Required: true,
+				},
+				cli.StringFlag{
+					Name:     "out-dir",
+					Usage:    "The directory to write the encrypted CA key and the shares to",
+					Required: true,
+				},
+			},
+			Action: thresholdSplitAction,
+			Before: beforeAction,
+		},
+		{
+			Name:   "default-messages",
+			Usage:  "Print the default user facing messages as JSON, to use as a starting point for MESSAGES_FILE",
+			Action: defaultMessagesAction,
+		},
 		{
 			Name:   "service",
 			Usage:  "Start the CA service in the foreground",
 			Action: serviceAction,
 			Before: beforeAction,
 		},
+		{
+			Name:      "lockdown",
+			Usage:     "Immediately stop (or resume) issuing certificates to everyone except BREAK_GLASS_USERS",
+			ArgsUsage: "on|off",
+			Action:    lockdownAction,
+			Before:    beforeAction,
+		},
 		{
 			Name:  "sign",
 			Usage: "Sign a given public key with all permissions without a dependency on Keybase",
 			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:     "public-key",
+					Name:     "public-key, pubkey",
 					Usage:    "The path to the public key you wish to sign. Eg `~/.ssh/id_rsa.pub`",
 					Required: true,
 				},
@@ -76,15 +212,421 @@ func main() {
 					Name:  "overwrite",
 					Usage: "Overwrite the existing certificate on the filesystem",
 				},
+				cli.BoolFlag{
+					Name:  "offline",
+					Usage: "Break-glass mode for when Keybase is down. Restricted to root and the owner of the CA key and recorded in the audit log",
+				},
+				cli.StringFlag{
+					Name:  "principals",
+					Usage: "With --offline, a comma separated subset of TEAMS to sign the key for. Defaults to all of them",
+				},
+				cli.DurationFlag{
+					Name:  "ttl",
+					Usage: "With --offline, how long the certificate is valid for. Eg `30m`. Defaults to KEY_EXPIRATION",
+				},
 			},
 			Action: signAction,
 			Before: beforeAction,
 		},
+		{
+			Name:  "test-sign",
+			Usage: "Run a signature request for the given user and teams through the CA's policy and sign a throwaway key without publishing anything. Meant for checking config changes in CI",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "as-user",
+					Usage:    "The Keybase username to sign the key for",
+					Required: true,
+				},
+				cli.StringSliceFlag{
+					Name:  "team",
+					Usage: "A team that the user is in. May be specified multiple times",
+				},
+				cli.BoolFlag{
+					Name:  "elevate",
+					Usage: "Request an elevated certificate",
+				},
+				cli.StringSliceFlag{
+					Name:  "extension",
+					Usage: "A custom extension of the form name=value to request (see ALLOWED_EXTENSIONS). May be specified multiple times",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the certificate details as JSON",
+				},
+			},
+			Action: testSignAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "verify-against-sshd",
+			Usage: "Sign a throwaway key for the given user and teams (like test-sign) and report whether the sshd configured by the given sshd_config would accept it",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "sshd-config",
+					Value: "/etc/ssh/sshd_config",
+					Usage: "The sshd_config to check against. Include directives and the files it references are read from this machine",
+				},
+				cli.StringFlag{
+					Name:     "as-user",
+					Usage:    "The Keybase username to sign the key for",
+					Required: true,
+				},
+				cli.StringSliceFlag{
+					Name:  "team",
+					Usage: "A team that the user is in. May be specified multiple times",
+				},
+				cli.StringFlag{
+					Name:  "login",
+					Value: "root",
+					Usage: "The user on the server to log in as",
+				},
+				cli.StringFlag{
+					Name:  "home",
+					Usage: "The home directory of --login, used for %h and relative paths. Looked up on this machine by default",
+				},
+				cli.BoolFlag{
+					Name:  "elevate",
+					Usage: "Request an elevated certificate",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the result as JSON",
+				},
+			},
+			Action: verifyAgainstSSHDAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "e2e-test",
+			Usage: "Run kssh's whole request, sign, and verify loop against the running CA bot with a throwaway key, and optionally log in to a test server with the certificate. Meant for checking a deployment. Must be run as a Keybase user other than the bot (eg a dedicated test account) since the bot ignores requests from itself",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "bot",
+					Usage: "The username of the CA bot to test. Defaults to KEYBASE_USERNAME",
+				},
+				cli.StringFlag{
+					Name:  "ssh",
+					Usage: "A [user@]host to log in to with the certificate (eg a test sshd container). Its host key must already be trusted since ssh is run non-interactively",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: kssh.DefaultRequestTimeout,
+					Usage: "How long to wait for the CA bot to respond",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the result as JSON",
+				},
+			},
+			Action: e2eTestAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "query",
+			Usage: "Search the certificates recorded in the ISSUANCE_STORE",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "user",
+					Usage: "Only show certificates issued to this Keybase user",
+				},
+				cli.StringFlag{
+					Name:  "principal",
+					Usage: "Only show certificates that include this principal",
+				},
+				cli.StringFlag{
+					Name:  "serial",
+					Usage: "Only show the certificate with this serial",
+				},
+				cli.StringFlag{
+					Name:  "request-hash",
+					Usage: "Only show the certificate issued for the signature request with this hash (its request-sha256@keybase.io extension)",
+				},
+				cli.StringFlag{
+					Name:  "cert",
+					Usage: "Only show the given certificate (eg one presented to a server) along with the signature request it was issued for",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Only show certificates issued at or after this time. Either RFC3339, a date (eg `2020-04-01`), or a duration before now (eg 24h)",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "Only show certificates issued before this time. Same format as --since",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Value: 100,
+					Usage: "The maximum number of certificates to show, most recent first. 0 for no limit",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Print the certificates as JSON",
+				},
+			},
+			Action: queryAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "purge",
+			Usage: "Purge audit data (the audit log and the ISSUANCE_STORE) for a user or that is older than AUDIT_RETENTION_DAYS",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "user",
+					Usage: "Purge every audit log entry that mentions this Keybase user and every certificate issued to them",
+				},
+				cli.StringFlag{
+					Name:  "reason",
+					Usage: "Used with --user. Recorded in the tombstones that replace the purged entries (eg a ticket number)",
+				},
+				cli.BoolFlag{
+					Name:  "expired",
+					Usage: "Purge audit data that is older than AUDIT_RETENTION_DAYS",
+				},
+			},
+			Action: purgeAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "generate-server-setup",
+			Usage: "Print a script (or cloud-init config) that configures an SSH server to trust this CA",
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "team",
+					Usage: "A team whose members may log in as --user. May be specified multiple times",
+				},
+				cli.StringFlag{
+					Name:  "user",
+					Value: "root",
+					Usage: "The user on the server that members of the teams may log in as",
+				},
+				cli.StringFlag{
+					Name:  "krl-url",
+					Usage: "If set, the server periodically downloads a key revocation list from this URL",
+				},
+				cli.StringFlag{
+					Name:  "sudo-principal",
+					Usage: "If set, configure sudo to accept an elevated certificate with this principal in place of a password (requires keybaseca-sudo-verify)",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "script",
+					Usage: "Either `script` or `cloud-init`",
+				},
+			},
+			Action: generateServerSetupAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "export-ca",
+			Usage: "Print the CA public key that servers must trust (the offline root CA key if INTERMEDIATE_CERT_LOCATION is set) in the given format",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format",
+					Value: sshutils.ExportFormatOpenSSH,
+					Usage: "One of `openssh`, `pem` (a PKIX public key, eg for HashiCorp Vault), `jwk`, or `sshd-snippet` (the sshd_config directives that trust the key)",
+				},
+				cli.StringFlag{
+					Name:  "out",
+					Usage: "Write the key to this file rather than printing it",
+				},
+			},
+			Action: exportCAAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "add-team",
+			Usage: "Add a team to the CA: check the bot's membership, update TEAMS, publish the kssh config, print the server setup, and announce it in the team. Prompts for anything not given as a flag",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "team",
+					Usage: "The team to add. Eg `acme.ssh.prod`",
+				},
+				cli.StringFlag{
+					Name:  "env-file",
+					Usage: "The env file with the keybaseca config (eg env.list or a systemd EnvironmentFile) to add the team to TEAMS in",
+				},
+				cli.StringFlag{
+					Name:  "user",
+					Value: "root",
+					Usage: "The user on the team's servers that its members may log in as",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "script",
+					Usage: "The format of the server setup, either `script` or `cloud-init`",
+				},
+				cli.StringFlag{
+					Name:  "setup-out",
+					Usage: "Write the server setup to this file rather than stdout",
+				},
+				cli.BoolFlag{
+					Name:  "no-announce",
+					Usage: "Do not announce the bot in the team",
+				},
+			},
+			Action: addTeamAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "reconcile",
+			Usage: "Delete kssh configs left behind in teams that are no longer configured",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "Only print the teams whose config would be deleted",
+				},
+			},
+			Action: reconcileAction,
+			Before: beforeAction,
+		},
+		{
+			Name:   "init",
+			Usage:  "Generate a new CA key if one does not exist and publish the kssh configs, then exit. Meant for init containers",
+			Action: initAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "healthcheck",
+			Usage: "Exit successfully if the running keybaseca service is healthy (requires HTTP_LISTEN_ADDRESS). Meant for Docker HEALTHCHECK",
+			Flags: []cli.Flag{
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 5 * time.Second,
+					Usage: "How long to wait for the service to respond",
+				},
+			},
+			Action: healthcheckAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "publish-release",
+			Usage: "Publish the kssh binaries built by buildAll.sh so that users can update via `kssh --self-update`",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "version",
+					Usage:    "The version of the release (eg the output of `cat VERSION`)",
+					Required: true,
+				},
+				cli.StringFlag{
+					Name:  "bin-dir",
+					Value: "bin",
+					Usage: "The directory containing the kssh binaries",
+				},
+			},
+			Action: publishReleaseAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "publish-inventory",
+			Usage: "Publish the hosts that members of a team can connect to so that kssh can list and tab-complete them",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:     "team",
+					Usage:    "The team whose hosts are listed in the inventory",
+					Required: true,
+				},
+				cli.StringFlag{
+					Name:     "file",
+					Usage:    "The hosts inventory. One host per line optionally followed by a description",
+					Required: true,
+				},
+			},
+			Action: publishInventoryAction,
+			Before: beforeAction,
+		},
+		{
+			Name:  "inventory",
+			Usage: "Manage the hosts inventories published for kssh",
+			Subcommands: []cli.Command{
+				{
+					Name:  "sync",
+					Usage: "Publish the hosts inventory of each team from the running cloud instances tagged with the team",
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "provider",
+							Usage: "The cloud provider to list instances from (aws, gcp, or azure). May be specified multiple times",
+						},
+						cli.StringFlag{
+							Name:  "tag",
+							Value: inventory.DefaultTag,
+							Usage: "The tag whose value is the team an instance belongs to. On GCP, a metadata entry or label",
+						},
+						cli.StringFlag{
+							Name:  "address",
+							Value: inventory.AddressPrivateIP,
+							Usage: "The address to publish for each instance: private-ip, public-ip, or name (the AWS instance ID or the GCP or Azure instance name)",
+						},
+						cli.StringFlag{
+							Name:  "aws-region",
+							Usage: "The AWS region to list instances in. Defaults to AWS_REGION or the CLI default",
+						},
+						cli.StringFlag{
+							Name:  "gcp-project",
+							Usage: "The GCP project to list instances in. Defaults to the CLI default",
+						},
+						cli.StringFlag{
+							Name:  "azure-resource-group",
+							Usage: "The Azure resource group to list instances in. Defaults to every resource group",
+						},
+						cli.DurationFlag{
+							Name:  "interval",
+							Usage: "Keep syncing at this interval (eg 15m) rather than syncing once",
+						},
+					},
+					Action: inventorySyncAction,
+					Before: beforeAction,
+				},
+			},
+		},
+		{
+			Name:  "canary",
+			Usage: "Manage canary certificates that alert the CA if anyone ever tries to use them",
+			Subcommands: []cli.Command{
+				{
+					Name:  "issue",
+					Usage: "Generate a key and sign a canary certificate for it to plant somewhere as a tripwire",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:     "name",
+							Usage:    "A unique description of where the canary will be planted. Included in alerts",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name:     "out",
+							Usage:    "Where to write the private key. The public key and certificate are written next to it",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name:     "principals",
+							Usage:    "A comma separated list of plausible looking principals that no server accepts",
+							Required: true,
+						},
+						cli.StringFlag{
+							Name:  "user",
+							Value: "deploy_bot",
+							Usage: "The decoy Keybase username included in the certificate's key ID",
+						},
+						cli.DurationFlag{
+							Name:  "ttl",
+							Usage: "How long the certificate is valid for. Defaults to a year",
+						},
+					},
+					Action: canaryIssueAction,
+					Before: beforeAction,
+				},
+				{
+					Name:   "list",
+					Usage:  "List the canary certificates that have been issued",
+					Action: canaryListAction,
+					Before: beforeAction,
+				},
+			},
+		},
 	}
 	app.Action = mainAction
 	err := app.Run(os.Args)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(shared.Redact(err.Error()))
 	}
 }
 
@@ -105,9 +647,10 @@ func backupAction(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	bytes, err := ioutil.ReadFile(conf.GetCAKeyLocation())
+	bytes, release, err := sshutils.ReadCAKey(conf)
+	defer release()
 	if err != nil {
-		return fmt.Errorf("Failed to load the CA key from %s: %v", conf.GetCAKeyLocation(), err)
+		return err
 	}
 	klog.Log(conf, "Exported CA key to stdout")
 	fmt.Println("\nKeep this key somewhere very safe. We recommend keeping a physical copy of it in a secure place.")
@@ -122,6 +665,10 @@ func generateAction(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	err = approveCAKeyReplacement(conf, "generate a new CA key")
+	if err != nil {
+		return err
+	}
 	err = sshutils.Generate(conf, strings.ToLower(os.Getenv("FORCE_WRITE")) == "true")
 	if err != nil {
 		return fmt.Errorf("Failed to generate a new key: %v", err)
@@ -129,41 +676,291 @@ func generateAction(c *cli.Context) error {
 	return nil
 }
 
-// The action for the `keybaseca service` subcommand
-func serviceAction(c *cli.Context) error {
+// The action for the `keybaseca import-key` subcommand
+func importKeyAction(c *cli.Context) error {
 	conf, err := loadServerConfig()
 	if err != nil {
 		return err
 	}
-	err = startCA(conf)
+	passphrase := ""
+	if c.String("passphrase-file") != "" {
+		bytes, err := ioutil.ReadFile(c.String("passphrase-file"))
+		if err != nil {
+			return fmt.Errorf("Failed to read the passphrase: %v", err)
+		}
+		passphrase = strings.TrimRight(string(bytes), "\r\n")
+	}
+	expectedPublicKey := ""
+	if c.String("vault-mount") != "" {
+		client := vault.Client{Address: c.String("vault-addr"), Token: os.Getenv("VAULT_TOKEN"), Namespace: os.Getenv("VAULT_NAMESPACE")}
+		expectedPublicKey, err = client.GetSSHCAPublicKey(c.String("vault-mount"))
+		if err != nil {
+			return fmt.Errorf("Failed to get the CA public key from Vault: %v", err)
+		}
+	}
+	err = approveCAKeyReplacement(conf, "import the CA key from "+c.String("path"))
 	if err != nil {
-		return fmt.Errorf("CA chatbot crashed: %v", err)
+		return err
+	}
+	publicKey, err := sshutils.ImportCAKey(conf, shared.ExpandPathWithTilde(c.String("path")), passphrase, expectedPublicKey,
+		strings.ToLower(os.Getenv("FORCE_WRITE")) == "true")
+	if err != nil {
+		return fmt.Errorf("Failed to import the key: %v", err)
 	}
+	fmt.Printf("Imported the CA key to %s. Servers that already trust this key do not need to be reconfigured:\n%s",
+		conf.GetCAKeyLocation(), publicKey)
+	fmt.Printf("Delete %s once you have checked that keybaseca works with the imported key.\n", c.String("path"))
 	return nil
 }
 
-func startCA(conf config.Config) error {
-	ca, err := bot.New(conf)
+// The action for the `keybaseca default-messages` subcommand
+func defaultMessagesAction(c *cli.Context) error {
+	bytes, err := json.MarshalIndent(shared.DefaultMessages, "", "  ")
 	if err != nil {
 		return err
 	}
-	fmt.Println("Starting CA bot...")
-	return ca.Start()
+	fmt.Println(string(bytes))
+	return nil
 }
 
-// The action for the `keybaseca sign` subcommand
-func signAction(c *cli.Context) error {
-	// Skip validation of the config since that relies on Keybase's servers
-	conf := config.EnvConfig{}
-	err := config.ValidateConfig(conf, true)
+// The action for the `keybaseca issue-intermediate` subcommand
+func issueIntermediateAction(c *cli.Context) error {
+	publicKey, err := ioutil.ReadFile(c.String("public-key"))
 	if err != nil {
-		return fmt.Errorf("Invalid config: %v", err)
+		return fmt.Errorf("Failed to read the intermediate CA public key: %v", err)
 	}
-	principals := strings.Join(conf.GetTeams(), ",")
-	expiration := conf.GetKeyExpiration()
-	randomUUID, err := uuid.NewRandom()
+	keyID := c.String("key-id")
+	if keyID == "" {
+		keyID = "keybaseca-intermediate:" + time.Now().UTC().Format("2006-01-02")
+	}
+	cert, err := sshutils.IssueIntermediate(shared.ExpandPathWithTilde(c.String("root-key")), keyID, c.String("principals"),
+		c.String("validity"), string(publicKey))
+	if err != nil {
+		return fmt.Errorf("Failed to issue the intermediate certificate: %v", err)
+	}
+	if c.String("out") == "" {
+		fmt.Print(cert)
+		return nil
+	}
+	err = ioutil.WriteFile(c.String("out"), []byte(cert), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write the intermediate certificate: %v", err)
+	}
+	fmt.Printf("Wrote the intermediate certificate to %s, install it with `keybaseca rotate-intermediate --cert %s`\n",
+		c.String("out"), c.String("out"))
+	return nil
+}
+
+// The action for the `keybaseca rotate-intermediate` subcommand
+func rotateIntermediateAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	if c.String("cert") == "" {
+		publicKey, err := sshutils.PrepareIntermediateRotation(conf, strings.ToLower(os.Getenv("FORCE_WRITE")) == "true")
+		if err != nil {
+			return fmt.Errorf("Failed to generate the next intermediate CA key: %v", err)
+		}
+		fmt.Printf("Generated the next intermediate CA key. Certify it on the machine that holds the root CA key with:\n\n"+
+			"  keybaseca issue-intermediate --root-key ROOT_KEY --principals TEAMS --out intermediate-cert.pub --pubkey next.pub\n\n"+
+			"where next.pub contains:\n\n%s\nthen run `keybaseca rotate-intermediate --cert intermediate-cert.pub` here.\n", publicKey)
+		return nil
+	}
+	contents, err := ioutil.ReadFile(c.String("cert"))
+	if err != nil {
+		return fmt.Errorf("Failed to read the intermediate certificate: %v", err)
+	}
+	intermediate, err := sshutils.InstallIntermediate(conf, string(contents), time.Now())
+	if err != nil {
+		return fmt.Errorf("Failed to install the intermediate certificate: %v", err)
+	}
+	klog.Log(conf, fmt.Sprintf("Installed the intermediate certificate %s for %s signed by the root CA key %s", intermediate.KeyId,
+		ssh.FingerprintSHA256(intermediate.Key), ssh.FingerprintSHA256(intermediate.SignatureKey)))
+	fmt.Printf("Installed the intermediate certificate %s valid until %s. Restart the CA service so that kssh picks up the new "+
+		"CA key.\n", intermediate.KeyId, time.Unix(int64(intermediate.ValidBefore), 0).Format(time.RFC3339))
+	return nil
+}
+
+// The action for the `keybaseca threshold-split` subcommand
+func thresholdSplitAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	err = sshutils.ThresholdSplit(conf, c.Int("shares"), c.Int("threshold"), c.String("out-dir"))
+	if err != nil {
+		return fmt.Errorf("Failed to split the CA key: %v", err)
+	}
+	klog.Log(conf, fmt.Sprintf("Split the CA key into %d threshold shares (threshold %d)", c.Int("shares"), c.Int("threshold")))
+	fmt.Printf("Wrote the encrypted CA key and %d shares to %s. Give each keybaseca instance a copy of ca-key and "+
+		"ca-key.pub and one share-N.json (set THRESHOLD_SHARE_LOCATION to it), then securely delete the original CA key "+
+		"and the other shares.\n", c.Int("shares"), c.String("out-dir"))
+	return nil
+}
+
+// The action for the `keybaseca service` subcommand
+func serviceAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	err = startCA(conf)
+	if err != nil {
+		return fmt.Errorf("CA chatbot crashed: %v", err)
+	}
+	return nil
+}
+
+func startCA(conf config.Config) error {
+	// Fail fast if the CA key is not usable rather than on the first signature request
+	err := checkCAKey(conf)
+	if err != nil {
+		return err
+	}
+	intermediate, err := sshutils.LoadIntermediateCert(conf, time.Now())
+	if err != nil {
+		return err
+	}
+	if intermediate != nil && sshutils.IntermediateExpiresSoon(intermediate, time.Now()) {
+		logrus.Warnf("The intermediate certificate %s expires at %s, rotate the intermediate CA key with `keybaseca "+
+			"rotate-intermediate`", intermediate.KeyId, time.Unix(int64(intermediate.ValidBefore), 0).Format(time.RFC3339))
+	}
+	ca, err := bot.New(conf)
+	if err != nil {
+		return err
+	}
+	events.Publish(conf, events.Event{Type: events.ConfigLoaded, Message: fmt.Sprintf("Starting keybaseca %s for the teams %v", VersionNumber, conf.GetTeams())})
+	fmt.Println("Starting CA bot...")
+	return ca.Start()
+}
+
+// Check that the CA key can be loaded. With threshold signing the CA key can only be decrypted with the shares of the
+// other instances so only this instance's share is checked, along with the CA key for the other teams if only
+// THRESHOLD_TEAMS are threshold signed. With Vault the CA public key is fetched from Vault.
+func checkCAKey(conf config.Config) error {
+	if conf.GetVaultSSHRole() != "" {
+		// Vault holds the CA key so only its public key is needed locally
+		_, err := sshutils.SyncVaultCAPublicKey(conf)
+		return err
+	}
+	if conf.GetThresholdShareLocation() != "" {
+		err := sshutils.CheckThresholdShare(conf)
+		if err != nil || len(conf.GetThresholdTeams()) == 0 {
+			return err
+		}
+	}
+	_, cleanup, err := sshutils.LoadCAKey(conf)
+	cleanup()
+	return err
+}
+
+// The action for the `keybaseca init` subcommand
+func initAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	_, err = os.Stat(conf.GetCAKeyLocation())
+	if conf.GetVaultSSHRole() != "" {
+		fmt.Printf("Using the CA key of the Vault role %s at %s\n", conf.GetVaultSSHRole(), conf.GetVaultAddress())
+	} else if os.IsNotExist(err) {
+		err = sshutils.Generate(conf, false)
+		if err != nil {
+			return fmt.Errorf("Failed to generate a new key: %v", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("Failed to check for an existing CA key at %s: %v", conf.GetCAKeyLocation(), err)
+	} else {
+		fmt.Printf("Using the existing CA key at %s\n", conf.GetCAKeyLocation())
+	}
+	// Make sure the key is usable before telling kssh clients about this bot
+	err = checkCAKey(conf)
+	if err != nil {
+		return err
+	}
+	cabot, err := bot.New(conf)
+	if err != nil {
+		return err
+	}
+	err = cabot.PublishClientConfigs()
+	if err != nil {
+		return fmt.Errorf("Failed to publish the kssh configs: %v", err)
+	}
+	fmt.Println("Published the kssh configs, keybaseca is ready to be started via `keybaseca service`")
+	return nil
+}
+
+// The action for the `keybaseca healthcheck` subcommand
+func healthcheckAction(c *cli.Context) error {
+	// Only HTTP_LISTEN_ADDRESS is needed so skip validation of the rest of the config
+	conf := config.EnvConfig{}
+	if conf.GetHTTPListenAddress() == "" {
+		return fmt.Errorf("HTTP_LISTEN_ADDRESS must be set in order to check the health of the service")
+	}
+	warnings, err := bot.GetHealthWarnings(conf.GetHTTPListenAddress(), c.Duration("timeout"))
+	if err != nil {
+		return fmt.Errorf("Unhealthy: %v", err)
+	}
+	fmt.Println("Healthy")
+	for _, warning := range warnings {
+		fmt.Printf("Warning: %s\n", warning)
+	}
+	return nil
+}
+
+// The action for the `keybaseca lockdown` subcommand
+func lockdownAction(c *cli.Context) error {
+	var enabled bool
+	switch c.Args().First() {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		return fmt.Errorf("Usage: keybaseca lockdown on|off")
+	}
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	changedBy := "local user " + getLocalUser()
+	if !enabled {
+		approvers, err := awaitApproval(conf, dualcontrol.LiftLockdown, "turn lockdown off")
+		if err != nil {
+			return err
+		}
+		if len(approvers) > 0 {
+			changedBy += " approved by " + strings.Join(approvers, " and ")
+		}
+	}
+	// The state is recorded before touching chat so that a lockdown takes effect even if Keybase is unavailable
+	state, err := lockdown.Set(conf, enabled, changedBy)
+	if err != nil {
+		return err
+	}
+	fmt.Println(lockdown.Notice(nil, state))
+
+	cabot, err := bot.New(conf)
+	if err == nil {
+		err = cabot.PublishLockdownNotice(state)
+	}
+	if err != nil {
+		return fmt.Errorf("Changed the lockdown state but failed to notify teams: %v", err)
+	}
+	return nil
+}
+
+// The action for the `keybaseca sign` subcommand
+func signAction(c *cli.Context) error {
+	if !c.Bool("offline") && (c.IsSet("principals") || c.IsSet("ttl")) {
+		return fmt.Errorf("--principals and --ttl may only be used with --offline")
+	}
+	// Skip validation of the config since that relies on Keybase's servers
+	conf := config.EnvConfig{}
+	err := config.ValidateConfig(conf, true)
 	if err != nil {
-		return fmt.Errorf("Failed to generate unique key ID: %v", err)
+		return fmt.Errorf("Invalid config: %v", err)
 	}
 
 	// Read the public key from the specified file
@@ -174,7 +971,45 @@ func signAction(c *cli.Context) error {
 	}
 
 	// Sign the public key
-	signature, err := sshutils.SignKey(conf.GetCAKeyLocation(), randomUUID.String()+":keybaseca-sign", principals, expiration, string(pubKey))
+	var signature string
+	if c.Bool("offline") && conf.GetVaultSSHRole() != "" {
+		return fmt.Errorf("--offline cannot be used with VAULT_SSH_ROLE since the CA key is held by Vault")
+	} else if c.Bool("offline") {
+		var principals []string
+		for _, principal := range strings.Split(c.String("principals"), ",") {
+			if strings.TrimSpace(principal) != "" {
+				principals = append(principals, strings.TrimSpace(principal))
+			}
+		}
+		signature, err = sshutils.SignKeyOffline(&conf, getLocalUser(), string(pubKey), principals, c.Duration("ttl"))
+	} else {
+		var randomUUID uuid.UUID
+		randomUUID, err = uuid.NewRandom()
+		if err != nil {
+			return fmt.Errorf("Failed to generate unique key ID: %v", err)
+		}
+		keyID := randomUUID.String() + ":keybaseca-sign"
+		principals := strings.Join(sshutils.GetLiteralTeams(&conf), ",")
+		expiration := sshutils.ValidityInterval(&conf, conf.GetKeyExpiration())
+		if conf.GetVaultSSHRole() != "" {
+			signature, err = sshutils.SignKeyWithVault(&conf, keyID, principals, expiration, string(pubKey))
+		} else {
+			var caKey sshutils.CAKey
+			var cleanup func()
+			caKey, cleanup, err = sshutils.LoadCAKey(&conf)
+			defer cleanup()
+			if err != nil {
+				return err
+			}
+			var chain []string
+			chain, err = sshutils.IntermediateOptions(&conf, principals)
+			if err != nil {
+				return err
+			}
+			signature, err = sshutils.SignKeyWithCAKey(caKey, sshutils.DefaultSignatureAlgorithm(&conf), keyID,
+				principals, expiration, string(pubKey), chain...)
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to sign key: %v", err)
 	}
@@ -195,6 +1030,490 @@ func signAction(c *cli.Context) error {
 	return nil
 }
 
+// The action for the `keybaseca test-sign` subcommand
+func testSignAction(c *cli.Context) error {
+	// Skip validation of the config since that relies on Keybase's servers
+	conf := config.EnvConfig{}
+	err := config.ValidateConfig(conf, true)
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	extensions := make(map[string]string)
+	for _, extension := range c.StringSlice("extension") {
+		name, value, err := shared.ParseExtension(extension)
+		if err != nil {
+			return fmt.Errorf("Invalid --extension: %v", err)
+		}
+		extensions[name] = value
+	}
+	result, err := sshutils.TestSign(&conf, c.String("as-user"), c.StringSlice("team"), c.Bool("elevate"), extensions)
+	if err != nil {
+		return fmt.Errorf("Failed to sign: %v", err)
+	}
+	if c.Bool("json") {
+		bytes, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	fmt.Printf("Key ID:              %s\n", result.KeyID)
+	fmt.Printf("Principals:          %s\n", strings.Join(result.Principals, ", "))
+	fmt.Printf("Valid:               %s to %s\n", result.ValidAfter.Format(time.RFC3339), result.ValidBefore.Format(time.RFC3339))
+	fmt.Printf("Extensions:          %s\n", strings.Join(result.Extensions, ", "))
+	if len(result.DeniedExtensions) > 0 {
+		fmt.Printf("Denied extensions:   %s\n", strings.Join(result.DeniedExtensions, ", "))
+	}
+	fmt.Printf("Signature algorithm: %s\n", result.SignatureAlgorithm)
+	fmt.Printf("Push approval:       %t\n", result.PushApprovalRequired)
+	return nil
+}
+
+// The action for the `keybaseca verify-against-sshd` subcommand
+func verifyAgainstSSHDAction(c *cli.Context) error {
+	// Skip validation of the config since that relies on Keybase's servers
+	conf := config.EnvConfig{}
+	err := config.ValidateConfig(conf, true)
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	sshdConfig, err := sshdconfig.Parse(c.String("sshd-config"))
+	if err != nil {
+		return fmt.Errorf("Failed to parse the sshd_config: %v", err)
+	}
+	caPublicKeyBytes, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetCAKeyLocation()))
+	if err != nil {
+		return fmt.Errorf("Failed to read the CA public key (run `keybaseca generate` first): %v", err)
+	}
+	caPublicKey, _, _, _, err := ssh.ParseAuthorizedKey(caPublicKeyBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse the CA public key: %v", err)
+	}
+	signed, err := sshutils.TestSign(&conf, c.String("as-user"), c.StringSlice("team"), c.Bool("elevate"), nil)
+	if err != nil {
+		return fmt.Errorf("Failed to sign: %v", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signed.Certificate))
+	if err != nil {
+		return fmt.Errorf("Failed to parse the signed certificate: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("Failed to parse the signed certificate: not a certificate")
+	}
+
+	result := sshdconfig.Verify(sshdConfig, sshdconfig.VerifyOptions{
+		Certificate: cert,
+		CAPublicKey: caPublicKey,
+		User:        c.String("login"),
+		HomeDir:     c.String("home"),
+		Now:         time.Now(),
+	})
+	if c.Bool("json") {
+		bytes, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+	} else {
+		fmt.Printf("Principals: %s\n", strings.Join(cert.ValidPrincipals, ", "))
+		for _, check := range result.Checks {
+			status := "ok  "
+			if !check.Passed {
+				status = "FAIL"
+			}
+			fmt.Printf("[%s] %-22s %s\n", status, check.Name, check.Message)
+		}
+		for _, warning := range result.Warnings {
+			fmt.Printf("Warning: %s\n", warning)
+		}
+	}
+	if !result.Accepted {
+		return fmt.Errorf("sshd would reject the certificate of %s when logging in as %s", c.String("as-user"), c.String("login"))
+	}
+	if !c.Bool("json") {
+		fmt.Printf("sshd would accept the certificate of %s when logging in as %s\n", c.String("as-user"), c.String("login"))
+	}
+	return nil
+}
+
+// The action for the `keybaseca e2e-test` subcommand
+func e2eTestAction(c *cli.Context) error {
+	botName := c.String("bot")
+	if botName == "" {
+		// Only the bot's username is needed so skip validation of the rest of the config
+		conf := config.EnvConfig{}
+		botName = conf.GetKeybaseUsername()
+	}
+	if botName == "" {
+		return fmt.Errorf("--bot must be specified since KEYBASE_USERNAME is not set")
+	}
+	requester, err := kssh.NewRequester()
+	if err != nil {
+		return err
+	}
+	requester.Timeout = c.Duration("timeout")
+	if !c.Bool("json") {
+		requester.OnProgress = func(step string) {
+			fmt.Printf("%s...\n", step)
+		}
+	}
+	result, err := kssh.SmokeTest(&requester, botName, c.String("ssh"))
+	if err != nil {
+		return fmt.Errorf("End to end test of %s failed: %v", botName, err)
+	}
+	if c.Bool("json") {
+		bytes, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	fmt.Printf("Key ID:     %s\n", result.KeyID)
+	fmt.Printf("Principals: %s\n", strings.Join(result.Principals, ", "))
+	fmt.Printf("Valid:      %s to %s\n", result.ValidAfter, result.ValidBefore)
+	if result.SSHDestination != "" {
+		fmt.Printf("Logged in to %s with the certificate\n", result.SSHDestination)
+	}
+	fmt.Printf("End to end test of %s passed\n", result.BotName)
+	return nil
+}
+
+// The action for the `keybaseca query` subcommand
+func queryAction(c *cli.Context) error {
+	// Only ISSUANCE_STORE is needed so skip validation of the rest of the config
+	conf := config.EnvConfig{}
+	if conf.GetIssuanceStore() == "" {
+		return fmt.Errorf("ISSUANCE_STORE must be set in order to query issued certificates")
+	}
+	filter := store.Filter{Username: c.String("user"), Principal: c.String("principal"), Limit: c.Int("limit")}
+	if c.String("serial") != "" {
+		serial, err := strconv.ParseUint(c.String("serial"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("--serial must be a number, got %s", c.String("serial"))
+		}
+		filter.Serial = &serial
+	}
+	filter.RequestHash = c.String("request-hash")
+	if c.String("cert") != "" {
+		cert, err := readCertificate(c.String("cert"))
+		if err != nil {
+			return err
+		}
+		filter.Serial = &cert.Serial
+		filter.RequestHash = cert.Extensions[shared.RequestHashExtension]
+	}
+	var err error
+	now := time.Now()
+	if c.String("since") != "" {
+		filter.Since, err = parseQueryTime(c.String("since"), now)
+		if err != nil {
+			return fmt.Errorf("Invalid --since: %v", err)
+		}
+	}
+	if c.String("until") != "" {
+		filter.Until, err = parseQueryTime(c.String("until"), now)
+		if err != nil {
+			return fmt.Errorf("Invalid --until: %v", err)
+		}
+	}
+	s, err := store.Open(conf.GetIssuanceStore())
+	if err != nil {
+		return err
+	}
+	records, err := s.Query(filter)
+	if err != nil {
+		return fmt.Errorf("Failed to query the issuance store: %v", err)
+	}
+	if filter.RequestHash != "" {
+		for _, r := range records {
+			if err := r.VerifyRequest(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}
+	}
+	if c.Bool("json") {
+		if records == nil {
+			records = []store.Record{}
+		}
+		bytes, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ISSUED\tUSER\tPRINCIPALS\tSERIAL\tVALID BEFORE\tKEY ID")
+	for _, r := range records {
+		user := r.Username
+		if r.Offline {
+			user += " (offline)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n", r.IssuedAt.Format(time.RFC3339), user, strings.Join(r.Principals, ","),
+			r.Serial, r.ValidBefore.Format(time.RFC3339), r.KeyID)
+	}
+	err = w.Flush()
+	if err != nil || filter.RequestHash == "" {
+		return err
+	}
+	// The request is only shown when looking up a specific request since it is long
+	for _, r := range records {
+		fmt.Printf("\nSignature request %s:\n%s\n", r.RequestHash, r.Request)
+	}
+	return nil
+}
+
+// Read the certificate passed to `keybaseca query --cert` in authorized_keys format (eg a -cert.pub file)
+func readCertificate(filename string) (*ssh.Certificate, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the certificate: %v", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(contents)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse the certificate: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", filename)
+	}
+	return cert, nil
+}
+
+// Parse a time passed to `keybaseca query`. Either RFC3339, a date, or a duration before now.
+func parseQueryTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("'%s' is not an RFC3339 time, a date, or a duration", value)
+}
+
+// The action for the `keybaseca purge` subcommand
+func purgeAction(c *cli.Context) error {
+	if c.String("user") == "" && !c.Bool("expired") {
+		return fmt.Errorf("Either --user or --expired is required")
+	}
+	if c.String("user") != "" && c.String("reason") == "" {
+		return fmt.Errorf("--reason is required with --user")
+	}
+	// Skip validation of the config since that relies on Keybase's servers
+	conf := config.EnvConfig{}
+	err := config.ValidateConfig(conf, true)
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	if c.Bool("expired") && conf.GetAuditRetention() == 0 {
+		return fmt.Errorf("AUDIT_RETENTION_DAYS must be set in order to purge expired audit data")
+	}
+	if c.Bool("expired") {
+		_, err = awaitApproval(&conf, dualcontrol.PurgeAuditData, "purge expired audit data")
+		if err != nil {
+			return err
+		}
+		result, err := retention.PurgeExpired(&conf, time.Now())
+		if err != nil {
+			return fmt.Errorf("Failed to purge expired audit data: %v", err)
+		}
+		fmt.Printf("Purged %d expired audit log entries and %d issuance records\n", result.AuditLogEntries, result.IssuanceRecords)
+	}
+	if c.String("user") != "" {
+		_, err = awaitApproval(&conf, dualcontrol.PurgeAuditData, fmt.Sprintf("purge the audit data of %s (reason: %s)",
+			c.String("user"), c.String("reason")))
+		if err != nil {
+			return err
+		}
+		result, err := retention.PurgeUser(&conf, c.String("user"), c.String("reason"))
+		if err != nil {
+			return fmt.Errorf("Failed to purge audit data for %s: %v", c.String("user"), err)
+		}
+		fmt.Printf("Purged %d audit log entries and %d issuance records for %s\n", result.AuditLogEntries, result.IssuanceRecords, c.String("user"))
+	}
+	return nil
+}
+
+// The action for the `keybaseca generate-server-setup` subcommand
+func generateServerSetupAction(c *cli.Context) error {
+	// Only the CA public key and the teams are needed so skip validation that relies on Keybase's servers
+	conf := config.EnvConfig{}
+	err := config.ValidateConfig(conf, true)
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	teams := c.StringSlice("team")
+	if len(teams) == 0 {
+		return fmt.Errorf("At least one --team must be specified")
+	}
+	for _, team := range teams {
+		if len(shared.MatchTeams(conf.GetTeams(), []string{team})) == 0 {
+			return fmt.Errorf("Team '%s' does not match any of the configured teams (%s)", team, strings.Join(conf.GetTeams(), ","))
+		}
+	}
+	caPublicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetCAKeyLocation()))
+	if err != nil {
+		return fmt.Errorf("Failed to read the CA public key (run `keybaseca generate` first): %v", err)
+	}
+	opts := serversetup.Options{CAPublicKey: string(caPublicKey), Teams: teams, User: c.String("user"),
+		KRLURL: c.String("krl-url"), SudoPrincipal: c.String("sudo-principal")}
+
+	var output string
+	switch c.String("format") {
+	case "script":
+		output, err = serversetup.GenerateScript(opts)
+	case "cloud-init":
+		output, err = serversetup.GenerateCloudInit(opts)
+	default:
+		return fmt.Errorf("Unknown format '%s', expected script or cloud-init", c.String("format"))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to generate the server setup: %v", err)
+	}
+	fmt.Print(output)
+	return nil
+}
+
+// The action for the `keybaseca export-ca` subcommand
+func exportCAAction(c *cli.Context) error {
+	// Only the CA public key is needed so skip validation that relies on Keybase's servers
+	conf := config.EnvConfig{}
+	err := config.ValidateConfig(conf, true)
+	if err != nil {
+		return fmt.Errorf("Invalid config: %v", err)
+	}
+	caPublicKey, err := sshutils.GetTrustedCAPublicKey(&conf)
+	if err != nil {
+		return err
+	}
+	output, err := sshutils.ExportPublicKey(caPublicKey, c.String("format"))
+	if err != nil {
+		return fmt.Errorf("Failed to export the CA public key: %v", err)
+	}
+	if c.String("out") == "" {
+		fmt.Print(output)
+		return nil
+	}
+	err = ioutil.WriteFile(c.String("out"), []byte(output), 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to write the CA public key to %s: %v", c.String("out"), err)
+	}
+	return nil
+}
+
+// The action for the `keybaseca add-team` subcommand
+func addTeamAction(c *cli.Context) error {
+	team := c.String("team")
+	envFile := c.String("env-file")
+	if team == "" {
+		// Interactive mode
+		reader := bufio.NewReader(os.Stdin)
+		team = prompt(reader, "Team to add (eg acme.ssh.prod): ")
+		if envFile == "" {
+			envFile = prompt(reader, "Env file with the keybaseca config to add it to (leave empty to update TEAMS yourself): ")
+		}
+	}
+	if team == "" {
+		return fmt.Errorf("A team must be specified with --team")
+	}
+	if err := shared.ValidateTeamPattern(team); err != nil || strings.Contains(team, "*") {
+		return fmt.Errorf("'%s' is not a valid team name", team)
+	}
+
+	conf := config.EnvConfig{}
+	err := config.ValidateConfig(conf, false)
+	if err != nil {
+		return fmt.Errorf("Failed to validate the current config: %v", err)
+	}
+	cabot, err := bot.New(&conf)
+	if err != nil {
+		return err
+	}
+	err = cabot.CheckTeamMembership(team)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s is a member of %s\n", conf.GetKeybaseUsername(), team)
+
+	if len(shared.MatchTeams(conf.GetTeams(), []string{team})) > 0 {
+		fmt.Printf("%s is already in TEAMS\n", team)
+	} else {
+		// EnvConfig reads the environment on every call so this adds the team for the rest of this command
+		os.Setenv("TEAMS", strings.Join(append(conf.GetTeams(), team), ","))
+		err = config.ValidateConfig(conf, false)
+		if err != nil {
+			return fmt.Errorf("The config is not valid once %s is added: %v", team, err)
+		}
+		if envFile != "" {
+			_, err = config.AddTeamToEnvFile(envFile, team)
+			if err != nil {
+				return fmt.Errorf("Failed to add %s to %s: %v", team, envFile, err)
+			}
+			fmt.Printf("Added %s to TEAMS in %s\n", team, envFile)
+		} else {
+			fmt.Printf("Add %s to TEAMS in the keybaseca config, otherwise its kssh config is deleted again when the "+
+				"CA service restarts\n", team)
+		}
+		klog.Log(&conf, fmt.Sprintf("Local user %s added the team %s", getLocalUser(), team))
+	}
+
+	err = cabot.PublishClientConfigs()
+	if err != nil {
+		return fmt.Errorf("Failed to publish the kssh configs: %v", err)
+	}
+	fmt.Printf("Published the kssh config and CA public key to %s\n", team)
+
+	caPublicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetCAKeyLocation()))
+	if err != nil {
+		return fmt.Errorf("Failed to read the CA public key: %v", err)
+	}
+	opts := serversetup.Options{CAPublicKey: string(caPublicKey), Teams: []string{team}, User: c.String("user")}
+	var setup string
+	switch c.String("format") {
+	case "script":
+		setup, err = serversetup.GenerateScript(opts)
+	case "cloud-init":
+		setup, err = serversetup.GenerateCloudInit(opts)
+	default:
+		return fmt.Errorf("Unknown format '%s', expected script or cloud-init", c.String("format"))
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to generate the server setup: %v", err)
+	}
+	if c.String("setup-out") != "" {
+		err = ioutil.WriteFile(c.String("setup-out"), []byte(setup), 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to write the server setup: %v", err)
+		}
+		fmt.Printf("Wrote the server setup to %s, run it on each of the team's servers\n", c.String("setup-out"))
+	} else {
+		fmt.Printf("Run the following on each of the team's servers (see also `keybaseca generate-server-setup`):\n\n%s\n", setup)
+	}
+
+	if !c.Bool("no-announce") {
+		err = cabot.AnnounceTeam(team)
+		if err != nil {
+			return fmt.Errorf("Failed to announce the bot in %s: %v", team, err)
+		}
+		fmt.Printf("Announced the bot in %s\n", team)
+	}
+	fmt.Println("Restart the CA service so that it starts answering requests from the team")
+	return nil
+}
+
+// Print the given question and read a line from reader
+func prompt(reader *bufio.Reader, question string) string {
+	fmt.Print(question)
+	answer, _ := reader.ReadString('\n')
+	return strings.TrimSpace(answer)
+}
+
 // A global before action that handles the --debug flag by setting the logrus logging level
 func beforeAction(c *cli.Context) error {
 	if c.GlobalBool("debug") {
@@ -203,6 +1522,171 @@ func beforeAction(c *cli.Context) error {
 	return nil
 }
 
+// The action for the `keybaseca reconcile` subcommand
+func reconcileAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	cabot, err := bot.New(conf)
+	if err != nil {
+		return err
+	}
+	stale, err := cabot.ReconcileClientConfigs(c.Bool("dry-run"))
+	if err != nil {
+		return fmt.Errorf("Failed to reconcile client configs: %v", err)
+	}
+	switch {
+	case len(stale) == 0:
+		fmt.Println("No stale kssh configs found")
+	case c.Bool("dry-run"):
+		fmt.Printf("Would delete the kssh configs for the teams: %s\n", strings.Join(stale, ", "))
+	default:
+		fmt.Printf("Deleted the kssh configs for the teams: %s\n", strings.Join(stale, ", "))
+	}
+	return nil
+}
+
+// The action for the `keybaseca publish-release` subcommand
+func publishReleaseAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	api, err := botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
+	if err != nil {
+		return err
+	}
+	signer := release.Signer{KeybaseBinaryPath: "keybase", HomeDir: conf.GetKeybaseHomeDir()}
+	manifest, err := release.Publish(constants.GetDefaultKBFSOperationsStruct(), signer, api.GetUsername(), c.String("version"), c.String("bin-dir"))
+	if err != nil {
+		return fmt.Errorf("Failed to publish the release: %v", err)
+	}
+	var platforms []string
+	for platform := range manifest.Binaries {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	klog.Log(conf, fmt.Sprintf("Published kssh %s for %s", manifest.Version, strings.Join(platforms, ", ")))
+	fmt.Printf("Published kssh %s for %s to %s. Users can update via `kssh --self-update`\n",
+		manifest.Version, strings.Join(platforms, ", "), shared.ReleaseDirectory(api.GetUsername()))
+	return nil
+}
+
+// The action for the `keybaseca publish-inventory` subcommand
+func publishInventoryAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	team := c.String("team")
+	if shared.IsTeamPattern(team) || len(shared.MatchTeams(conf.GetTeams(), []string{team})) == 0 {
+		return fmt.Errorf("Team '%s' does not match any of the configured teams (%s)", team, strings.Join(conf.GetTeams(), ","))
+	}
+	contents, err := ioutil.ReadFile(c.String("file"))
+	if err != nil {
+		return fmt.Errorf("Failed to read the hosts inventory: %v", err)
+	}
+	hosts, err := shared.ParseInventory(string(contents))
+	if err != nil {
+		return err
+	}
+	_, err = botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
+	if err != nil {
+		return err
+	}
+	err = constants.GetDefaultKBFSOperationsStruct().Write(shared.InventoryPath(team), string(contents), false)
+	if err != nil {
+		return fmt.Errorf("Failed to publish the hosts inventory: %v", err)
+	}
+	klog.Log(conf, fmt.Sprintf("Published a hosts inventory with %d hosts for team %s", len(hosts), team))
+	fmt.Printf("Published %d hosts to %s. Users can list them via `kssh --list-hosts`\n", len(hosts), shared.InventoryPath(team))
+	return nil
+}
+
+// The action for the `keybaseca inventory sync` subcommand
+func inventorySyncAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	if len(c.StringSlice("provider")) == 0 {
+		return fmt.Errorf("At least one --provider must be specified")
+	}
+	opts := inventory.Options{Providers: c.StringSlice("provider"), Tag: c.String("tag"), Address: c.String("address"),
+		AWSRegion: c.String("aws-region"), GCPProject: c.String("gcp-project"), AzureResourceGroup: c.String("azure-resource-group")}
+	if opts.AWSRegion == "" {
+		opts.AWSRegion = conf.GetAWSRegion()
+	}
+	_, err = botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
+	if err != nil {
+		return err
+	}
+	interval := c.Duration("interval")
+	for {
+		counts, err := inventory.Sync(conf, opts)
+		if err != nil && interval == 0 {
+			return fmt.Errorf("Failed to sync the hosts inventories: %v", err)
+		} else if err != nil {
+			klog.Log(conf, fmt.Sprintf("Failed to sync the hosts inventories: %v", err))
+		}
+		var teams []string
+		for team := range counts {
+			teams = append(teams, team)
+		}
+		sort.Strings(teams)
+		for _, team := range teams {
+			klog.Log(conf, fmt.Sprintf("Synced a hosts inventory with %d hosts for team %s from %s", counts[team], team,
+				strings.Join(opts.Providers, ",")))
+		}
+		if interval == 0 {
+			fmt.Printf("Synced the hosts inventories of %d teams. Users can list them via `kssh --list-hosts`\n", len(teams))
+			return nil
+		}
+		time.Sleep(interval)
+	}
+}
+
+// The action for the `keybaseca canary issue` subcommand
+func canaryIssueAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	var principals []string
+	for _, principal := range strings.Split(c.String("principals"), ",") {
+		if strings.TrimSpace(principal) != "" {
+			principals = append(principals, strings.TrimSpace(principal))
+		}
+	}
+	keyPath := shared.ExpandPathWithTilde(c.String("out"))
+	issued, err := canary.Issue(conf, c.String("name"), "local user "+getLocalUser(), c.String("user"), principals, c.Duration("ttl"), keyPath)
+	if err != nil {
+		return fmt.Errorf("Failed to issue the canary: %v", err)
+	}
+	fmt.Printf("Wrote the canary %s (keyID:%s) to %s and %s. It is valid until %s.\n", issued.Name, issued.KeyID,
+		keyPath, shared.KeyPathToCert(keyPath), issued.ValidBefore.Format(time.RFC3339))
+	fmt.Printf("Servers only alert on it if kssh-authcheck is run with --canaries %s (see docs/authcheck.md).\n", conf.GetCanaryLocation())
+	return nil
+}
+
+// The action for the `keybaseca canary list` subcommand
+func canaryListAction(c *cli.Context) error {
+	conf, err := loadServerConfig()
+	if err != nil {
+		return err
+	}
+	list, err := canary.Read(conf)
+	if err != nil {
+		return err
+	}
+	for _, issued := range list.Canaries {
+		fmt.Printf("%s\tkeyID:%s\tserial:%d\tissued %s by %s\tvalid until %s\n", issued.Name, issued.KeyID, issued.Serial,
+			issued.IssuedAt.Format(time.RFC3339), issued.IssuedBy, issued.ValidBefore.Format(time.RFC3339))
+	}
+	return nil
+}
+
 // The action for the `keybaseca` command. Only used for hidden and unlisted flags.
 func mainAction(c *cli.Context) error {
 	switch {
@@ -220,6 +1704,10 @@ func mainAction(c *cli.Context) error {
 			return err
 		}
 		logLocation := conf.GetLogLocation()
+		_, err = awaitApproval(conf, dualcontrol.PurgeAuditData, "delete the audit log at "+logLocation)
+		if err != nil {
+			return err
+		}
 		if strings.HasPrefix(logLocation, "/keybase/") {
 			err = constants.GetDefaultKBFSOperationsStruct().Delete(logLocation)
 			if err != nil {
@@ -238,6 +1726,40 @@ func mainAction(c *cli.Context) error {
 	return nil
 }
 
+// Wait for the given operation to be approved by two admins in chat if DUAL_CONTROL is enabled. Returns the admins who
+// approved it, or nil if no approval was needed.
+func awaitApproval(conf config.Config, operation dualcontrol.Operation, description string) ([]string, error) {
+	if !dualcontrol.IsRequired(conf) {
+		return nil, nil
+	}
+	request, err := dualcontrol.NewRequest(conf, operation, description, "local user "+getLocalUser(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	cabot, err := bot.New(conf)
+	if err != nil {
+		return nil, fmt.Errorf("DUAL_CONTROL is enabled but failed to start Keybase chat to ask for approval: %v", err)
+	}
+	err = cabot.AwaitApproval(request)
+	if err != nil {
+		return nil, fmt.Errorf("Refusing to %s: %v", description, err)
+	}
+	return request.Approvers(), nil
+}
+
+// Replacing an existing CA key with FORCE_WRITE destroys it so it needs approval if DUAL_CONTROL is enabled. Creating
+// the first CA key does not.
+func approveCAKeyReplacement(conf config.Config, description string) error {
+	if strings.ToLower(os.Getenv("FORCE_WRITE")) != "true" {
+		return nil
+	}
+	if _, err := os.Stat(conf.GetCAKeyLocation()); err != nil {
+		return nil
+	}
+	_, err := awaitApproval(conf, dualcontrol.ReplaceCAKey, description+", overwriting the CA key at "+conf.GetCAKeyLocation())
+	return err
+}
+
 func deleteAllClientConfigs(conf config.Config) error {
 	cabot, err := bot.New(conf)
 	if err != nil {
@@ -246,6 +1768,15 @@ func deleteAllClientConfigs(conf config.Config) error {
 	return cabot.DeleteAllClientConfigs()
 }
 
+// Get the name of the OS user running keybaseca for the audit log
+func getLocalUser() string {
+	u, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+	return u.Username
+}
+
 // Load and validate a server config object from the environment
 func loadServerConfig() (config.Config, error) {
 	conf := config.EnvConfig{}
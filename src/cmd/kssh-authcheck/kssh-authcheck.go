@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/authcheck"
+	"github.com/keybase/bot-sshca/src/keybaseca/sudoverify"
+
+	"github.com/urfave/cli"
+)
+
+var VersionNumber = "master"
+
+// kssh-authcheck is run by sshd as its AuthorizedPrincipalsCommand. It prints the principals accepted for the user
+// (read from their AuthorizedPrincipalsFile) if the certificate has not been revoked via the KRL or a lockdown since
+// it was issued, and prints nothing (so that sshd rejects the certificate) otherwise. With --root-ca it is run as the
+// AuthorizedKeysCommand and prints a cert-authority line for the intermediate CA key that signed the certificate
+// instead. See docs/authcheck.md.
+func main() {
+	app := cli.NewApp()
+	app.Name = "kssh-authcheck"
+	app.Usage = "Check keybaseca certificates against the current KRL and lockdown state (run as sshd's AuthorizedPrincipalsCommand)"
+	app.ArgsUsage = "%t %k"
+	app.Version = VersionNumber
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "principals-file",
+			Usage: "The AuthorizedPrincipalsFile of the user (eg /etc/ssh/auth_principals/%u)",
+		},
+		cli.StringFlag{
+			Name:  "root-ca",
+			Usage: "A file with the offline root CA public keys. Run as sshd's AuthorizedKeysCommand and accept certificates signed by an intermediate CA key certified by one of them",
+		},
+		cli.StringFlag{
+			Name:  "krl",
+			Usage: "The KRL as a file (which may be in /keybase/) or an https URL",
+		},
+		cli.StringFlag{
+			Name:  "lockdown",
+			Usage: "The lockdown state written by keybaseca (its LOCKDOWN_LOCATION) as a file or an https URL",
+		},
+		cli.StringFlag{
+			Name:  "break-glass-users",
+			Usage: "A comma separated list of users whose certificates are accepted during a lockdown",
+		},
+		cli.DurationFlag{
+			Name:  "max-age",
+			Usage: "Reject certificates that became valid longer ago than this (eg 12h)",
+		},
+		cli.StringFlag{
+			Name:  "cache-dir",
+			Value: "/var/cache/kssh-authcheck",
+			Usage: "Where the last copies of the KRL and lockdown state are kept for use during outages",
+		},
+		cli.BoolFlag{
+			Name:  "fail-open",
+			Usage: "Accept certificates if the KRL or lockdown state cannot be read and there is no cached copy",
+		},
+		cli.StringFlag{
+			Name:  "canaries",
+			Usage: "The list of canary certificates written by keybaseca (its CANARY_LOCATION) as a file or an https URL",
+		},
+		cli.StringFlag{
+			Name:  "canary-alert-url",
+			Usage: "The URL of the CA's /canary endpoint (eg http://ca.internal:8080/canary) to report canary certificates to",
+		},
+		cli.StringFlag{
+			Name:  "user",
+			Usage: "The user logging in (%u), included in canary alerts",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 5 * time.Second,
+			Usage: "How long to wait for the KRL and lockdown state",
+		},
+	}
+	app.Action = checkAction
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kssh-authcheck: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func checkAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return fmt.Errorf("expected the key type and key as arguments (AuthorizedPrincipalsCommand ... %%t %%k)")
+	}
+	if c.String("principals-file") == "" {
+		return fmt.Errorf("--principals-file is required")
+	}
+	cert, err := authcheck.ParseCertificate(c.Args().Get(0), c.Args().Get(1))
+	if err != nil {
+		return err
+	}
+	var breakGlassUsers []string
+	for _, user := range strings.Split(c.String("break-glass-users"), ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			breakGlassUsers = append(breakGlassUsers, user)
+		}
+	}
+	err = authcheck.Check(cert, authcheck.Options{
+		KRLLocation:      c.String("krl"),
+		LockdownLocation: c.String("lockdown"),
+		BreakGlassUsers:  breakGlassUsers,
+		MaxAge:           c.Duration("max-age"),
+		CacheDir:         c.String("cache-dir"),
+		FailOpen:         c.Bool("fail-open"),
+		Timeout:          c.Duration("timeout"),
+		CanaryLocation:   c.String("canaries"),
+		CanaryAlertURL:   c.String("canary-alert-url"),
+		User:             c.String("user"),
+	}, time.Now())
+	if err != nil {
+		return err
+	}
+	principals, err := authcheck.ReadPrincipals(c.String("principals-file"))
+	if err != nil {
+		return err
+	}
+	if c.String("root-ca") != "" {
+		roots, err := sudoverify.ReadCAPublicKeys(c.String("root-ca"))
+		if err != nil {
+			return err
+		}
+		line, err := authcheck.AuthorizedKey(cert, roots, principals, time.Now())
+		if err != nil {
+			return err
+		}
+		fmt.Println(line)
+		return nil
+	}
+	for _, principal := range principals {
+		fmt.Println(principal)
+	}
+	return nil
+}
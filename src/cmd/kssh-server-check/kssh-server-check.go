@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/authcheck"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshdconfig"
+
+	"github.com/urfave/cli"
+)
+
+var VersionNumber = "master"
+
+// The exit code used when the server has drifted from the published CA key, so that monitoring can tell drift apart
+// from the check itself failing (exit code 1)
+const exitDrifted = 2
+
+// kssh-server-check is run periodically on servers (eg from cron or a monitoring agent) to check that sshd still
+// trusts the CA key that keybaseca currently publishes. It is meant to be run as a user logged into a read-only
+// Keybase bot account that can read the published CA key in KBFS. See docs/authcheck.md.
+func main() {
+	app := cli.NewApp()
+	app.Name = "kssh-server-check"
+	app.Usage = "Check that sshd's TrustedUserCAKeys includes the CA key published by keybaseca"
+	app.Version = VersionNumber
+	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:  "sshd-config",
+			Value: "/etc/ssh/sshd_config",
+			Usage: "The sshd_config file to check",
+		},
+		cli.StringFlag{
+			Name:  "published-key",
+			Usage: "The CA public key published by keybaseca (ca.pub in a CONFIG_MIRRORS folder, or a kssh config) as a file (which may be in /keybase/) or an https URL",
+		},
+		cli.BoolFlag{
+			Name:  "strict",
+			Usage: "Also report drift if TrustedUserCAKeys trusts any key other than the published CA key (eg the key from before a rotation)",
+		},
+		cli.StringFlag{
+			Name:  "alert-url",
+			Usage: "A URL that the result is POSTed to as JSON if the server has drifted",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the result as JSON",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Value: 10 * time.Second,
+			Usage: "How long to wait for the published key and the alert URL",
+		},
+	}
+	app.Action = checkAction
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kssh-server-check: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// The body POSTed to --alert-url
+type alert struct {
+	Host   string                 `json:"host"`
+	Result sshdconfig.DriftResult `json:"result"`
+}
+
+func checkAction(c *cli.Context) error {
+	if c.String("published-key") == "" {
+		return fmt.Errorf("--published-key is required")
+	}
+	contents, err := authcheck.Fetch(c.String("published-key"), c.Duration("timeout"))
+	if err != nil {
+		return fmt.Errorf("failed to read the published CA key from %s: %v", c.String("published-key"), err)
+	}
+	published, err := sshdconfig.ParsePublishedCAKey(contents)
+	if err != nil {
+		return err
+	}
+	conf, err := sshdconfig.Parse(c.String("sshd-config"))
+	if err != nil {
+		return err
+	}
+	result := sshdconfig.CheckDrift(conf, published, c.Bool("strict"))
+
+	if c.Bool("json") {
+		encoded, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(encoded))
+	} else {
+		fmt.Println(result.Message)
+	}
+	if !result.Drifted {
+		return nil
+	}
+	if c.String("alert-url") != "" {
+		host, _ := os.Hostname()
+		err = sendAlert(c.String("alert-url"), alert{Host: host, Result: result}, c.Duration("timeout"))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kssh-server-check: failed to send the alert: %v\n", err)
+		}
+	}
+	os.Exit(exitDrifted)
+	return nil
+}
+
+func sendAlert(url string, a alert, timeout time.Duration) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
@@ -1,107 +1,695 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
 	"time"
 
-	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
-
-	"github.com/google/uuid"
 	"github.com/keybase/bot-sshca/src/kssh"
 	"github.com/keybase/bot-sshca/src/shared"
 	log "github.com/sirupsen/logrus"
-
-	"golang.org/x/crypto/ssh"
 )
 
 func main() {
 	kssh.InitLogging()
-	botName, remainingArgs, action, err := handleArgs(os.Args[1:])
+	opts, remainingArgs, err := handleArgs(os.Args[1:])
+	if err != nil {
+		exitWithError(opts, ExitUsage, fmt.Errorf("Failed to parse arguments: %v", err))
+	}
+	_, err = kssh.VerifyKeybaseBinary()
+	if err != nil {
+		exitWithError(opts, ExitError, err)
+	}
+	opts, err = applyInstallTargets(opts)
+	if err != nil {
+		exitWithError(opts, ExitError, err)
+	}
+	if opts.Action == Benchmark {
+		benchmark(opts, remainingArgs)
+		return
+	}
+	if opts.Action == ListHosts || opts.Action == CompleteHosts {
+		listHosts(opts)
+		return
+	}
+	if opts.Action == PushKey {
+		pushKey(opts, remainingArgs)
+		return
+	}
+	keyPath, err := kssh.GetSignedKeyLocation(opts.BotName)
+	if err != nil {
+		exitWithError(opts, ExitError, fmt.Errorf("Failed to retrieve location to store SSH keys: %v", err))
+	}
+	opts = applyFeatureFlags(opts, keyPath)
+	if opts.Elevate {
+		keyPath = kssh.ElevatedKeyPath(keyPath)
+	}
+	// If the CA has an RSA key, ask it to sign with an algorithm that the destination server accepts
+	var algorithms []string
+	if connectsToHost(opts) {
+		if conf, err := kssh.GetCachedClientConfig(keyPath); err == nil {
+			algorithms = kssh.DetectSignatureAlgorithms(conf, sshDestinationArgs(opts, remainingArgs))
+		}
+	}
+	reused := false
+	provisionStart := time.Now()
+	if opts.NoDisk {
+		// keyPath is never written to, it only identifies the key in the ssh-agent
+		reused, err = ensureAgentCert(opts, keyPath, algorithms)
+	} else if usesKeyFile(opts) {
+		reused, err = ensureValidCert(opts.BotName, keyPath, opts.Elevate, opts.Extensions, opts.Verbosity, algorithms)
+	}
+	if err == nil && usesPKCS11(opts) {
+		err = ensurePKCS11Cert(opts, keyPath, algorithms)
+	}
+	if opts.NoDisk || usesKeyFile(opts) || usesPKCS11(opts) {
+		recordCertMetrics(opts, keyPath, reused, time.Since(provisionStart), err)
+	}
+	if err != nil {
+		exitWithError(opts, ExitError, err)
+	}
+	doAction(opts, keyPath, remainingArgs, reused)
+}
+
+// Send the outcome of making sure that there is a valid certificate to the metrics endpoint that the CA configured in
+// its client config, if any (see kssh.Metrics). Only the result, how the key is stored, and how long it took are sent.
+func recordCertMetrics(opts Options, keyPath string, reused bool, duration time.Duration, err error) {
+	// After a failure to provision the first certificate there is no cached config and so nothing is sent
+	conf, confErr := kssh.GetCachedClientConfig(keyPath)
+	if confErr != nil {
+		return
+	}
+	metrics := kssh.NewMetrics(conf, VersionNumber)
+	if !metrics.Enabled() {
+		return
+	}
+	result := "provisioned"
+	if err != nil {
+		result = "failed"
+	} else if reused {
+		result = "reused"
+	}
+	storage := "file"
+	if opts.NoDisk {
+		storage = "agent"
+	} else if usesPKCS11(opts) && !usesKeyFile(opts) {
+		storage = "pkcs11"
+	}
+	tags := map[string]string{"result": result, "storage": storage, "elevated": strconv.FormatBool(opts.Elevate)}
+	metrics.Count(kssh.MetricCertificates, tags)
+	if !reused {
+		metrics.Timing(kssh.MetricProvisionDuration, duration, tags)
+	}
+	metrics.Flush()
+}
+
+// Fill in opts.Targets from the configured install targets. --no-disk overrides them to only use the ssh-agent.
+func applyInstallTargets(opts Options) (Options, error) {
+	targets, err := kssh.GetInstallTargets()
+	if err != nil {
+		return opts, err
+	}
+	opts.Targets = targets
+	if opts.NoDisk {
+		opts.Targets.File = false
+		opts.Targets.Agent = true
+	}
+	if !opts.Targets.File && opts.Targets.Agent && (connectsToHost(opts) || opts.Action == Provision) && !opts.JSON && !opts.NoExec {
+		// A key that is only installed in the ssh-agent never needs to touch the disk
+		opts.NoDisk = true
+	}
+	return opts, nil
+}
+
+// Enable the kssh behaviors that the CA is rolling out to this user (see KSSH_FEATURE_FLAGS). The flags are read from
+// the cached client config, so a change to them takes effect from the run after the next new certificate. Flags only
+// turn on behaviors that the user could have chosen via flags themselves and only where those flags are allowed.
+func applyFeatureFlags(opts Options, keyPath string) Options {
+	conf, err := kssh.GetCachedClientConfig(keyPath)
+	if err != nil || len(conf.FeatureFlags) == 0 {
+		return opts
+	}
+	keybaseUser, err := kssh.GetKeybaseUsername()
+	if err != nil {
+		return opts
+	}
+	// Keys that never touch disk require a running ssh-agent
+	if !opts.NoDisk && (connectsToHost(opts) || opts.Action == Provision) && !opts.JSON && !opts.NoExec &&
+		os.Getenv("SSH_AUTH_SOCK") != "" && conf.FeatureEnabled(shared.FeatureNoDisk, keybaseUser) {
+		log.Debugf("Enabling the %s feature flag", shared.FeatureNoDisk)
+		opts.NoDisk = true
+		opts.Targets.File = false
+		opts.Targets.Agent = true
+	}
+	return opts
+}
+
+// Returns whether the action connects to a host via ssh (directly or to bootstrap mosh)
+func connectsToHost(opts Options) bool {
+	return opts.Action == SSH || opts.Action == Mosh
+}
+
+// Returns the ssh arguments that determine the destination of the connection. When running mosh, the arguments are
+// mosh arguments so only the destination is used.
+func sshDestinationArgs(opts Options, remainingArgs []string) []string {
+	if opts.Action != Mosh {
+		return remainingArgs
+	}
+	user, host := kssh.GetMoshDestination(remainingArgs)
+	if host == "" {
+		return nil
+	}
+	if user != "" {
+		return []string{user + "@" + host}
+	}
+	return []string{host}
+}
+
+// Returns whether the action needs a signed key on disk. Only connecting via ssh and --provision can do without one
+// when the file and agent install targets are both disabled (see kssh.InstallTargets).
+func usesKeyFile(opts Options) bool {
+	if !connectsToHost(opts) && opts.Action != Provision || opts.JSON || opts.NoExec {
+		return true
+	}
+	return opts.Targets.File || opts.Targets.Agent
+}
+
+// Returns whether the certificate should also be installed for the key on the PKCS#11 token
+func usesPKCS11(opts Options) bool {
+	return opts.Targets.PKCS11 && (connectsToHost(opts) || opts.Action == Provision) && !opts.JSON && !opts.NoExec
+}
+
+// Make sure that there is a valid certificate for the key on the PKCS#11 token (see kssh.ProvisionPKCS11Key),
+// provisioning a new one if needed. If algorithms is not empty, the certificate must be signed with one of these
+// signature algorithms.
+func ensurePKCS11Cert(opts Options, keyPath string, algorithms []string) (err error) {
+	tokenKeyPath := kssh.GetPKCS11KeyPath(keyPath)
+	if kssh.IsReusablePKCS11Cert(keyPath) && kssh.IsCertSignedWithAlgorithm(tokenKeyPath, algorithms) &&
+		kssh.IsCertWithExtensions(tokenKeyPath, opts.Extensions) {
+		log.WithField("keyPath", tokenKeyPath).Debug("Reusing unexpired PKCS#11 certificate")
+		return nil
+	}
+	progress := kssh.StartProgress(opts.Verbosity)
+	defer func() { progress.Finish(err) }()
+	progress.Step("Starting Keybase chat")
+	requester, err := kssh.NewRequester()
+	if err != nil {
+		return err
+	}
+	requester.OnProgress = progress.Step
+	requester.SignatureAlgorithms = algorithms
+	requester.Extensions = opts.Extensions
+	requester.OnChallenge = func(challenge shared.SignatureChallenge) {
+		progress.Interrupt(func() { kssh.PresentChallenge(challenge) })
+	}
+	return kssh.ProvisionPKCS11Key(&requester, opts.BotName, keyPath, opts.Targets.PKCS11Provider, opts.Elevate)
+}
+
+// How long to wait for ksshd-agent to provision a key before provisioning it directly
+const daemonTimeout = 30 * time.Second
+
+// Make sure that there is a valid signed key at keyPath, provisioning a new one if needed. Returns whether an existing
+// key was reused. If elevate, an elevated certificate is requested. The certificate must include the given custom
+// extensions. Progress is reported according to verbosity. If algorithms is not empty, the certificate must be signed
+// with one of these signature algorithms.
+func ensureValidCert(botName, keyPath string, elevate bool, extensions map[string]string, verbosity kssh.Verbosity, algorithms []string) (reused bool, err error) {
+	if kssh.IsReusableCert(keyPath) && kssh.IsCertSignedWithAlgorithm(keyPath, algorithms) && kssh.IsCertWithExtensions(keyPath, extensions) {
+		log.WithField("keyPath", keyPath).Debug("Reusing unexpired certificate")
+		return true, nil
+	}
+	progress := kssh.StartProgress(verbosity)
+	defer func() { progress.Finish(err) }()
+	if elevate || len(extensions) > 0 {
+		// ksshd-agent only provisions regular certificates without any custom extensions
+		return provisionDirectly(botName, keyPath, elevate, extensions, progress, algorithms)
+	}
+	// If ksshd-agent is running, it can provision a key much faster since it is already connected to Keybase
+	progress.Step("Checking for ksshd-agent")
+	_, err = kssh.CallDaemon(kssh.DaemonRequest{Command: kssh.DaemonCommandProvision, BotName: botName}, daemonTimeout)
+	if err == nil && kssh.IsReusableCert(keyPath) && kssh.IsCertSignedWithAlgorithm(keyPath, algorithms) {
+		log.WithField("keyPath", keyPath).Debug("Using certificate provisioned by ksshd-agent")
+		return false, nil
+	}
+	log.Debugf("Not using ksshd-agent: %v", err)
+	return provisionDirectly(botName, keyPath, false, nil, progress, algorithms)
+}
+
+// Make sure that the ssh-agent holds a valid in-memory key for keyPath (see kssh.ProvisionInMemoryKey), provisioning a
+// new one if needed. Returns whether an existing key was reused. If algorithms is not empty, the certificate must be
+// signed with one of these signature algorithms.
+func ensureAgentCert(opts Options, keyPath string, algorithms []string) (reused bool, err error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	cert, err := kssh.GetAgentCertificate(socket, keyPath, algorithms)
 	if err != nil {
-		fmt.Printf("Failed to parse arguments: %v\n", err)
+		return false, err
+	}
+	if cert != nil && len(kssh.MissingExtensions(cert, opts.Extensions)) == 0 {
+		log.WithField("keyID", cert.KeyId).Debug("Reusing unexpired certificate from the ssh-agent")
+		return true, nil
+	}
+	progress := kssh.StartProgress(opts.Verbosity)
+	defer func() { progress.Finish(err) }()
+	progress.Step("Starting Keybase chat")
+	requester, err := kssh.NewRequester()
+	if err != nil {
+		return false, err
+	}
+	requester.OnProgress = progress.Step
+	requester.SignatureAlgorithms = algorithms
+	requester.Extensions = opts.Extensions
+	requester.OnChallenge = func(challenge shared.SignatureChallenge) {
+		progress.Interrupt(func() { kssh.PresentChallenge(challenge) })
+	}
+	return false, kssh.ProvisionInMemoryKey(&requester, opts.BotName, keyPath, socket, opts.Elevate)
+}
+
+// Provision a new key at keyPath by talking to the CA bot from this process. Concurrent kssh processes share a single
+// request to the CA (see kssh.ProvisionOnce). Returns whether a key provisioned by another kssh process was reused.
+func provisionDirectly(botName, keyPath string, elevate bool, extensions map[string]string, progress *kssh.Progress, algorithms []string) (bool, error) {
+	progress.Step("Waiting for other kssh processes")
+	return kssh.ProvisionOnce(keyPath, func() error {
+		log.Debug("Starting Keybase chat...")
+		progress.Step("Starting Keybase chat")
+		requester, err := kssh.NewRequester()
+		if err != nil {
+			return err
+		}
+		requester.OnProgress = progress.Step
+		requester.SignatureAlgorithms = algorithms
+		requester.Extensions = extensions
+		requester.OnChallenge = func(challenge shared.SignatureChallenge) {
+			progress.Interrupt(func() { kssh.PresentChallenge(challenge) })
+		}
+		if elevate {
+			return kssh.ProvisionElevatedKey(&requester, botName, keyPath)
+		}
+		return kssh.ProvisionNewKey(&requester, botName, keyPath)
+	})
+}
+
+func doAction(opts Options, keyPath string, remainingArgs []string, reused bool) {
+	if opts.Action == SSH {
+		runSSHWithKey(opts, keyPath, remainingArgs)
+	} else if opts.Action == Mosh {
+		runMoshWithKey(opts, keyPath, remainingArgs)
+	} else if opts.Action == Provision {
+		provision(opts, keyPath, reused)
+	} else if opts.Action == ExportAgentSocket {
+		exportAgentSocket(keyPath)
+	} else if opts.Action == AnsibleVars {
+		ansibleVars(keyPath, remainingArgs[0])
+	} else if opts.Action == ProxyMode {
+		proxyMode(keyPath, remainingArgs[0], remainingArgs[1])
+	}
+}
+
+// Act as an OpenSSH ProxyCommand. The signed key is offered to ssh via the ssh-agent since ssh has already loaded
+// its identity files by the time the ProxyCommand runs. stdout is the connection so nothing else may be printed to it.
+func proxyMode(keyPath, host, port string) {
+	err := kssh.AddKeyToSSHAgent(keyPath)
+	if err != nil {
+		log.Debugf("Failed to add SSH key to the SSH agent: %v", err)
+	}
+	conf, err := kssh.GetCachedClientConfig(keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the cached client config: %v\n", err)
 		os.Exit(1)
 	}
-	keyPath, err := getSignedKeyLocation(botName)
+	err = kssh.RunPreConnectHooks(conf, keyPath, host, port)
 	if err != nil {
-		fmt.Printf("Failed to retrieve location to store SSH keys: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-	if isValidCert(keyPath) {
-		log.WithField("keyPath", keyPath).Debug("Reusing unexpired certificate")
-		doAction(action, keyPath, remainingArgs)
-		os.Exit(0)
+	err = kssh.Proxy(conf, host, port)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// Run the pre-connect hooks that the CA configured for the destination of sshArgs (eg to open the firewall for this
+// machine). Exits if one fails since ssh would not be able to connect.
+func runPreConnectHooks(keyPath, hookKeyPath string, sshArgs []string) {
+	conf, err := kssh.GetCachedClientConfig(keyPath)
+	if err != nil {
+		log.Debugf("Failed to load the cached client config, skipping pre-connect hooks: %v", err)
+		return
 	}
-	err = provisionNewKey(botName, keyPath)
+	err = kssh.RunPreConnectHooksForArgs(conf, hookKeyPath, sshArgs)
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-	doAction(action, keyPath, remainingArgs)
 }
 
-func doAction(action Action, keyPath string, remainingArgs []string) {
-	if action == SSH {
-		runSSHWithKey(keyPath, remainingArgs)
-	} else if action == Provision {
-		provision(keyPath)
+// The exit codes used by kssh (other than when running ssh, in which case ssh's exit code is used). These are part of
+// the --json contract documented in docs/kssh.md and must not be changed.
+const (
+	// A local error (eg failing to write the key to disk)
+	ExitError = 1
+	// The provided arguments were invalid
+	ExitUsage = 2
+	// No usable kssh config was found (eg the CA bot is not running or the user is not in any configured teams)
+	ExitConfig = 3
+	// The CA did not sign the key (eg it timed out or rejected the request)
+	ExitCA = 4
+)
+
+// Print the given error and exit. If err is a kssh.ConfigError or a kssh.CAError, the matching exit code is used
+// instead of code. If the CA denied the request, what the user can do about it is printed too. In --json mode the
+// error is printed as a JSON object on stdout.
+func exitWithError(opts Options, code int, err error) {
+	var denied *kssh.DeniedError
+	switch e := err.(type) {
+	case *kssh.ConfigError:
+		code = ExitConfig
+	case *kssh.CAError:
+		code = ExitCA
+		denied, _ = e.Err.(*kssh.DeniedError)
+	}
+	if opts.JSON {
+		provisionError := kssh.ProvisionError{Version: kssh.ProvisionSchemaVersion, Error: err.Error(), ExitCode: code}
+		if denied != nil {
+			provisionError.DenialCode = denied.Code
+			provisionError.Remediation = denied.Remediation()
+		}
+		bytes, _ := json.Marshal(provisionError)
+		fmt.Println(string(bytes))
+	} else {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		if denied != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", denied.Remediation())
+		}
+	}
+	os.Exit(code)
+}
+
+// Time each phase of provisioning a key (and optionally connecting to the given host) over several iterations and
+// print a breakdown. A new key is never signed so that benchmarking does not fill up the audit log.
+func benchmark(opts Options, remainingArgs []string) {
+	var requester kssh.Requester
+	var conf kssh.Config
+	steps := []kssh.BenchmarkStep{
+		{Name: "keybase startup", Run: func() (err error) {
+			requester, err = kssh.NewRequester()
+			return err
+		}},
+		// The kssh config is discovered by listing the user's teams and reading the KV store of each of them
+		{Name: "config discovery", Run: func() (err error) {
+			conf, err = requester.GetConfig(opts.BotName)
+			return err
+		}},
+		{Name: "chat round trip", Run: func() error {
+			return requester.Ping(conf)
+		}},
+	}
+	if len(remainingArgs) > 0 {
+		destination := remainingArgs[0]
+		keyPath, err := kssh.GetSignedKeyLocation(opts.BotName)
+		if err != nil {
+			exitWithError(opts, ExitError, fmt.Errorf("Failed to retrieve location to store SSH keys: %v", err))
+		}
+		_, err = ensureValidCert(opts.BotName, keyPath, false, nil, opts.Verbosity, nil)
+		if err != nil {
+			exitWithError(opts, ExitError, err)
+		}
+		steps = append(steps, kssh.BenchmarkStep{Name: "ssh handshake", Run: func() error {
+			return kssh.CheckSSHConnection(keyPath, destination)
+		}})
 	}
+	iterations := opts.Iterations
+	if iterations == 0 {
+		iterations = defaultBenchmarkIterations
+	}
+	kssh.Statusf("Running %d iterations...\n", iterations)
+	fmt.Println(kssh.FormatBenchmark(kssh.RunBenchmark(iterations, steps)))
 }
 
-func provision(keyPath string) {
-	err := kssh.AddKeyToSSHAgent(keyPath)
+// Print the hosts published in the hosts inventories of the user's teams (--list-hosts). With --complete-hosts only
+// the host names are printed for the completion scripts and the cached inventory is used if it is fresh.
+func listHosts(opts Options) {
+	if opts.Action == CompleteHosts {
+		hosts, ok, err := kssh.GetCachedInventory(opts.BotName)
+		if err == nil && ok {
+			printHostNames(hosts)
+			return
+		}
+	}
+	requester, err := kssh.NewRequester()
+	if err != nil {
+		exitWithError(opts, ExitError, err)
+	}
+	hosts, err := requester.GetInventory(opts.BotName)
+	if err != nil {
+		exitWithError(opts, ExitError, fmt.Errorf("Failed to retrieve the hosts inventory: %v", err))
+	}
+	err = kssh.CacheInventory(opts.BotName, hosts)
+	if err != nil {
+		log.Debugf("Failed to cache the hosts inventory: %v", err)
+	}
+	if opts.Action == CompleteHosts {
+		printHostNames(hosts)
+		return
+	}
+	if len(hosts) == 0 {
+		kssh.Statusf("None of your teams have published a hosts inventory (see keybaseca publish-inventory)\n")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tTEAM\tDESCRIPTION")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", host.Host, host.Team, host.Description)
+	}
+	w.Flush()
+}
+
+func printHostNames(hosts []kssh.InventoryEntry) {
+	for _, host := range hosts {
+		fmt.Println(host.Host)
+	}
+}
+
+// The flags completed by the completion scripts (see --completion)
+func completionFlags() []string {
+	var flags []string
+	for _, arg := range cliArguments {
+		if arg.Name != "--complete-hosts" {
+			flags = append(flags, arg.Name)
+		}
+	}
+	return flags
+}
+
+// Install the user's long-lived public key (or with --trust-ca, configure sshd to trust the CA) on a host that has not
+// been set up to trust the CA yet (--push-key). This is done via plain ssh since kssh's keys are not accepted there.
+func pushKey(opts Options, remainingArgs []string) {
+	destination, sshOptions := remainingArgs[0], remainingArgs[1:]
+	var sshArgs []string
+	if opts.TrustCA {
+		requester, err := kssh.NewRequester()
+		if err != nil {
+			exitWithError(opts, ExitError, err)
+		}
+		conf, err := requester.GetConfig(opts.BotName)
+		if err != nil {
+			exitWithError(opts, ExitError, err)
+		}
+		user, _ := kssh.SplitDestination(destination)
+		if user == "" {
+			user, err = kssh.GetDefaultSSHUser()
+			if err != nil {
+				exitWithError(opts, ExitError, fmt.Errorf("Failed to retrieve default SSH user: %v", err))
+			}
+		}
+		if user == "" {
+			exitWithError(opts, ExitUsage, fmt.Errorf("--trust-ca requires a user to log in as, use --push-key user@host"))
+		}
+		sshArgs, err = kssh.TrustCAArgs(destination, user, conf, sshOptions)
+		if err != nil {
+			exitWithError(opts, ExitError, err)
+		}
+		kssh.Statusf("Configuring %s to trust the CA of %s for %s, sudo may ask for your password...\n", destination,
+			conf.TeamName, user)
+	} else {
+		publicKey, err := kssh.FindLongLivedPublicKey()
+		if err != nil {
+			exitWithError(opts, ExitError, err)
+		}
+		sshArgs = kssh.PushKeyArgs(destination, publicKey, sshOptions)
+		kssh.Statusf("Installing your public key on %s...\n", destination)
+	}
+	if opts.PrintCommand {
+		fmt.Println(kssh.FormatCommand(append([]string{"ssh"}, sshArgs...)))
+		os.Exit(0)
+	}
+	sshExit, err := kssh.RunSSH(sshArgs)
 	if err != nil {
-		fmt.Printf("%v\n", err)
+		exitWithError(opts, ExitError, err)
+	}
+	if sshExit.Code == 0 {
+		kssh.Statusf("Done, connect to %s with kssh from now on\n", destination)
+	}
+	sshExit.Exit()
+}
+
+// Print the JSON Ansible host variables needed to connect to the given host with the key
+func ansibleVars(keyPath, destination string) {
+	conf, err := kssh.GetCachedClientConfig(keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the cached client config: %v\n", err)
 		os.Exit(1)
 	}
 	user, err := kssh.GetDefaultSSHUser()
 	if err != nil {
-		fmt.Printf("Failed to retrieve default SSH user: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to retrieve default SSH user: %v\n", err)
 		os.Exit(1)
 	}
-	err = kssh.CreateDefaultUserConfigFile(keyPath)
+	vars, err := kssh.GetAnsibleVars(keyPath, destination, conf, user)
 	if err != nil {
-		fmt.Printf("Failed to create the ssh config file for the default user: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to generate Ansible variables: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("Provisioned new SSH key at %s\n", keyPath)
-	if user != "" {
-		fmt.Println("See docs/troubleshooting.md for information on configuring scp, rsync, etc to " +
-			"use the configured kssh default user")
+	bytes, err := json.MarshalIndent(vars, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to serialize Ansible variables: %v\n", err)
+		os.Exit(1)
 	}
+	fmt.Println(string(bytes))
 }
 
-// getSignedKeyLocation returns the path of where the signed SSH key should be stored. botName is the name of the bot
-// specified via --bot if specified. It is necessary to include the bot in the filename in order to properly
-// handle how the switch bot flow interacts with the isValidCert function
-func getSignedKeyLocation(botName string) (string, error) {
-	signedKeyLocation := shared.ExpandPathWithTilde("~/.ssh/keybase-signed-key--")
-	if botName != "" {
-		return signedKeyLocation + botName, nil
+// Load the key into a dedicated ssh-agent and print the shell commands needed to use it. Meant to be used via
+// `eval $(kssh --export-agent-socket)`. Like ssh-agent itself, the PID is included so that `eval $(ssh-agent -k)`
+// stops the agent.
+func exportAgentSocket(keyPath string) {
+	socket, err := kssh.StartDedicatedAgent(keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
 	}
-	defaultBot, _, err := kssh.GetDefaultBotAndTeam()
+	fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK;\n", socket)
+	pid, err := kssh.GetDedicatedAgentPID(keyPath)
 	if err != nil {
-		return "", err
+		// Eg an agent started by an older version of kssh
+		log.Debugf("Failed to get the PID of the dedicated ssh-agent: %v", err)
+		return
+	}
+	fmt.Printf("SSH_AGENT_PID=%d; export SSH_AGENT_PID;\n", pid)
+}
+
+func provision(opts Options, keyPath string, reused bool) {
+	if usesPKCS11(opts) && opts.Verbosity != kssh.VerbosityQuiet {
+		kssh.Statusf("Provisioned certificate for the PKCS#11 key at %s\n", shared.KeyPathToCert(kssh.GetPKCS11KeyPath(keyPath)))
+	}
+	if opts.NoDisk || !usesKeyFile(opts) {
+		// The key is already in the ssh-agent or only the PKCS#11 key is used
+		err := kssh.CreateDefaultUserConfigFile("")
+		if err != nil {
+			exitWithError(opts, ExitError, fmt.Errorf("Failed to create the ssh config file for the default user: %v", err))
+		}
+		if opts.NoDisk && opts.Verbosity != kssh.VerbosityQuiet {
+			kssh.Statusf("Provisioned new SSH key in the ssh-agent\n")
+		}
+		return
+	}
+	if !opts.NoExec {
+		if opts.Targets.Agent {
+			err := kssh.AddKeyToSSHAgent(keyPath)
+			if err != nil {
+				exitWithError(opts, ExitError, err)
+			}
+		}
+		err := kssh.CreateDefaultUserConfigFile(keyPath)
+		if err != nil {
+			exitWithError(opts, ExitError, fmt.Errorf("Failed to create the ssh config file for the default user: %v", err))
+		}
+	}
+	if opts.JSON {
+		result, err := kssh.NewProvisionResult(keyPath, reused)
+		if err != nil {
+			exitWithError(opts, ExitError, err)
+		}
+		bytes, err := json.Marshal(result)
+		if err != nil {
+			exitWithError(opts, ExitError, err)
+		}
+		fmt.Println(string(bytes))
+		return
+	}
+	user, err := kssh.GetDefaultSSHUser()
+	if err != nil {
+		exitWithError(opts, ExitError, fmt.Errorf("Failed to retrieve default SSH user: %v", err))
+	}
+	if opts.Verbosity == kssh.VerbosityQuiet {
+		return
+	}
+	kssh.Statusf("Provisioned new SSH key at %s\n", keyPath)
+	if user != "" && !opts.NoExec {
+		kssh.Statusf("See docs/troubleshooting.md for information on configuring scp, rsync, etc to " +
+			"use the configured kssh default user\n")
 	}
-	return signedKeyLocation + defaultBot, nil
 }
 
 var cliArguments = []kssh.CLIArgument{
 	{Name: "--set-default-bot", HasArgument: true},
 	{Name: "--clear-default-bot", HasArgument: false},
+	{Name: "--set-discovery-channel", HasArgument: true},
+	{Name: "--clear-discovery-channel", HasArgument: false},
 	{Name: "--bot", HasArgument: true},
 	{Name: "--provision", HasArgument: false},
+	{Name: "--export-agent-socket", HasArgument: false},
+	{Name: "--ansible-vars", HasArgument: true},
+	{Name: "--json", HasArgument: false},
+	{Name: "--no-exec", HasArgument: false},
+	{Name: "--elevate", HasArgument: false},
+	{Name: "--extension", HasArgument: true},
+	{Name: "--no-disk", HasArgument: false},
+	{Name: "--set-install-targets", HasArgument: true},
+	{Name: "--set-pkcs11-provider", HasArgument: true},
+	{Name: "--install-git", HasArgument: false},
+	{Name: "--install-integration", HasArgument: false},
+	{Name: "--proxy-hosts", HasArgument: true},
+	{Name: "--proxy-mode", HasArgument: false},
+	{Name: "--non-interactive", HasArgument: false},
 	{Name: "--set-default-user", HasArgument: true},
 	{Name: "--clear-default-user", HasArgument: false},
 	{Name: "--help", HasArgument: false},
 	{Name: "-v", HasArgument: false, Preserve: true},
+	{Name: "--quiet", HasArgument: false},
+	{Name: "--verbose", HasArgument: false},
 	{Name: "--set-keybase-binary", HasArgument: true},
+	{Name: "--pin-keybase-binary", HasArgument: false},
+	{Name: "--export-config", HasArgument: true},
+	{Name: "--import-config", HasArgument: true},
+	{Name: "--benchmark", HasArgument: false},
+	{Name: "--iterations", HasArgument: true},
+	{Name: "--self-update", HasArgument: false},
+	{Name: "--set-release-signer", HasArgument: true},
+	{Name: "--profile", HasArgument: true},
+	{Name: "--keybase-user", HasArgument: true},
+	{Name: "--set-keybase-user", HasArgument: true},
+	{Name: "--clear-keybase-user", HasArgument: false},
+	{Name: "--list-hosts", HasArgument: false},
+	{Name: "--print-command", HasArgument: false},
+	{Name: "--mosh", HasArgument: false},
+	{Name: "--last", HasArgument: false},
+	{Name: "--completion", HasArgument: true},
+	{Name: "--push-key", HasArgument: true},
+	{Name: "--trust-ca", HasArgument: false},
+	// Used by the completion scripts, not listed in the help page
+	{Name: "--complete-hosts", HasArgument: false},
 }
 
 var VersionNumber = "master"
 
+// The Keybase user whose releases --self-update installs. Set at build time via -ldflags "-X main.ReleaseSigner=...".
+// If empty, the signer recorded via --set-release-signer is used.
+var ReleaseSigner = ""
+
 func generateHelpPage() string {
 	return fmt.Sprintf(`NAME:
    kssh - A replacement ssh binary using Keybase SSH CA to provision SSH keys
@@ -114,89 +702,418 @@ VERSION:
 
 GLOBAL OPTIONS:
    --help                Show help
+   --profile             Use the given named profile (eg work or personal). Each profile has its own keys, default 
+                         bot, default user, and cached configs. Also selected via $KSSH_PROFILE
+   --keybase-user        Act as the given Keybase account if you have several (eg work and personal) on this machine. 
+                         Also selected via $KSSH_KEYBASE_USER
    -v                    Enable kssh and ssh debug logs
+   --quiet               Only print errors. Useful in scripts
+   --verbose             Print each step of provisioning a new SSH key along with how long it took
    --provision           Provision a new SSH key and add it to the ssh-agent. Useful if you need to run another 
                          program that uses SSH auth (eg scp, rsync, etc)
+   --export-agent-socket Provision a new SSH key and load only that key into a dedicated ssh-agent. Prints the 
+                         SSH_AUTH_SOCK for the agent. Use via eval $(kssh --export-agent-socket)
+   --ansible-vars        Provision a new SSH key and print the JSON Ansible host variables needed to connect to the
+                         given [user@]host with it
+   --json                Used with --provision. Print the result (or error) as JSON. See docs/kssh.md for the schema
+   --no-exec             Used with --provision. Only make sure a valid signed key exists on disk, do not add it to 
+                         the ssh-agent
+   --no-disk             Generate the SSH key in memory and only load it into the ssh-agent. The private key is never 
+                         written to disk. Requires a running ssh-agent
+   --set-install-targets Set where newly signed certificates are installed to. A comma separated list of file (the 
+                         key and certificate are written to ~/.ssh/kssh), agent (they are loaded into the ssh-agent), 
+                         and pkcs11 (the key on a PKCS#11 token is signed too). Defaults to file,agent
+   --set-pkcs11-provider Set the PKCS#11 library (an absolute path) used to access the token for the pkcs11 install 
+                         target
+   --elevate             Use a short lived elevated certificate that also includes the elevated principals (eg for 
+                         sudo) configured in keybaseca. Requires MFA approval each time a new one is issued
+   --extension           Request the given custom certificate extension of the form name@domain=value (eg 
+                         groups@acme.com=dba). May be specified multiple times. The CA only includes the extensions 
+                         that are allowed for your teams
    --set-default-bot     Set the default bot to be used for kssh. Not necessary if you are only in one team that
                          is using Keybase SSH CA
    --clear-default-bot   Clear the default bot
+   --set-discovery-channel
+                         Ask the CA bots in the given team#channel for configs rather than reading the config of 
+                         every team you are in. Useful if you are in hundreds of teams
+   --clear-discovery-channel
+                         Clear the discovery channel
    --bot                 Specify a specific bot to be used for kssh. Not necessary if you are only in one team that
                          is using Keybase SSH CA
    --set-default-user    Set the default SSH user to be used for kssh. Useful if you use ssh configs that do not set 
 					     a default SSH user 
    --clear-default-user  Clear the default SSH user
-   --set-keybase-binary  Run kssh with a specific keybase binary rather than resolving via $PATH `, VersionNumber)
+   --set-keybase-user    Act as the given Keybase account by default. Use USER=DIR if the account's Keybase service 
+                         runs with a separate home directory (keybase --home DIR)
+   --clear-keybase-user  Clear the default Keybase account
+   --set-keybase-binary  Run kssh with a specific keybase binary (an absolute path) rather than resolving via $PATH 
+   --pin-keybase-binary  Record the checksum of the keybase binary and refuse to run any other keybase binary
+   --export-config       Write the kssh settings (default bot and user, preferences, and known hosts) to the given 
+                         file encrypted for your Keybase user. Use with --import-config when moving to a new machine
+   --import-config       Import kssh settings from a file written by --export-config
+   --self-update         Update kssh to the latest release published by the CA bot (see keybaseca publish-release)
+   --set-release-signer  Set the Keybase user (normally the CA bot) whose signed releases --self-update installs
+   --install-git         Configure git to use kssh for ssh remotes by setting core.sshCommand in ~/.gitconfig 
+   --install-integration Set up shell completion, git (see --install-git), and a systemd user timer that keeps a valid 
+                         certificate on disk in one step. Safe to run again, eg after upgrading kssh
+   --proxy-hosts         Used with --install-integration. Also add a ProxyCommand stanza (see --proxy-mode) for the 
+                         given ssh Host pattern (eg *.internal.example.com) to ~/.ssh/config
+   --proxy-mode          Run as an OpenSSH ProxyCommand (kssh --proxy-mode %%h %%p). Provisions a new SSH key if
+                         needed, adds it to the ssh-agent, and connects to the given host and port 
+   --non-interactive     Run in a mode suited to being spawned by other programs such as IDEs. Only errors are 
+                         logged and the key is only delivered via the ssh-agent. Also enabled via $KSSH_NONINTERACTIVE
+   --benchmark           Time each phase of kssh (starting Keybase, config discovery, the chat round trip to the CA 
+                         bot, and the ssh handshake if a [user@]host is given) and print a breakdown. Useful when 
+                         reporting that kssh is slow
+   --iterations          Used with --benchmark. The number of times to run each phase (default: 5) 
+   --print-command       Provision a new SSH key if needed and print the full ssh command (with all of the -i and -o 
+                         options added by kssh) rather than running it
+   --mosh                Connect with mosh rather than ssh. The remaining arguments are passed to mosh (eg 
+                         kssh --mosh user@host). mosh bootstraps the connection via ssh with the signed key
+   --last                Reconnect to the host that kssh last connected to successfully, with the same options, user, 
+                         bot, and (if used) mosh. Any remaining arguments are run as the remote command
+   --list-hosts          List the hosts published in the hosts inventories of your teams (see keybaseca 
+                         publish-inventory). Use with --bot to only list the hosts of the teams that use that bot
+   --completion          Print the tab-completion script for the given shell (bash or zsh). Completes kssh flags and
+                         the hosts from --list-hosts. Use via source <(kssh --completion bash) 
+   --push-key            Install your long-lived public key (~/.ssh/id_ed25519.pub etc) on the given [user@]host via 
+                         plain ssh, for hosts that do not trust the CA yet. Any remaining arguments are ssh options
+   --trust-ca            Used with --push-key. Rather than installing your key, configure sshd on the host to trust 
+                         the CA for the given user via sudo (see keybaseca generate-server-setup) `, VersionNumber)
 }
 
 type Action int
 
+// The number of iterations run by --benchmark if --iterations is not specified
+const defaultBenchmarkIterations = 5
+
 const (
 	Provision Action = iota
 	SSH
+	ExportAgentSocket
+	AnsibleVars
+	ProxyMode
+	Benchmark
+	ListHosts
+	CompleteHosts
+	Mosh
+	PushKey
 )
 
-// Returns botName, remaining arguments, action, error
+// Options are the kssh specific options parsed from the command line
+type Options struct {
+	// The bot specified via --bot. Empty if not specified.
+	BotName string
+	Action  Action
+	// Whether to print results as JSON (--json)
+	JSON bool
+	// Whether to skip adding the key to the ssh-agent (--no-exec)
+	NoExec bool
+	// Whether kssh is being run by another program such as an IDE (--non-interactive or $KSSH_NONINTERACTIVE)
+	NonInteractive bool
+	// The number of iterations to run with --benchmark. Zero means defaultBenchmarkIterations.
+	Iterations int
+	// Whether to use an elevated certificate (--elevate)
+	Elevate bool
+	// The custom certificate extensions to request (--extension). Nil if none were specified.
+	Extensions map[string]string
+	// How much to print while provisioning a new key (--quiet or --verbose)
+	Verbosity kssh.Verbosity
+	// Whether to generate the key in memory and only deliver it via the ssh-agent (--no-disk)
+	NoDisk bool
+	// Where newly signed certificates are installed to (see --set-install-targets)
+	Targets kssh.InstallTargets
+	// Whether to print the ssh command rather than running it (--print-command)
+	PrintCommand bool
+	// Whether --push-key configures the host to trust the CA rather than installing the user's key (--trust-ca)
+	TrustCA bool
+}
+
+// Returns options, remaining arguments, error
 // If the argument requires exiting after processing, it will call os.Exit
-func handleArgs(args []string) (string, []string, Action, error) {
+func handleArgs(args []string) (Options, []string, error) {
+	opts := Options{Action: SSH, NonInteractive: os.Getenv("KSSH_NONINTERACTIVE") != ""}
 	remaining, found, err := kssh.ParseArgs(args, cliArguments)
 	if err != nil {
-		return "", nil, 0, fmt.Errorf("Failed to parse provided arguments: %v", err)
+		return opts, nil, fmt.Errorf("Failed to parse provided arguments: %v", err)
 	}
 
-	botName := ""
-	action := SSH
+	// The profile is selected before anything else so that the flags below read and write the config of that profile
+	profile := os.Getenv(kssh.ProfileEnvVar)
+	for _, arg := range found {
+		if arg.Argument.Name == "--profile" {
+			profile = arg.Value
+		}
+	}
+	if profile != "" {
+		err = kssh.SetProfile(profile)
+		if err != nil {
+			return opts, nil, err
+		}
+	}
+	// Likewise the Keybase account is selected before any of the flags below talk to Keybase
+	keybaseUser := ""
+	for _, arg := range found {
+		if arg.Argument.Name == "--keybase-user" {
+			keybaseUser = arg.Value
+		}
+	}
+	err = kssh.SelectKeybaseAccount(keybaseUser)
+	if err != nil {
+		return opts, nil, err
+	}
+
+	installGit := false
+	last := false
+	installIntegration := false
+	proxyHosts := ""
+	selfUpdate := false
+	iterationsSet := false
 	for _, arg := range found {
 		if arg.Argument.Name == "--bot" {
-			botName = arg.Value
+			opts.BotName = arg.Value
+		}
+		if arg.Argument.Name == "--install-git" {
+			// Handled after the loop so that it respects --bot regardless of the order of the flags
+			installGit = true
+		}
+		if arg.Argument.Name == "--install-integration" {
+			// Handled after the loop so that it respects --bot and --proxy-hosts regardless of the order of the flags
+			installIntegration = true
+		}
+		if arg.Argument.Name == "--proxy-hosts" {
+			proxyHosts = arg.Value
+		}
+		if arg.Argument.Name == "--self-update" {
+			// Handled after the loop so that it respects --bot regardless of the order of the flags
+			selfUpdate = true
 		}
 		if arg.Argument.Name == "--set-default-user" {
 			err := kssh.SetDefaultSSHUser(arg.Value)
 			if err != nil {
-				fmt.Printf("Failed to set the default ssh user: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Failed to set the default ssh user: %v\n", err)
 				os.Exit(1)
 			}
-			fmt.Println("Set default ssh user, exiting...")
+			kssh.Statusf("Set default ssh user, exiting...\n")
 			os.Exit(0)
 		}
 		if arg.Argument.Name == "--clear-default-user" {
 			err := kssh.SetDefaultSSHUser("")
 			if err != nil {
-				fmt.Printf("Failed to clear the default ssh user: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Failed to clear the default ssh user: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Cleared default ssh user, exiting...\n")
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--set-keybase-user" {
+			// Either USER or USER=DIR where DIR is the Keybase home directory of that account
+			split := strings.SplitN(arg.Value, "=", 2)
+			homeDir := ""
+			if len(split) == 2 {
+				homeDir = split[1]
+			}
+			err := kssh.SetKeybaseAccount(split[0], homeDir)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set the Keybase user: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Set Keybase user, exiting...\n")
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--clear-keybase-user" {
+			err := kssh.SetKeybaseAccount("", "")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to clear the Keybase user: %v\n", err)
 				os.Exit(1)
 			}
-			fmt.Println("Cleared default ssh user, exiting...")
+			kssh.Statusf("Cleared Keybase user, exiting...\n")
 			os.Exit(0)
 		}
 		if arg.Argument.Name == "--set-default-bot" {
 			// We exit immediately after setting the default bot
 			err := kssh.SetDefaultBot(arg.Value)
 			if err != nil {
-				fmt.Printf("Failed to set the default bot: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Failed to set the default bot: %v\n", err)
 				os.Exit(1)
 			}
-			fmt.Println("Set default bot, exiting...")
+			kssh.Statusf("Set default bot, exiting...\n")
 			os.Exit(0)
 		}
 		if arg.Argument.Name == "--clear-default-bot" {
 			err := kssh.ClearDefaultBot()
 			if err != nil {
-				fmt.Printf("Failed to clear the default bot: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Failed to clear the default bot: %v\n", err)
 				os.Exit(1)
 			}
-			fmt.Println("Cleared default bot, exiting...")
+			kssh.Statusf("Cleared default bot, exiting...\n")
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--set-discovery-channel" {
+			err := kssh.SetDiscoveryChannel(arg.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set the discovery channel: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Set discovery channel, exiting...\n")
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--clear-discovery-channel" {
+			err := kssh.SetDiscoveryChannel("")
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to clear the discovery channel: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Cleared discovery channel, exiting...\n")
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--set-release-signer" {
+			err := kssh.SetReleaseSigner(arg.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set the release signer: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Set release signer, exiting...\n")
 			os.Exit(0)
 		}
 		if arg.Argument.Name == "--set-keybase-binary" {
 			err := kssh.SetKeybaseBinaryPath(arg.Value)
 			if err != nil {
-				fmt.Printf("Failed to set the keybase binary: %v\n", err)
+				fmt.Fprintf(os.Stderr, "Failed to set the keybase binary: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Set keybase binary, exiting...\n")
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--pin-keybase-binary" {
+			path, err := kssh.PinKeybaseBinary()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to pin the keybase binary: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Pinned keybase binary %s, exiting...\n", path)
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--set-install-targets" {
+			err := kssh.SetInstallTargets(arg.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set the install targets: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Set install targets, exiting...\n")
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--set-pkcs11-provider" {
+			err := kssh.SetPKCS11Provider(arg.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to set the PKCS#11 provider: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Set PKCS#11 provider, exiting...\n")
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--export-config" {
+			err := kssh.ExportConfig(arg.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to export the kssh config: %v\n", err)
+				os.Exit(1)
+			}
+			kssh.Statusf("Exported kssh config to %s, exiting...\n", arg.Value)
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--import-config" {
+			err := kssh.ImportConfig(arg.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to import the kssh config: %v\n", err)
 				os.Exit(1)
 			}
-			fmt.Println("Set keybase binary, exiting...")
+			kssh.Statusf("Imported kssh config from %s, exiting...\n", arg.Value)
 			os.Exit(0)
 		}
 		if arg.Argument.Name == "--provision" {
-			action = Provision
+			opts.Action = Provision
+		}
+		if arg.Argument.Name == "--export-agent-socket" {
+			opts.Action = ExportAgentSocket
+		}
+		if arg.Argument.Name == "--ansible-vars" {
+			// The host is passed to the action as the first remaining argument
+			opts.Action = AnsibleVars
+			remaining = append([]string{arg.Value}, remaining...)
+		}
+		if arg.Argument.Name == "--push-key" {
+			// The host is passed to the action as the first remaining argument
+			opts.Action = PushKey
+			remaining = append([]string{arg.Value}, remaining...)
+		}
+		if arg.Argument.Name == "--trust-ca" {
+			opts.TrustCA = true
+		}
+		if arg.Argument.Name == "--benchmark" {
+			opts.Action = Benchmark
+		}
+		if arg.Argument.Name == "--iterations" {
+			opts.Iterations, err = strconv.Atoi(arg.Value)
+			if err != nil || opts.Iterations < 1 {
+				return opts, nil, fmt.Errorf("--iterations must be a positive integer, got %s", arg.Value)
+			}
+			iterationsSet = true
+		}
+		if arg.Argument.Name == "--proxy-mode" {
+			opts.Action = ProxyMode
+		}
+		if arg.Argument.Name == "--print-command" {
+			opts.PrintCommand = true
+		}
+		if arg.Argument.Name == "--mosh" {
+			opts.Action = Mosh
+		}
+		if arg.Argument.Name == "--last" {
+			// Handled after the loop so that it respects --bot regardless of the order of the flags
+			last = true
+		}
+		if arg.Argument.Name == "--list-hosts" {
+			opts.Action = ListHosts
+		}
+		if arg.Argument.Name == "--complete-hosts" {
+			opts.Action = CompleteHosts
+		}
+		if arg.Argument.Name == "--completion" {
+			script, err := kssh.CompletionScript(arg.Value, completionFlags())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to generate the completion script: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Print(script)
+			os.Exit(0)
+		}
+		if arg.Argument.Name == "--non-interactive" {
+			opts.NonInteractive = true
+		}
+		if arg.Argument.Name == "--json" {
+			opts.JSON = true
+		}
+		if arg.Argument.Name == "--no-exec" {
+			opts.NoExec = true
+		}
+		if arg.Argument.Name == "--elevate" {
+			opts.Elevate = true
+		}
+		if arg.Argument.Name == "--extension" {
+			name, value, err := shared.ParseExtension(arg.Value)
+			if err != nil {
+				return opts, nil, fmt.Errorf("Invalid --extension: %v", err)
+			}
+			if opts.Extensions == nil {
+				opts.Extensions = make(map[string]string)
+			}
+			opts.Extensions[name] = value
+			if len(opts.Extensions) > shared.MaxRequestedExtensions {
+				return opts, nil, fmt.Errorf("At most %d --extension flags may be given", shared.MaxRequestedExtensions)
+			}
+		}
+		if arg.Argument.Name == "--no-disk" {
+			opts.NoDisk = true
 		}
 		if arg.Argument.Name == "--help" {
 			fmt.Println(generateHelpPage())
@@ -205,142 +1122,366 @@ func handleArgs(args []string) (string, []string, Action, error) {
 		if arg.Argument.Name == "-v" {
 			log.SetLevel(log.DebugLevel)
 		}
+		if arg.Argument.Name == "--quiet" {
+			if opts.Verbosity == kssh.VerbosityVerbose {
+				return opts, nil, fmt.Errorf("--quiet and --verbose cannot be used together")
+			}
+			opts.Verbosity = kssh.VerbosityQuiet
+		}
+		if arg.Argument.Name == "--verbose" {
+			if opts.Verbosity == kssh.VerbosityQuiet {
+				return opts, nil, fmt.Errorf("--quiet and --verbose cannot be used together")
+			}
+			opts.Verbosity = kssh.VerbosityVerbose
+		}
 	}
-	return botName, remaining, action, nil
-}
-
-// Returns whether or not the cert at the given path is a valid unexpired certificate
-func isValidCert(keyPath string) bool {
-	_, err1 := os.Stat(keyPath)
-	_, err2 := os.Stat(shared.KeyPathToPubKey(keyPath))
-	_, err3 := os.Stat(shared.KeyPathToCert(keyPath))
-	if os.IsNotExist(err1) || os.IsNotExist(err2) || os.IsNotExist(err3) {
-		return false // Cert does not exist
+	if opts.NonInteractive && opts.Verbosity == kssh.VerbosityNormal {
+		// A spinner is just noise when kssh is spawned by another program
+		opts.Verbosity = kssh.VerbosityQuiet
 	}
-
-	certBytes, err := ioutil.ReadFile(shared.KeyPathToCert(keyPath))
-	if err != nil {
-		// Failed to read the file for some reason, just provision a new cert
-		return false
+	if (opts.NonInteractive || opts.Verbosity == kssh.VerbosityQuiet) && log.GetLevel() != log.DebugLevel {
+		// Warnings are not actionable when kssh is spawned by another program and may be shown to the user as errors
+		log.SetLevel(log.ErrorLevel)
 	}
-	k, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
-	if err != nil {
-		// Failed to parse it so just provision a new cert
-		return false
+	if installGit {
+		err := kssh.InstallGit(opts.BotName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to configure git: %v\n", err)
+			os.Exit(1)
+		}
+		kssh.Statusf("Configured git to use kssh, exiting...\n")
+		os.Exit(0)
 	}
-	// This is legal, see: https://github.com/golang/go/issues/22046
-	cert := k.(*ssh.Certificate)
-	validBefore := time.Unix(int64(cert.ValidBefore), 0)
-	validAfter := time.Unix(int64(cert.ValidAfter), 0)
-	return time.Now().After(validAfter) && time.Now().Before(validBefore)
-}
-
-// Provision a new signed SSH key :with the given config
-func provisionNewKey(botName string, keyPath string) error {
-	log.Debug("Generating a new SSH key...")
-
-	requester, err := kssh.NewRequester()
-	if err != nil {
-		return err
+	if proxyHosts != "" && !installIntegration {
+		return opts, nil, fmt.Errorf("--proxy-hosts can only be used with --install-integration")
 	}
-
-	// Make ~/.ssh/ in case it doesn't exist
-	err = kssh.MakeDotSSH()
-	if err != nil {
-		return err
+	if installIntegration {
+		steps := kssh.InstallIntegration(kssh.IntegrationOptions{
+			BotName:    opts.BotName,
+			Shell:      filepath.Base(os.Getenv("SHELL")),
+			ProxyHosts: proxyHosts,
+		})
+		failed := false
+		for _, step := range steps {
+			switch {
+			case step.Err != nil:
+				failed = true
+				kssh.Statusf("[failed]  %s: %v\n", step.Name, step.Err)
+			case step.Skipped:
+				kssh.Statusf("[skipped] %s: %s\n", step.Name, step.Message)
+			default:
+				kssh.Statusf("[done]    %s: %s\n", step.Name, step.Message)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
-
-	// Generate the key itself and read it
-	err = sshutils.GenerateNewSSHKey(keyPath, true, false)
-	if err != nil {
-		return fmt.Errorf("Failed to generate a new SSH key: %v", err)
+	if selfUpdate {
+		version, err := updateKssh()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to update kssh: %v\n", err)
+			os.Exit(1)
+		}
+		if version == "" {
+			kssh.Statusf("kssh is already up to date (%s), exiting...\n", VersionNumber)
+		} else {
+			kssh.Statusf("Updated kssh from %s to %s, exiting...\n", VersionNumber, version)
+		}
+		os.Exit(0)
 	}
-	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(keyPath))
-	if err != nil {
-		return fmt.Errorf("Failed to read the SSH key from the filesystem: %v", err)
+	if opts.Action == ProxyMode {
+		// -v is preserved for ssh but there is no ssh to pass it to in proxy mode
+		var hostAndPort []string
+		for _, arg := range remaining {
+			if arg != "-v" {
+				hostAndPort = append(hostAndPort, arg)
+			}
+		}
+		if len(hostAndPort) != 2 {
+			return opts, nil, fmt.Errorf("--proxy-mode requires exactly two arguments: the host and the port")
+		}
+		remaining = hostAndPort
 	}
-
-	// Provision the key
-	randomUUID, err := uuid.NewRandom()
-	if err != nil {
-		return fmt.Errorf("Failed to generate a new UUID for the SignatureRequest: %v", err)
+	if opts.TrustCA && opts.Action != PushKey {
+		return opts, nil, fmt.Errorf("--trust-ca can only be used with --push-key")
 	}
-
-	log.Debug("Requesting signature from the CA....")
-	resp, err := requester.GetSignedKey(botName, shared.SignatureRequest{
-		UUID:         randomUUID.String(),
-		SSHPublicKey: string(pubKey),
-	})
-	if err != nil {
-		return fmt.Errorf("Failed to get a signed key from the CA: %v", err)
+	if opts.Action == PushKey && (opts.Elevate || len(opts.Extensions) > 0) {
+		return opts, nil, fmt.Errorf("--elevate and --extension cannot be used with --push-key")
 	}
-	log.Debug("Received signature from the CA!")
+	if iterationsSet && opts.Action != Benchmark {
+		return opts, nil, fmt.Errorf("--iterations can only be used with --benchmark")
+	}
+	if opts.Action == Benchmark {
+		// -v is preserved for ssh but is not a destination
+		var destination []string
+		for _, arg := range remaining {
+			if arg != "-v" {
+				destination = append(destination, arg)
+			}
+		}
+		if len(destination) > 1 {
+			return opts, nil, fmt.Errorf("--benchmark accepts at most one argument: the [user@]host to connect to")
+		}
+		remaining = destination
+	}
+	if opts.Elevate && opts.Action == Benchmark {
+		return opts, nil, fmt.Errorf("--elevate cannot be used with --benchmark")
+	}
+	if len(opts.Extensions) > 0 && opts.Action == Benchmark {
+		return opts, nil, fmt.Errorf("--extension cannot be used with --benchmark")
+	}
+	if last {
+		if !connectsToHost(opts) {
+			return opts, nil, fmt.Errorf("--last can only be used when connecting via ssh or mosh")
+		}
+		session, err := kssh.GetLastSession()
+		if err != nil {
+			return opts, nil, err
+		}
+		if session.Mosh {
+			opts.Action = Mosh
+		}
+		if opts.BotName == "" {
+			opts.BotName = session.BotName
+		}
+		remaining = session.ResumeArgs(remaining)
+	}
+	if opts.Action == Mosh {
+		// -v is preserved for ssh but mosh does not accept it
+		var moshArgs []string
+		for _, arg := range remaining {
+			if arg != "-v" {
+				moshArgs = append(moshArgs, arg)
+			}
+		}
+		remaining = moshArgs
+		if _, host := kssh.GetMoshDestination(remaining); host == "" {
+			return opts, nil, fmt.Errorf("--mosh requires a [user@]host to connect to")
+		}
+	}
+	if opts.PrintCommand && !connectsToHost(opts) {
+		return opts, nil, fmt.Errorf("--print-command can only be used when connecting via ssh or mosh")
+	}
+	if (opts.JSON || opts.NoExec) && opts.Action != Provision {
+		return opts, nil, fmt.Errorf("--json and --no-exec can only be used with --provision")
+	}
+	if opts.NoDisk && (!connectsToHost(opts) && opts.Action != Provision || opts.JSON || opts.NoExec) {
+		return opts, nil, fmt.Errorf("--no-disk can only be used to connect via ssh or mosh or with --provision (without --json or --no-exec)")
+	}
+	return opts, remaining, nil
+}
 
-	// Write it to ~/.ssh
-	err = ioutil.WriteFile(shared.KeyPathToCert(keyPath), []byte(resp.SignedKey), 0600)
+// Update kssh to the latest release published by the release signer (see ReleaseSigner). Returns the version that was
+// installed or an empty string if kssh is already up to date. The signer is never taken from the bot's config since
+// the config is fetched from a team.
+func updateKssh() (string, error) {
+	signer, err := kssh.GetReleaseSigner(ReleaseSigner)
 	if err != nil {
-		return fmt.Errorf("Failed to write new SSH key to disk: %v", err)
+		return "", err
 	}
-
-	return nil
+	return kssh.SelfUpdate(signer, VersionNumber)
 }
 
-// Run SSH with the given key. Calls os.Exit and does not return.
-func runSSHWithKey(keyPath string, remainingArgs []string) {
+// Returns the ssh options needed to connect with the given key to the destination in destinationArgs: the identity,
+// the default user, and the cloud tunnel. Also adds the key to the ssh-agent. Calls os.Exit on failure.
+func getSSHArgs(opts Options, keyPath string, destinationArgs []string, gitMode bool) []string {
 	// Determine whether a default SSH user has been specified and configure it if so
 	useConfig := false
 	user, err := kssh.GetDefaultSSHUser()
 	if err != nil {
-		fmt.Printf("Failed to retrieve default SSH user: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Failed to retrieve default SSH user: %v\n", err)
 		os.Exit(1)
 	}
 	if user != "" {
 		useConfig = true
-		err = kssh.CreateDefaultUserConfigFile(keyPath)
+		configKeyPath := keyPath
+		if opts.NoDisk || !usesKeyFile(opts) {
+			configKeyPath = ""
+		}
+		err = kssh.CreateDefaultUserConfigFile(configKeyPath)
 		if err != nil {
-			fmt.Printf("Failed to set default user: %v\n", err)
+			fmt.Fprintf(os.Stderr, "Failed to set default user: %v\n", err)
 			os.Exit(1)
 		}
 	}
 
-	// Add the key to the ssh-agent in case we are doing multiple connections (eg via the `-J` flag)
-	err = kssh.AddKeyToSSHAgent(keyPath)
+	// Add the key to the ssh-agent in case we are doing multiple connections (eg via the `-J` flag). With --no-disk
+	// the key is only in the agent already.
+	if !opts.NoDisk && opts.Targets.Agent {
+		err = kssh.AddKeyToSSHAgent(keyPath)
+	}
 	if err != nil {
-		fmt.Printf("Failed to add SSH key to the SSH agent: %v\n", err)
-		os.Exit(1)
+		if !gitMode || opts.NonInteractive {
+			fmt.Fprintf(os.Stderr, "Failed to add SSH key to the SSH agent: %v\n", err)
+			os.Exit(1)
+		}
+		// git never needs the agent since the key is passed via -i
+		log.Debugf("Failed to add SSH key to the SSH agent: %v", err)
 	}
 
 	argumentList := []string{"-i", keyPath, "-o", "IdentitiesOnly=yes"}
-	checkAndWarnOnUnspecifiedBehavior(useConfig, remainingArgs)
+	if opts.NonInteractive && opts.Targets.Agent || opts.NoDisk || !usesKeyFile(opts) {
+		// The key is only delivered via the ssh-agent so that kssh does not override the identities of a caller that
+		// invokes ssh with its own arguments
+		argumentList = []string{}
+	}
+	if usesPKCS11(opts) {
+		argumentList = append(argumentList, kssh.PKCS11SSHArgs(keyPath, opts.Targets.PKCS11Provider)...)
+	}
 	if useConfig {
 		argumentList = append(argumentList, "-F", kssh.AlternateSSHConfigFile)
 		log.WithField("user", user).Debug("Using default ssh user")
 	}
 
-	argumentList = append(argumentList, remainingArgs...)
+	// Tunnel through the cloud provider if the CA configured one for this host
+	conf, err := kssh.GetCachedClientConfig(keyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load the cached client config: %v\n", err)
+		os.Exit(1)
+	}
+	tunnelArgs, err := kssh.GetCloudTunnelArgs(conf, destinationArgs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to configure cloud tunnel: %v\n", err)
+		os.Exit(1)
+	}
+	if len(tunnelArgs) > 0 {
+		log.WithField("args", tunnelArgs).Debug("Using cloud tunnel")
+		argumentList = append(argumentList, tunnelArgs...)
+		if opts.Action == Mosh {
+			log.Warn("Warning: the cloud tunnel only carries the ssh connection that starts mosh-server, mosh itself " +
+				"needs to reach the host directly over UDP")
+		}
+	}
 
-	cmd := exec.Command("ssh", argumentList...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	err = cmd.Run()
+	// Log in as the default user the CA configured for this host unless the user set their own default user
+	if user == "" {
+		userArgs := kssh.GetDefaultUserArgs(conf, destinationArgs)
+		if len(userArgs) > 0 {
+			log.WithField("args", userArgs).Debug("Using the default user configured by the CA")
+			argumentList = append(argumentList, userArgs...)
+		}
+	}
+	return argumentList
+}
 
+// Run mosh with the given key. mosh bootstraps the connection by running mosh-server via ssh, which is given the same
+// options as kssh would run ssh with. Calls os.Exit and does not return.
+func runMoshWithKey(opts Options, keyPath string, remainingArgs []string) {
+	sshArgs := getSSHArgs(opts, keyPath, sshDestinationArgs(opts, remainingArgs), false)
+	moshArgs, err := kssh.GetMoshArgs(sshArgs, remainingArgs)
+	if err != nil {
+		exitWithError(opts, ExitUsage, err)
+	}
+	if opts.PrintCommand {
+		fmt.Println(kssh.FormatCommand(append([]string{"mosh"}, moshArgs...)))
+		os.Exit(0)
+	}
+	hookKeyPath := keyPath
+	if opts.NoDisk {
+		hookKeyPath = ""
+	}
+	err = kssh.RunHooks(kssh.PreExec, kssh.HookContext{KeyPath: hookKeyPath, SSHArgs: sshArgs})
 	if err != nil {
-		fmt.Printf("SSH exited with err: %v\n", err)
+		fmt.Fprintf(os.Stderr, "%v\n", err)
 		os.Exit(1)
 	}
-	os.Exit(0)
+	runPreConnectHooks(keyPath, hookKeyPath, sshArgs)
+	connectedAt := time.Now()
+	moshExit, err := kssh.RunMosh(moshArgs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	// Unlike ssh, mosh does not exit with the exit code of the remote command so anything else is a failure
+	if moshExit.Code == 0 && !opts.NonInteractive {
+		recordSession(opts, keyPath, sshArgs, remainingArgs, connectedAt)
+	}
+	moshExit.Exit()
 }
 
-func checkAndWarnOnUnspecifiedBehavior(useConfig bool, arguments []string) {
-	if useConfig {
-		for _, arg := range arguments {
-			if arg == "-F" {
-				log.Warn("Warning: You passed a -F flag, but kssh also uses this argument in " +
-					"order to implement support for a default SSH username, which you're also using. " +
-					"Either do not use the -F flag or run `kssh --clear-default-user` to reset the " +
-					"default SSH user and delegate this to the running CA bot.")
-			}
+// Record the metadata of a successful connection made with the given kssh and user arguments so that --last can
+// reconnect to it. Failures are only logged since the connection itself worked.
+func recordSession(opts Options, keyPath string, ksshArgs, userArgs []string, connectedAt time.Time) {
+	var destinationArgs []string
+	var user, host string
+	if opts.Action == Mosh {
+		destinationArgs = kssh.GetMoshArgsUntilDestination(userArgs)
+		user, host = kssh.GetMoshDestination(userArgs)
+	} else {
+		destinationArgs = kssh.GetSSHArgsUntilDestination(userArgs)
+		user, host = kssh.GetSSHDestination(userArgs)
+	}
+	if host == "" {
+		return
+	}
+	defaultUser, err := kssh.GetDefaultSSHUser()
+	if err != nil {
+		log.Debugf("Failed to retrieve default SSH user: %v", err)
+	}
+	session := kssh.Session{
+		Args:          destinationArgs,
+		Mosh:          opts.Action == Mosh,
+		BotName:       opts.BotName,
+		User:          kssh.GetSessionUser(user, append(append([]string{}, ksshArgs...), destinationArgs...), defaultUser),
+		LastConnected: connectedAt,
+	}
+	if cert, err := kssh.ReadCertificate(keyPath); err == nil {
+		session.Principals = cert.ValidPrincipals
+	}
+	err = kssh.RecordSession(host, session)
+	if err != nil {
+		log.Debugf("Failed to record the session: %v", err)
+	}
+}
+
+// Run SSH with the given key. Calls os.Exit and does not return.
+func runSSHWithKey(opts Options, keyPath string, remainingArgs []string) {
+	// When kssh is git's core.sshCommand, stdout carries the git protocol. All errors are written to stderr and
+	// failures that do not prevent connecting are not fatal.
+	gitMode := kssh.IsGitInvocation(remainingArgs)
+	if gitMode {
+		log.Debug("Detected a git invocation")
+	}
+	argumentList := getSSHArgs(opts, keyPath, remainingArgs, gitMode)
+
+	// The user's arguments come last so ssh would silently prefer kssh's options for most conflicts
+	for _, conflict := range kssh.FindSSHOptionConflicts(argumentList, remainingArgs) {
+		if conflict.Fatal {
+			exitWithError(opts, ExitUsage, fmt.Errorf("%s", conflict.Message))
 		}
+		log.Warnf("Warning: %s", conflict.Message)
+	}
+	ksshArgs := argumentList
+	argumentList = append(append([]string{}, argumentList...), remainingArgs...)
+	if opts.PrintCommand {
+		fmt.Println(kssh.FormatCommand(append([]string{"ssh"}, argumentList...)))
+		os.Exit(0)
+	}
+
+	hookKeyPath := keyPath
+	if opts.NoDisk {
+		hookKeyPath = ""
+	}
+	err := kssh.RunHooks(kssh.PreExec, kssh.HookContext{KeyPath: hookKeyPath, SSHArgs: argumentList})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	runPreConnectHooks(keyPath, hookKeyPath, argumentList)
+
+	// Exit the same way as ssh so that callers like git and scripts see the real result
+	connectedAt := time.Now()
+	sshExit, err := kssh.RunSSH(argumentList)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SSH exited with err: %v\n", err)
+		os.Exit(1)
+	}
+	// ssh exits with 255 if it failed to connect and otherwise with the exit code of the remote command. Connections
+	// made by git and other programs are not worth reconnecting to via --last.
+	if sshExit.Code != 255 && !gitMode && !opts.NonInteractive {
+		recordSession(opts, keyPath, ksshArgs, remainingArgs, connectedAt)
 	}
+	sshExit.Exit()
 }
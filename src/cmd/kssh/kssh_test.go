@@ -1,45 +1,164 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
-	"os"
 	"testing"
 
-	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/bot-sshca/src/kssh"
 	"github.com/stretchr/testify/require"
 )
 
-func copyKeyFromTestFixture(t *testing.T, name, destination string) {
-	priv, err := ioutil.ReadFile(fmt.Sprintf("../../../tests/testFiles/%s", name))
+func TestHandleArgsJSON(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--provision", "--json", "--no-exec", "--bot", "cabot"})
 	require.NoError(t, err)
-	err = ioutil.WriteFile(destination, priv, 0600)
+	require.Equal(t, Options{BotName: "cabot", Action: Provision, JSON: true, NoExec: true}, opts)
+	require.Empty(t, remaining)
+
+	_, _, err = handleArgs([]string{"--json", "root@server"})
+	require.Error(t, err)
+
+	_, _, err = handleArgs([]string{"--no-exec", "root@server"})
+	require.Error(t, err)
+}
+
+func TestHandleArgsProxyMode(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--proxy-mode", "server.example.com", "22"})
 	require.NoError(t, err)
-	pub, err := ioutil.ReadFile(fmt.Sprintf("../../../tests/testFiles/%s.pub", name))
+	require.Equal(t, ProxyMode, opts.Action)
+	require.Equal(t, []string{"server.example.com", "22"}, remaining)
+
+	_, remaining, err = handleArgs([]string{"-v", "--proxy-mode", "server.example.com", "22"})
 	require.NoError(t, err)
-	err = ioutil.WriteFile(shared.KeyPathToPubKey(destination), pub, 0600)
+	require.Equal(t, []string{"server.example.com", "22"}, remaining)
+
+	_, _, err = handleArgs([]string{"--proxy-mode", "server.example.com"})
+	require.Error(t, err)
+}
+
+func TestHandleArgsBenchmark(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--benchmark", "--iterations", "10", "root@server"})
 	require.NoError(t, err)
-	cert, err := ioutil.ReadFile(fmt.Sprintf("../../../tests/testFiles/%s-cert.pub", name))
+	require.Equal(t, Benchmark, opts.Action)
+	require.Equal(t, 10, opts.Iterations)
+	require.Equal(t, []string{"root@server"}, remaining)
+
+	opts, remaining, err = handleArgs([]string{"-v", "--benchmark"})
+	require.NoError(t, err)
+	require.Equal(t, 0, opts.Iterations)
+	require.Empty(t, remaining)
+
+	_, _, err = handleArgs([]string{"--benchmark", "--iterations", "0"})
+	require.Error(t, err)
+
+	_, _, err = handleArgs([]string{"--iterations", "3", "root@server"})
+	require.Error(t, err)
+
+	_, _, err = handleArgs([]string{"--benchmark", "root@server", "ls"})
+	require.Error(t, err)
+}
+
+func TestHandleArgsElevate(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--elevate", "root@server"})
 	require.NoError(t, err)
-	err = ioutil.WriteFile(shared.KeyPathToCert(destination), cert, 0600)
+	require.True(t, opts.Elevate)
+	require.Equal(t, SSH, opts.Action)
+	require.Equal(t, []string{"root@server"}, remaining)
+
+	_, _, err = handleArgs([]string{"--elevate", "--benchmark"})
+	require.Error(t, err)
+}
+
+func TestHandleArgsExtension(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--extension", "groups@acme.com=dba", "--extension", "login@acme.com", "root@server"})
 	require.NoError(t, err)
+	require.Equal(t, map[string]string{"groups@acme.com": "dba", "login@acme.com": ""}, opts.Extensions)
+	require.Equal(t, []string{"root@server"}, remaining)
+
+	_, _, err = handleArgs([]string{"--extension", "permit-pty", "root@server"})
+	require.Error(t, err)
+	_, _, err = handleArgs([]string{"--extension", "groups@acme.com=dba", "--benchmark"})
+	require.Error(t, err)
 }
 
-func TestIsValidCert(t *testing.T) {
-	certTestFilename := "/tmp/bot-sshca-test-is-valid-cert"
+func TestHandleArgsPrintCommand(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--print-command", "-p", "2222", "root@server"})
+	require.NoError(t, err)
+	require.True(t, opts.PrintCommand)
+	require.Equal(t, []string{"-p", "2222", "root@server"}, remaining)
 
-	os.Remove(certTestFilename)
-	os.Remove(shared.KeyPathToPubKey(certTestFilename))
-	os.Remove(shared.KeyPathToCert(certTestFilename))
+	_, _, err = handleArgs([]string{"--print-command", "--provision"})
+	require.Error(t, err)
+}
 
-	// Test that when the cert files don't exist it is not a valid cert
-	require.False(t, isValidCert(certTestFilename))
+func TestHandleArgsMosh(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--mosh", "-v", "--predict=always", "root@server", "tmux", "attach"})
+	require.NoError(t, err)
+	require.Equal(t, Mosh, opts.Action)
+	require.Equal(t, []string{"--predict=always", "root@server", "tmux", "attach"}, remaining)
+	require.Equal(t, []string{"root@server"}, sshDestinationArgs(opts, remaining))
+
+	_, _, err = handleArgs([]string{"--mosh", "--predict", "always"})
+	require.Error(t, err)
+}
+
+func TestHandleArgsVerbosity(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--quiet", "root@server"})
+	require.NoError(t, err)
+	require.Equal(t, kssh.VerbosityQuiet, opts.Verbosity)
+	require.Equal(t, []string{"root@server"}, remaining)
+
+	opts, _, err = handleArgs([]string{"--provision", "--verbose"})
+	require.NoError(t, err)
+	require.Equal(t, kssh.VerbosityVerbose, opts.Verbosity)
+
+	_, _, err = handleArgs([]string{"--quiet", "--verbose", "root@server"})
+	require.Error(t, err)
+}
+
+func TestHandleArgsProfile(t *testing.T) {
+	defer func() { require.NoError(t, kssh.SetProfile("")) }()
+
+	_, remaining, err := handleArgs([]string{"--profile", "work", "root@server"})
+	require.NoError(t, err)
+	require.Equal(t, "work", kssh.GetProfile())
+	require.Equal(t, []string{"root@server"}, remaining)
+
+	_, _, err = handleArgs([]string{"--profile", "../work", "root@server"})
+	require.Error(t, err)
+}
+
+func TestUsesKeyFile(t *testing.T) {
+	// Connecting only via a PKCS#11 token does not need a key on disk
+	opts := Options{Action: SSH, Targets: kssh.InstallTargets{PKCS11: true}}
+	require.False(t, usesKeyFile(opts))
+	require.True(t, usesPKCS11(opts))
+
+	// But every other action does
+	opts.Action = ExportAgentSocket
+	require.True(t, usesKeyFile(opts))
+	require.False(t, usesPKCS11(opts))
+	opts = Options{Action: Provision, JSON: true, Targets: kssh.InstallTargets{PKCS11: true}}
+	require.True(t, usesKeyFile(opts))
+	require.False(t, usesPKCS11(opts))
+
+	opts = Options{Action: SSH, Targets: kssh.InstallTargets{File: true, Agent: true}}
+	require.True(t, usesKeyFile(opts))
+	require.False(t, usesPKCS11(opts))
+}
+
+func TestHandleArgsPushKey(t *testing.T) {
+	opts, remaining, err := handleArgs([]string{"--push-key", "root@server", "-p", "2222"})
+	require.NoError(t, err)
+	require.Equal(t, PushKey, opts.Action)
+	require.False(t, opts.TrustCA)
+	require.Equal(t, []string{"root@server", "-p", "2222"}, remaining)
+
+	opts, _, err = handleArgs([]string{"--trust-ca", "--push-key", "root@server"})
+	require.NoError(t, err)
+	require.True(t, opts.TrustCA)
 
-	// Test that a valid cert signed for the next 100 years is a valid cert
-	copyKeyFromTestFixture(t, "valid", certTestFilename)
-	require.True(t, isValidCert(certTestFilename))
+	_, _, err = handleArgs([]string{"--trust-ca", "root@server"})
+	require.Error(t, err)
 
-	// Test that an expired cert is not valid
-	copyKeyFromTestFixture(t, "expired", certTestFilename)
-	require.False(t, isValidCert(certTestFilename))
+	_, _, err = handleArgs([]string{"--push-key", "root@server", "--elevate"})
+	require.Error(t, err)
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/kssh"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+var VersionNumber = "master"
+
+// The location of the daemon's log file when started via `ksshd-agent start`
+var logLocation = shared.ExpandPathWithTilde("~/.ssh/ksshd-agent.log")
+
+// How long `ksshd-agent start` waits for the daemon to start accepting requests
+const startTimeout = 30 * time.Second
+
+func main() {
+	kssh.InitLogging()
+	daemonFlags := []cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "bot",
+			Usage: "A bot to keep a valid key for. May be specified multiple times. Defaults to the default kssh bot",
+		},
+		cli.DurationFlag{
+			Name:  "renew-before",
+			Usage: "Renew a key once less than this much of its validity remains. Defaults to 20% of its validity",
+		},
+	}
+
+	app := cli.NewApp()
+	app.Name = "ksshd-agent"
+	app.Usage = "Keep a valid kssh certificate in the ssh-agent at all times"
+	app.Version = VersionNumber
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "Log debug information",
+		},
+		cli.StringFlag{
+			Name:   "profile",
+			Usage:  "The kssh profile to keep a valid key for",
+			EnvVar: kssh.ProfileEnvVar,
+		},
+		cli.StringFlag{
+			Name:   "keybase-user",
+			Usage:  "The Keybase account to act as. Defaults to the account set via kssh --set-keybase-user",
+			EnvVar: kssh.KeybaseUserEnvVar,
+		},
+	}
+	app.Before = func(c *cli.Context) error {
+		if c.Bool("debug") {
+			log.SetLevel(log.DebugLevel)
+		}
+		err := kssh.SetProfile(c.String("profile"))
+		if err != nil {
+			return err
+		}
+		return kssh.SelectKeybaseAccount(c.String("keybase-user"))
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "start",
+			Usage:  "Start ksshd-agent in the background",
+			Flags:  daemonFlags,
+			Action: startAction,
+		},
+		{
+			Name:   "stop",
+			Usage:  "Stop the running ksshd-agent",
+			Action: stopAction,
+		},
+		{
+			Name:   "status",
+			Usage:  "Show the status of the running ksshd-agent",
+			Action: statusAction,
+		},
+		{
+			Name:   "run",
+			Usage:  "Run ksshd-agent in the foreground",
+			Flags:  daemonFlags,
+			Action: runAction,
+		},
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+// The action for the `ksshd-agent start` subcommand
+func startAction(c *cli.Context) error {
+	if resp, err := kssh.CallDaemon(kssh.DaemonRequest{Command: kssh.DaemonCommandStatus}, time.Second); err == nil {
+		return fmt.Errorf("ksshd-agent is already running (pid %d)", resp.PID)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine the location of ksshd-agent: %v", err)
+	}
+	args := []string{"run", "--renew-before", c.Duration("renew-before").String()}
+	for _, bot := range c.StringSlice("bot") {
+		args = append(args, "--bot", bot)
+	}
+	if c.GlobalBool("debug") {
+		args = append([]string{"--debug"}, args...)
+	}
+	logFile, err := os.OpenFile(logLocation, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open the log file %s: %v", logLocation, err)
+	}
+	defer logFile.Close()
+
+	cmd := exec.Command(executable, args...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start ksshd-agent: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Wait for the daemon to start accepting requests so that a subsequent kssh invocation can use it
+	deadline := time.Now().Add(startTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("ksshd-agent exited during startup (%v), see %s", err, logLocation)
+		case <-time.After(200 * time.Millisecond):
+		}
+		if resp, err := kssh.CallDaemon(kssh.DaemonRequest{Command: kssh.DaemonCommandStatus}, time.Second); err == nil {
+			fmt.Printf("Started ksshd-agent (pid %d), logging to %s\n", resp.PID, logLocation)
+			return nil
+		}
+	}
+	return fmt.Errorf("timed out waiting for ksshd-agent to start, see %s", logLocation)
+}
+
+// The action for the `ksshd-agent stop` subcommand
+func stopAction(c *cli.Context) error {
+	resp, err := kssh.CallDaemon(kssh.DaemonRequest{Command: kssh.DaemonCommandStop}, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Stopped ksshd-agent (pid %d)\n", resp.PID)
+	return nil
+}
+
+// The action for the `ksshd-agent status` subcommand
+func statusAction(c *cli.Context) error {
+	resp, err := kssh.CallDaemon(kssh.DaemonRequest{Command: kssh.DaemonCommandStatus}, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ksshd-agent is running (pid %d)\n", resp.PID)
+	for _, key := range resp.Keys {
+		botName := key.BotName
+		if botName == "" {
+			botName = "(default bot)"
+		}
+		validity := "no valid key"
+		if key.ValidBefore != "" {
+			validity = "valid until " + key.ValidBefore
+		}
+		fmt.Printf("  %s: %s %s\n", botName, key.KeyPath, validity)
+		if key.LastError != "" {
+			fmt.Printf("    last error: %s\n", key.LastError)
+		}
+	}
+	return nil
+}
+
+// The action for the `ksshd-agent run` subcommand
+func runAction(c *cli.Context) error {
+	if _, err := kssh.CallDaemon(kssh.DaemonRequest{Command: kssh.DaemonCommandStatus}, time.Second); err == nil {
+		return fmt.Errorf("ksshd-agent is already running")
+	}
+	_, err := kssh.VerifyKeybaseBinary()
+	if err != nil {
+		return err
+	}
+	socket, err := kssh.GetDaemonSocketPath()
+	if err != nil {
+		return err
+	}
+	// Nothing is listening so any existing socket was left behind by a daemon that did not shut down cleanly
+	err = os.Remove(socket)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale socket %s: %v", socket, err)
+	}
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", socket, err)
+	}
+	defer os.Remove(socket)
+
+	requester, err := kssh.NewRequester()
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	bots := c.StringSlice("bot")
+	if len(bots) == 0 {
+		bots = []string{""}
+	}
+	daemon := kssh.NewDaemon(&requester, bots, c.Duration("renew-before"))
+
+	// Keep running when the terminal that started us goes away
+	signal.Ignore(syscall.SIGHUP)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		daemon.Stop()
+	}()
+
+	fmt.Printf("ksshd-agent listening on %s\n", socket)
+	return daemon.Serve(listener)
+}
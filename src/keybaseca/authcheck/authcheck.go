@@ -0,0 +1,325 @@
+package authcheck
+
+/*
+authcheck decides whether sshd should accept a keybaseca certificate based on state that changes faster than
+certificates expire. It is used by `kssh-authcheck` which sshd runs as its AuthorizedPrincipalsCommand. A certificate
+is rejected if it is listed in the key revocation list (KRL), if it was issued before the CA went into lockdown (unless
+it was issued to a break-glass user), or if it is older than the maximum age. The KRL and the lockdown state are read
+from KBFS (or any file or https URL) on every login so that revocations take effect without waiting for the KRL to be
+distributed to every server. The last copy that was read successfully is cached so that a KBFS or network outage does
+not lock everyone out. If the CA signs with an intermediate CA key (see INTERMEDIATE_CERT_LOCATION), kssh-authcheck
+runs as sshd's AuthorizedKeysCommand instead and also checks the certificate chain against the offline root CA key.
+Canary certificates (see the canary package) are always rejected and reported to the CA.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/canary"
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/bot-sshca/src/shared"
+	"golang.org/x/crypto/ssh"
+)
+
+// Options describes how certificates are checked
+type Options struct {
+	// The location of the KRL. Either a file (which may be in /keybase/) or an https URL. Optional.
+	KRLLocation string
+	// The location of the lockdown state written by keybaseca (see LOCKDOWN_LOCATION). Either a file (which may be in
+	// /keybase/) or an https URL. Optional.
+	LockdownLocation string
+	// The users whose certificates are still accepted during a lockdown (see BREAK_GLASS_USERS)
+	BreakGlassUsers []string
+	// If non-zero, certificates that became valid longer ago than this are rejected
+	MaxAge time.Duration
+	// The directory where the last copies of the KRL and the lockdown state are cached. Optional.
+	CacheDir string
+	// Whether certificates are accepted when the KRL or the lockdown state cannot be read and there is no cached copy
+	FailOpen bool
+	// How long to wait for remote state
+	Timeout time.Duration
+	// The location of the list of canary certificates written by keybaseca (see CANARY_LOCATION). Either a file (which
+	// may be in /keybase/) or an https URL. Optional.
+	CanaryLocation string
+	// The URL of the CA's /canary endpoint that the use of a canary certificate is reported to. Optional.
+	CanaryAlertURL string
+	// The user that is logging in, included in canary alerts. Optional.
+	User string
+}
+
+// ParseCertificate parses a certificate passed by sshd via the %t (key type) and %k (base64 encoded key) tokens
+func ParseCertificate(keyType, encoded string) (*ssh.Certificate, error) {
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the %s key: %v", keyType, err)
+	}
+	key, err := ssh.ParsePublicKey(blob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the %s key: %v", keyType, err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("the %s key is not a certificate", keyType)
+	}
+	return cert, nil
+}
+
+// Check returns an error describing why the given certificate should be rejected or nil if it should be accepted.
+// sshd has already checked the signature, the validity period, and the principals by the time it runs the
+// AuthorizedPrincipalsCommand. When run as the AuthorizedKeysCommand, sshd checks them after AuthorizedKey.
+func Check(cert *ssh.Certificate, opts Options, now time.Time) error {
+	if opts.CanaryLocation != "" {
+		err := checkCanary(cert, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.MaxAge > 0 && now.Sub(time.Unix(int64(cert.ValidAfter), 0)) > opts.MaxAge {
+		return fmt.Errorf("the certificate %s is older than %s", cert.KeyId, opts.MaxAge)
+	}
+	if opts.LockdownLocation != "" {
+		err := checkLockdown(cert, opts)
+		if err != nil {
+			return err
+		}
+	}
+	if opts.KRLLocation != "" {
+		err := checkKRL(cert, opts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reject certificates that were issued before the CA went into lockdown unless they belong to a break-glass user
+func checkLockdown(cert *ssh.Certificate, opts Options) error {
+	contents, err := readState(opts.LockdownLocation, opts)
+	if os.IsNotExist(err) {
+		// keybaseca only writes the lockdown state once lockdown is first turned on
+		return nil
+	}
+	if err != nil {
+		return stateError("lockdown state", err, opts)
+	}
+	var state lockdown.State
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		return stateError("lockdown state", fmt.Errorf("failed to parse it: %v", err), opts)
+	}
+	if !state.Enabled || !time.Unix(int64(cert.ValidAfter), 0).Before(state.ChangedAt) {
+		return nil
+	}
+	username := KeyIDUsername(cert.KeyId)
+	for _, user := range opts.BreakGlassUsers {
+		if strings.EqualFold(user, username) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the certificate %s was issued before the CA went into lockdown", cert.KeyId)
+}
+
+// Reject canary certificates and report them to the CA. Unlike the other checks, certificates are accepted if the
+// list of canaries cannot be read even without opts.FailOpen since canaries are never used legitimately, so an
+// unreadable list only means that a canary may go unnoticed.
+func checkCanary(cert *ssh.Certificate, opts Options) error {
+	contents, err := readState(opts.CanaryLocation, opts)
+	if os.IsNotExist(err) {
+		// keybaseca only writes the list once the first canary is issued
+		return nil
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kssh-authcheck: ignoring the canary list since it could not be read: %v\n", err)
+		return nil
+	}
+	list, err := canary.Parse(contents)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kssh-authcheck: ignoring the canary list since it could not be parsed: %v\n", err)
+		return nil
+	}
+	if list.Find(cert) == nil {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "kssh-authcheck: ALERT: the canary certificate %s was used to log in\n", cert.KeyId)
+	if opts.CanaryAlertURL != "" {
+		host, _ := os.Hostname()
+		alert := canary.Alert{Certificate: string(ssh.MarshalAuthorizedKey(cert)), Host: host, User: opts.User}
+		err = canary.Report(opts.CanaryAlertURL, alert, opts.Timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kssh-authcheck: failed to report the canary certificate %s to the CA: %v\n", cert.KeyId, err)
+		}
+	}
+	return fmt.Errorf("the certificate %s is a canary", cert.KeyId)
+}
+
+// Reject certificates that are listed in the KRL. OpenSSH's KRL format is checked with `ssh-keygen -Q` since there is
+// no Go implementation.
+func checkKRL(cert *ssh.Certificate, opts Options) error {
+	contents, err := readState(opts.KRLLocation, opts)
+	if err != nil {
+		return stateError("KRL", err, opts)
+	}
+	dir, err := ioutil.TempDir("", "kssh-authcheck")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	krlPath := filepath.Join(dir, "krl")
+	certPath := filepath.Join(dir, "cert.pub")
+	err = ioutil.WriteFile(krlPath, contents, 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0600)
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command("ssh-keygen", "-Q", "-f", krlPath, certPath).CombinedOutput()
+	if strings.Contains(string(output), "REVOKED") {
+		return fmt.Errorf("the certificate %s is revoked", cert.KeyId)
+	}
+	if err != nil {
+		return stateError("KRL", fmt.Errorf("ssh-keygen -Q failed: %s (%v)", strings.TrimSpace(string(output)), err), opts)
+	}
+	return nil
+}
+
+// Returns nil if opts.FailOpen is set or otherwise an error explaining that the named state could not be read
+func stateError(name string, err error, opts Options) error {
+	if opts.FailOpen {
+		fmt.Fprintf(os.Stderr, "kssh-authcheck: ignoring the %s since it could not be read: %v\n", name, err)
+		return nil
+	}
+	return fmt.Errorf("failed to read the %s: %v", name, err)
+}
+
+// KeyIDUsername returns the Keybase username encoded at the end of a key ID generated by keybaseca
+func KeyIDUsername(keyID string) string {
+	return keyID[strings.LastIndex(keyID, ":")+1:]
+}
+
+// Read the state at the given location, falling back to the cached copy if it cannot be read. Returns an error
+// satisfying os.IsNotExist if the state does not exist.
+func readState(location string, opts Options) ([]byte, error) {
+	contents, err := Fetch(location, opts.Timeout)
+	cachePath := ""
+	if opts.CacheDir != "" {
+		hash := sha256.Sum256([]byte(location))
+		cachePath = filepath.Join(opts.CacheDir, hex.EncodeToString(hash[:8]))
+	}
+	if err == nil {
+		if cachePath != "" {
+			// Best effort since the cache is only used during outages
+			_ = ioutil.WriteFile(cachePath+".tmp", contents, 0600)
+			_ = os.Rename(cachePath+".tmp", cachePath)
+		}
+		return contents, nil
+	}
+	if os.IsNotExist(err) {
+		if cachePath != "" {
+			os.Remove(cachePath)
+		}
+		return nil, err
+	}
+	if cachePath != "" {
+		if cached, cacheErr := ioutil.ReadFile(cachePath); cacheErr == nil {
+			fmt.Fprintf(os.Stderr, "kssh-authcheck: using the cached copy of %s: %v\n", location, err)
+			return cached, nil
+		}
+	}
+	return nil, err
+}
+
+// Fetch reads the contents of a file, a file in KBFS, or an https URL. Returns an error satisfying os.IsNotExist if
+// there is nothing at the location.
+func Fetch(location string, timeout time.Duration) ([]byte, error) {
+	if strings.HasPrefix(location, "https://") {
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s returned %s", location, resp.Status)
+		}
+		return ioutil.ReadAll(resp.Body)
+	}
+	if strings.HasPrefix(location, "/keybase/") {
+		ko := constants.GetDefaultKBFSOperationsStruct()
+		exists, err := ko.FileExists(location)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, os.ErrNotExist
+		}
+		return ko.Read(location)
+	}
+	return ioutil.ReadFile(location)
+}
+
+// ReadPrincipals reads the principals that are accepted for a user from an AuthorizedPrincipalsFile, skipping
+// comments and blank lines
+func ReadPrincipals(filename string) ([]string, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var principals []string
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			principals = append(principals, line)
+		}
+	}
+	return principals, nil
+}
+
+// AuthorizedKey returns the authorized_keys line that makes sshd accept certificates signed by the intermediate CA key
+// that signed cert for the given principals (read from the user's AuthorizedPrincipalsFile). This is used when sshd
+// runs kssh-authcheck as its AuthorizedKeysCommand so that servers only need to trust the offline root CA keys and
+// do not need to be updated when the intermediate CA key is rotated. Returns an error if cert was not signed by an
+// intermediate CA key certified by one of the given root CA keys or if the intermediate certificate does not allow any
+// of the principals.
+func AuthorizedKey(cert *ssh.Certificate, roots []ssh.PublicKey, principals []string, now time.Time) (string, error) {
+	var intermediate *ssh.Certificate
+	err := fmt.Errorf("no root CA keys are configured")
+	for _, root := range roots {
+		intermediate, err = shared.VerifyChain(cert, root, now)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	var allowed []string
+	for _, principal := range principals {
+		// The principals are written into a quoted, comma separated option
+		if !strings.ContainsAny(principal, "\",") && shared.IntermediateAllows(intermediate, principal) {
+			allowed = append(allowed, principal)
+		}
+	}
+	if len(allowed) == 0 {
+		return "", fmt.Errorf("the intermediate certificate %s does not allow any of the principals accepted for the user",
+			intermediate.KeyId)
+	}
+	return fmt.Sprintf("cert-authority,principals=\"%s\" %s", strings.Join(allowed, ","),
+		strings.TrimSpace(string(ssh.MarshalAuthorizedKey(intermediate.Key)))), nil
+}
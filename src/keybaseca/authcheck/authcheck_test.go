@@ -0,0 +1,217 @@
+package authcheck
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/canary"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func generateCert(t *testing.T, keyID string, validAfter time.Time) *ssh.Certificate {
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	require.NoError(t, err)
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: []string{"team.ssh.prod"},
+		ValidAfter:      uint64(validAfter.Unix()),
+		ValidBefore:     uint64(validAfter.Add(time.Hour).Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert
+}
+
+func TestParseCertificate(t *testing.T) {
+	cert := generateCert(t, "a:b:alice", time.Now())
+	parsed, err := ParseCertificate(cert.Type(), base64.StdEncoding.EncodeToString(cert.Marshal()))
+	require.NoError(t, err)
+	require.Equal(t, "a:b:alice", parsed.KeyId)
+
+	_, err = ParseCertificate(cert.Type(), base64.StdEncoding.EncodeToString(cert.Key.Marshal()))
+	require.Error(t, err)
+	require.Equal(t, "alice", KeyIDUsername(parsed.KeyId))
+}
+
+func TestCheckLockdownAndMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authcheck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	lockdownPath := filepath.Join(dir, "lockdown.json")
+	opts := Options{LockdownLocation: lockdownPath, BreakGlassUsers: []string{"Bob"}, CacheDir: dir}
+
+	oldCert := generateCert(t, "a:b:alice", now.Add(-time.Hour))
+	newCert := generateCert(t, "a:b:alice", now.Add(time.Minute))
+	breakGlassCert := generateCert(t, "a:b:bob", now.Add(-time.Hour))
+
+	// A missing lockdown state means that the CA has never been in lockdown
+	require.NoError(t, Check(oldCert, opts, now))
+
+	bytes, err := json.Marshal(lockdown.State{Enabled: true, ChangedAt: now})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(lockdownPath, bytes, 0600))
+	require.Error(t, Check(oldCert, opts, now))
+	require.NoError(t, Check(newCert, opts, now))
+	require.NoError(t, Check(breakGlassCert, opts, now))
+
+	// The cached copy is used if the state cannot be read
+	require.NoError(t, os.Chmod(lockdownPath, 0))
+	if _, err := ioutil.ReadFile(lockdownPath); err != nil {
+		require.Error(t, Check(oldCert, opts, now))
+		opts.CacheDir = ""
+		require.Error(t, Check(newCert, opts, now))
+		opts.FailOpen = true
+		require.NoError(t, Check(oldCert, opts, now))
+	}
+
+	opts = Options{MaxAge: 30 * time.Minute}
+	require.Error(t, Check(oldCert, opts, now))
+	require.NoError(t, Check(newCert, opts, now))
+}
+
+func TestCheckKRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authcheck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	revoked := generateCert(t, "a:b:alice", time.Now())
+	valid := generateCert(t, "a:b:bob", time.Now())
+
+	revokedPath := filepath.Join(dir, "revoked.pub")
+	require.NoError(t, ioutil.WriteFile(revokedPath, ssh.MarshalAuthorizedKey(revoked.Key), 0600))
+	krlPath := filepath.Join(dir, "krl")
+	output, err := exec.Command("ssh-keygen", "-k", "-f", krlPath, revokedPath).CombinedOutput()
+	require.NoError(t, err, string(output))
+
+	opts := Options{KRLLocation: krlPath}
+	require.Error(t, Check(revoked, opts, time.Now()))
+	require.NoError(t, Check(valid, opts, time.Now()))
+
+	opts.KRLLocation = filepath.Join(dir, "missing")
+	require.Error(t, Check(valid, opts, time.Now()))
+}
+
+func TestCheckCanary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authcheck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	planted := generateCert(t, "a:b:deploy_bot", time.Now())
+	planted.Serial = 42
+	valid := generateCert(t, "a:b:alice", time.Now())
+	var alerts []canary.Alert
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert canary.Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Error(err)
+		}
+		alerts = append(alerts, alert)
+	}))
+	defer server.Close()
+
+	canaryPath := filepath.Join(dir, "canaries.json")
+	opts := Options{CanaryLocation: canaryPath, CanaryAlertURL: server.URL, User: "root", Timeout: time.Second}
+	// A missing or unreadable list does not lock anyone out
+	require.NoError(t, Check(planted, opts, time.Now()))
+	require.NoError(t, ioutil.WriteFile(canaryPath, []byte("not json"), 0600))
+	require.NoError(t, Check(planted, opts, time.Now()))
+
+	bytes, err := json.Marshal(canary.List{Canaries: []canary.Canary{{Name: "backup", KeyID: planted.KeyId, Serial: 42,
+		Fingerprint: ssh.FingerprintSHA256(planted.Key)}}})
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(canaryPath, bytes, 0600))
+	require.NoError(t, Check(valid, opts, time.Now()))
+	require.Empty(t, alerts)
+	err = Check(planted, opts, time.Now())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "canary")
+	require.Len(t, alerts, 1)
+	require.Equal(t, "root", alerts[0].User)
+	require.Equal(t, string(ssh.MarshalAuthorizedKey(planted)), alerts[0].Certificate)
+
+	// The canary is rejected even if the alert cannot be delivered
+	opts.CanaryAlertURL = "http://127.0.0.1:1/canary"
+	require.Error(t, Check(planted, opts, time.Now()))
+}
+
+func TestReadPrincipals(t *testing.T) {
+	f, err := ioutil.TempFile("", "principals")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# comment\nteam.ssh.prod\n\n  team.ssh.staging \n")
+	require.NoError(t, err)
+	f.Close()
+	principals, err := ReadPrincipals(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.prod", "team.ssh.staging"}, principals)
+}
+
+func TestAuthorizedKey(t *testing.T) {
+	now := time.Now()
+	newSigner := func() ssh.Signer {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		require.NoError(t, err)
+		signer, err := ssh.NewSignerFromKey(priv)
+		require.NoError(t, err)
+		return signer
+	}
+	root := newSigner()
+	ca := newSigner()
+	intermediate := &ssh.Certificate{
+		Key:             ca.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "intermediate",
+		ValidPrincipals: []string{"team.ssh.prod"},
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+		Permissions:     ssh.Permissions{CriticalOptions: map[string]string{shared.IntermediateCriticalOption: ""}},
+	}
+	require.NoError(t, intermediate.SignCert(rand.Reader, root))
+	cert := &ssh.Certificate{
+		Key:             newSigner().PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "a:b:alice",
+		ValidPrincipals: []string{"team.ssh.prod"},
+		ValidAfter:      uint64(now.Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+		Permissions:     ssh.Permissions{Extensions: map[string]string{shared.IntermediateExtension: shared.EncodeIntermediateCert(intermediate)}},
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+
+	line, err := AuthorizedKey(cert, []ssh.PublicKey{newSigner().PublicKey(), root.PublicKey()}, []string{"team.ssh.prod", "team.ssh.staging"}, now)
+	require.NoError(t, err)
+	_, _, options, _, err := ssh.ParseAuthorizedKey([]byte(line))
+	require.NoError(t, err)
+	require.Equal(t, []string{"cert-authority", `principals="team.ssh.prod"`}, options)
+	require.Contains(t, line, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(ca.PublicKey()))))
+
+	// None of the user's principals are allowed by the intermediate certificate
+	_, err = AuthorizedKey(cert, []ssh.PublicKey{root.PublicKey()}, []string{"team.ssh.staging"}, now)
+	require.Error(t, err)
+	// Not certified by the root CA key
+	_, err = AuthorizedKey(cert, []ssh.PublicKey{ca.PublicKey()}, []string{"team.ssh.prod"}, now)
+	require.Error(t, err)
+	// The intermediate certificate expired
+	_, err = AuthorizedKey(cert, []ssh.PublicKey{root.PublicKey()}, []string{"team.ssh.prod"}, now.Add(2*time.Hour))
+	require.Error(t, err)
+}
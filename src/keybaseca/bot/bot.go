@@ -3,16 +3,26 @@ package bot
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"github.com/keybase/bot-sshca/src/keybaseca/chaos"
+	"github.com/keybase/bot-sshca/src/keybaseca/clock"
+	"github.com/keybase/bot-sshca/src/keybaseca/dualcontrol"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/bot-sshca/src/keybaseca/oidc"
+	"github.com/keybase/bot-sshca/src/keybaseca/systemd"
+	"github.com/keybase/bot-sshca/src/keybaseca/threshold"
 	"github.com/keybase/bot-sshca/src/kssh"
 
 	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
 
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
 	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/config"
@@ -20,12 +30,29 @@ import (
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
 // Bot is a SSH CA Keybase-backed bot
 type Bot struct {
 	conf config.Config
 	api  *kbchat.API
+	// The identity provider that users must log in to before a certificate is issued. nil if step-up
+	// authentication is disabled.
+	stepUp *oidc.Provider
+	// Tracks the protocol messages that should be deleted. nil if protocol messages are kept.
+	compactor *compactor
+	// Injects faults into the protocol messages sent to kssh. nil unless running in chaos mode.
+	chaos *chaos.Injector
+	// Coordinates with the other keybaseca instances that hold shares of the CA key. nil unless threshold signing is
+	// enabled.
+	threshold *thresholdSigner
+	// Overrides of the user facing messages (see MESSAGES_FILE)
+	messages shared.Messages
+	// Set if the clock of the CA host was found to be off at startup (see NTP_SERVER) and reported by /healthz
+	clockWarning string
+	// Operations requested in chat that are waiting for a second admin's approval (see DUAL_CONTROL)
+	approvals *pendingApprovals
 }
 
 // New creates a new Bot with a Keybase chat API
@@ -34,13 +61,53 @@ func New(conf config.Config) (ca Bot, err error) {
 	if err != nil {
 		return ca, fmt.Errorf("error starting Keybase chat: %v", err)
 	}
-	return Bot{conf: conf, api: api}, nil
+	ca = Bot{conf: conf, api: api, approvals: newPendingApprovals()}
+	if conf.GetMessagesFile() != "" {
+		ca.messages, err = shared.LoadMessages(conf.GetMessagesFile())
+		if err != nil {
+			return ca, err
+		}
+	}
+	if conf.GetProtocolMessageRetention() > 0 {
+		ca.compactor = newCompactor(conf.GetProtocolMessageRetention())
+	}
+	if settings := conf.GetChaos(); settings != nil {
+		log.Warnf("Running in chaos mode (%+v)! Protocol messages will be delayed, dropped, and malformed. "+
+			"This must never be enabled on a production CA.", *settings)
+		ca.chaos = chaos.NewInjector(*settings)
+	}
+	if conf.GetNTPServer() != "" {
+		ca.clockWarning = clock.Check(conf.GetNTPServer(), 5*time.Second)
+		if ca.clockWarning != "" {
+			log.Warnf("Clock check: %s", ca.clockWarning)
+		}
+	}
+	if conf.GetThresholdShareLocation() != "" {
+		ca.threshold = newThresholdSigner(sshutils.IsThresholdCoordinator(conf, api.GetUsername()))
+	}
+	if conf.GetOIDCIssuer() != "" {
+		ca.stepUp = &oidc.Provider{
+			Issuer:        conf.GetOIDCIssuer(),
+			ClientID:      conf.GetOIDCClientID(),
+			ClientSecret:  conf.GetOIDCClientSecret(),
+			UsernameClaim: conf.GetOIDCUsernameClaim(),
+			RequiredAMR:   conf.GetOIDCRequiredAMR(),
+		}
+		_, err = ca.stepUp.Discover()
+		if err != nil {
+			return ca, fmt.Errorf("failed to set up step-up authentication: %v", err)
+		}
+	}
+	return ca, nil
 }
 
 // Start the SSH CA bot in an infinite loop. Does not return unless it
 // encounters an unrecoverable error.
 func (b *Bot) Start() error {
-	err := b.writeClientConfig()
+	if b.threshold != nil && !b.threshold.coordinator {
+		return b.startThresholdPeer()
+	}
+	err := b.PublishClientConfigs()
 	if err != nil {
 		return fmt.Errorf("failed to start CA bot due to error while writing client config: %v", err)
 	}
@@ -56,18 +123,66 @@ func (b *Bot) Start() error {
 	if err != nil {
 		return fmt.Errorf("failed to start CA bot due to error while sending announcement: %v", err)
 	}
+	b.joinDiscoveryChannel()
 
+	if b.conf.GetRestrictedBot() {
+		log.Infof("Running as a restricted bot. The bot settings in each team must allow messages matching %q or "+
+			"kssh requests will never be received.", shared.RestrictedBotTriggers(b.api.GetUsername()))
+	}
 	sub, err := b.api.ListenForNewTextMessages()
 	if err != nil {
 		return fmt.Errorf("error subscribing to messages: %v", err)
 	}
 
+	// Tell systemd (if we are running under it) that we are up and keep its watchdog fed while the message loop
+	// is still reading messages. The self-ping makes sure there is a message to read even when kssh is not in use, so
+	// a loop that is stuck (eg on a wedged Keybase service) stops being reported as healthy.
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	var progress progressTracker
+	progress.record(time.Now())
+	running := func() bool {
+		select {
+		case <-stopCh:
+			return false
+		default:
+			return progress.isRecent(time.Now(), maxProgressAge)
+		}
+	}
+	go b.runSelfPing(stopCh)
+	err = b.startHTTPServer(running)
+	if err != nil {
+		return fmt.Errorf("failed to start HTTP endpoints: %v", err)
+	}
+	if b.compactor != nil {
+		go b.runCompaction(stopCh)
+	}
+	if b.conf.GetAuditRetention() > 0 {
+		go b.runRetention(stopCh)
+	}
+	if b.conf.GetHeartbeatInterval() > 0 {
+		go b.runHeartbeat(stopCh)
+		defer b.stopHeartbeat()
+	} else {
+		b.deleteStaleHeartbeat()
+	}
+	if _, err = systemd.StartWatchdog(running, stopCh); err != nil {
+		log.Warnf("Failed to start the systemd watchdog: %v", err)
+	}
+	if _, err = systemd.NotifyReady(); err != nil {
+		log.Warnf("Failed to notify systemd of readiness: %v", err)
+	}
+	defer func() {
+		_, _ = systemd.NotifyStopping()
+	}()
+
 	log.Debug("CA Bot now listening for messages...")
 	for {
 		msg, err := sub.Read()
 		if err != nil {
 			return fmt.Errorf("failed to read message: %v", err)
 		}
+		progress.record(time.Now())
 
 		if msg.Message.Content.TypeName != "text" {
 			continue
@@ -86,6 +201,17 @@ func (b *Bot) Start() error {
 			continue
 		}
 
+		// Config requests only reveal the configs of the sender's own teams so they are answered in the discovery
+		// channel even though it is not one of the configured teams
+		if shared.IsConfigRequest(messageBody) && b.isDiscoveryChannel(msg.Message.Channel.Name, msg.Message.Channel.TopicName) {
+			log.Debug("Responding to ConfigRequest")
+			err = b.respondToConfigRequest(msg)
+			if err != nil {
+				log.Warnf("Failed to respond to the config request from %s: %v", msg.Message.Sender.Username, err)
+			}
+			continue
+		}
+
 		// Note that this line is one of the main security barriers around the SSH
 		// CA bot. If this line were removed or had a bug, it would cause the SSH
 		// CA bot to respond to any SignatureRequest messages in any channels. This
@@ -99,20 +225,37 @@ func (b *Bot) Start() error {
 		if shared.IsPingRequest(messageBody, b.api.GetUsername()) {
 			// Respond to messages of the form `ping @botName` with `pong @senderName`
 			log.Debug("Responding to ping with pong")
-			_, err = b.api.SendMessageByConvID(msg.Message.ConvID, shared.GeneratePingResponse(msg.Message.Sender.Username))
+			b.trackProtocolMessage(msg.Message.ConvID, msg.Message.Id)
+			err = b.sendProtocolMessage(msg.Message.ConvID, shared.GeneratePingResponse(msg.Message.Sender.Username))
 			if err != nil {
 				b.LogError(msg, err)
 				continue
 			}
 		} else if shared.IsAckRequest(messageBody) {
 			// Ack any AckRequests so that kssh can determine whether it has fully connected
-			_, err = b.api.SendMessageByConvID(msg.Message.ConvID, shared.GenerateAckResponse(messageBody))
+			b.trackProtocolMessage(msg.Message.ConvID, msg.Message.Id)
+			err = b.sendProtocolMessage(msg.Message.ConvID, shared.GenerateAckResponse(messageBody))
+			if err != nil {
+				b.LogError(msg, err)
+				continue
+			}
+		} else if enabled, ok := lockdown.ParseCommand(messageBody, b.api.GetUsername()); ok {
+			log.Debug("Responding to lockdown command")
+			err = b.handleLockdownCommand(msg, enabled)
+			if err != nil {
+				b.LogError(msg, err)
+				continue
+			}
+		} else if id, ok := dualcontrol.ParseApproveCommand(messageBody, b.api.GetUsername()); ok {
+			log.Debug("Responding to approve command")
+			err = b.handleApproveCommand(msg, id)
 			if err != nil {
 				b.LogError(msg, err)
 				continue
 			}
 		} else if strings.HasPrefix(messageBody, shared.SignatureRequestPreamble) {
 			log.Debug("Responding to SignatureRequest")
+			b.trackProtocolMessage(msg.Message.ConvID, msg.Message.Id)
 			signatureRequest, err := shared.ParseSignatureRequest(messageBody)
 			if err != nil {
 				b.LogError(msg, err)
@@ -120,18 +263,20 @@ func (b *Bot) Start() error {
 			}
 			signatureRequest.Username = msg.Message.Sender.Username
 			signatureRequest.DeviceName = msg.Message.Sender.DeviceName
-			signatureResponse, err := sshutils.ProcessSignatureRequest(b.conf, signatureRequest)
-			if err != nil {
-				b.LogError(msg, err)
+			signatureRequest.ReceivedAt = time.Now()
+			if b.stepUp != nil {
+				// Waiting for the user to log in to the identity provider takes a while so do it in the background
+				go b.stepUpAndSign(msg, signatureRequest)
 				continue
 			}
-
-			response, err := json.Marshal(signatureResponse)
-			if err != nil {
-				b.LogError(msg, err)
+			if b.conf.GetDuoAPIHost() != "" || b.threshold != nil {
+				// Likewise for waiting for the user to answer a Duo push or for the shares of the other instances
+				go b.signAndRespond(msg, signatureRequest)
 				continue
 			}
-			_, err = b.api.SendMessageByConvID(msg.Message.ConvID, shared.SignatureResponsePreamble+string(response))
+			b.signAndRespond(msg, signatureRequest)
+		} else if b.threshold != nil && strings.HasPrefix(messageBody, threshold.ShareResponsePreamble) {
+			err = b.handleShareResponse(msg)
 			if err != nil {
 				b.LogError(msg, err)
 				continue
@@ -142,6 +287,60 @@ func (b *Bot) Start() error {
 	}
 }
 
+// Sign the given signature request and send the response to the conversation it came from
+func (b *Bot) signAndRespond(msg kbchat.SubscriptionMessage, signatureRequest shared.SignatureRequest) {
+	if b.threshold != nil {
+		b.thresholdSignAndRespond(msg, signatureRequest)
+		return
+	}
+	signatureResponse, err := sshutils.ProcessSignatureRequest(b.conf, signatureRequest)
+	if err != nil {
+		b.denyOrLogError(msg, signatureRequest, err)
+		return
+	}
+	b.respondWithSignature(msg, signatureRequest, signatureResponse)
+}
+
+// Send the given signature response to the conversation that signatureRequest came from
+func (b *Bot) respondWithSignature(msg kbchat.SubscriptionMessage, signatureRequest shared.SignatureRequest, signatureResponse shared.SignatureResponse) {
+	response, err := json.Marshal(signatureResponse)
+	if err != nil {
+		b.LogError(msg, err)
+		return
+	}
+	err = b.sendProtocolMessage(msg.Message.ConvID, shared.SignatureResponsePreamble+string(response))
+	if err != nil {
+		b.LogError(msg, err)
+		return
+	}
+	b.notifyCertIssued(signatureRequest, signatureResponse)
+}
+
+// Get the cloud tunnels that kssh clients should use based off of the AWS_* config options
+func (b *Bot) getCloudTunnels() []kssh.CloudTunnel {
+	var tunnels []kssh.CloudTunnel
+	for _, pattern := range b.conf.GetAWSSSMHosts() {
+		tunnels = append(tunnels, kssh.CloudTunnel{HostPattern: pattern, Provider: kssh.CloudProviderAWSSSM, Region: b.conf.GetAWSRegion()})
+	}
+	for _, pattern := range b.conf.GetAWSInstanceConnectHosts() {
+		tunnels = append(tunnels, kssh.CloudTunnel{HostPattern: pattern, Provider: kssh.CloudProviderAWSInstanceConnect, Region: b.conf.GetAWSRegion()})
+	}
+	return tunnels
+}
+
+// PublishClientConfigs writes the kssh client config to every configured team and deletes the configs left behind in
+// teams that were removed from the config since the last start. Used on startup and by `keybaseca init`.
+func (b *Bot) PublishClientConfigs() error {
+	err := b.writeClientConfig()
+	if err != nil {
+		return err
+	}
+	if _, err = b.ReconcileClientConfigs(false); err != nil {
+		log.Warnf("Failed to delete stale client configs: %v", err)
+	}
+	return nil
+}
+
 // Write kssh config for kssh to use
 func (b *Bot) writeClientConfig() error {
 	username := b.api.GetUsername()
@@ -149,7 +348,10 @@ func (b *Bot) writeClientConfig() error {
 		return fmt.Errorf("failed to get a username from kbChat, got an empty string")
 	}
 
-	teams := b.conf.GetTeams()
+	teams, err := b.getConfiguredTeams()
+	if err != nil {
+		return err
+	}
 	if b.conf.GetChatTeam() != "" {
 		// Make sure we write the kssh config in the chat team, which may not be in
 		// the list of teams
@@ -159,6 +361,46 @@ func (b *Bot) writeClientConfig() error {
 
 	// If they configured a chat team, have messages go there
 	config := kssh.Config{TeamName: b.conf.GetChatTeam(), BotName: username, ChannelName: b.conf.GetChannelName()}
+	config.CloudTunnels = b.getCloudTunnels()
+	for _, entry := range b.conf.GetDefaultSSHUsers() {
+		config.DefaultUsers = append(config.DefaultUsers, kssh.DefaultUser{HostPattern: entry.HostPattern, User: entry.User})
+	}
+	config.ElevatedPrincipals = sshutils.GetElevatedPrincipalNames(b.conf)
+	config.GroupPrincipals = sshutils.GetGroupPrincipalNames(b.conf)
+	config.UsernamePrincipals = len(b.conf.GetUsernamePrincipalTeams()) > 0
+	config.ExplodingLifetime = int(b.conf.GetExplodingMessageLifetime() / time.Second)
+	caPublicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(b.conf.GetCAKeyLocation()))
+	if err != nil {
+		// kssh still works but cannot check that certificates were signed by this CA
+		log.Warnf("Failed to read the CA public key, kssh will not be able to verify certificates: %v", err)
+	} else {
+		config.CAPublicKey = strings.TrimSpace(string(caPublicKey))
+		b.putMirroredCAPublicKey(config.CAPublicKey)
+	}
+	if len(b.conf.GetThresholdTeams()) > 0 {
+		thresholdCAPublicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(b.conf.GetThresholdCAKeyLocation()))
+		if err != nil {
+			// kssh checks certificates for the threshold teams against the CA key and so rejects them
+			log.Warnf("Failed to read the threshold CA public key, kssh will reject threshold signed certificates: %v", err)
+		} else {
+			config.ThresholdTeams = b.conf.GetThresholdTeams()
+			config.ThresholdCAPublicKey = strings.TrimSpace(string(thresholdCAPublicKey))
+		}
+	}
+	intermediate, err := sshutils.LoadIntermediateCert(b.conf, time.Now())
+	if err != nil {
+		log.Warnf("Failed to load the intermediate certificate, kssh will verify certificates against the CA key: %v", err)
+	} else if intermediate != nil {
+		config.RootCAPublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(intermediate.SignatureKey)))
+	}
+	config.Mirrors = b.getMirrorReadLocations()
+	config.MetricsEndpoint = b.conf.GetKsshMetricsEndpoint()
+	for _, hook := range b.conf.GetPreConnectHooks() {
+		config.PreConnectHooks = append(config.PreConnectHooks, kssh.PreConnectHook{HostPattern: hook.HostPattern,
+			Provider: hook.Provider, Target: hook.Target, Region: b.conf.GetAWSRegion(),
+			Duration: int(b.conf.GetPreConnectDuration() / time.Second)})
+	}
+	config.Messages = b.messages.WithPrefix("kssh.")
 
 	for _, team := range teams {
 		if b.conf.GetChatTeam() == "" {
@@ -166,8 +408,18 @@ func (b *Bot) writeClientConfig() error {
 			// channel. This is done by having each client config reference the team
 			// it is found in.
 			config.TeamName = team
-			config.ChannelName = ""
+			config.ChannelName = b.conf.GetSigningChannel()
+			if config.ChannelName != "" {
+				// Make sure the bot receives messages from the signing channel, including in subteams matching a team
+				// pattern which are not validated with the rest of the config
+				_, err := b.api.JoinChannel(team, config.ChannelName)
+				if err != nil {
+					return fmt.Errorf("failed to join the signing channel %s in %s (does it exist?): %v", config.ChannelName, team, err)
+				}
+			}
 		}
+		config.FeatureFlags = b.getFeatureFlags(team)
+		config.Version = config.ComputeVersion()
 
 		var bytes []byte
 		bytes, err := json.Marshal(config)
@@ -175,34 +427,49 @@ func (b *Bot) writeClientConfig() error {
 			log.Debugf("Failed to serialize kssh config (%v) for team %+v: %v", config, team, err)
 			return err
 		}
-		_, err = b.api.PutEntry(&team, shared.SSHCANamespace, shared.SSHCAConfigKey, string(bytes))
+		err = b.putClientConfig(team, string(bytes))
 		if err != nil {
 			log.Debugf("Failed to write kssh config (%v) for team %v: %v", config, team, err)
 			return err
 		}
+		b.putMirroredClientConfig(team, string(bytes))
 	}
 
 	log.Debugf("Wrote kssh client configs for the teams: %v", teams)
 	return nil
 }
 
+// Returns the feature flags (see KSSH_FEATURE_FLAGS) that apply to the users of the given team. If several entries
+// name the same feature, the first one that matches the team is used so that team specific entries can be listed
+// before a default for every team.
+func (b *Bot) getFeatureFlags(team string) []kssh.FeatureFlag {
+	var flags []kssh.FeatureFlag
+	seen := make(map[string]bool)
+	for _, flag := range b.conf.GetKsshFeatureFlags() {
+		if seen[flag.Name] || flag.Team != "" && !shared.MatchTeam(flag.Team, team) {
+			continue
+		}
+		seen[flag.Name] = true
+		flags = append(flags, kssh.FeatureFlag{Name: flag.Name, Percent: flag.Percent})
+	}
+	return flags
+}
+
 // Attempts to delete the kssh configs for the specified teams.
 func (b *Bot) deleteClientConfig(teams []string) (found []string, err error) {
 	log.Debugf("Attempting to delete kssh configs for the teams: %v", teams)
 	for _, team := range teams {
-		_, err := b.api.DeleteEntry(&team, shared.SSHCANamespace, shared.SSHCAConfigKey)
+		exists, err := b.removeClientConfig(team)
 		if err != nil {
-			kerr, ok := err.(kbchat.Error)
-			if ok && kerr.Code == kbchat.DeleteNonExistentErrorCode {
-				// ignore if we couldn't find the kssh config for this team
-				log.Debugf("Did not find kssh config to delete for the team: %v", team)
-			} else {
-				// unexpected error
-				log.Debugf("Unexpected error deleting kssh config for the team: %v", team)
-				return found, err
-			}
-		} else {
+			log.Debugf("Unexpected error deleting kssh config for the team: %v", team)
+			return found, err
+		}
+		b.removeMirroredClientConfig(team)
+		if exists {
 			found = append(found, team)
+		} else {
+			// ignore if we couldn't find the kssh config for this team
+			log.Debugf("Did not find kssh config to delete for the team: %v", team)
 		}
 	}
 	log.Debugf("Deleted kssh configs for the teams: %v", found)
@@ -217,8 +484,14 @@ func (b *Bot) captureControlCToDeleteClientConfig() {
 	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-signalChan
+		_, _ = systemd.NotifyStopping()
+		b.stopHeartbeat()
 		fmt.Println("Losing CA bot, now deleting client configs...")
-		teams := b.conf.GetTeams()
+		teams, err := b.getConfiguredTeams()
+		if err != nil {
+			log.Warnf("Failed to get teams to delete client configs: %v", err)
+			os.Exit(1)
+		}
 		if b.conf.GetChatTeam() != "" {
 			// Make sure we delete the client config in the chat team which may not
 			// be in the list of teams
@@ -226,10 +499,10 @@ func (b *Bot) captureControlCToDeleteClientConfig() {
 		}
 		found, err := b.deleteClientConfig(teams)
 		if err != nil {
-			fmt.Printf("Failed to delete client configs: %v", err)
+			log.Warnf("Failed to delete client configs: %v", err)
 			os.Exit(1)
 		}
-		fmt.Printf("Deleted kssh configs for the teams: %v", found)
+		fmt.Printf("Deleted kssh configs for the teams: %v\n", found)
 		os.Exit(0)
 	}()
 }
@@ -237,31 +510,67 @@ func (b *Bot) captureControlCToDeleteClientConfig() {
 // DeleteAllClientConfigs deletes all found kssh configs for all teams the
 // CA bot is a member of
 func (b *Bot) DeleteAllClientConfigs() error {
-	teams, err := b.getAllTeams()
+	teams, err := b.getClientConfigTeams()
 	if err != nil {
-		fmt.Printf("Failed to get teams to delete client configs: %v", err)
+		log.Warnf("Failed to get teams to delete client configs: %v", err)
 		return err
 	}
 	found, err := b.deleteClientConfig(teams)
 	if err != nil {
-		fmt.Printf("Failed to delete client configs: %v", err)
+		log.Warnf("Failed to delete client configs: %v", err)
 		return err
 	}
-	fmt.Printf("Deleted kssh configs for the teams: %v", found)
+	fmt.Printf("Deleted kssh configs for the teams: %v\n", found)
 	return nil
 }
 
 func (b *Bot) getAllTeams() (teams []string, err error) {
-	return shared.GetAllTeams(b.api)
+	memberships, err := b.api.ListUserMemberships(b.api.GetUsername())
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range memberships {
+		if b.isUsableRole(m.Role) {
+			teams = append(teams, m.FqName)
+		}
+	}
+	return teams, nil
+}
+
+// Log the given error from processing signatureRequest. If the request was denied due to policy, kssh is also sent a
+// SignatureDenial so that it can tell the user why rather than waiting until it times out.
+func (b *Bot) denyOrLogError(msg kbchat.SubscriptionMessage, signatureRequest shared.SignatureRequest, err error) {
+	if denied, ok := err.(sshutils.RequestDeniedError); ok {
+		code := denied.Code
+		if code == "" {
+			code = shared.DenialOther
+		}
+		denial, e := json.Marshal(shared.SignatureDenial{UUID: signatureRequest.UUID, Code: code, Reason: denied.Reason})
+		if e == nil {
+			e = b.sendProtocolMessage(msg.Message.ConvID, shared.SignatureDenialPreamble+string(denial))
+		}
+		if e != nil {
+			auditlog.Log(b.conf, fmt.Sprintf("Failed to send a signature denial to %s: %v", msg.Message.Sender.Username, e))
+		}
+	}
+	b.LogError(msg, err)
 }
 
 // LogError logs the given error to Keybase chat and to the configured log file. Used so
 // that the SSHCA bot does not crash due to an error caused by a malformed
 // message.
 func (b *Bot) LogError(msg kbchat.SubscriptionMessage, err error) {
-	message := fmt.Sprintf("Encountered error while processing message from %s (messageID:%d): %v", msg.Message.Sender.Username, msg.Message.Id, err)
+	// The error is shown to everyone in the channel and sent to webhooks so it must not contain any secrets
+	errorMessage := shared.Redact(err.Error())
+	message := fmt.Sprintf("Encountered error while processing message from %s (messageID:%d): %s", msg.Message.Sender.Username, msg.Message.Id, errorMessage)
 	auditlog.Log(b.conf, message)
-	_, e := b.api.SendMessageByConvID(msg.Message.ConvID, message)
+	if denied, ok := err.(sshutils.RequestDeniedError); ok {
+		go events.Publish(b.conf, events.Event{Type: events.RequestDenied, Username: msg.Message.Sender.Username, Message: denied.Reason})
+	} else {
+		go events.Publish(b.conf, events.Event{Type: events.BotError, Username: msg.Message.Sender.Username, Message: errorMessage})
+	}
+	e := b.sendProtocolMessage(msg.Message.ConvID, b.messages.Render(shared.MessageBotError, map[string]interface{}{
+		"Username": msg.Message.Sender.Username, "MessageID": msg.Message.Id, "Error": errorMessage}))
 	if e != nil {
 		auditlog.Log(b.conf, fmt.Sprintf("Failed to log an error to chat (something is probably very wrong): %v", err))
 	}
@@ -274,16 +583,34 @@ func (b *Bot) isConfiguredTeam(teamName string, channelName string) bool {
 	if b.conf.GetChatTeam() != "" {
 		return b.conf.GetChatTeam() == teamName && b.conf.GetChannelName() == channelName
 	}
+	if b.conf.GetSigningChannel() != "" && b.conf.GetSigningChannel() != channelName {
+		return false
+	}
 	// If they didn't specify a chat team/channel, we just check whether the
-	// message was in one of the listed teams
+	// message was in one of the listed teams (or a subteam matching one of the
+	// listed team patterns)
 	for _, team := range b.conf.GetTeams() {
-		if team == teamName {
+		if shared.MatchTeam(team, teamName) {
 			return true
 		}
 	}
 	return false
 }
 
+// Get the configured teams with any team patterns (eg `acme.ssh.*`) expanded into
+// the matching teams that the CA bot is a member of
+func (b *Bot) getConfiguredTeams() ([]string, error) {
+	teams := sshutils.GetLiteralTeams(b.conf)
+	if len(teams) == len(b.conf.GetTeams()) {
+		return teams, nil
+	}
+	allTeams, err := b.getAllTeams()
+	if err != nil {
+		return nil, fmt.Errorf("failed to expand team patterns: %v", err)
+	}
+	return shared.MatchTeams(b.conf.GetTeams(), append(teams, allTeams...)), nil
+}
+
 type AnnouncementTemplateValues struct {
 	Username    string
 	CurrentTeam string
@@ -310,13 +637,21 @@ func (b *Bot) sendAnnouncementMessage() error {
 		// No announcement to send
 		return nil
 	}
-	for _, team := range b.conf.GetTeams() {
+	teams, err := b.getConfiguredTeams()
+	if err != nil {
+		return err
+	}
+	for _, team := range teams {
 		announcement := buildAnnouncement(b.conf.GetAnnouncement(),
 			AnnouncementTemplateValues{Username: b.api.GetUsername(),
 				CurrentTeam: team,
-				Teams:       b.conf.GetTeams()})
+				Teams:       teams})
 
 		var channel *string
+		if b.conf.GetSigningChannel() != "" {
+			signingChannel := b.conf.GetSigningChannel()
+			channel = &signingChannel
+		}
 		_, err := b.api.SendMessageByTeamName(team, channel, announcement)
 		if err != nil {
 			return err
@@ -1,8 +1,15 @@
 package bot
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/kssh"
+	"github.com/keybase/bot-sshca/src/shared"
 	"github.com/stretchr/testify/require"
 )
 
@@ -22,3 +29,109 @@ func TestBuildAnnouncement(t *testing.T) {
 	require.Equal(t, "double-is-not-escape {my_username}",
 		buildAnnouncement("double-is-not-escape {{USERNAME}}", values))
 }
+
+func TestProgressTracker(t *testing.T) {
+	var progress progressTracker
+	now := time.Now()
+	require.False(t, progress.isRecent(now, maxProgressAge))
+	progress.record(now)
+	require.True(t, progress.isRecent(now.Add(maxProgressAge), maxProgressAge))
+	require.False(t, progress.isRecent(now.Add(maxProgressAge+time.Second), maxProgressAge))
+}
+
+func TestThresholdSignerTake(t *testing.T) {
+	signer := newThresholdSigner(false)
+	signer.remember(shared.SignatureRequest{UUID: "uuid", Username: "alice", SSHPublicKey: "alice-key", ReceivedAt: time.Now()})
+	// Another team member resending alice's UUID neither replaces her request nor is mixed up with it
+	signer.remember(shared.SignatureRequest{UUID: "uuid", Username: "mallory", SSHPublicKey: "mallory-key", ReceivedAt: time.Now()})
+	// Nor does alice resending it with a different key
+	signer.remember(shared.SignatureRequest{UUID: "uuid", Username: "alice", SSHPublicKey: "other-key", ReceivedAt: time.Now()})
+
+	// A share request that fails validation keeps the signature request
+	found, err := signer.take("alice", "uuid", func(sr shared.SignatureRequest) error {
+		return fmt.Errorf("the share request does not match")
+	})
+	require.True(t, found)
+	require.Error(t, err)
+
+	var taken shared.SignatureRequest
+	use := func(sr shared.SignatureRequest) error {
+		taken = sr
+		return nil
+	}
+	found, err = signer.take("alice", "uuid", use)
+	require.True(t, found)
+	require.NoError(t, err)
+	require.Equal(t, "alice-key", taken.SSHPublicKey)
+	// The share is only sent once
+	found, _ = signer.take("alice", "uuid", use)
+	require.False(t, found)
+
+	found, err = signer.take("mallory", "uuid", use)
+	require.True(t, found)
+	require.NoError(t, err)
+	require.Equal(t, "mallory-key", taken.SSHPublicKey)
+}
+
+func TestCertIssuedSummary(t *testing.T) {
+	cert, err := ioutil.ReadFile("../../../tests/testFiles/valid-cert.pub")
+	require.NoError(t, err)
+	summary, err := certIssuedSummary("alice", "laptop", string(cert))
+	require.NoError(t, err)
+	require.Contains(t, summary, "> User: alice\n> Device: laptop\n")
+	require.Contains(t, summary, "> Principals: ")
+	require.Contains(t, summary, "> Key fingerprint: SHA256:")
+
+	_, err = certIssuedSummary("alice", "laptop", "garbage")
+	require.Error(t, err)
+}
+
+func TestInactiveTeams(t *testing.T) {
+	require.Equal(t, []string{"team.old", "other"}, inactiveTeams([]string{"team.ssh", "team.old", "other"}, []string{"team.ssh", "team.chat"}))
+	require.Nil(t, inactiveTeams([]string{"team.ssh"}, []string{"team.ssh"}))
+}
+
+func TestIsClientConfigFrom(t *testing.T) {
+	require.True(t, isClientConfigFrom(`{"teamname":"team.ssh","botname":"cabot"}`, "cabot"))
+	require.False(t, isClientConfigFrom(`{"teamname":"team.ssh","botname":"otherbot"}`, "cabot"))
+	require.False(t, isClientConfigFrom(`not json`, "cabot"))
+}
+
+func TestIsConfiguredTeam(t *testing.T) {
+	os.Setenv("TEAMS", "team.ssh.prod,team.ssh.dev.*")
+	defer os.Unsetenv("TEAMS")
+	b := Bot{conf: &config.EnvConfig{}}
+	require.True(t, b.isConfiguredTeam("team.ssh.prod", "general"))
+	require.True(t, b.isConfiguredTeam("team.ssh.dev.web", "random"))
+	require.False(t, b.isConfiguredTeam("team.ssh", "general"))
+
+	os.Setenv("SIGNING_CHANNEL", "#ssh-provisioning")
+	defer os.Unsetenv("SIGNING_CHANNEL")
+	require.True(t, b.isConfiguredTeam("team.ssh.prod", "ssh-provisioning"))
+	require.True(t, b.isConfiguredTeam("team.ssh.dev.web", "ssh-provisioning"))
+	require.False(t, b.isConfiguredTeam("team.ssh.prod", "general"))
+	require.False(t, b.isConfiguredTeam("team.ssh", "ssh-provisioning"))
+}
+
+func TestIsDiscoveryChannel(t *testing.T) {
+	b := Bot{conf: &config.EnvConfig{}}
+	require.False(t, b.isDiscoveryChannel("", ""))
+
+	os.Setenv("DISCOVERY_CHANNEL", "acme#kssh-discovery")
+	defer os.Unsetenv("DISCOVERY_CHANNEL")
+	require.True(t, b.isDiscoveryChannel("acme", "kssh-discovery"))
+	require.False(t, b.isDiscoveryChannel("acme", "general"))
+	require.False(t, b.isDiscoveryChannel("acme.ssh", "kssh-discovery"))
+}
+
+func TestGetFeatureFlags(t *testing.T) {
+	os.Setenv("KSSH_FEATURE_FLAGS", "team.ssh.prod=no-disk=0, team.ssh.*=no-disk=25, no-disk=10, bogus")
+	defer os.Unsetenv("KSSH_FEATURE_FLAGS")
+	b := Bot{conf: &config.EnvConfig{}}
+	require.Equal(t, []kssh.FeatureFlag{{Name: "no-disk", Percent: 0}}, b.getFeatureFlags("team.ssh.prod"))
+	require.Equal(t, []kssh.FeatureFlag{{Name: "no-disk", Percent: 25}}, b.getFeatureFlags("team.ssh.staging"))
+	require.Equal(t, []kssh.FeatureFlag{{Name: "no-disk", Percent: 10}}, b.getFeatureFlags("other"))
+
+	os.Setenv("KSSH_FEATURE_FLAGS", "team.ssh=no-disk=101")
+	require.Nil(t, b.getFeatureFlags("team.ssh"))
+}
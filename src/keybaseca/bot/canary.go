@@ -0,0 +1,79 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/canary"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Alerts about the same canary on the same host are only sent once per interval since sshd runs kssh-authcheck for
+// every authentication attempt
+const canaryAlertInterval = 5 * time.Minute
+
+// Handles the alerts that kssh-authcheck sends to /canary when a canary certificate is used. Alerts are verified (see
+// canary.Verify), published as a CanaryTriggered event (which fires webhooks), and posted to the security channel, or
+// to the chat channel if no security channel is configured.
+func (b *Bot) canaryHandler() http.HandlerFunc {
+	var lock sync.Mutex
+	lastAlerted := make(map[string]time.Time)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var alert canary.Alert
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, canary.MaxAlertSize)).Decode(&alert)
+		if err != nil {
+			http.Error(w, "invalid alert", http.StatusBadRequest)
+			return
+		}
+		triggered, err := canary.Verify(b.conf, alert)
+		if err != nil {
+			log.Warnf("Rejected a canary alert from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "not a canary", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+
+		key := triggered.KeyID + "\x00" + alert.Host + "\x00" + alert.User
+		lock.Lock()
+		if time.Since(lastAlerted[key]) < canaryAlertInterval {
+			lock.Unlock()
+			return
+		}
+		lastAlerted[key] = time.Now()
+		lock.Unlock()
+		go b.alertCanary(*triggered, alert, r.RemoteAddr)
+	}
+}
+
+// Tell everyone who should know that a canary certificate was used
+func (b *Bot) alertCanary(triggered canary.Canary, alert canary.Alert, remoteAddr string) {
+	message := fmt.Sprintf("the canary %s was used to log in to %s (reported from %s)", triggered.Name, alert.Host, remoteAddr)
+	if alert.User != "" {
+		message += " as " + alert.User
+	}
+	events.Publish(b.conf, events.Event{Type: events.CanaryTriggered, KeyID: triggered.KeyID, Message: message})
+
+	team, channel := b.conf.GetSecurityTeam(), b.conf.GetSecurityChannelName()
+	if team == "" {
+		team, channel = b.conf.GetChatTeam(), b.conf.GetChannelName()
+	}
+	if team == "" {
+		return
+	}
+	notice := b.messages.Render(shared.MessageCanaryTriggered, map[string]interface{}{"Name": triggered.Name,
+		"KeyID": triggered.KeyID, "Host": alert.Host, "User": alert.User})
+	_, err := b.api.SendMessageByTeamName(team, &channel, notice)
+	if err != nil {
+		log.Warnf("Failed to post the canary alert to %s#%s: %v", team, channel, err)
+	}
+}
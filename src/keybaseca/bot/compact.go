@@ -0,0 +1,130 @@
+package bot
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The longest time between two compaction passes
+const maxCompactionInterval = time.Minute
+
+// A protocolMessage is a chat message that is part of the kssh protocol (pings, acks, signature requests and
+// responses) and is deleted once the retention period has passed
+type protocolMessage struct {
+	convID chat1.ConvIDStr
+	msgID  chat1.MessageID
+	seenAt time.Time
+}
+
+// compactor keeps track of the protocol messages that should be deleted (see PROTOCOL_MESSAGE_RETENTION). Messages
+// are only tracked in memory so messages that were pending when the bot restarts are kept.
+type compactor struct {
+	retention time.Duration
+	lock      sync.Mutex
+	pending   []protocolMessage
+}
+
+func newCompactor(retention time.Duration) *compactor {
+	return &compactor{retention: retention}
+}
+
+// Record that the given message should be deleted once the retention period has passed
+func (c *compactor) track(convID chat1.ConvIDStr, msgID chat1.MessageID, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending = append(c.pending, protocolMessage{convID: convID, msgID: msgID, seenAt: now})
+}
+
+// Remove and return the messages whose retention period has passed as of now
+func (c *compactor) due(now time.Time) []protocolMessage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// Messages are tracked (roughly) in the order they were seen so the expired ones are a prefix. A message that is
+	// slightly out of order only delays the deletion of the messages after it until the next pass.
+	i := 0
+	for i < len(c.pending) && now.Sub(c.pending[i].seenAt) >= c.retention {
+		i++
+	}
+	expired := c.pending[:i:i]
+	c.pending = c.pending[i:]
+	return expired
+}
+
+// How often to check for messages whose retention period has passed
+func (c *compactor) interval() time.Duration {
+	if c.retention < maxCompactionInterval {
+		return c.retention
+	}
+	return maxCompactionInterval
+}
+
+// Delete protocol messages as their retention period passes until stopCh is closed
+func (b *Bot) runCompaction(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(b.compactor.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case now := <-ticker.C:
+			for _, msg := range b.compactor.due(now) {
+				err := b.deleteMessage(msg.convID, msg.msgID)
+				if err != nil {
+					// Deleting messages sent by users requires the bot to be an admin of the team
+					log.Debugf("Failed to delete protocol message %d in %s: %v", msg.msgID, msg.convID, err)
+				}
+			}
+		}
+	}
+}
+
+// Track the given protocol message for deletion. Does nothing if compaction is disabled.
+func (b *Bot) trackProtocolMessage(convID chat1.ConvIDStr, msgID chat1.MessageID) {
+	if b.compactor != nil {
+		b.compactor.track(convID, msgID, time.Now())
+	}
+}
+
+// Send a protocol message to the given conversation and track it for deletion. Protocol messages are sent as exploding
+// messages unless EXPLODING_MESSAGE_LIFETIME is 0.
+func (b *Bot) sendProtocolMessage(convID chat1.ConvIDStr, body string) error {
+	if b.chaos != nil {
+		var send bool
+		body, send = b.chaos.Apply(body)
+		if !send {
+			log.Debug("Chaos mode: dropping protocol message")
+			return nil
+		}
+	}
+	if lifetime := b.conf.GetExplodingMessageLifetime(); lifetime > 0 {
+		msgID, err := shared.SendExplodingMessage(b.api, map[string]interface{}{"conversation_id": convID}, body, lifetime)
+		if err != nil {
+			return err
+		}
+		if msgID != 0 {
+			b.trackProtocolMessage(convID, msgID)
+		}
+		return nil
+	}
+	resp, err := b.api.SendMessageByConvID(convID, body)
+	if err != nil {
+		return err
+	}
+	if resp.Result.MessageID != nil {
+		b.trackProtocolMessage(convID, *resp.Result.MessageID)
+	}
+	return nil
+}
+
+// Delete the given chat message. kbchat does not support deleting messages so this goes through `keybase chat api`.
+func (b *Bot) deleteMessage(convID chat1.ConvIDStr, msgID chat1.MessageID) error {
+	return shared.RunChatAPI(b.api, "delete", map[string]interface{}{
+		"conversation_id": convID,
+		"message_id":      msgID,
+	}, nil)
+}
@@ -0,0 +1,28 @@
+package bot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactor(t *testing.T) {
+	c := newCompactor(5 * time.Minute)
+	start := time.Now()
+	c.track("conv1", 1, start)
+	c.track("conv1", 2, start.Add(time.Minute))
+	c.track("conv2", 3, start.Add(2*time.Minute))
+
+	require.Empty(t, c.due(start.Add(4*time.Minute)))
+	require.Equal(t, []protocolMessage{{convID: "conv1", msgID: 1, seenAt: start}}, c.due(start.Add(5*time.Minute)))
+	due := c.due(start.Add(time.Hour))
+	require.Len(t, due, 2)
+	require.Equal(t, chat1.MessageID(2), due[0].msgID)
+	require.Equal(t, chat1.ConvIDStr("conv2"), due[1].convID)
+	require.Empty(t, c.due(start.Add(time.Hour)))
+
+	require.Equal(t, time.Minute, newCompactor(time.Hour).interval())
+	require.Equal(t, 30*time.Second, newCompactor(30*time.Second).interval())
+}
@@ -0,0 +1,72 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// kssh can be configured to find its configs by asking the CA bots in a discovery channel (see DISCOVERY_CHANNEL)
+// rather than by reading the config of every team the user is in, which is slow for users in hundreds of teams.
+
+// Whether the given channel is the discovery channel. Only config requests are answered there.
+func (b *Bot) isDiscoveryChannel(teamName string, channelName string) bool {
+	return b.conf.GetDiscoveryTeam() != "" && b.conf.GetDiscoveryTeam() == teamName && b.conf.GetDiscoveryChannelName() == channelName
+}
+
+// Join the discovery channel so that the bot receives config requests sent there
+func (b *Bot) joinDiscoveryChannel() {
+	if b.conf.GetDiscoveryTeam() == "" {
+		return
+	}
+	_, err := b.api.JoinChannel(b.conf.GetDiscoveryTeam(), b.conf.GetDiscoveryChannelName())
+	if err != nil {
+		log.Warnf("Failed to join the discovery channel %s#%s, kssh will fall back to reading configs from each team: %v",
+			b.conf.GetDiscoveryTeam(), b.conf.GetDiscoveryChannelName(), err)
+	}
+}
+
+// Respond to a config request with the kssh configs of the teams that the sender is in. The response is sent to the
+// sender directly rather than in the discovery channel so that the other members of the discovery team do not learn
+// which teams the sender is in.
+func (b *Bot) respondToConfigRequest(msg kbchat.SubscriptionMessage) error {
+	username := msg.Message.Sender.Username
+	userTeams, err := sshutils.GetUserTeams(b.conf, username)
+	if err != nil {
+		return err
+	}
+	teams := shared.MatchTeams(b.conf.GetTeams(), userTeams)
+	if b.conf.GetChatTeam() != "" && len(shared.MatchTeams([]string{b.conf.GetChatTeam()}, userTeams)) > 0 {
+		teams = append(teams, b.conf.GetChatTeam())
+	}
+	response := shared.ConfigResponse{Username: username, Configs: []json.RawMessage{}}
+	seen := make(map[string]bool)
+	for _, team := range teams {
+		if seen[team] {
+			continue
+		}
+		seen[team] = true
+		value, err := b.getClientConfig(team)
+		if err != nil {
+			log.Warnf("Failed to read the kssh config for team %s: %v", team, err)
+			continue
+		}
+		if value != "" {
+			response.Configs = append(response.Configs, json.RawMessage(value))
+		}
+	}
+	bytes, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	_, err = b.api.SendMessageByTlfName(b.api.GetUsername()+","+username, shared.ConfigResponsePreamble+string(bytes))
+	if err != nil {
+		return fmt.Errorf("failed to send the config response to %s: %v", username, err)
+	}
+	return nil
+}
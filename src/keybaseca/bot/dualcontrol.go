@@ -0,0 +1,175 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/dualcontrol"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pendingApprovals tracks the operations requested in chat that are waiting for a second admin (see dualcontrol).
+// Requests are only tracked in memory so requests that were pending when the bot restarts have to be made again.
+type pendingApprovals struct {
+	lock     sync.Mutex
+	requests map[string]*pendingApproval
+}
+
+type pendingApproval struct {
+	request *dualcontrol.Request
+	// Approvals are only accepted in the conversation that the operation was requested in
+	convID chat1.ConvIDStr
+	// Runs the operation once it has been approved
+	execute func(approvers []string) error
+}
+
+func newPendingApprovals() *pendingApprovals {
+	return &pendingApprovals{requests: make(map[string]*pendingApproval)}
+}
+
+// Return the pending request with the given ID after dropping the ones that have expired. Returns nil if there is no
+// such request.
+func (b *Bot) getPendingApproval(id string, now time.Time) *pendingApproval {
+	b.approvals.lock.Lock()
+	defer b.approvals.lock.Unlock()
+	for otherID, pending := range b.approvals.requests {
+		if !now.Before(pending.request.ExpiresAt) {
+			pending.request.Expire(b.conf)
+			delete(b.approvals.requests, otherID)
+		}
+	}
+	return b.approvals.requests[id]
+}
+
+// Ask for a second admin to approve the given operation that the sender of msg (who must be an admin) requested in
+// chat. The sender's request counts as the first approval. execute is run once the operation has been approved.
+func (b *Bot) requestApproval(msg kbchat.SubscriptionMessage, operation dualcontrol.Operation, description string, execute func(approvers []string) error) error {
+	sender := msg.Message.Sender.Username
+	now := time.Now()
+	request, err := dualcontrol.NewRequest(b.conf, operation, description, sender, now)
+	if err != nil {
+		return err
+	}
+	approved, err := request.Approve(b.conf, sender, now)
+	if err != nil {
+		return err
+	}
+	if approved {
+		return execute(request.Approvers())
+	}
+	b.getPendingApproval(request.ID, now)
+	b.approvals.lock.Lock()
+	b.approvals.requests[request.ID] = &pendingApproval{request: request, convID: msg.Message.ConvID, execute: execute}
+	b.approvals.lock.Unlock()
+	_, err = b.api.SendMessageByConvID(msg.Message.ConvID, request.Prompt(b.api.GetUsername()))
+	return err
+}
+
+// Handle an `approve <id> @bot` chat command. Approvals of requests that this bot is not tracking are ignored since
+// they may be for a request made via the keybaseca CLI (see AwaitApproval).
+func (b *Bot) handleApproveCommand(msg kbchat.SubscriptionMessage, id string) error {
+	now := time.Now()
+	pending := b.getPendingApproval(id, now)
+	if pending == nil || pending.convID != msg.Message.ConvID {
+		log.Debugf("Ignoring approval of unknown request %s", id)
+		return nil
+	}
+	approved, err := pending.request.Approve(b.conf, msg.Message.Sender.Username, now)
+	if err != nil {
+		_, err = b.api.SendMessageByConvID(msg.Message.ConvID, fmt.Sprintf("Not approved: %v", err))
+		return err
+	}
+	if !approved {
+		_, err = b.api.SendMessageByConvID(msg.Message.ConvID, pending.request.Prompt(b.api.GetUsername()))
+		return err
+	}
+	b.approvals.lock.Lock()
+	delete(b.approvals.requests, id)
+	b.approvals.lock.Unlock()
+	return pending.execute(pending.request.Approvers())
+}
+
+// AwaitApproval asks the admins to approve the given request (made via the keybaseca CLI) in the security channel, or
+// in the chat channel if there is no security channel, and waits until enough different admins have approved it.
+// Returns an error if the request expires first.
+func (b *Bot) AwaitApproval(request *dualcontrol.Request) error {
+	team, channel := b.conf.GetSecurityTeam(), b.conf.GetSecurityChannelName()
+	if team == "" {
+		team, channel = b.conf.GetChatTeam(), b.conf.GetChannelName()
+	}
+	sub, err := b.api.ListenForNewTextMessages()
+	if err != nil {
+		return fmt.Errorf("error subscribing to messages: %v", err)
+	}
+	defer sub.Shutdown()
+	messages := make(chan kbchat.SubscriptionMessage)
+	errors := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := sub.Read()
+			if err != nil {
+				errors <- err
+				return
+			}
+			messages <- msg
+		}
+	}()
+
+	prompt := func() error {
+		_, err := b.api.SendMessageByTeamName(team, &channel, request.Prompt(b.api.GetUsername()))
+		if err != nil {
+			return fmt.Errorf("failed to ask for approval in %s#%s: %v", team, channel, err)
+		}
+		return nil
+	}
+	err = prompt()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Waiting for %d admins to approve the request in %s#%s by sending `%s`...\n", dualcontrol.RequiredApprovals,
+		team, channel, dualcontrol.GenerateApproveCommand(request.ID, b.api.GetUsername()))
+	expired := time.After(time.Until(request.ExpiresAt))
+	for {
+		select {
+		case <-expired:
+			request.Expire(b.conf)
+			return fmt.Errorf("the request was not approved by %d admins within %s", dualcontrol.RequiredApprovals, dualcontrol.ApprovalTimeout)
+		case err := <-errors:
+			return fmt.Errorf("failed to read message: %v", err)
+		case msg := <-messages:
+			if msg.Message.Content.TypeName != "text" || msg.Message.Channel.Name != team ||
+				(channel != "" && !strings.EqualFold(msg.Message.Channel.TopicName, channel)) {
+				continue
+			}
+			id, ok := dualcontrol.ParseApproveCommand(msg.Message.Content.Text.Body, b.api.GetUsername())
+			if !ok || id != request.ID {
+				continue
+			}
+			approved, err := request.Approve(b.conf, msg.Message.Sender.Username, time.Now())
+			if err != nil {
+				_, err = b.api.SendMessageByConvID(msg.Message.ConvID, fmt.Sprintf("Not approved: %v", err))
+				if err != nil {
+					log.Warnf("Failed to refuse an approval: %v", err)
+				}
+				continue
+			}
+			if approved {
+				_, err = b.api.SendMessageByConvID(msg.Message.ConvID, fmt.Sprintf("Approved by %s: %s",
+					strings.Join(request.Approvers(), " and "), request.Description))
+				if err != nil {
+					log.Warnf("Failed to announce the approval: %v", err)
+				}
+				return nil
+			}
+			err = prompt()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package bot
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Write a heartbeat now and then every HEARTBEAT_INTERVAL until stopCh is closed so that kssh can tell whether the bot
+// is running (see shared.Heartbeat)
+func (b *Bot) runHeartbeat(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(b.conf.GetHeartbeatInterval())
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		err := b.writeHeartbeat(shared.Heartbeat{UpdatedAt: now.Unix(), Interval: int(b.conf.GetHeartbeatInterval() / time.Second)})
+		if err != nil {
+			log.Warnf("Failed to write the heartbeat: %v", err)
+		}
+		select {
+		case <-stopCh:
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
+
+// Record that the bot was stopped so that kssh fails fast straight away rather than once the heartbeat is stale. Does
+// nothing if heartbeats are disabled.
+func (b *Bot) stopHeartbeat() {
+	if b.conf.GetHeartbeatInterval() == 0 {
+		return
+	}
+	now := time.Now().Unix()
+	err := b.writeHeartbeat(shared.Heartbeat{UpdatedAt: now, Interval: int(b.conf.GetHeartbeatInterval() / time.Second), StoppedAt: now})
+	if err != nil {
+		log.Warnf("Failed to record that the bot stopped in the heartbeat: %v", err)
+	}
+}
+
+func (b *Bot) writeHeartbeat(heartbeat shared.Heartbeat) error {
+	bytes, err := json.Marshal(heartbeat)
+	if err != nil {
+		return err
+	}
+	return constants.GetDefaultKBFSOperationsStruct().Write(shared.HeartbeatPath(b.api.GetUsername()), string(bytes), false)
+}
+
+// Delete the heartbeat left behind from when heartbeats were enabled. Otherwise it would go stale and kssh would
+// consider the bot to be offline.
+func (b *Bot) deleteStaleHeartbeat() {
+	ko := constants.GetDefaultKBFSOperationsStruct()
+	filename := shared.HeartbeatPath(b.api.GetUsername())
+	exists, err := ko.FileExists(filename)
+	if err == nil && exists {
+		err = ko.Delete(filename)
+	}
+	if err != nil {
+		log.Warnf("Failed to delete the stale heartbeat: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package bot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/systemd"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Start the optional HTTP endpoints. They are served on any sockets passed in via systemd socket activation and
+// on HTTP_LISTEN_ADDRESS if it is configured. Does nothing if neither is present. isHealthy is used to decide
+// the status code of the /healthz endpoint, which also lists any warnings (eg about the CA's clock). kssh-authcheck
+// reports the use of canary certificates to the /canary endpoint.
+func (b *Bot) startHTTPServer(isHealthy func() bool) error {
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return err
+	}
+	if b.conf.GetHTTPListenAddress() != "" {
+		listener, err := net.Listen("tcp", b.conf.GetHTTPListenAddress())
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", b.conf.GetHTTPListenAddress(), err)
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !isHealthy() {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+		// Warnings do not make the service unhealthy since it can still issue certificates
+		if b.clockWarning != "" {
+			fmt.Fprintf(w, "warning: %s\n", b.clockWarning)
+		}
+	})
+
+	mux.HandleFunc("/canary", b.canaryHandler())
+
+	for _, listener := range listeners {
+		listener := listener
+		log.Debugf("Serving HTTP endpoints on %s", listener.Addr())
+		go func() {
+			err := http.Serve(listener, mux)
+			if err != nil {
+				log.Warnf("HTTP server on %s exited: %v", listener.Addr(), err)
+			}
+		}()
+	}
+	return nil
+}
+
+// CheckHealth queries the /healthz endpoint of a keybaseca service listening on the given HTTP_LISTEN_ADDRESS. Returns
+// an error if the service is not reachable or is unhealthy. Used by `keybaseca healthcheck` (eg as a Docker
+// HEALTHCHECK).
+func CheckHealth(listenAddress string, timeout time.Duration) error {
+	_, err := GetHealthWarnings(listenAddress, timeout)
+	return err
+}
+
+// GetHealthWarnings is like CheckHealth but also returns the warnings reported by a healthy service
+func GetHealthWarnings(listenAddress string, timeout time.Duration) (warnings []string, err error) {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid HTTP listen address %q: %v", listenAddress, err)
+	}
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		// The service is listening on every interface so it can be reached via loopback
+		host = "127.0.0.1"
+	}
+	url := "http://" + net.JoinHostPort(host, port) + "/healthz"
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, "warning: ") {
+			warnings = append(warnings, strings.TrimPrefix(line, "warning: "))
+		}
+	}
+	return warnings, nil
+}
@@ -0,0 +1,49 @@
+package bot
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckHealth(t *testing.T) {
+	healthy := true
+	warning := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/healthz", r.URL.Path)
+		if !healthy {
+			http.Error(w, "unhealthy", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+		if warning != "" {
+			fmt.Fprintf(w, "warning: %s\n", warning)
+		}
+	}))
+	defer server.Close()
+	address := server.Listener.Addr().String()
+	_, port, err := net.SplitHostPort(address)
+	require.NoError(t, err)
+
+	require.NoError(t, CheckHealth(address, time.Second))
+	require.NoError(t, CheckHealth(":"+port, time.Second))
+	warnings, err := GetHealthWarnings(address, time.Second)
+	require.NoError(t, err)
+	require.Empty(t, warnings)
+	warning = "the CA's clock is 2m0s ahead"
+	warnings, err = GetHealthWarnings(address, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, []string{"the CA's clock is 2m0s ahead"}, warnings)
+
+	healthy = false
+	err = CheckHealth(address, time.Second)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "503")
+
+	require.Error(t, CheckHealth("localhost", time.Second))
+}
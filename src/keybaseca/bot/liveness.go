@@ -0,0 +1,57 @@
+package bot
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How often the bot sends a message to itself so that the message loop keeps making progress while nobody uses kssh
+const selfPingInterval = time.Minute
+
+// The bot is reported as unhealthy (to /healthz and the systemd watchdog) once the message loop has not read a message
+// for this long. This leaves room for a couple of self-pings to be delayed.
+const maxProgressAge = 3 * selfPingInterval
+
+// The body of the self-ping messages. They are skipped like every other message sent by the bot itself.
+const selfPingBody = "keybaseca self-ping"
+
+// progressTracker records when the message loop last read a message. It is safe for concurrent use.
+type progressTracker struct {
+	// Unix nanoseconds, accessed atomically
+	lastProgress int64
+}
+
+// Record that the message loop made progress at the given time
+func (p *progressTracker) record(now time.Time) {
+	atomic.StoreInt64(&p.lastProgress, now.UnixNano())
+}
+
+// Returns whether the message loop made progress within maxAge of now
+func (p *progressTracker) isRecent(now time.Time, maxAge time.Duration) bool {
+	last := atomic.LoadInt64(&p.lastProgress)
+	return last != 0 && now.Sub(time.Unix(0, last)) <= maxAge
+}
+
+// Send an exploding message to the bot's own conversation every selfPingInterval until stopCh is closed. Reading it
+// back is what proves that the message loop (and the Keybase service behind it) is still working when no one else is
+// sending messages.
+func (b *Bot) runSelfPing(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(selfPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+		destination := map[string]interface{}{"channel": map[string]interface{}{"name": b.api.GetUsername()}}
+		_, err := shared.SendExplodingMessage(b.api, destination, selfPingBody, maxProgressAge)
+		if err != nil {
+			log.Warnf("Failed to send the self-ping: %v", err)
+		}
+	}
+}
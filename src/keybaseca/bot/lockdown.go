@@ -0,0 +1,64 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/dualcontrol"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+)
+
+// Handle a `lockdown on|off @bot` chat command. Only users listed in ADMINS may change the lockdown state. With
+// DUAL_CONTROL, turning lockdown off also needs a second admin's approval.
+func (b *Bot) handleLockdownCommand(msg kbchat.SubscriptionMessage, enabled bool) error {
+	sender := msg.Message.Sender.Username
+	if !lockdown.IsAdmin(b.conf, sender) {
+		auditlog.Log(b.conf, fmt.Sprintf("Refused lockdown command from non-admin user %s", sender))
+		_, err := b.api.SendMessageByConvID(msg.Message.ConvID, b.messages.Render(shared.MessageLockdownNotAdmin,
+			map[string]interface{}{"Username": sender}))
+		return err
+	}
+	if !enabled && dualcontrol.IsRequired(b.conf) {
+		return b.requestApproval(msg, dualcontrol.LiftLockdown, "turn lockdown off", func(approvers []string) error {
+			return b.setLockdown(enabled, strings.Join(approvers, " and "))
+		})
+	}
+	return b.setLockdown(enabled, sender)
+}
+
+func (b *Bot) setLockdown(enabled bool, changedBy string) error {
+	state, err := lockdown.Set(b.conf, enabled, changedBy)
+	if err != nil {
+		return err
+	}
+	return b.PublishLockdownNotice(state)
+}
+
+// PublishLockdownNotice announces the given lockdown state to every configured team (and the chat channel if one is
+// configured)
+func (b *Bot) PublishLockdownNotice(state lockdown.State) error {
+	notice := lockdown.Notice(b.messages, state)
+	if b.conf.GetChatTeam() != "" {
+		channel := b.conf.GetChannelName()
+		_, err := b.api.SendMessageByTeamName(b.conf.GetChatTeam(), &channel, notice)
+		if err != nil {
+			return fmt.Errorf("failed to send the lockdown notice to %s#%s: %v", b.conf.GetChatTeam(), channel, err)
+		}
+	}
+	teams, err := b.getConfiguredTeams()
+	if err != nil {
+		return err
+	}
+	for _, team := range teams {
+		var channel *string
+		_, err := b.api.SendMessageByTeamName(team, channel, notice)
+		if err != nil {
+			return fmt.Errorf("failed to send the lockdown notice to %s: %v", team, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package bot
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The kssh configs and the CA public key are also published to every location in CONFIG_MIRRORS so that kssh can
+// fall back to a mirror when it cannot read the config from its usual location. Mirrors are best effort: failing to
+// write to one is logged but does not stop the bot.
+
+// The name of the file that the CA public key is published as in each mirror
+const mirrorCAPublicKeyFilename = "ca.pub"
+
+// Write the serialized kssh config for the given team to every mirror
+func (b *Bot) putMirroredClientConfig(team, value string) {
+	for _, mirror := range b.conf.GetConfigMirrors() {
+		err := writeToMirror(mirror, team+".json", value)
+		if err != nil {
+			log.Warnf("Failed to write the kssh config for %s to the mirror %s: %v", team, mirror, err)
+		}
+	}
+}
+
+// Write the CA public key to every mirror so that servers can fetch it from there too
+func (b *Bot) putMirroredCAPublicKey(caPublicKey string) {
+	for _, mirror := range b.conf.GetConfigMirrors() {
+		err := writeToMirror(mirror, mirrorCAPublicKeyFilename, caPublicKey+"\n")
+		if err != nil {
+			log.Warnf("Failed to write the CA public key to the mirror %s: %v", mirror, err)
+		}
+	}
+}
+
+// Delete the kssh config for the given team from every mirror
+func (b *Bot) removeMirroredClientConfig(team string) {
+	for _, mirror := range b.conf.GetConfigMirrors() {
+		err := deleteFromMirror(mirror, team+".json")
+		if err != nil {
+			log.Warnf("Failed to delete the kssh config for %s from the mirror %s: %v", team, mirror, err)
+		}
+	}
+}
+
+// Get the locations that kssh reads the mirrored configs from. KBFS mirrors are read directly and S3 mirrors are read
+// over https so that kssh users do not need AWS credentials.
+func (b *Bot) getMirrorReadLocations() []string {
+	var locations []string
+	for _, mirror := range b.conf.GetConfigMirrors() {
+		if strings.HasPrefix(mirror, "s3://") {
+			bucket, prefix := splitS3Location(mirror)
+			location := "https://" + bucket + ".s3.amazonaws.com"
+			if prefix != "" {
+				location += "/" + prefix
+			}
+			locations = append(locations, location)
+		} else {
+			locations = append(locations, strings.TrimSuffix(mirror, "/"))
+		}
+	}
+	return locations
+}
+
+func writeToMirror(mirror, filename, contents string) error {
+	if strings.HasPrefix(mirror, "s3://") {
+		cmd := exec.Command("aws", "s3", "cp", "-", strings.TrimSuffix(mirror, "/")+"/"+filename, "--only-show-errors")
+		cmd.Stdin = strings.NewReader(contents)
+		return runAWSCommand(cmd)
+	}
+	return constants.GetDefaultKBFSOperationsStruct().WriteVerified(strings.TrimSuffix(mirror, "/")+"/"+filename, contents)
+}
+
+func deleteFromMirror(mirror, filename string) error {
+	if strings.HasPrefix(mirror, "s3://") {
+		return runAWSCommand(exec.Command("aws", "s3", "rm", strings.TrimSuffix(mirror, "/")+"/"+filename, "--only-show-errors"))
+	}
+	ko := constants.GetDefaultKBFSOperationsStruct()
+	path := strings.TrimSuffix(mirror, "/") + "/" + filename
+	exists, err := ko.FileExists(path)
+	if err != nil || !exists {
+		return err
+	}
+	return ko.Delete(path)
+}
+
+func runAWSCommand(cmd *exec.Cmd) error {
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s (%v)", strings.Join(cmd.Args[:3], " "), shared.RedactOutput(output), err)
+	}
+	return nil
+}
+
+// Split an s3://bucket/prefix location into the bucket and the prefix (without a trailing slash)
+func splitS3Location(location string) (bucket, prefix string) {
+	split := strings.SplitN(strings.TrimPrefix(location, "s3://"), "/", 2)
+	if len(split) == 2 {
+		prefix = strings.Trim(split[1], "/")
+	}
+	return split[0], prefix
+}
@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// Tell the requesting user (if NOTIFY_USERS is enabled) and the security channel (if SECURITY_CHANNEL is configured)
+// about a certificate that was just issued so that issuance that the user did not initiate is noticed. Failures are
+// only logged since the certificate has already been issued.
+func (b *Bot) notifyCertIssued(sr shared.SignatureRequest, resp shared.SignatureResponse) {
+	if !b.conf.GetNotifyUsers() && b.conf.GetSecurityTeam() == "" {
+		return
+	}
+	summary, err := certIssuedSummary(sr.Username, sr.DeviceName, resp.SignedKey)
+	if err != nil {
+		log.Warnf("Failed to summarize the certificate issued to %s: %v", sr.Username, err)
+		return
+	}
+	if b.conf.GetNotifyUsers() {
+		message := b.messages.Render(shared.MessageCertIssuedUser, map[string]interface{}{"Summary": summary})
+		_, err = b.api.SendMessageByTlfName(b.api.GetUsername()+","+sr.Username, message)
+		if err != nil {
+			log.Warnf("Failed to notify %s about their new certificate: %v", sr.Username, err)
+		}
+	}
+	if b.conf.GetSecurityTeam() != "" {
+		channel := b.conf.GetSecurityChannelName()
+		message := b.messages.Render(shared.MessageCertIssuedSecurity, map[string]interface{}{"Username": sr.Username, "Summary": summary})
+		_, err = b.api.SendMessageByTeamName(b.conf.GetSecurityTeam(), &channel, message)
+		if err != nil {
+			log.Warnf("Failed to post the certificate issued to %s to %s#%s: %v", sr.Username, b.conf.GetSecurityTeam(), channel, err)
+		}
+	}
+}
+
+// Returns a human readable summary of the given signed certificate
+func certIssuedSummary(username, deviceName, signedKey string) (string, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedKey))
+	if err != nil {
+		return "", err
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return "", fmt.Errorf("not an SSH certificate")
+	}
+	return fmt.Sprintf("> User: %s\n> Device: %s\n> Key ID: %s\n> Principals: %s\n> Valid until: %s\n> Key fingerprint: %s",
+		username, deviceName, cert.KeyId, strings.Join(cert.ValidPrincipals, ", "),
+		time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339), ssh.FingerprintSHA256(cert.Key)), nil
+}
@@ -0,0 +1,44 @@
+package bot
+
+import (
+	"fmt"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// CheckTeamMembership returns an error describing how to fix it if the bot is not a member of the given team with a
+// role that lets it read the team's messages
+func (b *Bot) CheckTeamMembership(team string) error {
+	memberships, err := b.api.ListUserMemberships(b.api.GetUsername())
+	if err != nil {
+		return fmt.Errorf("failed to list the teams of %s: %v", b.api.GetUsername(), err)
+	}
+	role := "reader"
+	if b.conf.GetRestrictedBot() {
+		role = "restrictedbot"
+	}
+	for _, m := range memberships {
+		if m.FqName != team {
+			continue
+		}
+		if !b.isUsableRole(m.Role) {
+			return fmt.Errorf("%s is a member of %s but its role does not let it read messages, run `keybase team "+
+				"edit-member %s --user=%s --role=%s`", b.api.GetUsername(), team, team, b.api.GetUsername(), role)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s is not a member of %s, run `keybase team add-member %s --user=%s --role=%s`",
+		b.api.GetUsername(), team, team, b.api.GetUsername(), role)
+}
+
+// AnnounceTeam tells the members of a newly added team that they can now use kssh
+func (b *Bot) AnnounceTeam(team string) error {
+	var channel *string
+	if b.conf.GetSigningChannel() != "" {
+		signingChannel := b.conf.GetSigningChannel()
+		channel = &signingChannel
+	}
+	message := b.messages.Render(shared.MessageTeamAdded, map[string]interface{}{"BotName": b.api.GetUsername(), "Team": team})
+	_, err := b.api.SendMessageByTeamName(team, channel, message)
+	return err
+}
@@ -0,0 +1,72 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/kssh"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ReconcileClientConfigs deletes the kssh configs written by this bot in teams that are no longer configured (eg
+// because a team was removed from TEAMS) so that kssh does not keep sending requests for them. Configs written by
+// other bots are left alone. If dryRun, nothing is deleted. Returns the teams whose config is (or would be) deleted.
+func (b *Bot) ReconcileClientConfigs(dryRun bool) (stale []string, err error) {
+	activeTeams, err := b.getConfiguredTeams()
+	if err != nil {
+		return nil, err
+	}
+	if b.conf.GetChatTeam() != "" {
+		activeTeams = append(activeTeams, b.conf.GetChatTeam())
+	}
+	allTeams, err := b.getClientConfigTeams()
+	if err != nil {
+		return nil, err
+	}
+	for _, team := range inactiveTeams(allTeams, activeTeams) {
+		value, err := b.getClientConfig(team)
+		if err != nil {
+			log.Debugf("Failed to read the kssh config for the team %s: %v", team, err)
+			continue
+		}
+		if value == "" || !isClientConfigFrom(value, b.api.GetUsername()) {
+			continue
+		}
+		stale = append(stale, team)
+	}
+	if dryRun || len(stale) == 0 {
+		return stale, nil
+	}
+	found, err := b.deleteClientConfig(stale)
+	if err != nil {
+		return found, err
+	}
+	auditlog.Log(b.conf, fmt.Sprintf("Deleted stale kssh configs for the teams that are no longer configured: %v", found))
+	return found, nil
+}
+
+// Returns the teams in allTeams that are not in activeTeams
+func inactiveTeams(allTeams, activeTeams []string) []string {
+	active := make(map[string]bool)
+	for _, team := range activeTeams {
+		active[team] = true
+	}
+	var inactive []string
+	for _, team := range allTeams {
+		if !active[team] {
+			inactive = append(inactive, team)
+		}
+	}
+	return inactive
+}
+
+// Returns whether the given serialized kssh config was written by the bot with the given username
+func isClientConfigFrom(value, botName string) bool {
+	var conf kssh.Config
+	if err := json.Unmarshal([]byte(value), &conf); err != nil {
+		return false
+	}
+	return conf.BotName == botName
+}
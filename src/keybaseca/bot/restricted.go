@@ -0,0 +1,96 @@
+package bot
+
+import (
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The kssh configs are stored in the team KV store unless the bot is a restricted bot (see RESTRICTED_BOT). Restricted
+// bots cannot use the KV store so their configs are published in the bot's public KBFS folder (see
+// shared.ClientConfigDirectory) where kssh looks for them once it knows the name of the bot.
+
+// Write the serialized kssh config for the given team
+func (b *Bot) putClientConfig(team, value string) error {
+	if b.conf.GetRestrictedBot() {
+		return constants.GetDefaultKBFSOperationsStruct().WriteVerified(shared.ClientConfigPath(b.api.GetUsername(), team), value)
+	}
+	_, err := b.api.PutEntry(&team, shared.SSHCANamespace, shared.SSHCAConfigKey, value)
+	return err
+}
+
+// Read the serialized kssh config for the given team. Returns an empty string if there is none.
+func (b *Bot) getClientConfig(team string) (string, error) {
+	if b.conf.GetRestrictedBot() {
+		ko := constants.GetDefaultKBFSOperationsStruct()
+		filename := shared.ClientConfigPath(b.api.GetUsername(), team)
+		exists, err := ko.FileExists(filename)
+		if err != nil || !exists {
+			return "", err
+		}
+		bytes, err := ko.Read(filename)
+		return string(bytes), err
+	}
+	res, err := b.api.GetEntry(&team, shared.SSHCANamespace, shared.SSHCAConfigKey)
+	if err != nil || res.Revision == 0 {
+		return "", err
+	}
+	return res.EntryValue, nil
+}
+
+// Delete the kssh config for the given team. found is false if there was no config to delete.
+func (b *Bot) removeClientConfig(team string) (found bool, err error) {
+	if b.conf.GetRestrictedBot() {
+		ko := constants.GetDefaultKBFSOperationsStruct()
+		filename := shared.ClientConfigPath(b.api.GetUsername(), team)
+		exists, err := ko.FileExists(filename)
+		if err != nil || !exists {
+			return false, err
+		}
+		return true, ko.Delete(filename)
+	}
+	_, err = b.api.DeleteEntry(&team, shared.SSHCANamespace, shared.SSHCAConfigKey)
+	if kerr, ok := err.(kbchat.Error); ok && kerr.Code == kbchat.DeleteNonExistentErrorCode {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Get the teams that the bot may have written a kssh config in. A restricted bot that is removed from a team can no
+// longer see the team but its config for the team is still in its public folder, so for restricted bots these are
+// the teams that have a config in the public folder.
+func (b *Bot) getClientConfigTeams() ([]string, error) {
+	if !b.conf.GetRestrictedBot() {
+		return b.getAllTeams()
+	}
+	ko := constants.GetDefaultKBFSOperationsStruct()
+	dir := shared.ClientConfigDirectory(b.api.GetUsername())
+	exists, err := ko.FileExists(dir)
+	if err != nil || !exists {
+		return nil, err
+	}
+	files, err := ko.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	var teams []string
+	for _, file := range files {
+		if team, ok := shared.ParseClientConfigFilename(file); ok {
+			teams = append(teams, team)
+		} else {
+			log.Debugf("Ignoring unexpected file %s in %s", file, dir)
+		}
+	}
+	return teams, nil
+}
+
+// Returns whether the bot should act on behalf of teams in which it has the given role
+func (b *Bot) isUsableRole(role keybase1.TeamRole) bool {
+	if b.conf.GetRestrictedBot() && role == keybase1.TeamRole_RESTRICTEDBOT {
+		return true
+	}
+	return shared.CanRoleReadTeam(role)
+}
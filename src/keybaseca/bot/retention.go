@@ -0,0 +1,33 @@
+package bot
+
+import (
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/retention"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+	log "github.com/sirupsen/logrus"
+)
+
+// How often audit data older than AUDIT_RETENTION_DAYS is purged
+const retentionInterval = 24 * time.Hour
+
+// Purge expired audit data now and then every retentionInterval until stopCh is closed
+func (b *Bot) runRetention(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(retentionInterval)
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		result, err := retention.PurgeExpired(b.conf, now)
+		if err != nil {
+			auditlog.Log(b.conf, "Failed to purge expired audit data: "+err.Error())
+		} else {
+			log.Debugf("Purged %d expired audit log entries and %d issuance records", result.AuditLogEntries, result.IssuanceRecords)
+		}
+		select {
+		case <-stopCh:
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
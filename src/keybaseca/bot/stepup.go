@@ -0,0 +1,55 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/keybaseca/oidc"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+)
+
+// Require the sender of the given signature request to log in to the identity provider and sign the request once they
+// have. The verification URL is sent to kssh as a SignatureChallenge. Anyone in the channel can see the challenge but
+// the login is only accepted if it maps to the Keybase user who sent the request.
+func (b *Bot) stepUpAndSign(msg kbchat.SubscriptionMessage, signatureRequest shared.SignatureRequest) {
+	auth, err := b.stepUp.StartDeviceAuthorization()
+	if err != nil {
+		b.LogError(msg, err)
+		return
+	}
+	challenge, err := json.Marshal(shared.SignatureChallenge{
+		UUID:                    signatureRequest.UUID,
+		VerificationURI:         auth.VerificationURI,
+		VerificationURIComplete: auth.VerificationURIComplete,
+		UserCode:                auth.UserCode,
+		ExpiresIn:               auth.ExpiresIn,
+	})
+	if err != nil {
+		b.LogError(msg, err)
+		return
+	}
+	err = b.sendProtocolMessage(msg.Message.ConvID, shared.SignatureChallengePreamble+string(challenge))
+	if err != nil {
+		b.LogError(msg, err)
+		return
+	}
+
+	claims, err := b.stepUp.WaitForLogin(auth)
+	if err == nil {
+		err = b.stepUp.VerifyClaims(claims, signatureRequest.Username, time.Now())
+	}
+	if authErr, ok := err.(oidc.AuthenticationError); ok {
+		err = sshutils.RequestDeniedError{Code: shared.DenialStepUpFailed, Reason: authErr.Error()}
+	}
+	if err != nil {
+		b.denyOrLogError(msg, signatureRequest, err)
+		return
+	}
+	auditlog.Log(b.conf, fmt.Sprintf("%s completed step-up authentication with %s as %v", signatureRequest.Username,
+		b.stepUp.Issuer, claims[b.stepUp.UsernameClaim]))
+	b.signAndRespond(msg, signatureRequest)
+}
@@ -0,0 +1,257 @@
+package bot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/dualcontrol"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/keybaseca/threshold"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+
+	auditlog "github.com/keybase/bot-sshca/src/keybaseca/log"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long an instance remembers the signature requests it received so that it can check share requests against them
+const seenRequestTTL = 10 * time.Minute
+
+// The state of threshold signing. Every instance remembers the signature requests sent by kssh and the coordinator
+// also tracks the share requests it is waiting on.
+type thresholdSigner struct {
+	lock sync.Mutex
+	// Whether this instance is the coordinator
+	coordinator bool
+	// The signature requests received from kssh by the username of their sender and their UUID (see requestKey)
+	seen map[string]shared.SignatureRequest
+	// The share responses received for each pending share request by ID
+	pending map[string]chan shareResponse
+}
+
+// A sealed share and the peer who sent it
+type shareResponse struct {
+	sender string
+	sealed []byte
+}
+
+func newThresholdSigner(coordinator bool) *thresholdSigner {
+	return &thresholdSigner{coordinator: coordinator, seen: make(map[string]shared.SignatureRequest), pending: make(map[string]chan shareResponse)}
+}
+
+// The key of a signature request in thresholdSigner.seen. Requests are keyed by their sender as well as their UUID so
+// that a team member who resends someone else's UUID cannot replace their request. Keybase usernames cannot contain
+// a colon.
+func requestKey(username, uuid string) string {
+	return username + ":" + uuid
+}
+
+// Remember the given signature request and forget the ones that are too old to be signed. A request is never replaced
+// by a later one with the same sender and UUID.
+func (t *thresholdSigner) remember(sr shared.SignatureRequest) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for key, seen := range t.seen {
+		if time.Since(seen.ReceivedAt) > seenRequestTTL {
+			delete(t.seen, key)
+		}
+	}
+	if _, ok := t.seen[requestKey(sr.Username, sr.UUID)]; !ok {
+		t.seen[requestKey(sr.Username, sr.UUID)] = sr
+	}
+}
+
+// Pass the signature request that username sent with the given UUID to use and forget it if use succeeds so that its
+// share is only sent once. A share request that fails validation does not remove the signature request. found is
+// false if this instance did not receive the signature request.
+func (t *thresholdSigner) take(username, uuid string, use func(shared.SignatureRequest) error) (found bool, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sr, ok := t.seen[requestKey(username, uuid)]
+	if !ok {
+		return false, nil
+	}
+	err = use(sr)
+	if err != nil {
+		return true, err
+	}
+	delete(t.seen, requestKey(username, uuid))
+	return true, nil
+}
+
+// Collect the shares for the given share request by sending it to convID and waiting for needed responses
+func (b *Bot) collectShares(convID chat1.ConvIDStr, request threshold.ShareRequest, needed int) ([][]byte, error) {
+	responses := make(chan shareResponse, len(b.conf.GetThresholdPeers()))
+	b.threshold.lock.Lock()
+	b.threshold.pending[request.ID] = responses
+	b.threshold.lock.Unlock()
+	defer func() {
+		b.threshold.lock.Lock()
+		delete(b.threshold.pending, request.ID)
+		b.threshold.lock.Unlock()
+	}()
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	err = b.sendProtocolMessage(convID, threshold.ShareRequestPreamble+string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var sealed [][]byte
+	responded := make(map[string]bool)
+	timeout := time.After(b.conf.GetThresholdTimeout())
+	for len(sealed) < needed {
+		select {
+		case response := <-responses:
+			// Each peer holds one share so only its first response counts
+			if !responded[response.sender] {
+				responded[response.sender] = true
+				sealed = append(sealed, response.sealed)
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("only %d of the %d shares needed were received within %s", len(sealed), needed,
+				b.conf.GetThresholdTimeout())
+		}
+	}
+	return sealed, nil
+}
+
+// Sign the given signature request with the shares of the other instances and send the response to the conversation
+// it came from
+func (b *Bot) thresholdSignAndRespond(msg kbchat.SubscriptionMessage, signatureRequest shared.SignatureRequest) {
+	signatureResponse, err := sshutils.ProcessThresholdSignatureRequest(b.conf, signatureRequest,
+		func(request threshold.ShareRequest, needed int) ([][]byte, error) {
+			return b.collectShares(msg.Message.ConvID, request, needed)
+		})
+	if err != nil {
+		b.denyOrLogError(msg, signatureRequest, err)
+		return
+	}
+	b.respondWithSignature(msg, signatureRequest, signatureResponse)
+}
+
+// Respond to a share request from the coordinator with this instance's share if this instance's policy agrees
+func (b *Bot) respondToShareRequest(msg kbchat.SubscriptionMessage) error {
+	sender := msg.Message.Sender.Username
+	if sender != b.conf.GetThresholdCoordinator() {
+		auditlog.Log(b.conf, fmt.Sprintf("Refused a threshold share request from %s who is not the coordinator", sender))
+		return nil
+	}
+	request, err := threshold.ParseShareRequest(msg.Message.Content.Text.Body)
+	if err != nil {
+		return err
+	}
+	var sealed []byte
+	found, err := b.threshold.take(request.Username, request.RequestUUID, func(signatureRequest shared.SignatureRequest) (err error) {
+		sealed, err = sshutils.SealThresholdShare(b.conf, signatureRequest, request)
+		return err
+	})
+	if !found {
+		auditlog.Log(b.conf, fmt.Sprintf("Refused a threshold share request for the signature request %s from %s which "+
+			"was not received by this instance", request.RequestUUID, request.Username))
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("refused a threshold share request for the signature request %s: %v", request.RequestUUID, err)
+	}
+	body, err := json.Marshal(threshold.ShareResponse{ID: request.ID, Sealed: sealed})
+	if err != nil {
+		return err
+	}
+	return b.sendProtocolMessage(msg.Message.ConvID, threshold.ShareResponsePreamble+string(body))
+}
+
+// Pass a share response from one of the peers to the share request that is waiting on it
+func (b *Bot) handleShareResponse(msg kbchat.SubscriptionMessage) error {
+	sender := msg.Message.Sender.Username
+	if !isThresholdPeer(b.conf.GetThresholdPeers(), sender) {
+		log.Debugf("Ignoring a threshold share response from %s who is not one of the peers", sender)
+		return nil
+	}
+	response, err := threshold.ParseShareResponse(msg.Message.Content.Text.Body)
+	if err != nil {
+		return err
+	}
+	b.threshold.lock.Lock()
+	defer b.threshold.lock.Unlock()
+	responses, ok := b.threshold.pending[response.ID]
+	if !ok {
+		log.Debugf("Ignoring a threshold share response from %s for an unknown share request", sender)
+		return nil
+	}
+	select {
+	case responses <- shareResponse{sender: sender, sealed: response.Sealed}:
+	default:
+		log.Debugf("Ignoring an extra threshold share response from %s", sender)
+	}
+	return nil
+}
+
+func isThresholdPeer(peers []string, username string) bool {
+	for _, peer := range peers {
+		if peer == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Run as one of the instances that hold a share of the CA key but do not answer kssh. The instance remembers the
+// signature requests sent in the configured teams and sends its share when the coordinator asks for it. Does not return
+// unless it encounters an unrecoverable error.
+func (b *Bot) startThresholdPeer() error {
+	sub, err := b.api.ListenForNewTextMessages()
+	if err != nil {
+		return fmt.Errorf("error subscribing to messages: %v", err)
+	}
+	log.Infof("Running as a threshold signing peer of %s", b.conf.GetThresholdCoordinator())
+	for {
+		msg, err := sub.Read()
+		if err != nil {
+			return fmt.Errorf("failed to read message: %v", err)
+		}
+		if msg.Message.Content.TypeName != "text" || msg.Message.Sender.Username == b.api.GetUsername() {
+			continue
+		}
+		// As in Start, only signature requests sent in the configured teams may be signed
+		if !b.isConfiguredTeam(msg.Message.Channel.Name, msg.Message.Channel.TopicName) {
+			continue
+		}
+
+		messageBody := msg.Message.Content.Text.Body
+		if enabled, ok := lockdown.ParseCommand(messageBody, b.api.GetUsername()); ok {
+			err = b.handleLockdownCommand(msg, enabled)
+			if err != nil {
+				b.LogError(msg, err)
+			}
+		} else if id, ok := dualcontrol.ParseApproveCommand(messageBody, b.api.GetUsername()); ok {
+			err = b.handleApproveCommand(msg, id)
+			if err != nil {
+				b.LogError(msg, err)
+			}
+		} else if strings.HasPrefix(messageBody, shared.SignatureRequestPreamble) {
+			signatureRequest, err := shared.ParseSignatureRequest(messageBody)
+			if err != nil {
+				log.Debugf("Ignoring malformed SignatureRequest: %v", err)
+				continue
+			}
+			signatureRequest.Username = msg.Message.Sender.Username
+			signatureRequest.DeviceName = msg.Message.Sender.DeviceName
+			signatureRequest.ReceivedAt = time.Now()
+			b.threshold.remember(signatureRequest)
+		} else if strings.HasPrefix(messageBody, threshold.ShareRequestPreamble) {
+			err = b.respondToShareRequest(msg)
+			if err != nil {
+				b.LogError(msg, err)
+			}
+		}
+	}
+}
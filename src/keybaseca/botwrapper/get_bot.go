@@ -8,6 +8,7 @@ package botwrapper
 import (
 	"time"
 
+	"github.com/keybase/bot-sshca/src/shared"
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 )
 
@@ -15,6 +16,11 @@ import (
 // is preferred to reference the `GetKBChat` method in the `bot` package instead
 func GetKBChat(keybaseHomeDir, keybasePaperKey, keybaseUsername string, keybaseTimeout time.Duration) (*kbchat.API, error) {
 	runOptions := kbchat.RunOptions{}
+	// Resolve keybase via the absolute directories in $PATH only. Note that kbchat runs keybase with the environment
+	// of this process rather than a scrubbed one.
+	if path, err := shared.LookPath("keybase"); err == nil {
+		runOptions.KeybaseLocation = path
+	}
 	if keybaseHomeDir != "" {
 		runOptions.HomeDir = keybaseHomeDir
 	}
@@ -0,0 +1,229 @@
+package canary
+
+/*
+canary implements canary certificates: certificates that are issued to nobody and planted where an intruder would find
+them (eg in a honeypot home directory, a CI secret, or a backup) as a tripwire. They are never meant to be used, so an
+attempt to log in with one means that wherever it was planted has been compromised. The CA records each canary in a
+list (see CANARY_LOCATION) that kssh-authcheck reads on every login. kssh-authcheck rejects canary certificates and
+reports them to the CA's /canary endpoint, which fires a canary_triggered event and posts to the security channel.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+	"golang.org/x/crypto/ssh"
+)
+
+// Canary describes a canary certificate. The certificate itself is not recorded so that the list does not help anyone
+// who reads it to use the canary.
+type Canary struct {
+	// A description of where the canary was planted (eg "backup-server:/root/.ssh/id_ed25519")
+	Name   string `json:"name"`
+	KeyID  string `json:"key_id"`
+	Serial uint64 `json:"serial"`
+	// The SHA256 fingerprint of the certified key
+	Fingerprint string    `json:"fingerprint"`
+	IssuedBy    string    `json:"issued_by"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ValidBefore time.Time `json:"valid_before"`
+}
+
+// List is the list of canaries stored at CANARY_LOCATION
+type List struct {
+	Canaries []Canary `json:"canaries"`
+}
+
+// Find returns the canary that cert is, or nil if it is not a canary
+func (l List) Find(cert *ssh.Certificate) *Canary {
+	fingerprint := ssh.FingerprintSHA256(cert.Key)
+	for i, canary := range l.Canaries {
+		if canary.Serial == cert.Serial && canary.Fingerprint == fingerprint && canary.KeyID == cert.KeyId {
+			return &l.Canaries[i]
+		}
+	}
+	return nil
+}
+
+// Alert is sent by kssh-authcheck to the CA's /canary endpoint when a canary certificate is used
+type Alert struct {
+	// The certificate in authorized_keys format. The CA checks that it is one of its canaries before alerting anyone.
+	Certificate string `json:"certificate"`
+	// The server that the canary was used to log in to
+	Host string `json:"host"`
+	// The user that the canary was used to log in as, if known
+	User string `json:"user,omitempty"`
+}
+
+// The maximum size of an Alert accepted by the CA
+const MaxAlertSize = 64 * 1024
+
+// Read returns the list of canaries. A missing list is empty.
+func Read(conf config.Config) (List, error) {
+	var list List
+	location := conf.GetCanaryLocation()
+	contents, err := readFile(location)
+	if os.IsNotExist(err) {
+		return list, nil
+	}
+	if err != nil {
+		return list, fmt.Errorf("failed to read the canary list from %s: %v", location, err)
+	}
+	list, err = Parse(contents)
+	if err != nil {
+		return list, fmt.Errorf("failed to parse the canary list in %s: %v", location, err)
+	}
+	return list, nil
+}
+
+// Parse parses a list of canaries
+func Parse(contents []byte) (List, error) {
+	var list List
+	err := json.Unmarshal(contents, &list)
+	return list, err
+}
+
+// Issue generates a new key at keyPath (and keyPath.pub), signs it as a canary certificate (see
+// sshutils.SignCanary) that is written to keyPath-cert.pub, and adds it to the list of canaries. name describes where
+// the canary will be planted and issuedBy describes who issued it. If the canary cannot be recorded, the key is deleted
+// so that no certificate exists that kssh-authcheck would not recognize as a canary.
+func Issue(conf config.Config, name, issuedBy, decoyUser string, principals []string, ttl time.Duration, keyPath string) (Canary, error) {
+	var canary Canary
+	if strings.TrimSpace(name) == "" {
+		return canary, fmt.Errorf("canaries need a name describing where they are planted")
+	}
+	list, err := Read(conf)
+	if err != nil {
+		return canary, err
+	}
+	for _, existing := range list.Canaries {
+		if existing.Name == name {
+			return canary, fmt.Errorf("there is already a canary named '%s'", name)
+		}
+	}
+
+	err = sshutils.GenerateNewSSHKey(keyPath, false, false)
+	if err != nil {
+		return canary, err
+	}
+	success := false
+	defer func() {
+		if !success {
+			os.Remove(keyPath)
+			os.Remove(shared.KeyPathToPubKey(keyPath))
+			os.Remove(shared.KeyPathToCert(keyPath))
+		}
+	}()
+	publicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(keyPath))
+	if err != nil {
+		return canary, err
+	}
+	signature, keyID, err := sshutils.SignCanary(conf, decoyUser, string(publicKey), principals, ttl)
+	if err != nil {
+		return canary, fmt.Errorf("failed to sign the canary: %v", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature))
+	if err != nil {
+		return canary, fmt.Errorf("failed to parse the canary certificate: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return canary, fmt.Errorf("the canary certificate is not an SSH certificate")
+	}
+	err = ioutil.WriteFile(shared.KeyPathToCert(keyPath), []byte(signature), 0644)
+	if err != nil {
+		return canary, err
+	}
+
+	canary = Canary{Name: name, KeyID: keyID, Serial: cert.Serial, Fingerprint: ssh.FingerprintSHA256(cert.Key),
+		IssuedBy: issuedBy, IssuedAt: time.Now().UTC(), ValidBefore: time.Unix(int64(cert.ValidBefore), 0).UTC()}
+	list.Canaries = append(list.Canaries, canary)
+	contents, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return canary, err
+	}
+	err = writeFile(conf.GetCanaryLocation(), contents)
+	if err != nil {
+		return canary, fmt.Errorf("failed to write the canary list to %s: %v", conf.GetCanaryLocation(), err)
+	}
+	log.Log(conf, fmt.Sprintf("Issued canary certificate name=%s by %s keyID:%s", name, issuedBy, keyID))
+	success = true
+	return canary, nil
+}
+
+// Verify checks that the certificate in the given alert is one of the canaries and returns the canary. Alerts about
+// other certificates are rejected so that the alert endpoint cannot be used to spam the security channel by anyone who
+// does not have a canary.
+func Verify(conf config.Config, alert Alert) (*Canary, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(alert.Certificate))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the certificate: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("not an SSH certificate")
+	}
+	list, err := Read(conf)
+	if err != nil {
+		return nil, err
+	}
+	canary := list.Find(cert)
+	if canary == nil {
+		return nil, fmt.Errorf("the certificate %s is not a canary", cert.KeyId)
+	}
+	return canary, nil
+}
+
+// Report sends the given alert to the CA's /canary endpoint at url
+func Report(url string, alert Alert, timeout time.Duration) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", url, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// Read the file at the given filename via either Keybase simple fs commands or via the local filesystem. Returns an
+// error satisfying os.IsNotExist if the file does not exist.
+func readFile(filename string) ([]byte, error) {
+	if strings.HasPrefix(filename, "/keybase/") {
+		exists, err := constants.GetDefaultKBFSOperationsStruct().FileExists(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, os.ErrNotExist
+		}
+		return constants.GetDefaultKBFSOperationsStruct().Read(filename)
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// Write the file at the given filename via either Keybase simple fs commands or via the local filesystem
+func writeFile(filename string, contents []byte) error {
+	if strings.HasPrefix(filename, "/keybase/") {
+		return constants.GetDefaultKBFSOperationsStruct().WriteVerified(filename, string(contents))
+	}
+	return ioutil.WriteFile(filename, contents, 0600)
+}
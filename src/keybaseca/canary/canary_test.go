@@ -0,0 +1,76 @@
+package canary
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIssueAndVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-canary")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKey := filepath.Join(dir, "ca")
+	require.NoError(t, sshutils.GenerateNewSSHKey(caKey, false, false))
+	os.Setenv("CA_KEY_LOCATION", caKey)
+	os.Setenv("LOG_LOCATION", filepath.Join(dir, "audit.log"))
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	defer os.Unsetenv("LOG_LOCATION")
+	conf := &config.EnvConfig{}
+
+	list, err := Read(conf)
+	require.NoError(t, err)
+	require.Empty(t, list.Canaries)
+
+	keyPath := filepath.Join(dir, "id_ed25519")
+	issued, err := Issue(conf, "backup-server:/root/.ssh/id_ed25519", "local user root", "deploy_bot", []string{"team.ssh.prod.admin"}, 0, keyPath)
+	require.NoError(t, err)
+	require.True(t, issued.ValidBefore.After(time.Now().Add(364*24*time.Hour)))
+	signature, err := ioutil.ReadFile(shared.KeyPathToCert(keyPath))
+	require.NoError(t, err)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(signature)
+	require.NoError(t, err)
+	cert := parsed.(*ssh.Certificate)
+	require.Equal(t, []string{"team.ssh.prod.admin"}, cert.ValidPrincipals)
+	require.Equal(t, issued.KeyID, cert.KeyId)
+	require.Regexp(t, `^[0-9a-f-]{36}:[0-9a-f-]{36}:deploy_bot$`, cert.KeyId)
+
+	list, err = Read(conf)
+	require.NoError(t, err)
+	require.Equal(t, []Canary{issued}, list.Canaries)
+	require.Equal(t, issued, *list.Find(cert))
+	found, err := Verify(conf, Alert{Certificate: string(signature), Host: "db1"})
+	require.NoError(t, err)
+	require.Equal(t, issued.Name, found.Name)
+
+	// Names are unique and keys are not overwritten
+	_, err = Issue(conf, issued.Name, "local user root", "deploy_bot", []string{"team.ssh.prod.admin"}, 0, filepath.Join(dir, "other"))
+	require.Error(t, err)
+	_, err = Issue(conf, "other", "local user root", "deploy_bot", []string{"team.ssh.prod.admin"}, 0, keyPath)
+	require.Error(t, err)
+	// Nothing is left behind if the canary cannot be signed
+	_, err = Issue(conf, "other", "local user root", "not a user", []string{"team.ssh.prod.admin"}, 0, filepath.Join(dir, "other"))
+	require.Error(t, err)
+	_, err = os.Stat(filepath.Join(dir, "other"))
+	require.True(t, os.IsNotExist(err))
+
+	// Only canaries are accepted by Verify
+	userKey := filepath.Join(dir, "user")
+	require.NoError(t, sshutils.GenerateNewSSHKey(userKey, false, false))
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+	other, err := sshutils.SignKey(caKey, cert.KeyId, "team.ssh.prod.admin", "+1h", string(pubKey))
+	require.NoError(t, err)
+	_, err = Verify(conf, Alert{Certificate: other, Host: "db1"})
+	require.Error(t, err)
+	_, err = Verify(conf, Alert{Certificate: string(pubKey), Host: "db1"})
+	require.Error(t, err)
+}
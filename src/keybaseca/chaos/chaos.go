@@ -0,0 +1,133 @@
+package chaos
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings describes the faults that keybaseca injects into the kssh protocol when running in chaos mode (see the
+// CHAOS environment variable). This is only meant for exercising the retry and error handling in kssh in
+// integration tests and must never be enabled on a production CA.
+type Settings struct {
+	// Each protocol message is delayed by a random duration up to MaxDelay
+	MaxDelay time.Duration
+	// The probability that a protocol message is silently dropped
+	DropRate float64
+	// The probability that a protocol message is replaced with a malformed one
+	MalformedRate float64
+	// The seed for the random number generator so that a failing run can be reproduced. Zero means a random seed.
+	Seed int64
+}
+
+// Parse the given chaos spec. The spec is a comma separated list of key=value pairs, eg
+// "delay=2s,drop=0.1,malformed=0.05,seed=42".
+func Parse(spec string) (Settings, error) {
+	var settings Settings
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return settings, fmt.Errorf("'%s' is not of the form key=value", item)
+		}
+		key, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		var err error
+		switch key {
+		case "delay":
+			settings.MaxDelay, err = time.ParseDuration(value)
+			if err == nil && settings.MaxDelay < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "drop":
+			settings.DropRate, err = parseRate(value)
+		case "malformed":
+			settings.MalformedRate, err = parseRate(value)
+		case "seed":
+			settings.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return settings, fmt.Errorf("unknown key '%s', expected one of delay, drop, malformed, seed", key)
+		}
+		if err != nil {
+			return settings, fmt.Errorf("invalid value '%s' for %s: %v", value, key, err)
+		}
+	}
+	return settings, nil
+}
+
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("must be between 0 and 1")
+	}
+	return rate, nil
+}
+
+// An Injector applies the faults described by Settings to outgoing protocol messages
+type Injector struct {
+	settings Settings
+
+	lock sync.Mutex
+	rand *rand.Rand
+
+	// Swapped out in tests
+	sleep func(time.Duration)
+}
+
+// NewInjector returns an Injector for the given settings
+func NewInjector(settings Settings) *Injector {
+	seed := settings.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &Injector{settings: settings, rand: rand.New(rand.NewSource(seed)), sleep: time.Sleep}
+}
+
+// Apply injects faults into the given protocol message before it is sent. It may sleep, and returns the (possibly
+// malformed) body to send or false if the message should be dropped.
+func (i *Injector) Apply(body string) (string, bool) {
+	i.lock.Lock()
+	var delay time.Duration
+	if i.settings.MaxDelay > 0 {
+		delay = time.Duration(i.rand.Int63n(int64(i.settings.MaxDelay) + 1))
+	}
+	drop := i.rand.Float64() < i.settings.DropRate
+	malformed := i.rand.Float64() < i.settings.MalformedRate
+	cut := 0
+	if len(body) > 0 {
+		cut = i.rand.Intn(len(body))
+	}
+	i.lock.Unlock()
+
+	if delay > 0 {
+		i.sleep(delay)
+	}
+	if drop {
+		return "", false
+	}
+	if malformed {
+		return malform(body, cut), true
+	}
+	return body, true
+}
+
+// Malform the given message while keeping the prefix that kssh uses to tell the types of messages apart so that the
+// message still reaches kssh's parsing code. The JSON payload (if any) is truncated at cut and followed by garbage.
+func malform(body string, cut int) string {
+	payloadStart := strings.Index(body, "{")
+	if payloadStart < 0 {
+		return body[:cut] + "\x00garbage"
+	}
+	if cut < payloadStart {
+		cut = payloadStart + (cut % (len(body) - payloadStart))
+	}
+	return body[:cut] + "\x00garbage"
+}
@@ -0,0 +1,61 @@
+package chaos
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	settings, err := Parse("delay=2s, drop=0.1,malformed=0.05,seed=42")
+	require.NoError(t, err)
+	require.Equal(t, Settings{MaxDelay: 2 * time.Second, DropRate: 0.1, MalformedRate: 0.05, Seed: 42}, settings)
+
+	settings, err = Parse("drop=1")
+	require.NoError(t, err)
+	require.Equal(t, Settings{DropRate: 1}, settings)
+
+	for _, spec := range []string{"drop", "drop=1.5", "malformed=-0.1", "delay=soon", "delay=-1s", "seed=x", "explode=1"} {
+		_, err = Parse(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestApply(t *testing.T) {
+	response, err := json.Marshal(shared.SignatureResponse{UUID: "uuid", SignedKey: "ssh-ed25519-cert-v01@openssh.com AAAA"})
+	require.NoError(t, err)
+	body := shared.SignatureResponsePreamble + string(response)
+
+	injector := NewInjector(Settings{})
+	sent, ok := injector.Apply(body)
+	require.True(t, ok)
+	require.Equal(t, body, sent)
+
+	injector = NewInjector(Settings{DropRate: 1})
+	_, ok = injector.Apply(body)
+	require.False(t, ok)
+
+	var slept time.Duration
+	injector = NewInjector(Settings{MaxDelay: time.Second, Seed: 1})
+	injector.sleep = func(d time.Duration) { slept += d }
+	for i := 0; i < 10; i++ {
+		sent, ok = injector.Apply(body)
+		require.True(t, ok)
+		require.Equal(t, body, sent)
+	}
+	require.True(t, slept > 0 && slept <= 10*time.Second)
+
+	// Malformed messages still look like a signature response but fail to parse
+	injector = NewInjector(Settings{MalformedRate: 1})
+	for i := 0; i < 20; i++ {
+		sent, ok = injector.Apply(body)
+		require.True(t, ok)
+		require.True(t, strings.HasPrefix(sent, shared.SignatureResponsePreamble))
+		_, err = shared.ParseSignatureResponse(sent)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,82 @@
+package clock
+
+// This package checks the clock of the CA host against an NTP server. Certificates are valid from the time that they
+// are signed (see CERT_BACKDATE) so a CA whose clock is ahead issues certificates that servers with a correct clock
+// reject as not yet valid, and a CA whose clock is behind issues certificates that expire early. It implements just
+// enough of SNTP (RFC 4330) to measure the offset rather than depending on a third party library.
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// MaxOffset is how far the CA's clock may be from the NTP server's before keybaseca warns about it
+const MaxOffset = time.Minute
+
+// The number of seconds between the NTP epoch (1900) and the Unix epoch (1970)
+const ntpEpochOffset = 2208988800
+
+// Offset returns how far the local clock is ahead of the clock of the given NTP server (host or host:port). A negative
+// offset means the local clock is behind.
+func Offset(server string, timeout time.Duration) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, timeout)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to the NTP server %s: %v", server, err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	request := make([]byte, 48)
+	// No leap indicator, version 4, client mode
+	request[0] = 0x23
+	sent := time.Now()
+	if _, err = conn.Write(request); err != nil {
+		return 0, fmt.Errorf("failed to query the NTP server %s: %v", server, err)
+	}
+	response := make([]byte, 48)
+	n, err := conn.Read(response)
+	received := time.Now()
+	if err != nil {
+		return 0, fmt.Errorf("failed to query the NTP server %s: %v", server, err)
+	}
+	if n < 48 || response[0]&0x07 != 4 {
+		return 0, fmt.Errorf("invalid response from the NTP server %s", server)
+	}
+	serverReceived := ntpTime(response[32:40])
+	serverSent := ntpTime(response[40:48])
+	// The standard SNTP clock offset, which assumes the network delay is the same in both directions
+	return -(serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+// Parse a 64 bit NTP timestamp
+func ntpTime(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[:4])) - ntpEpochOffset
+	fraction := int64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(seconds, (fraction*int64(time.Second))>>32)
+}
+
+// Check returns a warning if the local clock is more than MaxOffset from the given NTP server or the server cannot be
+// reached, and an empty string otherwise
+func Check(server string, timeout time.Duration) string {
+	offset, err := Offset(server, timeout)
+	if err != nil {
+		return fmt.Sprintf("failed to check the CA's clock: %v", err)
+	}
+	if offset > MaxOffset {
+		return fmt.Sprintf("the CA's clock is %s ahead of %s so servers may reject certificates as not yet valid, sync "+
+			"the clock or set CERT_BACKDATE", offset.Round(time.Second), server)
+	}
+	if offset < -MaxOffset {
+		return fmt.Sprintf("the CA's clock is %s behind %s so certificates expire early, sync the clock",
+			(-offset).Round(time.Second), server)
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package clock
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Start an NTP server on localhost whose clock is offset from the local clock by the given amount
+func startNTPServer(t *testing.T, offset time.Duration) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		buf := make([]byte, 48)
+		for {
+			_, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			response := make([]byte, 48)
+			// Version 4, server mode
+			response[0] = 0x24
+			now := time.Now().Add(offset)
+			putNTPTime(response[32:40], now)
+			putNTPTime(response[40:48], now)
+			_, _ = conn.WriteTo(response, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func putNTPTime(b []byte, t time.Time) {
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()+ntpEpochOffset))
+	binary.BigEndian.PutUint32(b[4:], uint32((int64(t.Nanosecond())<<32)/int64(time.Second)))
+}
+
+func TestOffset(t *testing.T) {
+	server := startNTPServer(t, -2*time.Minute)
+	offset, err := Offset(server, time.Second)
+	require.NoError(t, err)
+	require.InDelta(t, float64(2*time.Minute), float64(offset), float64(time.Second))
+	require.True(t, strings.Contains(Check(server, time.Second), "ahead"))
+
+	server = startNTPServer(t, 3*time.Minute)
+	require.True(t, strings.Contains(Check(server, time.Second), "behind"))
+
+	server = startNTPServer(t, 0)
+	require.Equal(t, "", Check(server, time.Second))
+}
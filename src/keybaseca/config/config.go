@@ -3,11 +3,16 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/keybase/bot-sshca/src/keybaseca/chaos"
 	"github.com/keybase/bot-sshca/src/keybaseca/constants"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
@@ -20,6 +25,9 @@ import (
 // Represents a loaded and validated config for keybaseca
 type Config interface {
 	GetCAKeyLocation() string
+	GetCAKeyPassphrase() string
+	GetCAKeyPassphraseFile() string
+	GetCAKeyPassphraseCommand() string
 	GetKeybaseHomeDir() string
 	GetKeybasePaperKey() string
 	GetKeybaseUsername() string
@@ -27,16 +35,175 @@ type Config interface {
 	GetTeams() []string
 	GetChatTeam() string
 	GetChannelName() string
+	GetSigningChannel() string
 	GetLogLocation() string
 	GetStrictLogging() bool
 	GetAnnouncement() string
 	DebugString() string
 	GetKeybaseTimeout() time.Duration
+	GetHTTPListenAddress() string
+	GetWebhooks() []Webhook
+	GetWebhookSecret() string
+	GetSensitiveTeams() []string
+	GetAWSSSMHosts() []string
+	GetDefaultSSHUsers() []HostUser
+	GetConfigMirrors() []string
+	GetKsshMetricsEndpoint() string
+	GetPreConnectHooks() []PreConnectHook
+	GetPreConnectDuration() time.Duration
+	GetKsshFeatureFlags() []FeatureFlag
+	GetRSASignatureAlgorithm() string
+	GetAllowSSHRSASignatures() bool
+	GetIssuanceStore() string
+	GetAuditRetention() time.Duration
+	GetChaos() *chaos.Settings
+	GetHeartbeatInterval() time.Duration
+	GetAllowedExtensions() []AllowedExtension
+	GetAWSInstanceConnectHosts() []string
+	GetAWSRegion() string
+	GetAdmins() []string
+	GetBreakGlassUsers() []string
+	GetLockdownLocation() string
+	GetCanaryLocation() string
+	GetNotifyUsers() bool
+	GetRequestMaxSkew() time.Duration
+	GetRequireRequestNonce() bool
+	GetDualControl() bool
+	GetProtocolMessageRetention() time.Duration
+	GetExplodingMessageLifetime() time.Duration
+	GetOIDCIssuer() string
+	GetOIDCClientID() string
+	GetOIDCClientSecret() string
+	GetOIDCUsernameClaim() string
+	GetOIDCRequiredAMR() []string
+	GetDuoAPIHost() string
+	GetDuoIntegrationKey() string
+	GetDuoSecretKey() string
+	GetDuoTeams() []string
+	GetDuoTimeout() time.Duration
+	GetElevatedPrincipals() []ElevatedPrincipal
+	GetElevatedKeyExpiration() string
+	GetSudoExtension() bool
+	GetRestrictedBot() bool
+	GetTeamAllowedUsers() []TeamUser
+	GetTeamDeniedUsers() []TeamUser
+	GetGroupProvider() string
+	GetOktaURL() string
+	GetOktaAPIToken() string
+	GetGroupCommand() string
+	GetGroupUsername(username string) string
+	GetGroupPrincipals() []GroupPrincipal
+	GetGroupCacheTTL() time.Duration
+	GetGroupFailOpen() bool
+	GetUsernamePrincipalTeams() []string
+	GetUsernameMap() []UsernameMapping
+	GetUsernameRegex() *regexp.Regexp
+	GetUsernameReplacement() string
+	GetUsernameCommand() string
+	GetSecurityTeam() string
+	GetSecurityChannelName() string
+	GetDiscoveryTeam() string
+	GetDiscoveryChannelName() string
+	GetMaxPrincipals() int
+	GetMaxKeyIDLength() int
+	GetMaxExtensionBytes() int
+	GetIntermediateCertLocation() string
+	GetThresholdShareLocation() string
+	GetThresholdTeams() []string
+	GetThresholdCAKeyLocation() string
+	GetThresholdPeers() []string
+	GetThresholdCoordinator() string
+	GetThresholdTimeout() time.Duration
+	GetCertBackdate() string
+	GetNTPServer() string
+	GetMessagesFile() string
+	GetVaultAddress() string
+	GetVaultToken() string
+	GetVaultNamespace() string
+	GetVaultSSHMount() string
+	GetVaultSSHRole() string
+}
+
+// The types of webhooks supported by keybaseca
+const (
+	WebhookTypeSlack     = "slack"
+	WebhookTypeGeneric   = "generic"
+	WebhookTypePagerDuty = "pagerduty"
+)
+
+// A Webhook is an outbound notification target. For slack and generic webhooks Target is an https URL. For
+// pagerduty webhooks Target is the routing key of a PagerDuty Events API v2 integration.
+type Webhook struct {
+	Type   string
+	Target string
+}
+
+// An ElevatedPrincipal is an additional principal that members of Team (a team or team pattern) receive when they
+// request an elevated certificate via `kssh --elevate`
+type ElevatedPrincipal struct {
+	Team      string
+	Principal string
+}
+
+// A TeamUser limits which members of Team (a team or team pattern) may receive certificates for it (see
+// TEAM_ALLOWED_USERS and TEAM_DENIED_USERS)
+type TeamUser struct {
+	Team     string
+	Username string
+}
+
+// A GroupPrincipal grants Principal to the members of Group in the external group provider (see GROUP_PROVIDER)
+type GroupPrincipal struct {
+	Group     string
+	Principal string
+}
+
+// An AllowedExtension allows members of Team (a team or team pattern) to request the custom certificate extension Name
+// with Value via `kssh --extension` (see ALLOWED_EXTENSIONS). A Value of "*" allows any value.
+type AllowedExtension struct {
+	Team  string
+	Name  string
+	Value string
+}
+
+// A HostUser specifies that kssh should log into hosts matching HostPattern as User unless the user chose another
+// remote user (see DEFAULT_SSH_USERS)
+type HostUser struct {
+	HostPattern string
+	User        string
+}
+
+// A PreConnectHook specifies that kssh should open the firewall for hosts matching HostPattern via Provider before
+// connecting to them (see PRE_CONNECT_HOOKS). Target is the URL of the API for the http provider or the ID of the
+// security group for the aws-security-group provider.
+type PreConnectHook struct {
+	HostPattern string
+	Provider    string
+	Target      string
+}
+
+// A FeatureFlag enables the kssh behavior Name (one of shared.KnownFeatures) for Percent percent of the users of the
+// teams matching Team, or of every team if Team is empty (see KSSH_FEATURE_FLAGS)
+type FeatureFlag struct {
+	Team    string
+	Name    string
+	Percent int
+}
+
+// A UsernameMapping maps the Keybase username Username to the unix username UnixUsername (see USERNAME_MAP). If Team
+// is set the mapping only applies to principals for that team (or team pattern).
+type UsernameMapping struct {
+	Team         string
+	Username     string
+	UnixUsername string
 }
 
 // Validate the given config file. If offline, do so without connecting to keybase (used in code that is meant
 // to function without any reliance on Keybase).
 func ValidateConfig(conf EnvConfig, offline bool) error {
+	// Registered before anything that may fail so that the secrets are kept out of every error and log message
+	shared.RegisterSecret(conf.GetKeybasePaperKey(), conf.GetCAKeyPassphrase(), conf.GetWebhookSecret(), conf.GetOIDCClientSecret(),
+		conf.GetDuoSecretKey(), conf.GetOktaAPIToken(), conf.GetVaultToken())
 	if conf.getKeybaseTimeout() != "" {
 		_, err := strconv.Atoi(conf.getKeybaseTimeout())
 		if err != nil {
@@ -46,6 +213,12 @@ func ValidateConfig(conf EnvConfig, offline bool) error {
 	if len(conf.GetTeams()) == 0 {
 		return fmt.Errorf("must specify at least one team via the TEAMS environment variable")
 	}
+	for _, team := range append(conf.GetTeams(), conf.GetSensitiveTeams()...) {
+		err := shared.ValidateTeamPattern(team)
+		if err != nil {
+			return err
+		}
+	}
 	if conf.GetKeyExpiration() != "" && !strings.HasPrefix(conf.GetKeyExpiration(), "+") {
 		// Only a basic check for this since ssh will error out later on if it is bogus
 		return fmt.Errorf("KEY_EXPIRATION must be of the form `+<number><unit> where unit is one of `m`, `h`, `d`, `w`. Eg `+1h`. ")
@@ -66,17 +239,455 @@ func ValidateConfig(conf EnvConfig, offline bool) error {
 			return fmt.Errorf("failed to validate CHAT_CHANNEL '%s': %v", channel, err)
 		}
 	}
+	if conf.GetSigningChannel() != "" {
+		if conf.getChatChannel() != "" {
+			return fmt.Errorf("SIGNING_CHANNEL cannot be used with CHAT_CHANNEL since CHAT_CHANNEL already restricts the bot to a single channel")
+		}
+		if strings.ContainsAny(conf.GetSigningChannel(), "# \t,") {
+			return fmt.Errorf("SIGNING_CHANNEL must be a channel name (eg ssh-provisioning), '%s' is not valid", conf.GetSigningChannel())
+		}
+		if !offline {
+			// Team patterns are expanded (and the channel joined) by the bot on startup
+			for _, team := range conf.GetTeams() {
+				if shared.IsTeamPattern(team) {
+					continue
+				}
+				err := validateChannel(&conf, team, conf.GetSigningChannel())
+				if err != nil {
+					return fmt.Errorf("failed to validate SIGNING_CHANNEL '%s': %v", conf.GetSigningChannel(), err)
+				}
+			}
+		}
+	}
+	if conf.getProtocolMessageRetention() != "" {
+		retention, err := strconv.Atoi(conf.getProtocolMessageRetention())
+		if err != nil || retention < minProtocolMessageRetention {
+			return fmt.Errorf("PROTOCOL_MESSAGE_RETENTION must be a number of seconds that is at least %d, '%s' is not valid",
+				minProtocolMessageRetention, conf.getProtocolMessageRetention())
+		}
+	}
+	if conf.getAuditRetentionDays() != "" {
+		days, err := strconv.Atoi(conf.getAuditRetentionDays())
+		if err != nil || days < 1 {
+			return fmt.Errorf("AUDIT_RETENTION_DAYS must be a positive number of days, '%s' is not valid", conf.getAuditRetentionDays())
+		}
+	}
+	if conf.getHeartbeatInterval() != "" {
+		interval, err := strconv.Atoi(conf.getHeartbeatInterval())
+		if err != nil || (interval != 0 && interval < minHeartbeatInterval) {
+			return fmt.Errorf("HEARTBEAT_INTERVAL must be 0 or a number of seconds of at least %d, '%s' is not valid",
+				minHeartbeatInterval, conf.getHeartbeatInterval())
+		}
+	}
+	if conf.getPreConnectDuration() != "" {
+		duration, err := strconv.Atoi(conf.getPreConnectDuration())
+		if err != nil || duration < 1 || duration > maxPreConnectDuration {
+			return fmt.Errorf("PRE_CONNECT_DURATION must be a number of seconds between 1 and %d, '%s' is not valid",
+				maxPreConnectDuration, conf.getPreConnectDuration())
+		}
+	}
+	if conf.getChaos() != "" {
+		_, err := chaos.Parse(conf.getChaos())
+		if err != nil {
+			return fmt.Errorf("failed to parse CHAOS: %v", err)
+		}
+	}
+	if conf.getExplodingMessageLifetime() != "" {
+		lifetime, err := strconv.Atoi(conf.getExplodingMessageLifetime())
+		valid := err == nil && (lifetime == 0 || (time.Duration(lifetime)*time.Second >= shared.MinExplodingLifetime &&
+			time.Duration(lifetime)*time.Second <= shared.MaxExplodingLifetime))
+		if !valid {
+			return fmt.Errorf("EXPLODING_MESSAGE_LIFETIME must be 0 or a number of seconds between %d and %d, '%s' is not valid",
+				int64(shared.MinExplodingLifetime/time.Second), int64(shared.MaxExplodingLifetime/time.Second),
+				conf.getExplodingMessageLifetime())
+		}
+	}
 	if conf.getStrictLogging() != "" {
 		if conf.getStrictLogging() != "true" && conf.getStrictLogging() != "false" {
 			return fmt.Errorf("STRICT_LOGGING must be either 'true' or 'false', '%s' is not valid", conf.getStrictLogging())
 		}
 	}
+	if conf.getRequestMaxSkew() != "" {
+		skew, err := strconv.Atoi(conf.getRequestMaxSkew())
+		if err != nil || skew <= 0 {
+			return fmt.Errorf("REQUEST_MAX_SKEW must be a positive number of seconds, '%s' is not valid", conf.getRequestMaxSkew())
+		}
+	}
+	if conf.GetMessagesFile() != "" {
+		_, err := shared.LoadMessages(conf.GetMessagesFile())
+		if err != nil {
+			return err
+		}
+	}
+	if conf.GetVaultSSHRole() != "" {
+		if conf.GetVaultAddress() == "" || conf.GetVaultToken() == "" {
+			return fmt.Errorf("VAULT_ADDR and VAULT_TOKEN must be set when VAULT_SSH_ROLE is set")
+		}
+		if conf.GetThresholdShareLocation() != "" || conf.GetIntermediateCertLocation() != "" {
+			return fmt.Errorf("THRESHOLD_SHARE_LOCATION and INTERMEDIATE_CERT_LOCATION may not be set when VAULT_SSH_ROLE " +
+				"is set since Vault holds the CA key")
+		}
+	}
+	if conf.GetCertBackdate() != "" && !strings.HasPrefix(conf.GetCertBackdate(), "-") {
+		// Only a basic check for this since ssh-keygen will error out later on if it is bogus
+		return fmt.Errorf("CERT_BACKDATE must be of the form `-<number><unit> where unit is one of `m`, `h`, `d`, `w`. Eg `-5m`. ")
+	}
+	if conf.getMaxPrincipals() != "" {
+		max, err := strconv.Atoi(conf.getMaxPrincipals())
+		if err != nil || max <= 0 || max > shared.CertMaxPrincipals {
+			return fmt.Errorf("MAX_PRINCIPALS must be a number between 1 and %d, '%s' is not valid", shared.CertMaxPrincipals, conf.getMaxPrincipals())
+		}
+	}
+	if conf.getMaxKeyIDLength() != "" {
+		max, err := strconv.Atoi(conf.getMaxKeyIDLength())
+		if err != nil || max <= 0 {
+			return fmt.Errorf("MAX_KEY_ID_LENGTH must be a positive number of bytes, '%s' is not valid", conf.getMaxKeyIDLength())
+		}
+	}
+	if conf.getMaxExtensionBytes() != "" {
+		max, err := strconv.Atoi(conf.getMaxExtensionBytes())
+		if err != nil || max <= 0 {
+			return fmt.Errorf("MAX_EXTENSION_BYTES must be a positive number of bytes, '%s' is not valid", conf.getMaxExtensionBytes())
+		}
+	}
+	if conf.GetThresholdShareLocation() != "" {
+		if len(conf.GetThresholdPeers()) == 0 || conf.GetThresholdCoordinator() == "" {
+			return fmt.Errorf("THRESHOLD_PEERS and THRESHOLD_COORDINATOR must be set when THRESHOLD_SHARE_LOCATION is set")
+		}
+		if len(conf.GetThresholdTeams()) == 0 && (conf.GetCAKeyPassphrase() != "" || conf.GetCAKeyPassphraseFile() != "" ||
+			conf.GetCAKeyPassphraseCommand() != "") {
+			return fmt.Errorf("the CA key passphrase may not be set when THRESHOLD_SHARE_LOCATION is set without " +
+				"THRESHOLD_TEAMS since the CA key is encrypted with the secret split between the instances")
+		}
+	}
+	if len(conf.GetThresholdTeams()) > 0 {
+		if conf.GetThresholdShareLocation() == "" || conf.getThresholdCAKeyLocation() == "" {
+			return fmt.Errorf("THRESHOLD_SHARE_LOCATION and THRESHOLD_CA_KEY_LOCATION must be set when THRESHOLD_TEAMS is set")
+		}
+		if conf.GetThresholdCAKeyLocation() == conf.GetCAKeyLocation() {
+			return fmt.Errorf("THRESHOLD_CA_KEY_LOCATION must be a different CA key than CA_KEY_LOCATION so that the " +
+				"teams in THRESHOLD_TEAMS do not trust certificates signed without threshold signing")
+		}
+		for _, team := range conf.GetThresholdTeams() {
+			err := shared.ValidateTeamPattern(team)
+			if err != nil {
+				return err
+			}
+		}
+	} else if conf.getThresholdCAKeyLocation() != "" {
+		return fmt.Errorf("THRESHOLD_CA_KEY_LOCATION may only be set when THRESHOLD_TEAMS is set")
+	}
+	if conf.getThresholdTimeout() != "" {
+		timeout, err := strconv.Atoi(conf.getThresholdTimeout())
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("THRESHOLD_TIMEOUT must be a positive number of seconds, '%s' is not valid", conf.getThresholdTimeout())
+		}
+	}
+	if conf.getRequireRequestNonce() != "" {
+		if conf.getRequireRequestNonce() != "true" && conf.getRequireRequestNonce() != "false" {
+			return fmt.Errorf("REQUIRE_REQUEST_NONCE must be either 'true' or 'false', '%s' is not valid", conf.getRequireRequestNonce())
+		}
+	}
+	if conf.getDualControl() != "" {
+		if conf.getDualControl() != "true" && conf.getDualControl() != "false" {
+			return fmt.Errorf("DUAL_CONTROL must be either 'true' or 'false', '%s' is not valid", conf.getDualControl())
+		}
+		if conf.GetDualControl() && len(conf.GetAdmins()) < 2 {
+			return fmt.Errorf("DUAL_CONTROL requires at least two ADMINS to approve operations")
+		}
+		if conf.GetDualControl() && conf.GetChatTeam() == "" && conf.GetSecurityTeam() == "" {
+			return fmt.Errorf("DUAL_CONTROL requires CHAT_CHANNEL or SECURITY_CHANNEL so that admins can be asked for approval")
+		}
+	}
+	if conf.GetOIDCIssuer() != "" {
+		u, err := url.Parse(conf.GetOIDCIssuer())
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("OIDC_ISSUER must be an https URL, '%s' is not valid", conf.GetOIDCIssuer())
+		}
+		if conf.GetOIDCClientID() == "" {
+			return fmt.Errorf("OIDC_CLIENT_ID must be set when OIDC_ISSUER is set")
+		}
+	}
+	if conf.GetDuoAPIHost() != "" {
+		if strings.Contains(conf.GetDuoAPIHost(), "/") {
+			return fmt.Errorf("DUO_API_HOST must be a hostname (eg api-xxxxxxxx.duosecurity.com), '%s' is not valid", conf.GetDuoAPIHost())
+		}
+		if conf.GetDuoIntegrationKey() == "" || conf.GetDuoSecretKey() == "" {
+			return fmt.Errorf("DUO_INTEGRATION_KEY and DUO_SECRET_KEY must be set when DUO_API_HOST is set")
+		}
+		for _, team := range conf.GetDuoTeams() {
+			err := shared.ValidateTeamPattern(team)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if conf.getDuoTimeout() != "" {
+		timeout, err := strconv.Atoi(conf.getDuoTimeout())
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("DUO_TIMEOUT must be a positive number of seconds, '%s' is not valid", conf.getDuoTimeout())
+		}
+	}
+	if conf.getElevatedPrincipals() != "" {
+		elevated := conf.GetElevatedPrincipals()
+		if len(elevated) != len(splitList(conf.getElevatedPrincipals())) {
+			return fmt.Errorf("ELEVATED_PRINCIPALS entries must be of the form team=principal, '%s' is not valid", conf.getElevatedPrincipals())
+		}
+		for _, entry := range elevated {
+			err := shared.ValidateTeamPattern(entry.Team)
+			if err != nil {
+				return err
+			}
+			if entry.Principal == "" || strings.ContainsAny(entry.Principal, " \t,*?") {
+				return fmt.Errorf("ELEVATED_PRINCIPALS contains an invalid principal '%s'", entry.Principal)
+			}
+		}
+		if conf.GetDuoAPIHost() == "" && conf.GetOIDCIssuer() == "" {
+			return fmt.Errorf("ELEVATED_PRINCIPALS requires either DUO_API_HOST or OIDC_ISSUER so that elevation is gated by MFA")
+		}
+	}
+	if conf.GetElevatedKeyExpiration() != "" && !strings.HasPrefix(conf.GetElevatedKeyExpiration(), "+") {
+		return fmt.Errorf("ELEVATED_KEY_EXPIRATION must be of the form `+<number><unit> where unit is one of `m`, `h`, `d`, `w`. Eg `+15m`. ")
+	}
+	if conf.getSudoExtension() != "" {
+		if conf.getSudoExtension() != "true" && conf.getSudoExtension() != "false" {
+			return fmt.Errorf("SUDO_EXTENSION must be either 'true' or 'false', '%s' is not valid", conf.getSudoExtension())
+		}
+		if conf.GetSudoExtension() && len(conf.GetElevatedPrincipals()) == 0 {
+			return fmt.Errorf("SUDO_EXTENSION requires ELEVATED_PRINCIPALS since only elevated certificates permit sudo")
+		}
+	}
+	teamUserLists := []struct{ name, raw string }{
+		{"TEAM_ALLOWED_USERS", conf.getTeamAllowedUsers()},
+		{"TEAM_DENIED_USERS", conf.getTeamDeniedUsers()},
+	}
+	for _, list := range teamUserLists {
+		name, raw := list.name, list.raw
+		entries := parseTeamUsers(raw)
+		if len(entries) != len(splitList(raw)) {
+			return fmt.Errorf("%s entries must be of the form team=username, '%s' is not valid", name, raw)
+		}
+		for _, entry := range entries {
+			err := shared.ValidateTeamPattern(entry.Team)
+			if err != nil {
+				return err
+			}
+			if entry.Username == "" || strings.ContainsAny(entry.Username, " \t,*?") {
+				return fmt.Errorf("%s contains an invalid username '%s'", name, entry.Username)
+			}
+		}
+	}
+	if conf.getAllowedExtensions() != "" {
+		allowed := conf.GetAllowedExtensions()
+		if len(allowed) != len(splitList(conf.getAllowedExtensions())) {
+			return fmt.Errorf("ALLOWED_EXTENSIONS entries must be of the form team=name or team=name=value, '%s' is not valid",
+				conf.getAllowedExtensions())
+		}
+		for _, entry := range allowed {
+			err := shared.ValidateTeamPattern(entry.Team)
+			if err != nil {
+				return err
+			}
+			err = shared.ValidateExtension(entry.Name, entry.Value)
+			if err != nil {
+				return fmt.Errorf("ALLOWED_EXTENSIONS contains an invalid extension: %v", err)
+			}
+		}
+	}
+	err := validateGroupProvider(conf)
+	if err != nil {
+		return err
+	}
+	err = validateUsernameMapping(conf)
+	if err != nil {
+		return err
+	}
+	if conf.getRestrictedBot() != "" {
+		if conf.getRestrictedBot() != "true" && conf.getRestrictedBot() != "false" {
+			return fmt.Errorf("RESTRICTED_BOT must be either 'true' or 'false', '%s' is not valid", conf.getRestrictedBot())
+		}
+	}
+	if conf.getNotifyUsers() != "" {
+		if conf.getNotifyUsers() != "true" && conf.getNotifyUsers() != "false" {
+			return fmt.Errorf("NOTIFY_USERS must be either 'true' or 'false', '%s' is not valid", conf.getNotifyUsers())
+		}
+	}
+	if conf.getSecurityChannel() != "" {
+		team, channel, err := splitTeamChannel(conf.getSecurityChannel())
+		if err != nil {
+			return fmt.Errorf("Failed to parse SECURITY_CHANNEL=%s: %v", conf.getSecurityChannel(), err)
+		}
+		if !offline {
+			err = validateChannel(&conf, team, channel)
+			if err != nil {
+				return fmt.Errorf("failed to validate SECURITY_CHANNEL '%s': %v", channel, err)
+			}
+		}
+	}
+	if conf.getDiscoveryChannel() != "" {
+		team, channel, err := splitTeamChannel(conf.getDiscoveryChannel())
+		if err != nil {
+			return fmt.Errorf("Failed to parse DISCOVERY_CHANNEL=%s: %v", conf.getDiscoveryChannel(), err)
+		}
+		if !offline {
+			err = validateChannel(&conf, team, channel)
+			if err != nil {
+				return fmt.Errorf("failed to validate DISCOVERY_CHANNEL '%s': %v", channel, err)
+			}
+		}
+	}
+	if conf.GetHTTPListenAddress() != "" {
+		_, _, err := net.SplitHostPort(conf.GetHTTPListenAddress())
+		if err != nil {
+			return fmt.Errorf("HTTP_LISTEN_ADDRESS must be of the form host:port: %v", err)
+		}
+	}
+	for _, webhook := range conf.GetWebhooks() {
+		switch webhook.Type {
+		case WebhookTypeSlack, WebhookTypeGeneric:
+			if !strings.HasPrefix(webhook.Target, "https://") {
+				return fmt.Errorf("WEBHOOKS entry for %s must be an https URL, got '%s'", webhook.Type, webhook.Target)
+			}
+		case WebhookTypePagerDuty:
+			if webhook.Target == "" {
+				return fmt.Errorf("WEBHOOKS entry for pagerduty must specify a routing key")
+			}
+		default:
+			return fmt.Errorf("WEBHOOKS entries must be of the form type=target where type is one of slack, generic, "+
+				"or pagerduty. '%s' is not valid", webhook.Type)
+		}
+	}
+	if conf.getWebhooks() != "" && len(conf.GetWebhooks()) == 0 {
+		return fmt.Errorf("failed to parse WEBHOOKS='%s'", conf.getWebhooks())
+	}
+	for _, pattern := range append(conf.GetAWSSSMHosts(), conf.GetAWSInstanceConnectHosts()...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("'%s' is not a valid host pattern: %v", pattern, err)
+		}
+	}
+	defaultUsers := conf.GetDefaultSSHUsers()
+	if len(defaultUsers) != len(splitList(conf.getDefaultSSHUsers())) {
+		return fmt.Errorf("DEFAULT_SSH_USERS entries must be of the form hostpattern=user, '%s' is not valid", conf.getDefaultSSHUsers())
+	}
+	for _, entry := range defaultUsers {
+		if _, err := path.Match(entry.HostPattern, ""); err != nil {
+			return fmt.Errorf("'%s' is not a valid host pattern: %v", entry.HostPattern, err)
+		}
+		if !shared.IsValidUnixUsername(entry.User) {
+			return fmt.Errorf("DEFAULT_SSH_USERS contains the invalid user '%s'", entry.User)
+		}
+	}
+	for _, mirror := range conf.GetConfigMirrors() {
+		if strings.HasPrefix(mirror, "s3://") {
+			if strings.TrimPrefix(mirror, "s3://") == "" || strings.HasPrefix(mirror, "s3:///") {
+				return fmt.Errorf("CONFIG_MIRRORS contains an S3 location without a bucket: '%s'", mirror)
+			}
+		} else if !strings.HasPrefix(mirror, "/keybase/") {
+			return fmt.Errorf("CONFIG_MIRRORS entries must be KBFS folders (/keybase/...) or S3 locations (s3://bucket/prefix), '%s' is not valid", mirror)
+		}
+	}
+	if endpoint := conf.GetKsshMetricsEndpoint(); endpoint != "" {
+		parsed, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("failed to parse KSSH_METRICS_ENDPOINT: %v", err)
+		}
+		if !(parsed.Scheme == "statsd" && parsed.Port() != "" || parsed.Scheme == "http" || parsed.Scheme == "https") || parsed.Hostname() == "" {
+			return fmt.Errorf("KSSH_METRICS_ENDPOINT must be statsd://host:port or an http(s) URL of an OTLP collector, '%s' is not valid", endpoint)
+		}
+	}
+	preConnectHooks := conf.GetPreConnectHooks()
+	if len(preConnectHooks) != len(splitList(conf.getPreConnectHooks())) {
+		return fmt.Errorf("PRE_CONNECT_HOOKS entries must be of the form hostpattern=provider:target, '%s' is not valid", conf.getPreConnectHooks())
+	}
+	for _, hook := range preConnectHooks {
+		if _, err := path.Match(hook.HostPattern, ""); err != nil {
+			return fmt.Errorf("'%s' is not a valid host pattern: %v", hook.HostPattern, err)
+		}
+		switch hook.Provider {
+		case "http":
+			parsed, err := url.Parse(hook.Target)
+			if err != nil || !(parsed.Scheme == "http" || parsed.Scheme == "https") || parsed.Hostname() == "" {
+				return fmt.Errorf("PRE_CONNECT_HOOKS http hooks require an http(s) URL, '%s' is not valid", hook.Target)
+			}
+		case "aws-security-group":
+			if !securityGroupIDRegex.MatchString(hook.Target) {
+				return fmt.Errorf("PRE_CONNECT_HOOKS aws-security-group hooks require a security group ID (sg-...), '%s' is not valid", hook.Target)
+			}
+		default:
+			return fmt.Errorf("PRE_CONNECT_HOOKS providers must be http or aws-security-group, '%s' is not valid", hook.Provider)
+		}
+	}
+	if conf.GetAWSRegion() != "" && !awsRegionRegex.MatchString(conf.GetAWSRegion()) {
+		return fmt.Errorf("AWS_REGION must be an AWS region name (eg us-west-2), '%s' is not valid", conf.GetAWSRegion())
+	}
+	featureFlags := conf.GetKsshFeatureFlags()
+	if len(featureFlags) != len(splitList(conf.getKsshFeatureFlags())) {
+		return fmt.Errorf("KSSH_FEATURE_FLAGS entries must be of the form feature=percent or team=feature=percent with a percentage between 0 and 100, '%s' is not valid", conf.getKsshFeatureFlags())
+	}
+	for _, flag := range featureFlags {
+		if flag.Team != "" {
+			err := shared.ValidateTeamPattern(flag.Team)
+			if err != nil {
+				return err
+			}
+		}
+		known := false
+		for _, feature := range shared.KnownFeatures {
+			known = known || flag.Name == feature
+		}
+		if !known {
+			return fmt.Errorf("KSSH_FEATURE_FLAGS features must be one of %s, '%s' is not valid", strings.Join(shared.KnownFeatures, ", "), flag.Name)
+		}
+	}
+	switch conf.GetRSASignatureAlgorithm() {
+	case shared.SigAlgoRSASHA512, shared.SigAlgoRSASHA256:
+	case shared.SigAlgoRSA:
+		if !conf.GetAllowSSHRSASignatures() {
+			return fmt.Errorf("RSA_SIGNATURE_ALGORITHM=ssh-rsa requires ALLOW_SSH_RSA_SIGNATURES=true")
+		}
+	default:
+		return fmt.Errorf("RSA_SIGNATURE_ALGORITHM must be one of rsa-sha2-512, rsa-sha2-256, or ssh-rsa, '%s' is not valid", conf.GetRSASignatureAlgorithm())
+	}
+	if conf.getAllowSSHRSASignatures() != "" {
+		if conf.getAllowSSHRSASignatures() != "true" && conf.getAllowSSHRSASignatures() != "false" {
+			return fmt.Errorf("ALLOW_SSH_RSA_SIGNATURES must be either 'true' or 'false', '%s' is not valid", conf.getAllowSSHRSASignatures())
+		}
+		if conf.GetAllowSSHRSASignatures() && shared.FIPSMode {
+			return fmt.Errorf("ALLOW_SSH_RSA_SIGNATURES=true is not allowed in FIPS mode since ssh-rsa signatures use SHA-1")
+		}
+	}
+	if store := conf.GetIssuanceStore(); store != "" {
+		if !(strings.HasPrefix(store, "sqlite:") && len(store) > len("sqlite:")) && !strings.HasPrefix(store, "postgres://") && !strings.HasPrefix(store, "postgresql://") {
+			return fmt.Errorf("ISSUANCE_STORE must be either sqlite:PATH or a postgres:// URL, '%s' is not valid", store)
+		}
+	}
+	passphraseSources := 0
+	for _, source := range []string{conf.GetCAKeyPassphrase(), conf.GetCAKeyPassphraseFile(), conf.GetCAKeyPassphraseCommand()} {
+		if source != "" {
+			passphraseSources++
+		}
+	}
+	if passphraseSources > 1 {
+		return fmt.Errorf("at most one of CA_KEY_PASSPHRASE, CA_KEY_PASSPHRASE_FILE, and CA_KEY_PASSPHRASE_COMMAND may be set")
+	}
+	if conf.getLockdownLocation() != "" && !offline {
+		err := validatePath(conf.GetLockdownLocation())
+		if err != nil {
+			return fmt.Errorf("LOCKDOWN_LOCATION '%s' is not a valid path: %v", conf.GetLockdownLocation(), err)
+		}
+	}
+	if conf.getCanaryLocation() != "" && !offline {
+		err := validatePath(conf.GetCanaryLocation())
+		if err != nil {
+			return fmt.Errorf("CANARY_LOCATION '%s' is not a valid path: %v", conf.GetCanaryLocation(), err)
+		}
+	}
 	if conf.GetKeybaseUsername() != "" || conf.GetKeybasePaperKey() != "" {
 		if conf.GetKeybaseUsername() == "" && conf.GetKeybasePaperKey() != "" {
-			return fmt.Errorf("you must set set a username if you set a paper key (username='%s', key='%s')", conf.GetKeybaseUsername(), conf.GetKeybasePaperKey())
+			return fmt.Errorf("you must set set a username if you set a paper key (username='%s')", conf.GetKeybaseUsername())
 		}
 		if conf.GetKeybasePaperKey() == "" && conf.GetKeybaseUsername() != "" {
-			return fmt.Errorf("you must set set a paper key if you set a username (username='%s', key='%s')", conf.GetKeybaseUsername(), conf.GetKeybasePaperKey())
+			return fmt.Errorf("you must set set a paper key if you set a username (username='%s')", conf.GetKeybaseUsername())
 		}
 		if !offline {
 			err := validateUsernamePaperkey(conf.GetKeybaseHomeDir(), conf.GetKeybaseUsername(), conf.GetKeybasePaperKey(), conf.GetKeybaseTimeout())
@@ -178,6 +789,24 @@ func (ef *EnvConfig) GetCAKeyLocation() string {
 	return shared.ExpandPathWithTilde("/mnt/keybase-ca-key")
 }
 
+// Get the passphrase used to encrypt the CA key. May be empty.
+func (ef *EnvConfig) GetCAKeyPassphrase() string {
+	return os.Getenv("CA_KEY_PASSPHRASE")
+}
+
+// Get the path to a file containing the passphrase used to encrypt the CA key. May be empty.
+func (ef *EnvConfig) GetCAKeyPassphraseFile() string {
+	if os.Getenv("CA_KEY_PASSPHRASE_FILE") != "" {
+		return shared.ExpandPathWithTilde(os.Getenv("CA_KEY_PASSPHRASE_FILE"))
+	}
+	return ""
+}
+
+// Get a shell command (eg a call to a KMS) that outputs the passphrase used to encrypt the CA key. May be empty.
+func (ef *EnvConfig) GetCAKeyPassphraseCommand() string {
+	return os.Getenv("CA_KEY_PASSPHRASE_COMMAND")
+}
+
 // Get the keybase home directory. Used if you are running a separate instance of keybase for the chatbot. May be empty.
 func (ef *EnvConfig) GetKeybaseHomeDir() string {
 	return os.Getenv("KEYBASE_HOME_DIR")
@@ -203,17 +832,10 @@ func (ef *EnvConfig) GetKeyExpiration() string {
 	return "+1h"
 }
 
-// Get the list of keybase teams configured to be used with the bot.
+// Get the list of keybase teams configured to be used with the bot. Entries may be team patterns (see
+// shared.MatchTeam) such as `acme.ssh.*`.
 func (ef *EnvConfig) GetTeams() []string {
-	split := strings.Split(os.Getenv("TEAMS"), ",")
-	var teams []string
-	for _, item := range split {
-		trimmed := strings.TrimSpace(item)
-		if trimmed != "" {
-			teams = append(teams, trimmed)
-		}
-	}
-	return teams
+	return splitList(os.Getenv("TEAMS"))
 }
 
 // Get the location for the bot's audit logs. May be empty.
@@ -260,6 +882,12 @@ func (ef *EnvConfig) GetChannelName() string {
 	return channel
 }
 
+// Get the channel (within each configured team) that signing traffic is restricted to. Unlike CHAT_CHANNEL, requests
+// are still sent in the team that granted access. May be empty.
+func (ef *EnvConfig) GetSigningChannel() string {
+	return strings.TrimPrefix(strings.TrimSpace(os.Getenv("SIGNING_CHANNEL")), "#")
+}
+
 // Get the announcement string used when the bot is started up. May be empty.
 func (ef *EnvConfig) GetAnnouncement() string {
 	return os.Getenv("ANNOUNCEMENT")
@@ -283,12 +911,1019 @@ func (ef *EnvConfig) GetKeybaseTimeout() time.Duration {
 	return time.Duration(timeoutInt) * time.Second
 }
 
-// Dump this EnvConfig to a string for debugging purposes
-func (ef *EnvConfig) DebugString() string {
-	return fmt.Sprintf("CAKeyLocation='%s'; KeybaseHomeDir='%s'; KeybasePaperKey='%s'; KeybaseUsername='%s'; "+
-		"KeyExpiration='%s'; Teams='%s'; ChatTeam='%s'; ChannelName='%s'; LogLocation='%s'; StrictLogging='%s'",
-		ef.GetCAKeyLocation(), ef.GetKeybaseHomeDir(), ef.GetKeybasePaperKey(), ef.GetKeybaseUsername(),
-		ef.GetKeyExpiration(), ef.GetTeams(), ef.GetChatTeam(), ef.GetChannelName(), ef.GetLogLocation(), ef.getStrictLogging())
+// Get the address (host:port) to serve the optional HTTP health endpoint on. May be empty. Note that the endpoint
+// is also served if keybaseca is started via systemd socket activation.
+func (ef *EnvConfig) GetHTTPListenAddress() string {
+	return os.Getenv("HTTP_LISTEN_ADDRESS")
+}
+
+func (ef *EnvConfig) getWebhooks() string {
+	return os.Getenv("WEBHOOKS")
+}
+
+// Get the list of webhooks to notify about events. Entries that are not of the form type=target are skipped (and
+// cause config validation to fail). May be empty.
+func (ef *EnvConfig) GetWebhooks() []Webhook {
+	var webhooks []Webhook
+	for _, item := range splitList(ef.getWebhooks()) {
+		split := strings.SplitN(item, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		webhooks = append(webhooks, Webhook{Type: strings.TrimSpace(split[0]), Target: strings.TrimSpace(split[1])})
+	}
+	return webhooks
+}
+
+// Get the secret used to sign webhook payloads with HMAC-SHA256. May be empty.
+func (ef *EnvConfig) GetWebhookSecret() string {
+	return os.Getenv("WEBHOOK_SECRET")
+}
+
+// Get the list of teams where issuing a certificate triggers a webhook. May be empty.
+func (ef *EnvConfig) GetSensitiveTeams() []string {
+	return splitList(os.Getenv("SENSITIVE_TEAMS"))
+}
+
+// Get the list of host patterns that kssh should reach via AWS SSM Session Manager. May be empty.
+func (ef *EnvConfig) GetAWSSSMHosts() []string {
+	return splitList(os.Getenv("AWS_SSM_HOSTS"))
+}
+
+// Get the list of host patterns that kssh should reach via an EC2 Instance Connect Endpoint. May be empty.
+func (ef *EnvConfig) GetAWSInstanceConnectHosts() []string {
+	return splitList(os.Getenv("AWS_EC2_INSTANCE_CONNECT_HOSTS"))
+}
+
+func (ef *EnvConfig) getDefaultSSHUsers() string {
+	return os.Getenv("DEFAULT_SSH_USERS")
+}
+
+// Get the remote users that kssh uses by default for hosts matching each host pattern. Malformed entries are skipped.
+func (ef *EnvConfig) GetDefaultSSHUsers() []HostUser {
+	var entries []HostUser
+	for _, item := range splitList(ef.getDefaultSSHUsers()) {
+		split := strings.SplitN(item, "=", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			continue
+		}
+		entries = append(entries, HostUser{HostPattern: strings.TrimSpace(split[0]), User: strings.TrimSpace(split[1])})
+	}
+	return entries
+}
+
+// Get the additional locations (KBFS folders or S3 locations) that kssh configs and the CA public key are published to.
+// May be empty.
+func (ef *EnvConfig) GetConfigMirrors() []string {
+	return splitList(os.Getenv("CONFIG_MIRRORS"))
+}
+
+// Get the endpoint (statsd://host:port or the URL of an OTLP collector) that kssh sends anonymous usage and latency
+// metrics to. Empty if kssh should not send metrics.
+func (ef *EnvConfig) GetKsshMetricsEndpoint() string {
+	return os.Getenv("KSSH_METRICS_ENDPOINT")
+}
+
+func (ef *EnvConfig) getPreConnectHooks() string {
+	return os.Getenv("PRE_CONNECT_HOOKS")
+}
+
+// Get the hooks that kssh runs to open the firewall before connecting to hosts matching each host pattern. Malformed
+// entries are skipped.
+func (ef *EnvConfig) GetPreConnectHooks() []PreConnectHook {
+	var hooks []PreConnectHook
+	for _, item := range splitList(ef.getPreConnectHooks()) {
+		split := strings.SplitN(item, "=", 2)
+		if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+			continue
+		}
+		target := strings.SplitN(strings.TrimSpace(split[1]), ":", 2)
+		if len(target) != 2 {
+			continue
+		}
+		hooks = append(hooks, PreConnectHook{HostPattern: strings.TrimSpace(split[0]), Provider: target[0], Target: target[1]})
+	}
+	return hooks
+}
+
+// Security group rules added by kssh are pruned by later kssh runs rather than on a timer, so keep them short-lived
+const maxPreConnectDuration = 24 * 60 * 60
+
+const defaultPreConnectDuration = 10 * time.Minute
+
+// AWS security group IDs and region names (kssh checks them again, see kssh.RunPreConnectHooks)
+var (
+	securityGroupIDRegex = regexp.MustCompile(`^sg-[0-9a-f]+$`)
+	awsRegionRegex       = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+)
+
+func (ef *EnvConfig) getPreConnectDuration() string {
+	return os.Getenv("PRE_CONNECT_DURATION")
+}
+
+// Get how long the pre-connect hooks should open the firewall for. Defaults to 10 minutes.
+func (ef *EnvConfig) GetPreConnectDuration() time.Duration {
+	if ef.getPreConnectDuration() == "" {
+		return defaultPreConnectDuration
+	}
+	duration, err := strconv.Atoi(ef.getPreConnectDuration())
+	if err != nil {
+		panic("Failed to parse PRE_CONNECT_DURATION! This should never happen due to config validation...")
+	}
+	return time.Duration(duration) * time.Second
+}
+
+func (ef *EnvConfig) getKsshFeatureFlags() string {
+	return os.Getenv("KSSH_FEATURE_FLAGS")
+}
+
+// Get the kssh behaviors that are being rolled out to a percentage of users, in order. Malformed entries (including
+// percentages outside of 0-100) are skipped.
+func (ef *EnvConfig) GetKsshFeatureFlags() []FeatureFlag {
+	var flags []FeatureFlag
+	for _, item := range splitList(ef.getKsshFeatureFlags()) {
+		split := strings.Split(item, "=")
+		if len(split) < 2 || len(split) > 3 {
+			continue
+		}
+		percent, err := strconv.Atoi(strings.TrimSpace(split[len(split)-1]))
+		if err != nil || percent < 0 || percent > 100 {
+			continue
+		}
+		flag := FeatureFlag{Name: strings.TrimSpace(split[len(split)-2]), Percent: percent}
+		if len(split) == 3 {
+			flag.Team = strings.TrimSpace(split[0])
+			if flag.Team == "" {
+				continue
+			}
+		}
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+// Get the signature algorithm used for certificates signed by an RSA CA key unless kssh requests another one. Defaults
+// to rsa-sha2-512.
+func (ef *EnvConfig) GetRSASignatureAlgorithm() string {
+	if os.Getenv("RSA_SIGNATURE_ALGORITHM") != "" {
+		return strings.ToLower(os.Getenv("RSA_SIGNATURE_ALGORITHM"))
+	}
+	return shared.SigAlgoRSASHA512
+}
+
+// Get the database that every issued certificate is recorded in. Either sqlite:PATH or a postgres:// URL. Empty if
+// certificates are only recorded in the audit log.
+func (ef *EnvConfig) GetIssuanceStore() string {
+	return os.Getenv("ISSUANCE_STORE")
+}
+
+func (ef *EnvConfig) getAllowSSHRSASignatures() string {
+	return os.Getenv("ALLOW_SSH_RSA_SIGNATURES")
+}
+
+// Get whether certificates may be signed with the deprecated SHA-1 based ssh-rsa algorithm for servers that do not
+// support anything else
+func (ef *EnvConfig) GetAllowSSHRSASignatures() bool {
+	return ef.getAllowSSHRSASignatures() == "true"
+}
+
+// Get the AWS region that kssh should use when tunneling to AWS hosts. May be empty.
+func (ef *EnvConfig) GetAWSRegion() string {
+	return os.Getenv("AWS_REGION")
+}
+
+// Get the list of Keybase users allowed to run admin chat commands (eg `lockdown on`). May be empty.
+func (ef *EnvConfig) GetAdmins() []string {
+	return splitList(os.Getenv("ADMINS"))
+}
+
+// Get the list of Keybase users who are still issued certificates while the CA is in lockdown. May be empty.
+func (ef *EnvConfig) GetBreakGlassUsers() []string {
+	return splitList(os.Getenv("BREAK_GLASS_USERS"))
+}
+
+func (ef *EnvConfig) getLockdownLocation() string {
+	return os.Getenv("LOCKDOWN_LOCATION")
+}
+
+// Get the location of the file that records whether the CA is in lockdown. Defaults to a file next to the CA key.
+func (ef *EnvConfig) GetLockdownLocation() string {
+	if ef.getLockdownLocation() != "" {
+		return shared.ExpandPathWithTilde(ef.getLockdownLocation())
+	}
+	return ef.GetCAKeyLocation() + ".lockdown"
+}
+
+func (ef *EnvConfig) getCanaryLocation() string {
+	return os.Getenv("CANARY_LOCATION")
+}
+
+// Get the location of the file that lists the canary certificates issued via `keybaseca canary issue`. Defaults to a
+// file next to the CA key.
+func (ef *EnvConfig) GetCanaryLocation() string {
+	if ef.getCanaryLocation() != "" {
+		return shared.ExpandPathWithTilde(ef.getCanaryLocation())
+	}
+	return ef.GetCAKeyLocation() + ".canaries"
+}
+
+func (ef *EnvConfig) getNotifyUsers() string {
+	return strings.ToLower(os.Getenv("NOTIFY_USERS"))
+}
+
+// Get whether users are sent a Keybase message about every certificate issued in their name
+func (ef *EnvConfig) GetNotifyUsers() bool {
+	return ef.getNotifyUsers() == "true"
+}
+
+// Get the team.subteam#channel that a summary of every issued certificate is posted to. May be empty.
+func (ef *EnvConfig) getSecurityChannel() string {
+	return os.Getenv("SECURITY_CHANNEL")
+}
+
+// Get the team of the security channel. May be empty.
+func (ef *EnvConfig) GetSecurityTeam() string {
+	if ef.getSecurityChannel() == "" {
+		return ""
+	}
+	team, _, err := splitTeamChannel(ef.getSecurityChannel())
+	if err != nil {
+		panic("Failed to retrieve security team! This should never happen due to config validation...")
+	}
+	return team
+}
+
+// Get the name of the security channel. May be empty.
+func (ef *EnvConfig) GetSecurityChannelName() string {
+	if ef.getSecurityChannel() == "" {
+		return ""
+	}
+	_, channel, err := splitTeamChannel(ef.getSecurityChannel())
+	if err != nil {
+		panic("Failed to retrieve security channel name! This should never happen due to config validation...")
+	}
+	return channel
+}
+
+// Get the team.subteam#channel that the bot answers config requests from kssh in (see `kssh --set-discovery-channel`).
+// May be empty.
+func (ef *EnvConfig) getDiscoveryChannel() string {
+	return os.Getenv("DISCOVERY_CHANNEL")
+}
+
+// Get the team of the discovery channel. May be empty.
+func (ef *EnvConfig) GetDiscoveryTeam() string {
+	if ef.getDiscoveryChannel() == "" {
+		return ""
+	}
+	team, _, err := splitTeamChannel(ef.getDiscoveryChannel())
+	if err != nil {
+		panic("Failed to retrieve discovery team! This should never happen due to config validation...")
+	}
+	return team
+}
+
+// Get the name of the discovery channel. May be empty.
+func (ef *EnvConfig) GetDiscoveryChannelName() string {
+	if ef.getDiscoveryChannel() == "" {
+		return ""
+	}
+	_, channel, err := splitTeamChannel(ef.getDiscoveryChannel())
+	if err != nil {
+		panic("Failed to retrieve discovery channel name! This should never happen due to config validation...")
+	}
+	return channel
+}
+
+// Heartbeats are written to KBFS so don't write them too often
+const minHeartbeatInterval = 10
+
+const defaultHeartbeatInterval = time.Minute
+
+func (ef *EnvConfig) getHeartbeatInterval() string {
+	return os.Getenv("HEARTBEAT_INTERVAL")
+}
+
+// Get how often the bot writes a heartbeat for kssh to check (see shared.Heartbeat). Zero if heartbeats are disabled.
+func (ef *EnvConfig) GetHeartbeatInterval() time.Duration {
+	if ef.getHeartbeatInterval() == "" {
+		return defaultHeartbeatInterval
+	}
+	interval, err := strconv.Atoi(ef.getHeartbeatInterval())
+	if err != nil {
+		panic("Failed to parse HEARTBEAT_INTERVAL! This should never happen due to config validation...")
+	}
+	return time.Duration(interval) * time.Second
+}
+
+func (ef *EnvConfig) getChaos() string {
+	return os.Getenv("CHAOS")
+}
+
+// Get the faults to inject into the kssh protocol. nil unless chaos mode is enabled, which is only meant for testing.
+func (ef *EnvConfig) GetChaos() *chaos.Settings {
+	if ef.getChaos() == "" {
+		return nil
+	}
+	settings, err := chaos.Parse(ef.getChaos())
+	if err != nil {
+		panic("Failed to parse CHAOS! This should never happen due to config validation...")
+	}
+	return &settings
+}
+
+// Protocol messages must be kept for long enough for kssh to read the response
+const minProtocolMessageRetention = 60
+
+func (ef *EnvConfig) getProtocolMessageRetention() string {
+	return os.Getenv("PROTOCOL_MESSAGE_RETENTION")
+}
+
+// Get how long protocol messages (signature requests and responses, acks, and pings) are kept in chat before they are
+// deleted. Zero if they are never deleted.
+func (ef *EnvConfig) GetProtocolMessageRetention() time.Duration {
+	if ef.getProtocolMessageRetention() == "" {
+		return 0
+	}
+	retention, err := strconv.Atoi(ef.getProtocolMessageRetention())
+	if err != nil {
+		panic("Failed to parse PROTOCOL_MESSAGE_RETENTION! This should never happen due to config validation...")
+	}
+	return time.Duration(retention) * time.Second
+}
+
+func (ef *EnvConfig) getAuditRetentionDays() string {
+	return os.Getenv("AUDIT_RETENTION_DAYS")
+}
+
+// Get how long entries in the audit log and the issuance store are kept before they are purged. Zero if they are kept
+// forever.
+func (ef *EnvConfig) GetAuditRetention() time.Duration {
+	if ef.getAuditRetentionDays() == "" {
+		return 0
+	}
+	days, err := strconv.Atoi(ef.getAuditRetentionDays())
+	if err != nil {
+		panic("Failed to parse AUDIT_RETENTION_DAYS! This should never happen due to config validation...")
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// The default lifetime of exploding protocol messages. Long enough for kssh to read the response even if the bot is
+// slow to respond.
+const defaultExplodingMessageLifetime = 5 * time.Minute
+
+func (ef *EnvConfig) getExplodingMessageLifetime() string {
+	return os.Getenv("EXPLODING_MESSAGE_LIFETIME")
+}
+
+// Get the lifetime of the exploding messages used for the kssh protocol. Zero if protocol messages should be sent as
+// regular messages.
+func (ef *EnvConfig) GetExplodingMessageLifetime() time.Duration {
+	if ef.getExplodingMessageLifetime() == "" {
+		return defaultExplodingMessageLifetime
+	}
+	lifetime, err := strconv.Atoi(ef.getExplodingMessageLifetime())
+	if err != nil {
+		panic("Failed to parse EXPLODING_MESSAGE_LIFETIME! This should never happen due to config validation...")
+	}
+	return time.Duration(lifetime) * time.Second
+}
+
+func (ef *EnvConfig) getRequestMaxSkew() string {
+	return os.Getenv("REQUEST_MAX_SKEW")
+}
+
+// Get how far the timestamp of a signature request may be from the CA's clock before it is rejected as stale.
+// Defaults to 5 minutes.
+func (ef *EnvConfig) GetRequestMaxSkew() time.Duration {
+	if ef.getRequestMaxSkew() == "" {
+		return 5 * time.Minute
+	}
+	skew, err := strconv.Atoi(ef.getRequestMaxSkew())
+	if err != nil {
+		panic("Found non-int in the request max skew field! This should never happen due to config validation...")
+	}
+	return time.Duration(skew) * time.Second
+}
+
+func (ef *EnvConfig) getRequireRequestNonce() string {
+	return strings.ToLower(os.Getenv("REQUIRE_REQUEST_NONCE"))
+}
+
+// Get whether signature requests without a nonce and timestamp (ie from old versions of kssh) are rejected
+func (ef *EnvConfig) GetRequireRequestNonce() bool {
+	return ef.getRequireRequestNonce() == "true"
+}
+
+func (ef *EnvConfig) getDualControl() string {
+	return strings.ToLower(os.Getenv("DUAL_CONTROL"))
+}
+
+// Get whether destructive operations (replacing the CA key, purging audit data, and lifting a lockdown) must be
+// approved by two different ADMINS in Keybase chat
+func (ef *EnvConfig) GetDualControl() bool {
+	return ef.getDualControl() == "true"
+}
+
+// Get the issuer URL of the OpenID Connect provider that users must log in to before a certificate is issued. Step-up
+// authentication is disabled if this is empty.
+func (ef *EnvConfig) GetOIDCIssuer() string {
+	return os.Getenv("OIDC_ISSUER")
+}
+
+// Get the client ID registered with the OpenID Connect provider
+func (ef *EnvConfig) GetOIDCClientID() string {
+	return os.Getenv("OIDC_CLIENT_ID")
+}
+
+// Get the client secret registered with the OpenID Connect provider. Empty for public clients.
+func (ef *EnvConfig) GetOIDCClientSecret() string {
+	return os.Getenv("OIDC_CLIENT_SECRET")
+}
+
+// Get the ID token claim that is mapped to the Keybase username. Defaults to preferred_username.
+func (ef *EnvConfig) GetOIDCUsernameClaim() string {
+	if os.Getenv("OIDC_USERNAME_CLAIM") == "" {
+		return "preferred_username"
+	}
+	return os.Getenv("OIDC_USERNAME_CLAIM")
+}
+
+// Get the authentication methods (values of the amr claim) of which at least one must have been used to log in to
+// the OpenID Connect provider. Defaults to mfa.
+func (ef *EnvConfig) GetOIDCRequiredAMR() []string {
+	if os.Getenv("OIDC_REQUIRED_AMR") == "" {
+		return []string{"mfa"}
+	}
+	return splitList(os.Getenv("OIDC_REQUIRED_AMR"))
+}
+
+// Get the hostname of the Duo Auth API. Push approval is disabled if this is empty.
+func (ef *EnvConfig) GetDuoAPIHost() string {
+	return os.Getenv("DUO_API_HOST")
+}
+
+// Get the integration key of the Duo Auth API application
+func (ef *EnvConfig) GetDuoIntegrationKey() string {
+	return os.Getenv("DUO_INTEGRATION_KEY")
+}
+
+// Get the secret key of the Duo Auth API application
+func (ef *EnvConfig) GetDuoSecretKey() string {
+	return os.Getenv("DUO_SECRET_KEY")
+}
+
+// Get the teams (or team patterns) that require a Duo push approval. If empty, every request requires approval.
+func (ef *EnvConfig) GetDuoTeams() []string {
+	return splitList(os.Getenv("DUO_TEAMS"))
+}
+
+func (ef *EnvConfig) getDuoTimeout() string {
+	return os.Getenv("DUO_TIMEOUT")
+}
+
+// Get how long to wait for the user to answer a Duo push. Defaults to 60 seconds.
+func (ef *EnvConfig) GetDuoTimeout() time.Duration {
+	if ef.getDuoTimeout() == "" {
+		return 60 * time.Second
+	}
+	timeout, err := strconv.Atoi(ef.getDuoTimeout())
+	if err != nil {
+		panic("Found non-int in the Duo timeout field! This should never happen due to config validation...")
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+func (ef *EnvConfig) getElevatedPrincipals() string {
+	return os.Getenv("ELEVATED_PRINCIPALS")
+}
+
+// Get the additional principals that are granted to elevated certificates
+func (ef *EnvConfig) GetElevatedPrincipals() []ElevatedPrincipal {
+	var elevated []ElevatedPrincipal
+	for _, item := range splitList(ef.getElevatedPrincipals()) {
+		split := strings.SplitN(item, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		elevated = append(elevated, ElevatedPrincipal{Team: strings.TrimSpace(split[0]), Principal: strings.TrimSpace(split[1])})
+	}
+	return elevated
+}
+
+// Get the expiration period for elevated certificates. Defaults to 15 minutes.
+func (ef *EnvConfig) GetElevatedKeyExpiration() string {
+	if os.Getenv("ELEVATED_KEY_EXPIRATION") != "" {
+		return os.Getenv("ELEVATED_KEY_EXPIRATION")
+	}
+	return "+15m"
+}
+
+func (ef *EnvConfig) getSudoExtension() string {
+	return strings.ToLower(os.Getenv("SUDO_EXTENSION"))
+}
+
+// Get whether elevated certificates include the extension that permits sudo via keybaseca-sudo-verify
+func (ef *EnvConfig) GetSudoExtension() bool {
+	return ef.getSudoExtension() == "true"
+}
+
+func (ef *EnvConfig) getTeamAllowedUsers() string {
+	return os.Getenv("TEAM_ALLOWED_USERS")
+}
+
+// Get the users that are allowed to receive certificates for each team. Teams without any entries are not restricted.
+func (ef *EnvConfig) GetTeamAllowedUsers() []TeamUser {
+	return parseTeamUsers(ef.getTeamAllowedUsers())
+}
+
+func (ef *EnvConfig) getTeamDeniedUsers() string {
+	return os.Getenv("TEAM_DENIED_USERS")
+}
+
+// Get the users that may not receive certificates for each team even though they are members of it
+func (ef *EnvConfig) GetTeamDeniedUsers() []TeamUser {
+	return parseTeamUsers(ef.getTeamDeniedUsers())
+}
+
+func (ef *EnvConfig) getAllowedExtensions() string {
+	return os.Getenv("ALLOWED_EXTENSIONS")
+}
+
+// Get the custom certificate extensions that kssh users may request
+func (ef *EnvConfig) GetAllowedExtensions() []AllowedExtension {
+	var allowed []AllowedExtension
+	for _, item := range splitList(ef.getAllowedExtensions()) {
+		split := strings.SplitN(item, "=", 3)
+		if len(split) < 2 || strings.TrimSpace(split[1]) == "" {
+			continue
+		}
+		entry := AllowedExtension{Team: strings.TrimSpace(split[0]), Name: strings.TrimSpace(split[1])}
+		if len(split) == 3 {
+			entry.Value = strings.TrimSpace(split[2])
+		}
+		allowed = append(allowed, entry)
+	}
+	return allowed
+}
+
+// Parse a comma separated list of team=username entries. Malformed entries are skipped.
+func parseTeamUsers(list string) []TeamUser {
+	var entries []TeamUser
+	for _, item := range splitList(list) {
+		split := strings.SplitN(item, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		entries = append(entries, TeamUser{Team: strings.TrimSpace(split[0]), Username: strings.ToLower(strings.TrimSpace(split[1]))})
+	}
+	return entries
+}
+
+// Validate the options of the external group provider
+func validateGroupProvider(conf EnvConfig) error {
+	switch conf.GetGroupProvider() {
+	case "":
+		if conf.getGroupPrincipals() != "" {
+			return fmt.Errorf("GROUP_PRINCIPALS requires GROUP_PROVIDER")
+		}
+		return nil
+	case "okta":
+		u, err := url.Parse(conf.GetOktaURL())
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("OKTA_URL must be an https URL when GROUP_PROVIDER is okta, '%s' is not valid", conf.GetOktaURL())
+		}
+		if conf.GetOktaAPIToken() == "" {
+			return fmt.Errorf("OKTA_API_TOKEN must be set when GROUP_PROVIDER is okta")
+		}
+	case "command":
+		if conf.GetGroupCommand() == "" {
+			return fmt.Errorf("GROUP_COMMAND must be set when GROUP_PROVIDER is command")
+		}
+	default:
+		return fmt.Errorf("GROUP_PROVIDER must be either 'okta' or 'command', '%s' is not valid", conf.GetGroupProvider())
+	}
+	principals := conf.GetGroupPrincipals()
+	if len(principals) == 0 || len(principals) != len(splitList(conf.getGroupPrincipals())) {
+		return fmt.Errorf("GROUP_PRINCIPALS must be a list of group=principal entries, '%s' is not valid", conf.getGroupPrincipals())
+	}
+	for _, entry := range principals {
+		if entry.Group == "" || entry.Principal == "" || strings.ContainsAny(entry.Principal, " \t,*?") {
+			return fmt.Errorf("GROUP_PRINCIPALS contains an invalid entry '%s=%s'", entry.Group, entry.Principal)
+		}
+	}
+	if !strings.Contains(conf.getGroupUsernameTemplate(), "{USERNAME}") {
+		return fmt.Errorf("GROUP_USERNAME_TEMPLATE must contain {USERNAME}, '%s' is not valid", conf.getGroupUsernameTemplate())
+	}
+	if conf.getGroupCacheTTL() != "" {
+		ttl, err := strconv.Atoi(conf.getGroupCacheTTL())
+		if err != nil || ttl < 0 {
+			return fmt.Errorf("GROUP_CACHE_TTL must be a number of seconds, '%s' is not valid", conf.getGroupCacheTTL())
+		}
+	}
+	if conf.getGroupFailureMode() != "" && conf.getGroupFailureMode() != "open" && conf.getGroupFailureMode() != "closed" {
+		return fmt.Errorf("GROUP_FAILURE_MODE must be either 'open' or 'closed', '%s' is not valid", conf.getGroupFailureMode())
+	}
+	return nil
+}
+
+// Validate the options used to map Keybase usernames to unix usernames
+func validateUsernameMapping(conf EnvConfig) error {
+	for _, team := range conf.GetUsernamePrincipalTeams() {
+		err := shared.ValidateTeamPattern(team)
+		if err != nil {
+			return err
+		}
+	}
+	mappings := conf.GetUsernameMap()
+	if len(mappings) != len(splitList(conf.getUsernameMap())) {
+		return fmt.Errorf("USERNAME_MAP entries must be of the form username=unixusername or team:username=unixusername, '%s' is not valid", conf.getUsernameMap())
+	}
+	for _, mapping := range mappings {
+		if mapping.Team != "" {
+			err := shared.ValidateTeamPattern(mapping.Team)
+			if err != nil {
+				return err
+			}
+		}
+		if !shared.IsValidUnixUsername(mapping.UnixUsername) {
+			return fmt.Errorf("USERNAME_MAP contains the invalid unix username '%s'", mapping.UnixUsername)
+		}
+	}
+	if conf.getUsernameRegex() != "" {
+		if _, err := regexp.Compile(conf.getUsernameRegex()); err != nil {
+			return fmt.Errorf("USERNAME_REGEX is not a valid regular expression: %v", err)
+		}
+		if conf.GetUsernameReplacement() == "" {
+			return fmt.Errorf("USERNAME_REPLACEMENT must be set when USERNAME_REGEX is set")
+		}
+	} else if conf.GetUsernameReplacement() != "" {
+		return fmt.Errorf("USERNAME_REPLACEMENT requires USERNAME_REGEX")
+	}
+	return nil
+}
+
+func (ef *EnvConfig) getUsernamePrincipalTeams() string {
+	return os.Getenv("USERNAME_PRINCIPAL_TEAMS")
+}
+
+// Get the teams (or team patterns) whose members also receive their unix username as a principal. The unix username
+// is the Keybase username unless it is mapped by USERNAME_MAP, USERNAME_COMMAND, or USERNAME_REGEX.
+func (ef *EnvConfig) GetUsernamePrincipalTeams() []string {
+	return splitList(ef.getUsernamePrincipalTeams())
+}
+
+func (ef *EnvConfig) getUsernameMap() string {
+	return os.Getenv("USERNAME_MAP")
+}
+
+// Get the static mappings from Keybase usernames to unix usernames. Malformed entries are skipped.
+func (ef *EnvConfig) GetUsernameMap() []UsernameMapping {
+	var mappings []UsernameMapping
+	for _, item := range splitList(ef.getUsernameMap()) {
+		split := strings.SplitN(item, "=", 2)
+		if len(split) != 2 {
+			continue
+		}
+		mapping := UsernameMapping{Username: strings.TrimSpace(split[0]), UnixUsername: strings.TrimSpace(split[1])}
+		if i := strings.Index(mapping.Username, ":"); i >= 0 {
+			mapping.Team = mapping.Username[:i]
+			mapping.Username = mapping.Username[i+1:]
+		}
+		mapping.Username = strings.ToLower(mapping.Username)
+		if mapping.Username == "" {
+			continue
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+func (ef *EnvConfig) getUsernameRegex() string {
+	return os.Getenv("USERNAME_REGEX")
+}
+
+// Get the regular expression used to transform Keybase usernames into unix usernames (see USERNAME_REPLACEMENT) or
+// nil if none is configured
+func (ef *EnvConfig) GetUsernameRegex() *regexp.Regexp {
+	if ef.getUsernameRegex() == "" {
+		return nil
+	}
+	re, err := regexp.Compile(ef.getUsernameRegex())
+	if err != nil {
+		panic("Failed to parse USERNAME_REGEX! This should never happen due to config validation...")
+	}
+	return re
+}
+
+// Get the replacement for USERNAME_REGEX in the syntax of regexp.Regexp.Expand (eg `$1`)
+func (ef *EnvConfig) GetUsernameReplacement() string {
+	return os.Getenv("USERNAME_REPLACEMENT")
+}
+
+// Get the shell command used to look up the unix username of a Keybase user
+func (ef *EnvConfig) GetUsernameCommand() string {
+	return os.Getenv("USERNAME_COMMAND")
+}
+
+// Get the external group provider used to grant principals based on group membership. Either "okta", "command", or
+// empty if disabled.
+func (ef *EnvConfig) GetGroupProvider() string {
+	return strings.ToLower(os.Getenv("GROUP_PROVIDER"))
+}
+
+// Get the URL of the Okta org used when GROUP_PROVIDER is okta
+func (ef *EnvConfig) GetOktaURL() string {
+	return os.Getenv("OKTA_URL")
+}
+
+// Get the Okta API token used when GROUP_PROVIDER is okta
+func (ef *EnvConfig) GetOktaAPIToken() string {
+	return os.Getenv("OKTA_API_TOKEN")
+}
+
+// Get the shell command used to look up groups when GROUP_PROVIDER is command
+func (ef *EnvConfig) GetGroupCommand() string {
+	return os.Getenv("GROUP_COMMAND")
+}
+
+func (ef *EnvConfig) getGroupUsernameTemplate() string {
+	if os.Getenv("GROUP_USERNAME_TEMPLATE") != "" {
+		return os.Getenv("GROUP_USERNAME_TEMPLATE")
+	}
+	return "{USERNAME}"
+}
+
+// Get the name of the user with the given Keybase username in the external group provider
+func (ef *EnvConfig) GetGroupUsername(username string) string {
+	return strings.Replace(ef.getGroupUsernameTemplate(), "{USERNAME}", username, -1)
+}
+
+func (ef *EnvConfig) getGroupPrincipals() string {
+	return os.Getenv("GROUP_PRINCIPALS")
+}
+
+// Get the principals granted to the members of groups in the external group provider
+func (ef *EnvConfig) GetGroupPrincipals() []GroupPrincipal {
+	var principals []GroupPrincipal
+	for _, item := range splitList(ef.getGroupPrincipals()) {
+		// Group names may contain `=` (eg LDAP DNs) so split on the last one
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			continue
+		}
+		principals = append(principals, GroupPrincipal{Group: strings.TrimSpace(item[:i]), Principal: strings.TrimSpace(item[i+1:])})
+	}
+	return principals
+}
+
+func (ef *EnvConfig) getGroupCacheTTL() string {
+	return os.Getenv("GROUP_CACHE_TTL")
+}
+
+// Get how long the groups of a user are cached. Defaults to 5 minutes.
+func (ef *EnvConfig) GetGroupCacheTTL() time.Duration {
+	if ef.getGroupCacheTTL() == "" {
+		return 5 * time.Minute
+	}
+	ttl, err := strconv.Atoi(ef.getGroupCacheTTL())
+	if err != nil {
+		panic("Failed to parse GROUP_CACHE_TTL! This should never happen due to config validation...")
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+func (ef *EnvConfig) getGroupFailureMode() string {
+	return strings.ToLower(os.Getenv("GROUP_FAILURE_MODE"))
+}
+
+// Get whether certificates are still issued (with the last known group principals, if any) when the group provider
+// fails. Defaults to false, in which case the request is denied.
+func (ef *EnvConfig) GetGroupFailOpen() bool {
+	return ef.getGroupFailureMode() == "open"
+}
+
+func (ef *EnvConfig) getRestrictedBot() string {
+	return strings.ToLower(os.Getenv("RESTRICTED_BOT"))
+}
+
+// Get whether the bot is a restricted bot member of its teams. Restricted bots cannot use the team KV store so kssh
+// configs are published in the bot's public KBFS folder instead.
+func (ef *EnvConfig) GetRestrictedBot() bool {
+	return ef.getRestrictedBot() == "true"
+}
+
+func (ef *EnvConfig) getMaxPrincipals() string {
+	return os.Getenv("MAX_PRINCIPALS")
+}
+
+// Get the maximum number of principals in a signed certificate. Defaults to shared.CertMaxPrincipals, the most that
+// OpenSSH accepts.
+func (ef *EnvConfig) GetMaxPrincipals() int {
+	if ef.getMaxPrincipals() == "" {
+		return shared.CertMaxPrincipals
+	}
+	max, err := strconv.Atoi(ef.getMaxPrincipals())
+	if err != nil {
+		panic("Found non-int in the max principals field! This should never happen due to config validation...")
+	}
+	return max
+}
+
+func (ef *EnvConfig) getMaxKeyIDLength() string {
+	return os.Getenv("MAX_KEY_ID_LENGTH")
+}
+
+// Get the maximum length in bytes of the key ID of a signed certificate. Defaults to 256.
+func (ef *EnvConfig) GetMaxKeyIDLength() int {
+	if ef.getMaxKeyIDLength() == "" {
+		return 256
+	}
+	max, err := strconv.Atoi(ef.getMaxKeyIDLength())
+	if err != nil {
+		panic("Found non-int in the max key ID length field! This should never happen due to config validation...")
+	}
+	return max
+}
+
+func (ef *EnvConfig) getMaxExtensionBytes() string {
+	return os.Getenv("MAX_EXTENSION_BYTES")
+}
+
+// Get the maximum combined size in bytes of the names and values of the extensions and critical options that keybaseca
+// adds to a signed certificate. Defaults to 4096.
+func (ef *EnvConfig) GetMaxExtensionBytes() int {
+	if ef.getMaxExtensionBytes() == "" {
+		return 4096
+	}
+	max, err := strconv.Atoi(ef.getMaxExtensionBytes())
+	if err != nil {
+		panic("Found non-int in the max extension bytes field! This should never happen due to config validation...")
+	}
+	return max
+}
+
+// Get the location of the certificate of the CA key issued by the offline root CA key (see `keybaseca
+// issue-intermediate`). May be empty if the CA key is not an intermediate CA key.
+func (ef *EnvConfig) GetIntermediateCertLocation() string {
+	if os.Getenv("INTERMEDIATE_CERT_LOCATION") != "" {
+		return shared.ExpandPathWithTilde(os.Getenv("INTERMEDIATE_CERT_LOCATION"))
+	}
+	return ""
+}
+
+// Get the location of this instance's share of the secret that the CA key is encrypted with when threshold signing is
+// used (see `keybaseca threshold-split`). May be empty.
+func (ef *EnvConfig) GetThresholdShareLocation() string {
+	if os.Getenv("THRESHOLD_SHARE_LOCATION") != "" {
+		return shared.ExpandPathWithTilde(os.Getenv("THRESHOLD_SHARE_LOCATION"))
+	}
+	return ""
+}
+
+// Get the teams or team patterns (see shared.MatchTeam) whose certificates are threshold signed. Certificates that do
+// not include any of these teams are signed with the CA key as usual. If empty, every certificate is threshold signed.
+func (ef *EnvConfig) GetThresholdTeams() []string {
+	return splitList(os.Getenv("THRESHOLD_TEAMS"))
+}
+
+func (ef *EnvConfig) getThresholdCAKeyLocation() string {
+	return os.Getenv("THRESHOLD_CA_KEY_LOCATION")
+}
+
+// Get the location of the CA key that is encrypted with the secret split between the instances (see `keybaseca
+// threshold-split`). This is a separate CA key when THRESHOLD_TEAMS is set and otherwise the CA key itself.
+func (ef *EnvConfig) GetThresholdCAKeyLocation() string {
+	if ef.getThresholdCAKeyLocation() != "" {
+		return shared.ExpandPathWithTilde(ef.getThresholdCAKeyLocation())
+	}
+	return ef.GetCAKeyLocation()
+}
+
+// Get the Keybase usernames of the other keybaseca instances that hold threshold shares
+func (ef *EnvConfig) GetThresholdPeers() []string {
+	return splitList(os.Getenv("THRESHOLD_PEERS"))
+}
+
+// Get the Keybase username of the keybaseca instance that answers kssh and collects threshold shares from its peers
+func (ef *EnvConfig) GetThresholdCoordinator() string {
+	return os.Getenv("THRESHOLD_COORDINATOR")
+}
+
+func (ef *EnvConfig) getThresholdTimeout() string {
+	return os.Getenv("THRESHOLD_TIMEOUT")
+}
+
+// Get how long the coordinator waits for threshold shares from its peers. Defaults to 30 seconds.
+func (ef *EnvConfig) GetThresholdTimeout() time.Duration {
+	if ef.getThresholdTimeout() == "" {
+		return 30 * time.Second
+	}
+	timeout, err := strconv.Atoi(ef.getThresholdTimeout())
+	if err != nil {
+		panic("Found non-int in the threshold timeout field! This should never happen due to config validation...")
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// Get how far before the time of signing certificates are valid from, in the format of ssh-keygen -V (eg -5m) so that
+// clients and servers whose clocks are slightly behind accept them. May be empty in which case ssh-keygen's default of
+// the start of the current minute is used.
+func (ef *EnvConfig) GetCertBackdate() string {
+	return os.Getenv("CERT_BACKDATE")
+}
+
+// Get the NTP server that the clock of the CA host is checked against at startup. May be empty in which case the
+// clock is not checked.
+func (ef *EnvConfig) GetNTPServer() string {
+	return os.Getenv("NTP_SERVER")
+}
+
+// Get the location of a JSON file that overrides the user facing messages of keybaseca and kssh (see
+// shared.DefaultMessages). May be empty.
+func (ef *EnvConfig) GetMessagesFile() string {
+	if os.Getenv("MESSAGES_FILE") != "" {
+		return shared.ExpandPathWithTilde(os.Getenv("MESSAGES_FILE"))
+	}
+	return ""
+}
+
+// Get the address of the HashiCorp Vault server that signs certificates when VAULT_SSH_ROLE is set
+func (ef *EnvConfig) GetVaultAddress() string {
+	return os.Getenv("VAULT_ADDR")
+}
+
+// Get the token that keybaseca authenticates to Vault with
+func (ef *EnvConfig) GetVaultToken() string {
+	return os.Getenv("VAULT_TOKEN")
+}
+
+// Get the Vault Enterprise namespace of the SSH secrets engine. May be empty.
+func (ef *EnvConfig) GetVaultNamespace() string {
+	return os.Getenv("VAULT_NAMESPACE")
+}
+
+// Get the path that Vault's SSH secrets engine is mounted at. Defaults to ssh-client-signer.
+func (ef *EnvConfig) GetVaultSSHMount() string {
+	if os.Getenv("VAULT_SSH_MOUNT") != "" {
+		return os.Getenv("VAULT_SSH_MOUNT")
+	}
+	return "ssh-client-signer"
+}
+
+// Get the role of Vault's SSH secrets engine that certificates are signed with. If set, Vault signs every certificate
+// rather than keybaseca signing with the CA key at CA_KEY_LOCATION. May be empty.
+func (ef *EnvConfig) GetVaultSSHRole() string {
+	return os.Getenv("VAULT_SSH_ROLE")
+}
+
+// Dump this EnvConfig to a string for debugging purposes
+func (ef *EnvConfig) DebugString() string {
+	return fmt.Sprintf("CAKeyLocation='%s'; CAKeyPassphraseSet='%t'; CAKeyPassphraseFile='%s'; "+
+		"CAKeyPassphraseCommand='%s'; KeybaseHomeDir='%s'; KeybasePaperKeySet='%t'; KeybaseUsername='%s'; "+
+		"KeyExpiration='%s'; Teams='%s'; ChatTeam='%s'; ChannelName='%s'; SigningChannel='%s'; LogLocation='%s'; StrictLogging='%s'; "+
+		"HTTPListenAddress='%s'; Webhooks='%v'; SensitiveTeams='%s'; AWSSSMHosts='%s'; AWSInstanceConnectHosts='%s'; "+
+		"AWSRegion='%s'; Admins='%s'; BreakGlassUsers='%s'; LockdownLocation='%s'; CanaryLocation='%s'; NotifyUsers='%t'; SecurityChannel='%s'; "+
+		"RequestMaxSkew='%s'; RequireRequestNonce='%t'; DualControl='%t'; ProtocolMessageRetention='%s'; ExplodingMessageLifetime='%s'; "+
+		"OIDCIssuer='%s'; OIDCClientID='%s'; OIDCClientSecretSet='%t'; OIDCUsernameClaim='%s'; OIDCRequiredAMR='%s'; "+
+		"DuoAPIHost='%s'; DuoIntegrationKey='%s'; DuoSecretKeySet='%t'; DuoTeams='%s'; DuoTimeout='%s'; "+
+		"ElevatedPrincipals='%v'; ElevatedKeyExpiration='%s'; SudoExtension='%t'; RestrictedBot='%t'; TeamAllowedUsers='%v'; TeamDeniedUsers='%v'; "+
+		"GroupProvider='%s'; OktaURL='%s'; OktaAPITokenSet='%t'; GroupCommand='%s'; GroupPrincipals='%v'; GroupCacheTTL='%s'; GroupFailOpen='%t'; "+
+		"UsernamePrincipalTeams='%v'; UsernameMap='%v'; UsernameRegex='%s'; UsernameReplacement='%s'; UsernameCommand='%s'; DefaultSSHUsers='%v'; ConfigMirrors='%v'; KsshMetricsEndpoint='%s'; PreConnectHooks='%s'; PreConnectDuration='%s'; KsshFeatureFlags='%v'; RSASignatureAlgorithm='%s'; AllowSSHRSASignatures='%t'; "+
+		"IssuanceStoreSet='%t'; AuditRetention='%s'; HeartbeatInterval='%s'; AllowedExtensions='%v'; DiscoveryChannel='%s'; "+
+		"MaxPrincipals='%d'; MaxKeyIDLength='%d'; MaxExtensionBytes='%d'; IntermediateCertLocation='%s'; "+
+		"ThresholdShareLocation='%s'; ThresholdTeams='%v'; ThresholdCAKeyLocation='%s'; ThresholdPeers='%v'; ThresholdCoordinator='%s'; ThresholdTimeout='%s'; CertBackdate='%s'; NTPServer='%s'; MessagesFile='%s'; "+
+		"VaultAddress='%s'; VaultTokenSet='%t'; VaultNamespace='%s'; VaultSSHMount='%s'; VaultSSHRole='%s'; Chaos='%s'",
+		ef.GetCAKeyLocation(), ef.GetCAKeyPassphrase() != "", ef.GetCAKeyPassphraseFile(), ef.GetCAKeyPassphraseCommand(),
+		ef.GetKeybaseHomeDir(), ef.GetKeybasePaperKey() != "", ef.GetKeybaseUsername(),
+		ef.GetKeyExpiration(), ef.GetTeams(), ef.GetChatTeam(), ef.GetChannelName(), ef.GetSigningChannel(), ef.GetLogLocation(), ef.getStrictLogging(),
+		ef.GetHTTPListenAddress(), ef.GetWebhooks(), ef.GetSensitiveTeams(), ef.GetAWSSSMHosts(), ef.GetAWSInstanceConnectHosts(),
+		ef.GetAWSRegion(), ef.GetAdmins(), ef.GetBreakGlassUsers(), ef.GetLockdownLocation(), ef.GetCanaryLocation(), ef.GetNotifyUsers(),
+		ef.getSecurityChannel(), ef.GetRequestMaxSkew(), ef.GetRequireRequestNonce(), ef.GetDualControl(), ef.GetProtocolMessageRetention(), ef.GetExplodingMessageLifetime(),
+		ef.GetOIDCIssuer(), ef.GetOIDCClientID(), ef.GetOIDCClientSecret() != "", ef.GetOIDCUsernameClaim(), ef.GetOIDCRequiredAMR(),
+		ef.GetDuoAPIHost(), ef.GetDuoIntegrationKey(), ef.GetDuoSecretKey() != "", ef.GetDuoTeams(), ef.GetDuoTimeout(),
+		ef.GetElevatedPrincipals(), ef.GetElevatedKeyExpiration(), ef.GetSudoExtension(), ef.GetRestrictedBot(),
+		ef.GetTeamAllowedUsers(), ef.GetTeamDeniedUsers(),
+		ef.GetGroupProvider(), ef.GetOktaURL(), ef.GetOktaAPIToken() != "", ef.GetGroupCommand(), ef.GetGroupPrincipals(), ef.GetGroupCacheTTL(), ef.GetGroupFailOpen(),
+		ef.GetUsernamePrincipalTeams(), ef.GetUsernameMap(), ef.getUsernameRegex(), ef.GetUsernameReplacement(), ef.GetUsernameCommand(), ef.GetDefaultSSHUsers(), ef.GetConfigMirrors(), shared.Redact(ef.GetKsshMetricsEndpoint()), shared.Redact(fmt.Sprint(ef.GetPreConnectHooks())), ef.GetPreConnectDuration(), ef.GetKsshFeatureFlags(), ef.GetRSASignatureAlgorithm(), ef.GetAllowSSHRSASignatures(),
+		ef.GetIssuanceStore() != "", ef.GetAuditRetention(), ef.GetHeartbeatInterval(), ef.GetAllowedExtensions(), ef.getDiscoveryChannel(),
+		ef.GetMaxPrincipals(), ef.GetMaxKeyIDLength(), ef.GetMaxExtensionBytes(), ef.GetIntermediateCertLocation(),
+		ef.GetThresholdShareLocation(), ef.GetThresholdTeams(), ef.GetThresholdCAKeyLocation(), ef.GetThresholdPeers(), ef.GetThresholdCoordinator(), ef.GetThresholdTimeout(),
+		ef.GetCertBackdate(), ef.GetNTPServer(), ef.GetMessagesFile(),
+		ef.GetVaultAddress(), ef.GetVaultToken() != "", ef.GetVaultNamespace(), ef.GetVaultSSHMount(), ef.GetVaultSSHRole(), ef.getChaos())
+}
+
+// Split a comma separated list into its trimmed non-empty items
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		trimmed := strings.TrimSpace(item)
+		if trimmed != "" {
+			items = append(items, trimmed)
+		}
+	}
+	return items
 }
 
 // Split a teamChannel of the form team.foo.bar#chan into "team.foo.bar", "chan"
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Matches the TEAMS line of an env file in the formats accepted by `docker run --env-file` (TEAMS=a,b), systemd's
+// EnvironmentFile (TEAMS="a,b") and shell scripts (export TEAMS='a,b')
+var teamsLineRegex = regexp.MustCompile(`^(\s*(?:export\s+)?TEAMS=)(["']?)(.*?)(["']?)\s*$`)
+
+// AddTeamToEnvFile adds team to the TEAMS variable in the given env file (eg the file passed to `docker run --env-file`
+// or a systemd EnvironmentFile), keeping the rest of the file as is. Returns false if the team was already listed.
+func AddTeamToEnvFile(filename, team string) (added bool, err error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return false, err
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	lines := strings.Split(string(contents), "\n")
+	found := false
+	for i, line := range lines {
+		match := teamsLineRegex.FindStringSubmatch(line)
+		if match == nil || match[2] != match[4] {
+			continue
+		}
+		if found {
+			return false, fmt.Errorf("%s sets TEAMS more than once", filename)
+		}
+		found = true
+		teams := splitList(match[3])
+		for _, existing := range teams {
+			if existing == team {
+				return false, nil
+			}
+		}
+		lines[i] = match[1] + match[2] + strings.Join(append(teams, team), ",") + match[4]
+	}
+	if !found {
+		if len(lines) > 0 && lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		lines = append(lines, "TEAMS="+team, "")
+	}
+	err = ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")), info.Mode().Perm())
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddTeamToEnvFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-envfile")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "env.list")
+
+	cases := []struct {
+		before string
+		after  string
+		added  bool
+	}{
+		{"CA_KEY_LOCATION=/mnt/ca\nTEAMS=team.ssh.staging\n", "CA_KEY_LOCATION=/mnt/ca\nTEAMS=team.ssh.staging,team.ssh.prod\n", true},
+		{"TEAMS=\"team.ssh.staging, team.ssh.dev\"\n", "TEAMS=\"team.ssh.staging,team.ssh.dev,team.ssh.prod\"\n", true},
+		{"export TEAMS='team.ssh.staging'", "export TEAMS='team.ssh.staging,team.ssh.prod'", true},
+		{"TEAMS=team.ssh.prod,team.ssh.staging\n", "TEAMS=team.ssh.prod,team.ssh.staging\n", false},
+		{"CA_KEY_LOCATION=/mnt/ca\n", "CA_KEY_LOCATION=/mnt/ca\nTEAMS=team.ssh.prod\n", true},
+	}
+	for _, c := range cases {
+		require.NoError(t, ioutil.WriteFile(filename, []byte(c.before), 0600))
+		added, err := AddTeamToEnvFile(filename, "team.ssh.prod")
+		require.NoError(t, err)
+		require.Equal(t, c.added, added, c.before)
+		contents, err := ioutil.ReadFile(filename)
+		require.NoError(t, err)
+		require.Equal(t, c.after, string(contents))
+		info, err := os.Stat(filename)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("TEAMS=a\nTEAMS=b\n"), 0600))
+	_, err = AddTeamToEnvFile(filename, "team.ssh.prod")
+	require.Error(t, err)
+}
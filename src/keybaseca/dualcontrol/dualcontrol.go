@@ -0,0 +1,142 @@
+package dualcontrol
+
+/*
+dualcontrol requires two different admins (see ADMINS) to approve destructive CA operations in Keybase chat when
+DUAL_CONTROL is enabled: replacing the CA key, purging audit data, and lifting a lockdown. This means that a single
+compromised or rogue admin account (or someone with a shell on the CA host) cannot destroy the CA, cover their tracks,
+or reopen the CA after an incident on their own. Every request, approval, refusal, and expiry is recorded in the audit
+log.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+)
+
+// Operation is a destructive operation that requires dual control
+type Operation string
+
+const (
+	// Overwrite the CA key via `keybaseca generate` or `keybaseca import-key` with FORCE_WRITE
+	ReplaceCAKey Operation = "replace-ca-key"
+	// Purge audit data via `keybaseca purge` or delete the audit log
+	PurgeAuditData Operation = "purge-audit-data"
+	// Turn lockdown off via chat or `keybaseca lockdown off`
+	LiftLockdown Operation = "lift-lockdown"
+)
+
+// The number of different admins who must approve an operation
+const RequiredApprovals = 2
+
+// How long admins have to approve an operation
+const ApprovalTimeout = 15 * time.Minute
+
+// Request is an operation that is waiting for approval
+type Request struct {
+	ID        string
+	Operation Operation
+	// A human readable description of exactly what will be done (eg which user's audit data will be purged)
+	Description string
+	// Who asked for the operation. A Keybase username or a local user running the CLI.
+	RequestedBy string
+	ExpiresAt   time.Time
+
+	lock      sync.Mutex
+	approvers []string
+}
+
+// IsRequired returns whether operations must be approved by two admins
+func IsRequired(conf config.Config) bool {
+	return conf.GetDualControl()
+}
+
+// NewRequest records a request for the given operation in the audit log and returns it. It still needs to be approved
+// by RequiredApprovals different admins (see Approve).
+func NewRequest(conf config.Config, operation Operation, description, requestedBy string, now time.Time) (*Request, error) {
+	var id [4]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate a request ID: %v", err)
+	}
+	request := &Request{ID: hex.EncodeToString(id[:]), Operation: operation, Description: description,
+		RequestedBy: requestedBy, ExpiresAt: now.Add(ApprovalTimeout)}
+	log.Log(conf, fmt.Sprintf("Dual control: %s requested %s (%s), request=%s", requestedBy, operation, description, request.ID))
+	return request, nil
+}
+
+// Approve records the approval of the given Keybase user and returns whether the request now has enough approvals.
+// Returns an error (which is recorded in the audit log) if the user is not an admin, has already approved the request,
+// or if the request has expired.
+func (r *Request) Approve(conf config.Config, username string, now time.Time) (approved bool, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	switch {
+	case !now.Before(r.ExpiresAt):
+		err = fmt.Errorf("the request %s has expired", r.ID)
+	case !lockdown.IsAdmin(conf, username):
+		err = fmt.Errorf("%s is not an admin", username)
+	case r.hasApproved(username):
+		err = fmt.Errorf("%s has already approved the request %s, another admin must approve it", username, r.ID)
+	}
+	if err != nil {
+		log.Log(conf, fmt.Sprintf("Dual control: refused approval of request=%s by %s: %v", r.ID, username, err))
+		return false, err
+	}
+	r.approvers = append(r.approvers, username)
+	log.Log(conf, fmt.Sprintf("Dual control: %s approved %s (%s), request=%s, approvals=%d/%d", username, r.Operation,
+		r.Description, r.ID, len(r.approvers), RequiredApprovals))
+	return len(r.approvers) >= RequiredApprovals, nil
+}
+
+// Approvers returns the admins who have approved the request so far
+func (r *Request) Approvers() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string{}, r.approvers...)
+}
+
+func (r *Request) hasApproved(username string) bool {
+	for _, approver := range r.approvers {
+		if strings.EqualFold(approver, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expire records in the audit log that the request expired without enough approvals
+func (r *Request) Expire(conf config.Config) {
+	log.Log(conf, fmt.Sprintf("Dual control: request=%s for %s (%s) expired with approvals from %v", r.ID, r.Operation,
+		r.Description, r.Approvers()))
+}
+
+// Prompt returns the chat message that asks the admins to approve the request
+func (r *Request) Prompt(botUsername string) string {
+	remaining := RequiredApprovals - len(r.Approvers())
+	return fmt.Sprintf("%s requested: %s. This requires %d more approval(s) from different admins. To approve, send "+
+		"`%s` within %s.", r.RequestedBy, r.Description, remaining, GenerateApproveCommand(r.ID, botUsername),
+		ApprovalTimeout)
+}
+
+// GenerateApproveCommand generates the chat message that approves the request with the given ID
+func GenerateApproveCommand(id, botUsername string) string {
+	return fmt.Sprintf("approve %s @%s", id, botUsername)
+}
+
+// ParseApproveCommand parses a chat message of the form `approve <id> @botUsername`. ok is false if the message is not
+// an approval for the given bot.
+func ParseApproveCommand(msg, botUsername string) (id string, ok bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || fields[0] != "approve" || fields[2] != "@"+botUsername {
+		return "", false
+	}
+	return fields[1], true
+}
@@ -0,0 +1,73 @@
+package dualcontrol
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseApproveCommand(t *testing.T) {
+	id, ok := ParseApproveCommand(GenerateApproveCommand("0a1b2c3d", "cabot"), "cabot")
+	require.True(t, ok)
+	require.Equal(t, "0a1b2c3d", id)
+	id, ok = ParseApproveCommand(" approve 0a1b2c3d @cabot\n", "cabot")
+	require.True(t, ok)
+	require.Equal(t, "0a1b2c3d", id)
+
+	_, ok = ParseApproveCommand("approve 0a1b2c3d @otherbot", "cabot")
+	require.False(t, ok)
+	_, ok = ParseApproveCommand("approve @cabot", "cabot")
+	require.False(t, ok)
+	_, ok = ParseApproveCommand("lockdown off @cabot", "cabot")
+	require.False(t, ok)
+}
+
+func TestApprove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dualcontrol")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("LOG_LOCATION", filepath.Join(dir, "audit.log"))
+	os.Setenv("ADMINS", "alice,bob")
+	defer os.Unsetenv("LOG_LOCATION")
+	defer os.Unsetenv("ADMINS")
+	conf := &config.EnvConfig{}
+
+	now := time.Now()
+	request, err := NewRequest(conf, LiftLockdown, "turn lockdown off", "alice", now)
+	require.NoError(t, err)
+	require.Regexp(t, `^[0-9a-f]{8}$`, request.ID)
+
+	// Only admins may approve and each admin only counts once
+	_, err = request.Approve(conf, "mallory", now)
+	require.Error(t, err)
+	approved, err := request.Approve(conf, "alice", now)
+	require.NoError(t, err)
+	require.False(t, approved)
+	_, err = request.Approve(conf, "ALICE", now)
+	require.Error(t, err)
+	require.Contains(t, request.Prompt("cabot"), "1 more approval")
+	approved, err = request.Approve(conf, "bob", now.Add(time.Minute))
+	require.NoError(t, err)
+	require.True(t, approved)
+	require.Equal(t, []string{"alice", "bob"}, request.Approvers())
+
+	// Approvals after the request has expired are refused
+	request, err = NewRequest(conf, PurgeAuditData, "purge expired audit data", "local user root", now)
+	require.NoError(t, err)
+	approved, err = request.Approve(conf, "alice", now)
+	require.NoError(t, err)
+	require.False(t, approved)
+	_, err = request.Approve(conf, "bob", now.Add(ApprovalTimeout))
+	require.Error(t, err)
+	request.Expire(conf)
+
+	auditLog, err := ioutil.ReadFile(conf.GetLogLocation())
+	require.NoError(t, err)
+	require.Contains(t, string(auditLog), "refused approval of request="+request.ID+" by bob")
+	require.Contains(t, string(auditLog), "request="+request.ID+" for purge-audit-data (purge expired audit data) expired")
+}
@@ -0,0 +1,178 @@
+package duo
+
+/*
+duo is a minimal client for the Duo Auth API (https://duo.com/docs/authapi). It is used by keybaseca to require users
+to approve a Duo push on their phone before a certificate is issued.
+*/
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The delay between polls of the authentication status
+const pollInterval = time.Second
+
+// Swapped out in tests so that polling does not actually sleep
+var sleep = time.Sleep
+
+// Client is a Duo Auth API client
+type Client struct {
+	// The API hostname, eg api-xxxxxxxx.duosecurity.com
+	Host           string
+	IntegrationKey string
+	SecretKey      string
+	HTTPClient     *http.Client
+}
+
+// Outcome is the result of a push
+type Outcome struct {
+	Approved bool
+	// The status message from Duo, eg "Success. Logging you in..." or "Login request denied."
+	Message string
+}
+
+type apiResponse struct {
+	Stat          string          `json:"stat"`
+	Response      json.RawMessage `json:"response"`
+	Code          int             `json:"code"`
+	Message       string          `json:"message"`
+	MessageDetail string          `json:"message_detail"`
+}
+
+type authStatus struct {
+	TxID      string `json:"txid"`
+	Result    string `json:"result"`
+	Status    string `json:"status"`
+	StatusMsg string `json:"status_msg"`
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return &http.Client{Timeout: 90 * time.Second}
+}
+
+// Push sends a push notification to the Duo user with the given username and waits up to timeout for them to approve
+// or deny it. details are shown to the user in the Duo app.
+func (c *Client) Push(username string, details map[string]string, timeout time.Duration) (Outcome, error) {
+	pushinfo := url.Values{}
+	for key, value := range details {
+		pushinfo.Set(key, value)
+	}
+	var started authStatus
+	err := c.call("POST", "/auth/v2/auth", map[string]string{
+		"username": username,
+		"factor":   "push",
+		"device":   "auto",
+		"async":    "1",
+		"type":     "SSH certificate request",
+		"pushinfo": pushinfo.Encode(),
+	}, &started)
+	if err != nil {
+		return Outcome{}, err
+	}
+	if started.TxID == "" {
+		return Outcome{}, fmt.Errorf("the Duo auth response did not include a transaction ID")
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var status authStatus
+		err = c.call("GET", "/auth/v2/auth_status", map[string]string{"txid": started.TxID}, &status)
+		if err != nil {
+			return Outcome{}, err
+		}
+		switch status.Result {
+		case "allow":
+			return Outcome{Approved: true, Message: status.StatusMsg}, nil
+		case "deny":
+			return Outcome{Approved: false, Message: status.StatusMsg}, nil
+		case "waiting":
+		default:
+			return Outcome{}, fmt.Errorf("unexpected Duo auth result '%s'", status.Result)
+		}
+		if time.Now().After(deadline) {
+			return Outcome{Approved: false, Message: "the push was not answered in time"}, nil
+		}
+		sleep(pollInterval)
+	}
+}
+
+// Make a signed request to the Duo Auth API and parse the response into result
+func (c *Client) call(method, path string, params map[string]string, result interface{}) error {
+	date := time.Now().UTC().Format(time.RFC1123Z)
+	query := canonicalParams(params)
+	endpoint := "https://" + c.Host + path
+	var req *http.Request
+	var err error
+	if method == "GET" {
+		req, err = http.NewRequest(method, endpoint+"?"+query, nil)
+	} else {
+		req, err = http.NewRequest(method, endpoint, strings.NewReader(query))
+		if req != nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Date", date)
+	req.SetBasicAuth(c.IntegrationKey, sign(c.SecretKey, date, method, c.Host, path, query))
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("Duo request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Duo request to %s failed: %v", path, err)
+	}
+	var parsed apiResponse
+	err = json.Unmarshal(body, &parsed)
+	if err != nil {
+		return fmt.Errorf("failed to parse the Duo response (HTTP %d): %v", resp.StatusCode, err)
+	}
+	if parsed.Stat != "OK" {
+		return fmt.Errorf("Duo request to %s failed: %d %s %s", path, parsed.Code, parsed.Message, parsed.MessageDetail)
+	}
+	return json.Unmarshal(parsed.Response, result)
+}
+
+// Encode the given parameters as required by Duo's request signatures: sorted by key and percent encoded with %20
+// for spaces
+func canonicalParams(params map[string]string) string {
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		parts = append(parts, escape(key)+"="+escape(params[key]))
+	}
+	return strings.Join(parts, "&")
+}
+
+func escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// Compute the signature of a request as described in https://duo.com/docs/authapi#authentication
+func sign(secretKey, date, method, host, path, query string) string {
+	canonical := strings.Join([]string{date, strings.ToUpper(method), strings.ToLower(host), path, query}, "\n")
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte(canonical))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,85 @@
+package duo
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Start a fake Duo API that reports the push as waiting for pendingPolls polls before returning result
+func startFakeDuo(t *testing.T, pendingPolls int, result string) (*httptest.Server, *Client) {
+	var client *Client
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.RawQuery
+		if r.Method == "POST" {
+			body, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			query = string(body)
+		}
+		ikey, sig, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "ikey", ikey)
+		require.Equal(t, sign("skey", r.Header.Get("Date"), r.Method, client.Host, r.URL.Path, query), sig)
+
+		switch r.URL.Path {
+		case "/auth/v2/auth":
+			form, err := url.ParseQuery(query)
+			require.NoError(t, err)
+			require.Equal(t, "alice", form.Get("username"))
+			require.Equal(t, "push", form.Get("factor"))
+			fmt.Fprint(w, `{"stat": "OK", "response": {"txid": "tx1"}}`)
+		case "/auth/v2/auth_status":
+			require.Equal(t, "tx1", r.URL.Query().Get("txid"))
+			if pendingPolls > 0 {
+				pendingPolls--
+				fmt.Fprint(w, `{"stat": "OK", "response": {"result": "waiting", "status": "pushed"}}`)
+				return
+			}
+			fmt.Fprintf(w, `{"stat": "OK", "response": {"result": "%s", "status_msg": "done"}}`, result)
+		default:
+			fmt.Fprint(w, `{"stat": "FAIL", "code": 40401, "message": "Resource not found"}`)
+		}
+	}))
+	client = &Client{
+		Host:           strings.TrimPrefix(server.URL, "https://"),
+		IntegrationKey: "ikey",
+		SecretKey:      "skey",
+		HTTPClient:     server.Client(),
+	}
+	return server, client
+}
+
+func TestPush(t *testing.T) {
+	sleep = func(time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	server, client := startFakeDuo(t, 2, "allow")
+	outcome, err := client.Push("alice", map[string]string{"principals": "team.ssh.prod"}, time.Minute)
+	server.Close()
+	require.NoError(t, err)
+	require.Equal(t, Outcome{Approved: true, Message: "done"}, outcome)
+
+	server, client = startFakeDuo(t, 0, "deny")
+	outcome, err = client.Push("alice", nil, time.Minute)
+	server.Close()
+	require.NoError(t, err)
+	require.False(t, outcome.Approved)
+
+	// A push that is never answered times out
+	server, client = startFakeDuo(t, 1000, "allow")
+	outcome, err = client.Push("alice", nil, 0)
+	server.Close()
+	require.NoError(t, err)
+	require.False(t, outcome.Approved)
+}
+
+func TestCanonicalParams(t *testing.T) {
+	require.Equal(t, "a=1&b=hello%20world&c=%257E~%2F", canonicalParams(map[string]string{"c": "%7E~/", "b": "hello world", "a": "1"}))
+}
@@ -0,0 +1,104 @@
+package events
+
+/*
+events is an in-process event bus for keybaseca. The CA publishes an Event whenever something noteworthy happens (a
+certificate is issued, a request is denied, an error occurs, etc) and integrations such as the audit log and webhooks
+subscribe to them. This means that new integrations do not need to be threaded through the signing path.
+*/
+
+import (
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Type is the type of an event
+type Type string
+
+const (
+	// A certificate was issued in response to a signature request
+	CertIssued Type = "cert_issued"
+	// A signature request was denied due to policy
+	RequestDenied Type = "request_denied"
+	// A new CA key was generated
+	CAKeyRotated Type = "ca_key_rotated"
+	// The bot encountered an error while processing a message
+	BotError Type = "bot_error"
+	// Lockdown was turned on or off
+	LockdownChanged Type = "lockdown_changed"
+	// A certificate was signed directly with the CA key via `keybaseca sign --offline`
+	OfflineCertIssued Type = "offline_cert_issued"
+	// The config was loaded and validated when the CA bot started
+	ConfigLoaded Type = "config_loaded"
+	// A server reported that someone tried to log in with a canary certificate (see the canary package)
+	CanaryTriggered Type = "canary_triggered"
+)
+
+// Event describes something that happened in keybaseca. It is also the JSON body sent to generic webhooks.
+type Event struct {
+	Type       Type      `json:"type"`
+	Timestamp  time.Time `json:"timestamp"`
+	Username   string    `json:"username,omitempty"`
+	Principals []string  `json:"principals,omitempty"`
+	KeyID      string    `json:"key_id,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	// The issued certificate in authorized_keys format for CertIssued and OfflineCertIssued. Not sent to webhooks.
+	Certificate string `json:"-"`
+	// The canonical signature request that the certificate was issued for (see shared.CanonicalizeSignatureRequest)
+	// for CertIssued. Not sent to webhooks.
+	Request string `json:"-"`
+}
+
+// Handler is called with every published event along with the config of the CA that published it
+type Handler func(conf config.Config, event Event)
+
+var (
+	lock     sync.RWMutex
+	handlers = make(map[int]Handler)
+	// Handlers are called in the order they subscribed
+	order  []int
+	nextID int
+)
+
+// Subscribe calls handler with every event published after this returns. Returns a function that unsubscribes it.
+func Subscribe(handler Handler) (unsubscribe func()) {
+	lock.Lock()
+	defer lock.Unlock()
+	id := nextID
+	nextID++
+	handlers[id] = handler
+	order = append(order, id)
+	return func() {
+		lock.Lock()
+		defer lock.Unlock()
+		delete(handlers, id)
+		for i, other := range order {
+			if other == id {
+				order = append(order[:i:i], order[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Publish calls every subscribed handler with the given event, setting its timestamp if it is not set. Handlers are
+// called synchronously in the order they subscribed so that short lived commands (eg `keybaseca lockdown`) do not
+// exit before every handler is done. Callers on the signing path should publish from a new goroutine since handlers
+// may be slow (eg sending webhooks). Secrets are removed from the message of the event (see shared.Redact).
+func Publish(conf config.Config, event Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	event.Message = shared.Redact(event.Message)
+	lock.RLock()
+	var subscribed []Handler
+	for _, id := range order {
+		subscribed = append(subscribed, handlers[id])
+	}
+	lock.RUnlock()
+	for _, handler := range subscribed {
+		handler(conf, event)
+	}
+}
@@ -0,0 +1,38 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublish(t *testing.T) {
+	var received []string
+	unsubscribeFirst := Subscribe(func(conf config.Config, event Event) {
+		require.False(t, event.Timestamp.IsZero())
+		received = append(received, "first:"+event.Username)
+	})
+	unsubscribeSecond := Subscribe(func(conf config.Config, event Event) {
+		received = append(received, "second:"+event.Username)
+	})
+	defer unsubscribeSecond()
+
+	Publish(&config.EnvConfig{}, Event{Type: CertIssued, Username: "alice"})
+	require.Equal(t, []string{"first:alice", "second:alice"}, received)
+
+	unsubscribeFirst()
+	Publish(&config.EnvConfig{}, Event{Type: RequestDenied, Username: "bob"})
+	require.Equal(t, []string{"first:alice", "second:alice", "second:bob"}, received)
+}
+
+func TestPublishRedactsMessages(t *testing.T) {
+	var received []string
+	unsubscribe := Subscribe(func(conf config.Config, event Event) {
+		received = append(received, event.Message)
+	})
+	defer unsubscribe()
+
+	Publish(&config.EnvConfig{}, Event{Type: BotError, Message: "Vault request failed: VAULT_TOKEN=s.abc is not valid"})
+	require.Equal(t, []string{"Vault request failed: VAULT_TOKEN=[REDACTED] is not valid"}, received)
+}
@@ -0,0 +1,153 @@
+package groups
+
+/*
+groups looks up the groups that a user is in with an external directory (Okta, or anything that can be queried from a
+command such as LDAP or Google Workspace) so that keybaseca can grant principals based on group membership in addition
+to Keybase team membership.
+*/
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider returns the names of the groups that the given user (as identified by the directory) is in
+type Provider interface {
+	GetGroups(user string) ([]string, error)
+}
+
+// OktaProvider looks up groups via the Okta users API
+type OktaProvider struct {
+	// The URL of the Okta org, eg https://example.okta.com
+	URL string
+	// An Okta API token with permission to read users and groups
+	APIToken   string
+	HTTPClient *http.Client
+}
+
+func (p *OktaProvider) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// Matches the URL of the next page in a Link header
+var nextLinkRegex = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="next"`)
+
+// GetGroups returns the names of the Okta groups that the user with the given login (or ID) is in
+func (p *OktaProvider) GetGroups(user string) ([]string, error) {
+	next := strings.TrimSuffix(p.URL, "/") + "/api/v1/users/" + url.PathEscape(user) + "/groups?limit=200"
+	var groups []string
+	for next != "" {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "SSWS "+p.APIToken)
+		req.Header.Set("Accept", "application/json")
+		resp, err := p.httpClient().Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query Okta: %v", err)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the response from Okta: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Okta returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		var page []struct {
+			Profile struct {
+				Name string `json:"name"`
+			} `json:"profile"`
+		}
+		err = json.Unmarshal(body, &page)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the response from Okta: %v", err)
+		}
+		for _, group := range page {
+			groups = append(groups, group.Profile.Name)
+		}
+		next = ""
+		if match := nextLinkRegex.FindStringSubmatch(resp.Header.Get("Link")); match != nil {
+			next = match[1]
+		}
+	}
+	return groups, nil
+}
+
+// CommandProvider runs a shell command to look up groups. The user is passed to the command as $1 (so that it never
+// needs to be quoted) and the command prints the name of each group on its own line. This makes it possible to use
+// any directory that has a command line client, eg ldapsearch for LDAP.
+type CommandProvider struct {
+	Command string
+}
+
+// GetGroups returns the groups printed by the command for the given user
+func (p *CommandProvider) GetGroups(user string) ([]string, error) {
+	cmd := exec.Command("sh", "-c", p.Command, "keybaseca-groups", user)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("GROUP_COMMAND failed: %v", err)
+	}
+	var groups []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if group := strings.TrimSpace(line); group != "" {
+			groups = append(groups, group)
+		}
+	}
+	return groups, nil
+}
+
+// Cache caches the groups returned by a Provider for TTL. Expired entries are kept so that callers can fall back to
+// the last known groups when the provider is unavailable.
+type Cache struct {
+	Provider Provider
+	TTL      time.Duration
+
+	lock    sync.Mutex
+	entries map[string]cacheEntry
+	// Swapped out in tests
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	groups    []string
+	fetchedAt time.Time
+}
+
+// NewCache returns a Cache for the given provider
+func NewCache(provider Provider, ttl time.Duration) *Cache {
+	return &Cache{Provider: provider, TTL: ttl, entries: make(map[string]cacheEntry), now: time.Now}
+}
+
+// GetGroups returns the groups that the given user is in, using the cached groups if they have not expired. If the
+// provider fails, the error is returned along with the last known groups of the user (or nil if there are none).
+func (c *Cache) GetGroups(user string) ([]string, error) {
+	c.lock.Lock()
+	entry, ok := c.entries[user]
+	c.lock.Unlock()
+	if ok && c.now().Sub(entry.fetchedAt) < c.TTL {
+		return entry.groups, nil
+	}
+	groups, err := c.Provider.GetGroups(user)
+	if err != nil {
+		return entry.groups, err
+	}
+	c.lock.Lock()
+	c.entries[user] = cacheEntry{groups: groups, fetchedAt: c.now()}
+	c.lock.Unlock()
+	return groups, nil
+}
@@ -0,0 +1,84 @@
+package groups
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOktaProvider(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "SSWS token" {
+			http.Error(w, `{"errorCode":"E0000011"}`, http.StatusUnauthorized)
+			return
+		}
+		require.Equal(t, "/api/v1/users/alice@example.com/groups", r.URL.Path)
+		if r.URL.Query().Get("after") == "" {
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/users/alice@example.com/groups?limit=200&after=1>; rel="next"`, server.URL))
+			fmt.Fprint(w, `[{"id":"1","profile":{"name":"Everyone"}},{"id":"2","profile":{"name":"SRE"}}]`)
+			return
+		}
+		fmt.Fprint(w, `[{"id":"3","profile":{"name":"DBAs"}}]`)
+	}))
+	defer server.Close()
+
+	provider := &OktaProvider{URL: server.URL + "/", APIToken: "token", HTTPClient: server.Client()}
+	groups, err := provider.GetGroups("alice@example.com")
+	require.NoError(t, err)
+	require.Equal(t, []string{"Everyone", "SRE", "DBAs"}, groups)
+
+	provider.APIToken = "wrong"
+	_, err = provider.GetGroups("alice@example.com")
+	require.Error(t, err)
+}
+
+func TestCommandProvider(t *testing.T) {
+	provider := &CommandProvider{Command: `test "$1" = "alice" && printf 'sre\n\n  dba  \n'`}
+	groups, err := provider.GetGroups("alice")
+	require.NoError(t, err)
+	require.Equal(t, []string{"sre", "dba"}, groups)
+
+	_, err = provider.GetGroups("bob")
+	require.Error(t, err)
+}
+
+type fakeProvider struct {
+	groups []string
+	err    error
+	calls  int
+}
+
+func (p *fakeProvider) GetGroups(user string) ([]string, error) {
+	p.calls++
+	return p.groups, p.err
+}
+
+func TestCache(t *testing.T) {
+	provider := &fakeProvider{groups: []string{"sre"}}
+	cache := NewCache(provider, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	groups, err := cache.GetGroups("alice")
+	require.NoError(t, err)
+	require.Equal(t, []string{"sre"}, groups)
+	_, _ = cache.GetGroups("alice")
+	require.Equal(t, 1, provider.calls)
+
+	// Once the entry expires the provider is queried again and its last known groups are returned if it fails
+	now = now.Add(2 * time.Minute)
+	provider.err = fmt.Errorf("directory unavailable")
+	groups, err = cache.GetGroups("alice")
+	require.Error(t, err)
+	require.Equal(t, []string{"sre"}, groups)
+	require.Equal(t, 2, provider.calls)
+
+	groups, err = cache.GetGroups("bob")
+	require.Error(t, err)
+	require.Nil(t, groups)
+}
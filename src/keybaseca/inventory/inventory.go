@@ -0,0 +1,359 @@
+package inventory
+
+// Package inventory builds the per-team hosts inventories consumed by `kssh --list-hosts` and kssh's tab-completion
+// (see shared.InventoryPath) from the instances running in a cloud provider. Instances are assigned to a team via a
+// tag whose value is the team name. The provider CLIs (aws, gcloud, and az) are used so that the usual credential
+// configuration of each of them applies.
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/keybaseca/kbfs"
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// The cloud providers that instances can be synced from
+const (
+	ProviderAWS   = "aws"
+	ProviderGCP   = "gcp"
+	ProviderAzure = "azure"
+)
+
+// The addresses that can be published for each instance
+const (
+	AddressPrivateIP = "private-ip"
+	AddressPublicIP  = "public-ip"
+	// The AWS instance ID (which works with the aws-ssm cloud tunnels) or the GCP or Azure instance name
+	AddressName = "name"
+)
+
+// The tag (or GCP metadata key, see listGCPInstances) used if none is specified
+const DefaultTag = "kssh-team"
+
+// The first line of every inventory written by Sync. Inventories that start with it are owned by Sync and are cleared
+// once a team no longer has any tagged instances. Other inventories (eg from `keybaseca publish-inventory`) are only
+// replaced if the team has tagged instances.
+const SyncHeader = "# Synced from the cloud by keybaseca inventory sync. Manual changes will be overwritten."
+
+// Options specifies which instances to sync
+type Options struct {
+	// The ProviderX constants to sync from. Instances from every provider are merged.
+	Providers []string
+	// The tag whose value is the team that an instance belongs to. Defaults to DefaultTag.
+	Tag string
+	// One of the AddressX constants. Defaults to AddressPrivateIP.
+	Address string
+	// The AWS region. May be empty in which case the CLI default is used.
+	AWSRegion string
+	// The GCP project. May be empty in which case the CLI default is used.
+	GCPProject string
+	// The Azure resource group. May be empty in which case every resource group is searched.
+	AzureResourceGroup string
+}
+
+// An Instance is a running cloud instance that is tagged with a team
+type Instance struct {
+	Team string
+	shared.InventoryHost
+}
+
+// Runs a provider CLI and returns its stdout. Swapped out in tests.
+var runCommand = func(name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("%s failed: %s (%v)", strings.Join(cmd.Args[:3], " "), strings.TrimSpace(string(exitErr.Stderr)), err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to run %s (is it installed?): %v", name, err)
+	}
+	return output, nil
+}
+
+// ListInstances returns the running instances tagged with a team in every provider in opts
+func ListInstances(opts Options) ([]Instance, error) {
+	if opts.Tag == "" {
+		opts.Tag = DefaultTag
+	}
+	if opts.Address == "" {
+		opts.Address = AddressPrivateIP
+	}
+	if opts.Address != AddressPrivateIP && opts.Address != AddressPublicIP && opts.Address != AddressName {
+		return nil, fmt.Errorf("unknown address %s, expected one of %s, %s, %s", opts.Address, AddressPrivateIP, AddressPublicIP, AddressName)
+	}
+	if len(opts.Providers) == 0 {
+		return nil, fmt.Errorf("at least one provider is required")
+	}
+	var instances []Instance
+	for _, provider := range opts.Providers {
+		var found []Instance
+		var err error
+		switch provider {
+		case ProviderAWS:
+			found, err = listAWSInstances(opts)
+		case ProviderGCP:
+			found, err = listGCPInstances(opts)
+		case ProviderAzure:
+			found, err = listAzureInstances(opts)
+		default:
+			return nil, fmt.Errorf("unknown provider %s, expected one of %s, %s, %s", provider, ProviderAWS, ProviderGCP, ProviderAzure)
+		}
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, found...)
+	}
+	return instances, nil
+}
+
+// Build an Instance from the fields that every provider has. Returns false (and logs why) if the instance cannot be
+// listed.
+func newInstance(opts Options, team, name, privateIP, publicIP, displayName string) (Instance, bool) {
+	host := privateIP
+	if opts.Address == AddressPublicIP {
+		host = publicIP
+	} else if opts.Address == AddressName {
+		host = name
+	}
+	if host == "" || !shared.IsValidInventoryHost(host) {
+		log.Debugf("Skipping instance %s since it does not have a valid %s", name, opts.Address)
+		return Instance{}, false
+	}
+	description := strings.Join(strings.Fields(displayName), " ")
+	if description == host {
+		description = ""
+	}
+	return Instance{Team: strings.TrimSpace(team), InventoryHost: shared.InventoryHost{Host: host, Description: description}}, true
+}
+
+type awsInstances struct {
+	Reservations []struct {
+		Instances []struct {
+			InstanceID       string `json:"InstanceId"`
+			PrivateIPAddress string `json:"PrivateIpAddress"`
+			PublicIPAddress  string `json:"PublicIpAddress"`
+			Tags             []struct {
+				Key   string `json:"Key"`
+				Value string `json:"Value"`
+			} `json:"Tags"`
+		} `json:"Instances"`
+	} `json:"Reservations"`
+}
+
+func listAWSInstances(opts Options) ([]Instance, error) {
+	args := []string{"ec2", "describe-instances", "--output", "json",
+		"--filters", "Name=tag-key,Values=" + opts.Tag, "Name=instance-state-name,Values=running"}
+	if opts.AWSRegion != "" {
+		args = append(args, "--region", opts.AWSRegion)
+	}
+	output, err := runCommand("aws", args...)
+	if err != nil {
+		return nil, err
+	}
+	var parsed awsInstances
+	err = json.Unmarshal(output, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the output of aws ec2 describe-instances: %v", err)
+	}
+	var instances []Instance
+	for _, reservation := range parsed.Reservations {
+		for _, awsInstance := range reservation.Instances {
+			var team, displayName string
+			for _, tag := range awsInstance.Tags {
+				if tag.Key == opts.Tag {
+					team = tag.Value
+				} else if tag.Key == "Name" {
+					displayName = tag.Value
+				}
+			}
+			instance, ok := newInstance(opts, team, awsInstance.InstanceID, awsInstance.PrivateIPAddress, awsInstance.PublicIPAddress, displayName)
+			if ok {
+				instances = append(instances, instance)
+			}
+		}
+	}
+	return instances, nil
+}
+
+type gcpInstance struct {
+	Name              string            `json:"name"`
+	Labels            map[string]string `json:"labels"`
+	NetworkInterfaces []struct {
+		NetworkIP     string `json:"networkIP"`
+		AccessConfigs []struct {
+			NatIP string `json:"natIP"`
+		} `json:"accessConfigs"`
+	} `json:"networkInterfaces"`
+	Metadata struct {
+		Items []struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		} `json:"items"`
+	} `json:"metadata"`
+}
+
+// GCP label values cannot contain the dots in team names so the team is read from the instance metadata entry named
+// opts.Tag. A label is used if there is no such metadata entry (eg for teams without subteams).
+func listGCPInstances(opts Options) ([]Instance, error) {
+	args := []string{"compute", "instances", "list", "--format", "json", "--filter", "status=RUNNING"}
+	if opts.GCPProject != "" {
+		args = append(args, "--project", opts.GCPProject)
+	}
+	output, err := runCommand("gcloud", args...)
+	if err != nil {
+		return nil, err
+	}
+	var parsed []gcpInstance
+	err = json.Unmarshal(output, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the output of gcloud compute instances list: %v", err)
+	}
+	var instances []Instance
+	for _, gcp := range parsed {
+		team := gcp.Labels[opts.Tag]
+		for _, item := range gcp.Metadata.Items {
+			if item.Key == opts.Tag {
+				team = item.Value
+			}
+		}
+		if team == "" {
+			continue
+		}
+		var privateIP, publicIP string
+		if len(gcp.NetworkInterfaces) > 0 {
+			privateIP = gcp.NetworkInterfaces[0].NetworkIP
+			if len(gcp.NetworkInterfaces[0].AccessConfigs) > 0 {
+				publicIP = gcp.NetworkInterfaces[0].AccessConfigs[0].NatIP
+			}
+		}
+		instance, ok := newInstance(opts, team, gcp.Name, privateIP, publicIP, gcp.Name)
+		if ok {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+type azureInstance struct {
+	Name       string            `json:"name"`
+	PowerState string            `json:"powerState"`
+	PrivateIPs string            `json:"privateIps"`
+	PublicIPs  string            `json:"publicIps"`
+	Tags       map[string]string `json:"tags"`
+}
+
+func listAzureInstances(opts Options) ([]Instance, error) {
+	args := []string{"vm", "list", "--show-details", "--output", "json"}
+	if opts.AzureResourceGroup != "" {
+		args = append(args, "--resource-group", opts.AzureResourceGroup)
+	}
+	output, err := runCommand("az", args...)
+	if err != nil {
+		return nil, err
+	}
+	var parsed []azureInstance
+	err = json.Unmarshal(output, &parsed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the output of az vm list: %v", err)
+	}
+	var instances []Instance
+	for _, vm := range parsed {
+		team := vm.Tags[opts.Tag]
+		if team == "" || vm.PowerState != "VM running" {
+			continue
+		}
+		// Azure lists every IP of a VM in a single comma separated string
+		privateIP := strings.TrimSpace(strings.Split(vm.PrivateIPs, ",")[0])
+		publicIP := strings.TrimSpace(strings.Split(vm.PublicIPs, ",")[0])
+		instance, ok := newInstance(opts, team, vm.Name, privateIP, publicIP, vm.Name)
+		if ok {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+// GroupByTeam groups the given instances into the inventory of each team, sorted by host. Instances tagged with a
+// team that does not match any of the given configured teams (or with a team pattern) are skipped so that tags cannot
+// be used to publish to arbitrary teams.
+func GroupByTeam(instances []Instance, configuredTeams []string) map[string][]shared.InventoryHost {
+	inventories := make(map[string][]shared.InventoryHost)
+	for _, instance := range instances {
+		if shared.ValidateTeamPattern(instance.Team) != nil || shared.IsTeamPattern(instance.Team) ||
+			len(shared.MatchTeams(configuredTeams, []string{instance.Team})) == 0 {
+			log.Warnf("Skipping instance %s since it is tagged with %q which is not one of the configured teams", instance.Host, instance.Team)
+			continue
+		}
+		inventories[instance.Team] = append(inventories[instance.Team], instance.InventoryHost)
+	}
+	for _, hosts := range inventories {
+		sort.Slice(hosts, func(i, j int) bool { return hosts[i].Host < hosts[j].Host })
+	}
+	return inventories
+}
+
+// FormatInventory serializes the given hosts as an inventory written by Sync (see shared.ParseInventory)
+func FormatInventory(hosts []shared.InventoryHost) string {
+	lines := []string{SyncHeader}
+	for _, host := range hosts {
+		line := host.Host
+		if host.Description != "" {
+			line += " " + host.Description
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Sync lists the instances described by opts and publishes the inventory of every configured team that has tagged
+// instances. Inventories previously written by Sync for teams that no longer have any tagged instances are cleared.
+// Returns the number of hosts published for each team that was written to.
+func Sync(conf config.Config, opts Options) (map[string]int, error) {
+	instances, err := ListInstances(opts)
+	if err != nil {
+		return nil, err
+	}
+	inventories := GroupByTeam(instances, conf.GetTeams())
+	ko := constants.GetDefaultKBFSOperationsStruct()
+	// The versions of the stale inventories so that they are only cleared if no one published a new one in the meantime
+	staleVersions := make(map[string]kbfs.FileVersion)
+	for _, team := range conf.GetTeams() {
+		if _, ok := inventories[team]; ok || shared.IsTeamPattern(team) {
+			continue
+		}
+		contents, version, err := ko.ReadVersion(shared.InventoryPath(team))
+		if err != nil {
+			log.Warnf("Failed to read the hosts inventory of team %s: %v", team, err)
+			continue
+		}
+		if version.Exists && strings.HasPrefix(string(contents), SyncHeader) && string(contents) != FormatInventory(nil) {
+			inventories[team] = nil
+			staleVersions[team] = version
+		}
+	}
+
+	counts := make(map[string]int)
+	for team, hosts := range inventories {
+		var err error
+		if version, ok := staleVersions[team]; ok {
+			err = ko.WriteIfUnchanged(shared.InventoryPath(team), FormatInventory(hosts), version)
+			if kbfs.IsConflict(err) {
+				log.Warnf("Not clearing the hosts inventory of team %s: %v", team, err)
+				continue
+			}
+		} else {
+			err = ko.Write(shared.InventoryPath(team), FormatInventory(hosts), false)
+		}
+		if err != nil {
+			return counts, fmt.Errorf("failed to publish the hosts inventory of team %s: %v", team, err)
+		}
+		counts[team] = len(hosts)
+	}
+	return counts, nil
+}
@@ -0,0 +1,97 @@
+package inventory
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+const awsOutput = `{"Reservations": [{"Instances": [
+	{"InstanceId": "i-0123", "PrivateIpAddress": "10.0.0.1", "PublicIpAddress": "54.1.2.3",
+	 "Tags": [{"Key": "kssh-team", "Value": "team.ssh.prod"}, {"Key": "Name", "Value": "prod db"}]},
+	{"InstanceId": "i-0456", "PrivateIpAddress": "10.0.0.2",
+	 "Tags": [{"Key": "kssh-team", "Value": "team.ssh.staging"}]}
+]}]}`
+
+const gcpOutput = `[
+	{"name": "web-1", "metadata": {"items": [{"key": "kssh-team", "value": "team.ssh.prod"}]},
+	 "networkInterfaces": [{"networkIP": "10.1.0.1", "accessConfigs": [{"natIP": "35.1.2.3"}]}]},
+	{"name": "untagged", "networkInterfaces": [{"networkIP": "10.1.0.2"}]},
+	{"name": "labeled", "labels": {"kssh-team": "devs"}, "networkInterfaces": [{"networkIP": "10.1.0.3"}]}
+]`
+
+const azureOutput = `[
+	{"name": "vm-1", "powerState": "VM running", "privateIps": "10.2.0.1,10.2.0.5", "publicIps": "", "tags": {"kssh-team": "team.ssh.prod"}},
+	{"name": "vm-2", "powerState": "VM deallocated", "privateIps": "10.2.0.2", "tags": {"kssh-team": "team.ssh.prod"}}
+]`
+
+func TestListInstances(t *testing.T) {
+	oldRunCommand := runCommand
+	defer func() { runCommand = oldRunCommand }()
+	var commands [][]string
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		commands = append(commands, append([]string{name}, args...))
+		switch name {
+		case "aws":
+			return []byte(awsOutput), nil
+		case "gcloud":
+			return []byte(gcpOutput), nil
+		case "az":
+			return []byte(azureOutput), nil
+		}
+		return nil, fmt.Errorf("unexpected command %s", name)
+	}
+
+	instances, err := ListInstances(Options{Providers: []string{ProviderAWS, ProviderGCP, ProviderAzure}, AWSRegion: "us-east-1"})
+	require.NoError(t, err)
+	require.Equal(t, []Instance{
+		{Team: "team.ssh.prod", InventoryHost: shared.InventoryHost{Host: "10.0.0.1", Description: "prod db"}},
+		{Team: "team.ssh.staging", InventoryHost: shared.InventoryHost{Host: "10.0.0.2"}},
+		{Team: "team.ssh.prod", InventoryHost: shared.InventoryHost{Host: "10.1.0.1", Description: "web-1"}},
+		{Team: "devs", InventoryHost: shared.InventoryHost{Host: "10.1.0.3", Description: "labeled"}},
+		{Team: "team.ssh.prod", InventoryHost: shared.InventoryHost{Host: "10.2.0.1", Description: "vm-1"}},
+	}, instances)
+	require.Contains(t, commands[0], "Name=tag-key,Values=kssh-team")
+	require.Contains(t, commands[0], "us-east-1")
+
+	// Instances without the requested address are skipped
+	instances, err = ListInstances(Options{Providers: []string{ProviderAWS, ProviderAzure}, Address: AddressPublicIP})
+	require.NoError(t, err)
+	require.Equal(t, []Instance{{Team: "team.ssh.prod", InventoryHost: shared.InventoryHost{Host: "54.1.2.3", Description: "prod db"}}}, instances)
+
+	instances, err = ListInstances(Options{Providers: []string{ProviderAWS}, Address: AddressName})
+	require.NoError(t, err)
+	require.Equal(t, "i-0123", instances[0].Host)
+
+	_, err = ListInstances(Options{Providers: []string{"digitalocean"}})
+	require.Error(t, err)
+	_, err = ListInstances(Options{Providers: []string{ProviderAWS}, Address: "hostname"})
+	require.Error(t, err)
+	runCommand = func(name string, args ...string) ([]byte, error) {
+		return []byte("not json"), nil
+	}
+	_, err = ListInstances(Options{Providers: []string{ProviderGCP}})
+	require.Error(t, err)
+}
+
+func TestGroupByTeam(t *testing.T) {
+	inventories := GroupByTeam([]Instance{
+		{Team: "team.ssh.prod", InventoryHost: shared.InventoryHost{Host: "10.0.0.2"}},
+		{Team: "team.ssh.prod", InventoryHost: shared.InventoryHost{Host: "10.0.0.1", Description: "db"}},
+		{Team: "team.ssh.staging", InventoryHost: shared.InventoryHost{Host: "10.0.1.1"}},
+		{Team: "team.other", InventoryHost: shared.InventoryHost{Host: "10.0.2.1"}},
+		{Team: "team.ssh.*", InventoryHost: shared.InventoryHost{Host: "10.0.3.1"}},
+	}, []string{"team.ssh.prod", "team.ssh.staging"})
+	require.Equal(t, map[string][]shared.InventoryHost{
+		"team.ssh.prod":    {{Host: "10.0.0.1", Description: "db"}, {Host: "10.0.0.2"}},
+		"team.ssh.staging": {{Host: "10.0.1.1"}},
+	}, inventories)
+
+	contents := FormatInventory(inventories["team.ssh.prod"])
+	require.Equal(t, SyncHeader+"\n10.0.0.1 db\n10.0.0.2\n", contents)
+	hosts, err := shared.ParseInventory(contents)
+	require.NoError(t, err)
+	require.Equal(t, inventories["team.ssh.prod"], hosts)
+}
@@ -0,0 +1,209 @@
+package kbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A ClientVersion is the version of a keybase client (eg 5.4.2 for 5.4.2-20200424190232+7d69e3a5a0)
+type ClientVersion struct {
+	Major, Minor, Patch int
+}
+
+var clientVersionRegex = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// ParseClientVersion parses the output of `keybase version --format=s`
+func ParseClientVersion(output string) (ClientVersion, error) {
+	match := clientVersionRegex.FindStringSubmatch(output)
+	if match == nil {
+		return ClientVersion{}, fmt.Errorf("failed to parse the keybase client version from %q", strings.TrimSpace(output))
+	}
+	// The regex guarantees that these are integers
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	patch, _ := strconv.Atoi(match[3])
+	return ClientVersion{Major: major, Minor: minor, Patch: patch}, nil
+}
+
+// AtLeast returns whether v is the same as or newer than other
+func (v ClientVersion) AtLeast(other ClientVersion) bool {
+	if v.Major != other.Major {
+		return v.Major > other.Major
+	}
+	if v.Minor != other.Minor {
+		return v.Minor > other.Minor
+	}
+	return v.Patch >= other.Patch
+}
+
+func (v ClientVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+}
+
+// fsFormat describes the output of the `keybase fs` commands of a range of keybase client versions
+type fsFormat struct {
+	// The oldest client version that uses this format
+	MinVersion ClientVersion
+	// Whether `keybase fs ls` and `keybase fs stat` accept --json. The JSON output is preferred since the human
+	// oriented output is not a stable interface.
+	JSON bool
+}
+
+// The compatibility matrix of keybase client versions and the `keybase fs` output they produce, newest first. Clients
+// with a version that cannot be detected use the first entry. If a client rejects --json (eg because it is a build that
+// predates it), the human oriented output is used instead so an inaccurate entry here only costs an extra command.
+var fsFormats = []fsFormat{
+	{MinVersion: ClientVersion{Major: 5, Minor: 0, Patch: 0}, JSON: true},
+	{MinVersion: ClientVersion{Major: 0, Minor: 0, Patch: 0}, JSON: false},
+}
+
+// The substrings of `keybase fs` errors that mean that a file does not exist, across client versions
+var notExistErrors = []string{"does not exist", "no such file or directory"}
+
+// Returns whether the given (failed) `keybase fs` output means that the file does not exist
+func isNotExistOutput(output []byte) bool {
+	lower := strings.ToLower(string(output))
+	for _, message := range notExistErrors {
+		if strings.Contains(lower, message) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the given (failed) `keybase fs` output means that the client does not support --json
+func isUnsupportedFlagOutput(output []byte) bool {
+	lower := strings.ToLower(string(output))
+	return strings.Contains(lower, "flag provided but not defined") || strings.Contains(lower, "incorrect usage")
+}
+
+// The detected fsFormat for each keybase binary path. Detection runs `keybase version` so it is only done once.
+var (
+	detectedFormats     = make(map[string]fsFormat)
+	detectedFormatsLock sync.Mutex
+)
+
+// ClientVersion returns the version of the keybase client that the Operation uses
+func (ko *Operation) ClientVersion() (ClientVersion, error) {
+	cmd, err := ko.keybaseCommand("version", "--format=s")
+	if err != nil {
+		return ClientVersion{}, err
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		return ClientVersion{}, fmt.Errorf("failed to get the keybase client version: %v", err)
+	}
+	return ParseClientVersion(string(output))
+}
+
+// Returns the entry of fsFormats for the keybase client that the Operation uses
+func (ko *Operation) format() fsFormat {
+	detectedFormatsLock.Lock()
+	defer detectedFormatsLock.Unlock()
+	if format, ok := detectedFormats[ko.KeybaseBinaryPath]; ok {
+		return format
+	}
+	format := fsFormats[0]
+	version, err := ko.ClientVersion()
+	if err == nil {
+		for _, f := range fsFormats {
+			if version.AtLeast(f.MinVersion) {
+				format = f
+				break
+			}
+		}
+	}
+	detectedFormats[ko.KeybaseBinaryPath] = format
+	return format
+}
+
+// Records that the keybase client that the Operation uses does not support --json
+func (ko *Operation) disableJSON() {
+	detectedFormatsLock.Lock()
+	defer detectedFormatsLock.Unlock()
+	format := detectedFormats[ko.KeybaseBinaryPath]
+	format.JSON = false
+	detectedFormats[ko.KeybaseBinaryPath] = format
+}
+
+// Runs the given `keybase fs` subcommand with --json if the keybase client supports it. isJSON is false if the
+// output is the human oriented output (which the given flags apply to) instead.
+func (ko *Operation) runFSCommand(subcommand, filename string, flags []string) (output []byte, isJSON bool, err error) {
+	if ko.format().JSON {
+		cmd, err := ko.fsCommand(subcommand, filename, "--json")
+		if err != nil {
+			return nil, false, err
+		}
+		output, err = cmd.CombinedOutput()
+		if err == nil || !isUnsupportedFlagOutput(output) {
+			return output, true, err
+		}
+		ko.disableJSON()
+	}
+	cmd, err := ko.fsCommand(subcommand, filename, flags...)
+	if err != nil {
+		return nil, false, err
+	}
+	output, err = cmd.CombinedOutput()
+	return output, false, err
+}
+
+// A KBFS directory entry as output by `keybase fs ls --json` and `keybase fs stat --json`
+type dirent struct {
+	Name string `json:"name"`
+	// Either the name of the type (eg DIR) or its number in the keybase protocol
+	DirentType json.RawMessage `json:"direntType"`
+}
+
+// The types of directory entries in the order of their numbers in the keybase protocol
+var direntTypes = []string{"FILE", "DIR", "SYM", "EXEC"}
+
+// Returns the name of the type of the entry (eg DIR or FILE)
+func (d dirent) typeName() (string, error) {
+	var name string
+	if json.Unmarshal(d.DirentType, &name) == nil {
+		return strings.ToUpper(name), nil
+	}
+	var number int
+	if json.Unmarshal(d.DirentType, &number) == nil && number >= 0 && number < len(direntTypes) {
+		return direntTypes[number], nil
+	}
+	return "", fmt.Errorf("unrecognized directory entry type %s", string(d.DirentType))
+}
+
+// Parses the output of `keybase fs ls --json`
+func parseListJSON(output []byte) ([]string, error) {
+	var result struct {
+		Entries []dirent `json:"entries"`
+	}
+	err := json.Unmarshal(output, &result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the output of keybase fs ls --json: %v", err)
+	}
+	var names []string
+	for _, entry := range result.Entries {
+		if entry.Name == "" {
+			return nil, fmt.Errorf("failed to parse the output of keybase fs ls --json: entry without a name")
+		}
+		names = append(names, entry.Name)
+	}
+	return names, nil
+}
+
+// Parses the output of `keybase fs stat --json` and returns whether the entry is a directory
+func parseStatJSON(output []byte) (bool, error) {
+	var entry dirent
+	err := json.Unmarshal(output, &entry)
+	if err != nil {
+		return false, fmt.Errorf("failed to parse the output of keybase fs stat --json: %v", err)
+	}
+	typeName, err := entry.typeName()
+	if err != nil {
+		return false, fmt.Errorf("failed to parse the output of keybase fs stat --json: %v", err)
+	}
+	return typeName == "DIR", nil
+}
@@ -0,0 +1,110 @@
+package kbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientVersion(t *testing.T) {
+	version, err := ParseClientVersion("5.4.2-20200424190232+7d69e3a5a0\n")
+	require.NoError(t, err)
+	require.Equal(t, ClientVersion{Major: 5, Minor: 4, Patch: 2}, version)
+	require.Equal(t, "5.4.2", version.String())
+
+	version, err = ParseClientVersion("Client:  4.7.2-20191016180000+abcdef")
+	require.NoError(t, err)
+	require.Equal(t, ClientVersion{Major: 4, Minor: 7, Patch: 2}, version)
+
+	_, err = ParseClientVersion("keybase: command not found")
+	require.Error(t, err)
+
+	require.True(t, ClientVersion{5, 4, 2}.AtLeast(ClientVersion{5, 4, 2}))
+	require.True(t, ClientVersion{5, 10, 0}.AtLeast(ClientVersion{5, 9, 9}))
+	require.True(t, ClientVersion{6, 0, 0}.AtLeast(ClientVersion{5, 9, 9}))
+	require.False(t, ClientVersion{5, 4, 1}.AtLeast(ClientVersion{5, 4, 2}))
+	require.False(t, ClientVersion{4, 99, 99}.AtLeast(ClientVersion{5, 0, 0}))
+}
+
+func TestParseJSON(t *testing.T) {
+	names, err := parseListJSON([]byte(`{"entries":[{"name":"a.ssh","direntType":"DIR"},{"name":"with space","direntType":0}]}`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"a.ssh", "with space"}, names)
+
+	names, err = parseListJSON([]byte(`{"entries":[]}`))
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	_, err = parseListJSON([]byte("a.ssh\nb.ssh\n"))
+	require.Error(t, err)
+	_, err = parseListJSON([]byte(`{"entries":[{"direntType":"DIR"}]}`))
+	require.Error(t, err)
+
+	for output, isDir := range map[string]bool{
+		`{"name":"a.ssh","direntType":"DIR"}`:   true,
+		`{"name":"a.ssh","direntType":1}`:       true,
+		`{"name":"ca.log","direntType":"FILE"}`: false,
+		`{"name":"ca.log","direntType":3}`:      false,
+	} {
+		result, err := parseStatJSON([]byte(output))
+		require.NoError(t, err, output)
+		require.Equal(t, isDir, result, output)
+	}
+	_, err = parseStatJSON([]byte(`{"name":"a.ssh","direntType":42}`))
+	require.Error(t, err)
+	_, err = parseStatJSON([]byte("2020-01-01\tDIR\t0\ta.ssh"))
+	require.Error(t, err)
+}
+
+func TestIsNotExistOutput(t *testing.T) {
+	require.True(t, isNotExistOutput([]byte("ERROR file does not exist")))
+	require.True(t, isNotExistOutput([]byte("▶ ERROR stat /keybase/team/a.ssh/x: no such file or directory")))
+	require.False(t, isNotExistOutput([]byte("ERROR permission denied")))
+}
+
+// Every combination of client version and JSON support is handled the same way
+func TestCompatibilityMatrix(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		version string
+		noJSON  bool
+		json    bool
+	}{
+		{name: "new client", version: "5.4.2-20200424190232+7d69e3a5a0", json: true},
+		{name: "old client", version: "4.7.2-20191016180000+abcdef", noJSON: true, json: false},
+		{name: "unknown version", json: true},
+		{name: "new client without JSON", version: "5.4.2", noJSON: true, json: false},
+	} {
+		ko, dir := setupFakeKBFS(t)
+		root := filepath.Join(dir, "root")
+		if c.version != "" {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(root, "version"), []byte(c.version+"\n"), 0600))
+		}
+		if c.noJSON {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(root, "no-json"), nil, 0600))
+		}
+
+		entries, err := ko.List("/keybase/team")
+		require.NoError(t, err, c.name)
+		require.Equal(t, []string{"a.ssh", "b.ssh", "c"}, entries, c.name)
+		require.Equal(t, c.json, ko.format().JSON, c.name)
+
+		isDir, err := ko.IsDir("/keybase/team/a.ssh")
+		require.NoError(t, err, c.name)
+		require.True(t, isDir, c.name)
+		isDir, err = ko.IsDir("/keybase/team/a.ssh/kssh-client.config")
+		require.NoError(t, err, c.name)
+		require.False(t, isDir, c.name)
+
+		_, err = ko.IsDir("/keybase/team/missing")
+		require.Error(t, err, c.name)
+		exists, err := ko.FileExists("/keybase/team/missing")
+		require.NoError(t, err, c.name)
+		require.False(t, exists, c.name)
+
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,139 @@
+package kbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A Backend is how an Operation accesses KBFS
+type Backend int
+
+const (
+	// Use the FUSE mount at /keybase if it is healthy and not disabled via DisableFuseEnvVar, `keybase fs` otherwise
+	BackendAuto Backend = iota
+	// Always use `keybase fs` commands
+	BackendCLI
+	// Always use the FUSE mount at /keybase, even if it fails the health check. Writes and deletes always use
+	// `keybase fs` commands regardless of the backend.
+	BackendFUSE
+)
+
+// Setting this environment variable to 1 (or true) makes operations with BackendAuto use `keybase fs` commands even
+// if the FUSE mount is healthy. This is useful for debugging and on machines where the mount is present but unreliable.
+const DisableFuseEnvVar = "KSSH_DISABLE_FUSE"
+
+// WithBackend returns a copy of the Operation that uses the given backend, eg to force a single call to use `keybase
+// fs` commands via ko.WithBackend(BackendCLI).Read(filename)
+func (ko *Operation) WithBackend(backend Backend) *Operation {
+	copied := *ko
+	copied.Backend = backend
+	return &copied
+}
+
+// Returns whether the Operation should access KBFS via the FUSE mount
+func (ko *Operation) useFuse() bool {
+	switch ko.Backend {
+	case BackendCLI:
+		return false
+	case BackendFUSE:
+		return true
+	}
+	if disabled, err := strconv.ParseBool(os.Getenv(DisableFuseEnvVar)); err == nil && disabled {
+		return false
+	}
+	return supportsFuse()
+}
+
+// The KBFS FUSE mount point and the directories that must exist in it
+var (
+	fuseRoot        = "/keybase"
+	fuseDirectories = []string{"team", "private", "public"}
+)
+
+// A small file that KBFS serves at the root of the mount. Reading it (rather than just stat-ing directories which the
+// kernel may answer from its cache) checks that the KBFS process behind the mount is responding.
+const fuseStatusFile = ".kbfs_status"
+
+// How long the FUSE health check may take before the mount is considered hung
+var fuseHealthCheckTimeout = 2 * time.Second
+
+// How long the result of the FUSE health check is reused for
+var fuseHealthCacheTTL = time.Minute
+
+// Swapped out in tests to simulate a hung mount
+var (
+	fuseStat     = os.Stat
+	fuseReadFile = ioutil.ReadFile
+)
+
+var fuseHealth struct {
+	sync.Mutex
+	healthy   bool
+	checkedAt time.Time
+	// Set while a health check is running. A check against a hung mount never returns so at most one is ever running.
+	inFlight chan bool
+}
+
+// Returns whether or not the current system supports accessing KBFS via a FUSE filesystem mounted at /keybase
+// This is used in order to optimize heavily used functions in the below library. Generally, it is preferred to
+// rely on `keybase fs` commands since those are guaranteed to work across systems (and are what is used inside the
+// integration tests). But in a few cases (namely when kssh is searching for kssh-client.config files) it gives very
+// large speed improvements to use the FUSE filesystem when available (an order of magnitude improvement for kssh)
+//
+// A stale or hung mount (eg because the KBFS process crashed) is treated as unsupported so that everything falls back
+// to `keybase fs` commands rather than hanging on the first filesystem call.
+func supportsFuse() bool {
+	// Note that this function is not tested via integration tests since fuse does not run in docker. Handle with care.
+	fuseHealth.Lock()
+	defer fuseHealth.Unlock()
+	if !fuseHealth.checkedAt.IsZero() && time.Since(fuseHealth.checkedAt) < fuseHealthCacheTTL {
+		return fuseHealth.healthy
+	}
+	if fuseHealth.inFlight == nil {
+		result := make(chan bool, 1)
+		fuseHealth.inFlight = result
+		go func() {
+			result <- checkFuseHealth()
+		}()
+		select {
+		case healthy := <-result:
+			fuseHealth.inFlight = nil
+			fuseHealth.healthy = healthy
+		case <-time.After(fuseHealthCheckTimeout):
+			// The check is left running and its result is used by a later call if the mount recovers
+			log.Warnf("The KBFS mount at %s is not responding, falling back to keybase fs commands", fuseRoot)
+			fuseHealth.healthy = false
+		}
+	} else {
+		// A previous check timed out and is still stuck so do not wait for it again
+		select {
+		case healthy := <-fuseHealth.inFlight:
+			fuseHealth.inFlight = nil
+			fuseHealth.healthy = healthy
+		default:
+			fuseHealth.healthy = false
+		}
+	}
+	fuseHealth.checkedAt = time.Now()
+	return fuseHealth.healthy
+}
+
+// Returns whether the FUSE mount exists and responds. May block forever if the mount is hung.
+func checkFuseHealth() bool {
+	if _, err := fuseStat(fuseRoot); err != nil {
+		return false
+	}
+	for _, dir := range fuseDirectories {
+		if _, err := fuseStat(filepath.Join(fuseRoot, dir)); err != nil {
+			return false
+		}
+	}
+	_, err := fuseReadFile(filepath.Join(fuseRoot, fuseStatusFile))
+	return err == nil
+}
@@ -0,0 +1,125 @@
+package kbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Points the FUSE health check at a fake mount in a temporary directory. Returns a function that restores it.
+func setupFakeFuse(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "kbfs-fuse")
+	require.NoError(t, err)
+	originalRoot, originalTimeout := fuseRoot, fuseHealthCheckTimeout
+	fuseRoot = dir
+	fuseHealthCheckTimeout = 100 * time.Millisecond
+	resetFuseHealth()
+	return dir, func() {
+		fuseRoot, fuseHealthCheckTimeout = originalRoot, originalTimeout
+		fuseStat, fuseReadFile = os.Stat, ioutil.ReadFile
+		resetFuseHealth()
+		os.RemoveAll(dir)
+	}
+}
+
+func resetFuseHealth() {
+	fuseHealth.Lock()
+	defer fuseHealth.Unlock()
+	fuseHealth.checkedAt = time.Time{}
+	fuseHealth.inFlight = nil
+}
+
+// Makes the next call to supportsFuse check again without forgetting about a check that is still running
+func expireFuseHealth() {
+	fuseHealth.Lock()
+	defer fuseHealth.Unlock()
+	fuseHealth.checkedAt = time.Time{}
+}
+
+func TestSupportsFuse(t *testing.T) {
+	dir, cleanup := setupFakeFuse(t)
+	defer cleanup()
+
+	// Missing directories
+	require.False(t, supportsFuse())
+
+	// The result is cached
+	for _, name := range fuseDirectories {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0700))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fuseStatusFile), []byte("{}"), 0600))
+	require.False(t, supportsFuse())
+
+	resetFuseHealth()
+	require.True(t, supportsFuse())
+
+	// A stale mount whose status file cannot be read
+	require.NoError(t, os.Remove(filepath.Join(dir, fuseStatusFile)))
+	resetFuseHealth()
+	require.False(t, supportsFuse())
+}
+
+func TestSupportsFuseHung(t *testing.T) {
+	dir, cleanup := setupFakeFuse(t)
+	defer cleanup()
+	for _, name := range fuseDirectories {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0700))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fuseStatusFile), []byte("{}"), 0600))
+
+	unhang := make(chan struct{})
+	fuseReadFile = func(filename string) ([]byte, error) {
+		<-unhang
+		return ioutil.ReadFile(filename)
+	}
+
+	// Times out rather than hanging
+	start := time.Now()
+	require.False(t, supportsFuse())
+	require.True(t, time.Since(start) < time.Second)
+
+	// Does not wait for the stuck check again
+	expireFuseHealth()
+	start = time.Now()
+	require.False(t, supportsFuse())
+	require.True(t, time.Since(start) < fuseHealthCheckTimeout)
+
+	// Picks up the result of the stuck check once the mount recovers
+	close(unhang)
+	time.Sleep(50 * time.Millisecond)
+	expireFuseHealth()
+	require.True(t, supportsFuse())
+}
+
+func TestUseFuse(t *testing.T) {
+	dir, cleanup := setupFakeFuse(t)
+	defer cleanup()
+	for _, name := range fuseDirectories {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0700))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, fuseStatusFile), []byte("{}"), 0600))
+	defer os.Unsetenv(DisableFuseEnvVar)
+
+	ko := &Operation{KeybaseBinaryPath: "keybase"}
+	require.True(t, ko.useFuse())
+	require.False(t, ko.WithBackend(BackendCLI).useFuse())
+	require.Equal(t, BackendAuto, ko.Backend)
+
+	for value, useFuse := range map[string]bool{"1": false, "true": false, "0": true, "false": true, "": true} {
+		require.NoError(t, os.Setenv(DisableFuseEnvVar, value))
+		require.Equal(t, useFuse, ko.useFuse(), value)
+		require.False(t, ko.WithBackend(BackendCLI).useFuse(), value)
+		require.True(t, ko.WithBackend(BackendFUSE).useFuse(), value)
+	}
+
+	// Forcing FUSE skips the health check
+	require.NoError(t, os.Remove(filepath.Join(dir, fuseStatusFile)))
+	require.NoError(t, os.Unsetenv(DisableFuseEnvVar))
+	resetFuseHealth()
+	require.False(t, ko.useFuse())
+	require.True(t, ko.WithBackend(BackendFUSE).useFuse())
+}
@@ -6,29 +6,62 @@ import (
 	"os"
 	"os/exec"
 	"strings"
-)
+	"unicode"
+	"unicode/utf8"
 
-// Returns whether or not the current system supports accessing KBFS via a FUSE filesystem mounted at /keybase
-// This is used in order to optimize heavily used functions in the below library. Generally, it is preferred to
-// rely on `keybase fs` commands since those are guaranteed to work across systems (and are what is used inside the
-// integration tests). But in a few cases (namely when kssh is searching for kssh-client.config files) it gives very
-// large speed improvements to use the FUSE filesystem when available (an order of magnitude improvement for kssh)
-func supportsFuse() bool {
-	// Note that this function is not tested via integration tests since fuse does not run in docker. Handle with care.
-	_, err1 := os.Stat("/keybase")
-	_, err2 := os.Stat("/keybase/team")
-	_, err3 := os.Stat("/keybase/private")
-	_, err4 := os.Stat("/keybase/public")
-	return err1 == nil && err2 == nil && err3 == nil && err4 == nil
-}
+	"github.com/keybase/bot-sshca/src/shared"
+)
 
 type Operation struct {
 	KeybaseBinaryPath string
+	// The Keybase home directory (`keybase --home`) of the account to act as. Empty for the default home directory.
+	HomeDir string
+	// How KBFS is accessed. Defaults to BackendAuto.
+	Backend Backend
+}
+
+// Returns a `keybase fs` command that runs the given subcommand with the given flags on the given KBFS path. The path
+// is passed as a separate argument (never through a shell) so it may contain spaces, unicode, and shell
+// metacharacters. Returns an error if the path would be misinterpreted by `keybase fs`. The command is run with a
+// scrubbed environment (see shared.Command).
+func (ko *Operation) fsCommand(subcommand, filename string, flags ...string) (*exec.Cmd, error) {
+	err := checkPath(filename)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{"fs", subcommand}, flags...)
+	return ko.keybaseCommand(append(args, filename)...)
+}
+
+// Returns a keybase command that runs with the given arguments and a scrubbed environment (see shared.Command)
+func (ko *Operation) keybaseCommand(args ...string) (*exec.Cmd, error) {
+	if ko.HomeDir != "" {
+		args = append([]string{"--home", ko.HomeDir}, args...)
+	}
+	return shared.Command(ko.KeybaseBinaryPath, args...)
+}
+
+// Returns an error if the given KBFS path cannot be safely passed to `keybase fs`
+func checkPath(filename string) error {
+	if !utf8.ValidString(filename) {
+		return fmt.Errorf("invalid KBFS path %q: paths must be valid UTF-8", filename)
+	}
+	// This also guarantees that the path cannot be parsed as a flag
+	if !strings.HasPrefix(filename, "/") {
+		return fmt.Errorf("invalid KBFS path %q: paths must be absolute", filename)
+	}
+	for _, r := range filename {
+		// Newlines in particular would break parsing the output of `keybase fs ls`
+		if unicode.IsControl(r) {
+			return fmt.Errorf("invalid KBFS path %q: paths may not contain control characters", filename)
+		}
+	}
+	return nil
 }
 
 // Returns whether the given KBFS file exists
 func (ko *Operation) FileExists(filename string) (bool, error) {
-	if supportsFuse() {
+	if ko.useFuse() {
 		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
 		_, err := os.Stat(filename)
 		if err == nil {
@@ -40,37 +73,71 @@ func (ko *Operation) FileExists(filename string) (bool, error) {
 		return false, err
 	}
 
-	cmd := exec.Command(ko.KeybaseBinaryPath, "fs", "stat", filename)
+	cmd, err := ko.fsCommand("stat", filename)
+	if err != nil {
+		return false, err
+	}
 	bytes, err := cmd.CombinedOutput()
 	if err == nil {
 		return true, nil
 	}
-	if strings.Contains(string(bytes), "ERROR file does not exist") {
+	if isNotExistOutput(bytes) {
 		return false, nil
 	}
-	return false, fmt.Errorf("failed to stat %s: %s (%v)", filename, strings.TrimSpace(string(bytes)), err)
+	return false, fmt.Errorf("failed to stat %s: %s (%v)", filename, shared.RedactOutput(bytes), err)
 }
 
 // Reads the specified KBFS file into a byte array
 func (ko *Operation) Read(filename string) ([]byte, error) {
-	if supportsFuse() {
+	if ko.useFuse() {
 		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
 		return ioutil.ReadFile(filename)
 	}
-	cmd := exec.Command(ko.KeybaseBinaryPath, "fs", "read", filename)
+	cmd, err := ko.fsCommand("read", filename)
+	if err != nil {
+		return nil, err
+	}
 	bytes, err := cmd.CombinedOutput()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read %s: %s (%v)", filename, strings.TrimSpace(string(bytes)), err)
+		return nil, fmt.Errorf("failed to read %s: %s (%v)", filename, shared.RedactOutput(bytes), err)
 	}
 	return bytes, nil
 }
 
+// Reads the specified KBFS file into a byte array. exists is false if there is no such file. Unlike calling FileExists
+// and then Read, this only runs a single `keybase fs` command.
+func (ko *Operation) ReadIfExists(filename string) (contents []byte, exists bool, err error) {
+	if ko.useFuse() {
+		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
+		contents, err = ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return contents, err == nil, err
+	}
+	cmd, err := ko.fsCommand("read", filename)
+	if err != nil {
+		return nil, false, err
+	}
+	bytes, err := cmd.CombinedOutput()
+	if err == nil {
+		return bytes, true, nil
+	}
+	if isNotExistOutput(bytes) {
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("failed to read %s: %s (%v)", filename, shared.RedactOutput(bytes), err)
+}
+
 // Delete the specified KBFS file
 func (ko *Operation) Delete(filename string) error {
-	cmd := exec.Command(ko.KeybaseBinaryPath, "fs", "rm", filename)
+	cmd, err := ko.fsCommand("rm", filename)
+	if err != nil {
+		return err
+	}
 	bytes, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to delete the file at %s: %s (%v)", filename, strings.TrimSpace(string(bytes)), err)
+		return fmt.Errorf("failed to delete the file at %s: %s (%v)", filename, shared.RedactOutput(bytes), err)
 	}
 	return nil
 }
@@ -78,7 +145,7 @@ func (ko *Operation) Delete(filename string) error {
 // Write contents to the specified KBFS file. If appendToFile, appends onto the end of the file. Otherwise, overwrites
 // and truncates the file.
 func (ko *Operation) Write(filename string, contents string, appendToFile bool) error {
-	var cmd *exec.Cmd
+	var flags []string
 	if appendToFile {
 		// `keybase fs write --append` only works if the file already exists so create it if it does not exist
 		exists, err := ko.FileExists(filename)
@@ -88,28 +155,34 @@ func (ko *Operation) Write(filename string, contents string, appendToFile bool)
 				return err
 			}
 		}
-		cmd = exec.Command(ko.KeybaseBinaryPath, "fs", "write", "--append", filename)
-	} else {
-		cmd = exec.Command(ko.KeybaseBinaryPath, "fs", "write", filename)
+		flags = []string{"--append"}
+	}
+	cmd, err := ko.fsCommand("write", filename, flags...)
+	if err != nil {
+		return err
 	}
 
 	cmd.Stdin = strings.NewReader(contents)
 	bytes, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to write to file at %s: %s (%v)", filename, strings.TrimSpace(string(bytes)), err)
+		return fmt.Errorf("failed to write to file at %s: %s (%v)", filename, shared.RedactOutput(bytes), err)
 	}
 	return nil
 }
 
 // List KBFS files in the given KBFS path
 func (ko *Operation) List(path string) ([]string, error) {
-	cmd := exec.Command(ko.KeybaseBinaryPath, "fs", "ls", "-1", "--nocolor", path)
-	output, err := cmd.CombinedOutput()
+	output, isJSON, err := ko.runFSCommand("ls", path, []string{"-1", "--nocolor"})
 	if err != nil {
-		return nil, fmt.Errorf("failed to list files in /keybase/team/: %s (%v)", strings.TrimSpace(string(output)), err)
+		return nil, fmt.Errorf("failed to list files in %s: %s (%v)", path, shared.RedactOutput(output), err)
+	}
+	if isJSON {
+		return parseListJSON(output)
 	}
 	var ret []string
 	for _, s := range strings.Split(string(output), "\n") {
+		// Only strip line endings since file names may begin or end with spaces
+		s = strings.TrimSuffix(s, "\r")
 		if s != "" {
 			ret = append(ret, s)
 		}
@@ -0,0 +1,165 @@
+package kbfs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Returns whether the given KBFS path is a directory
+func (ko *Operation) IsDir(filename string) (bool, error) {
+	if ko.useFuse() {
+		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
+		info, err := os.Stat(filename)
+		if err != nil {
+			return false, err
+		}
+		return info.IsDir(), nil
+	}
+	bytes, isJSON, err := ko.runFSCommand("stat", filename, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to stat %s: %s (%v)", filename, shared.RedactOutput(bytes), err)
+	}
+	if isJSON {
+		return parseStatJSON(bytes)
+	}
+	// The output is a tab separated line that includes the type of the entry (eg DIR or FILE) followed by the name of
+	// the entry. Only the first type is used since the name itself may contain a word such as DIR.
+	for _, field := range strings.Fields(string(bytes)) {
+		switch field {
+		case "DIR":
+			return true, nil
+		case "FILE", "EXEC", "SYM":
+			return false, nil
+		}
+	}
+	// Rather than guessing, fail loudly if a new keybase client changed the output format
+	return false, fmt.Errorf("failed to stat %s: unrecognized output from keybase fs stat: %s", filename, shared.RedactOutput(bytes))
+}
+
+// ListRecursive returns the full paths of every file (but not directory) under the given KBFS path in sorted order
+func (ko *Operation) ListRecursive(dir string) ([]string, error) {
+	if ko.useFuse() {
+		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
+		var files []string
+		err := filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				files = append(files, filename)
+			}
+			return nil
+		})
+		return files, err
+	}
+
+	var files []string
+	entries, err := ko.List(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		filename := path.Join(dir, entry)
+		isDir, err := ko.IsDir(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !isDir {
+			files = append(files, filename)
+			continue
+		}
+		children, err := ko.ListRecursive(filename)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, children...)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Glob returns the full paths of every KBFS file or directory matching the given pattern in sorted order. The
+// pattern syntax is the same as path.Match and a pattern may be used in any path component. Eg
+// `/keybase/team/*.ssh/kssh-client.config`. Directories that cannot be listed (eg a team that the user cannot read)
+// are skipped.
+func (ko *Operation) Glob(pattern string) ([]string, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+	}
+	if ko.useFuse() {
+		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
+		return filepath.Glob(pattern)
+	}
+
+	matches := []string{"/"}
+	for _, component := range strings.Split(strings.Trim(path.Clean(pattern), "/"), "/") {
+		var next []string
+		for _, dir := range matches {
+			if !hasMeta(component) {
+				next = append(next, path.Join(dir, component))
+				continue
+			}
+			entries, err := ko.List(dir)
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if matched, _ := path.Match(component, entry); matched {
+					next = append(next, path.Join(dir, entry))
+				}
+			}
+		}
+		matches = next
+	}
+
+	// Components without any glob characters were not checked so filter out anything that does not exist
+	var ret []string
+	for _, match := range matches {
+		exists, err := ko.FileExists(match)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			ret = append(ret, match)
+		}
+	}
+	sort.Strings(ret)
+	return ret, nil
+}
+
+// DeleteRecursive deletes the given KBFS path and, if it is a directory, everything inside of it
+func (ko *Operation) DeleteRecursive(filename string) error {
+	cmd, err := ko.fsCommand("rm", filename, "-r")
+	if err != nil {
+		return err
+	}
+	bytes, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to recursively delete %s: %s (%v)", filename, shared.RedactOutput(bytes), err)
+	}
+	return nil
+}
+
+// QuoteGlob escapes the special characters used by path.Match in the given path component so that it is only matched
+// literally by Glob. Eg `Glob("/keybase/team/*/" + QuoteGlob(name))`.
+func QuoteGlob(component string) string {
+	var sb strings.Builder
+	for _, r := range component {
+		if hasMeta(string(r)) {
+			sb.WriteRune('\\')
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+// Returns whether the given path component contains any of the special characters used by path.Match
+func hasMeta(component string) bool {
+	return strings.ContainsAny(component, `*?[\`)
+}
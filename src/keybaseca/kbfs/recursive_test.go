@@ -0,0 +1,219 @@
+package kbfs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// A fake keybase binary that implements the `keybase fs` subcommands used by Operation on top of a local directory
+// that stands in for /keybase
+const fakeKeybase = `#!/bin/sh
+root=%s
+if [ "$1" = version ]; then
+	# The version is only known if the test wrote it
+	exec cat "$root/version"
+fi
+shift
+cmd=$1
+shift
+# Record a revision of the given file under $root/.history
+snapshot() {
+	rev=$(($(cat "$root/.revision" 2>/dev/null || echo 0) + 1))
+	echo $rev > "$root/.revision"
+	mkdir -p "$root/.history${1#/keybase}"
+	cp "$root${1#/keybase}" "$root/.history${1#/keybase}/$rev"
+}
+json_string() {
+	printf '"%%s"' "$(printf '%%s' "$1" | sed 's/\\/\\\\/g; s/"/\\"/g')"
+}
+if [ "$1" = --json ]; then
+	# Simulate a client without JSON output if requested
+	if [ -e "$root/no-json" ]; then
+		echo "Incorrect Usage: flag provided but not defined: -json"
+		exit 1
+	fi
+	shift
+	target="$root${1#/keybase}"
+	if [ ! -e "$target" ]; then
+		echo "ERROR file does not exist"
+		exit 1
+	fi
+	case $cmd in
+	ls)
+		printf '{"entries":['
+		ls -A "$target" | {
+			sep=""
+			while IFS= read -r name; do
+				printf '%%s{"name":%%s,"direntType":"FILE"}' "$sep" "$(json_string "$name")"
+				sep=","
+			done
+		}
+		printf ']}\n'
+		;;
+	stat)
+		type=FILE
+		[ -d "$target" ] && type=DIR
+		printf '{"name":%%s,"direntType":"%%s"}\n' "$(json_string "$(basename "$target")")" "$type"
+		;;
+	esac
+	exit 0
+fi
+case $cmd in
+ls)
+	eval "target=\${$#}"
+	exec ls -1 "$root${target#/keybase}"
+	;;
+stat)
+	target="$root${1#/keybase}"
+	if [ -d "$target" ]; then
+		printf '2020-01-01\tDIR\t0\t%%s\n' "$1"
+	elif [ -e "$target" ]; then
+		printf '2020-01-01\tFILE\t0\t%%s\n' "$1"
+	else
+		echo "ERROR file does not exist"
+		exit 1
+	fi
+	exit 0
+	;;
+rm)
+	eval "target=\${$#}"
+	exec rm -r "$root${target#/keybase}"
+	;;
+read)
+	if [ "$1" = --rev ]; then
+		exec cat "$root/.history${3#/keybase}/$2"
+	fi
+	if [ ! -f "$root${1#/keybase}" ]; then
+		echo "ERROR file does not exist"
+		exit 1
+	fi
+	exec cat "$root${1#/keybase}"
+	;;
+write)
+	# Simulate a silent partial write if requested
+	if [ -e "$root/partial-writes" ]; then
+		count=$(cat "$root/partial-writes")
+		if [ "$count" -gt 0 ]; then
+			echo $((count - 1)) > "$root/partial-writes"
+			head -c 4 > "$root${1#/keybase}"
+			snapshot "$1"
+			exit 0
+		fi
+	fi
+	if [ "$1" = "--append" ]; then
+		cat >> "$root${2#/keybase}"
+		snapshot "$2"
+		exit 0
+	fi
+	cat > "$root${1#/keybase}"
+	snapshot "$1"
+	exit 0
+	;;
+history)
+	if [ ! -d "$root/.history${1#/keybase}" ]; then
+		echo "ERROR file does not exist"
+		exit 1
+	fi
+	printf 'Revision\tWriter\n'
+	ls "$root/.history${1#/keybase}" | sort -n | while read -r rev; do
+		printf '%%s\talice\n' "$rev"
+	done
+	exit 0
+	;;
+esac
+exit 1
+`
+
+func setupFakeKBFS(t *testing.T) (*Operation, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake keybase binary requires sh")
+	}
+	dir, err := ioutil.TempDir("", "kbfs")
+	require.NoError(t, err)
+	root := filepath.Join(dir, "root")
+	for _, filename := range []string{
+		"team/a.ssh/kssh-client.config",
+		"team/a.ssh/logs/2020/ca.log",
+		"team/b.ssh/kssh-client.config",
+		"team/c/kssh-client.config",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, filename)), 0700))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(root, filename), []byte("contents"), 0600))
+	}
+	binary := filepath.Join(dir, "keybase")
+	require.NoError(t, ioutil.WriteFile(binary, []byte(fmt.Sprintf(fakeKeybase, root)), 0700))
+	// The fake keybase binary must not be shadowed by a FUSE mount
+	return &Operation{KeybaseBinaryPath: binary, Backend: BackendCLI}, dir
+}
+
+func TestListRecursive(t *testing.T) {
+	ko, dir := setupFakeKBFS(t)
+	defer os.RemoveAll(dir)
+
+	files, err := ko.ListRecursive("/keybase/team/a.ssh")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/keybase/team/a.ssh/kssh-client.config", "/keybase/team/a.ssh/logs/2020/ca.log"}, files)
+}
+
+func TestGlob(t *testing.T) {
+	ko, dir := setupFakeKBFS(t)
+	defer os.RemoveAll(dir)
+
+	matches, err := ko.Glob("/keybase/team/*.ssh/kssh-client.config")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/keybase/team/a.ssh/kssh-client.config", "/keybase/team/b.ssh/kssh-client.config"}, matches)
+
+	matches, err = ko.Glob("/keybase/team/a.ssh/logs/*/*.log")
+	require.NoError(t, err)
+	require.Equal(t, []string{"/keybase/team/a.ssh/logs/2020/ca.log"}, matches)
+
+	matches, err = ko.Glob("/keybase/team/*/missing")
+	require.NoError(t, err)
+	require.Empty(t, matches)
+
+	_, err = ko.Glob("/keybase/team/[")
+	require.Error(t, err)
+}
+
+func TestQuoteGlob(t *testing.T) {
+	require.Equal(t, "plain name", QuoteGlob("plain name"))
+	require.Equal(t, `\*\?\[a]\\`, QuoteGlob(`*?[a]\`))
+	matched, err := path.Match(QuoteGlob(`*?[a]\`), `*?[a]\`)
+	require.NoError(t, err)
+	require.True(t, matched)
+}
+
+func TestDeleteRecursive(t *testing.T) {
+	ko, dir := setupFakeKBFS(t)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, ko.DeleteRecursive("/keybase/team/a.ssh"))
+	exists, err := ko.FileExists("/keybase/team/a.ssh/kssh-client.config")
+	require.NoError(t, err)
+	require.False(t, exists)
+	exists, err = ko.FileExists("/keybase/team/b.ssh/kssh-client.config")
+	require.NoError(t, err)
+	require.True(t, exists)
+}
+
+func TestReadIfExists(t *testing.T) {
+	ko, dir := setupFakeKBFS(t)
+	defer os.RemoveAll(dir)
+
+	contents, exists, err := ko.ReadIfExists("/keybase/team/a.ssh/kssh-client.config")
+	require.NoError(t, err)
+	require.True(t, exists)
+	require.Equal(t, "contents", string(contents))
+
+	contents, exists, err = ko.ReadIfExists("/keybase/team/a.ssh/missing")
+	require.NoError(t, err)
+	require.False(t, exists)
+	require.Nil(t, contents)
+}
@@ -0,0 +1,167 @@
+package kbfs
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// A Revision is a KBFS revision number. Every write to a KBFS folder creates a new revision of the folder so the
+// revisions of a single file are increasing but not consecutive.
+type Revision int64
+
+// A FileVersion identifies the contents of a KBFS file as returned by ReadVersion so that WriteIfUnchanged can detect
+// whether the file was changed by someone else (eg another CA instance) in the meantime
+type FileVersion struct {
+	Exists bool
+	// The latest revision of the file. 0 if the file does not exist or the keybase client does not report revisions,
+	// in which case only the checksum is compared.
+	Revision Revision
+	// The SHA256 checksum of the contents of the file
+	Checksum [sha256.Size]byte
+}
+
+// A ConflictError is returned by WriteIfUnchanged if the file was changed since it was read. The caller should read
+// the file again, reapply its change, and retry.
+type ConflictError struct {
+	Filename string
+	Reason   string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("conflicting write to %s: %s", e.Filename, e.Reason)
+}
+
+// IsConflict returns whether the given error is a ConflictError
+func IsConflict(err error) bool {
+	_, ok := err.(*ConflictError)
+	return ok
+}
+
+// Matches the revision at the start of a line of `keybase fs history` output (eg "42", "rev 42", or "Revision #42").
+// Other lines such as headers are skipped.
+var historyRevisionRegex = regexp.MustCompile(`(?i)^\s*(?:rev(?:ision)?\s*:?\s*)?#?(\d+)(?:\s|$)`)
+
+// History returns the revisions of the given KBFS file, newest first. Always uses `keybase fs history` since the FUSE
+// mount does not expose revisions.
+func (ko *Operation) History(filename string) ([]Revision, error) {
+	cmd, err := ko.fsCommand("history", filename)
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the history of %s: %s (%v)", filename, shared.RedactOutput(output), err)
+	}
+	return parseHistory(string(output)), nil
+}
+
+// Parses the output of `keybase fs history` into revisions sorted newest first
+func parseHistory(output string) []Revision {
+	var revisions []Revision
+	seen := make(map[Revision]bool)
+	for _, line := range strings.Split(output, "\n") {
+		match := historyRevisionRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		revision, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil || seen[Revision(revision)] {
+			continue
+		}
+		seen[Revision(revision)] = true
+		revisions = append(revisions, Revision(revision))
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i] > revisions[j] })
+	return revisions
+}
+
+// ReadAtRevision reads the specified KBFS file as it was at the given revision (as returned by History). Always uses
+// `keybase fs read --rev` since the FUSE mount only serves the latest revision.
+func (ko *Operation) ReadAtRevision(filename string, revision Revision) ([]byte, error) {
+	cmd, err := ko.fsCommand("read", filename, "--rev", strconv.FormatInt(int64(revision), 10))
+	if err != nil {
+		return nil, err
+	}
+	bytes, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s at revision %d: %s (%v)", filename, revision, shared.RedactOutput(bytes), err)
+	}
+	return bytes, nil
+}
+
+// Returns the latest revision of the given file or 0 if it is unknown
+func (ko *Operation) latestRevision(filename string) Revision {
+	revisions, err := ko.History(filename)
+	if err != nil || len(revisions) == 0 {
+		// Older keybase clients do not support `keybase fs history` so fall back to only comparing checksums
+		return 0
+	}
+	return revisions[0]
+}
+
+// ReadVersion reads the specified KBFS file along with its version. Pass the version to WriteIfUnchanged in order to
+// only write the file if no one else changed it since. Returns an empty FileVersion (and no error) if the file does
+// not exist.
+func (ko *Operation) ReadVersion(filename string) ([]byte, FileVersion, error) {
+	// Get the revision first so that a write that races with the read makes the version stale rather than current
+	revision := ko.latestRevision(filename)
+	contents, exists, err := ko.ReadIfExists(filename)
+	if err != nil || !exists {
+		return nil, FileVersion{}, err
+	}
+	return contents, FileVersion{Exists: true, Revision: revision, Checksum: sha256.Sum256(contents)}, nil
+}
+
+// WriteIfUnchanged overwrites the specified KBFS file with contents (see WriteVerified) if its version still matches
+// the given one (as returned by ReadVersion) and returns a ConflictError otherwise. KBFS does not support atomic
+// compare-and-swap so the history of the file is checked after writing as well: if another write landed between the
+// check and this write, a ConflictError is returned even though this write succeeded since it may have overwritten
+// the other one.
+func (ko *Operation) WriteIfUnchanged(filename string, contents string, version FileVersion) error {
+	current, currentVersion, err := ko.ReadVersion(filename)
+	if err != nil {
+		return err
+	}
+	if currentVersion.Exists != version.Exists {
+		return &ConflictError{Filename: filename, Reason: "the file was created or deleted since it was read"}
+	}
+	if currentVersion.Checksum != version.Checksum {
+		return &ConflictError{Filename: filename, Reason: "the contents of the file changed since it was read"}
+	}
+	if version.Revision != 0 && currentVersion.Revision != version.Revision {
+		return &ConflictError{Filename: filename, Reason: fmt.Sprintf("the file was rewritten at revision %d", currentVersion.Revision)}
+	}
+	if string(current) == contents {
+		return nil
+	}
+
+	err = ko.WriteVerified(filename, contents)
+	if err != nil {
+		return err
+	}
+	if currentVersion.Revision == 0 {
+		return nil
+	}
+	revisions, err := ko.History(filename)
+	if err != nil {
+		return nil
+	}
+	var newer int
+	for _, revision := range revisions {
+		if revision > currentVersion.Revision {
+			newer++
+		}
+	}
+	// A write that WriteVerified had to retry also shows up as more than one revision. It is reported as a conflict
+	// too since it cannot be told apart from someone else's write.
+	if newer > 1 {
+		return &ConflictError{Filename: filename, Reason: "the file was written concurrently by someone else"}
+	}
+	return nil
+}
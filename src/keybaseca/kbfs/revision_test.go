@@ -0,0 +1,94 @@
+package kbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHistory(t *testing.T) {
+	require.Equal(t, []Revision{42, 17, 3}, parseHistory("Revision\tTime\tWriter\n3\t2020-01-01\talice\n42\t2020-01-03\tbob\n17\t2020-01-02\talice\n"))
+	require.Equal(t, []Revision{8, 7}, parseHistory("rev 7 by alice\nRevision #8 by bob\n"))
+	require.Empty(t, parseHistory("2020-01-01T00:00:00Z alice\n"))
+	require.Empty(t, parseHistory(""))
+}
+
+func TestRevisions(t *testing.T) {
+	ko, dir := setupFakeKBFS(t)
+	defer os.RemoveAll(dir)
+	filename := "/keybase/team/a.ssh/lockdown.json"
+
+	require.NoError(t, ko.Write(filename, "first", false))
+	require.NoError(t, ko.Write(filename, "second", false))
+	revisions, err := ko.History(filename)
+	require.NoError(t, err)
+	require.Len(t, revisions, 2)
+	require.True(t, revisions[0] > revisions[1])
+
+	contents, err := ko.ReadAtRevision(filename, revisions[1])
+	require.NoError(t, err)
+	require.Equal(t, "first", string(contents))
+	contents, err = ko.ReadAtRevision(filename, revisions[0])
+	require.NoError(t, err)
+	require.Equal(t, "second", string(contents))
+
+	_, err = ko.History("/keybase/team/a.ssh/missing")
+	require.Error(t, err)
+}
+
+func TestWriteIfUnchanged(t *testing.T) {
+	ko, dir := setupFakeKBFS(t)
+	defer os.RemoveAll(dir)
+	verifiedWriteRetryDelay = 0
+	filename := "/keybase/team/a.ssh/lockdown.json"
+
+	// A file that does not exist yet
+	contents, version, err := ko.ReadVersion(filename)
+	require.NoError(t, err)
+	require.Nil(t, contents)
+	require.False(t, version.Exists)
+	require.NoError(t, ko.WriteIfUnchanged(filename, "first", version))
+
+	// An unchanged file
+	contents, version, err = ko.ReadVersion(filename)
+	require.NoError(t, err)
+	require.Equal(t, "first", string(contents))
+	require.True(t, version.Exists)
+	require.NotZero(t, version.Revision)
+	require.NoError(t, ko.WriteIfUnchanged(filename, "second", version))
+
+	// A file that someone else changed in the meantime is not overwritten
+	_, version, err = ko.ReadVersion(filename)
+	require.NoError(t, err)
+	require.NoError(t, ko.Write(filename, "someone else", false))
+	err = ko.WriteIfUnchanged(filename, "third", version)
+	require.Error(t, err)
+	require.True(t, IsConflict(err))
+	contents, err = ko.Read(filename)
+	require.NoError(t, err)
+	require.Equal(t, "someone else", string(contents))
+
+	// Even if they wrote the same contents
+	_, version, err = ko.ReadVersion(filename)
+	require.NoError(t, err)
+	require.NoError(t, ko.Write(filename, "someone else", false))
+	require.True(t, IsConflict(ko.WriteIfUnchanged(filename, "third", version)))
+
+	// A file that was created in the meantime
+	_, version, err = ko.ReadVersion("/keybase/team/a.ssh/new")
+	require.NoError(t, err)
+	require.NoError(t, ko.Write("/keybase/team/a.ssh/new", "", false))
+	require.True(t, IsConflict(ko.WriteIfUnchanged("/keybase/team/a.ssh/new", "contents", version)))
+
+	// More than one new revision after writing (here because a partial write was retried) is reported as a conflict
+	_, version, err = ko.ReadVersion(filename)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "root", "partial-writes"), []byte("1"), 0600))
+	require.True(t, IsConflict(ko.WriteIfUnchanged(filename, "fourth", version)))
+	contents, err = ko.Read(filename)
+	require.NoError(t, err)
+	require.Equal(t, "fourth", string(contents))
+}
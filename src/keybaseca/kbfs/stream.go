@@ -0,0 +1,106 @@
+package kbfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ReadStream opens the specified KBFS file for streaming reads. Unlike Read, the contents are never buffered in
+// memory in their entirety which makes it suitable for large files such as audit logs and backups. The caller must
+// call Close which returns an error if the read failed.
+func (ko *Operation) ReadStream(filename string) (io.ReadCloser, error) {
+	if ko.useFuse() {
+		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
+		return os.Open(filename)
+	}
+	cmd, err := ko.fsCommand("read", filename)
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stream := &cmdStream{cmd: cmd, pipe: stdout, description: "read " + filename}
+	cmd.Stderr = &stream.stderr
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", filename, err)
+	}
+	return cmdReader{Reader: stdout, cmdStream: stream}, nil
+}
+
+// WriteStream opens the specified KBFS file for streaming writes. If appendToFile, appends onto the end of the file.
+// Otherwise, overwrites and truncates the file. The caller must call Close which returns an error if the write failed.
+func (ko *Operation) WriteStream(filename string, appendToFile bool) (io.WriteCloser, error) {
+	if ko.useFuse() {
+		// Note that this code is not tested via integration tests since fuse does not run in docker. Handle with care.
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if appendToFile {
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		return os.OpenFile(filename, flags, 0600)
+	}
+	var flags []string
+	if appendToFile {
+		// `keybase fs write --append` only works if the file already exists so create it if it does not exist
+		exists, err := ko.FileExists(filename)
+		if !exists || err != nil {
+			err = ko.Write(filename, "", false)
+			if err != nil {
+				return nil, err
+			}
+		}
+		flags = []string{"--append"}
+	}
+	cmd, err := ko.fsCommand("write", filename, flags...)
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stream := &cmdStream{cmd: cmd, pipe: stdin, description: "write to file at " + filename}
+	cmd.Stdout = &stream.stderr
+	cmd.Stderr = &stream.stderr
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write to file at %s: %v", filename, err)
+	}
+	return cmdWriter{Writer: stdin, cmdStream: stream}, nil
+}
+
+// cmdStream waits for a running `keybase fs` command to exit once the pipe to it is closed
+type cmdStream struct {
+	cmd         *exec.Cmd
+	pipe        io.Closer
+	stderr      bytes.Buffer
+	description string
+}
+
+// Close closes the pipe and waits for the command to exit
+func (s *cmdStream) Close() error {
+	closeErr := s.pipe.Close()
+	err := s.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("failed to %s: %s (%v)", s.description, strings.TrimSpace(s.stderr.String()), err)
+	}
+	return closeErr
+}
+
+// cmdReader is an io.ReadCloser that reads the stdout of a `keybase fs` command
+type cmdReader struct {
+	io.Reader
+	*cmdStream
+}
+
+// cmdWriter is an io.WriteCloser that writes to the stdin of a `keybase fs` command
+type cmdWriter struct {
+	io.Writer
+	*cmdStream
+}
@@ -0,0 +1,43 @@
+package kbfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreams(t *testing.T) {
+	ko, dir := setupFakeKBFS(t)
+	defer os.RemoveAll(dir)
+	filename := "/keybase/team/a.ssh/backup"
+	large := strings.Repeat("0123456789abcdef", 1<<16)
+
+	writer, err := ko.WriteStream(filename, false)
+	require.NoError(t, err)
+	_, err = io.Copy(writer, strings.NewReader(large))
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	writer, err = ko.WriteStream(filename, true)
+	require.NoError(t, err)
+	_, err = io.WriteString(writer, "appended")
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+
+	reader, err := ko.ReadStream(filename)
+	require.NoError(t, err)
+	contents, err := ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+	require.Equal(t, large+"appended", string(contents))
+
+	reader, err = ko.ReadStream("/keybase/team/a.ssh/missing")
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(reader)
+	require.NoError(t, err)
+	require.Error(t, reader.Close())
+}
@@ -0,0 +1,58 @@
+package kbfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"time"
+)
+
+// The number of times WriteVerified attempts to write a file before giving up
+const verifiedWriteAttempts = 3
+
+// How long WriteVerified waits before retrying a write that failed verification
+var verifiedWriteRetryDelay = time.Second
+
+// WriteVerified overwrites the specified KBFS file with contents and then re-reads it to verify that its checksum
+// matches, retrying on a mismatch. Used for critical files since `keybase fs write` has been observed to fail silently
+// or only write part of a file.
+func (ko *Operation) WriteVerified(filename string, contents string) error {
+	expected := sha256.Sum256([]byte(contents))
+	var err error
+	for attempt := 1; attempt <= verifiedWriteAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(verifiedWriteRetryDelay)
+		}
+		err = ko.Write(filename, contents, false)
+		if err != nil {
+			continue
+		}
+		err = ko.verifyChecksum(filename, expected[:])
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to write %s after %d attempts: %v", filename, verifiedWriteAttempts, err)
+}
+
+// Returns an error if the SHA256 checksum of the specified KBFS file does not match expected
+func (ko *Operation) verifyChecksum(filename string, expected []byte) error {
+	reader, err := ko.ReadStream(filename)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, reader)
+	closeErr := reader.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if !bytes.Equal(hash.Sum(nil), expected) {
+		return fmt.Errorf("checksum mismatch after writing %s", filename)
+	}
+	return nil
+}
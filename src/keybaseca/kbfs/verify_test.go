@@ -0,0 +1,29 @@
+package kbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteVerified(t *testing.T) {
+	ko, dir := setupFakeKBFS(t)
+	defer os.RemoveAll(dir)
+	verifiedWriteRetryDelay = 0
+	filename := "/keybase/team/a.ssh/ca.pub"
+	partialWrites := filepath.Join(dir, "root", "partial-writes")
+
+	// Recovers from a partial write
+	require.NoError(t, ioutil.WriteFile(partialWrites, []byte("1"), 0600))
+	require.NoError(t, ko.WriteVerified(filename, "ssh-ed25519 AAAA"))
+	contents, err := ko.Read(filename)
+	require.NoError(t, err)
+	require.Equal(t, "ssh-ed25519 AAAA", string(contents))
+
+	// Gives up if every attempt is partial
+	require.NoError(t, ioutil.WriteFile(partialWrites, []byte("3"), 0600))
+	require.Error(t, ko.WriteVerified(filename, "ssh-ed25519 BBBB"))
+}
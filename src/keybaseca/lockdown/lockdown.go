@@ -0,0 +1,153 @@
+package lockdown
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// State records whether keybaseca is in lockdown. While in lockdown, certificates are only issued to the users listed
+// in BREAK_GLASS_USERS. The state is stored in a file (see LOCKDOWN_LOCATION) so that `keybaseca lockdown` takes effect
+// in a running CA bot without restarting it.
+type State struct {
+	Enabled bool `json:"enabled"`
+	// The user (a Keybase username or a local user running the CLI) who last changed the state
+	ChangedBy string    `json:"changed_by"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+// Get the current lockdown state. A missing state file means that keybaseca is not in lockdown.
+func Get(conf config.Config) (State, error) {
+	var state State
+	bytes, err := readFile(conf.GetLockdownLocation())
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read the lockdown state from %s: %v", conf.GetLockdownLocation(), err)
+	}
+	err = json.Unmarshal(bytes, &state)
+	if err != nil {
+		return state, fmt.Errorf("failed to parse the lockdown state in %s: %v", conf.GetLockdownLocation(), err)
+	}
+	return state, nil
+}
+
+// Set enables or disables lockdown and publishes a LockdownChanged event. changedBy describes who
+// requested the change.
+func Set(conf config.Config, enabled bool, changedBy string) (State, error) {
+	state := State{Enabled: enabled, ChangedBy: changedBy, ChangedAt: time.Now().UTC()}
+	bytes, err := json.Marshal(state)
+	if err != nil {
+		return state, err
+	}
+	err = writeFile(conf.GetLockdownLocation(), bytes)
+	if err != nil {
+		return state, fmt.Errorf("failed to write the lockdown state to %s: %v", conf.GetLockdownLocation(), err)
+	}
+	events.Publish(conf, events.Event{Type: events.LockdownChanged, Username: changedBy, Message: Notice(nil, state)})
+	return state, nil
+}
+
+// IsSigningAllowed returns whether a certificate may be issued to the given user. Returns an error (which should be
+// treated as a denial) if the lockdown state cannot be determined.
+func IsSigningAllowed(conf config.Config, username string) (bool, error) {
+	state, err := Get(conf)
+	if err != nil {
+		return false, err
+	}
+	if !state.Enabled {
+		return true, nil
+	}
+	if IsBreakGlassUser(conf, username) {
+		log.Log(conf, fmt.Sprintf("Allowing break-glass user %s to bypass the lockdown", username))
+		return true, nil
+	}
+	return false, nil
+}
+
+// IsBreakGlassUser returns whether the given user may still be issued certificates while in lockdown
+func IsBreakGlassUser(conf config.Config, username string) bool {
+	for _, user := range conf.GetBreakGlassUsers() {
+		if user == username {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAdmin returns whether the given user may run admin chat commands
+func IsAdmin(conf config.Config, username string) bool {
+	for _, admin := range conf.GetAdmins() {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Notice returns the message that is announced to teams when the lockdown state changes
+func Notice(messages shared.Messages, state State) string {
+	if state.Enabled {
+		return messages.Render(shared.MessageLockdownEnabled, map[string]interface{}{"ChangedBy": state.ChangedBy})
+	}
+	return messages.Render(shared.MessageLockdownLifted, map[string]interface{}{"ChangedBy": state.ChangedBy})
+}
+
+// GenerateCommand generates the chat message used to turn lockdown on or off for the given bot
+func GenerateCommand(enabled bool, botUsername string) string {
+	return fmt.Sprintf("lockdown %s @%s", onOff(enabled), botUsername)
+}
+
+// ParseCommand parses a chat message of the form `lockdown on|off @botUsername`. ok is false if the message is not a
+// lockdown command for the given bot.
+func ParseCommand(msg, botUsername string) (enabled bool, ok bool) {
+	switch strings.TrimSpace(msg) {
+	case GenerateCommand(true, botUsername):
+		return true, true
+	case GenerateCommand(false, botUsername):
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+// Read the file at the given filename via either Keybase simple fs commands or via the local filesystem. Returns an
+// error satisfying os.IsNotExist if the file does not exist.
+func readFile(filename string) ([]byte, error) {
+	if strings.HasPrefix(filename, "/keybase/") {
+		exists, err := constants.GetDefaultKBFSOperationsStruct().FileExists(filename)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, os.ErrNotExist
+		}
+		return constants.GetDefaultKBFSOperationsStruct().Read(filename)
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// Write the file at the given filename via either Keybase simple fs commands or via the local filesystem
+func writeFile(filename string, contents []byte) error {
+	if strings.HasPrefix(filename, "/keybase/") {
+		return constants.GetDefaultKBFSOperationsStruct().WriteVerified(filename, string(contents))
+	}
+	return ioutil.WriteFile(filename, contents, 0600)
+}
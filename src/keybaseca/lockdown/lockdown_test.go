@@ -0,0 +1,70 @@
+package lockdown
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCommand(t *testing.T) {
+	enabled, ok := ParseCommand("lockdown on @cabot", "cabot")
+	require.True(t, ok)
+	require.True(t, enabled)
+	enabled, ok = ParseCommand(" lockdown off @cabot\n", "cabot")
+	require.True(t, ok)
+	require.False(t, enabled)
+
+	_, ok = ParseCommand("lockdown on @otherbot", "cabot")
+	require.False(t, ok)
+	_, ok = ParseCommand("lockdown maybe @cabot", "cabot")
+	require.False(t, ok)
+	_, ok = ParseCommand("ping @cabot", "cabot")
+	require.False(t, ok)
+}
+
+func TestSetAndIsSigningAllowed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lockdown")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("LOCKDOWN_LOCATION", filepath.Join(dir, "lockdown"))
+	os.Setenv("BREAK_GLASS_USERS", "alice, bob")
+	defer os.Unsetenv("LOCKDOWN_LOCATION")
+	defer os.Unsetenv("BREAK_GLASS_USERS")
+	conf := &config.EnvConfig{}
+
+	// No state file means no lockdown
+	state, err := Get(conf)
+	require.NoError(t, err)
+	require.False(t, state.Enabled)
+	allowed, err := IsSigningAllowed(conf, "carol")
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	_, err = Set(conf, true, "dave")
+	require.NoError(t, err)
+	state, err = Get(conf)
+	require.NoError(t, err)
+	require.True(t, state.Enabled)
+	require.Equal(t, "dave", state.ChangedBy)
+	allowed, err = IsSigningAllowed(conf, "carol")
+	require.NoError(t, err)
+	require.False(t, allowed)
+	allowed, err = IsSigningAllowed(conf, "bob")
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	_, err = Set(conf, false, "dave")
+	require.NoError(t, err)
+	allowed, err = IsSigningAllowed(conf, "carol")
+	require.NoError(t, err)
+	require.True(t, allowed)
+
+	// A corrupt state file must be treated as an error rather than as no lockdown
+	require.NoError(t, ioutil.WriteFile(conf.GetLockdownLocation(), []byte("garbage"), 0600))
+	_, err = IsSigningAllowed(conf, "carol")
+	require.Error(t, err)
+}
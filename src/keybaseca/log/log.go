@@ -9,18 +9,23 @@ import (
 	"github.com/keybase/bot-sshca/src/keybaseca/constants"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/shared"
 )
 
 // Log attempts to log the given string to a file. If conf.GetStrictLogging()
 // it will panic if it fails to log to the file. If conf.GetStrictLogging() is
-// false, it may silently fail
+// false, it may silently fail. Secrets are removed from the string first (see
+// shared.Redact).
 func Log(conf config.Config, str string) {
-	strWithTs := fmt.Sprintf("[%s] %s", time.Now().String(), str)
+	strWithTs := fmt.Sprintf("[%s] %s", time.Now().String(), shared.Redact(str))
 
 	if conf.GetLogLocation() == "" {
 		fmt.Print(strWithTs + "\n")
 	} else {
+		writeLock.Lock()
 		err := appendToFile(conf.GetLogLocation(), strWithTs)
+		writeLock.Unlock()
 		if err != nil {
 			if conf.GetStrictLogging() {
 				panic(fmt.Errorf("Failed to log '%s' to %s: %v", strings.TrimSpace(strWithTs), conf.GetLogLocation(), err))
@@ -31,6 +36,22 @@ func Log(conf config.Config, str string) {
 	}
 }
 
+// HandleEvent is an events.Handler that records events in the audit log. Signatures, denials, and errors are not
+// recorded since they are logged in more detail where they happen (signatures before the key is even signed so that
+// strict logging prevents unlogged signatures).
+func HandleEvent(conf config.Config, event events.Event) {
+	switch event.Type {
+	case events.CAKeyRotated:
+		Log(conf, fmt.Sprintf("Generated a new SSH CA key: %s", event.Message))
+	case events.LockdownChanged:
+		Log(conf, fmt.Sprintf("Lockdown changed by %s: %s", event.Username, event.Message))
+	case events.ConfigLoaded:
+		Log(conf, event.Message)
+	case events.CanaryTriggered:
+		Log(conf, fmt.Sprintf("CANARY triggered keyID:%s: %s", event.KeyID, event.Message))
+	}
+}
+
 // Append to the file at the given filename via either Keybase simple fs
 // commands or via standard interactions with the local filesystem
 func appendToFile(filename string, str string) error {
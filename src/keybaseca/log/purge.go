@@ -0,0 +1,167 @@
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/constants"
+	"github.com/keybase/bot-sshca/src/keybaseca/kbfs"
+)
+
+// Held while the audit log is being written so that entries logged by this process are not lost while it is being
+// purged
+var writeLock sync.Mutex
+
+// Matches the timestamp at the start of every audit log entry, as written by time.Time.String()
+var entryStartRegex = regexp.MustCompile(`\[(\d{4}-\d{2}-\d{2} \d{2}:\d{2}:\d{2}(?:\.\d+)? [+-]\d{4} [^\]\s]+)(?: m=[^\]]*)?\] `)
+
+// The layout of the timestamp of an audit log entry
+const entryTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// Entry is a single entry in the audit log
+type Entry struct {
+	Time time.Time
+	// The full text of the entry including its timestamp
+	Text string
+}
+
+// ParseEntries splits the contents of an audit log into its entries. Entries are separated by their timestamps
+// rather than by newlines since a single entry may contain newlines. Anything before the first timestamp is returned
+// as an entry with a zero time.
+func ParseEntries(contents string) []Entry {
+	var entries []Entry
+	starts := entryStartRegex.FindAllStringSubmatchIndex(contents, -1)
+	if len(starts) == 0 || starts[0][0] > 0 {
+		end := len(contents)
+		if len(starts) > 0 {
+			end = starts[0][0]
+		}
+		if end > 0 {
+			entries = append(entries, Entry{Text: contents[:end]})
+		}
+	}
+	for i, start := range starts {
+		end := len(contents)
+		if i+1 < len(starts) {
+			end = starts[i+1][0]
+		}
+		timestamp, _ := time.Parse(entryTimeLayout, contents[start[2]:start[3]])
+		entries = append(entries, Entry{Time: timestamp, Text: contents[start[0]:end]})
+	}
+	return entries
+}
+
+// PurgeEntries replaces the entries of the given audit log for which shouldPurge returns true with tombstones. Each run
+// of consecutive purged entries is replaced by a single tombstone that records the reason, how many entries were
+// purged, and the SHA-256 of their text so that the remaining log can still be checked against a backup of the
+// original without retaining the purged data. Returns the new contents and the number of purged entries.
+func PurgeEntries(contents string, shouldPurge func(Entry) bool, reason string, now time.Time) (string, int) {
+	var out strings.Builder
+	var run []Entry
+	purged := 0
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		hash := sha256.New()
+		for _, entry := range run {
+			hash.Write([]byte(entry.Text))
+		}
+		fmt.Fprintf(&out, "[%s] PURGED %d audit log entries (%s) sha256:%s\n", now.String(), len(run), reason, hex.EncodeToString(hash.Sum(nil)))
+		purged += len(run)
+		run = nil
+	}
+	for _, entry := range ParseEntries(contents) {
+		if shouldPurge(entry) {
+			run = append(run, entry)
+			continue
+		}
+		flush()
+		out.WriteString(entry.Text)
+	}
+	flush()
+	return out.String(), purged
+}
+
+// How many times Purge retries if the audit log is written by another process while it is being purged
+const purgeAttempts = 3
+
+// Purge removes the entries of the audit log at LOG_LOCATION for which shouldPurge returns true, replacing them with
+// tombstones (see PurgeEntries). Returns the number of purged entries.
+func Purge(conf config.Config, shouldPurge func(Entry) bool, reason string) (int, error) {
+	filename := conf.GetLogLocation()
+	if filename == "" {
+		return 0, nil
+	}
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	for attempt := 0; attempt < purgeAttempts; attempt++ {
+		contents, version, err := readFileVersion(filename)
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read the audit log: %v", err)
+		}
+		purgedContents, purged := PurgeEntries(string(contents), shouldPurge, reason, time.Now())
+		if purged == 0 {
+			return 0, nil
+		}
+		// Another process (eg the running bot when purging via the CLI) may have appended to the log in the meantime
+		err = writeFileIfUnchanged(filename, purgedContents, version)
+		if kbfs.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to write the purged audit log: %v", err)
+		}
+		return purged, nil
+	}
+	return 0, fmt.Errorf("the audit log kept changing while it was being purged")
+}
+
+// Read the given file along with its version (see kbfs.FileVersion) via either Keybase simple fs commands or the local
+// filesystem. Returns an error satisfying os.IsNotExist if the file does not exist.
+func readFileVersion(filename string) ([]byte, kbfs.FileVersion, error) {
+	if strings.HasPrefix(filename, "/keybase/") {
+		contents, version, err := constants.GetDefaultKBFSOperationsStruct().ReadVersion(filename)
+		if err == nil && !version.Exists {
+			err = os.ErrNotExist
+		}
+		return contents, version, err
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, kbfs.FileVersion{}, err
+	}
+	return contents, kbfs.FileVersion{Exists: true, Checksum: sha256.Sum256(contents)}, nil
+}
+
+// Replace the contents of the given file via either Keybase simple fs commands or the local filesystem if it still
+// has the given version. Returns a kbfs.ConflictError otherwise.
+func writeFileIfUnchanged(filename, contents string, version kbfs.FileVersion) error {
+	if strings.HasPrefix(filename, "/keybase/") {
+		return constants.GetDefaultKBFSOperationsStruct().WriteIfUnchanged(filename, contents, version)
+	}
+	current, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if sha256.Sum256(current) != version.Checksum {
+		return &kbfs.ConflictError{Filename: filename, Reason: "the contents of the file changed since it was read"}
+	}
+	tmp := filename + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(contents), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
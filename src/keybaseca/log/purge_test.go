@@ -0,0 +1,76 @@
+package log
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/kbfs"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseEntries(t *testing.T) {
+	first := "[2020-04-01 12:00:00.123456789 +0000 UTC m=+0.001] Processing SignatureRequest from user=alice pubkey:ssh-ed25519 AAAA\n"
+	second := "[2020-04-02 12:00:00 -0700 PDT] Lockdown changed by bob: [not a timestamp]"
+	entries := ParseEntries("garbage" + first + second)
+	require.Len(t, entries, 3)
+	require.Equal(t, Entry{Text: "garbage"}, entries[0])
+	require.Equal(t, first, entries[1].Text)
+	require.True(t, entries[1].Time.Equal(time.Date(2020, 4, 1, 12, 0, 0, 123456789, time.UTC)))
+	require.Equal(t, second, entries[2].Text)
+	require.False(t, entries[2].Time.IsZero())
+}
+
+func TestPurgeEntries(t *testing.T) {
+	entries := []string{
+		"[2020-04-01 12:00:00 +0000 UTC] user=alice\n",
+		"[2020-04-01 13:00:00 +0000 UTC] user=alice again\n",
+		"[2020-04-01 14:00:00 +0000 UTC] user=bob\n",
+		"[2020-04-01 15:00:00 +0000 UTC] user=alice\n",
+	}
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	purged, count := PurgeEntries(strings.Join(entries, ""), func(entry Entry) bool {
+		return strings.Contains(entry.Text, "alice")
+	}, "deletion request", now)
+	require.Equal(t, 3, count)
+	hash := sha256.Sum256([]byte(entries[0] + entries[1]))
+	lines := strings.Split(strings.TrimSuffix(purged, "\n"), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, "["+now.String()+"] PURGED 2 audit log entries (deletion request) sha256:"+hex.EncodeToString(hash[:]), lines[0])
+	require.Equal(t, strings.TrimSuffix(entries[2], "\n"), lines[1])
+	require.Contains(t, lines[2], "PURGED 1 audit log entries")
+	require.NotContains(t, purged, "alice")
+
+	// Tombstones are themselves entries
+	require.Len(t, ParseEntries(purged), 3)
+}
+
+func TestWriteFileIfUnchanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keybaseca-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "ca.log")
+
+	_, _, err = readFileVersion(filename)
+	require.True(t, os.IsNotExist(err))
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("first\n"), 0600))
+	contents, version, err := readFileVersion(filename)
+	require.NoError(t, err)
+	require.Equal(t, "first\n", string(contents))
+	require.NoError(t, writeFileIfUnchanged(filename, "purged\n", version))
+
+	// The bot appended an entry in the meantime
+	_, version, err = readFileVersion(filename)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filename, []byte("purged\nappended\n"), 0600))
+	require.True(t, kbfs.IsConflict(writeFileIfUnchanged(filename, "purged again\n", version)))
+	contents, err = ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, "purged\nappended\n", string(contents))
+}
@@ -0,0 +1,293 @@
+package oidc
+
+/*
+oidc implements the OAuth 2.0 device authorization grant (RFC 8628) against an OpenID Connect provider. It is used by
+keybaseca to require users to complete an MFA-backed login with a corporate identity provider before a certificate is
+issued. The CA starts a device authorization, sends the verification URL to kssh over chat, and polls the provider's
+token endpoint until the user has logged in. The claims in the resulting ID token are then checked against the Keybase
+user that sent the signature request.
+*/
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The scopes requested from the identity provider
+const scopes = "openid profile email"
+
+// The polling interval used if the identity provider does not specify one (see RFC 8628 section 3.2)
+const defaultInterval = 5 * time.Second
+
+// Swapped out in tests so that polling does not actually sleep
+var sleep = time.Sleep
+
+// Provider is an OpenID Connect identity provider that supports the device authorization grant
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// The ID token claim that contains the user's username. An email address is mapped to its local part.
+	UsernameClaim string
+	// The user must have authenticated with at least one of these authentication methods (the ID token's amr claim)
+	RequiredAMR []string
+	HTTPClient  *http.Client
+
+	endpoints *Endpoints
+}
+
+// Endpoints are the endpoints published in the provider's discovery document
+type Endpoints struct {
+	Issuer                      string `json:"issuer"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+}
+
+// DeviceAuthorization is the response from the device authorization endpoint
+type DeviceAuthorization struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// AuthenticationError is returned when the user did not complete a login that satisfies the CA's requirements (eg they
+// declined the login, logged in as a different user, or did not use MFA)
+type AuthenticationError struct {
+	Reason string
+}
+
+func (e AuthenticationError) Error() string {
+	return fmt.Sprintf("identity provider authentication failed: %s", e.Reason)
+}
+
+func (p *Provider) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// Discover fetches and caches the provider's discovery document
+func (p *Provider) Discover() (*Endpoints, error) {
+	if p.endpoints != nil {
+		return p.endpoints, nil
+	}
+	resp, err := p.httpClient().Get(strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the OIDC discovery document: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch the OIDC discovery document: HTTP %d", resp.StatusCode)
+	}
+	var endpoints Endpoints
+	err = json.NewDecoder(resp.Body).Decode(&endpoints)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the OIDC discovery document: %v", err)
+	}
+	if endpoints.Issuer != p.Issuer {
+		return nil, fmt.Errorf("the OIDC discovery document is for the issuer '%s' rather than '%s'", endpoints.Issuer, p.Issuer)
+	}
+	if endpoints.DeviceAuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" {
+		return nil, fmt.Errorf("the identity provider %s does not support the device authorization grant", p.Issuer)
+	}
+	p.endpoints = &endpoints
+	return p.endpoints, nil
+}
+
+// StartDeviceAuthorization starts a new device authorization. The user must visit the returned verification URI to
+// complete it.
+func (p *Provider) StartDeviceAuthorization() (DeviceAuthorization, error) {
+	var auth DeviceAuthorization
+	endpoints, err := p.Discover()
+	if err != nil {
+		return auth, err
+	}
+	status, body, err := p.post(endpoints.DeviceAuthorizationEndpoint, url.Values{"scope": {scopes}})
+	if err != nil {
+		return auth, fmt.Errorf("failed to start a device authorization: %v", err)
+	}
+	if status != http.StatusOK {
+		return auth, fmt.Errorf("failed to start a device authorization: HTTP %d: %s", status, strings.TrimSpace(string(body)))
+	}
+	err = json.Unmarshal(body, &auth)
+	if err != nil {
+		return auth, fmt.Errorf("failed to parse the device authorization: %v", err)
+	}
+	if auth.DeviceCode == "" || auth.VerificationURI == "" {
+		return auth, fmt.Errorf("the device authorization is missing a device code or verification URI")
+	}
+	return auth, nil
+}
+
+// WaitForLogin polls the token endpoint until the user completes (or declines) the given device authorization and
+// returns the claims in the issued ID token
+func (p *Provider) WaitForLogin(auth DeviceAuthorization) (map[string]interface{}, error) {
+	endpoints, err := p.Discover()
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(auth.Interval) * time.Second
+	if auth.Interval <= 0 {
+		interval = defaultInterval
+	}
+	deadline := time.Now().Add(time.Duration(auth.ExpiresIn) * time.Second)
+	for {
+		sleep(interval)
+		if auth.ExpiresIn > 0 && time.Now().After(deadline) {
+			return nil, AuthenticationError{Reason: "the login was not completed in time"}
+		}
+		status, body, err := p.post(endpoints.TokenEndpoint, url.Values{
+			"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+			"device_code": {auth.DeviceCode},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to poll the token endpoint: %v", err)
+		}
+		var token struct {
+			IDToken string `json:"id_token"`
+			Error   string `json:"error"`
+		}
+		err = json.Unmarshal(body, &token)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the token response (HTTP %d): %v", status, err)
+		}
+		switch token.Error {
+		case "":
+			if status != http.StatusOK || token.IDToken == "" {
+				return nil, fmt.Errorf("the token response did not include an ID token (HTTP %d)", status)
+			}
+			return parseIDToken(token.IDToken)
+		case "authorization_pending":
+			continue
+		case "slow_down":
+			interval += 5 * time.Second
+			continue
+		case "access_denied":
+			return nil, AuthenticationError{Reason: "the login was declined"}
+		case "expired_token":
+			return nil, AuthenticationError{Reason: "the login was not completed in time"}
+		default:
+			return nil, fmt.Errorf("the token endpoint returned an error: %s", token.Error)
+		}
+	}
+}
+
+// VerifyClaims checks that the given ID token claims were issued for this CA to the given Keybase user after an
+// authentication that used one of the required methods.
+//
+// The signature of the ID token is not checked. The token is received directly from the token endpoint over TLS using
+// the device code that only the CA knows, which OpenID Connect Core section 3.1.3.7 permits in place of checking the
+// signature.
+func (p *Provider) VerifyClaims(claims map[string]interface{}, keybaseUsername string, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != p.Issuer {
+		return fmt.Errorf("the ID token was issued by '%s' rather than '%s'", iss, p.Issuer)
+	}
+	if !containsString(stringList(claims["aud"]), p.ClientID) {
+		return fmt.Errorf("the ID token was not issued for the client ID '%s'", p.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("the ID token has expired")
+	}
+	if len(p.RequiredAMR) > 0 {
+		amr := stringList(claims["amr"])
+		satisfied := false
+		for _, method := range p.RequiredAMR {
+			if containsString(amr, method) {
+				satisfied = true
+			}
+		}
+		if !satisfied {
+			return AuthenticationError{Reason: fmt.Sprintf("the login did not use one of the required authentication "+
+				"methods (%s), got (%s)", strings.Join(p.RequiredAMR, ","), strings.Join(amr, ","))}
+		}
+	}
+	username, _ := claims[p.UsernameClaim].(string)
+	if username == "" {
+		return AuthenticationError{Reason: fmt.Sprintf("the ID token does not include the %s claim", p.UsernameClaim)}
+	}
+	if !strings.EqualFold(MapUsername(username), keybaseUsername) {
+		return AuthenticationError{Reason: fmt.Sprintf("logged in to the identity provider as '%s' which does not "+
+			"match the Keybase user '%s'", username, keybaseUsername)}
+	}
+	return nil
+}
+
+// MapUsername maps a username from the identity provider to the expected Keybase username. Email addresses are mapped
+// to their local part.
+func MapUsername(username string) string {
+	if idx := strings.LastIndex(username, "@"); idx >= 0 {
+		return username[:idx]
+	}
+	return username
+}
+
+// POST the given form (along with the client credentials) to the given URL and return the status code and body
+func (p *Provider) post(endpoint string, form url.Values) (int, []byte, error) {
+	form.Set("client_id", p.ClientID)
+	if p.ClientSecret != "" {
+		form.Set("client_secret", p.ClientSecret)
+	}
+	resp, err := p.httpClient().PostForm(endpoint, form)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// Parse the claims out of the given JWT without checking its signature
+func parseIDToken(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("the ID token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the ID token: %v", err)
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the ID token: %v", err)
+	}
+	return claims, nil
+}
+
+// Convert a claim that is either a string or a list of strings into a list of strings
+func stringList(claim interface{}) []string {
+	switch value := claim.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var list []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	default:
+		return nil
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
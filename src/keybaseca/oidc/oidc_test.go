@@ -0,0 +1,97 @@
+package oidc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeIDToken(t *testing.T, claims map[string]interface{}) string {
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString(payload) + ".signature"
+}
+
+// Start a fake identity provider that requires pendingPolls polls of the token endpoint before the login completes
+func startFakeProvider(t *testing.T, pendingPolls int, claims map[string]interface{}) (*httptest.Server, *Provider) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer": "%s", "device_authorization_endpoint": "%s/device", "token_endpoint": "%s/token"}`,
+			server.URL, server.URL, server.URL)
+	})
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "kssh", r.PostFormValue("client_id"))
+		fmt.Fprint(w, `{"device_code": "dc", "user_code": "ABCD-EFGH", "verification_uri": "https://idp/activate", "expires_in": 600}`)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "dc", r.PostFormValue("device_code"))
+		if pendingPolls > 0 {
+			pendingPolls--
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error": "authorization_pending"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"access_token": "at", "id_token": "%s"}`, makeIDToken(t, claims))
+	})
+	return server, &Provider{Issuer: server.URL, ClientID: "kssh", UsernameClaim: "email", RequiredAMR: []string{"mfa"}}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	sleep = func(time.Duration) {}
+	defer func() { sleep = time.Sleep }()
+
+	claims := map[string]interface{}{"email": "alice@example.com", "amr": []string{"pwd", "mfa"}, "aud": "kssh",
+		"exp": time.Now().Add(time.Hour).Unix()}
+	server, provider := startFakeProvider(t, 2, claims)
+	defer server.Close()
+	claims["iss"] = server.URL
+
+	auth, err := provider.StartDeviceAuthorization()
+	require.NoError(t, err)
+	require.Equal(t, "ABCD-EFGH", auth.UserCode)
+	require.Equal(t, "https://idp/activate", auth.VerificationURI)
+
+	parsed, err := provider.WaitForLogin(auth)
+	require.NoError(t, err)
+	require.NoError(t, provider.VerifyClaims(parsed, "alice", time.Now()))
+	require.IsType(t, AuthenticationError{}, provider.VerifyClaims(parsed, "mallory", time.Now()))
+}
+
+func TestVerifyClaims(t *testing.T) {
+	provider := &Provider{Issuer: "https://idp", ClientID: "kssh", UsernameClaim: "preferred_username", RequiredAMR: []string{"mfa", "hwk"}}
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"iss": "https://idp", "aud": []interface{}{"other", "kssh"}, "amr": []interface{}{"hwk"},
+			"exp": float64(time.Now().Add(time.Hour).Unix()), "preferred_username": "Alice"}
+	}
+	require.NoError(t, provider.VerifyClaims(valid(), "alice", time.Now()))
+
+	claims := valid()
+	claims["iss"] = "https://evil"
+	require.Error(t, provider.VerifyClaims(claims, "alice", time.Now()))
+
+	claims = valid()
+	claims["aud"] = "other"
+	require.Error(t, provider.VerifyClaims(claims, "alice", time.Now()))
+
+	require.Error(t, provider.VerifyClaims(valid(), "alice", time.Now().Add(2*time.Hour)))
+
+	claims = valid()
+	claims["amr"] = []interface{}{"pwd"}
+	require.IsType(t, AuthenticationError{}, provider.VerifyClaims(claims, "alice", time.Now()))
+
+	claims = valid()
+	delete(claims, "preferred_username")
+	require.IsType(t, AuthenticationError{}, provider.VerifyClaims(claims, "alice", time.Now()))
+}
+
+func TestMapUsername(t *testing.T) {
+	require.Equal(t, "alice", MapUsername("alice"))
+	require.Equal(t, "alice", MapUsername("alice@example.com"))
+}
@@ -0,0 +1,204 @@
+package release
+
+/*
+release publishes kssh binaries (as built by buildAll.sh) to the public KBFS folder of the CA bot so that users can
+update kssh via `kssh --self-update`. It is used by `keybaseca publish-release`.
+*/
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/kbfs"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The operating system suffixes used in binary names by buildAll.sh
+var buildOSNames = map[string]string{
+	"linux":   "linux",
+	"mac":     "darwin",
+	"windows": "windows",
+}
+
+// ParseBinaryName returns the platform (see shared.ReleasePlatform) of a kssh binary built by buildAll.sh. Binaries are
+// named kssh-<os> for amd64 and kssh-<os>-<arch> for other architectures. ok is false if the file is not a kssh binary.
+func ParseBinaryName(filename string) (platform string, ok bool) {
+	parts := strings.Split(strings.TrimSuffix(filename, ".exe"), "-")
+	if parts[0] != "kssh" || len(parts) < 2 || len(parts) > 3 {
+		return "", false
+	}
+	goos, ok := buildOSNames[parts[1]]
+	if !ok {
+		return "", false
+	}
+	goarch := "amd64"
+	if len(parts) == 3 {
+		goarch = parts[2]
+	}
+	return shared.ReleasePlatform(goos, goarch), true
+}
+
+// BuildManifest hashes the kssh binaries in binDir and returns the manifest for the given version along with the
+// local path of each binary keyed by platform
+func BuildManifest(version, binDir string) (shared.ReleaseManifest, map[string]string, error) {
+	manifest := shared.ReleaseManifest{Version: version, Binaries: make(map[string]shared.ReleaseBinary)}
+	if !shared.IsValidReleaseVersion(version) {
+		return manifest, nil, fmt.Errorf("invalid release version %q", version)
+	}
+	files, err := ioutil.ReadDir(binDir)
+	if err != nil {
+		return manifest, nil, fmt.Errorf("failed to list the binaries in %s: %v", binDir, err)
+	}
+	localPaths := make(map[string]string)
+	for _, file := range files {
+		platform, ok := ParseBinaryName(file.Name())
+		if !ok || file.IsDir() {
+			continue
+		}
+		localPath := filepath.Join(binDir, file.Name())
+		hash, err := hashFile(localPath)
+		if err != nil {
+			return manifest, nil, err
+		}
+		manifest.Binaries[platform] = shared.ReleaseBinary{Path: path.Join(version, "kssh-"+platform), SHA256: hash}
+		localPaths[platform] = localPath
+	}
+	if len(localPaths) == 0 {
+		return manifest, nil, fmt.Errorf("no kssh binaries found in %s (run ./buildAll.sh first)", binDir)
+	}
+	return manifest, localPaths, nil
+}
+
+// Signer creates detached saltpack signatures with the key of the logged in Keybase user
+type Signer struct {
+	KeybaseBinaryPath string
+	// The home directory of the Keybase instance to use. May be empty.
+	HomeDir string
+}
+
+// Sign returns an armored detached signature of the given local file
+func (s Signer) Sign(filename string) ([]byte, error) {
+	var args []string
+	if s.HomeDir != "" {
+		args = append(args, "--home", s.HomeDir)
+	}
+	args = append(args, "sign", "--detached", "--infile", filename)
+	cmd, err := shared.Command(s.KeybaseBinaryPath, args...)
+	if err != nil {
+		return nil, err
+	}
+	output, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("failed to sign %s: %s (%v)", filename, strings.TrimSpace(string(exitErr.Stderr)), err)
+		}
+		return nil, fmt.Errorf("failed to sign %s: %v", filename, err)
+	}
+	return output, nil
+}
+
+// Publish uploads the kssh binaries in binDir to the release directory of the given bot along with a signed manifest.
+// The manifest is written last so that clients never see a manifest that refers to binaries that were not yet
+// uploaded.
+func Publish(ko *kbfs.Operation, signer Signer, botName, version, binDir string) (shared.ReleaseManifest, error) {
+	manifest, localPaths, err := BuildManifest(version, binDir)
+	if err != nil {
+		return manifest, err
+	}
+	releaseDir := shared.ReleaseDirectory(botName)
+
+	var platforms []string
+	for platform := range localPaths {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	for _, platform := range platforms {
+		localPath := localPaths[platform]
+		signature, err := signer.Sign(localPath)
+		if err != nil {
+			return manifest, err
+		}
+		remotePath := path.Join(releaseDir, manifest.Binaries[platform].Path)
+		err = uploadFile(ko, localPath, remotePath)
+		if err != nil {
+			return manifest, err
+		}
+		err = ko.Write(remotePath+shared.ReleaseSignatureSuffix, string(signature), false)
+		if err != nil {
+			return manifest, err
+		}
+	}
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	tempFile, err := ioutil.TempFile("", "kssh-manifest")
+	if err != nil {
+		return manifest, err
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.Write(manifestBytes)
+	tempFile.Close()
+	if err != nil {
+		return manifest, err
+	}
+	signature, err := signer.Sign(tempFile.Name())
+	if err != nil {
+		return manifest, err
+	}
+	manifestPath := path.Join(releaseDir, shared.ReleaseManifestFilename)
+	err = ko.Write(manifestPath, string(manifestBytes), false)
+	if err != nil {
+		return manifest, err
+	}
+	err = ko.Write(manifestPath+shared.ReleaseSignatureSuffix, string(signature), false)
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, nil
+}
+
+// Copy the given local file into KBFS without buffering it in memory
+func uploadFile(ko *kbfs.Operation, localPath, remotePath string) error {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := ko.WriteStream(remotePath, false)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	closeErr := w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %v", localPath, err)
+	}
+	return closeErr
+}
+
+// Returns the hex encoded SHA256 hash of the given local file
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash %s: %v", filename, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,51 @@
+package release
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBinaryName(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"kssh-linux":       "linux-amd64",
+		"kssh-linux-arm64": "linux-arm64",
+		"kssh-mac":         "darwin-amd64",
+		"kssh-windows":     "windows-amd64",
+		"kssh-windows.exe": "windows-amd64",
+	} {
+		platform, ok := ParseBinaryName(filename)
+		require.True(t, ok, filename)
+		require.Equal(t, expected, platform, filename)
+	}
+	for _, filename := range []string{"kssh", "keybaseca-linux", "ksshd-agent-linux", "kssh-freebsd", "kssh-linux-arm64-extra"} {
+		_, ok := ParseBinaryName(filename)
+		require.False(t, ok, filename)
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "release")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	_, _, err = BuildManifest("1.0.0", dir)
+	require.Error(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kssh-linux"), []byte("linux"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "kssh-mac"), []byte("mac"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "keybaseca-linux"), []byte("keybaseca"), 0755))
+	manifest, localPaths, err := BuildManifest("1.0.0-abc123", dir)
+	require.NoError(t, err)
+	require.Equal(t, "1.0.0-abc123", manifest.Version)
+	require.Len(t, manifest.Binaries, 2)
+	require.Equal(t, "1.0.0-abc123/kssh-linux-amd64", manifest.Binaries["linux-amd64"].Path)
+	require.Equal(t, "caf90169eefa5f807d577486b9f795ab86ae2983c5c20806cff959117e90af18", manifest.Binaries["linux-amd64"].SHA256)
+	require.Equal(t, filepath.Join(dir, "kssh-mac"), localPaths["darwin-amd64"])
+
+	_, _, err = BuildManifest("../1.0.0", dir)
+	require.Error(t, err)
+}
@@ -0,0 +1,94 @@
+package retention
+
+/*
+retention removes audit data (audit log entries and issuance store records) once it is older than
+AUDIT_RETENTION_DAYS and on request for a single user (eg to honor a legal deletion request). Purged audit log entries
+are replaced by tombstones so that it is still evident that, and when, something was removed.
+*/
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/keybaseca/store"
+)
+
+// Result describes what was purged
+type Result struct {
+	AuditLogEntries int
+	IssuanceRecords int
+}
+
+// PurgeExpired purges audit log entries and issuance records that are older than AUDIT_RETENTION_DAYS. Does nothing if
+// no retention is configured.
+func PurgeExpired(conf config.Config, now time.Time) (result Result, err error) {
+	if conf.GetAuditRetention() == 0 {
+		return result, nil
+	}
+	cutoff := now.Add(-conf.GetAuditRetention())
+	reason := fmt.Sprintf("older than the retention of %d days", int(conf.GetAuditRetention()/(24*time.Hour)))
+	result.AuditLogEntries, err = log.Purge(conf, func(entry log.Entry) bool {
+		return !entry.Time.IsZero() && entry.Time.Before(cutoff)
+	}, reason)
+	if err != nil {
+		return result, err
+	}
+	if conf.GetIssuanceStore() != "" {
+		var s *store.Store
+		s, err = store.Open(conf.GetIssuanceStore())
+		if err != nil {
+			return result, err
+		}
+		result.IssuanceRecords, err = s.Delete(store.Filter{Until: cutoff})
+		if err != nil {
+			return result, fmt.Errorf("failed to purge the issuance store: %v", err)
+		}
+	}
+	logResult(conf, result, reason)
+	return result, nil
+}
+
+// PurgeUser purges every audit log entry that mentions the given Keybase user and every issuance record for them. The
+// username itself is not recorded in the tombstones or in the audit log entry describing the purge; reason (eg a
+// ticket number) is.
+func PurgeUser(conf config.Config, username, reason string) (result Result, err error) {
+	if username == "" {
+		return result, fmt.Errorf("a username is required")
+	}
+	reason = "deletion request: " + reason
+	mentionsUser := usernameRegex(username)
+	result.AuditLogEntries, err = log.Purge(conf, func(entry log.Entry) bool {
+		return mentionsUser.MatchString(entry.Text)
+	}, reason)
+	if err != nil {
+		return result, err
+	}
+	if conf.GetIssuanceStore() != "" {
+		var s *store.Store
+		s, err = store.Open(conf.GetIssuanceStore())
+		if err != nil {
+			return result, err
+		}
+		result.IssuanceRecords, err = s.Delete(store.Filter{Username: username})
+		if err != nil {
+			return result, fmt.Errorf("failed to purge the issuance store: %v", err)
+		}
+	}
+	logResult(conf, result, reason)
+	return result, nil
+}
+
+// Matches the given username as a whole word. Keybase usernames only contain letters, numbers, and underscores.
+func usernameRegex(username string) *regexp.Regexp {
+	return regexp.MustCompile(`(?i)(^|[^a-z0-9_])` + regexp.QuoteMeta(username) + `($|[^a-z0-9_])`)
+}
+
+func logResult(conf config.Config, result Result, reason string) {
+	if result.AuditLogEntries == 0 && result.IssuanceRecords == 0 {
+		return
+	}
+	log.Log(conf, fmt.Sprintf("Purged %d audit log entries and %d issuance records (%s)", result.AuditLogEntries, result.IssuanceRecords, reason))
+}
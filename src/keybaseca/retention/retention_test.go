@@ -0,0 +1,49 @@
+package retention
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keybaseca-retention")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "ca.log")
+	os.Setenv("LOG_LOCATION", logFile)
+	os.Setenv("AUDIT_RETENTION_DAYS", "30")
+	defer os.Unsetenv("LOG_LOCATION")
+	defer os.Unsetenv("AUDIT_RETENTION_DAYS")
+	conf := &config.EnvConfig{}
+
+	now := time.Now()
+	old := now.Add(-60 * 24 * time.Hour)
+	contents := "[" + old.String() + "] Processing SignatureRequest from user=carol\n" +
+		"[" + now.String() + "] Processing SignatureRequest from user=alice keyID:a:b:alice\n" +
+		"[" + now.String() + "] Processing SignatureRequest from user=alice_bob\n"
+	require.NoError(t, ioutil.WriteFile(logFile, []byte(contents), 0600))
+
+	result, err := PurgeExpired(conf, now)
+	require.NoError(t, err)
+	require.Equal(t, Result{AuditLogEntries: 1}, result)
+
+	result, err = PurgeUser(conf, "alice", "ticket 123")
+	require.NoError(t, err)
+	require.Equal(t, Result{AuditLogEntries: 1}, result)
+
+	purged, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(purged), "carol")
+	require.NotContains(t, string(purged), "user=alice ")
+	// Usernames are matched as whole words
+	require.Contains(t, string(purged), "user=alice_bob")
+	require.Equal(t, 2, strings.Count(string(purged), "PURGED 1 audit log entries"))
+	require.Contains(t, string(purged), "(deletion request: ticket 123)")
+}
@@ -0,0 +1,247 @@
+package serversetup
+
+/*
+serversetup generates the commands needed to configure an SSH server to trust certificates issued by keybaseca. It is
+used by `keybaseca generate-server-setup` in order to reduce mistakes when setting up new hosts. The output is either
+a shell script or a cloud-init config that runs the same script on first boot.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"golang.org/x/crypto/ssh"
+)
+
+// Options describes how a server should be configured
+type Options struct {
+	// The CA public key in authorized_keys format
+	CAPublicKey string
+	// The principals (teams) that are allowed to log in as User
+	Teams []string
+	// The user on the server that members of Teams may log in as
+	User string
+	// If set, the server periodically downloads a key revocation list (KRL) from this URL
+	KRLURL string
+	// If set, sudo is configured to accept an elevated certificate with this principal in the forwarded ssh-agent
+	// (via keybaseca-sudo-verify) in place of a password
+	SudoPrincipal string
+}
+
+// The paths used on the server
+const (
+	caPublicKeyPath        = "/etc/ssh/ca.pub"
+	authPrincipalsDir      = "/etc/ssh/auth_principals"
+	revokedKeysPath        = "/etc/ssh/revoked_keys"
+	krlCronPath            = "/etc/cron.d/keybaseca-krl"
+	sshdConfigPath         = "/etc/ssh/sshd_config"
+	cloudInitScriptPath    = "/usr/local/sbin/keybaseca-server-setup.sh"
+	sudoVerifyPath         = "/usr/local/bin/keybaseca-sudo-verify"
+	sudoPAMPath            = "/etc/pam.d/sudo"
+	sudoersPath            = "/etc/sudoers.d/keybaseca-sudo"
+	krlRefreshCronSchedule = "*/15 * * * *"
+)
+
+// Valid usernames on common Linux distributions
+var userRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]*$`)
+
+// Valid elevated principals
+var principalRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// Valid (sub)team names. Teams are validated so that they can be safely written to the principals file.
+var teamRegex = regexp.MustCompile(`^[a-zA-Z0-9_]+(\.[a-zA-Z0-9_]+)*$`)
+
+// Validate returns an error if the given options cannot be used to generate a server setup script
+func (o Options) Validate() error {
+	_, _, _, _, err := ssh.ParseAuthorizedKey([]byte(o.CAPublicKey))
+	if err != nil {
+		return fmt.Errorf("failed to parse the CA public key: %v", err)
+	}
+	if len(o.Teams) == 0 {
+		return fmt.Errorf("at least one team must be specified")
+	}
+	for _, team := range o.Teams {
+		if !teamRegex.MatchString(team) {
+			return fmt.Errorf("invalid team name: %q", team)
+		}
+	}
+	if !userRegex.MatchString(o.User) {
+		return fmt.Errorf("invalid user name: %q", o.User)
+	}
+	if o.SudoPrincipal != "" && !principalRegex.MatchString(o.SudoPrincipal) {
+		return fmt.Errorf("invalid sudo principal: %q", o.SudoPrincipal)
+	}
+	if o.KRLURL != "" {
+		u, err := url.Parse(o.KRLURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("invalid KRL URL %q: must be an http(s) URL", o.KRLURL)
+		}
+	}
+	return nil
+}
+
+var scriptTemplate = template.Must(template.New("script").Funcs(template.FuncMap{"quote": shared.ShellQuote}).Parse(
+	`#!/bin/sh
+# Configures this server to trust SSH certificates issued by keybaseca. Generated by ` + "`keybaseca generate-server-setup`" + `.
+# Safe to run multiple times.
+set -eu
+
+# The CA public key
+cat > {{quote .CAPublicKeyPath}} <<'KEYBASECA_EOF'
+{{.CAPublicKey}}
+KEYBASECA_EOF
+chmod 644 {{quote .CAPublicKeyPath}}
+
+# The teams that may log in as {{.User}}
+id -u {{quote .User}} >/dev/null 2>&1 || useradd -m {{quote .User}}
+mkdir -p {{quote .AuthPrincipalsDir}}
+cat > {{quote .PrincipalsPath}} <<'KEYBASECA_EOF'
+{{range .Teams}}{{.}}
+{{end}}KEYBASECA_EOF
+chmod 644 {{quote .PrincipalsPath}}
+{{if .KRLURL}}
+# Periodically fetch the key revocation list. sshd refuses every certificate if the file is missing so start with an
+# empty list if it cannot be downloaded.
+if ! curl -fsS -o {{quote .RevokedKeysTempPath}} {{quote .KRLURL}}; then
+	ssh-keygen -k -f {{quote .RevokedKeysTempPath}}
+fi
+mv {{quote .RevokedKeysTempPath}} {{quote .RevokedKeysPath}}
+cat > {{quote .KRLCronPath}} <<'KEYBASECA_EOF'
+{{.KRLCronSchedule}} root curl -fsS -o {{quote .RevokedKeysTempPath}} {{quote .KRLURL}} && mv {{quote .RevokedKeysTempPath}} {{quote .RevokedKeysPath}}
+KEYBASECA_EOF
+{{end}}
+# Configure sshd
+add_sshd_config() {
+	grep -qxF "$1" {{quote .SSHDConfigPath}} || echo "$1" >> {{quote .SSHDConfigPath}}
+}
+add_sshd_config {{quote (print "TrustedUserCAKeys " .CAPublicKeyPath)}}
+add_sshd_config {{quote (print "AuthorizedPrincipalsFile " .AuthPrincipalsDir "/%u")}}
+{{- if .KRLURL}}
+add_sshd_config {{quote (print "RevokedKeys " .RevokedKeysPath)}}
+{{- end}}
+{{if .SudoPrincipal}}
+# Let sudo accept an elevated certificate (with the principal {{.SudoPrincipal}}) in the forwarded ssh-agent in place
+# of a password. keybaseca-sudo-verify is installed separately.
+if [ -x {{quote .SudoVerifyPath}} ]; then
+	echo 'Defaults env_keep += "SSH_AUTH_SOCK"' > {{quote .SudoersPath}}
+	chmod 440 {{quote .SudoersPath}}
+	visudo -cf {{quote .SudoersPath}}
+	grep -qF {{quote .SudoVerifyPath}} {{quote .SudoPAMPath}} || sed -i {{quote (print "1i auth sufficient pam_exec.so quiet " .SudoVerifyPath " --principal " .SudoPrincipal .SudoVerifyRevokedKeys)}} {{quote .SudoPAMPath}}
+else
+	echo {{quote (print .SudoVerifyPath " is not installed, skipping the sudo setup")}} >&2
+fi
+{{end}}
+# On some distributions /etc is group writable which will cause SSH to refuse to run
+chmod g-w /etc
+sshd -t
+systemctl restart sshd 2>/dev/null || systemctl restart ssh 2>/dev/null || service ssh restart
+`))
+
+var cloudInitTemplate = template.Must(template.New("cloud-init").Funcs(template.FuncMap{"indent": indent}).Parse(
+	`#cloud-config
+# Configures this server to trust SSH certificates issued by keybaseca. Generated by ` + "`keybaseca generate-server-setup`" + `.
+write_files:
+  - path: {{.ScriptPath}}
+    permissions: '0700'
+    content: |
+{{indent 6 .Script}}
+runcmd:
+  - [{{.ScriptPath}}]
+`))
+
+// GenerateScript returns a shell script that configures a server according to the given options
+func GenerateScript(opts Options) (string, error) {
+	err := opts.Validate()
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = scriptTemplate.Execute(&buf, struct {
+		Options
+		CAPublicKeyPath, AuthPrincipalsDir, PrincipalsPath, SSHDConfigPath string
+		RevokedKeysPath, RevokedKeysTempPath, KRLCronPath, KRLCronSchedule string
+		SudoVerifyPath, SudoPAMPath, SudoersPath                           string
+		// Passed to keybaseca-sudo-verify so that sudo also rejects revoked certificates
+		SudoVerifyRevokedKeys string
+	}{
+		Options: Options{CAPublicKey: strings.TrimSpace(opts.CAPublicKey), Teams: opts.Teams, User: opts.User,
+			KRLURL: opts.KRLURL, SudoPrincipal: opts.SudoPrincipal},
+		CAPublicKeyPath:       caPublicKeyPath,
+		AuthPrincipalsDir:     authPrincipalsDir,
+		PrincipalsPath:        authPrincipalsDir + "/" + opts.User,
+		SSHDConfigPath:        sshdConfigPath,
+		RevokedKeysPath:       revokedKeysPath,
+		RevokedKeysTempPath:   revokedKeysPath + ".tmp",
+		KRLCronPath:           krlCronPath,
+		KRLCronSchedule:       krlRefreshCronSchedule,
+		SudoVerifyPath:        sudoVerifyPath,
+		SudoPAMPath:           sudoPAMPath,
+		SudoersPath:           sudoersPath,
+		SudoVerifyRevokedKeys: sudoVerifyRevokedKeys(opts),
+	})
+	return buf.String(), err
+}
+
+// Returns the arguments that make keybaseca-sudo-verify check the same revocation list as sshd, if there is one
+func sudoVerifyRevokedKeys(opts Options) string {
+	if opts.KRLURL == "" {
+		return ""
+	}
+	return " --revoked-keys " + revokedKeysPath
+}
+
+// GenerateCloudInit returns a cloud-init config that runs the script returned by GenerateScript on first boot
+func GenerateCloudInit(opts Options) (string, error) {
+	script, err := GenerateScript(opts)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = cloudInitTemplate.Execute(&buf, struct{ ScriptPath, Script string }{cloudInitScriptPath, script})
+	return buf.String(), err
+}
+
+var sshdSnippetTemplate = template.Must(template.New("sshd-snippet").Parse(
+	`# Trust SSH certificates issued by keybaseca. Generated by ` + "`keybaseca export-ca --format sshd-snippet`" + `.
+# {{.CAPublicKeyPath}} must contain the CA public key ({{.Fingerprint}}):
+#   {{.CAPublicKey}}
+# and {{.AuthPrincipalsDir}}/<user> the teams that may log in as <user>, one per line.
+TrustedUserCAKeys {{.CAPublicKeyPath}}
+AuthorizedPrincipalsFile {{.AuthPrincipalsDir}}/%u
+`))
+
+// GenerateSSHDSnippet returns the sshd_config directives that make sshd trust certificates signed by the given CA
+// public key, using the same paths as the script returned by GenerateScript. The files that the directives reference
+// are described in comments rather than created.
+func GenerateSSHDSnippet(caPublicKey string) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(caPublicKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the CA public key: %v", err)
+	}
+	var buf bytes.Buffer
+	err = sshdSnippetTemplate.Execute(&buf, struct {
+		CAPublicKey, Fingerprint, CAPublicKeyPath, AuthPrincipalsDir string
+	}{
+		CAPublicKey:       strings.TrimSpace(caPublicKey),
+		Fingerprint:       ssh.FingerprintSHA256(key),
+		CAPublicKeyPath:   caPublicKeyPath,
+		AuthPrincipalsDir: authPrincipalsDir,
+	})
+	return buf.String(), err
+}
+
+// Indent every non-empty line of s by the given number of spaces
+func indent(spaces int, s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = strings.Repeat(" ", spaces) + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
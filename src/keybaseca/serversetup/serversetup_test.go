@@ -0,0 +1,98 @@
+package serversetup
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const caPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGhJM8a3mhSOZ2Pq0Z0hOr0nZ7uqJ2oZDGGn1YSaEhE+ keybaseca\n"
+
+func TestGenerateScript(t *testing.T) {
+	script, err := GenerateScript(Options{CAPublicKey: caPublicKey, Teams: []string{"team.ssh.prod", "team.ssh.root_everywhere"}, User: "root"})
+	require.NoError(t, err)
+	require.Contains(t, script, strings.TrimSpace(caPublicKey)+"\nKEYBASECA_EOF")
+	require.Contains(t, script, "team.ssh.prod\nteam.ssh.root_everywhere\nKEYBASECA_EOF")
+	require.Contains(t, script, "cat > '/etc/ssh/auth_principals/root'")
+	require.Contains(t, script, "add_sshd_config 'TrustedUserCAKeys /etc/ssh/ca.pub'")
+	require.Contains(t, script, "add_sshd_config 'AuthorizedPrincipalsFile /etc/ssh/auth_principals/%u'")
+	require.NotContains(t, script, "RevokedKeys")
+	requireValidShell(t, script)
+
+	script, err = GenerateScript(Options{CAPublicKey: caPublicKey, Teams: []string{"team.ssh.staging"}, User: "developer", KRLURL: "https://example.com/krl?team=staging&x='y'"})
+	require.NoError(t, err)
+	require.Contains(t, script, "add_sshd_config 'RevokedKeys /etc/ssh/revoked_keys'")
+	require.Contains(t, script, `'https://example.com/krl?team=staging&x='\''y'\'''`)
+	require.Contains(t, script, "*/15 * * * * root curl")
+	require.NotContains(t, script, "pam_exec.so")
+	requireValidShell(t, script)
+
+	script, err = GenerateScript(Options{CAPublicKey: caPublicKey, Teams: []string{"team.ssh.prod"}, User: "root", SudoPrincipal: "prod-sudo"})
+	require.NoError(t, err)
+	require.Contains(t, script, "'1i auth sufficient pam_exec.so quiet /usr/local/bin/keybaseca-sudo-verify --principal prod-sudo' '/etc/pam.d/sudo'")
+	require.Contains(t, script, `echo 'Defaults env_keep += "SSH_AUTH_SOCK"' > '/etc/sudoers.d/keybaseca-sudo'`)
+	requireValidShell(t, script)
+
+	// sudo checks the same revocation list as sshd
+	script, err = GenerateScript(Options{CAPublicKey: caPublicKey, Teams: []string{"team.ssh.prod"}, User: "root", SudoPrincipal: "prod-sudo",
+		KRLURL: "https://example.com/krl"})
+	require.NoError(t, err)
+	require.Contains(t, script, "keybaseca-sudo-verify --principal prod-sudo --revoked-keys /etc/ssh/revoked_keys'")
+	requireValidShell(t, script)
+}
+
+func TestGenerateCloudInit(t *testing.T) {
+	cloudInit, err := GenerateCloudInit(Options{CAPublicKey: caPublicKey, Teams: []string{"team.ssh.prod"}, User: "root"})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(cloudInit, "#cloud-config\n"))
+	require.Contains(t, cloudInit, "      #!/bin/sh\n")
+	require.Contains(t, cloudInit, "      team.ssh.prod\n")
+	require.Contains(t, cloudInit, "runcmd:\n  - [/usr/local/sbin/keybaseca-server-setup.sh]\n")
+}
+
+func TestGenerateSSHDSnippet(t *testing.T) {
+	snippet, err := GenerateSSHDSnippet(caPublicKey)
+	require.NoError(t, err)
+	require.Contains(t, snippet, "#   "+strings.TrimSpace(caPublicKey)+"\n")
+	require.Contains(t, snippet, "\nTrustedUserCAKeys /etc/ssh/ca.pub\n")
+	require.Contains(t, snippet, "\nAuthorizedPrincipalsFile /etc/ssh/auth_principals/%u\n")
+
+	_, err = GenerateSSHDSnippet("garbage")
+	require.Error(t, err)
+}
+
+func TestValidate(t *testing.T) {
+	valid := Options{CAPublicKey: caPublicKey, Teams: []string{"team.ssh.prod"}, User: "root"}
+	require.NoError(t, valid.Validate())
+
+	for name, opts := range map[string]Options{
+		"bad key":            {CAPublicKey: "garbage", Teams: valid.Teams, User: valid.User},
+		"no teams":           {CAPublicKey: caPublicKey, User: valid.User},
+		"bad team":           {CAPublicKey: caPublicKey, Teams: []string{"team.ssh\nroot"}, User: valid.User},
+		"bad user":           {CAPublicKey: caPublicKey, Teams: valid.Teams, User: "root; rm -rf /"},
+		"bad sudo principal": {CAPublicKey: caPublicKey, Teams: valid.Teams, User: valid.User, SudoPrincipal: "x --ca /tmp/ca.pub"},
+		"bad KRL scheme":     {CAPublicKey: caPublicKey, Teams: valid.Teams, User: valid.User, KRLURL: "file:///etc/passwd"},
+	} {
+		require.Error(t, opts.Validate(), name)
+	}
+}
+
+// Check that the given script is syntactically valid without running it
+func requireValidShell(t *testing.T, script string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	dir, err := ioutil.TempDir("", "serversetup")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "setup.sh")
+	require.NoError(t, ioutil.WriteFile(filename, []byte(script), 0600))
+	output, err := exec.Command("sh", "-n", filename).CombinedOutput()
+	require.NoError(t, err, string(output))
+}
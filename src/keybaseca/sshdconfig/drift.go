@@ -0,0 +1,99 @@
+package sshdconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// A DriftResult describes whether the TrustedUserCAKeys of a server still trust the CA key that keybaseca currently
+// publishes. Servers drift when the CA key is rotated (see `keybaseca generate` with FORCE_WRITE or `keybaseca
+// import-key`) and a server is not updated, or when someone edits sshd_config by hand.
+type DriftResult struct {
+	// The file named by TrustedUserCAKeys
+	TrustedCAKeysFile string `json:"trusted_ca_keys_file,omitempty"`
+	// The fingerprint of the CA key that keybaseca currently publishes
+	Expected string `json:"expected"`
+	// The fingerprints of every key in TrustedCAKeysFile
+	Trusted []string `json:"trusted"`
+	// The fingerprints of the trusted keys other than Expected, eg the CA key from before a rotation
+	Other []string `json:"other,omitempty"`
+	// Whether the server has drifted from the published CA key
+	Drifted bool   `json:"drifted"`
+	Message string `json:"message"`
+}
+
+// ParsePublishedCAKey parses the CA public key published by keybaseca. contents is either the ca.pub file that is
+// published to every CONFIG_MIRRORS location or a kssh config (eg from the public KBFS folder of a restricted bot).
+func ParsePublishedCAKey(contents []byte) (ssh.PublicKey, error) {
+	trimmed := bytes.TrimSpace(contents)
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var config struct {
+			CAPublicKey string `json:"ca_public_key"`
+		}
+		err := json.Unmarshal(trimmed, &config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the kssh config: %v", err)
+		}
+		if config.CAPublicKey == "" {
+			return nil, fmt.Errorf("the kssh config does not include the CA public key")
+		}
+		trimmed = []byte(config.CAPublicKey)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the CA public key: %v", err)
+	}
+	return key, nil
+}
+
+// CheckDrift checks that the TrustedUserCAKeys of the given sshd config include the published CA key. If strict is
+// set, trusting any other key is also treated as drift so that CA keys that were rotated away from are noticed.
+func CheckDrift(conf *Config, published ssh.PublicKey, strict bool) DriftResult {
+	result := DriftResult{Expected: ssh.FingerprintSHA256(published), Trusted: []string{}}
+	// TrustedUserCAKeys is only read from the global section of sshd_config
+	d, _ := conf.Get("TrustedUserCAKeys", "")
+	if d == nil || len(d.Args) == 0 || strings.EqualFold(d.Args[0], "none") {
+		result.Drifted = true
+		result.Message = "TrustedUserCAKeys is not set so sshd does not accept any certificates"
+		return result
+	}
+	result.TrustedCAKeysFile = d.Args[0]
+	contents, err := ioutil.ReadFile(d.Args[0])
+	if err != nil {
+		result.Drifted = true
+		result.Message = fmt.Sprintf("failed to read %s (set at %s): %v", d.Args[0], d.Location(), err)
+		return result
+	}
+	found := false
+	for rest := contents; len(bytes.TrimSpace(rest)) > 0; {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		fingerprint := ssh.FingerprintSHA256(key)
+		result.Trusted = append(result.Trusted, fingerprint)
+		if bytes.Equal(key.Marshal(), published.Marshal()) {
+			found = true
+		} else {
+			result.Other = append(result.Other, fingerprint)
+		}
+	}
+	switch {
+	case !found:
+		result.Drifted = true
+		result.Message = fmt.Sprintf("%s (set at %s) does not contain the current CA key %s", d.Args[0], d.Location(),
+			result.Expected)
+	case strict && len(result.Other) > 0:
+		result.Drifted = true
+		result.Message = fmt.Sprintf("%s (set at %s) also trusts %s", d.Args[0], d.Location(), strings.Join(result.Other, ", "))
+	default:
+		result.Message = fmt.Sprintf("%s trusts the current CA key %s", d.Args[0], result.Expected)
+	}
+	return result
+}
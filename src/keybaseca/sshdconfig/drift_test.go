@@ -0,0 +1,64 @@
+package sshdconfig
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestParsePublishedCAKey(t *testing.T) {
+	_, caKey := generateCert(t)
+	authorizedKey := ssh.MarshalAuthorizedKey(caKey)
+
+	key, err := ParsePublishedCAKey(authorizedKey)
+	require.NoError(t, err)
+	require.Equal(t, caKey.Marshal(), key.Marshal())
+	key, err = ParsePublishedCAKey([]byte(`{"teamname":"team.ssh","botname":"cabot","ca_public_key":"` +
+		string(authorizedKey[:len(authorizedKey)-1]) + `"}`))
+	require.NoError(t, err)
+	require.Equal(t, caKey.Marshal(), key.Marshal())
+
+	_, err = ParsePublishedCAKey([]byte(`{"teamname":"team.ssh","botname":"cabot"}`))
+	require.Error(t, err)
+	_, err = ParsePublishedCAKey([]byte("not a key"))
+	require.Error(t, err)
+}
+
+func TestCheckDrift(t *testing.T) {
+	_, caKey := generateCert(t)
+	_, oldCAKey := generateCert(t)
+	dir, cleanup := writeFiles(t, map[string]string{
+		"rotated.pub": string(ssh.MarshalAuthorizedKey(oldCAKey)) + string(ssh.MarshalAuthorizedKey(caKey)),
+		"stale.pub":   string(ssh.MarshalAuthorizedKey(oldCAKey)),
+	})
+	defer cleanup()
+	check := func(sshdConfig string, strict bool) DriftResult {
+		configDir, cleanupConfig := writeFiles(t, map[string]string{"sshd_config": sshdConfig})
+		defer cleanupConfig()
+		conf, err := Parse(filepath.Join(configDir, "sshd_config"))
+		require.NoError(t, err)
+		return CheckDrift(conf, caKey, strict)
+	}
+
+	result := check("TrustedUserCAKeys "+filepath.Join(dir, "rotated.pub")+"\n", false)
+	require.False(t, result.Drifted, result.Message)
+	require.Equal(t, ssh.FingerprintSHA256(caKey), result.Expected)
+	require.Len(t, result.Trusted, 2)
+	require.Equal(t, []string{ssh.FingerprintSHA256(oldCAKey)}, result.Other)
+
+	// Still trusting the key from before a rotation is only drift in strict mode
+	result = check("TrustedUserCAKeys "+filepath.Join(dir, "rotated.pub")+"\n", true)
+	require.True(t, result.Drifted)
+	require.Contains(t, result.Message, ssh.FingerprintSHA256(oldCAKey))
+
+	result = check("TrustedUserCAKeys "+filepath.Join(dir, "stale.pub")+"\n", false)
+	require.True(t, result.Drifted)
+	require.Contains(t, result.Message, "does not contain the current CA key")
+	result = check("TrustedUserCAKeys "+filepath.Join(dir, "missing.pub")+"\n", false)
+	require.True(t, result.Drifted)
+	result = check("PubkeyAuthentication yes\n", false)
+	require.True(t, result.Drifted)
+	require.Contains(t, result.Message, "TrustedUserCAKeys is not set")
+}
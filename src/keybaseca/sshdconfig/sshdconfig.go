@@ -0,0 +1,259 @@
+package sshdconfig
+
+/*
+sshdconfig parses an sshd_config file (see sshd_config(5)) well enough to work out the settings that decide whether
+sshd accepts a certificate issued by keybaseca. It is used by `keybaseca verify-against-sshd` to catch mismatched
+principals and missing CA keys before users are locked out. Include directives are followed and Match blocks are
+evaluated for the user being logged in as. Match criteria other than User and All depend on the connection so they are
+reported as warnings and treated as not matching.
+*/
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The maximum depth of nested Include directives, the same as sshd's
+const maxIncludeDepth = 16
+
+// A Directive is a single keyword and its arguments from an sshd_config file
+type Directive struct {
+	// The lower cased keyword (eg trustedusercakeys)
+	Keyword string
+	Args    []string
+	// Where the directive was read from, used in messages
+	File string
+	Line int
+	// The Match block the directive is in or nil if it is global
+	Match *MatchBlock
+}
+
+// Location returns the file and line of the directive
+func (d Directive) Location() string {
+	return fmt.Sprintf("%s:%d", d.File, d.Line)
+}
+
+// A MatchBlock is a Match line and the criteria on it
+type MatchBlock struct {
+	Criteria []string
+	File     string
+	Line     int
+}
+
+// Config is a parsed sshd_config file with its includes
+type Config struct {
+	Directives []Directive
+}
+
+// Parse parses the given sshd_config file. Relative Include paths are resolved against the directory of the file
+// (/etc/ssh for the default sshd_config) like sshd does.
+func Parse(filename string) (*Config, error) {
+	conf := &Config{}
+	err := conf.parseFile(filename, filepath.Dir(filename), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (c *Config) parseFile(filename, baseDir string, match *MatchBlock, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("too many nested Include directives in %s", filename)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		keyword, args, err := splitLine(scanner.Text())
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filename, lineNumber, err)
+		}
+		if keyword == "" {
+			continue
+		}
+		switch keyword {
+		case "match":
+			if len(args) == 0 {
+				return fmt.Errorf("%s:%d: Match without criteria", filename, lineNumber)
+			}
+			match = &MatchBlock{Criteria: args, File: filename, Line: lineNumber}
+		case "include":
+			for _, pattern := range args {
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(baseDir, pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s:%d: invalid Include pattern %s: %v", filename, lineNumber, pattern, err)
+				}
+				sort.Strings(matches)
+				for _, included := range matches {
+					// An included file inherits the current Match block but a Match inside of it does not apply
+					// after the Include
+					err = c.parseFile(included, baseDir, match, depth+1)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			c.Directives = append(c.Directives, Directive{Keyword: keyword, Args: args, File: filename, Line: lineNumber, Match: match})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %v", filename, err)
+	}
+	return nil
+}
+
+// Split a line of an sshd_config file into its lower cased keyword and its arguments. Arguments may be double quoted
+// and the keyword may be separated from the arguments by an equals sign. Returns an empty keyword for blank lines and
+// comments.
+func splitLine(line string) (string, []string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil, nil
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end < 0 {
+		return strings.ToLower(line), nil, nil
+	}
+	keyword := strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for _, r := range rest {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		case r == '#' && !inQuotes && !inArg:
+			// The rest of the line is a comment
+			return keyword, args, nil
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inQuotes {
+		return "", nil, fmt.Errorf("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return keyword, args, nil
+}
+
+// Get returns the directive that is in effect for the given keyword when logging in as user, or nil if the keyword is
+// not set. Like sshd, the first value in a matching Match block wins and otherwise the first global value wins.
+// Warnings describe Match blocks that could not be evaluated.
+func (c *Config) Get(keyword, user string) (directive *Directive, warnings []string) {
+	keyword = strings.ToLower(keyword)
+	var global *Directive
+	for i := range c.Directives {
+		d := &c.Directives[i]
+		if d.Keyword != keyword {
+			continue
+		}
+		if d.Match == nil {
+			if global == nil {
+				global = d
+			}
+			continue
+		}
+		matches, warning := d.Match.matches(user)
+		if warning != "" {
+			warnings = append(warnings, fmt.Sprintf("%s (which sets %s at %s) %s", d.Match.String(), d.Keyword, d.Location(), warning))
+		}
+		if matches {
+			return d, warnings
+		}
+	}
+	return global, warnings
+}
+
+func (m *MatchBlock) String() string {
+	return fmt.Sprintf("Match %s at %s:%d", strings.Join(m.Criteria, " "), m.File, m.Line)
+}
+
+// Returns whether the Match block applies to a login as user. The warning is set if the block has criteria that
+// depend on the connection, in which case the block is treated as not matching.
+func (m *MatchBlock) matches(user string) (bool, string) {
+	if len(m.Criteria) == 1 && strings.EqualFold(m.Criteria[0], "all") {
+		return true, ""
+	}
+	matches := true
+	for i := 0; i < len(m.Criteria); i += 2 {
+		criterion := strings.ToLower(m.Criteria[i])
+		if i+1 >= len(m.Criteria) {
+			return false, fmt.Sprintf("has no value for %s", m.Criteria[i])
+		}
+		switch criterion {
+		case "user":
+			if !MatchPatternList(user, m.Criteria[i+1]) {
+				matches = false
+			}
+		default:
+			return false, fmt.Sprintf("depends on %s which cannot be checked without a connection, assuming it does not match", m.Criteria[i])
+		}
+	}
+	return matches, ""
+}
+
+// MatchPatternList returns whether s matches the given comma separated list of patterns as used by sshd (see the
+// PATTERNS section of ssh_config(5)). A negated pattern (!pattern) that matches overrides every other pattern.
+func MatchPatternList(s, list string) bool {
+	matched := false
+	for _, pattern := range strings.Split(list, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		if negated {
+			pattern = pattern[1:]
+		}
+		if matchPattern(s, pattern) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Returns whether s matches the pattern, where * matches any number of characters and ? matches exactly one
+func matchPattern(s, pattern string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(s); i++ {
+			if matchPattern(s[i:], pattern[1:]) {
+				return true
+			}
+		}
+		return false
+	case '?':
+		return s != "" && matchPattern(s[1:], pattern[1:])
+	default:
+		return s != "" && s[0] == pattern[0] && matchPattern(s[1:], pattern[1:])
+	}
+}
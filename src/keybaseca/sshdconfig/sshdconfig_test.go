@@ -0,0 +1,91 @@
+package sshdconfig
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Write the given files to a new temporary directory and return it along with a function that deletes it
+func writeFiles(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "sshdconfig")
+	require.NoError(t, err)
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestSplitLine(t *testing.T) {
+	for line, expected := range map[string][]string{
+		"":                                       nil,
+		"  # a comment":                          nil,
+		"TrustedUserCAKeys /etc/ssh/ca.pub":      {"trustedusercakeys", "/etc/ssh/ca.pub"},
+		"AllowUsers\talice  bob # admins":        {"allowusers", "alice", "bob"},
+		"PubkeyAuthentication=no":                {"pubkeyauthentication", "no"},
+		`AuthorizedPrincipalsFile "/etc/a b/%u"`: {"authorizedprincipalsfile", "/etc/a b/%u"},
+	} {
+		keyword, args, err := splitLine(line)
+		require.NoError(t, err, line)
+		if expected == nil {
+			require.Equal(t, "", keyword, line)
+			continue
+		}
+		require.Equal(t, expected[0], keyword, line)
+		require.Equal(t, expected[1:], args, line)
+	}
+	_, _, err := splitLine(`AuthorizedPrincipalsFile "/etc/ssh`)
+	require.Error(t, err)
+}
+
+func TestParseIncludeAndMatch(t *testing.T) {
+	dir, cleanup := writeFiles(t, map[string]string{
+		"sshd_config": "Include sshd_config.d/*.conf\n" +
+			"TrustedUserCAKeys /etc/ssh/ignored.pub\n" +
+			"AuthorizedPrincipalsFile /etc/ssh/auth_principals/%u\n" +
+			"Match User deploy,!root\n" +
+			"  AuthorizedPrincipalsFile /etc/ssh/deploy_principals\n" +
+			"Match Address 10.0.0.0/8\n" +
+			"  AuthorizedPrincipalsFile none\n",
+		"sshd_config.d/10-ca.conf": "TrustedUserCAKeys /etc/ssh/ca.pub\n",
+		"sshd_config.d/ignored":    "TrustedUserCAKeys /etc/ssh/other.pub\n",
+	})
+	defer cleanup()
+
+	conf, err := Parse(filepath.Join(dir, "sshd_config"))
+	require.NoError(t, err)
+
+	// The first value wins, including ones from included files
+	d, warnings := conf.Get("TrustedUserCAKeys", "root")
+	require.Equal(t, []string{"/etc/ssh/ca.pub"}, d.Args)
+	require.Equal(t, filepath.Join(dir, "sshd_config.d/10-ca.conf")+":1", d.Location())
+	require.Empty(t, warnings)
+
+	// Matching Match blocks override the global value
+	d, warnings = conf.Get("authorizedprincipalsfile", "deploy")
+	require.Equal(t, []string{"/etc/ssh/deploy_principals"}, d.Args)
+	require.Empty(t, warnings)
+
+	// Match blocks that depend on the connection are reported and skipped
+	d, warnings = conf.Get("AuthorizedPrincipalsFile", "root")
+	require.Equal(t, []string{"/etc/ssh/auth_principals/%u"}, d.Args)
+	require.Len(t, warnings, 1)
+	require.Contains(t, warnings[0], "Match Address 10.0.0.0/8")
+
+	d, _ = conf.Get("RevokedKeys", "root")
+	require.Nil(t, d)
+}
+
+func TestMatchPatternList(t *testing.T) {
+	require.True(t, MatchPatternList("alice", "alice"))
+	require.True(t, MatchPatternList("alice", "bob,al*"))
+	require.True(t, MatchPatternList("alice", "?lice"))
+	require.False(t, MatchPatternList("alice", "bob"))
+	require.False(t, MatchPatternList("alice", "*,!alice"))
+	require.True(t, MatchPatternList("ssh-ed25519-cert-v01@openssh.com", "ssh-ed25519*,rsa-sha2-512"))
+}
@@ -0,0 +1,324 @@
+package sshdconfig
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/authcheck"
+	"golang.org/x/crypto/ssh"
+)
+
+// VerifyOptions describes the login that Verify simulates
+type VerifyOptions struct {
+	// The certificate that is presented
+	Certificate *ssh.Certificate
+	// The public key of the CA that signed the certificate
+	CAPublicKey ssh.PublicKey
+	// The user being logged in as
+	User string
+	// The home directory of User, used for %h and relative paths. Looked up on this machine if empty.
+	HomeDir string
+	// The uid of User, used for %U. Looked up on this machine if empty.
+	UID string
+	// The time of the login
+	Now time.Time
+}
+
+// A CheckResult is the outcome of one of the checks that sshd makes
+type CheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message"`
+}
+
+// A VerifyResult describes whether sshd would accept a certificate
+type VerifyResult struct {
+	Accepted bool          `json:"accepted"`
+	Checks   []CheckResult `json:"checks"`
+	// Settings that could not be simulated. sshd may still reject the certificate because of them.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Verify simulates the checks that sshd makes when a certificate is presented for a login and reports whether it would
+// accept it. Only the settings that are relevant to certificates are considered, so a login may still fail for
+// other reasons (eg PAM or a locked account).
+func Verify(conf *Config, opts VerifyOptions) VerifyResult {
+	v := &verifier{conf: conf, opts: opts}
+	if v.opts.HomeDir == "" || v.opts.UID == "" {
+		if u, err := user.Lookup(opts.User); err == nil {
+			if v.opts.HomeDir == "" {
+				v.opts.HomeDir = u.HomeDir
+			}
+			if v.opts.UID == "" {
+				v.opts.UID = u.Uid
+			}
+		}
+	}
+	v.checkPubkeyAuthentication()
+	v.checkAllowedUsers()
+	v.checkTrustedCAKeys()
+	v.checkAlgorithms()
+	v.checkValidity()
+	v.checkPrincipals()
+	v.checkRevokedKeys()
+
+	result := VerifyResult{Accepted: true, Checks: v.checks, Warnings: v.warnings}
+	for _, check := range v.checks {
+		if !check.Passed {
+			result.Accepted = false
+		}
+	}
+	return result
+}
+
+type verifier struct {
+	conf     *Config
+	opts     VerifyOptions
+	checks   []CheckResult
+	warnings []string
+}
+
+func (v *verifier) pass(name, format string, args ...interface{}) {
+	v.checks = append(v.checks, CheckResult{Name: name, Passed: true, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *verifier) fail(name, format string, args ...interface{}) {
+	v.checks = append(v.checks, CheckResult{Name: name, Passed: false, Message: fmt.Sprintf(format, args...)})
+}
+
+// Returns the directive in effect for the keyword, recording any warnings about Match blocks
+func (v *verifier) get(keyword string) *Directive {
+	directive, warnings := v.conf.Get(keyword, v.opts.User)
+	v.warnings = append(v.warnings, warnings...)
+	return directive
+}
+
+func (v *verifier) checkPubkeyAuthentication() {
+	d := v.get("PubkeyAuthentication")
+	if d != nil && len(d.Args) > 0 && strings.EqualFold(d.Args[0], "no") {
+		v.fail("PubkeyAuthentication", "public key authentication is disabled at %s", d.Location())
+		return
+	}
+	v.pass("PubkeyAuthentication", "public key authentication is enabled")
+}
+
+func (v *verifier) checkAllowedUsers() {
+	if d := v.get("DenyUsers"); d != nil {
+		for _, pattern := range d.Args {
+			if v.matchUserPattern(pattern) {
+				v.fail("AllowUsers/DenyUsers", "%s is denied by DenyUsers %s at %s", v.opts.User, pattern, d.Location())
+				return
+			}
+		}
+	}
+	if d := v.get("AllowUsers"); d != nil {
+		allowed := false
+		for _, pattern := range d.Args {
+			if v.matchUserPattern(pattern) {
+				allowed = true
+			}
+		}
+		if !allowed {
+			v.fail("AllowUsers/DenyUsers", "%s is not in AllowUsers at %s", v.opts.User, d.Location())
+			return
+		}
+	}
+	if d := v.get("AllowGroups"); d != nil {
+		v.warnings = append(v.warnings, fmt.Sprintf("AllowGroups at %s is not checked", d.Location()))
+	}
+	if d := v.get("DenyGroups"); d != nil {
+		v.warnings = append(v.warnings, fmt.Sprintf("DenyGroups at %s is not checked", d.Location()))
+	}
+	v.pass("AllowUsers/DenyUsers", "%s may log in", v.opts.User)
+}
+
+// Returns whether the user matches an AllowUsers or DenyUsers pattern. Patterns of the form user@host also depend on
+// the client's address which is not known so only the user part is checked.
+func (v *verifier) matchUserPattern(pattern string) bool {
+	if at := strings.Index(pattern, "@"); at >= 0 {
+		v.warnings = append(v.warnings, fmt.Sprintf("only the user part of %s is checked", pattern))
+		pattern = pattern[:at]
+	}
+	return matchPattern(v.opts.User, pattern)
+}
+
+func (v *verifier) checkTrustedCAKeys() {
+	d := v.get("TrustedUserCAKeys")
+	if d == nil || len(d.Args) == 0 || strings.EqualFold(d.Args[0], "none") {
+		v.fail("TrustedUserCAKeys", "TrustedUserCAKeys is not set so sshd does not accept any certificates")
+		return
+	}
+	filename := v.expandPath(d.Args[0])
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		v.fail("TrustedUserCAKeys", "failed to read %s (set at %s): %v", filename, d.Location(), err)
+		return
+	}
+	caKey := v.opts.CAPublicKey.Marshal()
+	for rest := contents; len(bytes.TrimSpace(rest)) > 0; {
+		var key ssh.PublicKey
+		key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(key.Marshal(), caKey) {
+			v.pass("TrustedUserCAKeys", "%s contains the CA public key", filename)
+			return
+		}
+	}
+	v.fail("TrustedUserCAKeys", "%s (set at %s) does not contain the CA public key %s", filename, d.Location(),
+		ssh.FingerprintSHA256(v.opts.CAPublicKey))
+}
+
+func (v *verifier) checkAlgorithms() {
+	cert := v.opts.Certificate
+	if d := v.get("CASignatureAlgorithms"); d != nil && len(d.Args) > 0 {
+		if !algorithmAllowed(cert.Signature.Format, d.Args[0]) {
+			v.fail("CASignatureAlgorithms", "the certificate is signed with %s which is not allowed by CASignatureAlgorithms %s at %s",
+				cert.Signature.Format, d.Args[0], d.Location())
+			return
+		}
+	}
+	keyword := "PubkeyAcceptedAlgorithms"
+	d := v.get(keyword)
+	if d == nil {
+		// The name before OpenSSH 8.5
+		keyword = "PubkeyAcceptedKeyTypes"
+		d = v.get(keyword)
+	}
+	if d != nil && len(d.Args) > 0 && !algorithmAllowed(cert.Type(), d.Args[0]) {
+		v.fail("CASignatureAlgorithms", "certificates of type %s are not allowed by %s %s at %s", cert.Type(), keyword,
+			d.Args[0], d.Location())
+		return
+	}
+	v.pass("CASignatureAlgorithms", "%s certificates signed with %s are allowed", cert.Type(), cert.Signature.Format)
+}
+
+// Returns whether the algorithm is allowed by the given algorithm list. A list that starts with +, -, or ^ modifies
+// sshd's default list, which is assumed to allow every algorithm that keybaseca uses.
+func algorithmAllowed(algorithm, list string) bool {
+	switch {
+	case strings.HasPrefix(list, "-"):
+		return !MatchPatternList(algorithm, list[1:])
+	case strings.HasPrefix(list, "+"), strings.HasPrefix(list, "^"):
+		return true
+	default:
+		return MatchPatternList(algorithm, list)
+	}
+}
+
+func (v *verifier) checkValidity() {
+	cert := v.opts.Certificate
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	if v.opts.Now.Before(validAfter) || !v.opts.Now.Before(validBefore) {
+		v.fail("Validity", "the certificate is only valid from %s to %s", validAfter.Format(time.RFC3339), validBefore.Format(time.RFC3339))
+		return
+	}
+	v.pass("Validity", "the certificate is valid until %s", validBefore.Format(time.RFC3339))
+}
+
+func (v *verifier) checkPrincipals() {
+	cert := v.opts.Certificate
+	var filename string
+	var location string
+	if d := v.get("AuthorizedPrincipalsCommand"); d != nil && len(d.Args) > 0 && !strings.EqualFold(d.Args[0], "none") {
+		// kssh-authcheck prints the contents of its --principals-file so it can be simulated as if that was the
+		// AuthorizedPrincipalsFile
+		filename = authcheckPrincipalsFile(d.Args)
+		if filename == "" {
+			v.warnings = append(v.warnings, fmt.Sprintf("the AuthorizedPrincipalsCommand at %s cannot be simulated", d.Location()))
+			v.pass("Principals", "the principals are decided by the AuthorizedPrincipalsCommand at %s", d.Location())
+			return
+		}
+		v.warnings = append(v.warnings, fmt.Sprintf("the KRL and lockdown checks of kssh-authcheck (at %s) are not simulated", d.Location()))
+		location = d.Location()
+	} else if d := v.get("AuthorizedPrincipalsFile"); d != nil && len(d.Args) > 0 && !strings.EqualFold(d.Args[0], "none") {
+		filename = d.Args[0]
+		location = d.Location()
+	}
+
+	if filename == "" {
+		// Without a principals file sshd requires the name of the user to be one of the principals
+		for _, principal := range cert.ValidPrincipals {
+			if principal == v.opts.User {
+				v.pass("Principals", "the certificate includes the principal %s and no AuthorizedPrincipalsFile is set", v.opts.User)
+				return
+			}
+		}
+		v.fail("Principals", "no AuthorizedPrincipalsFile is set so the certificate must include the principal %s but it only includes %s",
+			v.opts.User, strings.Join(cert.ValidPrincipals, ", "))
+		return
+	}
+
+	filename = v.expandPath(filename)
+	accepted, err := authcheck.ReadPrincipals(filename)
+	if err != nil {
+		v.fail("Principals", "failed to read the principals file %s (set at %s) so sshd rejects every certificate for %s: %v",
+			filename, location, v.opts.User, err)
+		return
+	}
+	for _, principal := range cert.ValidPrincipals {
+		for _, line := range accepted {
+			// A line may start with options (eg from="10.0.0.0/8") that apply to the principal at its end
+			fields := strings.Fields(line)
+			if fields[len(fields)-1] == principal {
+				v.pass("Principals", "%s accepts the principal %s", filename, principal)
+				return
+			}
+		}
+	}
+	v.fail("Principals", "%s (set at %s) accepts %s but the certificate only includes %s", filename, location,
+		strings.Join(accepted, ", "), strings.Join(cert.ValidPrincipals, ", "))
+}
+
+// Returns the --principals-file passed to kssh-authcheck in the given AuthorizedPrincipalsCommand or an empty string
+// if the command is not kssh-authcheck
+func authcheckPrincipalsFile(args []string) string {
+	if filepath.Base(args[0]) != "kssh-authcheck" {
+		return ""
+	}
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--principals-file=") {
+			return strings.TrimPrefix(arg, "--principals-file=")
+		}
+		if arg == "--principals-file" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+func (v *verifier) checkRevokedKeys() {
+	d := v.get("RevokedKeys")
+	if d == nil || len(d.Args) == 0 || strings.EqualFold(d.Args[0], "none") {
+		return
+	}
+	filename := v.expandPath(d.Args[0])
+	if _, err := ioutil.ReadFile(filename); err != nil {
+		v.fail("RevokedKeys", "sshd rejects every key since %s (set at %s) cannot be read: %v", filename, d.Location(), err)
+		return
+	}
+	v.pass("RevokedKeys", "%s exists", filename)
+}
+
+// Expand the %-tokens that sshd supports in file names and make relative paths relative to the home directory
+func (v *verifier) expandPath(path string) string {
+	uid := v.opts.UID
+	if uid == "" {
+		uid = "%U"
+	}
+	path = strings.NewReplacer("%%", "%", "%h", v.opts.HomeDir, "%u", v.opts.User, "%U", uid).Replace(path)
+	if strings.HasPrefix(path, "~/") {
+		path = filepath.Join(v.opts.HomeDir, path[2:])
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(v.opts.HomeDir, path)
+	}
+	return path
+}
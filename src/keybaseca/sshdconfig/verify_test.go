@@ -0,0 +1,153 @@
+package sshdconfig
+
+import (
+	"crypto/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Returns a certificate with the given principals and the public key of the CA that signed it
+func generateCert(t *testing.T, principals ...string) (*ssh.Certificate, ssh.PublicKey) {
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	require.NoError(t, err)
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "keybaseca-test-sign:uuid:alice",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return cert, ca.PublicKey()
+}
+
+// Returns the names of the checks that failed
+func failedChecks(result VerifyResult) []string {
+	var failed []string
+	for _, check := range result.Checks {
+		if !check.Passed {
+			failed = append(failed, check.Name)
+		}
+	}
+	return failed
+}
+
+func TestVerify(t *testing.T) {
+	cert, caKey := generateCert(t, "team.ssh.prod", "team.ssh")
+	_, otherCAKey := generateCert(t)
+	dir, cleanup := writeFiles(t, map[string]string{
+		"ca.pub":                       string(ssh.MarshalAuthorizedKey(otherCAKey)) + string(ssh.MarshalAuthorizedKey(caKey)),
+		"auth_principals/root":         "# admins\nteam.ssh.prod\n",
+		"auth_principals/deploy":       "team.ssh.deploy\n",
+		"home/developer/.ssh/accepted": `from="10.0.0.0/8" team.ssh` + "\n",
+	})
+	defer cleanup()
+	sshdConfig := "TrustedUserCAKeys " + filepath.Join(dir, "ca.pub") + "\n" +
+		"AuthorizedPrincipalsFile " + filepath.Join(dir, "auth_principals/%u") + "\n" +
+		"Match User developer\n" +
+		"  AuthorizedPrincipalsFile .ssh/accepted\n" +
+		"Match User nobody\n" +
+		"  PubkeyAuthentication no\n"
+	configDir, cleanupConfig := writeFiles(t, map[string]string{"sshd_config": sshdConfig})
+	defer cleanupConfig()
+	conf, err := Parse(filepath.Join(configDir, "sshd_config"))
+	require.NoError(t, err)
+
+	verify := func(user string) VerifyResult {
+		return Verify(conf, VerifyOptions{Certificate: cert, CAPublicKey: caKey, User: user,
+			HomeDir: filepath.Join(dir, "home", user), UID: "1000", Now: time.Now()})
+	}
+
+	result := verify("root")
+	require.True(t, result.Accepted, "%+v", result)
+	require.Empty(t, failedChecks(result))
+
+	// Relative principals files are relative to the home directory and may have options
+	result = verify("developer")
+	require.True(t, result.Accepted, "%+v", result)
+
+	result = verify("deploy")
+	require.False(t, result.Accepted)
+	require.Equal(t, []string{"Principals"}, failedChecks(result))
+
+	// A user without a principals file is locked out
+	result = verify("ubuntu")
+	require.False(t, result.Accepted)
+	require.Equal(t, []string{"Principals"}, failedChecks(result))
+	require.Contains(t, result.Checks[len(result.Checks)-1].Message, "failed to read the principals file")
+
+	result = verify("nobody")
+	require.Contains(t, failedChecks(result), "PubkeyAuthentication")
+
+	// A CA that is not trusted
+	result = Verify(conf, VerifyOptions{Certificate: cert, CAPublicKey: otherCAKey, User: "root", Now: time.Now()})
+	require.True(t, result.Accepted, "the other CA is trusted too")
+	_, untrustedCAKey := generateCert(t)
+	result = Verify(conf, VerifyOptions{Certificate: cert, CAPublicKey: untrustedCAKey, User: "root", Now: time.Now()})
+	require.Equal(t, []string{"TrustedUserCAKeys"}, failedChecks(result))
+
+	// An expired certificate
+	result = Verify(conf, VerifyOptions{Certificate: cert, CAPublicKey: caKey, User: "root", Now: time.Now().Add(2 * time.Hour)})
+	require.Equal(t, []string{"Validity"}, failedChecks(result))
+}
+
+func TestVerifyWithoutPrincipalsFile(t *testing.T) {
+	cert, caKey := generateCert(t, "root")
+	dir, cleanup := writeFiles(t, map[string]string{
+		"sshd_config": "AllowUsers root deploy@10.0.0.1\nDenyUsers admin*\nRevokedKeys /nonexistent/revoked_keys\n" +
+			"CASignatureAlgorithms rsa-sha2-512\n",
+	})
+	defer cleanup()
+	conf, err := Parse(filepath.Join(dir, "sshd_config"))
+	require.NoError(t, err)
+
+	result := Verify(conf, VerifyOptions{Certificate: cert, CAPublicKey: caKey, User: "root", HomeDir: "/root", Now: time.Now()})
+	require.Equal(t, []string{"TrustedUserCAKeys", "CASignatureAlgorithms", "RevokedKeys"}, failedChecks(result))
+	for _, check := range result.Checks {
+		if check.Name == "Principals" {
+			require.True(t, check.Passed)
+			require.Contains(t, check.Message, "no AuthorizedPrincipalsFile is set")
+		}
+	}
+
+	result = Verify(conf, VerifyOptions{Certificate: cert, CAPublicKey: caKey, User: "admin2", HomeDir: "/root", Now: time.Now()})
+	require.Contains(t, failedChecks(result), "AllowUsers/DenyUsers")
+	require.Contains(t, failedChecks(result), "Principals")
+}
+
+func TestVerifyAuthcheck(t *testing.T) {
+	cert, caKey := generateCert(t, "team.ssh.prod")
+	dir, cleanup := writeFiles(t, map[string]string{
+		"ca.pub":          string(ssh.MarshalAuthorizedKey(caKey)),
+		"principals/root": "team.ssh.prod\n",
+	})
+	defer cleanup()
+	configDir, cleanupConfig := writeFiles(t, map[string]string{
+		"sshd_config": "TrustedUserCAKeys " + filepath.Join(dir, "ca.pub") + "\n" +
+			"AuthorizedPrincipalsCommand /usr/local/bin/kssh-authcheck --principals-file " + filepath.Join(dir, "principals/%u") +
+			" --krl /keybase/team/team.ssh/krl %t %k\n" +
+			"AuthorizedPrincipalsCommandUser kssh-authcheck\n",
+	})
+	defer cleanupConfig()
+	conf, err := Parse(filepath.Join(configDir, "sshd_config"))
+	require.NoError(t, err)
+
+	result := Verify(conf, VerifyOptions{Certificate: cert, CAPublicKey: caKey, User: "root", HomeDir: "/root", Now: time.Now()})
+	require.True(t, result.Accepted, "%+v", result)
+	require.Len(t, result.Warnings, 1)
+	require.True(t, strings.Contains(result.Warnings[0], "KRL and lockdown"))
+}
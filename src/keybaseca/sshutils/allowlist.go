@@ -0,0 +1,43 @@
+package sshutils
+
+import (
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Remove the teams that the given user may not receive certificates for due to TEAM_ALLOWED_USERS and
+// TEAM_DENIED_USERS. This is evaluated after team membership so it can only take principals away. A team is denied if
+// the user is listed in a matching TEAM_DENIED_USERS entry or if there are matching TEAM_ALLOWED_USERS entries and
+// the user is not listed in any of them. Returns the remaining teams and the teams that were removed.
+func filterAllowedTeams(conf config.Config, username string, teams []string) (allowed []string, removed []string) {
+	username = strings.ToLower(username)
+	for _, team := range teams {
+		if isTeamUserAllowed(conf, username, team) {
+			allowed = append(allowed, team)
+		} else {
+			removed = append(removed, team)
+		}
+	}
+	return allowed, removed
+}
+
+func isTeamUserAllowed(conf config.Config, username, team string) bool {
+	for _, entry := range conf.GetTeamDeniedUsers() {
+		if entry.Username == username && shared.MatchTeam(entry.Team, team) {
+			return false
+		}
+	}
+	restricted := false
+	for _, entry := range conf.GetTeamAllowedUsers() {
+		if !shared.MatchTeam(entry.Team, team) {
+			continue
+		}
+		if entry.Username == username {
+			return true
+		}
+		restricted = true
+	}
+	return !restricted
+}
@@ -0,0 +1,45 @@
+package sshutils
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterAllowedTeams(t *testing.T) {
+	os.Setenv("TEAM_ALLOWED_USERS", "team.ssh.prod.*=alice,team.ssh.prod.*=Bob")
+	os.Setenv("TEAM_DENIED_USERS", "team.ssh.staging=contractor,team.ssh.prod.db=bob")
+	defer os.Unsetenv("TEAM_ALLOWED_USERS")
+	defer os.Unsetenv("TEAM_DENIED_USERS")
+	conf := &config.EnvConfig{}
+	teams := []string{"team.ssh.staging", "team.ssh.prod.web", "team.ssh.prod.db"}
+
+	allowed, removed := filterAllowedTeams(conf, "alice", teams)
+	require.Equal(t, teams, allowed)
+	require.Empty(t, removed)
+
+	// The denylist takes precedence over the allowlist and usernames are case insensitive
+	allowed, removed = filterAllowedTeams(conf, "bob", teams)
+	require.Equal(t, []string{"team.ssh.staging", "team.ssh.prod.web"}, allowed)
+	require.Equal(t, []string{"team.ssh.prod.db"}, removed)
+
+	// Teams without allowlist entries are only restricted by the denylist
+	allowed, removed = filterAllowedTeams(conf, "contractor", teams)
+	require.Empty(t, allowed)
+	require.Equal(t, teams, removed)
+	allowed, _ = filterAllowedTeams(conf, "carol", teams)
+	require.Equal(t, []string{"team.ssh.staging"}, allowed)
+}
+
+func TestMapGroupPrincipals(t *testing.T) {
+	entries := []config.GroupPrincipal{
+		{Group: "SRE", Principal: "root"},
+		{Group: "cn=dba,ou=groups,dc=example,dc=com", Principal: "postgres"},
+		{Group: "Admins", Principal: "root"},
+	}
+	require.Equal(t, []string{"root"}, mapGroupPrincipals(entries, []string{"SRE", "Admins", "Everyone"}))
+	require.Equal(t, []string{"postgres"}, mapGroupPrincipals(entries, []string{"cn=dba,ou=groups,dc=example,dc=com"}))
+	require.Empty(t, mapGroupPrincipals(entries, nil))
+}
@@ -0,0 +1,48 @@
+package sshutils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/duo"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Returns whether a certificate with the given principals requires a Duo push approval. Elevated certificates always
+// require approval.
+func isPushApprovalRequired(conf config.Config, principals []string, elevate bool) bool {
+	if conf.GetDuoAPIHost() == "" {
+		return false
+	}
+	if elevate || len(conf.GetDuoTeams()) == 0 {
+		return true
+	}
+	return len(shared.MatchTeams(conf.GetDuoTeams(), principals)) > 0
+}
+
+// Send a Duo push to the user who sent the given signature request (if required for the given principals) and return
+// a RequestDeniedError unless they approve it. The outcome is recorded in the audit log. The Duo username must be the
+// same as the Keybase username.
+func requirePushApproval(conf config.Config, sr shared.SignatureRequest, principals []string) error {
+	if !isPushApprovalRequired(conf, principals, sr.Elevate) {
+		return nil
+	}
+	client := duo.Client{Host: conf.GetDuoAPIHost(), IntegrationKey: conf.GetDuoIntegrationKey(), SecretKey: conf.GetDuoSecretKey()}
+	outcome, err := client.Push(sr.Username, map[string]string{
+		"Principals": strings.Join(principals, ","),
+		"Device":     sr.DeviceName,
+		"Elevated":   fmt.Sprintf("%t", sr.Elevate),
+	}, conf.GetDuoTimeout())
+	if err != nil {
+		log.Log(conf, fmt.Sprintf("Duo push approval for user=%s failed: %v", sr.Username, err))
+		return fmt.Errorf("failed to request a Duo push approval: %v", err)
+	}
+	if !outcome.Approved {
+		log.Log(conf, fmt.Sprintf("Duo push approval for user=%s denied: %s", sr.Username, outcome.Message))
+		return RequestDeniedError{Code: shared.DenialApprovalDenied, Reason: fmt.Sprintf("the Duo push was not approved: %s", outcome.Message)}
+	}
+	log.Log(conf, fmt.Sprintf("Duo push approval for user=%s approved: %s", sr.Username, outcome.Message))
+	return nil
+}
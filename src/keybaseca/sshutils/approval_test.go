@@ -0,0 +1,24 @@
+package sshutils
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsPushApprovalRequired(t *testing.T) {
+	conf := &config.EnvConfig{}
+	require.False(t, isPushApprovalRequired(conf, []string{"team.ssh.prod"}, false))
+
+	os.Setenv("DUO_API_HOST", "api-test.duosecurity.com")
+	defer os.Unsetenv("DUO_API_HOST")
+	require.True(t, isPushApprovalRequired(conf, []string{"team.ssh.staging"}, false))
+
+	os.Setenv("DUO_TEAMS", "team.ssh.prod.*")
+	defer os.Unsetenv("DUO_TEAMS")
+	require.False(t, isPushApprovalRequired(conf, []string{"team.ssh.staging"}, false))
+	require.True(t, isPushApprovalRequired(conf, []string{"team.ssh.staging", "team.ssh.prod.db"}, false))
+	require.True(t, isPushApprovalRequired(conf, []string{"team.ssh.staging"}, true))
+}
@@ -0,0 +1,317 @@
+package sshutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The PEM block type of a CA key encrypted by keybaseca
+const encryptedKeyBlockType = "KEYBASECA ENCRYPTED PRIVATE KEY"
+
+// scrypt parameters used to derive the encryption key from the passphrase
+const (
+	scryptN       = 1 << 15
+	scryptR       = 8
+	scryptP       = 1
+	scryptKeySize = 32
+	saltSize      = 16
+)
+
+var (
+	passphraseCommandLock   sync.Mutex
+	passphraseCommandOutput string
+)
+
+// Earlier versions of keybaseca decrypted the CA key into a "cakey" file in a temporary directory with this prefix
+// while signing, which was left behind if keybaseca crashed before removing it
+const staleDecryptedKeyPrefix = "keybaseca-key"
+
+var removeStaleDecryptedKeysOnce sync.Once
+
+// Get the passphrase used to encrypt the CA key from CA_KEY_PASSPHRASE, CA_KEY_PASSPHRASE_FILE, or the output of
+// CA_KEY_PASSPHRASE_COMMAND. Returns an empty string if the CA key is not encrypted.
+func getCAKeyPassphrase(conf config.Config) (string, error) {
+	switch {
+	case conf.GetCAKeyPassphrase() != "":
+		return conf.GetCAKeyPassphrase(), nil
+	case conf.GetCAKeyPassphraseFile() != "":
+		bytes, err := ioutil.ReadFile(conf.GetCAKeyPassphraseFile())
+		if err != nil {
+			return "", fmt.Errorf("failed to read the CA key passphrase from %s: %v", conf.GetCAKeyPassphraseFile(), err)
+		}
+		passphrase := strings.TrimRight(string(bytes), "\r\n")
+		shared.RegisterSecret(passphrase)
+		return passphrase, nil
+	case conf.GetCAKeyPassphraseCommand() != "":
+		// The command may be slow (eg a call to a KMS) so its output is cached for the lifetime of the process
+		passphraseCommandLock.Lock()
+		defer passphraseCommandLock.Unlock()
+		if passphraseCommandOutput != "" {
+			return passphraseCommandOutput, nil
+		}
+		cmd := exec.Command("sh", "-c", conf.GetCAKeyPassphraseCommand())
+		cmd.Stderr = os.Stderr
+		bytes, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("CA_KEY_PASSPHRASE_COMMAND failed: %v", err)
+		}
+		passphrase := strings.TrimRight(string(bytes), "\r\n")
+		if passphrase == "" {
+			return "", fmt.Errorf("CA_KEY_PASSPHRASE_COMMAND did not output a passphrase")
+		}
+		shared.RegisterSecret(passphrase)
+		passphraseCommandOutput = passphrase
+		return passphrase, nil
+	default:
+		return "", nil
+	}
+}
+
+// ReadCAKey checks the permissions on the CA key and returns its (decrypted) contents. The contents are kept out of
+// swap where supported and release zeroes them. release must always be called, even if an error is returned.
+func ReadCAKey(conf config.Config) (contents []byte, release func(), err error) {
+	contents, _, release, err = readCAKey(conf, func() (string, error) { return getCAKeyPassphrase(conf) })
+	return contents, release, err
+}
+
+// Read and decrypt the CA key. encrypted is whether the CA key is stored encrypted. The decrypted contents are locked
+// into memory (see LockMemory) until release is called. release must always be called, even if an error is returned.
+func readCAKey(conf config.Config, getPassphrase func() (string, error)) (contents []byte, encrypted bool, release func(), err error) {
+	release = func() {}
+	err = checkCAKeyPermissions(conf.GetCAKeyLocation())
+	if err != nil {
+		return nil, false, release, err
+	}
+	contents, err = ioutil.ReadFile(conf.GetCAKeyLocation())
+	if err != nil {
+		return nil, false, release, fmt.Errorf("failed to load the CA key from %s: %v", conf.GetCAKeyLocation(), err)
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil || block.Type != encryptedKeyBlockType {
+		return contents, false, LockMemory(contents), nil
+	}
+	passphrase, err := getPassphrase()
+	if err != nil {
+		return nil, true, release, err
+	}
+	if passphrase == "" {
+		return nil, true, release, fmt.Errorf("the CA key at %s is encrypted but no passphrase is configured", conf.GetCAKeyLocation())
+	}
+	contents, err = decryptKey(block, passphrase)
+	if err != nil {
+		return nil, true, release, err
+	}
+	return contents, true, LockMemory(contents), nil
+}
+
+// A CAKey is a CA key that ssh-keygen can sign certificates with (see SignKeyWithCAKey). An unencrypted CA key is
+// read from its file. An encrypted CA key is only ever decrypted in memory and is held by an ssh-agent served from this
+// process, which ssh-keygen signs with via -U, so that the plaintext key is never written to disk.
+type CAKey struct {
+	// The unencrypted CA private key file. Empty if the key is held by an agent.
+	Path string
+	// The CA public key file and the socket of the ssh-agent that holds the private key. Empty if Path is set.
+	PublicKeyPath string
+	AgentSocket   string
+}
+
+// LoadCAKey returns the CA key in a form that ssh-keygen can use. If the CA key is encrypted, it is decrypted into an
+// ssh-agent that is served from this process on a socket in a private temporary directory until cleanup is called.
+// cleanup must always be called, even if an error is returned.
+func LoadCAKey(conf config.Config) (caKey CAKey, cleanup func(), err error) {
+	return loadCAKey(conf, func() (string, error) { return getCAKeyPassphrase(conf) })
+}
+
+// Like LoadCAKey but the CA key is decrypted with the passphrase returned by getPassphrase
+func loadCAKey(conf config.Config, getPassphrase func() (string, error)) (caKey CAKey, cleanup func(), err error) {
+	cleanup = func() {}
+	err = checkFIPSCAKey(conf)
+	if err != nil {
+		return caKey, cleanup, err
+	}
+	contents, encrypted, release, err := readCAKey(conf, getPassphrase)
+	// The decrypted PEM is zeroed as soon as it has been parsed. The parsed key is held by the agent on the Go heap,
+	// which cannot be locked into memory, until the agent is stopped.
+	defer release()
+	if err != nil {
+		return caKey, cleanup, err
+	}
+	if !encrypted {
+		return CAKey{Path: conf.GetCAKeyLocation()}, cleanup, nil
+	}
+	removeStaleDecryptedKeysOnce.Do(func() { removeStaleDecryptedKeys(conf) })
+	privateKey, err := ssh.ParseRawPrivateKey(contents)
+	if err != nil {
+		return caKey, cleanup, fmt.Errorf("failed to parse the decrypted CA key: %v", err)
+	}
+	return serveCAKeyAgent(privateKey)
+}
+
+// Remove the plaintext copies of the CA key that earlier versions of keybaseca left in the temporary directory
+func removeStaleDecryptedKeys(conf config.Config) {
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), staleDecryptedKeyPrefix+"*"))
+	for _, dir := range matches {
+		if _, err := os.Stat(filepath.Join(dir, "cakey")); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Log(conf, fmt.Sprintf("Failed to remove a decrypted copy of the CA key left behind at %s: %v", dir, err))
+		} else {
+			log.Log(conf, fmt.Sprintf("Removed a decrypted copy of the CA key left behind at %s", dir))
+		}
+	}
+}
+
+// Serve an ssh-agent holding only privateKey on a socket in a new private temporary directory. The agent is stopped
+// and the directory deleted by calling cleanup, which must always be called, even if an error is returned.
+func serveCAKeyAgent(privateKey interface{}) (caKey CAKey, cleanup func(), err error) {
+	cleanup = func() {}
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: privateKey})
+	if err != nil {
+		return caKey, cleanup, fmt.Errorf("failed to load the CA key into the agent: %v", err)
+	}
+	signers, err := keyring.Signers()
+	if err != nil || len(signers) != 1 {
+		return caKey, cleanup, fmt.Errorf("failed to load the CA key into the agent: %v", err)
+	}
+	// ioutil.TempDir creates the directory with 0700 permissions so that only the keybaseca user can use the agent
+	dir, err := ioutil.TempDir("", "keybaseca-agent")
+	if err != nil {
+		return caKey, cleanup, err
+	}
+	cleanup = func() {
+		_ = keyring.RemoveAll()
+		os.RemoveAll(dir)
+	}
+	caKey = CAKey{PublicKeyPath: filepath.Join(dir, "ca.pub"), AgentSocket: filepath.Join(dir, "agent.sock")}
+	err = ioutil.WriteFile(caKey.PublicKeyPath, ssh.MarshalAuthorizedKey(signers[0].PublicKey()), 0600)
+	if err != nil {
+		return caKey, cleanup, err
+	}
+	listener, err := net.Listen("unix", caKey.AgentSocket)
+	if err != nil {
+		return caKey, cleanup, fmt.Errorf("failed to start the CA key agent: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+	cleanup = func() {
+		listener.Close()
+		_ = keyring.RemoveAll()
+		os.RemoveAll(dir)
+	}
+	return caKey, cleanup, nil
+}
+
+// Encrypt the (unencrypted) CA key at conf.GetCAKeyLocation() in place if a passphrase is configured
+func encryptCAKey(conf config.Config) error {
+	return encryptKeyFile(conf, conf.GetCAKeyLocation())
+}
+
+// Encrypt the (unencrypted) key at filename in place with the CA key passphrase if one is configured
+func encryptKeyFile(conf config.Config, filename string) error {
+	passphrase, err := getCAKeyPassphrase(conf)
+	if err != nil || passphrase == "" {
+		return err
+	}
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	defer LockMemory(contents)()
+	block, err := encryptKey(contents, passphrase)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, pem.EncodeToMemory(block), 0600)
+}
+
+// Derive an AES-GCM cipher from the given passphrase and salt
+func newCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, scryptKeySize)
+	if err != nil {
+		return nil, err
+	}
+	defer Zeroize(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt the given private key with the given passphrase
+func encryptKey(contents []byte, passphrase string) (*pem.Block, error) {
+	salt := make([]byte, saltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &pem.Block{
+		Type:    encryptedKeyBlockType,
+		Headers: map[string]string{"KDF": "scrypt", "Salt": hex.EncodeToString(salt)},
+		Bytes:   aead.Seal(nonce, nonce, contents, nil),
+	}, nil
+}
+
+// Decrypt a private key encrypted by encryptKey
+func decryptKey(block *pem.Block, passphrase string) ([]byte, error) {
+	if block.Headers["KDF"] != "scrypt" {
+		return nil, fmt.Errorf("unsupported CA key KDF: '%s'", block.Headers["KDF"])
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the CA key salt: %v", err)
+	}
+	aead, err := newCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, fmt.Errorf("the encrypted CA key is truncated")
+	}
+	nonce, ciphertext := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	contents, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt the CA key (is the passphrase correct?): %v", err)
+	}
+	return contents, nil
+}
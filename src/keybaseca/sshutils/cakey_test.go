@@ -0,0 +1,129 @@
+package sshutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestEncryptDecryptKey(t *testing.T) {
+	block, err := encryptKey([]byte("private key"), "passphrase")
+	require.NoError(t, err)
+	require.NotContains(t, string(block.Bytes), "private key")
+
+	contents, err := decryptKey(block, "passphrase")
+	require.NoError(t, err)
+	require.Equal(t, "private key", string(contents))
+
+	_, err = decryptKey(block, "wrong passphrase")
+	require.Error(t, err)
+}
+
+func TestLoadCAKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cakey")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKeyLocation := filepath.Join(dir, "cakey")
+	userKey := filepath.Join(dir, "user")
+	require.NoError(t, GenerateNewSSHKey(caKeyLocation, false, false))
+	require.NoError(t, GenerateNewSSHKey(userKey, false, false))
+	plaintext, err := ioutil.ReadFile(caKeyLocation)
+	require.NoError(t, err)
+	caPublicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(caKeyLocation))
+	require.NoError(t, err)
+	userPublicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+	os.Setenv("CA_KEY_LOCATION", caKeyLocation)
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	conf := &config.EnvConfig{}
+
+	// An unencrypted key is used in place
+	caKey, cleanup, err := LoadCAKey(conf)
+	require.NoError(t, err)
+	require.Equal(t, CAKey{Path: caKeyLocation}, caKey)
+	cleanup()
+
+	// An encrypted key is decrypted into an agent rather than onto disk
+	os.Setenv("CA_KEY_PASSPHRASE", "passphrase")
+	defer os.Unsetenv("CA_KEY_PASSPHRASE")
+	require.NoError(t, encryptCAKey(conf))
+	encrypted, err := ioutil.ReadFile(caKeyLocation)
+	require.NoError(t, err)
+	require.NotEqual(t, plaintext, encrypted)
+
+	caKey, cleanup, err = LoadCAKey(conf)
+	require.NoError(t, err)
+	require.Empty(t, caKey.Path)
+	require.NotEmpty(t, caKey.AgentSocket)
+	keyDir := filepath.Dir(caKey.AgentSocket)
+	files, err := ioutil.ReadDir(keyDir)
+	require.NoError(t, err)
+	for _, f := range files {
+		contents, err := ioutil.ReadFile(filepath.Join(keyDir, f.Name()))
+		if err == nil {
+			require.NotContains(t, string(contents), "PRIVATE KEY")
+		}
+	}
+	signature, err := SignKeyWithCAKey(caKey, "", "key-id", "team.ssh.prod", "+15m", string(userPublicKey))
+	require.NoError(t, err)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature))
+	require.NoError(t, err)
+	expected, _, _, _, err := ssh.ParseAuthorizedKey(caPublicKey)
+	require.NoError(t, err)
+	require.Equal(t, expected.Marshal(), parsed.(*ssh.Certificate).SignatureKey.Marshal())
+	cleanup()
+	_, err = os.Stat(keyDir)
+	require.True(t, os.IsNotExist(err))
+
+	// Without the passphrase the key cannot be used
+	os.Unsetenv("CA_KEY_PASSPHRASE")
+	_, cleanup, err = LoadCAKey(conf)
+	cleanup()
+	require.Error(t, err)
+}
+
+func TestRemoveStaleDecryptedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cakey")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer os.Setenv("TMPDIR", os.Getenv("TMPDIR"))
+	os.Setenv("TMPDIR", dir)
+	stale := filepath.Join(dir, staleDecryptedKeyPrefix+"123")
+	require.NoError(t, os.Mkdir(stale, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(stale, "cakey"), []byte("private key"), 0600))
+	// Directories that do not contain a CA key are left alone
+	other := filepath.Join(dir, staleDecryptedKeyPrefix+"-other")
+	require.NoError(t, os.Mkdir(other, 0700))
+
+	removeStaleDecryptedKeys(&config.EnvConfig{})
+	_, err = os.Stat(stale)
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(other)
+	require.NoError(t, err)
+}
+
+func TestCheckCAKeyPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not checked on windows")
+	}
+	dir, err := ioutil.TempDir("", "cakey")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKeyLocation := filepath.Join(dir, "cakey")
+	require.NoError(t, ioutil.WriteFile(caKeyLocation, []byte("private key"), 0600))
+	require.NoError(t, checkCAKeyPermissions(caKeyLocation))
+
+	require.NoError(t, os.Chmod(caKeyLocation, 0640))
+	require.Error(t, checkCAKeyPermissions(caKeyLocation))
+
+	require.NoError(t, os.Chmod(caKeyLocation, 0600))
+	require.NoError(t, os.Chmod(dir, 0777))
+	require.Error(t, checkCAKeyPermissions(caKeyLocation))
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package sshutils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Returns an error if the CA key at caKeyLocation is accessible by other users or if the directory containing it is
+// writable by other users
+func checkCAKeyPermissions(caKeyLocation string) error {
+	info, err := os.Stat(caKeyLocation)
+	if err != nil {
+		return fmt.Errorf("failed to stat the CA key at %s: %v", caKeyLocation, err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("refusing to use the CA key at %s since it is accessible by other users (mode %s), run `chmod 600 %s`",
+			caKeyLocation, info.Mode().Perm(), caKeyLocation)
+	}
+	dir := filepath.Dir(caKeyLocation)
+	info, err = os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %v", dir, err)
+	}
+	if info.Mode().Perm()&0022 != 0 {
+		return fmt.Errorf("refusing to use the CA key at %s since %s is writable by other users (mode %s), run `chmod 700 %s`",
+			caKeyLocation, dir, info.Mode().Perm(), dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		log.Warnf("The directory containing the CA key (%s) is accessible by other users (mode %s), consider running `chmod 700 %s`",
+			dir, info.Mode().Perm(), dir)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package sshutils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"github.com/google/uuid"
+)
+
+// The default lifetime of canary certificates. Canaries are planted and then forgotten about so they are long-lived.
+const DefaultCanaryTTL = 365 * 24 * time.Hour
+
+// SignCanary signs the given public key as a canary certificate (see the canary package) in the name of the decoy
+// Keybase user decoyUser. The key ID has the same format as the key IDs of the certificates issued by the bot so that
+// the canary cannot be told apart from a real certificate. principals are used as is since they should be principals
+// that no server accepts. ttl defaults to DefaultCanaryTTL if zero. Must be run by root or the owner of the CA key.
+func SignCanary(conf config.Config, decoyUser, publicKey string, principals []string, ttl time.Duration) (signature, keyID string, err error) {
+	if !shared.IsValidKeybaseUsername(decoyUser) {
+		return "", "", fmt.Errorf("'%s' is not a valid Keybase username", decoyUser)
+	}
+	if len(principals) == 0 {
+		return "", "", fmt.Errorf("canary certificates need at least one principal")
+	}
+	for _, principal := range principals {
+		if principal == "" || strings.ContainsAny(principal, ", \t\n") {
+			return "", "", fmt.Errorf("'%s' is not a valid principal", principal)
+		}
+	}
+	if ttl == 0 {
+		ttl = DefaultCanaryTTL
+	}
+	expiration, err := ttlToExpiration(conf, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	expiration = ValidityInterval(conf, expiration)
+	requestUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate unique key ID: %v", err)
+	}
+	randomUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate unique key ID: %v", err)
+	}
+	keyID = requestUUID.String() + ":" + randomUUID.String() + ":" + decoyUser
+
+	log.Log(conf, fmt.Sprintf("Signing canary certificate keyID:%s, principals:%s, expiration:%s, pubkey:%s",
+		keyID, strings.Join(principals, ","), expiration, strings.TrimSpace(publicKey)))
+	if conf.GetVaultSSHRole() != "" {
+		signature, err = SignKeyWithVault(conf, keyID, strings.Join(principals, ","), expiration, publicKey)
+		return signature, keyID, err
+	}
+	err = CheckLocalAuth(conf.GetCAKeyLocation())
+	if err != nil {
+		return "", "", err
+	}
+	chain, err := IntermediateOptions(conf, strings.Join(principals, ","))
+	if err != nil {
+		return "", "", err
+	}
+	caKey, cleanup, err := LoadCAKey(conf)
+	defer cleanup()
+	if err != nil {
+		return "", "", err
+	}
+	signature, err = SignKeyWithCAKey(caKey, DefaultSignatureAlgorithm(conf), keyID, strings.Join(principals, ","), expiration, publicKey, chain...)
+	return signature, keyID, err
+}
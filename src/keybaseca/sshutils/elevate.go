@@ -0,0 +1,34 @@
+package sshutils
+
+import (
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Get the elevated principals that a user with the given (team) principals may receive via `kssh --elevate`
+func getElevatedPrincipals(conf config.Config, principals []string) []string {
+	var elevated []string
+	seen := make(map[string]bool)
+	for _, entry := range conf.GetElevatedPrincipals() {
+		if seen[entry.Principal] || len(shared.MatchTeams([]string{entry.Team}, principals)) == 0 {
+			continue
+		}
+		seen[entry.Principal] = true
+		elevated = append(elevated, entry.Principal)
+	}
+	return elevated
+}
+
+// GetElevatedPrincipalNames returns every elevated principal in the config. kssh uses this list to check that the
+// principals in an elevated certificate are expected.
+func GetElevatedPrincipalNames(conf config.Config) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, entry := range conf.GetElevatedPrincipals() {
+		if !seen[entry.Principal] {
+			seen[entry.Principal] = true
+			names = append(names, entry.Principal)
+		}
+	}
+	return names
+}
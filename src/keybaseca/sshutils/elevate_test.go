@@ -0,0 +1,20 @@
+package sshutils
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetElevatedPrincipals(t *testing.T) {
+	os.Setenv("ELEVATED_PRINCIPALS", "team.ssh.prod.*=prod-sudo,team.ssh.staging=staging-sudo,team.ssh.prod.db=prod-sudo")
+	defer os.Unsetenv("ELEVATED_PRINCIPALS")
+	conf := &config.EnvConfig{}
+
+	require.Equal(t, []string{"prod-sudo"}, getElevatedPrincipals(conf, []string{"team.ssh.prod.db"}))
+	require.Equal(t, []string{"prod-sudo", "staging-sudo"}, getElevatedPrincipals(conf, []string{"team.ssh.staging", "team.ssh.prod.web"}))
+	require.Nil(t, getElevatedPrincipals(conf, []string{"team.ssh.dev"}))
+	require.Equal(t, []string{"prod-sudo", "staging-sudo"}, GetElevatedPrincipalNames(conf))
+}
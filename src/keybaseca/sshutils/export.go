@@ -0,0 +1,161 @@
+package sshutils
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/serversetup"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// The formats that ExportPublicKey supports
+const (
+	// The authorized_keys format used by TrustedUserCAKeys
+	ExportFormatOpenSSH = "openssh"
+	// A PEM encoded PKIX (SubjectPublicKeyInfo) public key, eg for HashiCorp Vault's SSH secrets engine
+	ExportFormatPEM = "pem"
+	// A JSON Web Key (RFC 7517, and RFC 8037 for ed25519 keys)
+	ExportFormatJWK = "jwk"
+	// The sshd_config directives that trust the key (see serversetup.GenerateSSHDSnippet)
+	ExportFormatSSHDSnippet = "sshd-snippet"
+)
+
+// ExportFormats lists the formats that ExportPublicKey supports
+var ExportFormats = []string{ExportFormatOpenSSH, ExportFormatPEM, ExportFormatJWK, ExportFormatSSHDSnippet}
+
+// GetTrustedCAPublicKey returns the public key in authorized_keys format that servers must trust in order to accept
+// certificates issued by keybaseca. This is the offline root CA key if the CA key is an intermediate CA key (see
+// INTERMEDIATE_CERT_LOCATION) and otherwise the CA public key.
+func GetTrustedCAPublicKey(conf config.Config) (string, error) {
+	intermediate, err := LoadIntermediateCert(conf, time.Now())
+	if err != nil {
+		return "", err
+	}
+	if intermediate != nil {
+		return string(ssh.MarshalAuthorizedKey(intermediate.SignatureKey)), nil
+	}
+	publicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetCAKeyLocation()))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the CA public key (run `keybaseca generate` first): %v", err)
+	}
+	return string(publicKey), nil
+}
+
+// ExportPublicKey converts the given public key in authorized_keys format to the given format (one of ExportFormats)
+func ExportPublicKey(publicKey, format string) (string, error) {
+	key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the public key: %v", err)
+	}
+	switch format {
+	case ExportFormatOpenSSH:
+		authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		if comment != "" {
+			authorizedKey += " " + comment
+		}
+		return authorizedKey + "\n", nil
+	case ExportFormatPEM:
+		der, err := marshalPKIXPublicKey(key)
+		if err != nil {
+			return "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+	case ExportFormatJWK:
+		jwk, err := marshalJWK(key)
+		if err != nil {
+			return "", err
+		}
+		return string(jwk) + "\n", nil
+	case ExportFormatSSHDSnippet:
+		return serversetup.GenerateSSHDSnippet(publicKey)
+	default:
+		return "", fmt.Errorf("unknown format '%s', expected one of %s", format, strings.Join(ExportFormats, ", "))
+	}
+}
+
+// The object identifier of ed25519 keys (RFC 8410)
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// Returns the underlying crypto public key of an SSH public key
+func cryptoPublicKey(key ssh.PublicKey) (interface{}, error) {
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s keys cannot be exported in this format", key.Type())
+	}
+	return cryptoKey.CryptoPublicKey(), nil
+}
+
+// Marshal the given key as a DER encoded PKIX public key. ed25519 keys are encoded by hand since crypto/x509 only
+// supports them as of go 1.13.
+func marshalPKIXPublicKey(key ssh.PublicKey) ([]byte, error) {
+	cryptoKey, err := cryptoPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	switch k := cryptoKey.(type) {
+	case ed25519.PublicKey:
+		return asn1.Marshal(struct {
+			Algorithm pkix.AlgorithmIdentifier
+			PublicKey asn1.BitString
+		}{
+			Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+			PublicKey: asn1.BitString{Bytes: k, BitLength: 8 * len(k)},
+		})
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return x509.MarshalPKIXPublicKey(k)
+	default:
+		return nil, fmt.Errorf("%s keys cannot be exported in this format", key.Type())
+	}
+}
+
+// Marshal the given key as a JSON Web Key. The key ID is the SHA256 fingerprint of the key.
+func marshalJWK(key ssh.PublicKey) ([]byte, error) {
+	cryptoKey, err := cryptoPublicKey(key)
+	if err != nil {
+		return nil, err
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	jwk := map[string]string{"kid": ssh.FingerprintSHA256(key), "use": "sig"}
+	switch k := cryptoKey.(type) {
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = encode(k)
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = encode(k.N.Bytes())
+		jwk["e"] = encode(big.NewInt(int64(k.E)).Bytes())
+	case *ecdsa.PublicKey:
+		jwk["kty"] = "EC"
+		jwk["crv"] = k.Curve.Params().Name
+		// The coordinates are padded to the size of the curve
+		size := (k.Curve.Params().BitSize + 7) / 8
+		jwk["x"] = encode(padLeft(k.X.Bytes(), size))
+		jwk["y"] = encode(padLeft(k.Y.Bytes(), size))
+	default:
+		return nil, fmt.Errorf("%s keys cannot be exported in this format", key.Type())
+	}
+	return json.MarshalIndent(jwk, "", "  ")
+}
+
+func padLeft(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
@@ -0,0 +1,90 @@
+package sshutils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func authorizedKey(t *testing.T, key interface{}) string {
+	sshKey, err := ssh.NewPublicKey(key)
+	require.NoError(t, err)
+	return string(ssh.MarshalAuthorizedKey(sshKey))
+}
+
+func TestExportPublicKey(t *testing.T) {
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	// openssh keeps the comment
+	withComment := strings.TrimSpace(authorizedKey(t, ed25519Key)) + " keybaseca"
+	exported, err := ExportPublicKey(withComment, ExportFormatOpenSSH)
+	require.NoError(t, err)
+	require.Equal(t, withComment+"\n", exported)
+
+	// pem
+	exported, err = ExportPublicKey(authorizedKey(t, ed25519Key), ExportFormatPEM)
+	require.NoError(t, err)
+	block, _ := pem.Decode([]byte(exported))
+	require.Equal(t, "PUBLIC KEY", block.Type)
+	// The fixed RFC 8410 prefix followed by the key
+	prefix := []byte{0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00}
+	require.Equal(t, append(prefix, ed25519Key...), block.Bytes)
+	for _, key := range []interface{}{&rsaKey.PublicKey, &ecdsaKey.PublicKey} {
+		exported, err = ExportPublicKey(authorizedKey(t, key), ExportFormatPEM)
+		require.NoError(t, err)
+		block, _ = pem.Decode([]byte(exported))
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		require.NoError(t, err)
+		require.Equal(t, key, parsed)
+	}
+
+	// jwk
+	var jwk map[string]string
+	exported, err = ExportPublicKey(authorizedKey(t, ed25519Key), ExportFormatJWK)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(exported), &jwk))
+	require.Equal(t, "OKP", jwk["kty"])
+	require.Equal(t, "Ed25519", jwk["crv"])
+	require.Equal(t, base64.RawURLEncoding.EncodeToString(ed25519Key), jwk["x"])
+	exported, err = ExportPublicKey(authorizedKey(t, &rsaKey.PublicKey), ExportFormatJWK)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(exported), &jwk))
+	require.Equal(t, "RSA", jwk["kty"])
+	require.Equal(t, "AQAB", jwk["e"])
+	exported, err = ExportPublicKey(authorizedKey(t, &ecdsaKey.PublicKey), ExportFormatJWK)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(exported), &jwk))
+	require.Equal(t, "EC", jwk["kty"])
+	require.Equal(t, "P-256", jwk["crv"])
+	y, err := base64.RawURLEncoding.DecodeString(jwk["y"])
+	require.NoError(t, err)
+	require.Len(t, y, 32)
+	require.True(t, bytes.Equal(padLeft(ecdsaKey.Y.Bytes(), 32), y))
+
+	// sshd-snippet
+	exported, err = ExportPublicKey(authorizedKey(t, ed25519Key), ExportFormatSSHDSnippet)
+	require.NoError(t, err)
+	require.Contains(t, exported, "TrustedUserCAKeys /etc/ssh/ca.pub\n")
+
+	_, err = ExportPublicKey(authorizedKey(t, ed25519Key), "der")
+	require.Error(t, err)
+	_, err = ExportPublicKey("garbage", ExportFormatPEM)
+	require.Error(t, err)
+}
@@ -0,0 +1,44 @@
+package sshutils
+
+import (
+	"sort"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Filter the custom extensions requested via `kssh --extension` against ALLOWED_EXTENSIONS for the given principals.
+// An extension is granted if an entry for one of the user's teams allows its name and value. Returns the ssh-keygen
+// options for the granted extensions and the names of the extensions that were not granted, both sorted by name.
+func filterExtensions(conf config.Config, requested map[string]string, principals []string) (options []string, denied []string) {
+	var names []string
+	for name := range requested {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := requested[name]
+		if shared.ValidateExtension(name, value) == nil && isExtensionAllowed(conf, name, value, principals) {
+			option := "extension:" + name
+			if value != "" {
+				option += "=" + value
+			}
+			options = append(options, option)
+		} else {
+			denied = append(denied, name)
+		}
+	}
+	return options, denied
+}
+
+func isExtensionAllowed(conf config.Config, name, value string, principals []string) bool {
+	for _, entry := range conf.GetAllowedExtensions() {
+		if entry.Name != name || (entry.Value != "*" && entry.Value != value) {
+			continue
+		}
+		if len(shared.MatchTeams([]string{entry.Team}, principals)) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package sshutils
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterExtensions(t *testing.T) {
+	os.Setenv("ALLOWED_EXTENSIONS", "team.ssh.prod=groups@acme.com=dba,team.ssh.*=login@acme.com,team.ssh.staging=role@acme.com=*")
+	defer os.Unsetenv("ALLOWED_EXTENSIONS")
+	conf := &config.EnvConfig{}
+
+	options, denied := filterExtensions(conf, map[string]string{
+		"groups@acme.com": "dba",
+		"login@acme.com":  "",
+		"role@acme.com":   "admin",
+	}, []string{"team.ssh.prod"})
+	require.Equal(t, []string{"extension:groups@acme.com=dba", "extension:login@acme.com"}, options)
+	require.Equal(t, []string{"role@acme.com"}, denied)
+
+	options, denied = filterExtensions(conf, map[string]string{
+		"groups@acme.com": "root",
+		"role@acme.com":   "admin",
+	}, []string{"team.ssh.staging"})
+	require.Equal(t, []string{"extension:role@acme.com=admin"}, options)
+	require.Equal(t, []string{"groups@acme.com"}, denied)
+
+	// Standard extensions can never be requested even if they somehow made it into the request
+	options, denied = filterExtensions(conf, map[string]string{"permit-pty": ""}, []string{"team.ssh.prod"})
+	require.Empty(t, options)
+	require.Equal(t, []string{"permit-pty"}, denied)
+
+	options, denied = filterExtensions(conf, nil, []string{"team.ssh.prod"})
+	require.Empty(t, options)
+	require.Empty(t, denied)
+}
@@ -0,0 +1,44 @@
+package sshutils
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Returns an error if in FIPS mode and the given public key (in authorized_keys format) may not be signed (see
+// shared.CheckFIPSKey)
+func checkFIPSPublicKey(publicKey string) error {
+	if !shared.FIPSMode {
+		return nil
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return fmt.Errorf("failed to parse the public key: %v", err)
+	}
+	return shared.CheckFIPSKey(key)
+}
+
+// Returns an error if in FIPS mode and the CA key may not be used (see shared.CheckFIPSKey)
+func checkFIPSCAKey(conf config.Config) error {
+	if !shared.FIPSMode {
+		return nil
+	}
+	bytes, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetCAKeyLocation()))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA public key: %v", err)
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse the CA public key: %v", err)
+	}
+	err = shared.CheckFIPSKey(key)
+	if err != nil {
+		return fmt.Errorf("the CA key cannot be used in FIPS mode (run `keybaseca generate` to generate a new ECDSA CA key): %v", err)
+	}
+	return nil
+}
@@ -10,7 +10,6 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
-	"strings"
 
 	"golang.org/x/crypto/ssh"
 
@@ -22,8 +21,12 @@ import (
 // generates an ecdsa key using go's crypto library. Note that we use ecdsa rather than ed25519
 // in this case since go's crypto library does not support marshalling ed25519 keys into the format
 // expected by openssh. github.com/ScaleFT/sshkeys claims to support this but does not reliably
-// work with all versions of ssh.
+// work with all versions of ssh. In FIPS mode (see shared.FIPSMode) an ecdsa key is always generated using go's crypto
+// library since ed25519 is not FIPS approved and go's crypto library is backed by the validated BoringCrypto module.
 func generateNewSSHKey(filename string) error {
+	if shared.FIPSMode {
+		return generateNewSSHKeyEcdsa(filename)
+	}
 	if sshKeygenBinaryExists() {
 		return generateNewSSHKeyEd25519(filename)
 	}
@@ -42,7 +45,7 @@ func generateNewSSHKeyEd25519(filename string) error {
 	cmd := exec.Command("ssh-keygen", "-t", "ed25519", "-f", filename, "-m", "PEM", "-N", "")
 	bytes, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("ssh-keygen failed: %s (%v)", strings.TrimSpace(string(bytes)), err)
+		return fmt.Errorf("ssh-keygen failed: %s (%v)", shared.RedactOutput(bytes), err)
 	}
 	return nil
 }
@@ -0,0 +1,86 @@
+package sshutils
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/groups"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The group cache is shared between requests so that it is built lazily from the config of the first request
+var groupCacheLock sync.Mutex
+var groupCache *groups.Cache
+
+func getGroupCache(conf config.Config) *groups.Cache {
+	groupCacheLock.Lock()
+	defer groupCacheLock.Unlock()
+	if groupCache != nil {
+		return groupCache
+	}
+	var provider groups.Provider
+	switch conf.GetGroupProvider() {
+	case "okta":
+		provider = &groups.OktaProvider{URL: conf.GetOktaURL(), APIToken: conf.GetOktaAPIToken()}
+	case "command":
+		provider = &groups.CommandProvider{Command: conf.GetGroupCommand()}
+	default:
+		return nil
+	}
+	groupCache = groups.NewCache(provider, conf.GetGroupCacheTTL())
+	return groupCache
+}
+
+// Get the principals granted to the given user via GROUP_PRINCIPALS based on their groups in the external group
+// provider. If the provider fails the request is denied unless GROUP_FAILURE_MODE is open, in which case the principals
+// of the last known groups of the user (if any) are used.
+func getGroupPrincipals(conf config.Config, username string) ([]string, error) {
+	cache := getGroupCache(conf)
+	if cache == nil {
+		return nil, nil
+	}
+	user := conf.GetGroupUsername(username)
+	userGroups, err := cache.GetGroups(user)
+	if err != nil {
+		if !conf.GetGroupFailOpen() {
+			log.Log(conf, fmt.Sprintf("Failed to look up the groups of %s (%s): %v", username, user, err))
+			return nil, RequestDeniedError{Code: shared.DenialLookupFailed, Reason: "failed to look up the groups of " + username}
+		}
+		log.Log(conf, fmt.Sprintf("Failed to look up the groups of %s (%s), using the last known groups %v: %v",
+			username, user, userGroups, err))
+	}
+	return mapGroupPrincipals(conf.GetGroupPrincipals(), userGroups), nil
+}
+
+// Map the given groups to principals via the given GROUP_PRINCIPALS entries, without duplicates
+func mapGroupPrincipals(entries []config.GroupPrincipal, userGroups []string) []string {
+	inGroup := make(map[string]bool)
+	for _, group := range userGroups {
+		inGroup[group] = true
+	}
+	var principals []string
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if inGroup[entry.Group] && !seen[entry.Principal] {
+			seen[entry.Principal] = true
+			principals = append(principals, entry.Principal)
+		}
+	}
+	return principals
+}
+
+// GetGroupPrincipalNames returns every principal that may be granted via GROUP_PRINCIPALS so that kssh accepts
+// certificates that contain them
+func GetGroupPrincipalNames(conf config.Config) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for _, entry := range conf.GetGroupPrincipals() {
+		if !seen[entry.Principal] {
+			seen[entry.Principal] = true
+			names = append(names, entry.Principal)
+		}
+	}
+	return names
+}
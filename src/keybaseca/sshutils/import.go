@@ -0,0 +1,190 @@
+package sshutils
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// The smallest RSA CA key that can be imported
+const minImportedRSAKeySize = 2048
+
+// ImportCAKey installs the existing private key at path as the CA key so that an organization migrating from another
+// SSH CA (eg a CA key generated with ssh-keygen, or the key that was imported into HashiCorp Vault) can keep the key
+// that its servers already trust. The key may be encrypted with passphrase. If expectedPublicKey is not empty, the key
+// must match it. The imported key is stored like a key generated by `keybaseca generate`: unencrypted, or encrypted
+// with the CA key passphrase if one is configured. Returns the public key in authorized_keys format.
+func ImportCAKey(conf config.Config, path, passphrase, expectedPublicKey string, overwrite bool) (string, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the key to import: %v", err)
+	}
+	defer LockMemory(contents)()
+	encrypted := false
+	privateKey, err := ssh.ParseRawPrivateKey(contents)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		if passphrase == "" {
+			return "", fmt.Errorf("the key at %s is encrypted but no passphrase was given", path)
+		}
+		encrypted = true
+		privateKey, err = ssh.ParseRawPrivateKeyWithPassphrase(contents, []byte(passphrase))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the key to import: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the key to import: %v", err)
+	}
+	publicKey := signer.PublicKey()
+	err = checkImportedKeyType(publicKey)
+	if err != nil {
+		return "", err
+	}
+	if expectedPublicKey != "" {
+		expected, _, _, _, err := ssh.ParseAuthorizedKey([]byte(expectedPublicKey))
+		if err != nil {
+			return "", fmt.Errorf("failed to parse the expected public key: %v", err)
+		}
+		if !bytes.Equal(expected.Marshal(), publicKey.Marshal()) {
+			return "", fmt.Errorf("the key at %s (%s) does not match the expected CA key %s", path,
+				ssh.FingerprintSHA256(publicKey), ssh.FingerprintSHA256(expected))
+		}
+	}
+
+	keyLocation := conf.GetCAKeyLocation()
+	if _, err = os.Stat(keyLocation); err == nil && !overwrite {
+		return "", fmt.Errorf("Refusing to overwrite existing key (try with FORCE_WRITE=true if you're sure): %s", keyLocation)
+	}
+	err = os.MkdirAll(filepath.Dir(keyLocation), 0700)
+	if err != nil {
+		return "", err
+	}
+	// ssh-keygen cannot read keys with a passphrase without prompting for it so encrypted keys are stored decrypted
+	// (and then encrypted with the CA key passphrase below)
+	decrypted := contents
+	if encrypted {
+		decrypted, err = marshalPrivateKey(privateKey)
+		if err != nil {
+			return "", err
+		}
+		defer LockMemory(decrypted)()
+	}
+	err = ioutil.WriteFile(keyLocation, decrypted, 0600)
+	if err != nil {
+		return "", err
+	}
+	authorizedKey := ssh.MarshalAuthorizedKey(publicKey)
+	err = ioutil.WriteFile(shared.KeyPathToPubKey(keyLocation), authorizedKey, 0644)
+	if err != nil {
+		return "", err
+	}
+	err = encryptCAKey(conf)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt the CA key: %v", err)
+	}
+	events.Publish(conf, events.Event{Type: events.CAKeyRotated, Message: fmt.Sprintf("imported the CA key %s from %s to %s",
+		ssh.FingerprintSHA256(publicKey), path, keyLocation)})
+	return string(authorizedKey), nil
+}
+
+// Returns an error if the given key cannot be used as a CA key. DSA keys and RSA keys that are shorter than
+// minImportedRSAKeySize are rejected since current versions of OpenSSH do not accept certificates signed by them.
+func checkImportedKeyType(key ssh.PublicKey) error {
+	switch key.Type() {
+	case ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+	case ssh.KeyAlgoRSA:
+		rsaKey, ok := key.(ssh.CryptoPublicKey).CryptoPublicKey().(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("failed to determine the size of the RSA key")
+		}
+		if rsaKey.N.BitLen() < minImportedRSAKeySize {
+			return fmt.Errorf("%d bit RSA keys cannot be used as a CA key, at least %d bits are required",
+				rsaKey.N.BitLen(), minImportedRSAKeySize)
+		}
+	default:
+		return fmt.Errorf("%s keys cannot be used as a CA key", key.Type())
+	}
+	return shared.CheckFIPSKey(key)
+}
+
+// Marshal the given private key unencrypted in a format that ssh-keygen reads
+func marshalPrivateKey(privateKey interface{}) ([]byte, error) {
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), nil
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+	case *ed25519.PrivateKey:
+		return marshalOpenSSHEd25519Key(*k)
+	case ed25519.PrivateKey:
+		return marshalOpenSSHEd25519Key(k)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+}
+
+// Marshal the given ed25519 key in the unencrypted openssh-key-v1 format (see PROTOCOL.key in OpenSSH) since there is
+// no PEM encoding of ed25519 keys that older versions of ssh-keygen read
+func marshalOpenSSHEd25519Key(key ed25519.PrivateKey) ([]byte, error) {
+	publicKey, err := ssh.NewPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	check := make([]byte, 4)
+	_, err = rand.Read(check)
+	if err != nil {
+		return nil, err
+	}
+	private := struct {
+		Check1, Check2 uint32
+		KeyType        string
+		PublicKey      []byte
+		PrivateKey     []byte
+		Comment        string
+		Pad            []byte `ssh:"rest"`
+	}{
+		Check1:     binary.BigEndian.Uint32(check),
+		Check2:     binary.BigEndian.Uint32(check),
+		KeyType:    ssh.KeyAlgoED25519,
+		PublicKey:  key.Public().(ed25519.PublicKey),
+		PrivateKey: key,
+	}
+	// The private section is padded with 1, 2, 3, ... to a multiple of the block size, which is 8 without a cipher
+	unpadded := ssh.Marshal(private)
+	Zeroize(unpadded)
+	for i := 0; (len(unpadded)+i)%8 != 0; i++ {
+		private.Pad = append(private.Pad, byte(i+1))
+	}
+	privateSection := ssh.Marshal(private)
+	defer Zeroize(privateSection)
+	encoded := append([]byte("openssh-key-v1\x00"), ssh.Marshal(struct {
+		CipherName  string
+		KdfName     string
+		KdfOpts     string
+		NumKeys     uint32
+		PublicKey   []byte
+		PrivateKeys []byte
+	}{"none", "none", "", 1, publicKey.Marshal(), privateSection})...)
+	defer Zeroize(encoded)
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: encoded}), nil
+}
@@ -0,0 +1,97 @@
+package sshutils
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+// Generate a key with ssh-keygen with the given extra arguments and return its path
+func generateKeyToImport(t *testing.T, dir, name string, args ...string) string {
+	path := filepath.Join(dir, name)
+	output, err := exec.Command("ssh-keygen", append([]string{"-q", "-f", path, "-C", "old-ca"}, args...)...).CombinedOutput()
+	require.NoError(t, err, string(output))
+	return path
+}
+
+func TestImportCAKey(t *testing.T) {
+	if shared.FIPSMode {
+		t.Skip("imports ed25519 keys which are not allowed in FIPS mode")
+	}
+	if !sshKeygenBinaryExists() {
+		t.Skip("ssh-keygen is not installed")
+	}
+	dir, err := ioutil.TempDir("", "import")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKeyLocation := filepath.Join(dir, "ca", "cakey")
+	os.Setenv("CA_KEY_LOCATION", caKeyLocation)
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	conf := &config.EnvConfig{}
+
+	for _, args := range [][]string{
+		{"-t", "ed25519", "-N", ""},
+		{"-t", "ed25519", "-N", "old passphrase"},
+		{"-t", "ecdsa", "-N", "old passphrase"},
+		{"-t", "rsa", "-b", "2048", "-m", "PEM", "-N", "old passphrase"},
+	} {
+		name := strings.Join(args, "-")
+		path := generateKeyToImport(t, dir, name, args...)
+		expected, err := ioutil.ReadFile(shared.KeyPathToPubKey(path))
+		require.NoError(t, err)
+		passphrase := args[len(args)-1]
+
+		publicKey, err := ImportCAKey(conf, path, passphrase, string(expected), true)
+		require.NoError(t, err, name)
+		require.Equal(t, strings.Fields(string(expected))[1], strings.Fields(publicKey)[1], name)
+
+		// The stored key is decrypted and readable by ssh-keygen
+		output, err := exec.Command("ssh-keygen", "-y", "-P", "", "-f", caKeyLocation).CombinedOutput()
+		require.NoError(t, err, name+": "+string(output))
+		require.Equal(t, strings.Fields(string(expected))[1], strings.Fields(string(output))[1], name)
+	}
+
+	// Existing keys are only replaced if overwrite is set
+	path := generateKeyToImport(t, dir, "other", "-t", "ed25519", "-N", "")
+	_, err = ImportCAKey(conf, path, "", "", false)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "Refusing to overwrite")
+
+	// The key must match the expected key
+	expected, err := ioutil.ReadFile(shared.KeyPathToPubKey(filepath.Join(dir, "-t-ed25519--N-")))
+	require.NoError(t, err)
+	_, err = ImportCAKey(conf, path, "", string(expected), true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not match")
+
+	// Encrypted keys require the right passphrase
+	encrypted := filepath.Join(dir, "-t-ed25519--N-old passphrase")
+	_, err = ImportCAKey(conf, encrypted, "", "", true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no passphrase")
+	_, err = ImportCAKey(conf, encrypted, "wrong", "", true)
+	require.Error(t, err)
+
+	// Weak keys are rejected
+	weak := generateKeyToImport(t, dir, "weak", "-t", "rsa", "-b", "1024", "-N", "")
+	_, err = ImportCAKey(conf, weak, "", "", true)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "1024 bit RSA keys")
+
+	// The imported key is encrypted with the CA key passphrase if one is configured
+	os.Setenv("CA_KEY_PASSPHRASE", "passphrase")
+	defer os.Unsetenv("CA_KEY_PASSPHRASE")
+	_, err = ImportCAKey(conf, encrypted, "old passphrase", "", true)
+	require.NoError(t, err)
+	contents, release, err := ReadCAKey(conf)
+	defer release()
+	require.NoError(t, err)
+	require.Contains(t, string(contents), "OPENSSH PRIVATE KEY")
+}
@@ -0,0 +1,196 @@
+package sshutils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// How long before the intermediate certificate expires keybaseca starts warning that it must be re-issued
+const IntermediateExpiryWarning = 7 * 24 * time.Hour
+
+// The suffix of the location of the next intermediate CA key while the intermediate CA key is being rotated
+const nextIntermediateSuffix = ".next"
+
+// IssueIntermediate signs the intermediate CA public key publicKey with the root CA key at rootKeyLocation and returns
+// the certificate in authorized_keys format. principals is a comma separated list of the team patterns (see
+// shared.MatchTeam) that the intermediate CA key may issue certificates for and validity is an ssh-keygen validity
+// interval (eg +30d). The certificate has no extensions and has the shared.IntermediateCriticalOption so that it
+// cannot be used to log in. This is run on the offline machine that holds the root CA key so it does not use the
+// keybaseca config.
+func IssueIntermediate(rootKeyLocation, keyID, principals, validity, publicKey string) (string, error) {
+	if strings.TrimSpace(principals) == "" {
+		return "", fmt.Errorf("the intermediate certificate must list the principals it may issue certificates for " +
+			"(use * to allow every principal)")
+	}
+	var patterns []string
+	for _, pattern := range strings.Split(principals, ",") {
+		pattern = strings.TrimSpace(pattern)
+		err := shared.ValidateTeamPattern(pattern)
+		if err != nil {
+			return "", err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return SignKey(rootKeyLocation, keyID, strings.Join(patterns, ","), validity, publicKey,
+		"clear", "critical:"+shared.IntermediateCriticalOption)
+}
+
+// LoadIntermediateCert reads the certificate at INTERMEDIATE_CERT_LOCATION and checks that it certifies the CA key and
+// is valid at now. Returns nil if the CA key is not an intermediate CA key.
+func LoadIntermediateCert(conf config.Config, now time.Time) (*ssh.Certificate, error) {
+	if conf.GetIntermediateCertLocation() == "" {
+		return nil, nil
+	}
+	contents, err := ioutil.ReadFile(conf.GetIntermediateCertLocation())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the intermediate certificate: %v", err)
+	}
+	caPublicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetCAKeyLocation()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA public key: %v", err)
+	}
+	return checkIntermediateCert(string(contents), string(caPublicKey), now)
+}
+
+// Parse the given intermediate certificate and check that it certifies caPublicKey and is valid at now. The root CA
+// key is not known to keybaseca so the signature is checked against the key that the certificate claims signed it.
+func checkIntermediateCert(contents, caPublicKey string, now time.Time) (*ssh.Certificate, error) {
+	intermediate, err := shared.ParseIntermediateCert(strings.TrimSpace(contents))
+	if err != nil {
+		return nil, err
+	}
+	caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(caPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the CA public key: %v", err)
+	}
+	if !bytes.Equal(intermediate.Key.Marshal(), caKey.Marshal()) {
+		return nil, fmt.Errorf("the intermediate certificate %s is for the key %s rather than the CA key %s",
+			intermediate.KeyId, ssh.FingerprintSHA256(intermediate.Key), ssh.FingerprintSHA256(caKey))
+	}
+	err = shared.VerifyIntermediateCert(intermediate, intermediate.SignatureKey, now)
+	if err != nil {
+		return nil, fmt.Errorf("%v, re-issue it with `keybaseca issue-intermediate`", err)
+	}
+	return intermediate, nil
+}
+
+// IntermediateExpiresSoon returns whether the given intermediate certificate expires within IntermediateExpiryWarning
+func IntermediateExpiresSoon(intermediate *ssh.Certificate, now time.Time) bool {
+	return intermediate.ValidBefore != ssh.CertTimeInfinity &&
+		time.Unix(int64(intermediate.ValidBefore), 0).Before(now.Add(IntermediateExpiryWarning))
+}
+
+// IntermediateOptions returns the ssh-keygen options that add the intermediate certificate to a certificate for the
+// given comma separated principals, or nil if the CA key is not an intermediate CA key
+func IntermediateOptions(conf config.Config, principals string) ([]string, error) {
+	intermediate, err := LoadIntermediateCert(conf, time.Now())
+	if err != nil || intermediate == nil {
+		return nil, err
+	}
+	for _, principal := range strings.Split(principals, ",") {
+		if !shared.IntermediateAllows(intermediate, principal) {
+			return nil, fmt.Errorf("the intermediate certificate %s does not allow issuing certificates for the principal "+
+				"'%s', re-issue it with `keybaseca issue-intermediate` and add the principal to --principals",
+				intermediate.KeyId, principal)
+		}
+	}
+	return []string{"extension:" + shared.IntermediateExtension + "=" + shared.EncodeIntermediateCert(intermediate)}, nil
+}
+
+// PrepareIntermediateRotation generates the next intermediate CA key next to the CA key and returns its public key,
+// which must be certified with `keybaseca issue-intermediate` on the machine that holds the root CA key. The CA keeps
+// signing with the current key until the certificate is installed with InstallIntermediate.
+func PrepareIntermediateRotation(conf config.Config, overwrite bool) (string, error) {
+	nextKeyLocation := conf.GetCAKeyLocation() + nextIntermediateSuffix
+	err := GenerateNewSSHKey(nextKeyLocation, overwrite, false)
+	if err != nil {
+		return "", err
+	}
+	err = encryptKeyFile(conf, nextKeyLocation)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt the next intermediate CA key: %v", err)
+	}
+	publicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(nextKeyLocation))
+	if err != nil {
+		return "", err
+	}
+	return string(publicKey), nil
+}
+
+// InstallIntermediate installs the given intermediate certificate at INTERMEDIATE_CERT_LOCATION. If it certifies the
+// key generated by PrepareIntermediateRotation, that key replaces the CA key. Otherwise it must certify the current
+// CA key (eg when re-issuing a certificate that is about to expire). If there is a current intermediate certificate,
+// the new one must have been signed by the same root CA key.
+func InstallIntermediate(conf config.Config, contents string, now time.Time) (*ssh.Certificate, error) {
+	if conf.GetIntermediateCertLocation() == "" {
+		return nil, fmt.Errorf("INTERMEDIATE_CERT_LOCATION must be set to install an intermediate certificate")
+	}
+	keyLocation := conf.GetCAKeyLocation()
+	nextKeyLocation := keyLocation + nextIntermediateSuffix
+	rotating := false
+	intermediate, err := checkIntermediateCert(contents, readFileOrEmpty(shared.KeyPathToPubKey(keyLocation)), now)
+	if err != nil {
+		nextPublicKey := readFileOrEmpty(shared.KeyPathToPubKey(nextKeyLocation))
+		if nextPublicKey == "" {
+			return nil, err
+		}
+		intermediate, err = checkIntermediateCert(contents, nextPublicKey, now)
+		if err != nil {
+			return nil, err
+		}
+		rotating = true
+	}
+
+	current, err := ioutil.ReadFile(conf.GetIntermediateCertLocation())
+	if err == nil {
+		currentCert, err := shared.ParseIntermediateCert(strings.TrimSpace(string(current)))
+		if err == nil && !bytes.Equal(currentCert.SignatureKey.Marshal(), intermediate.SignatureKey.Marshal()) {
+			return nil, fmt.Errorf("the intermediate certificate was signed by the root CA key %s rather than %s which "+
+				"signed the current one, delete %s first if the root CA key was replaced", ssh.FingerprintSHA256(intermediate.SignatureKey),
+				ssh.FingerprintSHA256(currentCert.SignatureKey), conf.GetIntermediateCertLocation())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read the current intermediate certificate: %v", err)
+	}
+
+	if rotating {
+		// If keybaseca is interrupted before the certificate is written, signing fails since the current certificate
+		// is not for the new key
+		err = os.Rename(nextKeyLocation, keyLocation)
+		if err != nil {
+			return nil, err
+		}
+		err = os.Rename(shared.KeyPathToPubKey(nextKeyLocation), shared.KeyPathToPubKey(keyLocation))
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = ioutil.WriteFile(conf.GetIntermediateCertLocation(), ssh.MarshalAuthorizedKey(intermediate), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to write the intermediate certificate: %v", err)
+	}
+	if rotating {
+		events.Publish(conf, events.Event{Type: events.CAKeyRotated, Message: fmt.Sprintf("installed the intermediate CA key %s certified by %s",
+			ssh.FingerprintSHA256(intermediate.Key), intermediate.KeyId)})
+	}
+	return intermediate, nil
+}
+
+// Returns the contents of the given file or an empty string if it cannot be read
+func readFileOrEmpty(filename string) string {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return ""
+	}
+	return string(contents)
+}
@@ -0,0 +1,91 @@
+package sshutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestIntermediate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-intermediate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	rootKey := filepath.Join(dir, "root")
+	caKey := filepath.Join(dir, "ca")
+	userKey := filepath.Join(dir, "user")
+	certLocation := filepath.Join(dir, "intermediate-cert.pub")
+	for _, key := range []string{rootKey, caKey, userKey} {
+		require.NoError(t, GenerateNewSSHKey(key, false, false))
+	}
+	readFile := func(filename string) string {
+		contents, err := ioutil.ReadFile(filename)
+		require.NoError(t, err)
+		return string(contents)
+	}
+
+	os.Setenv("CA_KEY_LOCATION", caKey)
+	os.Setenv("INTERMEDIATE_CERT_LOCATION", certLocation)
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	defer os.Unsetenv("INTERMEDIATE_CERT_LOCATION")
+	conf := &config.EnvConfig{}
+
+	_, err = IssueIntermediate(rootKey, "intermediate", "", "+1d", readFile(shared.KeyPathToPubKey(caKey)))
+	require.Error(t, err)
+	issued, err := IssueIntermediate(rootKey, "intermediate", "team.ssh.prod, team.ssh.prod.*", "+1d", readFile(shared.KeyPathToPubKey(caKey)))
+	require.NoError(t, err)
+	intermediate, err := InstallIntermediate(conf, issued, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.prod", "team.ssh.prod.*"}, intermediate.ValidPrincipals)
+	// The intermediate certificate cannot be used to log in
+	require.Contains(t, intermediate.CriticalOptions, shared.IntermediateCriticalOption)
+	require.Empty(t, intermediate.Extensions)
+	require.True(t, IntermediateExpiresSoon(intermediate, time.Now()))
+
+	options, err := IntermediateOptions(conf, "team.ssh.prod,team.ssh.prod.db")
+	require.NoError(t, err)
+	signature, err := SignKey(caKey, "key-id", "team.ssh.prod,team.ssh.prod.db", "+15m", readFile(shared.KeyPathToPubKey(userKey)), options...)
+	require.NoError(t, err)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature))
+	require.NoError(t, err)
+	_, err = shared.VerifyChain(parsed.(*ssh.Certificate), intermediate.SignatureKey, time.Now())
+	require.NoError(t, err)
+	_, err = IntermediateOptions(conf, "team.ssh.staging")
+	require.Error(t, err)
+
+	// Rotate to a new intermediate CA key
+	nextPublicKey, err := PrepareIntermediateRotation(conf, false)
+	require.NoError(t, err)
+	// Signing continues with the current key until the new certificate is installed
+	_, err = IntermediateOptions(conf, "team.ssh.prod")
+	require.NoError(t, err)
+	// A certificate from a different root is refused
+	otherRoot := filepath.Join(dir, "other-root")
+	require.NoError(t, GenerateNewSSHKey(otherRoot, false, false))
+	issued, err = IssueIntermediate(otherRoot, "intermediate-2", "team.ssh.prod", "+1d", nextPublicKey)
+	require.NoError(t, err)
+	_, err = InstallIntermediate(conf, issued, time.Now())
+	require.Error(t, err)
+
+	issued, err = IssueIntermediate(rootKey, "intermediate-2", "team.ssh.prod", "+1d", nextPublicKey)
+	require.NoError(t, err)
+	intermediate, err = InstallIntermediate(conf, issued, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "intermediate-2", intermediate.KeyId)
+	require.Equal(t, nextPublicKey, readFile(shared.KeyPathToPubKey(caKey)))
+	_, err = os.Stat(caKey + nextIntermediateSuffix)
+	require.True(t, os.IsNotExist(err))
+	loaded, err := LoadIntermediateCert(conf, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "intermediate-2", loaded.KeyId)
+
+	// An expired intermediate certificate stops signing
+	_, err = LoadIntermediateCert(conf, time.Now().Add(48*time.Hour))
+	require.Error(t, err)
+}
@@ -0,0 +1,41 @@
+package sshutils
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+)
+
+// Returns an error if a certificate with the given key ID, comma separated principals, and ssh-keygen options would
+// exceed MAX_PRINCIPALS, MAX_KEY_ID_LENGTH, or MAX_EXTENSION_BYTES. Some versions of sshd reject oversized
+// certificates without logging why so it is better to refuse to sign them with an error that names the setting.
+func checkCertificateLimits(conf config.Config, username, keyID, principals string, options []string) error {
+	if count := len(strings.Split(principals, ",")); count > conf.GetMaxPrincipals() {
+		return fmt.Errorf("the certificate for %s would have %d principals which is more than MAX_PRINCIPALS (%d), "+
+			"reduce the number of teams or groups that grant principals to the user", username, count, conf.GetMaxPrincipals())
+	}
+	if len(keyID) > conf.GetMaxKeyIDLength() {
+		return fmt.Errorf("the key ID of the certificate for %s would be %d bytes which is more than MAX_KEY_ID_LENGTH (%d)",
+			username, len(keyID), conf.GetMaxKeyIDLength())
+	}
+	if size := extensionBytes(options); size > conf.GetMaxExtensionBytes() {
+		return fmt.Errorf("the extensions of the certificate for %s would be %d bytes which is more than "+
+			"MAX_EXTENSION_BYTES (%d)", username, size, conf.GetMaxExtensionBytes())
+	}
+	return nil
+}
+
+// Returns the combined size of the names and values of the extensions and critical options in the given ssh-keygen
+// options (eg `extension:groups@acme.com=dba`)
+func extensionBytes(options []string) int {
+	size := 0
+	for _, option := range options {
+		for _, prefix := range []string{"extension:", "critical:"} {
+			if strings.HasPrefix(option, prefix) {
+				size += len(strings.Replace(strings.TrimPrefix(option, prefix), "=", "", 1))
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,36 @@
+package sshutils
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckCertificateLimits(t *testing.T) {
+	conf := &config.EnvConfig{}
+	var principals []string
+	for i := 0; i < 256; i++ {
+		principals = append(principals, "team.ssh.p")
+	}
+	require.NoError(t, checkCertificateLimits(conf, "alice", "uuid:uuid:alice", strings.Join(principals, ","), nil))
+	err := checkCertificateLimits(conf, "alice", "uuid:uuid:alice", strings.Join(append(principals, "one-more"), ","), nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "257 principals which is more than MAX_PRINCIPALS (256)")
+
+	os.Setenv("MAX_PRINCIPALS", "2")
+	os.Setenv("MAX_KEY_ID_LENGTH", "16")
+	os.Setenv("MAX_EXTENSION_BYTES", "20")
+	defer os.Unsetenv("MAX_PRINCIPALS")
+	defer os.Unsetenv("MAX_KEY_ID_LENGTH")
+	defer os.Unsetenv("MAX_EXTENSION_BYTES")
+	options := []string{"extension:groups@acme.com=dba", "extension:login@acme.com"}
+	require.NoError(t, checkCertificateLimits(conf, "alice", "uuid:uuid:alice", "team.ssh.prod,alice", options[:1]))
+	require.Error(t, checkCertificateLimits(conf, "alice", "uuid:uuid:alice", "team.ssh.prod,team.ssh.staging,alice", nil))
+	require.Error(t, checkCertificateLimits(conf, "alice", "uuid:uuid:alice:too-long", "team.ssh.prod", nil))
+	err = checkCertificateLimits(conf, "alice", "uuid:uuid:alice", "team.ssh.prod", options)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "32 bytes which is more than MAX_EXTENSION_BYTES (20)")
+}
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package sshutils
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// CheckLocalAuth returns an error unless the current user is allowed to sign keys directly with the CA key at
+// caKeyLocation. Only root and the owner of the CA key are allowed to do so.
+func CheckLocalAuth(caKeyLocation string) error {
+	info, err := os.Stat(caKeyLocation)
+	if err != nil {
+		return fmt.Errorf("failed to stat the CA key at %s: %v", caKeyLocation, err)
+	}
+	uid := os.Geteuid()
+	if uid == 0 {
+		return nil
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != uid {
+		return fmt.Errorf("only root or the owner of the CA key (uid %d) may sign keys offline", stat.Uid)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+package sshutils
+
+import (
+	"fmt"
+	"os"
+)
+
+// CheckLocalAuth returns an error unless the current user is allowed to sign keys directly with the CA key at
+// caKeyLocation. On windows this only checks that the CA key is accessible since file ownership is not checked.
+func CheckLocalAuth(caKeyLocation string) error {
+	_, err := os.Stat(caKeyLocation)
+	if err != nil {
+		return fmt.Errorf("failed to stat the CA key at %s: %v", caKeyLocation, err)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+package sshutils
+
+// Zeroize overwrites the given buffer (eg a private key) with zeros so that it does not linger in memory after use
+func Zeroize(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// LockMemory asks the OS to keep the given buffer (eg a decrypted private key) out of swap where supported (see
+// lockMemory) and returns a function that zeroes and unlocks it. The returned function must be called once the buffer
+// is no longer needed. Failing to lock the buffer (eg due to RLIMIT_MEMLOCK) is not an error since the buffer is
+// still zeroed.
+func LockMemory(b []byte) (release func()) {
+	locked := len(b) > 0 && lockMemory(b)
+	return func() {
+		Zeroize(b)
+		if locked {
+			unlockMemory(b)
+		}
+	}
+}
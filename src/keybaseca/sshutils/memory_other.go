@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+package sshutils
+
+// Memory locking is not supported on this platform so buffers are only zeroed
+func lockMemory(b []byte) bool {
+	return false
+}
+
+func unlockMemory(b []byte) {}
@@ -0,0 +1,18 @@
+package sshutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockMemory(t *testing.T) {
+	secret := []byte("private key")
+	release := LockMemory(secret)
+	require.Equal(t, "private key", string(secret))
+	release()
+	require.Equal(t, make([]byte, len("private key")), secret)
+
+	// Empty buffers cannot be locked but releasing them is harmless
+	LockMemory(nil)()
+}
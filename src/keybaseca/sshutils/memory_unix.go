@@ -0,0 +1,24 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+package sshutils
+
+import (
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Lock the given buffer into memory via mlock. Returns whether it was locked.
+func lockMemory(b []byte) bool {
+	err := syscall.Mlock(b)
+	if err != nil {
+		log.Debugf("Failed to mlock %d bytes, the buffer may be swapped to disk: %v", len(b), err)
+		return false
+	}
+	return true
+}
+
+func unlockMemory(b []byte) {
+	_ = syscall.Munlock(b)
+}
@@ -0,0 +1,104 @@
+package sshutils
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/keybaseca/store"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"github.com/google/uuid"
+)
+
+// SignKeyOffline signs the given public key directly with the CA key without going through Keybase chat. It is used by
+// `keybaseca sign --offline` when Keybase is unavailable and on-call still needs access. localUser is the OS user
+// running the command. principals must be a subset of the configured teams and defaults to all of them if empty. ttl
+// defaults to KEY_EXPIRATION if zero. The signature is recorded in the audit log (before signing, so that strict
+// logging prevents unlogged signatures) and the issuance store, and an OfflineCertIssued event is published.
+func SignKeyOffline(conf config.Config, localUser, publicKey string, principals []string, ttl time.Duration) (signature string, err error) {
+	err = CheckLocalAuth(conf.GetCAKeyLocation())
+	if err != nil {
+		return "", err
+	}
+	principals, err = validateOfflinePrincipals(conf, principals)
+	if err != nil {
+		return "", err
+	}
+	expiration, err := ttlToExpiration(conf, ttl)
+	if err != nil {
+		return "", err
+	}
+	expiration = ValidityInterval(conf, expiration)
+	randomUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate unique key ID: %v", err)
+	}
+	keyID := randomUUID.String() + ":keybaseca-offline:" + localUser
+	chain, err := IntermediateOptions(conf, strings.Join(principals, ","))
+	if err != nil {
+		return "", err
+	}
+
+	log.Log(conf, fmt.Sprintf("BREAK-GLASS offline signature by local user=%s keyID:%s, principals:%s, expiration:%s, pubkey:%s",
+		localUser, keyID, strings.Join(principals, ","), expiration, strings.TrimSpace(publicKey)))
+	caKey, cleanup, err := LoadCAKey(conf)
+	defer cleanup()
+	if err != nil {
+		return "", err
+	}
+	signature, err = SignKeyWithCAKey(caKey, DefaultSignatureAlgorithm(conf), keyID, strings.Join(principals, ","), expiration, publicKey, chain...)
+	if err != nil {
+		return "", err
+	}
+	issued := events.Event{Type: events.OfflineCertIssued, Timestamp: time.Now(), Username: localUser, Principals: principals, KeyID: keyID,
+		Certificate: signature}
+	// Keybase may be down but the issuance store is not needed to get access, so a failure is only recorded in the
+	// audit log (which already has the signature)
+	err = store.RecordIssuance(conf, issued)
+	if err != nil {
+		log.Log(conf, fmt.Sprintf("Failed to record the certificate %s in the issuance store: %v", keyID, err))
+	}
+	events.Publish(conf, issued)
+	return signature, nil
+}
+
+// Returns the given principals after checking that each of them matches a configured team. Returns every configured
+// team if principals is empty. Team patterns cannot be expanded without Keybase so they are only used to validate
+// explicitly specified principals.
+func validateOfflinePrincipals(conf config.Config, principals []string) ([]string, error) {
+	if len(principals) == 0 {
+		return GetLiteralTeams(conf), nil
+	}
+	for _, principal := range principals {
+		if len(shared.MatchTeams(conf.GetTeams(), []string{principal})) == 0 {
+			return nil, fmt.Errorf("principal '%s' does not match any of the configured teams (%s)", principal, strings.Join(conf.GetTeams(), ","))
+		}
+	}
+	return principals, nil
+}
+
+// GetLiteralTeams returns the configured teams that are not team patterns
+func GetLiteralTeams(conf config.Config) []string {
+	var teams []string
+	for _, team := range conf.GetTeams() {
+		if !shared.IsTeamPattern(team) {
+			teams = append(teams, team)
+		}
+	}
+	return teams
+}
+
+// Convert the given TTL into an ssh-keygen validity interval. Defaults to KEY_EXPIRATION if ttl is zero.
+func ttlToExpiration(conf config.Config, ttl time.Duration) (string, error) {
+	if ttl == 0 {
+		return conf.GetKeyExpiration(), nil
+	}
+	if ttl < time.Second {
+		return "", fmt.Errorf("the TTL must be at least one second, got %s", ttl)
+	}
+	return fmt.Sprintf("+%ds", int64(ttl/time.Second)), nil
+}
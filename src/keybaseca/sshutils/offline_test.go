@@ -0,0 +1,44 @@
+package sshutils
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateOfflinePrincipals(t *testing.T) {
+	os.Setenv("TEAMS", "team.ssh.prod,team.ssh.staging")
+	defer os.Unsetenv("TEAMS")
+	conf := &config.EnvConfig{}
+
+	principals, err := validateOfflinePrincipals(conf, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.prod", "team.ssh.staging"}, principals)
+
+	principals, err = validateOfflinePrincipals(conf, []string{"team.ssh.staging"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.staging"}, principals)
+
+	_, err = validateOfflinePrincipals(conf, []string{"team.ssh.staging", "root"})
+	require.Error(t, err)
+}
+
+func TestTTLToExpiration(t *testing.T) {
+	os.Setenv("KEY_EXPIRATION", "+2h")
+	defer os.Unsetenv("KEY_EXPIRATION")
+	conf := &config.EnvConfig{}
+
+	expiration, err := ttlToExpiration(conf, 0)
+	require.NoError(t, err)
+	require.Equal(t, "+2h", expiration)
+
+	expiration, err = ttlToExpiration(conf, 90*time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, "+5400s", expiration)
+
+	_, err = ttlToExpiration(conf, -time.Hour)
+	require.Error(t, err)
+}
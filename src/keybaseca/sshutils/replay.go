@@ -0,0 +1,60 @@
+package sshutils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// nonceCache records the nonces of recently processed signature requests so that a request cannot be processed twice.
+// A nonce only needs to be remembered until the timestamp of its request falls outside of REQUEST_MAX_SKEW since the
+// request is rejected as stale after that point. The cache is in memory so after a restart the skew window is the only
+// protection against replays.
+type nonceCache struct {
+	lock sync.Mutex
+	// Maps nonces to the time at which they may be forgotten
+	seen map[string]time.Time
+}
+
+var seenNonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// Record the given nonce. Returns false if it was already recorded and has not yet expired.
+func (c *nonceCache) add(nonce string, expiration, now time.Time) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for n, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, n)
+		}
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return false
+	}
+	c.seen[nonce] = expiration
+	return true
+}
+
+// Returns a RequestDeniedError if the given signature request is stale or is a replay of an earlier request. Requests
+// without a nonce and timestamp (sent by old versions of kssh) are allowed unless REQUIRE_REQUEST_NONCE is set.
+func checkFreshness(conf config.Config, sr shared.SignatureRequest, now time.Time) error {
+	if sr.Nonce == "" || sr.Timestamp == 0 {
+		if conf.GetRequireRequestNonce() {
+			return RequestDeniedError{Code: shared.DenialOutdatedClient, Reason: "the request does not include a nonce and timestamp (please upgrade kssh)"}
+		}
+		return nil
+	}
+	skew := conf.GetRequestMaxSkew()
+	requestTime := time.Unix(sr.Timestamp, 0)
+	if requestTime.Before(now.Add(-skew)) || requestTime.After(now.Add(skew)) {
+		return RequestDeniedError{Code: shared.DenialClockSkew, Reason: fmt.Sprintf("the request was created at %s which is more than %s from the "+
+			"CA's clock (is your clock correct?)", requestTime.UTC().Format(time.RFC3339), skew)}
+	}
+	// Nonces are scoped to the user so that one user cannot block another user's requests
+	if !seenNonces.add(sr.Username+":"+sr.Nonce, requestTime.Add(skew), now) {
+		return RequestDeniedError{Code: shared.DenialReplay, Reason: "the request is a replay of an earlier request"}
+	}
+	return nil
+}
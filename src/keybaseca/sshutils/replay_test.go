@@ -0,0 +1,47 @@
+package sshutils
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFreshness(t *testing.T) {
+	os.Setenv("REQUEST_MAX_SKEW", "60")
+	defer os.Unsetenv("REQUEST_MAX_SKEW")
+	conf := &config.EnvConfig{}
+	now := time.Now()
+
+	sr := shared.SignatureRequest{Username: "alice", Nonce: "nonce-1", Timestamp: now.Unix()}
+	require.NoError(t, checkFreshness(conf, sr, now))
+	// The same nonce is rejected
+	require.Equal(t, shared.DenialReplay, checkFreshness(conf, sr, now.Add(time.Second)).(RequestDeniedError).Code)
+	// But not for a different user
+	sr.Username = "bob"
+	require.NoError(t, checkFreshness(conf, sr, now))
+
+	// Stale and future requests are rejected
+	sr.Nonce = "nonce-2"
+	sr.Timestamp = now.Add(-2 * time.Minute).Unix()
+	require.Equal(t, shared.DenialClockSkew, checkFreshness(conf, sr, now).(RequestDeniedError).Code)
+	sr.Timestamp = now.Add(2 * time.Minute).Unix()
+	require.IsType(t, RequestDeniedError{}, checkFreshness(conf, sr, now))
+
+	// Nonces are forgotten once the request would be rejected as stale anyway
+	sr = shared.SignatureRequest{Username: "alice", Nonce: "nonce-1", Timestamp: now.Add(2 * time.Minute).Unix()}
+	require.NoError(t, checkFreshness(conf, sr, now.Add(2*time.Minute)))
+}
+
+func TestCheckFreshnessMissingNonce(t *testing.T) {
+	conf := &config.EnvConfig{}
+	sr := shared.SignatureRequest{Username: "alice"}
+	require.NoError(t, checkFreshness(conf, sr, time.Now()))
+
+	os.Setenv("REQUIRE_REQUEST_NONCE", "true")
+	defer os.Unsetenv("REQUIRE_REQUEST_NONCE")
+	require.IsType(t, RequestDeniedError{}, checkFreshness(conf, sr, time.Now()))
+}
@@ -0,0 +1,47 @@
+package sshutils
+
+import (
+	"io/ioutil"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Get the signature algorithm that the certificate for the given request should be signed with. This only matters for
+// RSA CA keys since old servers only accept ssh-rsa signatures and new servers reject them. The first algorithm
+// requested by kssh that is allowed is used, falling back to RSA_SIGNATURE_ALGORITHM. ssh-rsa is only allowed if
+// ALLOW_SSH_RSA_SIGNATURES is set. Returns an empty string (meaning ssh-keygen's default) if the CA key is not an RSA
+// key.
+func chooseSignatureAlgorithm(conf config.Config, requested []string) string {
+	caPublicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetCAKeyLocation()))
+	if err != nil {
+		log.Debugf("Failed to read the CA public key, using the default signature algorithm: %v", err)
+		return ""
+	}
+	if !strings.HasPrefix(string(caPublicKey), "ssh-rsa ") {
+		return ""
+	}
+	for _, algorithm := range requested {
+		switch algorithm {
+		case shared.SigAlgoRSASHA512, shared.SigAlgoRSASHA256:
+			return algorithm
+		case shared.SigAlgoRSA:
+			if conf.GetAllowSSHRSASignatures() && shared.IsFIPSSignatureAlgorithm(algorithm) {
+				return algorithm
+			}
+		}
+	}
+	if len(requested) > 0 {
+		log.Debugf("None of the requested signature algorithms %v are allowed, using %s", requested, conf.GetRSASignatureAlgorithm())
+	}
+	return conf.GetRSASignatureAlgorithm()
+}
+
+// DefaultSignatureAlgorithm returns the signature algorithm used for certificates that are not requested by kssh (eg
+// `keybaseca sign`)
+func DefaultSignatureAlgorithm(conf config.Config) string {
+	return chooseSignatureAlgorithm(conf, nil)
+}
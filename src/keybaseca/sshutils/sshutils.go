@@ -1,15 +1,23 @@
 package sshutils
 
 import (
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/botwrapper"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
 
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
 	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/keybaseca/store"
 
 	"github.com/keybase/bot-sshca/src/keybaseca/config"
 	"github.com/keybase/bot-sshca/src/shared"
@@ -49,13 +57,35 @@ func GenerateNewSSHKey(filename string, overwrite bool, printPubKey bool) error
 }
 
 // Generate a new CA key based off of the data in the config. If overwrite, it will overwrite the current CA key. Prints
-// the generated public key to stdout.
+// the generated public key to stdout. The directory containing the CA key is created with 0700 permissions if it does
+// not exist and the key is encrypted if a CA key passphrase is configured.
 func Generate(conf config.Config, overwrite bool) error {
-	err := GenerateNewSSHKey(conf.GetCAKeyLocation(), overwrite, true)
-	if err == nil {
-		log.Log(conf, fmt.Sprintf("Wrote new SSH CA key to %s", conf.GetCAKeyLocation()))
+	err := os.MkdirAll(filepath.Dir(conf.GetCAKeyLocation()), 0700)
+	if err != nil {
+		return err
+	}
+	err = GenerateNewSSHKey(conf.GetCAKeyLocation(), overwrite, true)
+	if err != nil {
+		return err
+	}
+	err = encryptCAKey(conf)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt the CA key: %v", err)
 	}
-	return err
+	events.Publish(conf, events.Event{Type: events.CAKeyRotated, Message: fmt.Sprintf("wrote new CA key to %s", conf.GetCAKeyLocation())})
+	return nil
+}
+
+// RequestDeniedError is returned when a SignatureRequest is refused due to policy (as opposed to failing due to an
+// internal error)
+type RequestDeniedError struct {
+	// One of the shared.Denial* codes. Sent to kssh so that it can tell the user what to do next.
+	Code   string
+	Reason string
+}
+
+func (e RequestDeniedError) Error() string {
+	return "signature request denied: " + e.Reason
 }
 
 // Get a temporary filename that starts with pattern using ioutil.TempFile
@@ -76,6 +106,94 @@ func getTempFilename(pattern string) (string, error) {
 // Process a given SignatureRequest into a SignatureResponse or an error. This consists of validating the signature request,
 // determining the correct principals, and signing the provided public key.
 func ProcessSignatureRequest(conf config.Config, sr shared.SignatureRequest) (resp shared.SignatureResponse, err error) {
+	return processSignatureRequest(conf, sr, func(principals string) (CAKey, func(), error) { return LoadCAKey(conf) })
+}
+
+// Process a SignatureRequest like ProcessSignatureRequest but load the CA key with loadCAKey, which is given the comma
+// separated principals that the policy granted
+func processSignatureRequest(conf config.Config, sr shared.SignatureRequest, loadCAKey func(principals string) (CAKey, func(), error)) (resp shared.SignatureResponse, err error) {
+	keyID, grant, err := authorizeSignatureRequest(conf, sr)
+	if err != nil {
+		return
+	}
+	principals := grant.principals
+	err = requirePushApproval(conf, sr, strings.Split(principals, ","))
+	if err != nil {
+		return
+	}
+	return issueCertificate(conf, sr, keyID, grant, loadCAKey)
+}
+
+// Sign the certificate for an authorized SignatureRequest and record it in the issuance store
+func issueCertificate(conf config.Config, sr shared.SignatureRequest, keyID string, grant certificateGrant, loadCAKey func(principals string) (CAKey, func(), error)) (resp shared.SignatureResponse, err error) {
+	principals := grant.principals
+	// The hash of the request is embedded in the certificate and the request itself is kept in the issuance store so
+	// that the certificate can be tied back to the request during an investigation
+	canonicalRequest, requestHash, err := shared.CanonicalizeSignatureRequest(sr)
+	if err != nil {
+		return
+	}
+	grant.options = append(grant.options, "extension:"+shared.RequestHashExtension+"="+requestHash)
+
+	if len(grant.deniedExtensions) > 0 {
+		log.Log(conf, fmt.Sprintf("Not including the extensions %s requested by user=%s since they are not allowed for the user's teams",
+			strings.Join(grant.deniedExtensions, ","), sr.Username))
+	}
+	log.Log(conf, fmt.Sprintf("Processing SignatureRequest from user=%s on device='%s' keyID:%s, principals:%s, expiration:%s, requestHash:%s, pubkey:%s",
+		sr.Username, sr.DeviceName, keyID, principals, grant.expiration, requestHash, sr.SSHPublicKey))
+	signature, err := signCertificate(conf, sr, keyID, grant, loadCAKey)
+	if err != nil {
+		return
+	}
+	issued := events.Event{Type: events.CertIssued, Timestamp: time.Now(), Username: sr.Username, Principals: strings.Split(principals, ","),
+		KeyID: keyID, Certificate: signature, Request: canonicalRequest}
+	// Recorded before the certificate is returned so that no certificate is handed out without a record of it and
+	// of the request it was issued for. The other subscribers (eg webhooks) are notified in the background.
+	err = store.RecordIssuance(conf, issued)
+	if err != nil {
+		return resp, fmt.Errorf("failed to record the certificate %s in the issuance store: %v", keyID, err)
+	}
+	go events.Publish(conf, issued)
+
+	return shared.SignatureResponse{SignedKey: signature, UUID: sr.UUID, UsernamePrincipals: grant.usernamePrincipals}, nil
+}
+
+// Sign the public key of a SignatureRequest according to grant with the CA key loaded by loadCAKey, or with Vault if
+// VAULT_SSH_ROLE is set
+func signCertificate(conf config.Config, sr shared.SignatureRequest, keyID string, grant certificateGrant, loadCAKey func(principals string) (CAKey, func(), error)) (string, error) {
+	if conf.GetVaultSSHRole() != "" {
+		return SignKeyWithVault(conf, keyID, grant.principals, grant.expiration, sr.SSHPublicKey, grant.options...)
+	}
+	caKey, cleanup, err := loadCAKey(grant.principals)
+	defer cleanup()
+	if err != nil {
+		return "", err
+	}
+	algorithm := chooseSignatureAlgorithm(conf, sr.SignatureAlgorithms)
+	return SignKeyWithCAKey(caKey, algorithm, keyID, grant.principals, grant.expiration, sr.SSHPublicKey, grant.options...)
+}
+
+// Check a SignatureRequest against the policy (everything but push approval) and return the key ID and the grant for
+// its certificate
+func authorizeSignatureRequest(conf config.Config, sr shared.SignatureRequest) (keyID string, grant certificateGrant, err error) {
+	allowed, err := lockdown.IsSigningAllowed(conf, sr.Username)
+	if err != nil {
+		return
+	}
+	if !allowed {
+		return keyID, grant, RequestDeniedError{Code: shared.DenialLockdown, Reason: "the CA is in lockdown"}
+	}
+	receivedAt := sr.ReceivedAt
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	err = checkFreshness(conf, sr, receivedAt)
+	if err != nil {
+		return
+	}
+	if err = checkFIPSPublicKey(sr.SSHPublicKey); err != nil {
+		return keyID, grant, RequestDeniedError{Code: shared.DenialKeyRejected, Reason: err.Error()}
+	}
 	randomUUID, err := uuid.NewRandom()
 	if err != nil {
 		return
@@ -84,28 +202,106 @@ func ProcessSignatureRequest(conf config.Config, sr shared.SignatureRequest) (re
 	if err != nil {
 		return
 	}
+	grant, err = grantCertificate(conf, sr, principals)
+	if err != nil {
+		return
+	}
+	principals = grant.principals
 
 	// The key ID uniquely identifies the certificate by encoding the UUID of the request, a new UUID, and the username
 	// Use both their uuid and our uuid to ensure it is unique
-	keyID := sr.UUID + ":" + randomUUID.String() + ":" + sr.Username
+	keyID = sr.UUID + ":" + randomUUID.String() + ":" + sr.Username
 
-	log.Log(conf, fmt.Sprintf("Processing SignatureRequest from user=%s on device='%s' keyID:%s, principals:%s, expiration:%s, pubkey:%s",
-		sr.Username, sr.DeviceName, keyID, principals, conf.GetKeyExpiration(), sr.SSHPublicKey))
-	signature, err := SignKey(conf.GetCAKeyLocation(), keyID, principals, conf.GetKeyExpiration(), sr.SSHPublicKey)
+	chain, err := IntermediateOptions(conf, principals)
 	if err != nil {
 		return
 	}
+	grant.options = append(grant.options, chain...)
 
-	return shared.SignatureResponse{SignedKey: signature, UUID: sr.UUID}, nil
+	// Checked before asking for push approval so that the user is not asked to approve a certificate that cannot be signed
+	err = checkCertificateLimits(conf, sr.Username, keyID, principals, grant.options)
+	if err != nil {
+		return
+	}
+	return keyID, grant, nil
 }
 
-// Sign an SSH public key with the given data. Do so without any operations that rely on Keybase in order to ensure
-// that running `keybaseca sign` works even if Keybase is down.
-func SignKey(caKeyLocation, keyID, principals, expiration, publicKey string) (signature string, err error) {
+// The certificate that the CA's policy grants for a signature request
+type certificateGrant struct {
+	// Comma separated
+	principals         string
+	usernamePrincipals []string
+	expiration         string
+	options            []string
+	// The names of the requested custom extensions that were not allowed (see ALLOWED_EXTENSIONS)
+	deniedExtensions []string
+}
+
+// Apply the policy for the certificate contents (elevation, username principals, and the expiration) to a signature
+// request given the comma separated principals granted by the user's teams and groups
+func grantCertificate(conf config.Config, sr shared.SignatureRequest, principals string) (grant certificateGrant, err error) {
+	if principals == "" {
+		// ssh-keygen treats an empty list of principals as valid for every principal so this must be refused
+		return grant, RequestDeniedError{Code: shared.DenialNotInTeam, Reason: fmt.Sprintf("%s is not in any of the configured teams", sr.Username)}
+	}
+	usernamePrincipals, err := getUsernamePrincipals(conf, sr.Username, strings.Split(principals, ","))
+	if err != nil {
+		return
+	}
+	expiration := conf.GetKeyExpiration()
+	// Extensions are granted based on the user's teams rather than on the principals added below
+	options, deniedExtensions := filterExtensions(conf, sr.Extensions, strings.Split(principals, ","))
+	if sr.Elevate {
+		elevated := getElevatedPrincipals(conf, strings.Split(principals, ","))
+		if len(elevated) == 0 {
+			return grant, RequestDeniedError{Code: shared.DenialElevationNotAllowed, Reason: fmt.Sprintf("%s is not in any of the teams that may request elevation", sr.Username)}
+		}
+		principals += "," + strings.Join(elevated, ",")
+		expiration = conf.GetElevatedKeyExpiration()
+		if conf.GetSudoExtension() {
+			options = append(options, "extension:"+shared.SudoExtension)
+		}
+	}
+	if len(usernamePrincipals) > 0 {
+		principals += "," + strings.Join(usernamePrincipals, ",")
+	}
+	return certificateGrant{principals: principals, usernamePrincipals: usernamePrincipals, expiration: ValidityInterval(conf, expiration), options: options,
+		deniedExtensions: deniedExtensions}, nil
+}
+
+// ValidityInterval returns the ssh-keygen validity interval (see -V) for a certificate that expires at expiration (eg
+// +1h), starting CERT_BACKDATE before the time of signing if it is set
+func ValidityInterval(conf config.Config, expiration string) string {
+	if conf.GetCertBackdate() == "" {
+		return expiration
+	}
+	return conf.GetCertBackdate() + ":" + expiration
+}
+
+// Sign an SSH public key with the given data. Each option is passed to ssh-keygen via -O (eg
+// `extension:permit-sudo@keybase.io`). Do so without any operations that rely on Keybase in order to ensure that
+// running `keybaseca sign` works even if Keybase is down.
+func SignKey(caKeyLocation, keyID, principals, expiration, publicKey string, options ...string) (signature string, err error) {
+	return SignKeyWithAlgorithm(caKeyLocation, "", keyID, principals, expiration, publicKey, options...)
+}
+
+// SignKeyWithAlgorithm is like SignKey but signs with the given signature algorithm (eg shared.SigAlgoRSASHA512) if
+// it is not empty. Only RSA CA keys support more than one signature algorithm.
+func SignKeyWithAlgorithm(caKeyLocation, algorithm, keyID, principals, expiration, publicKey string, options ...string) (signature string, err error) {
+	return SignKeyWithCAKey(CAKey{Path: caKeyLocation}, algorithm, keyID, principals, expiration, publicKey, options...)
+}
+
+// SignKeyWithCAKey is like SignKeyWithAlgorithm but signs with a CA key loaded by LoadCAKey, which may be held by an
+// ssh-agent rather than stored in a file
+func SignKeyWithCAKey(caKey CAKey, algorithm, keyID, principals, expiration, publicKey string, options ...string) (signature string, err error) {
 	// Just a little bit of validation to give a nice error message
 	if strings.Contains(publicKey, "PRIVATE KEY") {
 		return "", fmt.Errorf("SignKey expects a public key (not a private key)")
 	}
+	err = checkFIPSPublicKey(publicKey)
+	if err != nil {
+		return
+	}
 
 	// Write the public key to a temporary file
 	tempFilename, err := getTempFilename("keybase-ca-signed-key")
@@ -117,19 +313,41 @@ func SignKey(caKeyLocation, keyID, principals, expiration, publicKey string) (si
 		return
 	}
 
+	serial, err := randomSerial()
+	if err != nil {
+		return
+	}
+
 	// Note that we use ssh-keygen rather than Go's builtin SSH library since Go's SSH library does not support ed25519
 	// SSH keys.
-	cmd := exec.Command("ssh-keygen",
-		"-s", caKeyLocation, // The CA key
+	var args []string
+	if caKey.AgentSocket != "" {
+		// The CA public key identifies which key in the agent signs the certificate
+		args = append(args, "-s", caKey.PublicKeyPath, "-U")
+	} else {
+		args = append(args, "-s", caKey.Path) // The CA key
+	}
+	args = append(args,
 		"-I", keyID, // A unique key ID
+		"-z", serial, // A random serial so that certificates can be looked up and revoked by serial
 		"-n", principals, // The allowed principals
 		"-V", expiration, // The expiration period for the key
 		"-N", "", // No password on the key
-		shared.KeyPathToPubKey(tempFilename), // The location of the public key
 	)
+	for _, option := range options {
+		args = append(args, "-O", option)
+	}
+	if algorithm != "" {
+		args = append(args, "-t", algorithm)
+	}
+	args = append(args, shared.KeyPathToPubKey(tempFilename)) // The location of the public key
+	cmd := exec.Command("ssh-keygen", args...)
+	if caKey.AgentSocket != "" {
+		cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+caKey.AgentSocket)
+	}
 	bytes, err := cmd.CombinedOutput()
 	if err != nil {
-		return "", fmt.Errorf("ssh-keygen error: %s (%v)", strings.TrimSpace(string(bytes)), err)
+		return "", fmt.Errorf("ssh-keygen error: %s (%v)", shared.RedactOutput(bytes), err)
 	}
 
 	// Read the certificate from the file
@@ -151,40 +369,83 @@ func SignKey(caKeyLocation, keyID, principals, expiration, publicKey string) (si
 	return string(signatureBytes), nil
 }
 
+// Generate a random certificate serial. Serials are limited to 63 bits so that they fit in a signed 64 bit integer.
+func randomSerial() (string, error) {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to generate a certificate serial: %v", err)
+	}
+	return strconv.FormatUint(binary.BigEndian.Uint64(b[:])>>1, 10), nil
+}
+
 // Get the principals that should be placed in the signed certificate. Note
 // that this function is a security boundary since if it was bypassed an
 // attacker would be able to provision SSH keys for environments that they
 // should not have access to.
 func getPrincipals(conf config.Config, sr shared.SignatureRequest) (string, error) {
-	// Start by getting the list of teams the user is in
-	api, err := botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
+	userTeams, err := GetUserTeams(conf, sr.Username)
 	if err != nil {
-		return "", fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
+		return "", err
 	}
-	results, err := api.ListUserMemberships(sr.Username)
+	principals, removed, err := getPrincipalsForTeams(conf, sr.Username, userTeams)
 	if err != nil {
-		return "", fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
+		return "", err
+	}
+	if len(removed) > 0 {
+		log.Log(conf, fmt.Sprintf("Not including the teams %v in the certificate for %s due to TEAM_ALLOWED_USERS or TEAM_DENIED_USERS",
+			removed, sr.Username))
 	}
+	return principals, nil
+}
 
-	// Maps from a team to whether or not the user is in the current team (with
-	// writer, admin, or owner permissions)
-	teamToMembership := make(map[string]bool)
+// GetUserTeams returns the teams that the given user is in (with reader, writer, admin, or owner permissions)
+func GetUserTeams(conf config.Config, username string) ([]string, error) {
+	api, err := botwrapper.GetKBChat(conf.GetKeybaseHomeDir(), conf.GetKeybasePaperKey(), conf.GetKeybaseUsername(), conf.GetKeybaseTimeout())
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
+	}
+	results, err := api.ListUserMemberships(username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve the list of teams the user is in: %v", err)
+	}
+	var userTeams []string
 	for _, result := range results {
 		// Check if the user is actually in the team, and not a restricted bot
 		// or implicit admin.
 		if shared.CanRoleReadTeam(result.Role) {
-			teamToMembership[result.FqName] = true
+			userTeams = append(userTeams, result.FqName)
 		}
 	}
+	return userTeams, nil
+}
 
-	// Iterate through the teams in the config file and use the subteam as the principal
-	// if the user is in that subteam
-	var principals []string
-	for _, team := range conf.GetTeams() {
-		result, ok := teamToMembership[team]
-		if ok && result {
-			principals = append(principals, team)
+// Get the comma separated principals for a user in the given teams along with the teams that were removed due to
+// TEAM_ALLOWED_USERS or TEAM_DENIED_USERS
+func getPrincipalsForTeams(conf config.Config, username string, userTeams []string) (string, []string, error) {
+	// Use every subteam that the user is in that matches one of the teams (or team patterns) in the config file as
+	// a principal
+	principals := shared.MatchTeams(conf.GetTeams(), userTeams)
+
+	// Team membership may be broader than SSH access (eg contractors that are only in the team for chat)
+	principals, removed := filterAllowedTeams(conf, username, principals)
+
+	// Principals may also be granted based on groups in an external directory (see GROUP_PROVIDER)
+	groupPrincipals, err := getGroupPrincipals(conf, username)
+	if err != nil {
+		return "", removed, err
+	}
+	seen := make(map[string]bool)
+	for _, principal := range principals {
+		seen[principal] = true
+	}
+	for _, principal := range groupPrincipals {
+		if !seen[principal] {
+			principals = append(principals, principal)
 		}
 	}
-	return strings.Join(principals, ","), nil
+	if len(removed) > 0 && len(principals) == 0 {
+		return "", removed, RequestDeniedError{Code: shared.DenialTeamNotAllowed, Reason: fmt.Sprintf("%s is not allowed to receive certificates for any of their teams", username)}
+	}
+	return strings.Join(principals, ","), removed, nil
 }
@@ -0,0 +1,243 @@
+package sshutils
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/store"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSignKeyWithOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-sign")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKey := filepath.Join(dir, "ca")
+	userKey := filepath.Join(dir, "user")
+	require.NoError(t, GenerateNewSSHKey(caKey, false, false))
+	require.NoError(t, GenerateNewSSHKey(userKey, false, false))
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+
+	signature, err := SignKey(caKey, "key-id", "team.ssh.prod,prod-sudo", "+15m", string(pubKey), "extension:"+shared.SudoExtension)
+	require.NoError(t, err)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature))
+	require.NoError(t, err)
+	cert := parsed.(*ssh.Certificate)
+	require.Equal(t, []string{"team.ssh.prod", "prod-sudo"}, cert.ValidPrincipals)
+	require.Contains(t, cert.Extensions, shared.SudoExtension)
+	// The default extensions are kept
+	require.Contains(t, cert.Extensions, "permit-pty")
+}
+
+func TestSignKeyWithAlgorithm(t *testing.T) {
+	if shared.FIPSMode {
+		t.Skip("ssh-rsa signatures are not allowed in FIPS mode")
+	}
+	dir, err := ioutil.TempDir("", "bot-sshca-sign")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKey := filepath.Join(dir, "ca")
+	userKey := filepath.Join(dir, "user")
+	output, err := exec.Command("ssh-keygen", "-t", "rsa", "-b", "2048", "-f", caKey, "-N", "").CombinedOutput()
+	require.NoError(t, err, string(output))
+	require.NoError(t, GenerateNewSSHKey(userKey, false, false))
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+
+	os.Setenv("CA_KEY_LOCATION", caKey)
+	os.Setenv("ALLOW_SSH_RSA_SIGNATURES", "true")
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	defer os.Unsetenv("ALLOW_SSH_RSA_SIGNATURES")
+	conf := &config.EnvConfig{}
+	for _, algorithm := range []string{shared.SigAlgoRSA, shared.SigAlgoRSASHA256} {
+		chosen := chooseSignatureAlgorithm(conf, []string{"unknown", algorithm})
+		require.Equal(t, algorithm, chosen)
+		signature, err := SignKeyWithAlgorithm(caKey, chosen, "key-id", "team.ssh.prod", "+15m", string(pubKey))
+		require.NoError(t, err)
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature))
+		require.NoError(t, err)
+		require.Equal(t, algorithm, parsed.(*ssh.Certificate).Signature.Format)
+	}
+	// ssh-rsa is only used if it is allowed and SHA-2 is the default
+	require.Equal(t, shared.SigAlgoRSASHA512, chooseSignatureAlgorithm(conf, nil))
+	os.Setenv("ALLOW_SSH_RSA_SIGNATURES", "false")
+	require.Equal(t, shared.SigAlgoRSASHA512, chooseSignatureAlgorithm(conf, []string{shared.SigAlgoRSA}))
+	os.Setenv("RSA_SIGNATURE_ALGORITHM", shared.SigAlgoRSASHA256)
+	defer os.Unsetenv("RSA_SIGNATURE_ALGORITHM")
+	require.Equal(t, shared.SigAlgoRSASHA256, DefaultSignatureAlgorithm(conf))
+
+	// Only RSA keys support choosing the algorithm
+	os.Setenv("CA_KEY_LOCATION", userKey)
+	require.Equal(t, "", chooseSignatureAlgorithm(conf, []string{shared.SigAlgoRSA}))
+}
+
+func TestGrantCertificateRequiresPrincipals(t *testing.T) {
+	conf := &config.EnvConfig{}
+	_, err := grantCertificate(conf, shared.SignatureRequest{Username: "alice"}, "")
+	require.IsType(t, RequestDeniedError{}, err)
+	require.Equal(t, shared.DenialNotInTeam, err.(RequestDeniedError).Code)
+
+	grant, err := grantCertificate(conf, shared.SignatureRequest{Username: "alice"}, "team.ssh.prod")
+	require.NoError(t, err)
+	require.Equal(t, "team.ssh.prod", grant.principals)
+}
+
+func TestIssueCertificateRecordsRequest(t *testing.T) {
+	if _, err := exec.LookPath("sqlite3"); err != nil {
+		t.Skip("sqlite3 is not installed")
+	}
+	dir, err := ioutil.TempDir("", "bot-sshca-issue")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKey := filepath.Join(dir, "ca")
+	userKey := filepath.Join(dir, "user")
+	require.NoError(t, GenerateNewSSHKey(caKey, false, false))
+	require.NoError(t, GenerateNewSSHKey(userKey, false, false))
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+	loadCAKey := func(principals string) (CAKey, func(), error) { return CAKey{Path: caKey}, func() {}, nil }
+	sr := shared.SignatureRequest{SSHPublicKey: string(pubKey), UUID: "uuid", Username: "alice", DeviceName: "laptop"}
+	grant := certificateGrant{principals: "team.ssh.prod", expiration: "+15m"}
+	conf := &config.EnvConfig{}
+
+	// The certificate and its request are in the store as soon as the response is returned
+	location := "sqlite:" + filepath.Join(dir, "issuances.db")
+	os.Setenv("ISSUANCE_STORE", location)
+	defer os.Unsetenv("ISSUANCE_STORE")
+	resp, err := issueCertificate(conf, sr, "uuid:key-id:alice", grant, loadCAKey)
+	require.NoError(t, err)
+	s, err := store.Open(location)
+	require.NoError(t, err)
+	records, err := s.Query(store.Filter{Username: "alice"})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "uuid:key-id:alice", records[0].KeyID)
+	require.NoError(t, records[0].VerifyRequest())
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(resp.SignedKey))
+	require.NoError(t, err)
+	require.Equal(t, records[0].RequestHash, parsed.(*ssh.Certificate).Extensions[shared.RequestHashExtension])
+
+	// A certificate that cannot be recorded is not returned
+	os.Setenv("ISSUANCE_STORE", "sqlite:"+filepath.Join(dir, "missing", "issuances.db"))
+	resp, err = issueCertificate(conf, sr, "uuid:other-key-id:alice", grant, loadCAKey)
+	require.Error(t, err)
+	require.Empty(t, resp.SignedKey)
+}
+
+func TestTestSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-sign")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKey := filepath.Join(dir, "ca")
+	require.NoError(t, GenerateNewSSHKey(caKey, false, false))
+
+	os.Setenv("CA_KEY_LOCATION", caKey)
+	os.Setenv("TEAMS", "team.ssh.prod,team.ssh.staging")
+	os.Setenv("TEAM_DENIED_USERS", "team.ssh.prod=bob")
+	os.Setenv("ELEVATED_PRINCIPALS", "team.ssh.prod=prod-sudo")
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	defer os.Unsetenv("TEAMS")
+	defer os.Unsetenv("TEAM_DENIED_USERS")
+	defer os.Unsetenv("ELEVATED_PRINCIPALS")
+	conf := &config.EnvConfig{}
+
+	result, err := TestSign(conf, "alice", []string{"team.ssh.prod", "team.other"}, false, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.prod"}, result.Principals)
+	require.True(t, strings.HasSuffix(result.KeyID, ":alice"))
+	require.True(t, result.ValidBefore.After(result.ValidAfter))
+
+	result, err = TestSign(conf, "alice", []string{"team.ssh.prod"}, true, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.prod", "prod-sudo"}, result.Principals)
+
+	os.Setenv("ALLOWED_EXTENSIONS", "team.ssh.prod=groups@acme.com=dba")
+	defer os.Unsetenv("ALLOWED_EXTENSIONS")
+	result, err = TestSign(conf, "alice", []string{"team.ssh.prod"}, false, map[string]string{"groups@acme.com": "dba", "role@acme.com": "admin"})
+	require.NoError(t, err)
+	require.Contains(t, result.Extensions, "groups@acme.com")
+	require.NotContains(t, result.Extensions, "role@acme.com")
+	require.Equal(t, []string{"role@acme.com"}, result.DeniedExtensions)
+
+	_, err = TestSign(conf, "bob", []string{"team.ssh.prod"}, false, nil)
+	require.IsType(t, RequestDeniedError{}, err)
+	require.Equal(t, shared.DenialTeamNotAllowed, err.(RequestDeniedError).Code)
+	_, err = TestSign(conf, "alice", []string{"team.other"}, false, nil)
+	require.IsType(t, RequestDeniedError{}, err)
+	require.Equal(t, shared.DenialNotInTeam, err.(RequestDeniedError).Code)
+}
+
+func TestTestSignVault(t *testing.T) {
+	if shared.FIPSMode {
+		t.Skip("signs with ed25519 keys which are not allowed in FIPS mode")
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	server := startFakeVault(t, caKey, "")
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "bot-sshca-test-sign-vault")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("VAULT_ADDR", server.URL)
+	os.Setenv("VAULT_TOKEN", "token")
+	os.Setenv("VAULT_SSH_ROLE", "keybaseca")
+	// There is no local CA key so the certificate can only come from Vault
+	os.Setenv("CA_KEY_LOCATION", filepath.Join(dir, "keybase-ca-key"))
+	os.Setenv("TEAMS", "team.ssh.prod")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+	defer os.Unsetenv("VAULT_SSH_ROLE")
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	defer os.Unsetenv("TEAMS")
+	conf := &config.EnvConfig{}
+
+	result, err := TestSign(conf, "alice", []string{"team.ssh.prod"}, false, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.prod"}, result.Principals)
+	require.Equal(t, ssh.KeyAlgoED25519, result.SignatureAlgorithm)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(result.Certificate))
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	require.Equal(t, signer.PublicKey().Marshal(), parsed.(*ssh.Certificate).SignatureKey.Marshal())
+}
+
+func TestTestSignThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-test-sign-threshold")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKey := filepath.Join(dir, "ca")
+	require.NoError(t, GenerateNewSSHKey(caKey, false, false))
+
+	os.Setenv("CA_KEY_LOCATION", caKey)
+	os.Setenv("TEAMS", "team.ssh.prod,team.ssh.staging")
+	os.Setenv("THRESHOLD_SHARE_LOCATION", filepath.Join(dir, "share-1.json"))
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	defer os.Unsetenv("TEAMS")
+	defer os.Unsetenv("THRESHOLD_SHARE_LOCATION")
+	conf := &config.EnvConfig{}
+
+	_, err = TestSign(conf, "alice", []string{"team.ssh.prod"}, false, nil)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not supported for threshold signed certificates")
+
+	// Certificates for the teams that are not threshold signed use the CA key as usual
+	os.Setenv("THRESHOLD_TEAMS", "team.ssh.prod")
+	defer os.Unsetenv("THRESHOLD_TEAMS")
+	_, err = TestSign(conf, "alice", []string{"team.ssh.prod"}, false, nil)
+	require.Error(t, err)
+	result, err := TestSign(conf, "alice", []string{"team.ssh.staging"}, false, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.staging"}, result.Principals)
+}
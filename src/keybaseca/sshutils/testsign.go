@@ -0,0 +1,135 @@
+package sshutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/lockdown"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestSignResult describes the certificate that the CA issued to a throwaway key via TestSign
+type TestSignResult struct {
+	KeyID       string    `json:"key_id"`
+	Principals  []string  `json:"principals"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	// The extensions of the certificate, sorted
+	Extensions []string `json:"extensions"`
+	// The requested custom extensions that were not allowed (see ALLOWED_EXTENSIONS), sorted
+	DeniedExtensions   []string `json:"denied_extensions,omitempty"`
+	SignatureAlgorithm string   `json:"signature_algorithm"`
+	// Whether a real request would have required a Duo push approval, which TestSign skips
+	PushApprovalRequired bool `json:"push_approval_required"`
+	// The certificate in authorized_keys format
+	Certificate string `json:"certificate"`
+}
+
+// TestSign runs a signature request from the given user in the given (fully qualified) teams through the same policy
+// and signing as ProcessSignatureRequest, but for a throwaway key and with the teams given rather than looked up via
+// Keybase. The given custom extensions (see `kssh --extension`) are requested as well. It is used by `keybaseca
+// test-sign` to check config changes in CI. Nothing is published: the request is not recorded in the audit log, no
+// webhooks are sent, and no push approval is requested. Policy denials are returned as a RequestDeniedError. The
+// certificate is signed with Vault if VAULT_SSH_ROLE is set. Certificates that would be threshold signed cannot be
+// test signed since that needs the shares of the other instances.
+func TestSign(conf config.Config, username string, teams []string, elevate bool, extensions map[string]string) (result TestSignResult, err error) {
+	// Not lockdown.IsSigningAllowed since that records break-glass users in the audit log
+	state, err := lockdown.Get(conf)
+	if err != nil {
+		return
+	}
+	if state.Enabled && !lockdown.IsBreakGlassUser(conf, username) {
+		return result, RequestDeniedError{Code: shared.DenialLockdown, Reason: "the CA is in lockdown"}
+	}
+	principals, _, err := getPrincipalsForTeams(conf, username, teams)
+	if err != nil {
+		return
+	}
+	sr := shared.SignatureRequest{Username: username, Elevate: elevate, Extensions: extensions}
+	grant, err := grantCertificate(conf, sr, principals)
+	if err != nil {
+		return
+	}
+	randomUUID, err := uuid.NewRandom()
+	if err != nil {
+		return
+	}
+	keyID := "keybaseca-test-sign:" + randomUUID.String() + ":" + username
+	chain, err := IntermediateOptions(conf, grant.principals)
+	if err != nil {
+		return
+	}
+	grant.options = append(grant.options, chain...)
+	err = checkCertificateLimits(conf, username, keyID, grant.principals, grant.options)
+	if err != nil {
+		return
+	}
+	if conf.GetThresholdShareLocation() != "" && isThresholdSigned(conf, grant.principals) {
+		return result, fmt.Errorf("test-sign is not supported for threshold signed certificates (see THRESHOLD_TEAMS) " +
+			"since signing them needs the shares of the other instances")
+	}
+
+	publicKey, cleanupKey, err := generateThrowawayKey()
+	defer cleanupKey()
+	if err != nil {
+		return
+	}
+	sr.SSHPublicKey = publicKey
+	signature, err := signCertificate(conf, sr, keyID, grant, func(principals string) (CAKey, func(), error) { return LoadCAKey(conf) })
+	if err != nil {
+		return
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature))
+	if err != nil {
+		return result, fmt.Errorf("failed to parse the signed certificate: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return result, fmt.Errorf("ssh-keygen did not produce a certificate")
+	}
+	var certExtensions []string
+	for extension := range cert.Extensions {
+		certExtensions = append(certExtensions, extension)
+	}
+	sort.Strings(certExtensions)
+	return TestSignResult{
+		KeyID:                cert.KeyId,
+		Principals:           cert.ValidPrincipals,
+		ValidAfter:           time.Unix(int64(cert.ValidAfter), 0),
+		ValidBefore:          time.Unix(int64(cert.ValidBefore), 0),
+		Extensions:           certExtensions,
+		DeniedExtensions:     grant.deniedExtensions,
+		SignatureAlgorithm:   cert.Signature.Format,
+		PushApprovalRequired: isPushApprovalRequired(conf, strings.Split(grant.principals, ","), elevate),
+		Certificate:          strings.TrimSpace(signature),
+	}, nil
+}
+
+// Generate a new key in a temporary directory and return its public key along with a function that deletes it
+func generateThrowawayKey() (publicKey string, cleanup func(), err error) {
+	cleanup = func() {}
+	dir, err := ioutil.TempDir("", "keybaseca-test-sign")
+	if err != nil {
+		return "", cleanup, err
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	keyPath := filepath.Join(dir, "key")
+	err = GenerateNewSSHKey(keyPath, false, false)
+	if err != nil {
+		return "", cleanup, err
+	}
+	bytes, err := ioutil.ReadFile(shared.KeyPathToPubKey(keyPath))
+	if err != nil {
+		return "", cleanup, err
+	}
+	return string(bytes), cleanup, nil
+}
@@ -0,0 +1,207 @@
+package sshutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/keybaseca/threshold"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/ssh"
+)
+
+// ShareCollector sends the given share request to the other keybaseca instances and returns the sealed shares from
+// their responses (see threshold.ShareResponse) once THRESHOLD-1 of them have responded
+type ShareCollector func(request threshold.ShareRequest, needed int) ([][]byte, error)
+
+// IsThresholdCoordinator returns whether this keybaseca instance (running as the Keybase user username) answers kssh
+// and collects threshold shares from the other instances
+func IsThresholdCoordinator(conf config.Config, username string) bool {
+	return conf.GetThresholdShareLocation() != "" && conf.GetThresholdCoordinator() == username
+}
+
+// A config.Config whose CA key is the threshold CA key (see config.Config.GetThresholdCAKeyLocation) so that it can
+// be loaded like the CA key
+type thresholdKeyConfig struct {
+	config.Config
+}
+
+func (c thresholdKeyConfig) GetCAKeyLocation() string {
+	return c.Config.GetThresholdCAKeyLocation()
+}
+
+// Returns whether a certificate for the given comma separated principals is threshold signed, ie whether
+// THRESHOLD_TEAMS is empty or matches one of the principals
+func isThresholdSigned(conf config.Config, principals string) bool {
+	return len(conf.GetThresholdTeams()) == 0 ||
+		len(shared.MatchTeams(conf.GetThresholdTeams(), strings.Split(principals, ","))) > 0
+}
+
+// CheckThresholdShare checks that this instance's share can be read and is for the threshold CA key
+func CheckThresholdShare(conf config.Config) error {
+	share, err := threshold.ReadShare(conf.GetThresholdShareLocation())
+	if err != nil {
+		return err
+	}
+	publicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetThresholdCAKeyLocation()))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA public key: %v", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse the CA public key: %v", err)
+	}
+	if share.KeyFingerprint != ssh.FingerprintSHA256(parsed) {
+		return fmt.Errorf("the threshold share at %s is for the CA key %s rather than %s", conf.GetThresholdShareLocation(),
+			share.KeyFingerprint, ssh.FingerprintSHA256(parsed))
+	}
+	return nil
+}
+
+// ProcessThresholdSignatureRequest processes a SignatureRequest like ProcessSignatureRequest but the threshold CA key
+// is decrypted with the secret reconstructed from this instance's share and the shares that collect gets from the
+// other instances, who each check the request against their own policy first. Certificates that do not include any of
+// the THRESHOLD_TEAMS (if set) are signed with the CA key as usual.
+func ProcessThresholdSignatureRequest(conf config.Config, sr shared.SignatureRequest, collect ShareCollector) (shared.SignatureResponse, error) {
+	return processSignatureRequest(conf, sr, func(principals string) (CAKey, func(), error) {
+		if !isThresholdSigned(conf, principals) {
+			return LoadCAKey(conf)
+		}
+		return loadCAKey(thresholdKeyConfig{conf}, func() (string, error) {
+			return collectThresholdPassphrase(conf, sr, principals, collect)
+		})
+	})
+}
+
+// Reconstruct the passphrase of the CA key from this instance's share and the shares of the other instances
+func collectThresholdPassphrase(conf config.Config, sr shared.SignatureRequest, principals string, collect ShareCollector) (string, error) {
+	ownShare, err := threshold.ReadShare(conf.GetThresholdShareLocation())
+	if err != nil {
+		return "", err
+	}
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		for i := range privateKey {
+			privateKey[i] = 0
+		}
+	}()
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", err
+	}
+	request := threshold.ShareRequest{ID: id.String(), RequestUUID: sr.UUID, Username: sr.Username, Principals: principals,
+		BoxKey: publicKey[:]}
+	sealed, err := collect(request, ownShare.Threshold-1)
+	if err != nil {
+		return "", fmt.Errorf("failed to collect threshold shares: %v", err)
+	}
+	shares := []threshold.Share{ownShare}
+	for _, s := range sealed {
+		share, err := threshold.OpenShare(s, publicKey, privateKey)
+		if err != nil {
+			return "", err
+		}
+		shares = append(shares, share)
+	}
+	secret, err := threshold.Combine(shares)
+	if err != nil {
+		return "", err
+	}
+	defer LockMemory(secret)()
+	return hex.EncodeToString(secret), nil
+}
+
+// SealThresholdShare is called by an instance other than the coordinator when it receives a share request for sr,
+// which it received from kssh itself. The request is checked against this instance's own policy and this instance's
+// share is returned sealed to the coordinator.
+func SealThresholdShare(conf config.Config, sr shared.SignatureRequest, request threshold.ShareRequest) ([]byte, error) {
+	if sr.UUID != request.RequestUUID || sr.Username != request.Username {
+		return nil, fmt.Errorf("the share request does not match the signature request")
+	}
+	// Push approval is left to the coordinator so that the user only gets one push
+	_, grant, err := authorizeSignatureRequest(conf, sr)
+	if err != nil {
+		return nil, err
+	}
+	if grant.principals != request.Principals {
+		return nil, fmt.Errorf("the coordinator asked to sign a certificate for the principals %s but the policy grants %s",
+			request.Principals, grant.principals)
+	}
+	if !isThresholdSigned(conf, grant.principals) {
+		return nil, fmt.Errorf("the certificate for the principals %s is not threshold signed since they do not "+
+			"include any of the THRESHOLD_TEAMS", grant.principals)
+	}
+	share, err := threshold.ReadShare(conf.GetThresholdShareLocation())
+	if err != nil {
+		return nil, err
+	}
+	log.Log(conf, fmt.Sprintf("Sending threshold share %d for the signature request %s from user=%s, principals:%s",
+		share.Index, sr.UUID, sr.Username, grant.principals))
+	return threshold.SealShare(share, request.BoxKey)
+}
+
+// ThresholdSplit encrypts the CA key with a random secret, splits the secret into the given number of shares of which
+// threshold are needed to decrypt the CA key, and writes the encrypted CA key (as ca-key and ca-key.pub) and the
+// shares (as share-N.json) to outputDir. Each keybaseca instance needs a copy of the encrypted CA key and one share.
+func ThresholdSplit(conf config.Config, shares, thresholdCount int, outputDir string) error {
+	publicKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(conf.GetCAKeyLocation()))
+	if err != nil {
+		return fmt.Errorf("failed to read the CA public key: %v", err)
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey(publicKey)
+	if err != nil {
+		return fmt.Errorf("failed to parse the CA public key: %v", err)
+	}
+	contents, release, err := ReadCAKey(conf)
+	defer release()
+	if err != nil {
+		return err
+	}
+
+	secret := make([]byte, threshold.SecretSize)
+	defer LockMemory(secret)()
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	split, err := threshold.Split(secret, shares, thresholdCount, ssh.FingerprintSHA256(parsed))
+	if err != nil {
+		return err
+	}
+	block, err := encryptKey(contents, hex.EncodeToString(secret))
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(outputDir, 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(outputDir, "ca-key"), pem.EncodeToMemory(block), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(outputDir, "ca-key.pub"), publicKey, 0644)
+	if err != nil {
+		return err
+	}
+	for _, share := range split {
+		err = threshold.WriteShare(filepath.Join(outputDir, fmt.Sprintf("share-%d.json", share.Index)), share)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
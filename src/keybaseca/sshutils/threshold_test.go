@@ -0,0 +1,91 @@
+package sshutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/threshold"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestThresholdSplit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-threshold")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caKey := filepath.Join(dir, "ca")
+	userKey := filepath.Join(dir, "user")
+	outDir := filepath.Join(dir, "out")
+	require.NoError(t, GenerateNewSSHKey(caKey, false, false))
+	require.NoError(t, GenerateNewSSHKey(userKey, false, false))
+
+	os.Setenv("CA_KEY_LOCATION", caKey)
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	require.NoError(t, ThresholdSplit(&config.EnvConfig{}, 3, 2, outDir))
+
+	// Run as the instance that holds the first share
+	os.Setenv("CA_KEY_LOCATION", filepath.Join(outDir, "ca-key"))
+	os.Setenv("THRESHOLD_SHARE_LOCATION", filepath.Join(outDir, "share-1.json"))
+	defer os.Unsetenv("THRESHOLD_SHARE_LOCATION")
+	conf := &config.EnvConfig{}
+	require.NoError(t, CheckThresholdShare(conf))
+	// The CA key cannot be loaded without the shares of the other instances
+	_, cleanup, err := LoadCAKey(conf)
+	cleanup()
+	require.Error(t, err)
+
+	sr := shared.SignatureRequest{UUID: "uuid", Username: "alice"}
+	collect := func(request threshold.ShareRequest, needed int) ([][]byte, error) {
+		require.Equal(t, 1, needed)
+		require.Equal(t, "uuid", request.RequestUUID)
+		require.Equal(t, "team.ssh.prod", request.Principals)
+		share, err := threshold.ReadShare(filepath.Join(outDir, "share-3.json"))
+		require.NoError(t, err)
+		sealed, err := threshold.SealShare(share, request.BoxKey)
+		require.NoError(t, err)
+		return [][]byte{sealed}, nil
+	}
+	passphrase, err := collectThresholdPassphrase(conf, sr, "team.ssh.prod", collect)
+	require.NoError(t, err)
+	key, cleanup, err := loadCAKey(conf, func() (string, error) { return passphrase, nil })
+	defer cleanup()
+	require.NoError(t, err)
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(userKey))
+	require.NoError(t, err)
+	signature, err := SignKeyWithCAKey(key, "", "key-id", "team.ssh.prod", "+15m", string(pubKey))
+	require.NoError(t, err)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature))
+	require.NoError(t, err)
+	caPublicKey, err := ioutil.ReadFile(filepath.Join(outDir, "ca-key.pub"))
+	require.NoError(t, err)
+	expected, _, _, _, err := ssh.ParseAuthorizedKey(caPublicKey)
+	require.NoError(t, err)
+	require.Equal(t, expected.Marshal(), parsed.(*ssh.Certificate).SignatureKey.Marshal())
+
+	// A share request must match the signature request that the instance received itself
+	_, err = SealThresholdShare(conf, sr, threshold.ShareRequest{RequestUUID: "other", Username: "alice"})
+	require.Error(t, err)
+}
+
+func TestIsThresholdSigned(t *testing.T) {
+	conf := &config.EnvConfig{}
+	require.True(t, isThresholdSigned(conf, "team.ssh.staging"))
+
+	os.Setenv("THRESHOLD_TEAMS", "team.ssh.prod.*")
+	defer os.Unsetenv("THRESHOLD_TEAMS")
+	require.True(t, isThresholdSigned(conf, "team.ssh.staging,team.ssh.prod.db"))
+	require.False(t, isThresholdSigned(conf, "team.ssh.staging"))
+	require.False(t, isThresholdSigned(conf, "team.ssh.prod"))
+
+	// Threshold signed certificates are signed with the threshold CA key
+	os.Setenv("CA_KEY_LOCATION", "/mnt/ca-key")
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	require.Equal(t, "/mnt/ca-key", thresholdKeyConfig{conf}.GetCAKeyLocation())
+	os.Setenv("THRESHOLD_CA_KEY_LOCATION", "/mnt/threshold-ca-key")
+	defer os.Unsetenv("THRESHOLD_CA_KEY_LOCATION")
+	require.Equal(t, "/mnt/threshold-ca-key", thresholdKeyConfig{conf}.GetCAKeyLocation())
+}
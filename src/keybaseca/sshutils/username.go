@@ -0,0 +1,82 @@
+package sshutils
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Get the unix usernames that should be included as principals for the given user who receives the given team
+// principals (see USERNAME_PRINCIPAL_TEAMS). This lets servers rely on sshd's default behavior of accepting
+// certificates whose principals include the name of the account being logged into, even when it differs from the
+// Keybase username.
+func getUsernamePrincipals(conf config.Config, username string, teams []string) ([]string, error) {
+	var principals []string
+	seen := make(map[string]bool)
+	for _, team := range shared.MatchTeams(conf.GetUsernamePrincipalTeams(), teams) {
+		unixUsername, err := mapUsername(conf, username, team)
+		if err != nil {
+			log.Log(conf, fmt.Sprintf("Failed to map the username of %s for %s: %v", username, team, err))
+			return nil, RequestDeniedError{Code: shared.DenialLookupFailed, Reason: "failed to look up the unix username of " + username}
+		}
+		if unixUsername == "" || seen[unixUsername] {
+			continue
+		}
+		if !shared.IsValidUnixUsername(unixUsername) {
+			log.Log(conf, fmt.Sprintf("Not including the username principal '%s' for %s in %s since it is not a valid unix username",
+				unixUsername, username, team))
+			continue
+		}
+		seen[unixUsername] = true
+		principals = append(principals, unixUsername)
+	}
+	return principals, nil
+}
+
+// Map the given Keybase username to a unix username for the given team. USERNAME_MAP entries for the team take
+// precedence over global USERNAME_MAP entries, followed by USERNAME_COMMAND and then USERNAME_REGEX. If none of them
+// apply the Keybase username is used unchanged. Returns an empty string if the user should not receive a username
+// principal.
+func mapUsername(conf config.Config, username, team string) (string, error) {
+	username = strings.ToLower(username)
+	var global string
+	for _, mapping := range conf.GetUsernameMap() {
+		if mapping.Username != username {
+			continue
+		}
+		if mapping.Team == "" {
+			global = mapping.UnixUsername
+		} else if shared.MatchTeam(mapping.Team, team) {
+			return mapping.UnixUsername, nil
+		}
+	}
+	if global != "" {
+		return global, nil
+	}
+	if conf.GetUsernameCommand() != "" {
+		return runUsernameCommand(conf.GetUsernameCommand(), username, team)
+	}
+	if re := conf.GetUsernameRegex(); re != nil {
+		if match := re.FindStringSubmatchIndex(username); match != nil {
+			return string(re.ExpandString(nil, conf.GetUsernameReplacement(), username, match)), nil
+		}
+	}
+	return username, nil
+}
+
+// Run USERNAME_COMMAND with the Keybase username as $1 and the team as $2. The command prints the unix username, or
+// nothing if the user should not receive a username principal.
+func runUsernameCommand(command, username, team string) (string, error) {
+	cmd := exec.Command("sh", "-c", command, "keybaseca-username", username, team)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("USERNAME_COMMAND failed: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
@@ -0,0 +1,49 @@
+package sshutils
+
+import (
+	"os"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapUsername(t *testing.T) {
+	os.Setenv("USERNAME_MAP", "alice=asmith,team.ssh.prod:alice=alice_prod,team.ssh.*:bob=robert")
+	os.Setenv("USERNAME_REGEX", "^(.*)_kb$")
+	os.Setenv("USERNAME_REPLACEMENT", "${1}")
+	defer os.Unsetenv("USERNAME_MAP")
+	defer os.Unsetenv("USERNAME_REGEX")
+	defer os.Unsetenv("USERNAME_REPLACEMENT")
+	conf := &config.EnvConfig{}
+
+	check := func(username, team, expected string) {
+		unixUsername, err := mapUsername(conf, username, team)
+		require.NoError(t, err)
+		require.Equal(t, expected, unixUsername)
+	}
+	// Team specific mappings take precedence over global ones
+	check("Alice", "team.ssh.prod", "alice_prod")
+	check("alice", "team.ssh.staging", "asmith")
+	check("bob", "team.ssh.staging", "robert")
+	check("bob", "team.other", "bob")
+	check("carol_kb", "team.ssh.prod", "carol")
+
+	os.Setenv("USERNAME_COMMAND", `test "$2" = "team.ssh.prod" && echo "$1" | tr -d _`)
+	defer os.Unsetenv("USERNAME_COMMAND")
+	check("carol_kb", "team.ssh.prod", "carolkb")
+	_, err := mapUsername(conf, "carol_kb", "team.ssh.staging")
+	require.Error(t, err)
+}
+
+func TestGetUsernamePrincipals(t *testing.T) {
+	os.Setenv("USERNAME_PRINCIPAL_TEAMS", "team.ssh.*")
+	os.Setenv("USERNAME_MAP", "team.ssh.prod:alice=alice_prod,team.ssh.staging:alice=Not-Valid")
+	defer os.Unsetenv("USERNAME_PRINCIPAL_TEAMS")
+	defer os.Unsetenv("USERNAME_MAP")
+	conf := &config.EnvConfig{}
+
+	principals, err := getUsernamePrincipals(conf, "alice", []string{"team.ssh.prod", "team.ssh.staging", "team.ssh.dev", "team.other"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"alice_prod", "alice"}, principals)
+}
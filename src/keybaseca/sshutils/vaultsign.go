@@ -0,0 +1,199 @@
+package sshutils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/vault"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The extensions that ssh-keygen includes in user certificates unless the clear option is given
+var defaultExtensions = []string{"permit-X11-forwarding", "permit-agent-forwarding", "permit-port-forwarding", "permit-pty", "permit-user-rc"}
+
+// The number of seconds in each unit of an ssh-keygen time specification (see TIME FORMATS in sshd_config(5))
+var ttlUnits = map[rune]int{'s': 1, 'S': 1, 'm': 60, 'M': 60, 'h': 3600, 'H': 3600, 'd': 86400, 'D': 86400, 'w': 604800, 'W': 604800}
+
+func newVaultClient(conf config.Config) *vault.Client {
+	return &vault.Client{Address: conf.GetVaultAddress(), Token: conf.GetVaultToken(), Namespace: conf.GetVaultNamespace()}
+}
+
+// SignKeyWithVault is like SignKey but signs with VAULT_SSH_ROLE of the SSH secrets engine of HashiCorp Vault rather
+// than with a local CA key. The validity interval and the options are translated into the equivalent Vault
+// parameters. The start of the validity interval is ignored since Vault backdates certificates by the
+// not_before_duration of the role instead.
+func SignKeyWithVault(conf config.Config, keyID, principals, expiration, publicKey string, options ...string) (string, error) {
+	if strings.Contains(publicKey, "PRIVATE KEY") {
+		return "", fmt.Errorf("SignKey expects a public key (not a private key)")
+	}
+	err := checkFIPSPublicKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+	ttl, err := vaultTTL(expiration)
+	if err != nil {
+		return "", err
+	}
+	extensions, criticalOptions, err := vaultOptions(options)
+	if err != nil {
+		return "", err
+	}
+	signedKey, err := newVaultClient(conf).SignSSHKey(conf.GetVaultSSHMount(), conf.GetVaultSSHRole(), vault.SSHSignRequest{
+		PublicKey:       publicKey,
+		CertType:        "user",
+		ValidPrincipals: principals,
+		KeyID:           keyID,
+		TTL:             ttl,
+		CriticalOptions: criticalOptions,
+		Extensions:      extensions,
+	})
+	if err != nil {
+		return "", err
+	}
+	err = checkVaultCertificate(signedKey, publicKey, principals)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(signedKey) + "\n", nil
+}
+
+// Convert an ssh-keygen validity interval (eg -5m:+1h or +1h30m) into a Vault TTL in seconds
+func vaultTTL(expiration string) (string, error) {
+	if i := strings.Index(expiration, ":"); i >= 0 {
+		expiration = expiration[i+1:]
+	}
+	// Vault only supports expirations relative to the time of signing
+	spec := strings.TrimPrefix(expiration, "+")
+	if spec == expiration || spec == "" {
+		return "", fmt.Errorf("the certificate expiration %q cannot be used with Vault", expiration)
+	}
+	seconds := 0
+	digits := ""
+	for _, c := range spec {
+		if c >= '0' && c <= '9' {
+			digits += string(c)
+			continue
+		}
+		multiplier, ok := ttlUnits[c]
+		if !ok || digits == "" {
+			return "", fmt.Errorf("the certificate expiration %q cannot be used with Vault", expiration)
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return "", err
+		}
+		seconds += n * multiplier
+		digits = ""
+	}
+	if digits != "" {
+		n, err := strconv.Atoi(digits)
+		if err != nil {
+			return "", err
+		}
+		seconds += n
+	}
+	if seconds <= 0 {
+		return "", fmt.Errorf("the certificate expiration %q cannot be used with Vault", expiration)
+	}
+	return fmt.Sprintf("%ds", seconds), nil
+}
+
+// Convert ssh-keygen options (see SignKey) into the extensions and critical options of a Vault sign request. Like
+// ssh-keygen, the default permit-* extensions are included unless the clear option is given.
+func vaultOptions(options []string) (extensions map[string]string, criticalOptions map[string]string, err error) {
+	extensions = map[string]string{}
+	criticalOptions = map[string]string{}
+	clear := false
+	for _, option := range options {
+		var target map[string]string
+		var nameValue string
+		switch {
+		case option == "clear":
+			clear = true
+			continue
+		case strings.HasPrefix(option, "extension:"):
+			target, nameValue = extensions, strings.TrimPrefix(option, "extension:")
+		case strings.HasPrefix(option, "critical:"):
+			target, nameValue = criticalOptions, strings.TrimPrefix(option, "critical:")
+		default:
+			return nil, nil, fmt.Errorf("the certificate option %q cannot be used with Vault", option)
+		}
+		parts := strings.SplitN(nameValue, "=", 2)
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		target[parts[0]] = value
+	}
+	if !clear {
+		for _, name := range defaultExtensions {
+			if _, ok := extensions[name]; !ok {
+				extensions[name] = ""
+			}
+		}
+	}
+	return extensions, criticalOptions, nil
+}
+
+// Check that a certificate returned by Vault is for the given public key and is only valid for the requested
+// principals. A misconfigured role (eg with a default_user) could otherwise grant more access than the policy allows.
+func checkVaultCertificate(signedKey, publicKey, principals string) error {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedKey))
+	if err != nil {
+		return fmt.Errorf("failed to parse the certificate signed by Vault: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return fmt.Errorf("Vault did not return a certificate")
+	}
+	requested, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(cert.Key.Marshal(), requested.Marshal()) {
+		return fmt.Errorf("the certificate signed by Vault is not for the requested public key")
+	}
+	expected := strings.Split(principals, ",")
+	actual := append([]string{}, cert.ValidPrincipals...)
+	sort.Strings(expected)
+	sort.Strings(actual)
+	if strings.Join(expected, ",") != strings.Join(actual, ",") {
+		return fmt.Errorf("the certificate signed by Vault is valid for the principals %s rather than %s",
+			strings.Join(actual, ","), strings.Join(expected, ","))
+	}
+	return nil
+}
+
+// SyncVaultCAPublicKey fetches the CA public key of the SSH secrets engine at VAULT_SSH_MOUNT and writes it to
+// CA_KEY_LOCATION.pub where the rest of keybaseca (eg the kssh client configs and `keybaseca export-ca`) reads it.
+// Returns the public key in authorized_keys format.
+func SyncVaultCAPublicKey(conf config.Config) (string, error) {
+	publicKey, err := newVaultClient(conf).GetSSHCAPublicKey(conf.GetVaultSSHMount())
+	if err != nil {
+		return "", fmt.Errorf("failed to get the CA public key from Vault: %v", err)
+	}
+	_, _, _, _, err = ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the CA public key from Vault: %v", err)
+	}
+	publicKey = strings.TrimSpace(publicKey) + "\n"
+	pubKeyLocation := shared.KeyPathToPubKey(conf.GetCAKeyLocation())
+	err = os.MkdirAll(filepath.Dir(pubKeyLocation), 0700)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(pubKeyLocation, []byte(publicKey), 0644)
+	if err != nil {
+		return "", err
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,150 @@
+package sshutils
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/vault"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestVaultTTL(t *testing.T) {
+	for expiration, expected := range map[string]string{
+		"+1h":       "3600s",
+		"+15m":      "900s",
+		"-5m:+1h":   "3600s",
+		"+1h30m":    "5400s",
+		"+2w1d":     "1296000s",
+		"+90":       "90s",
+		"+1H":       "3600s",
+		"-1d:+600s": "600s",
+	} {
+		ttl, err := vaultTTL(expiration)
+		require.NoError(t, err, expiration)
+		require.Equal(t, expected, ttl, expiration)
+	}
+	for _, expiration := range []string{"", "+", "forever", "+1y", "+h", "20200101:20210101", "+0m"} {
+		_, err := vaultTTL(expiration)
+		require.Error(t, err, expiration)
+	}
+}
+
+func TestVaultOptions(t *testing.T) {
+	extensions, criticalOptions, err := vaultOptions([]string{"extension:permit-sudo@keybase.io", "extension:groups@acme.com=dba"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"permit-X11-forwarding": "", "permit-agent-forwarding": "", "permit-port-forwarding": "",
+		"permit-pty": "", "permit-user-rc": "", "permit-sudo@keybase.io": "", "groups@acme.com": "dba"}, extensions)
+	require.Equal(t, map[string]string{}, criticalOptions)
+
+	extensions, criticalOptions, err = vaultOptions([]string{"clear", "critical:source-address=10.0.0.0/8", "extension:permit-pty"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"permit-pty": ""}, extensions)
+	require.Equal(t, map[string]string{"source-address": "10.0.0.0/8"}, criticalOptions)
+
+	_, _, err = vaultOptions([]string{"no-pty"})
+	require.Error(t, err)
+}
+
+// Start a fake Vault server whose SSH secrets engine signs with caKey. If extraPrincipal is set it is added to every
+// certificate like a role with a default_user would.
+func startFakeVault(t *testing.T, caKey ed25519.PrivateKey, extraPrincipal string) *httptest.Server {
+	signer, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/ssh-client-signer/config/ca":
+			fmt.Fprintf(w, `{"data": {"public_key": %q}}`, string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+		case "/v1/ssh-client-signer/sign/keybaseca":
+			var request vault.SSHSignRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request.PublicKey))
+			require.NoError(t, err)
+			ttl, err := time.ParseDuration(request.TTL)
+			require.NoError(t, err)
+			principals := strings.Split(request.ValidPrincipals, ",")
+			if extraPrincipal != "" {
+				principals = append(principals, extraPrincipal)
+			}
+			cert := &ssh.Certificate{
+				Key:             publicKey,
+				CertType:        ssh.UserCert,
+				KeyId:           request.KeyID,
+				ValidPrincipals: principals,
+				ValidAfter:      uint64(time.Now().Add(-30 * time.Second).Unix()),
+				ValidBefore:     uint64(time.Now().Add(ttl).Unix()),
+				Permissions:     ssh.Permissions{CriticalOptions: request.CriticalOptions, Extensions: request.Extensions},
+			}
+			require.NoError(t, cert.SignCert(rand.Reader, signer))
+			fmt.Fprintf(w, `{"data": {"signed_key": %q}}`, string(ssh.MarshalAuthorizedKey(cert)))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": []}`)
+		}
+	}))
+}
+
+func TestSignKeyWithVault(t *testing.T) {
+	if shared.FIPSMode {
+		t.Skip("signs with ed25519 keys which are not allowed in FIPS mode")
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	userKey, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	server := startFakeVault(t, caKey, "")
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "vault")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	os.Setenv("VAULT_ADDR", server.URL)
+	defer os.Unsetenv("VAULT_ADDR")
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("VAULT_TOKEN")
+	os.Setenv("VAULT_SSH_ROLE", "keybaseca")
+	defer os.Unsetenv("VAULT_SSH_ROLE")
+	os.Setenv("CA_KEY_LOCATION", filepath.Join(dir, "ca", "keybase-ca-key"))
+	defer os.Unsetenv("CA_KEY_LOCATION")
+	conf := &config.EnvConfig{}
+
+	// The CA public key is written where the rest of keybaseca reads it
+	publicKey, err := SyncVaultCAPublicKey(conf)
+	require.NoError(t, err)
+	written, err := ioutil.ReadFile(filepath.Join(dir, "ca", "keybase-ca-key.pub"))
+	require.NoError(t, err)
+	require.Equal(t, publicKey, string(written))
+
+	signature, err := SignKeyWithVault(conf, "key-id", "team.ssh.prod,root", "-5m:+1h", authorizedKey(t, userKey),
+		"extension:permit-sudo@keybase.io")
+	require.NoError(t, err)
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signature))
+	require.NoError(t, err)
+	cert := parsed.(*ssh.Certificate)
+	require.Equal(t, "key-id", cert.KeyId)
+	require.Equal(t, []string{"team.ssh.prod", "root"}, cert.ValidPrincipals)
+	require.Contains(t, cert.Extensions, "permit-sudo@keybase.io")
+	require.Contains(t, cert.Extensions, "permit-pty")
+	require.Equal(t, strings.Fields(publicKey)[1], strings.Fields(string(ssh.MarshalAuthorizedKey(cert.SignatureKey)))[1])
+
+	// Certificates with more principals than requested are rejected
+	greedy := startFakeVault(t, caKey, "admin")
+	defer greedy.Close()
+	os.Setenv("VAULT_ADDR", greedy.URL)
+	_, err = SignKeyWithVault(conf, "key-id", "team.ssh.prod", "+1h", authorizedKey(t, userKey))
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "rather than team.ssh.prod")
+}
@@ -0,0 +1,377 @@
+package store
+
+/*
+store records every certificate issued by keybaseca in a database so that questions such as "which certificates did
+alice get last week?" or "who was issued the certificate with serial N?" can be answered via `keybaseca query` rather
+than by searching the audit log. SQLite and Postgres are supported. The sqlite3 and psql command line clients are used
+(in the same way that keybaseca uses ssh-keygen rather than a Go library) so that keybaseca does not need cgo or any
+database drivers. The client for the configured database must be installed (the Docker image includes both).
+
+Since the SQL is sent to the clients as text, every value is validated (see checkValue) and quoted (see quote), and
+psql is always run with standard_conforming_strings on so that backslashes in values are never treated as escapes.
+Postgres credentials are never passed on the psql command line, where other users could see them: a password in the
+URL is passed via PGPASSWORD and otherwise psql reads PGPASSFILE or ~/.pgpass as usual.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/shared"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Record describes a single issued certificate
+type Record struct {
+	KeyID       string    `json:"key_id"`
+	Serial      uint64    `json:"serial"`
+	Username    string    `json:"username"`
+	Principals  []string  `json:"principals"`
+	IssuedAt    time.Time `json:"issued_at"`
+	ValidAfter  time.Time `json:"valid_after"`
+	ValidBefore time.Time `json:"valid_before"`
+	// Whether the certificate was signed via `keybaseca sign --offline` rather than requested via kssh
+	Offline bool `json:"offline"`
+	// The hash of the signature request embedded in the certificate (see shared.RequestHashExtension) and the
+	// canonical request itself. Empty for offline certificates and certificates issued before requests were recorded.
+	RequestHash string `json:"request_hash,omitempty"`
+	Request     string `json:"request,omitempty"`
+}
+
+// Filter restricts the records returned by Query. Zero values match every record.
+type Filter struct {
+	Username  string
+	Principal string
+	Serial    *uint64
+	// Only the certificate issued for the signature request with this hash is returned
+	RequestHash string
+	// Only certificates issued at or after Since and before Until are returned
+	Since time.Time
+	Until time.Time
+	// The maximum number of records to return, most recently issued first
+	Limit int
+}
+
+// Used to separate the fields and rows printed by sqlite3 and psql since they cannot appear in any value
+const (
+	fieldSeparator  = "\x1f"
+	recordSeparator = "\x1e"
+)
+
+const schema = `CREATE TABLE IF NOT EXISTS issuances (
+	key_id TEXT PRIMARY KEY,
+	serial BIGINT NOT NULL,
+	username TEXT NOT NULL,
+	principals TEXT NOT NULL,
+	issued_at BIGINT NOT NULL,
+	valid_after BIGINT NOT NULL,
+	valid_before BIGINT NOT NULL,
+	offline INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS issuances_username ON issuances (username);
+CREATE INDEX IF NOT EXISTS issuances_serial ON issuances (serial);
+CREATE INDEX IF NOT EXISTS issuances_issued_at ON issuances (issued_at);
+CREATE TABLE IF NOT EXISTS issuance_requests (
+	key_id TEXT PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	request TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS issuance_requests_request_hash ON issuance_requests (request_hash);
+`
+
+// Store is a database of issued certificates
+type Store struct {
+	location string
+}
+
+// Open opens the store at the given location (see ISSUANCE_STORE), creating its table if needed
+func Open(location string) (*Store, error) {
+	if !strings.HasPrefix(location, "sqlite:") && !strings.HasPrefix(location, "postgres://") && !strings.HasPrefix(location, "postgresql://") {
+		return nil, fmt.Errorf("unsupported issuance store %s", location)
+	}
+	if !strings.HasPrefix(location, "sqlite:") {
+		if _, _, err := postgresConnection(location); err != nil {
+			return nil, err
+		}
+	}
+	s := &Store{location: location}
+	_, err := s.exec(schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the issuances table: %v", err)
+	}
+	return s, nil
+}
+
+// Run the given SQL and return the rows that it printed
+func (s *Store) exec(sql string) ([][]string, error) {
+	var cmd *exec.Cmd
+	if strings.HasPrefix(s.location, "sqlite:") {
+		cmd = exec.Command("sqlite3", "-batch", "-noheader", "-cmd", ".timeout 10000",
+			"-separator", fieldSeparator, "-newline", recordSeparator, strings.TrimPrefix(s.location, "sqlite:"))
+	} else {
+		connection, password, err := postgresConnection(s.location)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.Command("psql", "-X", "-q", "-A", "-t", "-v", "ON_ERROR_STOP=1",
+			"-F", fieldSeparator, "-R", recordSeparator, "-d", connection)
+		if password != "" {
+			cmd.Env = append(os.Environ(), "PGPASSWORD="+password)
+		}
+		// quote relies on backslashes not being escapes, which is only the default since Postgres 9.1
+		sql = "SET standard_conforming_strings = on;\n" + sql
+	}
+	cmd.Stdin = strings.NewReader(sql)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %s (%v)", cmd.Args[0], strings.TrimSpace(stderr.String()), err)
+	}
+	var rows [][]string
+	for _, row := range strings.Split(string(output), recordSeparator) {
+		row = strings.Trim(row, "\n")
+		if row != "" {
+			rows = append(rows, strings.Split(row, fieldSeparator))
+		}
+	}
+	return rows, nil
+}
+
+// Split the given postgres:// URL into the URL to pass to psql and the password it contains, if any, so that the
+// password does not appear on the command line of psql
+func postgresConnection(location string) (string, string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		// The error includes the URL, which may include the password
+		return "", "", fmt.Errorf("the issuance store is not a valid postgres:// URL")
+	}
+	if u.User == nil {
+		return location, "", nil
+	}
+	password, ok := u.User.Password()
+	if !ok {
+		return location, "", nil
+	}
+	u.User = url.User(u.User.Username())
+	return u.String(), password, nil
+}
+
+// Quote the given string as a SQL string literal
+func quote(value string) string {
+	return "'" + strings.Replace(value, "'", "''", -1) + "'"
+}
+
+// Returns an error if the given value cannot be stored safely
+func checkValue(value string) error {
+	if strings.ContainsAny(value, "\x00"+fieldSeparator+recordSeparator) {
+		return fmt.Errorf("%q contains a control character", value)
+	}
+	return nil
+}
+
+// Insert records the given certificate
+func (s *Store) Insert(r Record) error {
+	for _, value := range append([]string{r.KeyID, r.Username, r.RequestHash, r.Request}, r.Principals...) {
+		if err := checkValue(value); err != nil {
+			return err
+		}
+	}
+	offline := 0
+	if r.Offline {
+		offline = 1
+	}
+	sql := fmt.Sprintf("INSERT INTO issuances (key_id, serial, username, principals, issued_at, valid_after, valid_before, offline) "+
+		"VALUES (%s, %d, %s, %s, %d, %d, %d, %d);\n",
+		quote(r.KeyID), int64(r.Serial), quote(r.Username), quote(strings.Join(r.Principals, ",")),
+		r.IssuedAt.Unix(), r.ValidAfter.Unix(), r.ValidBefore.Unix(), offline)
+	if r.Request != "" {
+		// Requests are kept in their own table so that stores created before requests were recorded do not need to
+		// be migrated
+		sql += fmt.Sprintf("INSERT INTO issuance_requests (key_id, request_hash, request) VALUES (%s, %s, %s);\n",
+			quote(r.KeyID), quote(r.RequestHash), quote(r.Request))
+	}
+	_, err := s.exec(sql)
+	return err
+}
+
+// Build the WHERE clause (including the leading space) for the given filter. Empty if it matches every record.
+func whereClause(f Filter) string {
+	var conditions []string
+	if f.Username != "" {
+		conditions = append(conditions, "username = "+quote(f.Username))
+	}
+	if f.Principal != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(f.Principal)
+		conditions = append(conditions, fmt.Sprintf(`(',' || principals || ',') LIKE %s ESCAPE '\'`, quote("%,"+escaped+",%")))
+	}
+	if f.Serial != nil {
+		conditions = append(conditions, fmt.Sprintf("serial = %d", int64(*f.Serial)))
+	}
+	if f.RequestHash != "" {
+		conditions = append(conditions, "issuances.key_id IN (SELECT key_id FROM issuance_requests WHERE request_hash = "+quote(f.RequestHash)+")")
+	}
+	if !f.Since.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("issued_at >= %d", f.Since.Unix()))
+	}
+	if !f.Until.IsZero() {
+		conditions = append(conditions, fmt.Sprintf("issued_at < %d", f.Until.Unix()))
+	}
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// Query returns the records matching the given filter, most recently issued first
+func (s *Store) Query(f Filter) ([]Record, error) {
+	sql := "SELECT issuances.key_id, serial, username, principals, issued_at, valid_after, valid_before, offline, " +
+		"COALESCE(issuance_requests.request_hash, ''), COALESCE(issuance_requests.request, '') FROM issuances " +
+		"LEFT JOIN issuance_requests ON issuance_requests.key_id = issuances.key_id" + whereClause(f)
+	sql += " ORDER BY issued_at DESC, issuances.key_id"
+	if f.Limit > 0 {
+		sql += fmt.Sprintf(" LIMIT %d", f.Limit)
+	}
+	rows, err := s.exec(sql + ";\n")
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	for _, row := range rows {
+		record, err := parseRow(row)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Delete deletes the records matching the given filter (ignoring its limit) and returns how many were deleted
+func (s *Store) Delete(f Filter) (int, error) {
+	deleteRequests := "DELETE FROM issuance_requests WHERE key_id IN (SELECT key_id FROM issuances" + whereClause(f) + ")"
+	sql := "DELETE FROM issuances" + whereClause(f)
+	if strings.HasPrefix(s.location, "sqlite:") {
+		sql = deleteRequests + ";\n" + sql + ";\nSELECT changes();\n"
+	} else {
+		sql = "WITH requests AS (" + deleteRequests + "), deleted AS (" + sql + " RETURNING 1) SELECT count(*) FROM deleted;\n"
+	}
+	rows, err := s.exec(sql)
+	if err != nil {
+		return 0, err
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 {
+		return 0, fmt.Errorf("unexpected output from the issuance store")
+	}
+	return strconv.Atoi(rows[0][0])
+}
+
+func parseRow(row []string) (Record, error) {
+	if len(row) != 10 {
+		return Record{}, fmt.Errorf("unexpected row with %d columns from the issuance store", len(row))
+	}
+	var ints [4]int64
+	for i, column := range []string{row[1], row[4], row[5], row[6]} {
+		value, err := strconv.ParseInt(column, 10, 64)
+		if err != nil {
+			return Record{}, fmt.Errorf("unexpected value %q from the issuance store", column)
+		}
+		ints[i] = value
+	}
+	var principals []string
+	if row[3] != "" {
+		principals = strings.Split(row[3], ",")
+	}
+	return Record{
+		KeyID:       row[0],
+		Serial:      uint64(ints[0]),
+		Username:    row[2],
+		Principals:  principals,
+		IssuedAt:    time.Unix(ints[1], 0),
+		ValidAfter:  time.Unix(ints[2], 0),
+		ValidBefore: time.Unix(ints[3], 0),
+		Offline:     row[7] == "1",
+		RequestHash: row[8],
+		Request:     row[9],
+	}, nil
+}
+
+// VerifyRequest checks that the recorded request is the one whose hash was embedded in the certificate. Returns an
+// error if no request was recorded.
+func (r Record) VerifyRequest() error {
+	if r.Request == "" {
+		return fmt.Errorf("no signature request was recorded for the certificate %s", r.KeyID)
+	}
+	if shared.HashCanonicalSignatureRequest(r.Request) != r.RequestHash {
+		return fmt.Errorf("the signature request recorded for the certificate %s does not match the hash %s", r.KeyID, r.RequestHash)
+	}
+	return nil
+}
+
+// NewRecord builds the record for a CertIssued or OfflineCertIssued event
+func NewRecord(event events.Event) (Record, error) {
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(event.Certificate))
+	if err != nil {
+		return Record{}, fmt.Errorf("failed to parse the certificate: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return Record{}, fmt.Errorf("not a certificate")
+	}
+	return Record{
+		KeyID:       cert.KeyId,
+		Serial:      cert.Serial,
+		Username:    event.Username,
+		Principals:  cert.ValidPrincipals,
+		IssuedAt:    event.Timestamp,
+		ValidAfter:  time.Unix(int64(cert.ValidAfter), 0),
+		ValidBefore: time.Unix(int64(cert.ValidBefore), 0),
+		Offline:     event.Type == events.OfflineCertIssued,
+		RequestHash: cert.Extensions[shared.RequestHashExtension],
+		Request:     event.Request,
+	}, nil
+}
+
+var (
+	openLock sync.Mutex
+	opened   = make(map[string]*Store)
+)
+
+// RecordIssuance records the certificate of the given CertIssued or OfflineCertIssued event in the ISSUANCE_STORE, if
+// one is configured. It is called before the certificate is handed out (rather than from an events.Handler, which
+// may run after the certificate was returned) so that a certificate is never issued without a record.
+func RecordIssuance(conf config.Config, event events.Event) error {
+	if conf.GetIssuanceStore() == "" {
+		return nil
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	r, err := NewRecord(event)
+	if err != nil {
+		return err
+	}
+	location := conf.GetIssuanceStore()
+	openLock.Lock()
+	s, ok := opened[location]
+	if !ok {
+		s, err = Open(location)
+		if err != nil {
+			openLock.Unlock()
+			return err
+		}
+		opened[location] = s
+	}
+	openLock.Unlock()
+	return s.Insert(r)
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package sudoverify
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Returns an error unless the socket at socketPath is owned by the given user
+func checkSocketOwner(socketPath, username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return fmt.Errorf("failed to look up the user %s: %v", username, err)
+	}
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat the ssh-agent socket: %v", err)
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("failed to determine the owner of the ssh-agent socket")
+	}
+	if strconv.FormatUint(uint64(stat.Uid), 10) != u.Uid {
+		return fmt.Errorf("the ssh-agent socket %s is not owned by %s", socketPath, username)
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+package sudoverify
+
+import "fmt"
+
+// sudo is not available on windows
+func checkSocketOwner(socketPath, username string) error {
+	return fmt.Errorf("verifying the ssh-agent for sudo is not supported on windows")
+}
@@ -0,0 +1,262 @@
+package sudoverify
+
+/*
+sudoverify checks whether the ssh-agent forwarded by a user holds a certificate issued by keybaseca that permits sudo.
+It is used by `keybaseca-sudo-verify` which is run by sudo's PAM stack (via pam_exec) on servers so that sudo can be
+authenticated with an elevated kssh certificate rather than a password. A certificate permits sudo if it was signed by
+the CA, is currently valid, includes the required principal (if any), includes the shared.SudoExtension extension
+(which keybaseca adds to elevated certificates when SUDO_EXTENSION is enabled), and is not revoked. The agent must also
+prove that it holds the private key for the certificate by signing a random challenge.
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Options describes which certificates permit sudo
+type Options struct {
+	// The CA public keys that certificates must be signed by, either directly or via an intermediate CA key
+	CAPublicKeys []ssh.PublicKey
+	// If set, certificates must include this principal (eg an elevated principal such as `prod-sudo`)
+	Principal string
+	// Whether certificates must include shared.SudoExtension
+	RequireExtension bool
+	// If set, certificates (or their keys or CA keys) listed in this file are rejected. Either an OpenSSH KRL or a list
+	// of public keys, like sshd's RevokedKeys.
+	RevokedKeys string
+}
+
+// ReadCAPublicKeys reads the CA public keys (in authorized_keys format, one per line) from the given file
+func ReadCAPublicKeys(filename string) ([]ssh.PublicKey, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the CA public keys: %v", err)
+	}
+	var keys []ssh.PublicKey
+	for len(bytes.TrimSpace(contents)) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the CA public keys in %s: %v", filename, err)
+		}
+		keys = append(keys, key)
+		contents = rest
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no CA public keys found in %s", filename)
+	}
+	return keys, nil
+}
+
+// Verify returns the first certificate in the given agent that permits sudo according to opts. Returns an error
+// describing why each certificate was rejected if there is no such certificate.
+func Verify(agentClient agent.Agent, opts Options, now time.Time) (*ssh.Certificate, error) {
+	keys, err := agentClient.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the keys in the ssh-agent: %v", err)
+	}
+	var rejections []string
+	for _, key := range keys {
+		pub, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			continue
+		}
+		err = checkCert(cert, opts, now)
+		if err == nil {
+			err = checkPossession(agentClient, cert)
+		}
+		if err != nil {
+			rejections = append(rejections, fmt.Sprintf("%s: %v", cert.KeyId, err))
+			continue
+		}
+		return cert, nil
+	}
+	if len(rejections) == 0 {
+		return nil, fmt.Errorf("the ssh-agent does not hold any certificates")
+	}
+	return nil, fmt.Errorf("no certificate in the ssh-agent permits sudo (%s)", strings.Join(rejections, "; "))
+}
+
+// Check that the given certificate permits sudo according to opts
+func checkCert(cert *ssh.Certificate, opts Options, now time.Time) error {
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("not a user certificate")
+	}
+	checker := ssh.CertChecker{
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, caKey := range opts.CAPublicKeys {
+				if bytes.Equal(auth.Marshal(), caKey.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+		Clock: func() time.Time { return now },
+	}
+	if !checker.IsUserAuthority(cert.SignatureKey) {
+		intermediate, err := verifyChain(cert, opts.CAPublicKeys, now)
+		if err != nil {
+			return err
+		}
+		checker.IsUserAuthority = func(auth ssh.PublicKey) bool {
+			return bytes.Equal(auth.Marshal(), intermediate.Key.Marshal())
+		}
+	}
+	principal := opts.Principal
+	if principal == "" {
+		if len(cert.ValidPrincipals) == 0 {
+			return fmt.Errorf("the certificate does not restrict which principals it is valid for")
+		}
+		principal = cert.ValidPrincipals[0]
+	}
+	// CheckCert verifies the signature, the validity period, and the principal
+	err := checker.CheckCert(principal, cert)
+	if err != nil {
+		return err
+	}
+	if opts.RequireExtension {
+		if _, ok := cert.Extensions[shared.SudoExtension]; !ok {
+			return fmt.Errorf("missing the %s extension", shared.SudoExtension)
+		}
+	}
+	if opts.RevokedKeys != "" {
+		return checkRevoked(cert, opts.RevokedKeys)
+	}
+	return nil
+}
+
+// The first bytes of a binary OpenSSH KRL
+var krlMagic = []byte("SSHKRL\n\x00")
+
+// Check that neither the certificate nor its key nor the key that signed it is listed in the given revocation list.
+// Like sshd, a revocation list that cannot be read rejects every certificate.
+func checkRevoked(cert *ssh.Certificate, revokedKeys string) error {
+	contents, err := ioutil.ReadFile(revokedKeys)
+	if err != nil {
+		return fmt.Errorf("failed to read the revoked keys: %v", err)
+	}
+	if !bytes.HasPrefix(contents, krlMagic) {
+		// A list of public keys in authorized_keys format
+		for rest := contents; len(bytes.TrimSpace(rest)) > 0; {
+			var key ssh.PublicKey
+			key, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+			if err != nil {
+				return fmt.Errorf("failed to parse the revoked keys in %s: %v", revokedKeys, err)
+			}
+			for _, candidate := range []ssh.PublicKey{cert, cert.Key, cert.SignatureKey} {
+				if bytes.Equal(key.Marshal(), candidate.Marshal()) {
+					return fmt.Errorf("revoked by %s", revokedKeys)
+				}
+			}
+		}
+		return nil
+	}
+	// OpenSSH's KRL format is checked with `ssh-keygen -Q` since there is no Go implementation
+	dir, err := ioutil.TempDir("", "keybaseca-sudo-verify")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "cert.pub")
+	caPath := filepath.Join(dir, "ca.pub")
+	err = ioutil.WriteFile(certPath, ssh.MarshalAuthorizedKey(cert), 0600)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(caPath, ssh.MarshalAuthorizedKey(cert.SignatureKey), 0600)
+	if err != nil {
+		return err
+	}
+	output, err := exec.Command("ssh-keygen", "-Q", "-f", revokedKeys, certPath, caPath).CombinedOutput()
+	if bytes.Contains(output, []byte("REVOKED")) {
+		return fmt.Errorf("revoked by %s", revokedKeys)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check %s: ssh-keygen -Q failed: %s (%v)", revokedKeys, strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// Check that the agent holds the private key for the given certificate by asking it to sign a random challenge
+func checkPossession(agentClient agent.Agent, cert *ssh.Certificate) error {
+	challenge := make([]byte, 32)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return err
+	}
+	sig, err := agentClient.Sign(cert, challenge)
+	if err != nil {
+		return fmt.Errorf("the ssh-agent failed to sign a challenge: %v", err)
+	}
+	err = cert.Key.Verify(challenge, sig)
+	if err != nil {
+		return fmt.Errorf("the ssh-agent returned an invalid signature: %v", err)
+	}
+	return nil
+}
+
+// ConnectToAgent connects to the ssh-agent at socketPath after checking that the socket is owned by the given user.
+// This prevents a user from pointing sudo at an agent belonging to someone else.
+func ConnectToAgent(socketPath, username string) (agent.ExtendedAgent, func(), error) {
+	err := checkSocketOwner(socketPath, username)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the ssh-agent: %v", err)
+	}
+	return agent.NewClient(conn), func() { conn.Close() }, nil
+}
+
+// FindAgentSocket returns the SSH_AUTH_SOCK of the process running sudo. pam_exec does not pass the environment of
+// sudo to its child so it is read from the environment of the parent process on Linux.
+func FindAgentSocket() (string, error) {
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		return sock, nil
+	}
+	environ, err := ioutil.ReadFile("/proc/" + strconv.Itoa(os.Getppid()) + "/environ")
+	if err != nil {
+		return "", fmt.Errorf("SSH_AUTH_SOCK is not set and the environment of the parent process is unavailable: %v", err)
+	}
+	for _, entry := range bytes.Split(environ, []byte{0}) {
+		if bytes.HasPrefix(entry, []byte("SSH_AUTH_SOCK=")) {
+			return string(bytes.TrimPrefix(entry, []byte("SSH_AUTH_SOCK="))), nil
+		}
+	}
+	return "", fmt.Errorf("SSH_AUTH_SOCK is not set (is agent forwarding enabled and is SSH_AUTH_SOCK in sudo's env_keep?)")
+}
+
+// Check that the given certificate was signed by an intermediate CA key certified by one of the given CA keys (see
+// shared.VerifyChain) and return the intermediate certificate
+func verifyChain(cert *ssh.Certificate, caKeys []ssh.PublicKey, now time.Time) (*ssh.Certificate, error) {
+	if _, ok := cert.Extensions[shared.IntermediateExtension]; !ok {
+		return nil, fmt.Errorf("not signed by the CA")
+	}
+	err := fmt.Errorf("no CA public keys are configured")
+	for _, caKey := range caKeys {
+		var intermediate *ssh.Certificate
+		intermediate, err = shared.VerifyChain(cert, caKey, now)
+		if err == nil {
+			return intermediate, nil
+		}
+	}
+	return nil, fmt.Errorf("not signed by the CA: %v", err)
+}
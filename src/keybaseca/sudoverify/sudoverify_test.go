@@ -0,0 +1,131 @@
+package sudoverify
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func generateKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return priv, signer
+}
+
+// Add a key with a certificate signed by ca to the given agent
+func addCert(t *testing.T, keyring agent.Agent, ca ssh.Signer, keyID string, principals []string, extensions map[string]string) *ssh.Certificate {
+	priv, signer := generateKey(t)
+	cert := &ssh.Certificate{
+		Key:             signer.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           keyID,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		Permissions:     ssh.Permissions{Extensions: extensions},
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: priv, Certificate: cert}))
+	return cert
+}
+
+func TestVerify(t *testing.T) {
+	_, ca := generateKey(t)
+	_, otherCA := generateKey(t)
+	opts := Options{CAPublicKeys: []ssh.PublicKey{ca.PublicKey()}, Principal: "prod-sudo", RequireExtension: true}
+	sudo := map[string]string{shared.SudoExtension: ""}
+
+	keyring := agent.NewKeyring()
+	_, err := Verify(keyring, opts, time.Now())
+	require.Error(t, err)
+
+	// Certificates that do not permit sudo are rejected
+	addCert(t, keyring, ca, "no-extension", []string{"team.ssh.prod", "prod-sudo"}, nil)
+	addCert(t, keyring, ca, "no-principal", []string{"team.ssh.prod"}, sudo)
+	addCert(t, keyring, otherCA, "other-ca", []string{"prod-sudo"}, sudo)
+	_, err = Verify(keyring, opts, time.Now())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "no-extension")
+
+	// Unless the extension is not required
+	cert, err := Verify(keyring, Options{CAPublicKeys: opts.CAPublicKeys, Principal: "prod-sudo"}, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "no-extension", cert.KeyId)
+
+	addCert(t, keyring, ca, "elevated", []string{"team.ssh.prod", "prod-sudo"}, sudo)
+	cert, err = Verify(keyring, opts, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "elevated", cert.KeyId)
+
+	// Expired certificates are rejected
+	_, err = Verify(keyring, opts, time.Now().Add(2*time.Hour))
+	require.Error(t, err)
+}
+
+func TestVerifyRevoked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sudoverify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	_, ca := generateKey(t)
+	sudo := map[string]string{shared.SudoExtension: ""}
+	keyring := agent.NewKeyring()
+	revoked := addCert(t, keyring, ca, "revoked", []string{"prod-sudo"}, sudo)
+	opts := Options{CAPublicKeys: []ssh.PublicKey{ca.PublicKey()}, Principal: "prod-sudo", RequireExtension: true,
+		RevokedKeys: filepath.Join(dir, "revoked_keys")}
+
+	// A revocation list that cannot be read rejects every certificate, like sshd
+	_, err = Verify(keyring, opts, time.Now())
+	require.Error(t, err)
+
+	// A list of public keys
+	require.NoError(t, ioutil.WriteFile(opts.RevokedKeys, ssh.MarshalAuthorizedKey(revoked.Key), 0644))
+	_, err = Verify(keyring, opts, time.Now())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "revoked")
+
+	// A KRL
+	revokedPath := filepath.Join(dir, "revoked.pub")
+	require.NoError(t, ioutil.WriteFile(revokedPath, ssh.MarshalAuthorizedKey(revoked.Key), 0644))
+	require.NoError(t, os.Remove(opts.RevokedKeys))
+	output, err := exec.Command("ssh-keygen", "-k", "-f", opts.RevokedKeys, revokedPath).CombinedOutput()
+	require.NoError(t, err, string(output))
+	_, err = Verify(keyring, opts, time.Now())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "revoked")
+
+	addCert(t, keyring, ca, "valid", []string{"prod-sudo"}, sudo)
+	cert, err := Verify(keyring, opts, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, "valid", cert.KeyId)
+}
+
+func TestReadCAPublicKeys(t *testing.T) {
+	_, ca1 := generateKey(t)
+	_, ca2 := generateKey(t)
+	dir, err := ioutil.TempDir("", "sudoverify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "ca.pub")
+	contents := append(ssh.MarshalAuthorizedKey(ca1.PublicKey()), ssh.MarshalAuthorizedKey(ca2.PublicKey())...)
+	require.NoError(t, ioutil.WriteFile(filename, contents, 0644))
+
+	keys, err := ReadCAPublicKeys(filename)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+
+	require.NoError(t, ioutil.WriteFile(filename, []byte("\n"), 0644))
+	_, err = ReadCAPublicKeys(filename)
+	require.Error(t, err)
+}
@@ -0,0 +1,143 @@
+package systemd
+
+// This package implements the small subset of the systemd service protocol that keybaseca needs in order to be
+// supervised correctly when run as a `Type=notify` unit: readiness notification, watchdog pings, and socket
+// activation. It deliberately does not depend on libsystemd or any third party library since the protocol is a
+// handful of environment variables and a datagram socket. All functions are no-ops when not running under systemd.
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The first file descriptor passed by systemd when using socket activation. See sd_listen_fds(3)
+const listenFdsStart = 3
+
+// Notify sends the given state string (eg "READY=1") to the systemd notification socket. Returns false if
+// NOTIFY_SOCKET is not set (meaning we are not running under systemd with Type=notify).
+func Notify(state string) (bool, error) {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return false, nil
+	}
+	// Abstract namespace sockets are specified with a leading @ but actually start with a null byte
+	if strings.HasPrefix(socketPath, "@") {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to the systemd notification socket: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, fmt.Errorf("failed to send %s to systemd: %v", state, err)
+	}
+	return true, nil
+}
+
+// NotifyReady tells systemd that the service has finished starting up
+func NotifyReady() (bool, error) {
+	return Notify("READY=1")
+}
+
+// NotifyStopping tells systemd that the service is beginning its shutdown
+func NotifyStopping() (bool, error) {
+	return Notify("STOPPING=1")
+}
+
+// WatchdogInterval returns the interval configured via WatchdogSec= in the unit file. Returns 0 if the watchdog
+// is not enabled for this process.
+func WatchdogInterval() (time.Duration, error) {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0, nil
+	}
+	if pidStr := os.Getenv("WATCHDOG_PID"); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse WATCHDOG_PID=%s: %v", pidStr, err)
+		}
+		if pid != os.Getpid() {
+			// The watchdog is meant for a different process (eg our parent)
+			return 0, nil
+		}
+	}
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse WATCHDOG_USEC=%s: %v", usecStr, err)
+	}
+	if usec <= 0 {
+		return 0, fmt.Errorf("WATCHDOG_USEC must be positive, got %d", usec)
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// StartWatchdog starts a goroutine that pings the systemd watchdog at half of the configured interval until
+// stopCh is closed. isHealthy is called before every ping so that a wedged service stops pinging and is
+// restarted by systemd. Returns false if the watchdog is not enabled.
+func StartWatchdog(isHealthy func() bool, stopCh <-chan struct{}) (bool, error) {
+	interval, err := WatchdogInterval()
+	if err != nil || interval == 0 {
+		return false, err
+	}
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if isHealthy() {
+					_, _ = Notify("WATCHDOG=1")
+				}
+			}
+		}
+	}()
+	return true, nil
+}
+
+// Listeners returns the listening sockets passed in by systemd socket activation. Returns an empty list if
+// the process was not socket activated. See sd_listen_fds(3).
+func Listeners() ([]net.Listener, error) {
+	pidStr := os.Getenv("LISTEN_PID")
+	fdsStr := os.Getenv("LISTEN_FDS")
+	if pidStr == "" || fdsStr == "" {
+		return nil, nil
+	}
+	pid, err := strconv.Atoi(pidStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse LISTEN_PID=%s: %v", pidStr, err)
+	}
+	if pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(fdsStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse LISTEN_FDS=%s: %v", fdsStr, err)
+	}
+
+	// Unset these so that child processes do not attempt to use the sockets
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	var listeners []net.Listener
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to use socket activated file descriptor %d: %v", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
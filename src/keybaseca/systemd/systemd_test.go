@@ -0,0 +1,66 @@
+package systemd
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	sent, err := Notify("READY=1")
+	require.NoError(t, err)
+	require.False(t, sent)
+
+	dir, err := ioutil.TempDir("", "sshca-systemd-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socketPath)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	sent, err = NotifyReady()
+	require.NoError(t, err)
+	require.True(t, sent)
+
+	buf := make([]byte, 64)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+	interval, err := WatchdogInterval()
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), interval)
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	interval, err = WatchdogInterval()
+	require.NoError(t, err)
+	require.Equal(t, 30*time.Second, interval)
+
+	// A watchdog meant for another process is ignored
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	defer os.Unsetenv("WATCHDOG_PID")
+	interval, err = WatchdogInterval()
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), interval)
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("WATCHDOG_USEC", "bogus")
+	_, err = WatchdogInterval()
+	require.Error(t, err)
+}
@@ -0,0 +1,230 @@
+package threshold
+
+/*
+threshold implements threshold signing where the CA key is encrypted with a secret that is split between several
+keybaseca instances with Shamir's secret sharing. A certificate can only be signed once enough of the instances have
+each checked the signature request against their own copy of the policy and sent their share to the instance that
+received the request (the coordinator). Shares are sent over Keybase chat sealed to a key that the coordinator
+generates for each request so that other members of the team cannot read them.
+
+OpenSSH certificates only have a single signature so the coordinator must reconstruct the CA key in memory to sign a
+certificate. Threshold signing protects the CA key at rest (an attacker needs the shares of THRESHOLD instances) and
+makes sure that several instances agree that a certificate should be issued, but an attacker who controls the
+coordinator while it is signing can still learn the CA key.
+*/
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// The size in bytes of the secret that the CA key is encrypted with
+const SecretSize = 32
+
+// The prefixes of the messages that keybaseca instances exchange in chat to collect shares
+const (
+	ShareRequestPreamble  = "Threshold_Share_Request:"
+	ShareResponsePreamble = "Threshold_Share_Response:"
+)
+
+// A Share is one of the pieces of the secret that the CA key is encrypted with. Each keybaseca instance holds one.
+type Share struct {
+	// The number of shares needed to reconstruct the secret
+	Threshold int `json:"threshold"`
+	// The x coordinate of the share, between 1 and the number of shares
+	Index int    `json:"index"`
+	Value []byte `json:"value"`
+	// The SHA256 fingerprint of the CA public key that the secret decrypts so that shares of different keys are not
+	// mixed up
+	KeyFingerprint string `json:"key_fingerprint"`
+}
+
+// A ShareRequest is sent by the coordinator to ask the other instances for their shares in order to sign the
+// certificate for a signature request sent by kssh
+type ShareRequest struct {
+	// A random ID that the responses refer to
+	ID string `json:"id"`
+	// The UUID of the signature request and the user who sent it. Each instance only sends its share for signature
+	// requests that it received itself.
+	RequestUUID string `json:"request_uuid"`
+	Username    string `json:"username"`
+	// The comma separated principals that the coordinator's policy granted. Each instance checks that its own policy
+	// grants the same principals.
+	Principals string `json:"principals"`
+	// The public key that the share must be sealed to
+	BoxKey []byte `json:"box_key"`
+}
+
+// A ShareResponse carries the share of one instance sealed to the BoxKey of the ShareRequest
+type ShareResponse struct {
+	ID     string `json:"id"`
+	Sealed []byte `json:"sealed"`
+}
+
+// Split splits the given secret into n shares such that any threshold of them can reconstruct it
+func Split(secret []byte, n, threshold int, keyFingerprint string) ([]Share, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("the threshold must be between 2 and the number of shares (at most 255), got %d of %d", threshold, n)
+	}
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{Threshold: threshold, Index: i + 1, Value: make([]byte, len(secret)), KeyFingerprint: keyFingerprint}
+	}
+	coefficients := make([]byte, threshold)
+	for b, secretByte := range secret {
+		// A random polynomial of degree threshold-1 whose value at zero is the byte of the secret
+		coefficients[0] = secretByte
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i := range shares {
+			x := byte(shares[i].Index)
+			var y byte
+			for c := len(coefficients) - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coefficients[c]
+			}
+			shares[i].Value[b] = y
+		}
+	}
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+	return shares, nil
+}
+
+// Combine reconstructs the secret from the given shares. There must be at least as many shares as their threshold.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("no shares were given")
+	}
+	threshold := shares[0].Threshold
+	seen := make(map[int]bool)
+	for _, share := range shares {
+		if share.Threshold != threshold || share.KeyFingerprint != shares[0].KeyFingerprint || len(share.Value) != len(shares[0].Value) {
+			return nil, fmt.Errorf("the shares are not all for the same secret")
+		}
+		if share.Index < 1 || share.Index > 255 || seen[share.Index] {
+			return nil, fmt.Errorf("invalid or duplicate share index %d", share.Index)
+		}
+		seen[share.Index] = true
+	}
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("%d shares are needed but only %d were given", threshold, len(shares))
+	}
+	shares = shares[:threshold]
+	secret := make([]byte, len(shares[0].Value))
+	for i, share := range shares {
+		// The Lagrange basis polynomial for this share evaluated at zero. Subtraction is xor in GF(2^8).
+		basis := byte(1)
+		for j, other := range shares {
+			if i != j {
+				basis = gfMul(basis, gfMul(byte(other.Index), gfInverse(byte(other.Index)^byte(share.Index))))
+			}
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(share.Value[b], basis)
+		}
+	}
+	return secret, nil
+}
+
+// Multiply in GF(2^8) with the AES polynomial. The operands are secret so this runs in constant time: it always
+// does eight rounds and uses masks rather than branches or lookup tables.
+func gfMul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		// -(x & 1) is 0xff if the low bit of x is set and 0 otherwise
+		product ^= a & -(b & 1)
+		a = a<<1 ^ 0x1b&-(a>>7)
+		b >>= 1
+	}
+	return product
+}
+
+// Invert a non-zero element of GF(2^8) by raising it to the power of 254. Like gfMul this runs in constant time.
+func gfInverse(a byte) byte {
+	result := byte(1)
+	for i := 0; i < 254; i++ {
+		result = gfMul(result, a)
+	}
+	return result
+}
+
+// ReadShare reads a share written by WriteShare
+func ReadShare(filename string) (Share, error) {
+	var share Share
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return share, fmt.Errorf("failed to read the threshold share: %v", err)
+	}
+	err = json.Unmarshal(contents, &share)
+	if err != nil {
+		return share, fmt.Errorf("failed to parse the threshold share in %s: %v", filename, err)
+	}
+	if share.Index < 1 || share.Threshold < 2 || len(share.Value) != SecretSize {
+		return share, fmt.Errorf("%s is not a valid threshold share", filename)
+	}
+	return share, nil
+}
+
+// WriteShare writes the given share to filename so that only the current user can read it
+func WriteShare(filename string, share Share) error {
+	contents, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, contents, 0600)
+}
+
+// SealShare encrypts the given share to the given box public key (see ShareRequest.BoxKey)
+func SealShare(share Share, boxKey []byte) ([]byte, error) {
+	if len(boxKey) != 32 {
+		return nil, fmt.Errorf("invalid box key")
+	}
+	var recipient [32]byte
+	copy(recipient[:], boxKey)
+	contents, err := json.Marshal(share)
+	if err != nil {
+		return nil, err
+	}
+	return box.SealAnonymous(nil, contents, &recipient, rand.Reader)
+}
+
+// OpenShare decrypts a share sealed with SealShare
+func OpenShare(sealed []byte, publicKey, privateKey *[32]byte) (Share, error) {
+	var share Share
+	contents, ok := box.OpenAnonymous(nil, sealed, publicKey, privateKey)
+	if !ok {
+		return share, fmt.Errorf("failed to decrypt the share")
+	}
+	err := json.Unmarshal(contents, &share)
+	if err != nil {
+		return share, fmt.Errorf("failed to parse the share: %v", err)
+	}
+	return share, nil
+}
+
+// ParseShareRequest parses a message that starts with ShareRequestPreamble
+func ParseShareRequest(body string) (ShareRequest, error) {
+	var request ShareRequest
+	err := json.Unmarshal([]byte(strings.TrimPrefix(body, ShareRequestPreamble)), &request)
+	if err != nil {
+		return request, fmt.Errorf("failed to parse the share request: %v", err)
+	}
+	return request, nil
+}
+
+// ParseShareResponse parses a message that starts with ShareResponsePreamble
+func ParseShareResponse(body string) (ShareResponse, error) {
+	var response ShareResponse
+	err := json.Unmarshal([]byte(strings.TrimPrefix(body, ShareResponsePreamble)), &response)
+	if err != nil {
+		return response, fmt.Errorf("failed to parse the share response: %v", err)
+	}
+	return response, nil
+}
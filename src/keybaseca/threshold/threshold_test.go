@@ -0,0 +1,80 @@
+package threshold
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/nacl/box"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := make([]byte, SecretSize)
+	_, err := rand.Read(secret)
+	require.NoError(t, err)
+	shares, err := Split(secret, 5, 3, "SHA256:fingerprint")
+	require.NoError(t, err)
+	require.Len(t, shares, 5)
+
+	// Every combination of three shares reconstructs the secret
+	for i := 0; i < len(shares); i++ {
+		for j := i + 1; j < len(shares); j++ {
+			for k := j + 1; k < len(shares); k++ {
+				combined, err := Combine([]Share{shares[k], shares[i], shares[j]})
+				require.NoError(t, err)
+				require.Equal(t, secret, combined)
+			}
+		}
+	}
+
+	_, err = Combine(shares[:2])
+	require.Error(t, err)
+	_, err = Combine([]Share{shares[0], shares[0], shares[1]})
+	require.Error(t, err)
+	other, err := Split(secret, 5, 3, "SHA256:other")
+	require.NoError(t, err)
+	_, err = Combine([]Share{shares[0], shares[1], other[2]})
+	require.Error(t, err)
+
+	_, err = Split(secret, 3, 1, "SHA256:fingerprint")
+	require.Error(t, err)
+	_, err = Split(secret, 2, 3, "SHA256:fingerprint")
+	require.Error(t, err)
+}
+
+func TestGFMul(t *testing.T) {
+	// The examples from FIPS 197
+	require.Equal(t, byte(0xc1), gfMul(0x57, 0x83))
+	require.Equal(t, byte(0xfe), gfMul(0x57, 0x13))
+	require.Equal(t, byte(0xca), gfInverse(0x53))
+	for a := 0; a < 256; a++ {
+		require.Equal(t, byte(0), gfMul(byte(a), 0))
+		require.Equal(t, byte(a), gfMul(byte(a), 1))
+	}
+}
+
+func TestGFInverse(t *testing.T) {
+	for a := 1; a < 256; a++ {
+		require.Equal(t, byte(1), gfMul(byte(a), gfInverse(byte(a))))
+	}
+}
+
+func TestSealOpenShare(t *testing.T) {
+	shares, err := Split(make([]byte, SecretSize), 2, 2, "SHA256:fingerprint")
+	require.NoError(t, err)
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	sealed, err := SealShare(shares[1], publicKey[:])
+	require.NoError(t, err)
+	opened, err := OpenShare(sealed, publicKey, privateKey)
+	require.NoError(t, err)
+	require.Equal(t, shares[1], opened)
+
+	otherPublicKey, otherPrivateKey, err := box.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, err = OpenShare(sealed, otherPublicKey, otherPrivateKey)
+	require.Error(t, err)
+	_, err = SealShare(shares[1], []byte("short"))
+	require.Error(t, err)
+}
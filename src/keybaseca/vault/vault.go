@@ -0,0 +1,133 @@
+package vault
+
+/*
+vault is a minimal client for the SSH secrets engine of HashiCorp Vault (https://www.vaultproject.io/api/secret/ssh).
+It is used by keybaseca to sign certificates with a CA key held by Vault (see VAULT_SSH_ROLE) and by
+`keybaseca import-key` to check that a CA key being migrated out of Vault is the one that servers already trust.
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client is a Vault API client
+type Client struct {
+	// The address of the Vault server, eg https://vault.example.com:8200 (like VAULT_ADDR)
+	Address string
+	// The token to authenticate with (like VAULT_TOKEN)
+	Token string
+	// The Vault Enterprise namespace to use. May be empty. (like VAULT_NAMESPACE)
+	Namespace  string
+	HTTPClient *http.Client
+}
+
+type apiResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []string        `json:"errors"`
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return &http.Client{Timeout: 30 * time.Second}
+}
+
+// GetSSHCAPublicKey returns the CA public key (in authorized_keys format) of the SSH secrets engine mounted at mount
+// (eg ssh-client-signer). Vault never returns the private key.
+func (c *Client) GetSSHCAPublicKey(mount string) (string, error) {
+	var result struct {
+		PublicKey string `json:"public_key"`
+	}
+	err := c.call("GET", strings.Trim(mount, "/")+"/config/ca", nil, &result)
+	if err != nil {
+		return "", err
+	}
+	if result.PublicKey == "" {
+		return "", fmt.Errorf("the SSH secrets engine at %s does not have a CA key", mount)
+	}
+	return result.PublicKey, nil
+}
+
+// SSHSignRequest is a request to sign an SSH public key with a role of the SSH secrets engine. The role must allow
+// everything that is requested (eg the extensions via allowed_extensions).
+type SSHSignRequest struct {
+	// In authorized_keys format
+	PublicKey string `json:"public_key"`
+	// Either user or host
+	CertType string `json:"cert_type"`
+	// Comma separated
+	ValidPrincipals string            `json:"valid_principals"`
+	KeyID           string            `json:"key_id,omitempty"`
+	TTL             string            `json:"ttl,omitempty"`
+	CriticalOptions map[string]string `json:"critical_options,omitempty"`
+	Extensions      map[string]string `json:"extensions,omitempty"`
+}
+
+// SignSSHKey signs a public key with the given role of the SSH secrets engine mounted at mount. Returns the
+// certificate in authorized_keys format.
+func (c *Client) SignSSHKey(mount, role string, request SSHSignRequest) (string, error) {
+	var result struct {
+		SignedKey string `json:"signed_key"`
+	}
+	err := c.call("POST", strings.Trim(mount, "/")+"/sign/"+role, request, &result)
+	if err != nil {
+		return "", err
+	}
+	if result.SignedKey == "" {
+		return "", fmt.Errorf("Vault did not return a signed key")
+	}
+	return result.SignedKey, nil
+}
+
+// Make a request to the Vault API at the given path (relative to /v1/) and parse the data of the response into result
+func (c *Client) call(method, path string, params interface{}, result interface{}) error {
+	if c.Address == "" {
+		return fmt.Errorf("the address of the Vault server is not set")
+	}
+	var body []byte
+	if params != nil {
+		var err error
+		body, err = json.Marshal(params)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(c.Address, "/")+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", c.Token)
+	req.Header.Set("X-Vault-Request", "true")
+	if c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Namespace)
+	}
+	if params != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("Vault request to %s failed: %v", path, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Vault request to %s failed: %v", path, err)
+	}
+	var parsed apiResponse
+	err = json.Unmarshal(respBody, &parsed)
+	if err != nil {
+		return fmt.Errorf("failed to parse the Vault response (HTTP %d): %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || len(parsed.Errors) > 0 {
+		return fmt.Errorf("Vault request to %s failed: HTTP %d %s", path, resp.StatusCode, strings.Join(parsed.Errors, ", "))
+	}
+	return json.Unmarshal(parsed.Data, result)
+}
@@ -0,0 +1,82 @@
+package vault
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSSHCAPublicKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors": ["permission denied"]}`)
+			return
+		}
+		require.Equal(t, "team-a", r.Header.Get("X-Vault-Namespace"))
+		switch r.URL.Path {
+		case "/v1/ssh-client-signer/config/ca":
+			fmt.Fprint(w, `{"data": {"public_key": "ssh-rsa AAAA"}}`)
+		case "/v1/ssh-empty/config/ca":
+			fmt.Fprint(w, `{"data": {}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors": []}`)
+		}
+	}))
+	defer server.Close()
+
+	client := Client{Address: server.URL + "/", Token: "token", Namespace: "team-a"}
+	publicKey, err := client.GetSSHCAPublicKey("/ssh-client-signer/")
+	require.NoError(t, err)
+	require.Equal(t, "ssh-rsa AAAA", publicKey)
+
+	_, err = client.GetSSHCAPublicKey("ssh-empty")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "does not have a CA key")
+
+	_, err = client.GetSSHCAPublicKey("ssh-missing")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "HTTP 404")
+
+	client.Token = "wrong"
+	_, err = client.GetSSHCAPublicKey("ssh-client-signer")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "permission denied")
+
+	_, err = (&Client{}).GetSSHCAPublicKey("ssh-client-signer")
+	require.Error(t, err)
+}
+
+func TestSignSSHKey(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "POST", r.Method)
+		require.Equal(t, "token", r.Header.Get("X-Vault-Token"))
+		if r.URL.Path != "/v1/ssh-client-signer/sign/keybaseca" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"errors": ["unknown role"]}`)
+			return
+		}
+		var request SSHSignRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		require.Equal(t, SSHSignRequest{PublicKey: "ssh-ed25519 AAAA", CertType: "user", ValidPrincipals: "team.ssh.prod",
+			KeyID: "key-id", TTL: "3600s", Extensions: map[string]string{"permit-pty": ""}}, request)
+		fmt.Fprint(w, `{"data": {"serial_number": "1", "signed_key": "ssh-ed25519-cert-v01@openssh.com AAAA"}}`)
+	}))
+	defer server.Close()
+
+	client := Client{Address: server.URL, Token: "token"}
+	request := SSHSignRequest{PublicKey: "ssh-ed25519 AAAA", CertType: "user", ValidPrincipals: "team.ssh.prod",
+		KeyID: "key-id", TTL: "3600s", Extensions: map[string]string{"permit-pty": ""}}
+	signedKey, err := client.SignSSHKey("ssh-client-signer", "keybaseca", request)
+	require.NoError(t, err)
+	require.Equal(t, "ssh-ed25519-cert-v01@openssh.com AAAA", signedKey)
+
+	_, err = client.SignSSHKey("ssh-client-signer", "other", request)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown role")
+}
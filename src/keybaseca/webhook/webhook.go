@@ -0,0 +1,153 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/keybase/bot-sshca/src/keybaseca/log"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The header containing the hex encoded HMAC-SHA256 of the request body if WEBHOOK_SECRET is set
+const SignatureHeader = "X-Keybaseca-Signature"
+
+// The URL of the PagerDuty Events API v2
+var pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// Summary returns a single line human readable description of the event
+func Summary(e events.Event) string {
+	switch e.Type {
+	case events.CertIssued:
+		return fmt.Sprintf("keybaseca issued a certificate to %s for sensitive principals %s (keyID:%s)",
+			e.Username, strings.Join(e.Principals, ","), e.KeyID)
+	case events.RequestDenied:
+		return fmt.Sprintf("keybaseca denied a signature request from %s: %s", e.Username, e.Message)
+	case events.CAKeyRotated:
+		return fmt.Sprintf("keybaseca generated a new CA key: %s", e.Message)
+	case events.OfflineCertIssued:
+		return fmt.Sprintf("keybaseca signed a certificate offline for %s with principals %s (keyID:%s)",
+			e.Username, strings.Join(e.Principals, ","), e.KeyID)
+	case events.LockdownChanged:
+		return fmt.Sprintf("keybaseca lockdown changed: %s", e.Message)
+	case events.CanaryTriggered:
+		return fmt.Sprintf("keybaseca canary certificate used (keyID:%s): %s", e.KeyID, e.Message)
+	default:
+		return fmt.Sprintf("keybaseca encountered an error: %s", e.Message)
+	}
+}
+
+// The PagerDuty severity for the given event
+func severity(e events.Event) string {
+	switch e.Type {
+	case events.CanaryTriggered:
+		return "critical"
+	case events.BotError:
+		return "error"
+	case events.CertIssued:
+		return "info"
+	default:
+		return "warning"
+	}
+}
+
+// Returns whether any of the given principals match one of the sensitive teams
+func IsSensitive(conf config.Config, principals []string) bool {
+	return len(shared.MatchTeams(conf.GetSensitiveTeams(), principals)) > 0
+}
+
+// HandleEvent is an events.Handler that sends the events that webhooks are fired for to every configured webhook.
+// Certificates are only reported if they include a principal from SENSITIVE_TEAMS.
+func HandleEvent(conf config.Config, event events.Event) {
+	switch event.Type {
+	case events.CertIssued:
+		if !IsSensitive(conf, event.Principals) {
+			return
+		}
+	case events.RequestDenied, events.CAKeyRotated, events.BotError, events.LockdownChanged, events.OfflineCertIssued,
+		events.CanaryTriggered:
+	default:
+		return
+	}
+	Notify(conf, event)
+}
+
+// Notify sends the given event to every configured webhook. Failures are recorded in the audit log rather than
+// returned since webhooks are best effort.
+func Notify(conf config.Config, event events.Event) {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	for _, webhook := range conf.GetWebhooks() {
+		err := send(conf, webhook, event)
+		if err != nil {
+			log.Log(conf, fmt.Sprintf("Failed to send %s event to %s webhook: %v", event.Type, webhook.Type, err))
+		}
+	}
+}
+
+// Build the URL and body to send for the given webhook and event
+func buildRequest(webhook config.Webhook, event events.Event) (string, []byte, error) {
+	switch webhook.Type {
+	case config.WebhookTypeSlack:
+		body, err := json.Marshal(map[string]string{"text": Summary(event)})
+		return webhook.Target, body, err
+	case config.WebhookTypePagerDuty:
+		body, err := json.Marshal(map[string]interface{}{
+			"routing_key":  webhook.Target,
+			"event_action": "trigger",
+			"payload": map[string]interface{}{
+				"summary":        Summary(event),
+				"source":         "keybaseca",
+				"severity":       severity(event),
+				"timestamp":      event.Timestamp.Format(time.RFC3339),
+				"custom_details": event,
+			},
+		})
+		return pagerDutyURL, body, err
+	default:
+		body, err := json.Marshal(event)
+		return webhook.Target, body, err
+	}
+}
+
+// Sign the given body with the given secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func send(conf config.Config, webhook config.Webhook, event events.Event) error {
+	url, body, err := buildRequest(webhook, event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if conf.GetWebhookSecret() != "" {
+		req.Header.Set(SignatureHeader, Sign(conf.GetWebhookSecret(), body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
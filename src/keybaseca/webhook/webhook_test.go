@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/config"
+	"github.com/keybase/bot-sshca/src/keybaseca/events"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	// echo -n '{"type":"bot_error"}' | openssl dgst -sha256 -hmac secret
+	require.Equal(t, "sha256=52840c9bef2be60d3194da2b8501a89b8b486d9752cadbf7bc6c9cf5187b5926", Sign("secret", []byte(`{"type":"bot_error"}`)))
+	require.NotEqual(t, Sign("secret", []byte("body")), Sign("other-secret", []byte("body")))
+}
+
+func TestNotifyGeneric(t *testing.T) {
+	received := make(chan events.Event, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.Equal(t, Sign("secret", body), r.Header.Get(SignatureHeader))
+		var event events.Event
+		require.NoError(t, json.Unmarshal(body, &event))
+		received <- event
+	}))
+	defer server.Close()
+	client = server.Client()
+
+	os.Setenv("WEBHOOKS", "generic="+server.URL)
+	os.Setenv("WEBHOOK_SECRET", "secret")
+	defer os.Unsetenv("WEBHOOKS")
+	defer os.Unsetenv("WEBHOOK_SECRET")
+
+	Notify(&config.EnvConfig{}, events.Event{Type: events.RequestDenied, Username: "alice", Message: "not in team"})
+	event := <-received
+	require.Equal(t, events.RequestDenied, event.Type)
+	require.Equal(t, "alice", event.Username)
+	require.False(t, event.Timestamp.IsZero())
+}
+
+func TestBuildRequestPagerDuty(t *testing.T) {
+	url, body, err := buildRequest(config.Webhook{Type: config.WebhookTypePagerDuty, Target: "routing-key"}, events.Event{Type: events.BotError, Message: "boom"})
+	require.NoError(t, err)
+	require.Equal(t, pagerDutyURL, url)
+	var parsed map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &parsed))
+	require.Equal(t, "routing-key", parsed["routing_key"])
+	require.Equal(t, "trigger", parsed["event_action"])
+	require.Equal(t, "error", parsed["payload"].(map[string]interface{})["severity"])
+}
+
+func TestHandleEventSensitive(t *testing.T) {
+	received := make(chan events.Event, 2)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event events.Event
+		body, _ := ioutil.ReadAll(r.Body)
+		_ = json.Unmarshal(body, &event)
+		received <- event
+	}))
+	defer server.Close()
+	client = server.Client()
+
+	os.Setenv("WEBHOOKS", "generic="+server.URL)
+	os.Setenv("SENSITIVE_TEAMS", "team.ssh.prod")
+	defer os.Unsetenv("WEBHOOKS")
+	defer os.Unsetenv("SENSITIVE_TEAMS")
+	conf := &config.EnvConfig{}
+
+	// Only certificates for sensitive teams and the events that webhooks are fired for are sent
+	HandleEvent(conf, events.Event{Type: events.CertIssued, Username: "alice", Principals: []string{"team.ssh.staging"}})
+	HandleEvent(conf, events.Event{Type: events.ConfigLoaded})
+	HandleEvent(conf, events.Event{Type: events.CertIssued, Username: "bob", Principals: []string{"team.ssh.prod"}})
+	require.Len(t, received, 1)
+	require.Equal(t, "bob", (<-received).Username)
+}
@@ -0,0 +1,105 @@
+package kssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The environment variable used to select the Keybase account that kssh acts as (see SelectKeybaseAccount). It is
+// also set by SelectKeybaseAccount so that any kssh processes spawned by this one use the same account.
+const KeybaseUserEnvVar = "KSSH_KEYBASE_USER"
+
+var (
+	// The Keybase account that kssh was asked to act as. Empty if kssh acts as whichever account is logged in.
+	selectedKeybaseUser string
+	// The Keybase home directory (`keybase --home`) of the selected account. Empty for the default home directory.
+	keybaseHomeDir string
+)
+
+// SelectKeybaseAccount makes kssh act as the given Keybase user for people with several Keybase accounts (eg work
+// and personal) on one machine. If a home directory was registered for the user (see SetKeybaseAccount), every keybase
+// command kssh runs uses that home directory and so talks to the Keybase service that is logged in as that user.
+// Otherwise the default Keybase service is used and kssh refuses to run if it is logged in as anyone else. If username
+// is empty, the account from $KSSH_KEYBASE_USER or the local config file (see SetKeybaseAccount) is used, if any. Must
+// be called after SetProfile and before anything talks to Keybase.
+func SelectKeybaseAccount(username string) error {
+	lcf, err := getCurrentConfigFile()
+	if err != nil {
+		return err
+	}
+	if username == "" {
+		username = os.Getenv(KeybaseUserEnvVar)
+	}
+	if username == "" {
+		username = lcf.KeybaseUser
+	}
+	if username == "" {
+		return nil
+	}
+	if !shared.IsValidKeybaseUsername(username) {
+		return fmt.Errorf("invalid Keybase username %q", username)
+	}
+	selectedKeybaseUser = strings.ToLower(username)
+	keybaseHomeDir = lcf.KeybaseHomes[selectedKeybaseUser]
+	return os.Setenv(KeybaseUserEnvVar, selectedKeybaseUser)
+}
+
+// SetKeybaseAccount sets the Keybase account that kssh acts as by default (see SelectKeybaseAccount). If homeDir is
+// not empty, it is registered as the home directory of the Keybase service that is logged in as username (eg one
+// started via `keybase --home ~/.keybase-work service`). An empty username clears the default account.
+func SetKeybaseAccount(username, homeDir string) error {
+	username = strings.ToLower(username)
+	if username != "" && !shared.IsValidKeybaseUsername(username) {
+		return fmt.Errorf("invalid Keybase username %q", username)
+	}
+	if homeDir != "" {
+		homeDir = shared.ExpandPathWithTilde(homeDir)
+		if !filepath.IsAbs(homeDir) {
+			return fmt.Errorf("the Keybase home directory must be an absolute path, %q is not", homeDir)
+		}
+		if info, err := os.Stat(homeDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("the Keybase home directory %s does not exist", homeDir)
+		}
+	}
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.KeybaseUser = username
+		if homeDir != "" {
+			if lcf.KeybaseHomes == nil {
+				lcf.KeybaseHomes = make(map[string]string)
+			}
+			lcf.KeybaseHomes[username] = homeDir
+		}
+		return nil
+	})
+}
+
+// Check that the Keybase user that the keybase binary is logged in as is the selected account, if any
+func checkKeybaseAccount(username string) error {
+	if selectedKeybaseUser == "" || strings.EqualFold(username, selectedKeybaseUser) {
+		return nil
+	}
+	if keybaseHomeDir != "" {
+		return fmt.Errorf("the Keybase service in %s is logged in as %s rather than %s", keybaseHomeDir, username, selectedKeybaseUser)
+	}
+	return fmt.Errorf("Keybase is logged in as %s rather than %s. Log in as %s or run a Keybase service for %s in "+
+		"a separate home directory and register it via `kssh --set-keybase-user %s=DIR`", username, selectedKeybaseUser,
+		selectedKeybaseUser, selectedKeybaseUser, selectedKeybaseUser)
+}
+
+// Returns the given keybase arguments preceded by the global options that select the Keybase account
+func keybaseArgs(args ...string) []string {
+	if keybaseHomeDir == "" {
+		return args
+	}
+	return append([]string{"--home", keybaseHomeDir}, args...)
+}
+
+// Returns a command that runs the keybase binary with the given arguments as the selected Keybase account
+func keybaseCommand(args ...string) (*exec.Cmd, error) {
+	return shared.Command(GetKeybaseBinaryPath(), keybaseArgs(args...)...)
+}
@@ -0,0 +1,64 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectKeybaseAccount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-account-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig := localConfigFileLocation
+	defer func() {
+		localConfigFileLocation = oldConfig
+		selectedKeybaseUser, keybaseHomeDir = "", ""
+		os.Unsetenv(KeybaseUserEnvVar)
+	}()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+	os.Unsetenv(KeybaseUserEnvVar)
+
+	// Nothing selected
+	require.NoError(t, SelectKeybaseAccount(""))
+	require.Equal(t, []string{"whoami"}, keybaseArgs("whoami"))
+	require.NoError(t, checkKeybaseAccount("anyone"))
+
+	workHome := filepath.Join(dir, "keybase-work")
+	require.NoError(t, os.Mkdir(workHome, 0700))
+	require.Error(t, SetKeybaseAccount("alice", filepath.Join(dir, "missing")))
+	require.Error(t, SetKeybaseAccount("alice", "relative/home"))
+	require.Error(t, SetKeybaseAccount("not a user", ""))
+	require.NoError(t, SetKeybaseAccount("alice_work", workHome))
+	require.NoError(t, SetKeybaseAccount("Alice", ""))
+
+	// The default account from the local config file
+	require.NoError(t, SelectKeybaseAccount(""))
+	require.Equal(t, "alice", selectedKeybaseUser)
+	require.Equal(t, "alice", os.Getenv(KeybaseUserEnvVar))
+	require.Equal(t, []string{"whoami"}, keybaseArgs("whoami"))
+	require.NoError(t, checkKeybaseAccount("Alice"))
+	err = checkKeybaseAccount("alice_work")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "--set-keybase-user alice=DIR")
+
+	// The environment (eg set by a parent kssh process) overrides the local config file and the flag overrides both
+	os.Setenv(KeybaseUserEnvVar, "alice_work")
+	require.NoError(t, SelectKeybaseAccount(""))
+	require.Equal(t, "alice_work", selectedKeybaseUser)
+	require.Equal(t, []string{"--home", workHome, "team", "api"}, keybaseArgs("team", "api"))
+	require.Error(t, checkKeybaseAccount("alice"))
+	require.NoError(t, SelectKeybaseAccount("alice"))
+	require.Equal(t, []string{"team", "api"}, keybaseArgs("team", "api"))
+	require.Error(t, SelectKeybaseAccount("-alice"))
+
+	// Clearing the default account keeps the registered home directories
+	require.NoError(t, SetKeybaseAccount("", ""))
+	lcf, err := getCurrentConfigFile()
+	require.NoError(t, err)
+	require.Empty(t, lcf.KeybaseUser)
+	require.Equal(t, map[string]string{"alice_work": workHome}, lcf.KeybaseHomes)
+}
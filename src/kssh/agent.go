@@ -0,0 +1,146 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// GetDedicatedAgentSocket returns the path of the dedicated ssh-agent socket for the given signed key
+func GetDedicatedAgentSocket(keyPath string) string {
+	return keyPath + ".agent.sock"
+}
+
+// Returns the path of the file that records the PID of the dedicated ssh-agent for the given signed key
+func getDedicatedAgentPIDFile(keyPath string) string {
+	return keyPath + ".agent.pid"
+}
+
+// Matches the PID in the shell commands printed by ssh-agent
+var agentPIDRegex = regexp.MustCompile(`SSH_AGENT_PID=(\d+)`)
+
+// GetDedicatedAgentPID returns the PID of the dedicated ssh-agent for the given signed key as recorded by
+// StartDedicatedAgent so that it can be stopped via `ssh-agent -k`, which also removes its socket
+func GetDedicatedAgentPID(keyPath string) (int, error) {
+	contents, err := ioutil.ReadFile(getDedicatedAgentPIDFile(keyPath))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(contents)))
+}
+
+// ReadCertificate reads and parses the SSH certificate associated with the key at keyPath
+func ReadCertificate(keyPath string) (*ssh.Certificate, error) {
+	certBytes, err := ioutil.ReadFile(shared.KeyPathToCert(keyPath))
+	if err != nil {
+		return nil, err
+	}
+	k, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := k.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an SSH certificate", shared.KeyPathToCert(keyPath))
+	}
+	return cert, nil
+}
+
+// StartDedicatedAgent makes sure that an ssh-agent is listening on the dedicated socket for the given key and that
+// it holds only that key. The key is loaded with a lifetime matching the remaining validity of the certificate so
+// that the agent does not keep serving it once it has expired. This keeps the short lived certificate separated
+// from the keys in the user's personal agent so that it can be handed to tools like Ansible or Terraform. Returns the
+// path of the socket.
+func StartDedicatedAgent(keyPath string) (string, error) {
+	socket := GetDedicatedAgentSocket(keyPath)
+	if !isAgentRunning(socket) {
+		// Clean up a socket left behind by an agent that is no longer running
+		err := os.Remove(socket)
+		if err != nil && !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to remove stale agent socket %s: %v", socket, err)
+		}
+		log.WithField("socket", socket).Debug("Starting a dedicated ssh-agent")
+		output, err := exec.Command("ssh-agent", "-a", socket).CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("failed to start ssh-agent: %s (%v)", strings.TrimSpace(string(output)), err)
+		}
+		pidFile := getDedicatedAgentPIDFile(keyPath)
+		if match := agentPIDRegex.FindSubmatch(output); match != nil {
+			err = ioutil.WriteFile(pidFile, append(match[1], '\n'), 0600)
+			if err != nil {
+				return "", fmt.Errorf("failed to record the PID of the dedicated ssh-agent: %v", err)
+			}
+		} else {
+			os.Remove(pidFile)
+		}
+	}
+
+	// Remove any previous (and likely expired) certificates before loading the current one
+	output, err := agentCommand(socket, "ssh-add", "-D").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to clear the dedicated ssh-agent: %s (%v)", strings.TrimSpace(string(output)), err)
+	}
+	err = addKeyUntilExpiry(socket, keyPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to add SSH key to the dedicated ssh-agent: %v", err)
+	}
+	return socket, nil
+}
+
+// AddKeyToSSHAgentUntilExpiry adds the key at keyPath to the currently running ssh-agent with a lifetime matching the
+// remaining validity of its certificate so that the agent does not accumulate expired certificates
+func AddKeyToSSHAgentUntilExpiry(keyPath string) error {
+	err := addKeyUntilExpiry(os.Getenv("SSH_AUTH_SOCK"), keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to add SSH key to the ssh-agent (is it running?): %v", err)
+	}
+	return nil
+}
+
+// Add the key at keyPath to the ssh-agent listening on socket with a lifetime matching the remaining validity of its
+// certificate
+func addKeyUntilExpiry(socket, keyPath string) error {
+	cert, err := ReadCertificate(keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read the signed certificate: %v", err)
+	}
+	lifetime := time.Until(time.Unix(int64(cert.ValidBefore), 0))
+	if lifetime <= 0 {
+		return fmt.Errorf("the signed certificate has already expired")
+	}
+	seconds := int64(lifetime / time.Second)
+	output, err := agentCommand(socket, "ssh-add", "-t", fmt.Sprintf("%d", seconds), keyPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// Returns whether an ssh-agent is accepting connections on the given socket. `ssh-add -l` exits with 1 if the agent
+// has no keys and 2 if it cannot connect to the agent.
+func isAgentRunning(socket string) bool {
+	if _, err := os.Stat(socket); err != nil {
+		return false
+	}
+	err := agentCommand(socket, "ssh-add", "-l").Run()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return exitErr.ExitCode() == 1
+	}
+	return err == nil
+}
+
+// Returns a command that talks to the ssh-agent on the given socket rather than the user's agent
+func agentCommand(socket string, name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), "SSH_AUTH_SOCK="+socket)
+	return cmd
+}
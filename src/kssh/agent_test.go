@@ -0,0 +1,91 @@
+package kssh
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestStartDedicatedAgent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a unix socket")
+	}
+	dir, err := ioutil.TempDir("", "kssh-agent")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	caPath := filepath.Join(dir, "ca")
+	keyPath := filepath.Join(dir, "keybase-signed-key--cabot")
+	for _, path := range []string{caPath, keyPath} {
+		output, err := exec.Command("ssh-keygen", "-t", "ed25519", "-N", "", "-q", "-f", path).CombinedOutput()
+		require.NoError(t, err, string(output))
+	}
+	output, err := exec.Command("ssh-keygen", "-s", caPath, "-I", "kssh-test", "-n", "team.ssh", "-V", "+1h", keyPath+".pub").CombinedOutput()
+	require.NoError(t, err, string(output))
+	cert, err := ReadCertificate(keyPath)
+	require.NoError(t, err)
+
+	socket, err := StartDedicatedAgent(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, GetDedicatedAgentSocket(keyPath), socket)
+	pid, err := GetDedicatedAgentPID(keyPath)
+	require.NoError(t, err)
+	stopAgent := func() ([]byte, error) {
+		cmd := agentCommand(socket, "ssh-agent", "-k")
+		cmd.Env = append(cmd.Env, "SSH_AGENT_PID="+strconv.Itoa(pid))
+		return cmd.CombinedOutput()
+	}
+	stopped := false
+	defer func() {
+		if !stopped {
+			_, _ = stopAgent()
+		}
+	}()
+
+	// The agent only holds the signed key (ssh-add adds both the key and its certificate)
+	listKeys := func() []*agent.Key {
+		conn, err := net.Dial("unix", socket)
+		require.NoError(t, err)
+		defer conn.Close()
+		keys, err := agent.NewClient(conn).List()
+		require.NoError(t, err)
+		return keys
+	}
+	keys := listKeys()
+	require.Len(t, keys, 2)
+	foundCert := false
+	for _, key := range keys {
+		foundCert = foundCert || bytes.Equal(cert.Marshal(), key.Marshal())
+		require.True(t, bytes.Equal(cert.Marshal(), key.Marshal()) || bytes.Equal(cert.Key.Marshal(), key.Marshal()))
+	}
+	require.True(t, foundCert)
+
+	// Starting it again reuses the same agent
+	_, err = StartDedicatedAgent(keyPath)
+	require.NoError(t, err)
+	samePID, err := GetDedicatedAgentPID(keyPath)
+	require.NoError(t, err)
+	require.Equal(t, pid, samePID)
+	require.Len(t, listKeys(), 2)
+
+	// Stopping the agent like `eval $(ssh-agent -k)` removes its socket
+	output, err = stopAgent()
+	require.NoError(t, err, string(output))
+	stopped = true
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(socket); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	require.True(t, os.IsNotExist(err), "the socket was not removed")
+}
@@ -0,0 +1,70 @@
+package kssh
+
+import (
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// AnsibleVars are the Ansible host variables needed to connect to a host with a kssh provisioned certificate. See
+// https://docs.ansible.com/ansible/latest/collections/ansible/builtin/ssh_connection.html
+type AnsibleVars struct {
+	Host            string `json:"ansible_host"`
+	User            string `json:"ansible_user,omitempty"`
+	PrivateKeyFile  string `json:"ansible_ssh_private_key_file"`
+	SSHCommonArgs   string `json:"ansible_ssh_common_args"`
+	CertificateFile string `json:"kssh_certificate_file"`
+	ValidBefore     string `json:"kssh_valid_before"`
+}
+
+// GetAnsibleVars returns the AnsibleVars for connecting to destination (of the form [user@]host) with the key at
+// keyPath. conf is the cached client config for the key and may be nil. defaultUser is used if destination does not
+// include a user, followed by the default user the CA configured for the host (see DefaultUser).
+func GetAnsibleVars(keyPath, destination string, conf *Config, defaultUser string) (AnsibleVars, error) {
+	cert, err := ReadCertificate(keyPath)
+	if err != nil {
+		return AnsibleVars{}, err
+	}
+	user, host := splitDestination(destination)
+	if user == "" {
+		user = defaultUser
+	}
+	if user == "" && conf != nil {
+		user = conf.GetDefaultUser(host)
+	}
+
+	args := []string{"-o", "CertificateFile=" + shared.KeyPathToCert(keyPath), "-o", "IdentitiesOnly=yes"}
+	tunnelArgs, err := GetCloudTunnelArgs(conf, []string{host})
+	if err != nil {
+		return AnsibleVars{}, err
+	}
+	args = append(args, tunnelArgs...)
+
+	return AnsibleVars{
+		Host:            host,
+		User:            user,
+		PrivateKeyFile:  keyPath,
+		SSHCommonArgs:   shellJoin(args),
+		CertificateFile: shared.KeyPathToCert(keyPath),
+		ValidBefore:     time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// Join the given arguments into a single string that a POSIX shell (or python's shlex) splits back into the same
+// arguments
+func shellJoin(args []string) string {
+	var quoted []string
+	for _, arg := range args {
+		if arg != "" && strings.IndexFunc(arg, isShellSpecial) < 0 {
+			quoted = append(quoted, arg)
+			continue
+		}
+		quoted = append(quoted, "'"+strings.Replace(arg, "'", `'"'"'`, -1)+"'")
+	}
+	return strings.Join(quoted, " ")
+}
+
+func isShellSpecial(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_=+./:@,%", r))
+}
@@ -0,0 +1,41 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellJoin(t *testing.T) {
+	require.Equal(t, "-o IdentitiesOnly=yes", shellJoin([]string{"-o", "IdentitiesOnly=yes"}))
+	require.Equal(t, "-o 'ProxyCommand=aws ssm start-session --target %h'",
+		shellJoin([]string{"-o", "ProxyCommand=aws ssm start-session --target %h"}))
+	require.Equal(t, `'it'"'"'s' ''`, shellJoin([]string{"it's", ""}))
+}
+
+func TestGetAnsibleVars(t *testing.T) {
+	keyPath := "../../tests/testFiles/valid"
+	conf := &Config{CloudTunnels: []CloudTunnel{{HostPattern: "i-*", Provider: CloudProviderAWSSSM}}}
+
+	vars, err := GetAnsibleVars(keyPath, "root@server", conf, "ubuntu")
+	require.NoError(t, err)
+	require.Equal(t, "server", vars.Host)
+	require.Equal(t, "root", vars.User)
+	require.Equal(t, keyPath, vars.PrivateKeyFile)
+	require.Equal(t, keyPath+"-cert.pub", vars.CertificateFile)
+	require.Equal(t, "-o CertificateFile="+keyPath+"-cert.pub -o IdentitiesOnly=yes", vars.SSHCommonArgs)
+	require.NotEmpty(t, vars.ValidBefore)
+
+	vars, err = GetAnsibleVars(keyPath, "i-0abc", conf, "ubuntu")
+	require.NoError(t, err)
+	require.Equal(t, "ubuntu", vars.User)
+	require.Contains(t, vars.SSHCommonArgs, "-o 'ProxyCommand=aws ssm start-session")
+
+	conf.DefaultUsers = []DefaultUser{{HostPattern: "i-*", User: "ec2-user"}}
+	vars, err = GetAnsibleVars(keyPath, "i-0abc", conf, "")
+	require.NoError(t, err)
+	require.Equal(t, "ec2-user", vars.User)
+
+	_, err = GetAnsibleVars("../../tests/testFiles/does-not-exist", "server", nil, "")
+	require.Error(t, err)
+}
@@ -0,0 +1,104 @@
+package kssh
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// BenchmarkStep is a single timed phase of `kssh --benchmark` (eg the chat round trip to the CA bot)
+type BenchmarkStep struct {
+	Name string
+	Run  func() error
+}
+
+// BenchmarkPhase contains the timings of a single BenchmarkStep across every iteration of a benchmark
+type BenchmarkPhase struct {
+	Name string
+	// The durations of every successful run of the step
+	Durations []time.Duration
+	Failures  int
+	// The number of iterations in which the step was not run since an earlier step failed
+	Skipped int
+	// The error returned by the first failed run, if any
+	FirstError error
+}
+
+// RunBenchmark runs the given steps in order the given number of times and records how long each step took. Steps
+// generally depend on the results of the steps before them so if a step fails, the remaining steps of that iteration
+// are skipped.
+func RunBenchmark(iterations int, steps []BenchmarkStep) []BenchmarkPhase {
+	phases := make([]BenchmarkPhase, len(steps))
+	for i, step := range steps {
+		phases[i].Name = step.Name
+	}
+	for iteration := 0; iteration < iterations; iteration++ {
+		failed := false
+		for i, step := range steps {
+			if failed {
+				phases[i].Skipped++
+				continue
+			}
+			start := time.Now()
+			err := step.Run()
+			duration := time.Since(start)
+			if err != nil {
+				failed = true
+				phases[i].Failures++
+				if phases[i].FirstError == nil {
+					phases[i].FirstError = err
+				}
+				continue
+			}
+			phases[i].Durations = append(phases[i].Durations, duration)
+		}
+	}
+	return phases
+}
+
+// FormatBenchmark formats the results of RunBenchmark as a table with a row per phase followed by any errors
+func FormatBenchmark(phases []BenchmarkPhase) string {
+	var buf bytes.Buffer
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tOK\tFAILED\tSKIPPED\tMIN\tMEDIAN\tMEAN\tMAX")
+	for _, phase := range phases {
+		min, median, mean, max := summarizeDurations(phase.Durations)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\t%s\t%s\n", phase.Name, len(phase.Durations), phase.Failures,
+			phase.Skipped, formatBenchmarkDuration(min), formatBenchmarkDuration(median),
+			formatBenchmarkDuration(mean), formatBenchmarkDuration(max))
+	}
+	_ = w.Flush()
+	for _, phase := range phases {
+		if phase.FirstError != nil {
+			fmt.Fprintf(&buf, "\n%s failed: %v", phase.Name, phase.FirstError)
+		}
+	}
+	return buf.String()
+}
+
+// Returns the min, median, mean, and max of the given durations. All are zero if durations is empty.
+func summarizeDurations(durations []time.Duration) (min, median, mean, max time.Duration) {
+	if len(durations) == 0 {
+		return
+	}
+	sorted := append([]time.Duration{}, durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	median = sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	}
+	return sorted[0], median, total / time.Duration(len(sorted)), sorted[len(sorted)-1]
+}
+
+func formatBenchmarkDuration(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return d.Round(time.Millisecond).String()
+}
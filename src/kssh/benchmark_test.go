@@ -0,0 +1,48 @@
+package kssh
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunBenchmark(t *testing.T) {
+	calls := 0
+	phases := RunBenchmark(3, []BenchmarkStep{
+		{Name: "first", Run: func() error {
+			calls++
+			if calls == 2 {
+				return fmt.Errorf("failure")
+			}
+			return nil
+		}},
+		{Name: "second", Run: func() error { return nil }},
+	})
+	require.Len(t, phases, 2)
+	require.Equal(t, "first", phases[0].Name)
+	require.Len(t, phases[0].Durations, 2)
+	require.Equal(t, 1, phases[0].Failures)
+	require.EqualError(t, phases[0].FirstError, "failure")
+	// The second step is skipped when the first fails
+	require.Len(t, phases[1].Durations, 2)
+	require.Equal(t, 1, phases[1].Skipped)
+	require.NoError(t, phases[1].FirstError)
+
+	output := FormatBenchmark(phases)
+	require.Contains(t, output, "PHASE")
+	require.Contains(t, output, "first failed: failure")
+}
+
+func TestSummarizeDurations(t *testing.T) {
+	min, median, mean, max := summarizeDurations([]time.Duration{4 * time.Second, time.Second, 3 * time.Second, 2 * time.Second})
+	require.Equal(t, time.Second, min)
+	require.Equal(t, 2500*time.Millisecond, median)
+	require.Equal(t, 2500*time.Millisecond, mean)
+	require.Equal(t, 4*time.Second, max)
+
+	min, median, mean, max = summarizeDurations(nil)
+	require.Zero(t, min+median+mean+max)
+	require.Equal(t, "-", formatBenchmarkDuration(0))
+}
@@ -0,0 +1,41 @@
+package kssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// Open the given URL in the user's browser
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// PresentChallenge tells the user how to complete the given step-up authentication challenge and try to open the login
+// page in their browser. The instructions are printed to stderr so that they do not interfere with
+// `kssh --provision --json`.
+func PresentChallenge(challenge shared.SignatureChallenge) {
+	url := challenge.VerificationURIComplete
+	if url == "" {
+		url = challenge.VerificationURI
+	}
+	fmt.Fprintf(os.Stderr, "The CA requires you to log in to your identity provider before issuing a certificate.\n"+
+		"Visit %s and enter the code %s\n", challenge.VerificationURI, challenge.UserCode)
+	err := openBrowser(url)
+	if err != nil {
+		log.Debugf("Failed to open a browser: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package kssh
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// The cloud providers that kssh can tunnel ssh connections through
+const (
+	// Tunnel through AWS Systems Manager Session Manager (`aws ssm start-session`)
+	CloudProviderAWSSSM = "aws-ssm"
+	// Tunnel through an EC2 Instance Connect Endpoint (`aws ec2-instance-connect open-tunnel`)
+	CloudProviderAWSInstanceConnect = "aws-ec2-instance-connect"
+)
+
+// CloudTunnel specifies that hosts matching HostPattern should be reached through the given cloud provider. This
+// makes it possible to close port 22 entirely while still authenticating with a certificate signed by the CA.
+type CloudTunnel struct {
+	// A glob (eg `i-*`) matched against the destination host
+	HostPattern string `json:"host_pattern"`
+	// One of the CloudProvider constants
+	Provider string `json:"provider"`
+	// The cloud region to use. May be empty in which case the provider's CLI default is used.
+	Region string `json:"region,omitempty"`
+}
+
+// GetCloudTunnel returns the first configured CloudTunnel matching host or nil if host should be connected to directly
+func (c *Config) GetCloudTunnel(host string) *CloudTunnel {
+	for _, tunnel := range c.CloudTunnels {
+		matched, err := path.Match(tunnel.HostPattern, host)
+		if err == nil && matched {
+			tunnel := tunnel
+			return &tunnel
+		}
+	}
+	return nil
+}
+
+// ProxyCommand returns the ssh ProxyCommand used to reach a host through this tunnel. The %h and %p tokens are
+// expanded by ssh. For AWS the host is expected to be the instance ID.
+func (t *CloudTunnel) ProxyCommand() (string, error) {
+	regionFlag := ""
+	if t.Region != "" {
+		regionFlag = " --region " + t.Region
+	}
+	switch t.Provider {
+	case CloudProviderAWSSSM:
+		return "aws ssm start-session --target %h --document-name AWS-StartSSHSession --parameters portNumber=%p" + regionFlag, nil
+	case CloudProviderAWSInstanceConnect:
+		return "aws ec2-instance-connect open-tunnel --instance-id %h --remote-port %p" + regionFlag, nil
+	default:
+		return "", fmt.Errorf("unsupported cloud tunnel provider: %s", t.Provider)
+	}
+}
+
+// Returns whether the user already specified how to reach the destination in which case kssh should not add its
+// own ProxyCommand
+func hasUserSpecifiedProxy(args []string) bool {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "-J") {
+			return true
+		}
+		option := ""
+		if arg == "-o" && i+1 < len(args) {
+			option = args[i+1]
+		} else if strings.HasPrefix(arg, "-o") {
+			option = arg[2:]
+		}
+		option = strings.ToLower(option)
+		if strings.HasPrefix(option, "proxycommand") || strings.HasPrefix(option, "proxyjump") {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCloudTunnelArgs returns the extra ssh arguments needed in order to reach the destination in sshArgs via
+// a CloudTunnel. Returns nil if the destination is not a cloud host or if the user specified their own proxy.
+func GetCloudTunnelArgs(conf *Config, sshArgs []string) ([]string, error) {
+	if conf == nil || len(conf.CloudTunnels) == 0 || hasUserSpecifiedProxy(sshArgs) {
+		return nil, nil
+	}
+	_, host := GetSSHDestination(sshArgs)
+	if host == "" {
+		return nil, nil
+	}
+	tunnel := conf.GetCloudTunnel(host)
+	if tunnel == nil {
+		return nil, nil
+	}
+	proxyCommand, err := tunnel.ProxyCommand()
+	if err != nil {
+		return nil, err
+	}
+	return []string{"-o", "ProxyCommand=" + proxyCommand}, nil
+}
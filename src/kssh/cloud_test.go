@@ -0,0 +1,62 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetSSHDestination(t *testing.T) {
+	cases := []struct {
+		args []string
+		user string
+		host string
+	}{
+		{[]string{"root@server"}, "root", "server"},
+		{[]string{"server"}, "", "server"},
+		{[]string{"-p", "2222", "-v", "user@i-0abc", "ls", "-l"}, "user", "i-0abc"},
+		{[]string{"-p2222", "i-0abc"}, "", "i-0abc"},
+		{[]string{"-o", "StrictHostKeyChecking=no", "ssh://root@server:22"}, "root", "server"},
+		{[]string{"root@[::1]:22"}, "root", "::1"},
+		{[]string{"--", "server"}, "", "server"},
+		{[]string{"-v"}, "", ""},
+		{[]string{"-t", "root@server", "top"}, "root", "server"},
+		{[]string{"-tt", "-T", "server"}, "", "server"},
+	}
+	for _, c := range cases {
+		user, host := GetSSHDestination(c.args)
+		require.Equal(t, c.user, user, "%v", c.args)
+		require.Equal(t, c.host, host, "%v", c.args)
+	}
+}
+
+func TestGetCloudTunnelArgs(t *testing.T) {
+	conf := &Config{CloudTunnels: []CloudTunnel{
+		{HostPattern: "i-*", Provider: CloudProviderAWSSSM, Region: "us-west-2"},
+		{HostPattern: "*.eic.internal", Provider: CloudProviderAWSInstanceConnect},
+	}}
+
+	args, err := GetCloudTunnelArgs(conf, []string{"root@i-0abc"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"-o", "ProxyCommand=aws ssm start-session --target %h --document-name AWS-StartSSHSession " +
+		"--parameters portNumber=%p --region us-west-2"}, args)
+
+	args, err = GetCloudTunnelArgs(conf, []string{"host.eic.internal"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"-o", "ProxyCommand=aws ec2-instance-connect open-tunnel --instance-id %h --remote-port %p"}, args)
+
+	args, err = GetCloudTunnelArgs(conf, []string{"root@server"})
+	require.NoError(t, err)
+	require.Nil(t, args)
+
+	args, err = GetCloudTunnelArgs(conf, []string{"-J", "bastion", "root@i-0abc"})
+	require.NoError(t, err)
+	require.Nil(t, args)
+
+	args, err = GetCloudTunnelArgs(nil, []string{"root@i-0abc"})
+	require.NoError(t, err)
+	require.Nil(t, args)
+
+	_, err = GetCloudTunnelArgs(&Config{CloudTunnels: []CloudTunnel{{HostPattern: "*", Provider: "gcp"}}}, []string{"host"})
+	require.Error(t, err)
+}
@@ -0,0 +1,58 @@
+package kssh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The shells that CompletionScript supports
+var CompletionShells = []string{"bash", "zsh"}
+
+// The bash completion script. Destinations are completed from the hosts inventory (see `kssh --complete-hosts`),
+// keeping any user@ prefix, and everything else falls back to file completion.
+const bashCompletionScript = `_kssh() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    if [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "%s" -- "$cur"))
+        return
+    fi
+    local user=""
+    if [[ "$cur" == *@* ]]; then
+        user="${cur%%%%@*}@"
+        cur="${cur#*@}"
+    fi
+    COMPREPLY=($(compgen -P "$user" -W "$(kssh --complete-hosts 2>/dev/null)" -- "$cur"))
+}
+complete -o default -F _kssh kssh
+`
+
+// The zsh completion script. Same behavior as bashCompletionScript.
+const zshCompletionScript = `#compdef kssh
+_kssh() {
+    if [[ "$PREFIX" == -* ]]; then
+        compadd -- %s
+        return
+    fi
+    local -a hosts
+    hosts=(${(f)"$(kssh --complete-hosts 2>/dev/null)"})
+    if compset -P '*@'; then
+        compadd -a hosts
+    else
+        _alternative 'hosts:host:compadd -a hosts' 'files:file:_files'
+    fi
+}
+compdef _kssh kssh
+`
+
+// CompletionScript returns the script that enables tab-completion of the given kssh flags and of the hosts in the
+// hosts inventories of the user's teams for the given shell (one of CompletionShells)
+func CompletionScript(shell string, flags []string) (string, error) {
+	switch shell {
+	case "bash":
+		return fmt.Sprintf(bashCompletionScript, strings.Join(flags, " ")), nil
+	case "zsh":
+		return fmt.Sprintf(zshCompletionScript, strings.Join(flags, " ")), nil
+	default:
+		return "", fmt.Errorf("unsupported shell %q, expected one of %s", shell, strings.Join(CompletionShells, ", "))
+	}
+}
@@ -0,0 +1,22 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompletionScript(t *testing.T) {
+	script, err := CompletionScript("bash", []string{"--bot", "--provision"})
+	require.NoError(t, err)
+	require.Contains(t, script, `compgen -W "--bot --provision"`)
+	require.Contains(t, script, `user="${cur%%@*}@"`)
+	require.Contains(t, script, "complete -o default -F _kssh kssh")
+
+	script, err = CompletionScript("zsh", []string{"--bot", "--provision"})
+	require.NoError(t, err)
+	require.Contains(t, script, "compadd -- --bot --provision")
+
+	_, err = CompletionScript("tcsh", nil)
+	require.Error(t, err)
+}
@@ -1,13 +1,18 @@
 package kssh
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
 )
 
 // Config is provided by the keybaseca server and lives in the KV store.  It is
@@ -17,6 +22,75 @@ type Config struct {
 	TeamName    string `json:"teamname"`
 	ChannelName string `json:"channelname"`
 	BotName     string `json:"botname"`
+
+	// The public key of the CA. kssh refuses to use certificates from the bot that were not signed by this key.
+	CAPublicKey string `json:"ca_public_key,omitempty"`
+
+	// The public key of the offline root CA if CAPublicKey is an intermediate CA key (see INTERMEDIATE_CERT_LOCATION).
+	// kssh accepts certificates signed by any intermediate CA key that was certified by this key.
+	RootCAPublicKey string `json:"root_ca_public_key,omitempty"`
+
+	// The teams or team patterns whose certificates are threshold signed with ThresholdCAPublicKey rather than
+	// CAPublicKey when only some teams use threshold signing (see THRESHOLD_TEAMS). kssh expects certificates that
+	// include one of these teams to be signed by ThresholdCAPublicKey.
+	ThresholdTeams       []string `json:"threshold_teams,omitempty"`
+	ThresholdCAPublicKey string   `json:"threshold_ca_public_key,omitempty"`
+
+	// The additional principals that keybaseca may include in elevated certificates (see `kssh --elevate`)
+	ElevatedPrincipals []string `json:"elevated_principals,omitempty"`
+
+	// The additional principals that keybaseca may include in certificates based on group membership in an external
+	// directory (see GROUP_PRINCIPALS)
+	GroupPrincipals []string `json:"group_principals,omitempty"`
+
+	// Whether keybaseca may include the user's unix username as a principal (see USERNAME_PRINCIPAL_TEAMS). The
+	// username is reported in the signature response since it may differ from the Keybase username.
+	UsernamePrincipals bool `json:"username_principals,omitempty"`
+
+	// If set, kssh sends its messages to the bot as exploding messages with this lifetime in seconds so that they are
+	// not kept in the chat history
+	ExplodingLifetime int `json:"exploding_lifetime,omitempty"`
+
+	// Hosts that should be reached through a cloud provider tunnel rather than a direct TCP connection
+	CloudTunnels []CloudTunnel `json:"cloud_tunnels,omitempty"`
+
+	// The remote users that kssh logs in as by default for hosts matching each pattern
+	DefaultUsers []DefaultUser `json:"default_users,omitempty"`
+
+	// Additional locations (KBFS folders or https URLs) where the bot publishes its configs as `<team>.json`. kssh
+	// tries them in order when it cannot load the config from its usual location (see LoadMirroredConfig).
+	Mirrors []string `json:"mirrors,omitempty"`
+
+	// Overrides of the messages that kssh shows to the user (see MESSAGES_FILE)
+	Messages shared.Messages `json:"messages,omitempty"`
+
+	// Where kssh sends anonymous usage and latency metrics (see KSSH_METRICS_ENDPOINT and Metrics). kssh does not send
+	// any metrics if this is empty.
+	MetricsEndpoint string `json:"metrics_endpoint,omitempty"`
+
+	// Hooks that kssh runs before connecting to hosts matching each pattern to open the firewall for this client (see
+	// PRE_CONNECT_HOOKS and RunPreConnectHooks)
+	PreConnectHooks []PreConnectHook `json:"pre_connect_hooks,omitempty"`
+
+	// The kssh behaviors that are being rolled out to a percentage of the team's users (see KSSH_FEATURE_FLAGS and
+	// FeatureEnabled)
+	FeatureFlags []FeatureFlag `json:"feature_flags,omitempty"`
+
+	// A hash of the rest of the config (see ComputeVersion). Changes whenever the config changes so that kssh can
+	// tell when its cached copies are stale.
+	Version string `json:"version,omitempty"`
+}
+
+// ComputeVersion returns a hash of every field of the config other than Version
+func (c Config) ComputeVersion() string {
+	c.Version = ""
+	bytes, err := json.Marshal(c)
+	if err != nil {
+		// Config only contains types that can always be marshaled
+		panic(fmt.Sprintf("failed to marshal a kssh config: %v", err))
+	}
+	hash := sha256.Sum256(bytes)
+	return hex.EncodeToString(hash[:8])
 }
 
 // Get the configured channel name from the given config file. Returns either a pointer to the channel name string
@@ -28,6 +102,12 @@ func (c *Config) getChannel() *string {
 	return nil
 }
 
+// Get the lifetime of the exploding messages that kssh should send to the bot. Zero if kssh should send regular
+// messages.
+func (c *Config) getExplodingLifetime() time.Duration {
+	return time.Duration(c.ExplodingLifetime) * time.Second
+}
+
 // A LocalConfigFile is a file that lives on the FS of the computer running kssh.
 // By default (and for most users), this file is not used.
 //
@@ -41,14 +121,39 @@ func (c *Config) getChannel() *string {
 // README.md for a description of why this may be useful) this is also stored
 // in the local config file. This is controlled via `kssh --set-default-user
 // foo`.
+//
+// kssh also caches the client config that was used to provision each signed
+// key so that it can be consulted (eg for CloudTunnels) when an existing
+// certificate is reused without talking to Keybase.
 type LocalConfigFile struct {
 	DefaultBotName string `json:"default_bot"`
 	DefaultBotTeam string `json:"default_team"`
 	DefaultSSHUser string `json:"default_ssh_user"`
 	KeybaseBinPath string `json:"keybase_binary"`
+	// The SHA-256 of the keybase binary. If set, kssh refuses to run any other keybase binary (see PinKeybaseBinary).
+	KeybaseBinSHA256 string `json:"keybase_binary_sha256,omitempty"`
+	// Where newly signed certificates are installed to (see SetInstallTargets). Empty means DefaultInstallTargets.
+	InstallTargets []string `json:"install_targets,omitempty"`
+	// The PKCS#11 library used for the pkcs11 install target (see SetPKCS11Provider)
+	PKCS11Provider string `json:"pkcs11_provider,omitempty"`
+	// The team#channel that kssh asks the CA bots for its configs in (see SetDiscoveryChannel). Empty means configs
+	// are read from each team.
+	DiscoveryChannel string            `json:"discovery_channel,omitempty"`
+	ClientConfigs    map[string]Config `json:"client_configs,omitempty"`
+	// Metadata about the last connection to each host (see RecordSession)
+	Sessions map[string]Session `json:"sessions,omitempty"`
+	// The Keybase account that kssh acts as by default and the Keybase home directories registered for each account
+	// (see SetKeybaseAccount)
+	KeybaseUser  string            `json:"keybase_user,omitempty"`
+	KeybaseHomes map[string]string `json:"keybase_homes,omitempty"`
+	// The Keybase user whose signed releases `kssh --self-update` installs (see SetReleaseSigner)
+	ReleaseSigner string `json:"release_signer,omitempty"`
 }
 
 func GetKeybaseBinaryPath() string {
+	if verifiedKeybaseBinaryPath != "" {
+		return verifiedKeybaseBinaryPath
+	}
 	lcf, err := getCurrentConfigFile()
 	if err != nil {
 		return "keybase"
@@ -60,6 +165,111 @@ func GetKeybaseBinaryPath() string {
 	return "keybase"
 }
 
+// The keybase binary that was checked by VerifyKeybaseBinary
+var verifiedKeybaseBinaryPath string
+
+// VerifyKeybaseBinary checks the keybase binary that kssh is configured to use and returns its absolute path, which
+// GetKeybaseBinaryPath returns from then on. A binary set via --set-keybase-binary must be an absolute path;
+// otherwise keybase is looked up in the absolute directories in $PATH so that a keybase binary in the current
+// directory is never run. The binary must be a regular file that only its owner can write to and, if the binary was
+// pinned via PinKeybaseBinary, must match the pinned checksum.
+func VerifyKeybaseBinary() (string, error) {
+	lcf, err := getCurrentConfigFile()
+	if err != nil {
+		return "", err
+	}
+	path := lcf.KeybaseBinPath
+	if path == "" {
+		path, err = shared.LookPath("keybase")
+		if err != nil {
+			return "", fmt.Errorf("failed to find keybase (use --set-keybase-binary to specify its location): %v", err)
+		}
+	} else if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("the configured keybase binary %s is not an absolute path, use --set-keybase-binary to specify its absolute path", path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to find the keybase binary: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("the keybase binary %s is not a regular file", path)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0022 != 0 {
+		return "", fmt.Errorf("refusing to run the keybase binary %s since it can be modified by other users (permissions %s)", path, info.Mode().Perm())
+	}
+	if lcf.KeybaseBinSHA256 != "" {
+		checksum, err := fileSHA256(path)
+		if err != nil {
+			return "", err
+		}
+		if checksum != lcf.KeybaseBinSHA256 {
+			return "", fmt.Errorf("refusing to run the keybase binary %s since it does not match the pinned checksum "+
+				"(if keybase was updated, run kssh --pin-keybase-binary again)", path)
+		}
+	}
+	verifiedKeybaseBinaryPath = path
+	return path, nil
+}
+
+// PinKeybaseBinary records the absolute path and checksum of the keybase binary that kssh currently uses so that
+// kssh refuses to run any other binary. Returns the pinned path. Note that this has to be re-run whenever keybase is
+// updated.
+func PinKeybaseBinary() (string, error) {
+	// Verify the binary without the previous pin, if any
+	err := updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.KeybaseBinSHA256 = ""
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	path, err := VerifyKeybaseBinary()
+	if err != nil {
+		return "", err
+	}
+	checksum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	return path, updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.KeybaseBinPath = path
+		lcf.KeybaseBinSHA256 = checksum
+		return nil
+	})
+}
+
+// SetReleaseSigner records the Keybase user (normally the CA bot) that publishes kssh releases. `kssh --self-update`
+// only installs releases from that user's public folder that are signed by that user. It is recorded locally (eg when
+// kssh is installed) rather than taken from the config of the bot, since anyone who can write a config to a team kssh
+// reads configs from could otherwise point kssh at their own releases. An empty string clears it.
+func SetReleaseSigner(username string) error {
+	username = strings.ToLower(username)
+	if username != "" && !shared.IsValidKeybaseUsername(username) {
+		return fmt.Errorf("invalid Keybase username %q", username)
+	}
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.ReleaseSigner = username
+		return nil
+	})
+}
+
+// GetReleaseSigner returns the Keybase user whose releases `kssh --self-update` installs. buildSigner is the signer
+// compiled into kssh, if any, which takes precedence over the one recorded via SetReleaseSigner.
+func GetReleaseSigner(buildSigner string) (string, error) {
+	if buildSigner != "" {
+		return buildSigner, nil
+	}
+	lcf, err := getCurrentConfigFile()
+	if err != nil {
+		return "", err
+	}
+	if lcf.ReleaseSigner == "" {
+		return "", fmt.Errorf("no release signer is configured, run `kssh --set-release-signer <keybase user>` with the " +
+			"Keybase user of your CA bot first")
+	}
+	return lcf.ReleaseSigner, nil
+}
+
 // Where to store the local config file. Just stash it in ~/.ssh rather than
 // making a ~/.kssh folder
 var localConfigFileLocation = shared.ExpandPathWithTilde("~/.ssh/kssh-config.json")
@@ -74,15 +284,18 @@ func GetDefaultSSHUser() (string, error) {
 	return lcf.DefaultSSHUser, nil
 }
 
-// Set the default SSH user to use for kssh connections.
+// Set the keybase binary to use rather than looking it up in $PATH. The path must be absolute. This clears any pinned
+// checksum (see PinKeybaseBinary).
 func SetKeybaseBinaryPath(path string) error {
-	lcf, err := getCurrentConfigFile()
-	if err != nil {
-		return err
+	path = shared.ExpandPathWithTilde(path)
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("the keybase binary must be an absolute path: %s", path)
 	}
-
-	lcf.KeybaseBinPath = path
-	return writeConfigFile(lcf)
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.KeybaseBinPath = path
+		lcf.KeybaseBinSHA256 = ""
+		return nil
+	})
 }
 
 // Set the default SSH user to use for kssh connections.
@@ -91,49 +304,160 @@ func SetDefaultSSHUser(username string) error {
 		return fmt.Errorf("invalid username: %s", username)
 	}
 
-	lcf, err := getCurrentConfigFile()
-	if err != nil {
-		return err
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.DefaultSSHUser = username
+		return nil
+	})
+}
+
+// Set the team#channel that kssh sends config requests to (see Requester.DiscoverConfigs) rather than reading the
+// config of every team the user is in. An empty string clears it.
+func SetDiscoveryChannel(teamChannel string) error {
+	if teamChannel != "" {
+		if _, _, err := ParseDiscoveryChannel(teamChannel); err != nil {
+			return err
+		}
 	}
 
-	lcf.DefaultSSHUser = username
-	return writeConfigFile(lcf)
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.DiscoveryChannel = teamChannel
+		return nil
+	})
 }
 
-// Write the given config file to disk
-func writeConfigFile(lcf LocalConfigFile) error {
-	bytes, err := json.Marshal(&lcf)
+// Get the team and channel that kssh sends config requests to. Both are empty if no discovery channel is configured.
+func GetDiscoveryChannel() (string, string, error) {
+	lcf, err := getCurrentConfigFile()
 	if err != nil {
-		return fmt.Errorf("failed to marshal json into config file: %v", err)
+		return "", "", err
+	}
+	if lcf.DiscoveryChannel == "" {
+		return "", "", nil
+	}
+	return ParseDiscoveryChannel(lcf.DiscoveryChannel)
+}
+
+// ParseDiscoveryChannel parses a discovery channel of the form team#channel
+func ParseDiscoveryChannel(teamChannel string) (string, string, error) {
+	split := strings.Split(teamChannel, "#")
+	if len(split) != 2 || split[0] == "" || split[1] == "" || strings.ContainsAny(teamChannel, " \t\n\r") {
+		return "", "", fmt.Errorf("invalid discovery channel %q, expected team#channel", teamChannel)
 	}
+	return split[0], split[1], nil
+}
+
+// The local config file. It is read and written via a jsonStore since many kssh processes may update it at once (eg
+// to record sessions or cache client configs).
+func localConfigStore() jsonStore {
+	return jsonStore{path: localConfigFileLocation, perm: 0600}
+}
 
+// Replace the config file on disk with the given config file. Prefer updateConfigFile, which does not lose the changes
+// that other kssh processes make at the same time.
+func writeConfigFile(lcf LocalConfigFile) error {
 	// Create ~/.ssh/ if it does not yet exist
-	err = MakeDotSSH()
+	err := MakeDotSSH()
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(localConfigFileLocation, bytes, 0600)
+	err = localConfigStore().Write(&lcf)
 	if err != nil {
 		return fmt.Errorf("failed to write config file: %v", err)
 	}
 	return nil
 }
 
+// Apply update to the current config file and write it back to disk. Other kssh processes cannot change the config
+// file in the meantime. Nothing is written if update returns an error or errStoreUnchanged.
+func updateConfigFile(update func(lcf *LocalConfigFile) error) error {
+	// Create ~/.ssh/ if it does not yet exist
+	err := MakeDotSSH()
+	if err != nil {
+		return err
+	}
+
+	var lcf LocalConfigFile
+	return localConfigStore().Update(&lcf, func() error { return update(&lcf) })
+}
+
 // Get the current kssh config file
 func getCurrentConfigFile() (lcf LocalConfigFile, err error) {
-	if _, err := os.Stat(localConfigFileLocation); os.IsNotExist(err) {
-		return lcf, nil
-	}
-	bytes, err := ioutil.ReadFile(localConfigFileLocation)
+	err = localConfigStore().Read(&lcf)
 	if err != nil {
 		return lcf, fmt.Errorf("failed to read local config file: %v", err)
 	}
-	err = json.Unmarshal(bytes, &lcf)
+	return lcf, nil
+}
+
+// CacheClientConfig stores the client config that was used to provision the key at keyPath
+func CacheClientConfig(keyPath string, conf Config) error {
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		if lcf.ClientConfigs == nil {
+			lcf.ClientConfigs = make(map[string]Config)
+		}
+		lcf.ClientConfigs[keyPath] = conf
+		return nil
+	})
+}
+
+// GetCachedClientConfig returns the client config that was used to provision the key at keyPath. Returns nil
+// if no config has been cached for that key.
+func GetCachedClientConfig(keyPath string) (*Config, error) {
+	lcf, err := getCurrentConfigFile()
 	if err != nil {
-		return lcf, fmt.Errorf("failed to parse local config file: %v", err)
+		return nil, err
 	}
-	return lcf, nil
+	conf, ok := lcf.ClientConfigs[keyPath]
+	if !ok {
+		return nil, nil
+	}
+	return &conf, nil
+}
+
+// RefreshLocalConfig updates the local config file after the current version of the client config for a team was
+// loaded from Keybase. Cached client configs from the same team that are out of date are replaced (or dropped if a
+// different bot now serves the team) and the default bot is repointed if the team that it is in is now served by a
+// different bot. This keeps kssh from holding onto stale settings after an operator reconfigures the CA.
+func RefreshLocalConfig(conf Config) error {
+	lcf, err := getCurrentConfigFile()
+	if err != nil {
+		return err
+	}
+	// Most of the time nothing is stale so only take the lock when there is something to update
+	if !refreshLocalConfig(&lcf, conf) {
+		return nil
+	}
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		if !refreshLocalConfig(lcf, conf) {
+			return errStoreUnchanged
+		}
+		return nil
+	})
+}
+
+// Apply the given current client config to lcf (see RefreshLocalConfig). Returns whether lcf changed.
+func refreshLocalConfig(lcf *LocalConfigFile, conf Config) bool {
+	changed := false
+	for keyPath, cached := range lcf.ClientConfigs {
+		if cached.TeamName != conf.TeamName || cached.ChannelName != conf.ChannelName || cached.Version == conf.Version {
+			continue
+		}
+		if cached.BotName == conf.BotName {
+			log.Debugf("The client config for %s has changed, updating the cached copy", conf.BotName)
+			lcf.ClientConfigs[keyPath] = conf
+		} else {
+			delete(lcf.ClientConfigs, keyPath)
+		}
+		changed = true
+	}
+	if lcf.DefaultBotTeam == conf.TeamName && lcf.DefaultBotName != "" && lcf.DefaultBotName != conf.BotName {
+		log.Warnf("The default bot %s has been replaced by %s in the team %s, using %s as the default bot from now on",
+			lcf.DefaultBotName, conf.BotName, conf.TeamName, conf.BotName)
+		lcf.DefaultBotName = conf.BotName
+		changed = true
+	}
+	return changed
 }
 
 // GetDefaultBotAndTeam gets the default bot and team for kssh from the local
@@ -171,12 +495,9 @@ func SetDefaultBot(botName string) error {
 		teamName = conf.TeamName
 	}
 
-	lcf, err := getCurrentConfigFile()
-	if err != nil {
-		return err
-	}
-	lcf.DefaultBotName = botName
-	lcf.DefaultBotTeam = teamName
-
-	return writeConfigFile(lcf)
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.DefaultBotName = botName
+		lcf.DefaultBotTeam = teamName
+		return nil
+	})
 }
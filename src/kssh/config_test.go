@@ -0,0 +1,168 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeVersion(t *testing.T) {
+	conf := Config{TeamName: "team.ssh", BotName: "cabot"}
+	version := conf.ComputeVersion()
+	require.NotEmpty(t, version)
+
+	// The version does not depend on itself
+	conf.Version = version
+	require.Equal(t, version, conf.ComputeVersion())
+
+	conf.CAPublicKey = "ssh-ed25519 AAAA"
+	require.NotEqual(t, version, conf.ComputeVersion())
+}
+
+func TestRefreshLocalConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig := localConfigFileLocation
+	defer func() { localConfigFileLocation = oldConfig }()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+
+	old := Config{TeamName: "team.ssh", BotName: "cabot"}
+	old.Version = old.ComputeVersion()
+	other := Config{TeamName: "team.other", BotName: "otherbot"}
+	other.Version = other.ComputeVersion()
+	require.NoError(t, writeConfigFile(LocalConfigFile{
+		DefaultBotName: "cabot",
+		DefaultBotTeam: "team.ssh",
+		ClientConfigs:  map[string]Config{"key-1": old, "key-2": other},
+	}))
+
+	// The same bot with a new CA key replaces the cached config
+	updated := Config{TeamName: "team.ssh", BotName: "cabot", CAPublicKey: "ssh-ed25519 AAAA"}
+	updated.Version = updated.ComputeVersion()
+	require.NoError(t, RefreshLocalConfig(updated))
+	lcf, err := getCurrentConfigFile()
+	require.NoError(t, err)
+	require.Equal(t, updated, lcf.ClientConfigs["key-1"])
+	require.Equal(t, other, lcf.ClientConfigs["key-2"])
+	require.Equal(t, "cabot", lcf.DefaultBotName)
+
+	// A new bot in the default team drops the cached config and becomes the default
+	replaced := Config{TeamName: "team.ssh", BotName: "newbot"}
+	replaced.Version = replaced.ComputeVersion()
+	require.NoError(t, RefreshLocalConfig(replaced))
+	lcf, err = getCurrentConfigFile()
+	require.NoError(t, err)
+	require.NotContains(t, lcf.ClientConfigs, "key-1")
+	require.Contains(t, lcf.ClientConfigs, "key-2")
+	require.Equal(t, "newbot", lcf.DefaultBotName)
+	require.Equal(t, "team.ssh", lcf.DefaultBotTeam)
+}
+
+func TestReleaseSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig := localConfigFileLocation
+	defer func() { localConfigFileLocation = oldConfig }()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+
+	_, err = GetReleaseSigner("")
+	require.Error(t, err)
+	signer, err := GetReleaseSigner("buildbot")
+	require.NoError(t, err)
+	require.Equal(t, "buildbot", signer)
+
+	require.Error(t, SetReleaseSigner("../evil"))
+	require.NoError(t, SetReleaseSigner("CABot"))
+	signer, err = GetReleaseSigner("")
+	require.NoError(t, err)
+	require.Equal(t, "cabot", signer)
+	// The signer compiled into kssh wins
+	signer, err = GetReleaseSigner("buildbot")
+	require.NoError(t, err)
+	require.Equal(t, "buildbot", signer)
+
+	require.NoError(t, SetReleaseSigner(""))
+	_, err = GetReleaseSigner("")
+	require.Error(t, err)
+}
+
+func TestVerifyKeybaseBinary(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses unix permissions")
+	}
+	dir, err := ioutil.TempDir("", "kssh-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig := localConfigFileLocation
+	defer func() { localConfigFileLocation = oldConfig; verifiedKeybaseBinaryPath = "" }()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+	binary := filepath.Join(dir, "keybase")
+	require.NoError(t, ioutil.WriteFile(binary, []byte("#!/bin/sh\n"), 0755))
+
+	require.Error(t, SetKeybaseBinaryPath("keybase"))
+	require.NoError(t, SetKeybaseBinaryPath(binary))
+	path, err := VerifyKeybaseBinary()
+	require.NoError(t, err)
+	require.Equal(t, binary, path)
+	require.Equal(t, binary, GetKeybaseBinaryPath())
+
+	// A binary that other users can modify is refused
+	require.NoError(t, os.Chmod(binary, 0777))
+	_, err = VerifyKeybaseBinary()
+	require.Error(t, err)
+	require.NoError(t, os.Chmod(binary, 0755))
+
+	// Once pinned, a modified binary is refused until it is pinned again
+	path, err = PinKeybaseBinary()
+	require.NoError(t, err)
+	require.Equal(t, binary, path)
+	_, err = VerifyKeybaseBinary()
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(binary, []byte("#!/bin/sh\necho evil\n"), 0755))
+	_, err = VerifyKeybaseBinary()
+	require.Error(t, err)
+	_, err = PinKeybaseBinary()
+	require.NoError(t, err)
+	_, err = VerifyKeybaseBinary()
+	require.NoError(t, err)
+
+	// Setting a new binary clears the pin
+	require.NoError(t, SetKeybaseBinaryPath(binary))
+	lcf, err := getCurrentConfigFile()
+	require.NoError(t, err)
+	require.Empty(t, lcf.KeybaseBinSHA256)
+}
+
+func TestDiscoveryChannel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-config")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig := localConfigFileLocation
+	defer func() { localConfigFileLocation = oldConfig }()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+
+	team, channel, err := GetDiscoveryChannel()
+	require.NoError(t, err)
+	require.Equal(t, "", team)
+	require.Equal(t, "", channel)
+
+	for _, invalid := range []string{"acme", "acme#", "#kssh", "acme#kssh#more", "acme#k ssh"} {
+		require.Error(t, SetDiscoveryChannel(invalid), invalid)
+	}
+	require.NoError(t, SetDiscoveryChannel("acme#kssh-discovery"))
+	team, channel, err = GetDiscoveryChannel()
+	require.NoError(t, err)
+	require.Equal(t, "acme", team)
+	require.Equal(t, "kssh-discovery", channel)
+
+	require.NoError(t, SetDiscoveryChannel(""))
+	team, _, err = GetDiscoveryChannel()
+	require.NoError(t, err)
+	require.Equal(t, "", team)
+}
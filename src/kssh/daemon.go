@@ -0,0 +1,347 @@
+package kssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The commands understood by ksshd-agent
+const (
+	// Return the status of every key managed by the daemon
+	DaemonCommandStatus = "status"
+	// Make sure there is a valid key for the given bot, provisioning one if needed
+	DaemonCommandProvision = "provision"
+	// Shut down the daemon
+	DaemonCommandStop = "stop"
+)
+
+// How often the daemon checks whether any keys need to be renewed
+const daemonCheckInterval = 30 * time.Second
+
+// The daemon never renews a key more often than this in order to avoid flooding the CA
+const minRenewInterval = time.Minute
+
+// The longest the daemon waits before retrying after a failure to renew a key
+const maxRenewBackoff = 10 * time.Minute
+
+// GetDaemonSocketPath returns the path of the unix socket that ksshd-agent listens on. There is one daemon per OS
+// user and Keybase user.
+func GetDaemonSocketPath() (string, error) {
+	stateDirectory, err := GetStateDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDirectory, "ksshd-agent.sock"), nil
+}
+
+// DaemonRequest is sent to ksshd-agent as a single line of JSON
+type DaemonRequest struct {
+	Command string `json:"command"`
+	// The bot to provision a key for. Empty means the default bot.
+	BotName string `json:"bot_name,omitempty"`
+}
+
+// DaemonKeyStatus describes a key managed by ksshd-agent
+type DaemonKeyStatus struct {
+	BotName string `json:"bot_name"`
+	KeyPath string `json:"key_path"`
+	// RFC3339. Empty if there is no valid key.
+	ValidBefore string `json:"valid_before,omitempty"`
+	// The error from the last failed attempt to renew the key, if any
+	LastError string `json:"last_error,omitempty"`
+}
+
+// DaemonResponse is sent by ksshd-agent as a single line of JSON
+type DaemonResponse struct {
+	Error string            `json:"error,omitempty"`
+	PID   int               `json:"pid"`
+	Keys  []DaemonKeyStatus `json:"keys,omitempty"`
+}
+
+// CallDaemon sends the given request to the running ksshd-agent. Returns an error if no daemon is running.
+func CallDaemon(request DaemonRequest, timeout time.Duration) (DaemonResponse, error) {
+	socket, err := GetDaemonSocketPath()
+	if err != nil {
+		return DaemonResponse{}, err
+	}
+	return callDaemon(socket, request, timeout)
+}
+
+func callDaemon(socket string, request DaemonRequest, timeout time.Duration) (DaemonResponse, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return DaemonResponse{}, fmt.Errorf("ksshd-agent is not running: %v", err)
+	}
+	defer conn.Close()
+	err = conn.SetDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return DaemonResponse{}, err
+	}
+	err = json.NewEncoder(conn).Encode(request)
+	if err != nil {
+		return DaemonResponse{}, fmt.Errorf("failed to send request to ksshd-agent: %v", err)
+	}
+	var response DaemonResponse
+	err = json.NewDecoder(bufio.NewReader(conn)).Decode(&response)
+	if err != nil {
+		return DaemonResponse{}, fmt.Errorf("failed to read response from ksshd-agent: %v", err)
+	}
+	if response.Error != "" {
+		return response, fmt.Errorf("%s", response.Error)
+	}
+	return response, nil
+}
+
+// Daemon keeps a valid signed key in the ssh-agent at all times for each of its bots by renewing it in the
+// background. It holds a single Keybase chat connection so that provisioning through it is much faster than starting
+// a new kssh process.
+type Daemon struct {
+	requester *Requester
+	// Renew a key once less than this much of its validity remains. Zero means renew once 20% of its validity remains.
+	renewBefore time.Duration
+
+	// Serializes provisioning
+	provisionLock sync.Mutex
+
+	lock      sync.Mutex
+	keys      map[string]*daemonKey
+	stopCh    chan struct{}
+	closeOnce sync.Once
+}
+
+type daemonKey struct {
+	status DaemonKeyStatus
+	// When the key was last provisioned by the daemon
+	lastRenewal time.Time
+	// The earliest time at which to retry after a failure
+	retryAt time.Time
+	backoff time.Duration
+	// Whether the current key has been loaded into the ssh-agent
+	inAgent bool
+}
+
+// NewDaemon creates a Daemon that keeps keys for each of the given bots (where an empty name means the default bot)
+// valid. Additional bots are added as kssh requests keys for them.
+func NewDaemon(requester *Requester, botNames []string, renewBefore time.Duration) *Daemon {
+	d := &Daemon{requester: requester, renewBefore: renewBefore, keys: make(map[string]*daemonKey), stopCh: make(chan struct{})}
+	for _, botName := range botNames {
+		d.keys[botName] = &daemonKey{status: DaemonKeyStatus{BotName: botName}}
+	}
+	return d
+}
+
+// Serve renews keys in the background and handles requests on the given listener until Stop is called
+func (d *Daemon) Serve(listener net.Listener) error {
+	go func() {
+		<-d.stopCh
+		listener.Close()
+	}()
+	go d.renewLoop()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-d.stopCh:
+				return nil
+			default:
+				return err
+			}
+		}
+		go d.handle(conn)
+	}
+}
+
+// Stop shuts down the daemon
+func (d *Daemon) Stop() {
+	d.closeOnce.Do(func() { close(d.stopCh) })
+}
+
+func (d *Daemon) handle(conn net.Conn) {
+	defer conn.Close()
+	var request DaemonRequest
+	err := json.NewDecoder(bufio.NewReader(conn)).Decode(&request)
+	if err != nil {
+		log.Debugf("Failed to parse ksshd-agent request: %v", err)
+		return
+	}
+
+	response := DaemonResponse{PID: os.Getpid()}
+	switch request.Command {
+	case DaemonCommandStatus:
+		response.Keys = d.Status()
+	case DaemonCommandProvision:
+		status, err := d.ensureValidKey(request.BotName, false)
+		if err != nil {
+			response.Error = err.Error()
+		}
+		response.Keys = []DaemonKeyStatus{status}
+	case DaemonCommandStop:
+		defer d.Stop()
+	default:
+		response.Error = fmt.Sprintf("unknown command: %s", request.Command)
+	}
+	err = json.NewEncoder(conn).Encode(response)
+	if err != nil {
+		log.Debugf("Failed to send ksshd-agent response: %v", err)
+	}
+}
+
+// Status returns the status of every key managed by the daemon sorted by bot name
+func (d *Daemon) Status() []DaemonKeyStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	statuses := []DaemonKeyStatus{}
+	for _, key := range d.keys {
+		statuses = append(statuses, key.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].BotName < statuses[j].BotName })
+	return statuses
+}
+
+func (d *Daemon) renewLoop() {
+	ticker := time.NewTicker(daemonCheckInterval)
+	defer ticker.Stop()
+	for {
+		d.lock.Lock()
+		var botNames []string
+		for botName := range d.keys {
+			botNames = append(botNames, botName)
+		}
+		d.lock.Unlock()
+
+		for _, botName := range botNames {
+			_, err := d.ensureValidKey(botName, true)
+			if err != nil {
+				log.Warnf("Failed to renew the key for bot '%s': %v", botName, err)
+			}
+		}
+
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Make sure there is a valid key for the given bot, renewing it if it is close to expiring. If background is true,
+// the renewal policy (the minimum renewal interval and the backoff after failures) is respected. Requests from kssh
+// are not subject to the policy if there is no valid key since kssh would otherwise provision one itself.
+func (d *Daemon) ensureValidKey(botName string, background bool) (DaemonKeyStatus, error) {
+	d.provisionLock.Lock()
+	defer d.provisionLock.Unlock()
+
+	d.lock.Lock()
+	key, ok := d.keys[botName]
+	if !ok {
+		key = &daemonKey{status: DaemonKeyStatus{BotName: botName}}
+		d.keys[botName] = key
+	}
+	d.lock.Unlock()
+
+	keyPath, err := GetSignedKeyLocation(botName)
+	if err != nil {
+		return key.status, err
+	}
+	renewAt, validBefore, valid := d.getValidity(keyPath)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	key.status.KeyPath = keyPath
+	key.status.ValidBefore = ""
+	if valid {
+		key.status.ValidBefore = validBefore.UTC().Format(time.RFC3339)
+		if !key.inAgent {
+			// A key that was provisioned before the daemon started
+			key.inAgent = AddKeyToSSHAgentUntilExpiry(keyPath) == nil
+		}
+		// kssh only needs a valid key, background renewals wait until it is time to renew
+		if !background || time.Now().Before(renewAt) {
+			return key.status, nil
+		}
+	}
+	if background && (time.Now().Before(key.retryAt) || time.Since(key.lastRenewal) < minRenewInterval) {
+		return key.status, nil
+	}
+
+	d.lock.Unlock()
+	err = d.provision(botName, keyPath)
+	d.lock.Lock()
+
+	if err != nil {
+		key.status.LastError = err.Error()
+		key.backoff = nextBackoff(key.backoff)
+		key.retryAt = time.Now().Add(key.backoff)
+		return key.status, err
+	}
+	key.status.LastError = ""
+	key.backoff = 0
+	key.retryAt = time.Time{}
+	key.lastRenewal = time.Now()
+	key.inAgent = true
+	if _, validBefore, valid := d.getValidity(keyPath); valid {
+		key.status.ValidBefore = validBefore.UTC().Format(time.RFC3339)
+	}
+	return key.status, nil
+}
+
+// Returns the time at which the key at keyPath should be renewed, when it expires, and whether it is currently valid
+func (d *Daemon) getValidity(keyPath string) (time.Time, time.Time, bool) {
+	if !IsReusableCert(keyPath) {
+		return time.Time{}, time.Time{}, false
+	}
+	cert, err := ReadCertificate(keyPath)
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	return renewalTime(validAfter, validBefore, d.renewBefore), validBefore, true
+}
+
+// Provision a new key for botName at keyPath and load it into the ssh-agent
+func (d *Daemon) provision(botName, keyPath string) error {
+	_, err := ProvisionOnce(keyPath, func() error {
+		log.WithField("bot", botName).Debug("Provisioning a new key")
+		return ProvisionNewKey(d.requester, botName, keyPath)
+	})
+	if err != nil {
+		return err
+	}
+	err = AddKeyToSSHAgentUntilExpiry(keyPath)
+	if err != nil {
+		// The key is still usable by kssh so this is not fatal
+		log.Warnf("%v", err)
+	}
+	return nil
+}
+
+// Returns the time at which a certificate valid from validAfter to validBefore should be renewed
+func renewalTime(validAfter, validBefore time.Time, renewBefore time.Duration) time.Time {
+	if renewBefore <= 0 {
+		renewBefore = validBefore.Sub(validAfter) / 5
+	}
+	return validBefore.Add(-renewBefore)
+}
+
+// Returns the backoff to use after another failure given the current backoff
+func nextBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return daemonCheckInterval
+	}
+	backoff *= 2
+	if backoff > maxRenewBackoff {
+		return maxRenewBackoff
+	}
+	return backoff
+}
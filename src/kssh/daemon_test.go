@@ -0,0 +1,57 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRenewalTime(t *testing.T) {
+	validAfter := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	validBefore := validAfter.Add(time.Hour)
+	require.Equal(t, validAfter.Add(48*time.Minute), renewalTime(validAfter, validBefore, 0))
+	require.Equal(t, validAfter.Add(55*time.Minute), renewalTime(validAfter, validBefore, 5*time.Minute))
+}
+
+func TestNextBackoff(t *testing.T) {
+	backoff := nextBackoff(0)
+	require.Equal(t, daemonCheckInterval, backoff)
+	require.Equal(t, 2*daemonCheckInterval, nextBackoff(backoff))
+	require.Equal(t, maxRenewBackoff, nextBackoff(maxRenewBackoff))
+}
+
+func TestDaemonIPC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-daemon-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "ksshd-agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	// No bots so that the renewal loop does not try to provision anything
+	d := NewDaemon(nil, nil, 0)
+	served := make(chan error)
+	go func() { served <- d.Serve(listener) }()
+
+	resp, err := callDaemon(socket, DaemonRequest{Command: DaemonCommandStatus}, time.Second)
+	require.NoError(t, err)
+	require.Equal(t, os.Getpid(), resp.PID)
+	require.Empty(t, resp.Keys)
+
+	_, err = callDaemon(socket, DaemonRequest{Command: "bogus"}, time.Second)
+	require.EqualError(t, err, "unknown command: bogus")
+
+	_, err = callDaemon(socket, DaemonRequest{Command: DaemonCommandStop}, time.Second)
+	require.NoError(t, err)
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon did not stop")
+	}
+}
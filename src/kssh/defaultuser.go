@@ -0,0 +1,93 @@
+package kssh
+
+import (
+	"os/exec"
+	"os/user"
+	"path"
+	"strings"
+)
+
+// DefaultUser specifies that kssh should log into hosts matching HostPattern as User (eg `ubuntu` for `*.aws`) unless
+// the user chose a remote user themselves. This avoids the "Permission denied (publickey)" errors caused by logging
+// in with the local username on images that only have a fixed login user.
+type DefaultUser struct {
+	// A glob (eg `*.aws`) matched against the destination host
+	HostPattern string `json:"host_pattern"`
+	User        string `json:"user"`
+}
+
+// GetDefaultUser returns the remote user of the first DefaultUser matching host or an empty string if there is none
+func (c *Config) GetDefaultUser(host string) string {
+	for _, entry := range c.DefaultUsers {
+		matched, err := path.Match(entry.HostPattern, host)
+		if err == nil && matched {
+			return entry.User
+		}
+	}
+	return ""
+}
+
+// GetDefaultUserArgs returns the extra ssh arguments needed to log into the destination in sshArgs as the default
+// user published by the CA. Returns nil if there is no default for the destination or if the user already chose a
+// remote user via `user@host`, `-l`, `-o User=`, or a User entry in their ssh config.
+func GetDefaultUserArgs(conf *Config, sshArgs []string) []string {
+	if conf == nil || len(conf.DefaultUsers) == 0 || hasUserSpecifiedUser(sshArgs) {
+		return nil
+	}
+	remoteUser, host := GetSSHDestination(sshArgs)
+	if host == "" || remoteUser != "" {
+		return nil
+	}
+	defaultUser := conf.GetDefaultUser(host)
+	if defaultUser == "" || hasConfiguredUser(sshArgs) {
+		return nil
+	}
+	return []string{"-l", defaultUser}
+}
+
+// Returns whether the given ssh arguments specify the remote user via a flag. Only the flags before the destination
+// are considered since the rest of the arguments are the remote command.
+func hasUserSpecifiedUser(args []string) bool {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || len(arg) == 1 {
+			return false
+		}
+		if strings.HasPrefix(arg, "-l") {
+			return true
+		}
+		option := ""
+		if arg == "-o" && i+1 < len(args) {
+			option = args[i+1]
+		} else if strings.HasPrefix(arg, "-o") {
+			option = arg[2:]
+		}
+		if strings.HasPrefix(strings.ToLower(option), "user") {
+			return true
+		}
+		if len(arg) == 2 && strings.ContainsRune(sshFlagsWithArguments, rune(arg[1])) {
+			i++
+		}
+	}
+	return false
+}
+
+// Returns whether the user's ssh config sets the remote user for the destination in args. ssh -G resolves the config
+// without connecting, and any user other than the local username must have come from a config file. Errors are
+// treated as no user being configured. Swapped out in tests.
+var hasConfiguredUser = func(args []string) bool {
+	current, err := user.Current()
+	if err != nil {
+		return false
+	}
+	output, err := exec.Command("ssh", append([]string{"-G"}, args...)...).Output()
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.HasPrefix(line, "user ") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "user ")) != current.Username
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetDefaultUserArgs(t *testing.T) {
+	configured := false
+	original := hasConfiguredUser
+	hasConfiguredUser = func(args []string) bool { return configured }
+	defer func() { hasConfiguredUser = original }()
+
+	conf := &Config{DefaultUsers: []DefaultUser{
+		{HostPattern: "*.aws", User: "ubuntu"},
+		{HostPattern: "*.flatcar", User: "core"},
+	}}
+	require.Equal(t, []string{"-l", "ubuntu"}, GetDefaultUserArgs(conf, []string{"web.aws"}))
+	require.Equal(t, []string{"-l", "core"}, GetDefaultUserArgs(conf, []string{"-p", "2222", "db.flatcar", "ls", "-l"}))
+	require.Nil(t, GetDefaultUserArgs(conf, []string{"server"}))
+	require.Nil(t, GetDefaultUserArgs(nil, []string{"web.aws"}))
+
+	// The user's own choice always wins
+	require.Nil(t, GetDefaultUserArgs(conf, []string{"root@web.aws"}))
+	require.Nil(t, GetDefaultUserArgs(conf, []string{"-l", "root", "web.aws"}))
+	require.Nil(t, GetDefaultUserArgs(conf, []string{"-lroot", "web.aws"}))
+	require.Nil(t, GetDefaultUserArgs(conf, []string{"-o", "User=root", "web.aws"}))
+	configured = true
+	require.Nil(t, GetDefaultUserArgs(conf, []string{"web.aws"}))
+}
@@ -0,0 +1,32 @@
+package kssh
+
+import (
+	"fmt"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// DeniedError is returned by GetSignedKeyWithConfig when the CA refused to sign the key due to policy (see
+// shared.SignatureDenial)
+type DeniedError struct {
+	// One of the shared.Denial* codes
+	Code     string
+	Reason   string
+	BotName  string
+	TeamName string
+	// The CA's overrides of the remediation messages (see Config.Messages)
+	Messages shared.Messages
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("the CA bot %s denied the request: %s", e.BotName, e.Reason)
+}
+
+// Remediation returns what the user can do about the denial
+func (e *DeniedError) Remediation() string {
+	id := shared.MessageDenialPrefix + e.Code
+	if _, ok := shared.DefaultMessages[id]; !ok {
+		id = shared.MessageDenialPrefix + shared.DenialOther
+	}
+	return e.Messages.Render(id, map[string]interface{}{"BotName": e.BotName, "TeamName": e.TeamName})
+}
@@ -0,0 +1,20 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeniedErrorRemediation(t *testing.T) {
+	denied := &DeniedError{Code: shared.DenialOther, BotName: "cabot", TeamName: "team.ssh"}
+	require.Equal(t, "Contact the administrators of cabot for help.", denied.Remediation())
+
+	// Unknown codes are treated like DenialOther
+	denied.Code = "some_new_code"
+	require.Equal(t, "Contact the administrators of cabot for help.", denied.Remediation())
+
+	denied.Messages = shared.Messages{shared.MessageDenialPrefix + shared.DenialOther: "Read https://wiki.example.com/ssh or ask in {{.TeamName}}"}
+	require.Equal(t, "Read https://wiki.example.com/ssh or ask in team.ssh", denied.Remediation())
+}
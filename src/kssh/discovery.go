@@ -0,0 +1,124 @@
+package kssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to keep collecting config responses after the first one arrives. Every CA bot in the discovery channel
+// responds independently so kssh cannot know how many responses to expect.
+var discoveryGracePeriod = 500 * time.Millisecond
+
+// DiscoverConfigs asks the CA bots in the discovery channel (see SetDiscoveryChannel) for the configs of the teams the
+// current user is in rather than reading the config of every team. Returns configs deduplicated by bot name like
+// LoadConfigs. A config is only accepted if it was sent by the bot it names and is for a team the user is in so that
+// another member of the discovery team cannot redirect kssh to their own bot.
+func (r *Requester) DiscoverConfigs() (configs []Config, botNames []string, err error) {
+	if r.DiscoveryTeam == "" {
+		return nil, nil, fmt.Errorf("no discovery channel is configured")
+	}
+	sub, err := r.transport.Subscribe()
+	if err != nil {
+		return nil, nil, fmt.Errorf("error subscribing to messages: %v", err)
+	}
+	messages, readErrors, stopReading := readInBackground(sub)
+	defer stopReading()
+
+	username := r.transport.GetUsername()
+	channel := r.DiscoveryChannel
+	send := func() error {
+		return r.transport.SendMessage(r.DiscoveryTeam, &channel, shared.GenerateConfigRequest(username), 0)
+	}
+	if err := send(); err != nil {
+		return nil, nil, err
+	}
+
+	var teams map[string]bool
+	var discovered []Config
+	var gracePeriod <-chan time.Time
+	timeout := time.After(r.Timeout)
+	resend := time.NewTicker(time.Second)
+	defer resend.Stop()
+	for {
+		select {
+		case <-gracePeriod:
+			configs, botNames = dedupeConfigs(discovered)
+			return configs, botNames, nil
+		case <-timeout:
+			if gracePeriod != nil {
+				configs, botNames = dedupeConfigs(discovered)
+				return configs, botNames, nil
+			}
+			return nil, nil, fmt.Errorf("timed out while waiting for a CA bot in %s#%s to respond to a config request", r.DiscoveryTeam, r.DiscoveryChannel)
+		case err := <-readErrors:
+			return nil, nil, fmt.Errorf("failed to read message: %v", err)
+		case <-resend.C:
+			if gracePeriod != nil {
+				continue
+			}
+			if err := send(); err != nil {
+				return nil, nil, err
+			}
+		case msg := <-messages:
+			if !strings.HasPrefix(msg.Body, shared.ConfigResponsePreamble) {
+				continue
+			}
+			response, err := shared.ParseConfigResponse(msg.Body)
+			if err != nil {
+				log.Debugf("Ignoring a malformed config response from %s: %v", msg.Sender, err)
+				continue
+			}
+			if response.Username != username {
+				continue
+			}
+			if teams == nil {
+				teamList, err := r.getAllTeams()
+				if err != nil {
+					return nil, nil, err
+				}
+				teams = make(map[string]bool)
+				for _, team := range teamList {
+					teams[team] = true
+				}
+			}
+			for _, raw := range response.Configs {
+				var conf Config
+				if err := json.Unmarshal(raw, &conf); err != nil {
+					log.Debugf("Ignoring a malformed config sent by %s: %v", msg.Sender, err)
+					continue
+				}
+				if conf.BotName != msg.Sender || !teams[conf.TeamName] {
+					log.Debugf("Ignoring a config for bot=%s, team=%s sent by %s", conf.BotName, conf.TeamName, msg.Sender)
+					continue
+				}
+				discovered = append(discovered, conf)
+			}
+			if gracePeriod == nil {
+				gracePeriod = time.After(discoveryGracePeriod)
+			}
+		}
+	}
+}
+
+// Deduplicate the given configs by bot name, preferring configs from parent teams like LoadConfigs
+func dedupeConfigs(discovered []Config) (configs []Config, botNames []string) {
+	sort.SliceStable(discovered, func(i, j int) bool {
+		return strings.Count(discovered[i].TeamName, ".") < strings.Count(discovered[j].TeamName, ".")
+	})
+	seen := make(map[string]bool)
+	for _, conf := range discovered {
+		if seen[conf.BotName] {
+			continue
+		}
+		seen[conf.BotName] = true
+		configs = append(configs, conf)
+		botNames = append(botNames, conf.BotName)
+	}
+	return configs, botNames
+}
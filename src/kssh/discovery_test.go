@@ -0,0 +1,91 @@
+package kssh_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/kssh"
+	"github.com/keybase/bot-sshca/src/kssh/ksshtest"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+// Returns a Responder that answers config requests with the given raw configs and otherwise behaves like NewBot
+func discoveryBot(configs ...string) ksshtest.Responder {
+	bot := ksshtest.NewBot(signWith("signed-key"))
+	return func(msg kssh.ChatMessage) []string {
+		if !shared.IsConfigRequest(msg.Body) {
+			return bot(msg)
+		}
+		response := shared.ConfigResponse{Username: msg.Sender}
+		for _, conf := range configs {
+			response.Configs = append(response.Configs, json.RawMessage(conf))
+		}
+		bytes, _ := json.Marshal(response)
+		return []string{shared.ConfigResponsePreamble + string(bytes)}
+	}
+}
+
+func newDiscoveryRequester(transport *ksshtest.Transport) kssh.Requester {
+	requester := newRequester(transport)
+	requester.DiscoveryTeam = "acme"
+	requester.DiscoveryChannel = "kssh-discovery"
+	return requester
+}
+
+func TestDiscoverConfigs(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "acme.ssh", "cabot", discoveryBot(
+		`{"teamname":"acme.ssh.staging","botname":"cabot"}`,
+		`{"teamname":"acme.ssh","botname":"cabot"}`,
+	))
+	transport.Teams = []string{"acme", "acme.ssh", "acme.ssh.staging"}
+	// The KV store is not read when discovery succeeds
+	transport.Configs = map[string]string{}
+	requester := newDiscoveryRequester(transport)
+
+	configs, botNames, err := requester.LoadConfigs()
+	require.NoError(t, err)
+	require.Equal(t, []string{"cabot"}, botNames)
+	require.Equal(t, "acme.ssh", configs[0].TeamName)
+
+	sent := transport.Sent()
+	require.Equal(t, shared.GenerateConfigRequest("alice"), sent[0].Body)
+	require.Equal(t, "alice", sent[0].Sender)
+
+	resp, err := requester.GetSignedKey("", shared.SignatureRequest{UUID: "uuid-1"})
+	require.NoError(t, err)
+	require.Equal(t, "signed-key", resp.SignedKey)
+}
+
+func TestDiscoverConfigsIgnoresUntrustedConfigs(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "acme.ssh", "cabot", discoveryBot(
+		// A config for a different bot than the one that sent it
+		`{"teamname":"acme.ssh","botname":"evilbot"}`,
+		// A config for a team the user is not in
+		`{"teamname":"evil.ssh","botname":"cabot"}`,
+	))
+	requester := newDiscoveryRequester(transport)
+
+	configs, _, err := requester.DiscoverConfigs()
+	require.NoError(t, err)
+	require.Empty(t, configs)
+
+	// LoadConfigs falls back to the KV store
+	configs, botNames, err := requester.LoadConfigs()
+	require.NoError(t, err)
+	require.Equal(t, []string{"cabot"}, botNames)
+	require.Equal(t, "acme.ssh", configs[0].TeamName)
+}
+
+func TestDiscoverConfigsNoBot(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "acme.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	requester := newDiscoveryRequester(transport)
+
+	_, _, err := requester.DiscoverConfigs()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+
+	configs, _, err := requester.LoadConfigs()
+	require.NoError(t, err)
+	require.Equal(t, "acme.ssh", configs[0].TeamName)
+}
@@ -0,0 +1,34 @@
+package kssh
+
+import (
+	"sort"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// MissingExtensions returns the names of the requested custom extensions (see `kssh --extension`) that cert does not
+// include with the requested value, sorted by name
+func MissingExtensions(cert *ssh.Certificate, extensions map[string]string) []string {
+	var missing []string
+	for name, value := range extensions {
+		actual, ok := cert.Extensions[name]
+		if !ok || actual != value {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// IsCertWithExtensions returns whether the certificate for the signed key at keyPath includes all of the requested
+// custom extensions. Always true if no extensions were requested.
+func IsCertWithExtensions(keyPath string, extensions map[string]string) bool {
+	if len(extensions) == 0 {
+		return true
+	}
+	cert, err := ReadCertificate(keyPath)
+	if err != nil {
+		return false
+	}
+	return len(MissingExtensions(cert, extensions)) == 0
+}
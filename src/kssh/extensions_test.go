@@ -0,0 +1,20 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMissingExtensions(t *testing.T) {
+	cert := &ssh.Certificate{Permissions: ssh.Permissions{Extensions: map[string]string{
+		"permit-pty":      "",
+		"groups@acme.com": "dba",
+		"login@acme.com":  "",
+	}}}
+	require.Empty(t, MissingExtensions(cert, nil))
+	require.Empty(t, MissingExtensions(cert, map[string]string{"groups@acme.com": "dba", "login@acme.com": ""}))
+	require.Equal(t, []string{"groups@acme.com", "role@acme.com"},
+		MissingExtensions(cert, map[string]string{"groups@acme.com": "root", "role@acme.com": "admin"}))
+}
@@ -0,0 +1,40 @@
+package kssh
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+)
+
+// If this environment variable is set, kssh ignores the feature flags in the client config so that a user can opt out
+// of a rollout that breaks their setup
+const NoFeatureFlagsEnvVar = "KSSH_NO_FEATURE_FLAGS"
+
+// A FeatureFlag enables a kssh behavior (one of shared.KnownFeatures) for Percent percent of users (see
+// KSSH_FEATURE_FLAGS). keybaseca only publishes the flags that apply to the team the config is written to.
+type FeatureFlag struct {
+	Name    string `json:"name"`
+	Percent int    `json:"percent"`
+}
+
+// FeatureEnabled returns whether the given feature is enabled for the given Keybase user. Each user is assigned to a
+// bucket between 0 and 99 by hashing the feature name and the username, so the result is the same on every run and
+// every machine, and raising the percentage only ever adds users. Features that are not in the config are disabled.
+func (c *Config) FeatureEnabled(feature, keybaseUser string) bool {
+	if os.Getenv(NoFeatureFlagsEnvVar) != "" {
+		return false
+	}
+	for _, flag := range c.FeatureFlags {
+		if flag.Name == feature {
+			return featureBucket(feature, keybaseUser) < flag.Percent
+		}
+	}
+	return false
+}
+
+// Returns the rollout bucket (0-99) of the given user for the given feature. The feature name is included in the hash
+// so that the first users to get one feature are not always the first users to get every feature.
+func featureBucket(feature, keybaseUser string) int {
+	hash := sha256.Sum256([]byte(feature + "\x00" + keybaseUser))
+	return int(binary.BigEndian.Uint64(hash[:8]) % 100)
+}
@@ -0,0 +1,47 @@
+package kssh
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFeatureEnabled(t *testing.T) {
+	conf := Config{FeatureFlags: []FeatureFlag{{Name: "no-disk", Percent: 0}}}
+	require.False(t, conf.FeatureEnabled("no-disk", "alice"))
+	require.False(t, conf.FeatureEnabled("other", "alice"))
+
+	conf.FeatureFlags[0].Percent = 100
+	require.True(t, conf.FeatureEnabled("no-disk", "alice"))
+	require.False(t, conf.FeatureEnabled("other", "alice"))
+
+	defer os.Setenv(NoFeatureFlagsEnvVar, os.Getenv(NoFeatureFlagsEnvVar))
+	os.Setenv(NoFeatureFlagsEnvVar, "1")
+	require.False(t, conf.FeatureEnabled("no-disk", "alice"))
+	os.Unsetenv(NoFeatureFlagsEnvVar)
+
+	// Roughly the given percentage of users are enabled and raising the percentage never disables anyone
+	conf.FeatureFlags[0].Percent = 10
+	enabled := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		user := fmt.Sprintf("user%d", i)
+		if conf.FeatureEnabled("no-disk", user) {
+			enabled[user] = true
+		}
+	}
+	require.InDelta(t, 100, len(enabled), 40)
+	conf.FeatureFlags[0].Percent = 50
+	for user := range enabled {
+		require.True(t, conf.FeatureEnabled("no-disk", user))
+	}
+}
+
+func TestFeatureBucket(t *testing.T) {
+	require.Equal(t, featureBucket("no-disk", "alice"), featureBucket("no-disk", "alice"))
+	for i := 0; i < 100; i++ {
+		bucket := featureBucket("no-disk", fmt.Sprintf("user%d", i))
+		require.True(t, bucket >= 0 && bucket < 100)
+	}
+}
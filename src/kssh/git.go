@@ -0,0 +1,77 @@
+package kssh
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The remote commands that git runs over ssh
+var gitRemoteCommands = []string{"git-upload-pack", "git-receive-pack", "git-upload-archive"}
+
+// IsGitInvocation returns whether the given ssh arguments look like they came from git (eg
+// `user@host "git-upload-pack 'repo.git'"`). When kssh is used as git's core.sshCommand, stdout carries the git
+// protocol so kssh must not print anything to it.
+func IsGitInvocation(args []string) bool {
+	command := getRemoteCommand(args)
+	if len(command) == 0 {
+		return false
+	}
+	// git may pass the command as a single quoted argument or as separate arguments
+	program := strings.Fields(command[0])
+	if len(program) == 0 {
+		return false
+	}
+	for _, gitCommand := range gitRemoteCommands {
+		if program[0] == gitCommand {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the remote command (the arguments after the destination) from the given ssh arguments
+func getRemoteCommand(args []string) []string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+2 <= len(args) {
+				return args[i+2:]
+			}
+			return nil
+		}
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			if len(arg) == 2 && strings.ContainsRune(sshFlagsWithArguments, rune(arg[1])) {
+				i++
+			}
+			continue
+		}
+		return args[i+1:]
+	}
+	return nil
+}
+
+// InstallGit configures git to use kssh for all ssh connections by setting core.sshCommand in the user's global git
+// config. If botName is not empty, kssh is configured to always use that bot.
+func InstallGit(botName string) error {
+	ksshPath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to determine the location of kssh: %v", err)
+	}
+	ksshPath, err = filepath.Abs(ksshPath)
+	if err != nil {
+		return fmt.Errorf("failed to determine the location of kssh: %v", err)
+	}
+	// git runs core.sshCommand via the shell so the path must be quoted in case it contains spaces
+	command := shellJoin([]string{filepath.ToSlash(ksshPath)})
+	if botName != "" {
+		command += " --bot " + shellJoin([]string{botName})
+	}
+	output, err := exec.Command("git", "config", "--global", "core.sshCommand", command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to set core.sshCommand: %s (%v)", strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
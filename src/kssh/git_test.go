@@ -0,0 +1,16 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsGitInvocation(t *testing.T) {
+	require.True(t, IsGitInvocation([]string{"git@github.com", "git-upload-pack 'keybase/bot-sshca.git'"}))
+	require.True(t, IsGitInvocation([]string{"-o", "SendEnv=GIT_PROTOCOL", "-p", "2222", "git@server", "git-receive-pack '/srv/repo.git'"}))
+	require.True(t, IsGitInvocation([]string{"git@server", "git-upload-archive", "'repo.git'"}))
+	require.False(t, IsGitInvocation([]string{"root@server"}))
+	require.False(t, IsGitInvocation([]string{"root@server", "ls", "-l"}))
+	require.False(t, IsGitInvocation([]string{"-p", "git-upload-pack"}))
+}
@@ -0,0 +1,102 @@
+package kssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// HookPoint is a point in the lifecycle of kssh where user supplied hooks are run
+type HookPoint string
+
+const (
+	// Run before kssh requests a new certificate from the CA. Not run if an existing certificate is reused.
+	PreProvision HookPoint = "pre-provision"
+	// Run after kssh has received and stored a new certificate
+	PostProvision HookPoint = "post-provision"
+	// Run right before kssh execs ssh (or mosh with --mosh)
+	PreExec HookPoint = "pre-exec"
+)
+
+// HookContext is the JSON object passed to hooks on stdin
+type HookContext struct {
+	Hook    HookPoint `json:"hook"`
+	BotName string    `json:"bot_name,omitempty"`
+	KeyPath string    `json:"key_path,omitempty"`
+	SSHArgs []string  `json:"ssh_args,omitempty"`
+}
+
+// Get the directory that hooks are loaded from. Respects $XDG_CONFIG_HOME and defaults to ~/.config/kssh/hooks.d
+func GetHooksDirectory() string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "kssh", "hooks.d")
+	}
+	return shared.ExpandPathWithTilde("~/.config/kssh/hooks.d")
+}
+
+// Returns the sorted list of executable hooks in the given directory. A missing directory has no hooks.
+func listHooks(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list hooks in %s: %v", dir, err)
+	}
+	var hooks []string
+	for _, f := range files {
+		if !f.Mode().IsRegular() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		if runtime.GOOS != "windows" && f.Mode()&0111 == 0 {
+			log.Debugf("Skipping non-executable hook %s", f.Name())
+			continue
+		}
+		hooks = append(hooks, filepath.Join(dir, f.Name()))
+	}
+	sort.Strings(hooks)
+	return hooks, nil
+}
+
+// RunHooks runs every executable in the hooks directory in lexical order (in the style of run-parts) for the given
+// hook point. Each hook is called with the hook point as its only argument and the JSON serialized HookContext on
+// stdin. Hook output is sent to stderr so that it does not interfere with ssh. Returns an error (and stops running
+// further hooks) as soon as a hook exits with a non-zero status, which aborts kssh.
+func RunHooks(point HookPoint, hookContext HookContext) error {
+	hooks, err := listHooks(GetHooksDirectory())
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	hookContext.Hook = point
+	input, err := json.Marshal(hookContext)
+	if err != nil {
+		return fmt.Errorf("failed to serialize hook context: %v", err)
+	}
+
+	for _, hook := range hooks {
+		log.WithField("hook", hook).Debugf("Running %s hook", point)
+		cmd := exec.Command(hook, string(point))
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		err = cmd.Run()
+		if err != nil {
+			return fmt.Errorf("%s hook %s failed: %v", point, filepath.Base(hook), err)
+		}
+	}
+	return nil
+}
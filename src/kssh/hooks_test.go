@@ -0,0 +1,130 @@
+package kssh
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunHooks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts")
+	}
+	// Each hook appends its name to the log so that the order hooks ran in can be checked
+	record := func(name string) string {
+		return "#!/bin/sh\necho " + name + " >> \"$HOOK_LOG\"\n"
+	}
+	type hook struct {
+		script string
+		mode   os.FileMode
+	}
+	for _, test := range []struct {
+		name  string
+		hooks map[string]hook
+		// Whether the hooks directory is created at all
+		missingDirectory bool
+		expectedRuns     []string
+		expectedError    string
+	}{
+		{
+			name:             "missing directory",
+			missingDirectory: true,
+		},
+		{
+			name:  "empty directory",
+			hooks: map[string]hook{},
+		},
+		{
+			name: "lexical order",
+			hooks: map[string]hook{
+				"20-second": {record("20-second"), 0755},
+				"10-first":  {record("10-first"), 0755},
+				"30-third":  {record("30-third"), 0755},
+			},
+			expectedRuns: []string{"10-first", "20-second", "30-third"},
+		},
+		{
+			name: "non-executable and hidden files are skipped",
+			hooks: map[string]hook{
+				"10-first":      {record("10-first"), 0755},
+				"20-not-exec":   {record("20-not-exec"), 0644},
+				".30-hidden":    {record(".30-hidden"), 0755},
+				"40-executable": {record("40-executable"), 0700},
+			},
+			expectedRuns: []string{"10-first", "40-executable"},
+		},
+		{
+			name: "non-zero exit stops later hooks",
+			hooks: map[string]hook{
+				"10-first": {record("10-first"), 0755},
+				"20-fail":  {record("20-fail") + "exit 3\n", 0755},
+				"30-never": {record("30-never"), 0755},
+			},
+			expectedRuns:  []string{"10-first", "20-fail"},
+			expectedError: "pre-exec hook 20-fail failed",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "kssh-hooks")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			hookLog := filepath.Join(dir, "hooks.log")
+			os.Setenv("XDG_CONFIG_HOME", dir)
+			defer os.Unsetenv("XDG_CONFIG_HOME")
+			os.Setenv("HOOK_LOG", hookLog)
+			defer os.Unsetenv("HOOK_LOG")
+			if !test.missingDirectory {
+				require.NoError(t, os.MkdirAll(GetHooksDirectory(), 0700))
+			}
+			for name, hook := range test.hooks {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(GetHooksDirectory(), name), []byte(hook.script), hook.mode))
+			}
+
+			err = RunHooks(PreExec, HookContext{BotName: "cabot"})
+			if test.expectedError != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), test.expectedError)
+			} else {
+				require.NoError(t, err)
+			}
+			var runs []string
+			contents, err := ioutil.ReadFile(hookLog)
+			if !os.IsNotExist(err) {
+				require.NoError(t, err)
+				runs = strings.Fields(string(contents))
+			}
+			require.Equal(t, test.expectedRuns, runs)
+		})
+	}
+}
+
+func TestRunHooksContext(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("hooks are shell scripts")
+	}
+	dir, err := ioutil.TempDir("", "kssh-hooks")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_CONFIG_HOME", dir)
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	require.NoError(t, os.MkdirAll(GetHooksDirectory(), 0700))
+	// The hook point is passed as the only argument and the context on stdin
+	script := "#!/bin/sh\necho \"$1\" > \"$(dirname \"$0\")/../arg\"\ncat > \"$(dirname \"$0\")/../context\"\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(GetHooksDirectory(), "10-hook"), []byte(script), 0755))
+
+	require.NoError(t, RunHooks(PostProvision, HookContext{BotName: "cabot", KeyPath: "/tmp/key"}))
+	arg, err := ioutil.ReadFile(filepath.Join(dir, "kssh", "arg"))
+	require.NoError(t, err)
+	require.Equal(t, "post-provision\n", string(arg))
+	contents, err := ioutil.ReadFile(filepath.Join(dir, "kssh", "context"))
+	require.NoError(t, err)
+	var hookContext HookContext
+	require.NoError(t, json.Unmarshal(contents, &hookContext))
+	require.Equal(t, HookContext{Hook: PostProvision, BotName: "cabot", KeyPath: "/tmp/key"}, hookContext)
+}
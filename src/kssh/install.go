@@ -0,0 +1,218 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// The places that kssh can install a signed certificate to (see SetInstallTargets)
+const (
+	// The key and certificate are written to ~/.ssh/kssh and passed to ssh via -i
+	InstallTargetFile = "file"
+	// The key and certificate are loaded into the ssh-agent
+	InstallTargetAgent = "agent"
+	// A key on a PKCS#11 token (eg a smart card or YubiKey) is signed and the certificate is written next to the
+	// signed key so that ssh can use it together with the token (see SetPKCS11Provider)
+	InstallTargetPKCS11 = "pkcs11"
+)
+
+// The install targets used if none are configured
+var DefaultInstallTargets = []string{InstallTargetFile, InstallTargetAgent}
+
+// InstallTargets describes where kssh installs newly signed certificates. Any combination is allowed as long as at
+// least one target is selected. A key that is only installed in the agent is generated in memory and never written to
+// disk (like --no-disk).
+type InstallTargets struct {
+	File   bool
+	Agent  bool
+	PKCS11 bool
+	// The PKCS#11 library used to talk to the token. Set if PKCS11 is set.
+	PKCS11Provider string
+}
+
+// ParseInstallTargets parses the given comma separated list of install targets
+func ParseInstallTargets(list string) ([]string, error) {
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			continue
+		}
+		if target != InstallTargetFile && target != InstallTargetAgent && target != InstallTargetPKCS11 {
+			return nil, fmt.Errorf("unknown install target %s, expected one of %s, %s, %s", target,
+				InstallTargetFile, InstallTargetAgent, InstallTargetPKCS11)
+		}
+		if !containsString(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("at least one install target is required")
+	}
+	return targets, nil
+}
+
+// SetInstallTargets sets where newly signed certificates are installed to. targets is a comma separated list of
+// InstallTargetFile, InstallTargetAgent, and InstallTargetPKCS11. An empty string restores DefaultInstallTargets.
+func SetInstallTargets(list string) error {
+	var targets []string
+	if strings.TrimSpace(list) != "" {
+		var err error
+		targets, err = ParseInstallTargets(list)
+		if err != nil {
+			return err
+		}
+	}
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		if containsString(targets, InstallTargetPKCS11) && lcf.PKCS11Provider == "" {
+			return fmt.Errorf("the %s install target requires a PKCS#11 provider, set one via --set-pkcs11-provider first",
+				InstallTargetPKCS11)
+		}
+		lcf.InstallTargets = targets
+		return nil
+	})
+}
+
+// SetPKCS11Provider sets the PKCS#11 library (eg /usr/lib/opensc-pkcs11.so) that is used to talk to the token for the
+// InstallTargetPKCS11 install target. The path must be absolute.
+func SetPKCS11Provider(path string) error {
+	path = shared.ExpandPathWithTilde(path)
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("the PKCS#11 provider must be an absolute path: %s", path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("failed to find the PKCS#11 provider: %v", err)
+	}
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.PKCS11Provider = path
+		return nil
+	})
+}
+
+// GetInstallTargets returns where newly signed certificates should be installed to
+func GetInstallTargets() (InstallTargets, error) {
+	lcf, err := getCurrentConfigFile()
+	if err != nil {
+		return InstallTargets{}, err
+	}
+	targets := lcf.InstallTargets
+	if len(targets) == 0 {
+		targets = DefaultInstallTargets
+	}
+	installTargets := InstallTargets{
+		File:   containsString(targets, InstallTargetFile),
+		Agent:  containsString(targets, InstallTargetAgent),
+		PKCS11: containsString(targets, InstallTargetPKCS11),
+	}
+	if installTargets.PKCS11 {
+		if lcf.PKCS11Provider == "" {
+			return installTargets, fmt.Errorf("the %s install target is configured but no PKCS#11 provider is set "+
+				"(see --set-pkcs11-provider)", InstallTargetPKCS11)
+		}
+		installTargets.PKCS11Provider = lcf.PKCS11Provider
+	}
+	return installTargets, nil
+}
+
+// GetPKCS11KeyPath returns the path that the certificate for the PKCS#11 token key that belongs with the signed key at
+// keyPath is stored under. The private key never leaves the token so only the public key and certificate are stored
+// (at shared.KeyPathToPubKey and shared.KeyPathToCert of the returned path).
+func GetPKCS11KeyPath(keyPath string) string {
+	return keyPath + "-pkcs11"
+}
+
+// IsReusablePKCS11Cert returns whether there is a valid certificate for the current Keybase user for the PKCS#11
+// token key that belongs with keyPath
+func IsReusablePKCS11Cert(keyPath string) bool {
+	tokenKeyPath := GetPKCS11KeyPath(keyPath)
+	cert, err := ReadCertificate(tokenKeyPath)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	if now.Before(time.Unix(int64(cert.ValidAfter), 0)) || !now.Before(time.Unix(int64(cert.ValidBefore), 0)) {
+		return false
+	}
+	return IsCertForCurrentUser(tokenKeyPath)
+}
+
+// The command used to list the public keys on a PKCS#11 token. Swapped out in tests.
+var listPKCS11Keys = func(provider string) ([]byte, error) {
+	return exec.Command("ssh-keygen", "-D", provider).Output()
+}
+
+// Get the public key on the PKCS#11 token accessed via provider. Tokens with multiple keys use the first one, which
+// matches the key that ssh tries first.
+func getPKCS11PublicKey(provider string) (string, error) {
+	output, err := listPKCS11Keys(provider)
+	if err != nil {
+		return "", fmt.Errorf("failed to list the keys on the PKCS#11 token (is it plugged in?): %v", err)
+	}
+	for _, line := range strings.Split(string(output), "\n") {
+		if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line)); err == nil {
+			return strings.TrimSpace(line), nil
+		}
+	}
+	return "", fmt.Errorf("did not find any keys on the PKCS#11 token")
+}
+
+// ProvisionPKCS11Key asks the CA to sign the public key on the PKCS#11 token accessed via provider and stores the
+// certificate next to the signed key at keyPath (see GetPKCS11KeyPath)
+func ProvisionPKCS11Key(requester *Requester, botName, keyPath, provider string, elevate bool) error {
+	tokenKeyPath := GetPKCS11KeyPath(keyPath)
+	err := RunHooks(PreProvision, HookContext{BotName: botName, KeyPath: tokenKeyPath})
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Reading the public key from the PKCS#11 token...")
+	requester.reportProgress("Reading the key on the PKCS#11 token")
+	pubKey, err := getPKCS11PublicKey(provider)
+	if err != nil {
+		return err
+	}
+	conf, signedKey, err := requestCertificate(requester, botName, keyPath, pubKey, elevate)
+	if err != nil {
+		return err
+	}
+
+	err = MakeDotSSH()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(tokenKeyPath), 0700)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(shared.KeyPathToPubKey(tokenKeyPath), []byte(pubKey+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write the PKCS#11 public key to disk: %v", err)
+	}
+	err = ioutil.WriteFile(shared.KeyPathToCert(tokenKeyPath), []byte(signedKey), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write the PKCS#11 certificate to disk: %v", err)
+	}
+	err = CacheClientConfig(tokenKeyPath, conf)
+	if err != nil {
+		return fmt.Errorf("Failed to cache the client config: %v", err)
+	}
+	return RunHooks(PostProvision, HookContext{BotName: botName, KeyPath: tokenKeyPath})
+}
+
+// PKCS11SSHArgs returns the ssh arguments that make ssh offer the key on the PKCS#11 token together with the
+// certificate stored for it by ProvisionPKCS11Key
+func PKCS11SSHArgs(keyPath, provider string) []string {
+	return []string{
+		"-o", "PKCS11Provider=" + provider,
+		"-o", "CertificateFile=" + shared.KeyPathToCert(GetPKCS11KeyPath(keyPath)),
+	}
+}
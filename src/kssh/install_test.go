@@ -0,0 +1,80 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallTargets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-install")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig := localConfigFileLocation
+	defer func() { localConfigFileLocation = oldConfig }()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+
+	targets, err := ParseInstallTargets(" agent, file,agent ")
+	require.NoError(t, err)
+	require.Equal(t, []string{InstallTargetAgent, InstallTargetFile}, targets)
+	_, err = ParseInstallTargets("file,disk")
+	require.Error(t, err)
+	_, err = ParseInstallTargets(" , ")
+	require.Error(t, err)
+
+	installTargets, err := GetInstallTargets()
+	require.NoError(t, err)
+	require.Equal(t, InstallTargets{File: true, Agent: true}, installTargets)
+
+	require.NoError(t, SetInstallTargets("file"))
+	installTargets, err = GetInstallTargets()
+	require.NoError(t, err)
+	require.Equal(t, InstallTargets{File: true}, installTargets)
+
+	// pkcs11 requires a provider
+	require.Error(t, SetInstallTargets("agent,pkcs11"))
+	require.Error(t, SetPKCS11Provider("relative/opensc-pkcs11.so"))
+	provider := filepath.Join(dir, "opensc-pkcs11.so")
+	require.Error(t, SetPKCS11Provider(provider))
+	require.NoError(t, ioutil.WriteFile(provider, []byte{}, 0644))
+	require.NoError(t, SetPKCS11Provider(provider))
+	require.NoError(t, SetInstallTargets("agent,pkcs11"))
+	installTargets, err = GetInstallTargets()
+	require.NoError(t, err)
+	require.Equal(t, InstallTargets{Agent: true, PKCS11: true, PKCS11Provider: provider}, installTargets)
+
+	require.NoError(t, SetInstallTargets(""))
+	installTargets, err = GetInstallTargets()
+	require.NoError(t, err)
+	require.Equal(t, InstallTargets{File: true, Agent: true}, installTargets)
+}
+
+func TestGetPKCS11PublicKey(t *testing.T) {
+	oldList := listPKCS11Keys
+	defer func() { listPKCS11Keys = oldList }()
+
+	listPKCS11Keys = func(provider string) ([]byte, error) {
+		require.Equal(t, "/usr/lib/opensc-pkcs11.so", provider)
+		return []byte("ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDDnQ2yZgJ1bCJO8hIvOp0/ZVZI5UgTgKTHDnV8Ur56zDRW9LnyBhpAUNmOrqTwkXv4mDKpWrUIbz+AEoDEvd0wv69MPJnL3OqUQNWR5bIdZYgp7s+rZbH4ZUvnS4fAo3gd6Dco9EwuUNlHh1XRvhhp3X68sbwzmA5UlbzWJt3ljQ== pkcs11 key\n" +
+			"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIDm7gzhrw4ixBzsLMFYBmu3yNRpjq2PCn7/Sw6UWOk4D second key\n"), nil
+	}
+	key, err := getPKCS11PublicKey("/usr/lib/opensc-pkcs11.so")
+	require.NoError(t, err)
+	require.Contains(t, key, "pkcs11 key")
+
+	listPKCS11Keys = func(provider string) ([]byte, error) {
+		return []byte("\n"), nil
+	}
+	_, err = getPKCS11PublicKey("/usr/lib/opensc-pkcs11.so")
+	require.Error(t, err)
+
+	listPKCS11Keys = func(provider string) ([]byte, error) {
+		return nil, fmt.Errorf("no slots")
+	}
+	_, err = getPKCS11PublicKey("/usr/lib/opensc-pkcs11.so")
+	require.Error(t, err)
+}
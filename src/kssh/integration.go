@@ -0,0 +1,272 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The markers around the blocks that InstallIntegration manages in the user's files. Running InstallIntegration again
+// replaces the block rather than adding another one.
+const (
+	integrationBlockStart = "# BEGIN kssh --install-integration"
+	integrationBlockEnd   = "# END kssh --install-integration"
+)
+
+// The files that InstallIntegration edits. Variables so that they can be changed in tests.
+var (
+	bashrcLocation          = shared.ExpandPathWithTilde("~/.bashrc")
+	zshrcLocation           = shared.ExpandPathWithTilde("~/.zshrc")
+	userSSHConfigLocation   = shared.ExpandPathWithTilde("~/.ssh/config")
+	systemdUserUnitLocation = shared.ExpandPathWithTilde("~/.config/systemd/user")
+)
+
+// How often the renewal timer makes sure that a valid certificate exists
+const renewalTimerInterval = "5min"
+
+// Run systemctl with the given arguments. A variable so that it can be replaced in tests.
+var runSystemctl = func(args ...string) error {
+	output, err := exec.Command("systemctl", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl %s failed: %s (%v)", strings.Join(args, " "), strings.TrimSpace(string(output)), err)
+	}
+	return nil
+}
+
+// IntegrationOptions configures InstallIntegration
+type IntegrationOptions struct {
+	// The bot that git, the ProxyCommand, and the renewal timer use. Empty means the default bot.
+	BotName string
+	// The shell to install completion for (bash or zsh). Usually the base name of $SHELL.
+	Shell string
+	// The ssh Host pattern (eg *.internal.example.com) to add a ProxyCommand stanza for to ~/.ssh/config. Empty means
+	// no stanza is added.
+	ProxyHosts string
+}
+
+// An IntegrationStep is the result of one of the steps of InstallIntegration
+type IntegrationStep struct {
+	Name string
+	// What was done, or why the step was skipped
+	Message string
+	Skipped bool
+	Err     error
+}
+
+// InstallIntegration sets up everything needed to use kssh day to day in one step: shell completion, a ProxyCommand
+// stanza in ~/.ssh/config (if opts.ProxyHosts is set), git's core.sshCommand, and a systemd user timer that keeps a
+// valid certificate on disk. Every step is attempted even if an earlier one fails and every step can be run again
+// safely.
+func InstallIntegration(opts IntegrationOptions) []IntegrationStep {
+	ksshPath, err := getKsshPath()
+	if err != nil {
+		return []IntegrationStep{{Name: "kssh", Err: err}}
+	}
+	return []IntegrationStep{
+		installCompletion(ksshPath, opts.Shell),
+		installProxyCommand(ksshPath, opts.BotName, opts.ProxyHosts),
+		installGitStep(opts.BotName),
+		installRenewalTimer(ksshPath, opts.BotName),
+	}
+}
+
+// Returns the absolute path of the running kssh binary
+func getKsshPath() (string, error) {
+	ksshPath, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the location of kssh: %v", err)
+	}
+	ksshPath, err = filepath.Abs(ksshPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the location of kssh: %v", err)
+	}
+	return filepath.ToSlash(ksshPath), nil
+}
+
+// Returns the kssh flags that select the current profile so that commands run later (eg by the renewal timer) use it
+func profileArgs() []string {
+	if GetProfile() == "" {
+		return nil
+	}
+	return []string{"--profile", GetProfile()}
+}
+
+func installCompletion(ksshPath, shell string) IntegrationStep {
+	step := IntegrationStep{Name: "shell completion"}
+	var rcFile, block string
+	command := shellJoin([]string{ksshPath})
+	switch shell {
+	case "bash":
+		rcFile = bashrcLocation
+		block = fmt.Sprintf("source <(%s --completion bash)", command)
+	case "zsh":
+		rcFile = zshrcLocation
+		// The completion script uses compdef which is only defined once compinit has run
+		block = fmt.Sprintf("(( $+functions[compdef] )) || { autoload -Uz compinit && compinit }\n"+
+			"source <(%s --completion zsh)", command)
+	default:
+		step.Skipped = true
+		step.Message = fmt.Sprintf("unsupported shell %q, run `kssh --completion SHELL` to get the script for one of %s",
+			shell, strings.Join(CompletionShells, ", "))
+		return step
+	}
+	step.Err = writeManagedBlock(rcFile, block, 0644)
+	step.Message = "added to " + rcFile + ", open a new shell to use it"
+	return step
+}
+
+func installProxyCommand(ksshPath, botName, hosts string) IntegrationStep {
+	step := IntegrationStep{Name: "ProxyCommand"}
+	if hosts == "" {
+		step.Skipped = true
+		step.Message = "pass --proxy-hosts PATTERN to add a ProxyCommand stanza to " + userSSHConfigLocation
+		return step
+	}
+	if strings.ContainsAny(hosts, "\n\r\"") {
+		step.Err = fmt.Errorf("invalid host pattern %q", hosts)
+		return step
+	}
+	args := append([]string{ksshPath}, profileArgs()...)
+	if botName != "" {
+		args = append(args, "--bot", botName)
+	}
+	command := shellJoin(append(args, "--non-interactive", "--proxy-mode"))
+	block := fmt.Sprintf("Host %s\n  ProxyCommand %s %%h %%p", hosts, command)
+	err := os.MkdirAll(filepath.Dir(userSSHConfigLocation), 0700)
+	if err == nil {
+		err = writeManagedBlock(userSSHConfigLocation, block, 0600)
+	}
+	step.Err = err
+	step.Message = "added a stanza for " + hosts + " to " + userSSHConfigLocation
+	return step
+}
+
+func installGitStep(botName string) IntegrationStep {
+	step := IntegrationStep{Name: "git", Message: "set core.sshCommand in ~/.gitconfig"}
+	if _, err := shared.LookPath("git"); err != nil {
+		step.Skipped = true
+		step.Message = "git is not installed"
+		return step
+	}
+	step.Err = InstallGit(botName)
+	return step
+}
+
+func installRenewalTimer(ksshPath, botName string) IntegrationStep {
+	step := IntegrationStep{Name: "renewal timer"}
+	if runtime.GOOS != "linux" {
+		step.Skipped = true
+		step.Message = "systemd user timers are only supported on linux, use ksshd-agent instead"
+		return step
+	}
+	if _, err := shared.LookPath("systemctl"); err != nil {
+		step.Skipped = true
+		step.Message = "systemd is not available, use ksshd-agent instead"
+		return step
+	}
+	name := "kssh-renew"
+	if GetProfile() != "" {
+		name += "-" + GetProfile()
+	}
+	service, timer := renewalUnits(ksshPath, botName)
+	err := os.MkdirAll(systemdUserUnitLocation, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(systemdUserUnitLocation, name+".service"), []byte(service), 0644)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(systemdUserUnitLocation, name+".timer"), []byte(timer), 0644)
+	}
+	if err == nil {
+		err = runSystemctl("--user", "daemon-reload")
+	}
+	if err == nil {
+		err = runSystemctl("--user", "enable", "--now", name+".timer")
+	}
+	step.Err = err
+	step.Message = "enabled " + name + ".timer"
+	return step
+}
+
+var systemdEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `%`, `%%`, `$`, `$$`)
+
+// Returns the contents of the systemd service and timer units that keep a valid certificate on disk. The service only
+// provisions a new certificate once the current one has expired so the timer runs it frequently.
+func renewalUnits(ksshPath, botName string) (service string, timer string) {
+	args := append([]string{ksshPath}, profileArgs()...)
+	if botName != "" {
+		args = append(args, "--bot", botName)
+	}
+	args = append(args, "--non-interactive", "--provision", "--no-exec")
+	var quoted []string
+	for _, arg := range args {
+		// systemd splits ExecStart= like a shell does for double quoted words and expands specifiers (%) and
+		// environment variables ($) even inside of quotes
+		quoted = append(quoted, `"`+systemdEscaper.Replace(arg)+`"`)
+	}
+	service = fmt.Sprintf(`[Unit]
+Description=Keep a valid kssh certificate on disk
+
+[Service]
+Type=oneshot
+ExecStart=%s
+`, strings.Join(quoted, " "))
+	timer = fmt.Sprintf(`[Unit]
+Description=Keep a valid kssh certificate on disk
+
+[Timer]
+OnStartupSec=1min
+OnUnitActiveSec=%s
+
+[Install]
+WantedBy=timers.target
+`, renewalTimerInterval)
+	return service, timer
+}
+
+// Write block to the given file between the integration markers. An existing block is replaced and otherwise the
+// block is appended so that settings earlier in the file (eg global ssh options) keep applying. The file is created
+// with the given permissions if it does not exist.
+func writeManagedBlock(filename, block string, perm os.FileMode) error {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %v", filename, err)
+	}
+	if info, err := os.Stat(filename); err == nil {
+		perm = info.Mode().Perm()
+	}
+	managed := integrationBlockStart + "\n" + block + "\n" + integrationBlockEnd + "\n"
+
+	existing := string(contents)
+	start := strings.Index(existing, integrationBlockStart)
+	end := strings.Index(existing, integrationBlockEnd)
+	var updated string
+	if start >= 0 && end > start {
+		end += len(integrationBlockEnd)
+		if end < len(existing) && existing[end] == '\n' {
+			end++
+		}
+		updated = existing[:start] + managed + existing[end:]
+	} else {
+		if existing != "" && !strings.HasSuffix(existing, "\n") {
+			existing += "\n"
+		}
+		if existing != "" {
+			existing += "\n"
+		}
+		updated = existing + managed
+	}
+	if updated == string(contents) {
+		return nil
+	}
+	err = ioutil.WriteFile(filename, []byte(updated), perm)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteManagedBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-integration")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config")
+
+	// Created with the given permissions if it does not exist
+	require.NoError(t, writeManagedBlock(filename, "Host a", 0600))
+	info, err := os.Stat(filename)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	contents, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, integrationBlockStart+"\nHost a\n"+integrationBlockEnd+"\n", string(contents))
+
+	// Appended after the existing contents and replaced in place when run again
+	require.NoError(t, ioutil.WriteFile(filename, []byte("User alice"), 0644))
+	require.NoError(t, writeManagedBlock(filename, "Host a", 0600))
+	require.NoError(t, ioutil.WriteFile(filename, append(mustReadFile(t, filename), []byte("Host other\n")...), 0644))
+	require.NoError(t, writeManagedBlock(filename, "Host b", 0600))
+	require.NoError(t, writeManagedBlock(filename, "Host b", 0600))
+	require.Equal(t, "User alice\n\n"+integrationBlockStart+"\nHost b\n"+integrationBlockEnd+"\nHost other\n", string(mustReadFile(t, filename)))
+}
+
+func mustReadFile(t *testing.T, filename string) []byte {
+	contents, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	return contents
+}
+
+func TestInstallCompletionAndProxyCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-integration")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldBashrc, oldZshrc, oldSSHConfig := bashrcLocation, zshrcLocation, userSSHConfigLocation
+	defer func() { bashrcLocation, zshrcLocation, userSSHConfigLocation = oldBashrc, oldZshrc, oldSSHConfig }()
+	bashrcLocation = filepath.Join(dir, ".bashrc")
+	zshrcLocation = filepath.Join(dir, ".zshrc")
+	userSSHConfigLocation = filepath.Join(dir, ".ssh", "config")
+
+	step := installCompletion("/opt/my tools/kssh", "bash")
+	require.NoError(t, step.Err)
+	require.Contains(t, string(mustReadFile(t, bashrcLocation)), "source <('/opt/my tools/kssh' --completion bash)")
+	step = installCompletion("/usr/bin/kssh", "zsh")
+	require.NoError(t, step.Err)
+	require.Contains(t, string(mustReadFile(t, zshrcLocation)), "source <(/usr/bin/kssh --completion zsh)")
+	step = installCompletion("/usr/bin/kssh", "fish")
+	require.True(t, step.Skipped)
+
+	step = installProxyCommand("/usr/bin/kssh", "", "")
+	require.True(t, step.Skipped)
+	_, err = os.Stat(userSSHConfigLocation)
+	require.True(t, os.IsNotExist(err))
+	step = installProxyCommand("/usr/bin/kssh", "cabot", "*.internal.example.com")
+	require.NoError(t, step.Err)
+	require.Contains(t, string(mustReadFile(t, userSSHConfigLocation)),
+		"Host *.internal.example.com\n  ProxyCommand /usr/bin/kssh --bot cabot --non-interactive --proxy-mode %h %p\n")
+	step = installProxyCommand("/usr/bin/kssh", "", "evil\n  ProxyCommand sh")
+	require.Error(t, step.Err)
+}
+
+func TestRenewalUnits(t *testing.T) {
+	defer func() { require.NoError(t, SetProfile("")) }()
+	require.NoError(t, SetProfile("work"))
+
+	service, timer := renewalUnits("/opt/100% kssh/kssh", "cabot")
+	require.Contains(t, service, `ExecStart="/opt/100%% kssh/kssh" "--profile" "work" "--bot" "cabot" "--non-interactive" "--provision" "--no-exec"`)
+	require.Contains(t, timer, "OnUnitActiveSec="+renewalTimerInterval)
+	require.True(t, strings.HasSuffix(timer, "WantedBy=timers.target\n"))
+}
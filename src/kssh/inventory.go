@@ -0,0 +1,117 @@
+package kssh
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long the hosts inventory cached by kssh --list-hosts is used for shell completion before it is fetched again
+const InventoryCacheTTL = time.Hour
+
+// An InventoryEntry is a host from the hosts inventory of one of the current user's teams (see shared.InventoryPath)
+type InventoryEntry struct {
+	shared.InventoryHost
+	// The team whose inventory lists the host
+	Team string `json:"team"`
+}
+
+// GetInventory returns the hosts listed in the hosts inventories of the current user's teams, sorted by host. If
+// botName is not empty, only the teams that use that bot are included. Hosts listed by multiple teams are only
+// included once (for the top most team). Inventories that cannot be read or parsed are skipped.
+func (r *Requester) GetInventory(botName string) ([]InventoryEntry, error) {
+	teams, err := r.getAllTeams()
+	if err != nil {
+		return nil, err
+	}
+	sortTeamsByDepth(teams)
+	var entries []InventoryEntry
+	seen := make(map[string]bool)
+	for _, team := range teams {
+		if botName != "" && !r.isTeamForBot(team, botName) {
+			continue
+		}
+		contents, found, err := r.transport.ReadFile(shared.InventoryPath(team))
+		if err != nil {
+			log.Debugf("Failed to read the hosts inventory for team %s: %v", team, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		hosts, err := shared.ParseInventory(contents)
+		if err != nil {
+			log.Warnf("Skipping the hosts inventory for team %s: %v", team, err)
+			continue
+		}
+		for _, host := range hosts {
+			if !seen[host.Host] {
+				seen[host.Host] = true
+				entries = append(entries, InventoryEntry{InventoryHost: host, Team: team})
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Host < entries[j].Host })
+	return entries, nil
+}
+
+// Returns whether botName is the CA bot for the given team, either via the team's KV store or via a config the bot
+// published as a restricted bot
+func (r *Requester) isTeamForBot(team, botName string) bool {
+	conf, err := r.LoadConfig(team)
+	if err == nil && conf != nil {
+		return conf.BotName == botName
+	}
+	_, found, err := r.transport.ReadFile(shared.ClientConfigPath(botName, team))
+	return err == nil && found
+}
+
+// The hosts inventory cached on disk for shell completion
+type inventoryCache struct {
+	// The unix time at which the inventory was fetched
+	UpdatedAt int64 `json:"updated_at"`
+	// The bot the inventory was filtered by. Empty if it covers every team.
+	BotName string           `json:"bot_name,omitempty"`
+	Hosts   []InventoryEntry `json:"hosts"`
+}
+
+func getInventoryCachePath() (string, error) {
+	stateDirectory, err := GetStateDirectory()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateDirectory, "hosts-inventory.json"), nil
+}
+
+// CacheInventory stores the given hosts inventory (as returned by GetInventory for botName) for shell completion
+func CacheInventory(botName string, hosts []InventoryEntry) error {
+	cachePath, err := getInventoryCachePath()
+	if err != nil {
+		return err
+	}
+	// Shell completion may read the cache while another kssh process is writing it
+	return jsonStore{path: cachePath, perm: 0600}.Write(inventoryCache{UpdatedAt: time.Now().Unix(), BotName: botName, Hosts: hosts})
+}
+
+// GetCachedInventory returns the hosts inventory stored by CacheInventory for botName. ok is false if there is no
+// cached inventory for botName or if it is older than InventoryCacheTTL.
+func GetCachedInventory(botName string) (hosts []InventoryEntry, ok bool, err error) {
+	cachePath, err := getInventoryCachePath()
+	if err != nil {
+		return nil, false, err
+	}
+	// cache is empty if no inventory has been cached yet
+	var cache inventoryCache
+	err = jsonStore{path: cachePath, perm: 0600}.Read(&cache)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read the cached hosts inventory: %v", err)
+	}
+	if cache.BotName != botName || time.Since(time.Unix(cache.UpdatedAt, 0)) > InventoryCacheTTL {
+		return nil, false, nil
+	}
+	return cache.Hosts, true, nil
+}
@@ -0,0 +1,39 @@
+package kssh_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/kssh"
+	"github.com/keybase/bot-sshca/src/kssh/ksshtest"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetInventory(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", nil)
+	otherConfig, _ := json.Marshal(kssh.Config{TeamName: "team.ssh.staging", BotName: "otherbot"})
+	transport.Teams = []string{"team.ssh.staging", "team.ssh", "team.other", "team.broken"}
+	transport.Configs["team.ssh.staging"] = string(otherConfig)
+	transport.Files = map[string]string{
+		shared.InventoryPath("team.ssh"):         "web.example.com Web server\ndb.example.com\n",
+		shared.InventoryPath("team.ssh.staging"): "staging.example.com\ndb.example.com Listed twice\n",
+		shared.InventoryPath("team.broken"):      "-oProxyCommand=evil\n",
+	}
+	requester := newRequester(transport)
+
+	entries, err := requester.GetInventory("")
+	require.NoError(t, err)
+	require.Equal(t, []kssh.InventoryEntry{
+		{InventoryHost: shared.InventoryHost{Host: "db.example.com"}, Team: "team.ssh"},
+		{InventoryHost: shared.InventoryHost{Host: "staging.example.com"}, Team: "team.ssh.staging"},
+		{InventoryHost: shared.InventoryHost{Host: "web.example.com", Description: "Web server"}, Team: "team.ssh"},
+	}, entries)
+
+	entries, err = requester.GetInventory("otherbot")
+	require.NoError(t, err)
+	require.Equal(t, []kssh.InventoryEntry{
+		{InventoryHost: shared.InventoryHost{Host: "db.example.com", Description: "Listed twice"}, Team: "team.ssh.staging"},
+		{InventoryHost: shared.InventoryHost{Host: "staging.example.com"}, Team: "team.ssh.staging"},
+	}, entries)
+}
@@ -0,0 +1,168 @@
+package kssh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to wait for a response from a persistent `keybase <kind> api` process before giving up on it and falling
+// back to spawning a process per call
+var keybaseAPICallTimeout = 30 * time.Second
+
+// keybaseAPI sends JSON API calls to `keybase <kind> api` (eg `keybase team api` or `keybase kvstore api`). Rather than
+// spawning a new keybase process for every call (which has to start up and connect to the Keybase service each time),
+// it keeps a single process running and writes one request per line to its stdin, reading one response per line from
+// its stdout. If the persistent process fails for any reason, keybaseAPI falls back to spawning a process per call for
+// the rest of its lifetime so that older or unusual keybase installs keep working.
+type keybaseAPI struct {
+	keybaseBinaryPath string
+	kind              string
+
+	lock     sync.Mutex
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	fallback bool
+}
+
+func newKeybaseAPI(keybaseBinaryPath, kind string) *keybaseAPI {
+	return &keybaseAPI{keybaseBinaryPath: keybaseBinaryPath, kind: kind}
+}
+
+// keybaseAPIResponse is the envelope shared by every keybase JSON API
+type keybaseAPIResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Call sends the given method and params and unmarshals the result into result
+func (k *keybaseAPI) Call(method string, params interface{}, result interface{}) error {
+	input, err := json.Marshal(map[string]interface{}{"method": method, "params": params})
+	if err != nil {
+		return err
+	}
+	output, err := k.call(input)
+	if err != nil {
+		return fmt.Errorf("keybase %s api %s failed: %v", k.kind, method, err)
+	}
+	var response keybaseAPIResponse
+	err = json.Unmarshal(output, &response)
+	if err != nil {
+		return fmt.Errorf("failed to parse the response to keybase %s api %s: %v", k.kind, method, err)
+	}
+	if response.Error.Message != "" {
+		return fmt.Errorf("keybase %s api %s failed: %s", k.kind, method, response.Error.Message)
+	}
+	if result == nil || len(response.Result) == 0 {
+		return nil
+	}
+	return json.Unmarshal(response.Result, result)
+}
+
+func (k *keybaseAPI) call(input []byte) ([]byte, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if !k.fallback {
+		output, err := k.callPersistent(input)
+		if err == nil {
+			return output, nil
+		}
+		log.Debugf("Persistent keybase %s api process failed, falling back to a process per call: %v", k.kind, err)
+		k.closeLocked()
+		k.fallback = true
+	}
+	return k.callOnce(input)
+}
+
+// Send the input to the persistent process, starting it if needed. Must be called with the lock held.
+func (k *keybaseAPI) callPersistent(input []byte) ([]byte, error) {
+	if k.cmd == nil {
+		cmd, err := shared.Command(k.keybaseBinaryPath, keybaseArgs(k.kind, "api")...)
+		if err != nil {
+			return nil, err
+		}
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		err = cmd.Start()
+		if err != nil {
+			return nil, err
+		}
+		k.cmd, k.stdin, k.stdout = cmd, stdin, bufio.NewReader(stdout)
+	}
+	_, err := k.stdin.Write(append(input, '\n'))
+	if err != nil {
+		return nil, err
+	}
+
+	type readResult struct {
+		line []byte
+		err  error
+	}
+	done := make(chan readResult, 1)
+	stdout := k.stdout
+	go func() {
+		line, err := stdout.ReadBytes('\n')
+		done <- readResult{line, err}
+	}()
+	select {
+	case res := <-done:
+		if len(bytes.TrimSpace(res.line)) == 0 && res.err != nil {
+			return nil, res.err
+		}
+		return res.line, nil
+	case <-time.After(keybaseAPICallTimeout):
+		return nil, fmt.Errorf("timed out after %s", keybaseAPICallTimeout)
+	}
+}
+
+// Spawn a process that handles just the given input
+func (k *keybaseAPI) callOnce(input []byte) ([]byte, error) {
+	cmd, err := shared.Command(k.keybaseBinaryPath, keybaseArgs(k.kind, "api")...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
+
+// Close stops the persistent process, if any
+func (k *keybaseAPI) Close() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.closeLocked()
+}
+
+func (k *keybaseAPI) closeLocked() {
+	if k.cmd == nil {
+		return
+	}
+	// Closing stdin tells keybase that there are no more calls. Kill it as well in case it is wedged.
+	k.stdin.Close()
+	_ = k.cmd.Process.Kill()
+	_ = k.cmd.Wait()
+	k.cmd, k.stdin, k.stdout = nil, nil, nil
+}
@@ -0,0 +1,80 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+	"github.com/stretchr/testify/require"
+)
+
+// A fake keybase binary whose `api` subcommands answer each line of input with a KV store entry. Every time it is
+// spawned it appends a line to the spawns file. If persistent is false it exits after the first call, like a keybase
+// that does not support multiple calls per process.
+const fakeKeybaseAPI = `#!/bin/sh
+echo "$1" >> %s
+while read -r line || [ -n "$line" ]; do
+	echo '{"result": {"entryValue": "value", "revision": 1}}'
+	if [ "%t" = "false" ]; then
+		exit 0
+	fi
+done
+`
+
+func writeFakeKeybaseAPI(t *testing.T, persistent bool) (binary, spawns string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "kssh-keybaseapi")
+	require.NoError(t, err)
+	binary = filepath.Join(dir, "keybase")
+	spawns = filepath.Join(dir, "spawns")
+	require.NoError(t, ioutil.WriteFile(binary, []byte(fmt.Sprintf(fakeKeybaseAPI, spawns, persistent)), 0755))
+	return binary, spawns, func() { os.RemoveAll(dir) }
+}
+
+func countSpawns(t *testing.T, spawns string) int {
+	bytes, err := ioutil.ReadFile(spawns)
+	require.NoError(t, err)
+	return len(strings.Split(strings.TrimSpace(string(bytes)), "\n"))
+}
+
+func TestKeybaseAPIPersistent(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	binary, spawns, cleanup := writeFakeKeybaseAPI(t, true)
+	defer cleanup()
+
+	api := newKeybaseAPI(binary, "kvstore")
+	defer api.Close()
+	for i := 0; i < 5; i++ {
+		var res keybase1.KVGetResult
+		require.NoError(t, api.Call("get", nil, &res))
+		require.Equal(t, "value", res.EntryValue)
+		require.Equal(t, 1, res.Revision)
+	}
+	require.Equal(t, 1, countSpawns(t, spawns))
+	require.False(t, api.fallback)
+}
+
+func TestKeybaseAPIFallback(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	binary, spawns, cleanup := writeFakeKeybaseAPI(t, false)
+	defer cleanup()
+
+	api := newKeybaseAPI(binary, "kvstore")
+	defer api.Close()
+	for i := 0; i < 3; i++ {
+		var res keybase1.KVGetResult
+		require.NoError(t, api.Call("get", nil, &res))
+		require.Equal(t, "value", res.EntryValue)
+	}
+	// The first process exits after one call, the second call fails over to a process per call
+	require.True(t, api.fallback)
+	require.Equal(t, 3, countSpawns(t, spawns))
+}
@@ -0,0 +1,163 @@
+package ksshtest
+
+// Package ksshtest provides an in memory implementation of kssh.ChatTransport so that the kssh request/response
+// state machine can be unit tested without a running Keybase service. A Transport behaves like a single chat
+// conversation: every message sent (by kssh or by the simulated bot) is delivered to every subscriber.
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/kssh"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// Responder simulates the CA bot. It is called with every message that kssh sends and returns the messages the
+// bot should send in response.
+type Responder func(msg kssh.ChatMessage) []string
+
+// Transport is an in memory kssh.ChatTransport
+type Transport struct {
+	// The username of the simulated kssh user
+	Username string
+	// The teams the simulated kssh user is in
+	Teams []string
+	// Maps from team name to the raw kssh config stored in the KV store for that team
+	Configs map[string]string
+	// Maps from KBFS path to the contents of the file
+	Files map[string]string
+	// The name of the simulated bot. Responses from Bot are sent as this user.
+	BotName string
+	// The simulated bot. May be nil in which case nobody responds.
+	Bot Responder
+	// How long the simulated bot waits before sending its responses
+	Delay time.Duration
+
+	lock        sync.Mutex
+	sent        []kssh.ChatMessage
+	lifetimes   []time.Duration
+	subscribers []chan kssh.ChatMessage
+}
+
+var _ kssh.ChatTransport = (*Transport)(nil)
+
+// NewTransport returns a Transport for a user in a single team that contains a config pointing at botName
+func NewTransport(username, team, botName string, bot Responder) *Transport {
+	config, _ := json.Marshal(kssh.Config{TeamName: team, BotName: botName})
+	return &Transport{
+		Username: username,
+		Teams:    []string{team},
+		Configs:  map[string]string{team: string(config)},
+		BotName:  botName,
+		Bot:      bot,
+	}
+}
+
+func (t *Transport) GetUsername() string {
+	return t.Username
+}
+
+func (t *Transport) ListTeams() ([]string, error) {
+	return t.Teams, nil
+}
+
+func (t *Transport) GetEntry(teamName, namespace, entryKey string) (string, bool, error) {
+	if namespace != shared.SSHCANamespace || entryKey != shared.SSHCAConfigKey {
+		return "", false, nil
+	}
+	value, ok := t.Configs[teamName]
+	return value, ok, nil
+}
+
+func (t *Transport) ReadFile(path string) (string, bool, error) {
+	contents, ok := t.Files[path]
+	return contents, ok, nil
+}
+
+func (t *Transport) SendMessage(teamName string, channel *string, body string, explodingLifetime time.Duration) error {
+	msg := kssh.ChatMessage{Sender: t.Username, Body: body}
+	t.lock.Lock()
+	t.lifetimes = append(t.lifetimes, explodingLifetime)
+	t.lock.Unlock()
+	t.deliver(msg)
+	if t.Bot != nil {
+		responses := t.Bot(msg)
+		go func() {
+			time.Sleep(t.Delay)
+			for _, response := range responses {
+				t.deliver(kssh.ChatMessage{Sender: t.BotName, Body: response})
+			}
+		}()
+	}
+	return nil
+}
+
+func (t *Transport) Subscribe() (kssh.ChatSubscription, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ch := make(chan kssh.ChatMessage, 1024)
+	t.subscribers = append(t.subscribers, ch)
+	return &subscription{ch: ch}, nil
+}
+
+// SendFromBot delivers a message from the simulated bot to every subscriber. Used to simulate messages that the bot
+// sends later rather than in direct response to a message from kssh.
+func (t *Transport) SendFromBot(body string) {
+	t.deliver(kssh.ChatMessage{Sender: t.BotName, Body: body})
+}
+
+// Sent returns every message that has been delivered so far (from both kssh and the simulated bot)
+func (t *Transport) Sent() []kssh.ChatMessage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]kssh.ChatMessage{}, t.sent...)
+}
+
+// ExplodingLifetimes returns the exploding lifetime of every message sent by kssh so far (zero for regular messages)
+func (t *Transport) ExplodingLifetimes() []time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]time.Duration{}, t.lifetimes...)
+}
+
+func (t *Transport) deliver(msg kssh.ChatMessage) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sent = append(t.sent, msg)
+	for _, subscriber := range t.subscribers {
+		subscriber <- msg
+	}
+}
+
+type subscription struct {
+	ch chan kssh.ChatMessage
+}
+
+func (s *subscription) Read() (kssh.ChatMessage, error) {
+	return <-s.ch, nil
+}
+
+// NewBot returns a Responder that implements the CA side of the protocol. It acks every AckRequest, answers every
+// ping, and responds to every SignatureRequest with the result of sign.
+func NewBot(sign func(shared.SignatureRequest) shared.SignatureResponse) Responder {
+	return func(msg kssh.ChatMessage) []string {
+		switch {
+		case shared.IsAckRequest(msg.Body):
+			return []string{shared.GenerateAckResponse(msg.Body)}
+		case strings.HasPrefix(msg.Body, "ping @"):
+			return []string{shared.GeneratePingResponse(msg.Sender)}
+		case strings.HasPrefix(msg.Body, shared.SignatureRequestPreamble):
+			request, err := shared.ParseSignatureRequest(msg.Body)
+			if err != nil {
+				return []string{fmt.Sprintf("Encountered error while processing message: %v", err)}
+			}
+			response, _ := json.Marshal(sign(request))
+			return []string{shared.SignatureResponsePreamble + string(response)}
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package kssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// How long to wait for another kssh process to finish provisioning a key. This is long since the other process may be
+// waiting for the user to complete step-up authentication. Processes that crashed are detected via staleLockAge.
+const lockTimeout = 10 * time.Minute
+
+// A lock file that has not been touched for this long is assumed to have been left behind by a kssh process that
+// crashed. The process holding the lock touches it every lockHeartbeatInterval.
+const staleLockAge = 2 * time.Minute
+
+// How often the process holding a lock touches the lock file
+const lockHeartbeatInterval = staleLockAge / 4
+
+// LockKey takes an exclusive lock on the signed key at keyPath so that concurrent kssh invocations (eg from an IDE
+// that spawns many ssh processes at once) do not all provision a new key and overwrite each other's files. A lock file
+// is used rather than flock(2) so that this works on every platform kssh supports. Returns a function that releases
+// the lock.
+func LockKey(keyPath string) (func(), error) {
+	release, _, err := lockKey(keyPath)
+	return release, err
+}
+
+// Like LockKey but also returns whether another process held the lock when this one started waiting for it
+func lockKey(keyPath string) (release func(), waited bool, err error) {
+	return lockFile(keyPath+".lock", lockTimeout)
+}
+
+// Take an exclusive lock by creating the lock file at lockPath, waiting up to timeout for the process that holds it
+// to release it. Also returns whether another process held the lock when this one started waiting for it.
+func lockFile(lockPath string, timeout time.Duration) (release func(), waited bool, err error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+			return heartbeat(lockPath), waited, nil
+		}
+		if !os.IsExist(err) {
+			return nil, waited, fmt.Errorf("failed to create lock file %s: %v", lockPath, err)
+		}
+		waited = true
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			log.Debugf("Removing stale lock file %s", lockPath)
+			os.Remove(lockPath)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, waited, fmt.Errorf("timed out waiting for another kssh process to release %s", lockPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Keep touching the given lock file so that other processes do not consider it stale while provisioning takes a
+// long time. Returns a function that stops touching the file and removes it.
+func heartbeat(lockPath string) func() {
+	stopCh := make(chan struct{})
+	stoppedCh := make(chan struct{})
+	go func() {
+		defer close(stoppedCh)
+		ticker := time.NewTicker(lockHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				_ = os.Chtimes(lockPath, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(stopCh)
+		<-stoppedCh
+		os.Remove(lockPath)
+	}
+}
+
+// The result of a failed attempt to provision a key that is shared with the processes that were waiting for it
+type provisionFailure struct {
+	Error string `json:"error"`
+	// "config" for a ConfigError, "ca" for a CAError, and empty otherwise
+	Kind string `json:"kind,omitempty"`
+	// Set if the CA denied the request so that the waiting processes can show the same remediation
+	Denied *DeniedError `json:"denied,omitempty"`
+}
+
+// ProvisionOnce coalesces concurrent attempts to provision the key at keyPath into a single request to the CA. The
+// first process to take the lock calls provision while every other process waits for it. Once it is done the waiting
+// processes reuse the key it provisioned or, if it failed, return the same error rather than each sending their own
+// request. Returns whether a key provisioned by another process was reused.
+func ProvisionOnce(keyPath string, provision func() error) (bool, error) {
+	waitStart := time.Now()
+	release, waited, err := lockKey(keyPath)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	failurePath := keyPath + ".failed"
+	if waited {
+		// Another kssh process may have provisioned a key while we were waiting for the lock
+		if IsReusableCert(keyPath) {
+			log.WithField("keyPath", keyPath).Debug("Reusing certificate provisioned by another kssh process")
+			return true, nil
+		}
+		if err := readProvisionFailure(failurePath, waitStart); err != nil {
+			log.WithField("keyPath", keyPath).Debug("Another kssh process failed to provision a certificate")
+			return false, err
+		}
+	}
+	err = provision()
+	if err != nil {
+		writeProvisionFailure(failurePath, err)
+	} else {
+		os.Remove(failurePath)
+	}
+	return false, err
+}
+
+// Record that provisioning failed with the given error for the processes waiting for the lock
+func writeProvisionFailure(failurePath string, err error) {
+	failure := provisionFailure{Error: err.Error()}
+	switch err.(type) {
+	case *ConfigError:
+		failure.Kind = "config"
+	case *CAError:
+		failure.Kind = "ca"
+		failure.Denied, _ = err.(*CAError).Err.(*DeniedError)
+	}
+	bytes, _ := json.Marshal(failure)
+	if err := ioutil.WriteFile(failurePath, bytes, 0600); err != nil {
+		log.Debugf("Failed to record the provisioning failure in %s: %v", failurePath, err)
+	}
+}
+
+// Returns the error of a failed attempt to provision the key that was recorded after since or nil if there was none
+func readProvisionFailure(failurePath string, since time.Time) error {
+	info, err := os.Stat(failurePath)
+	if err != nil || info.ModTime().Before(since) {
+		return nil
+	}
+	bytes, err := ioutil.ReadFile(failurePath)
+	if err != nil {
+		return nil
+	}
+	var failure provisionFailure
+	if json.Unmarshal(bytes, &failure) != nil || failure.Error == "" {
+		return nil
+	}
+	err = fmt.Errorf("%s", failure.Error)
+	switch failure.Kind {
+	case "config":
+		return &ConfigError{Err: err}
+	case "ca":
+		if failure.Denied != nil {
+			return &CAError{Err: failure.Denied}
+		}
+		return &CAError{Err: err}
+	}
+	return err
+}
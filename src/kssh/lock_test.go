@@ -0,0 +1,119 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "keybase-signed-key--cabot")
+
+	release, err := LockKey(keyPath)
+	require.NoError(t, err)
+
+	acquired := make(chan error)
+	go func() {
+		release2, err := LockKey(keyPath)
+		if err == nil {
+			release2()
+		}
+		acquired <- err
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquired a lock that is already held")
+	case <-time.After(300 * time.Millisecond):
+	}
+	release()
+	select {
+	case err := <-acquired:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed to acquire a released lock")
+	}
+
+	// A stale lock file is ignored
+	require.NoError(t, ioutil.WriteFile(keyPath+".lock", []byte("1\n"), 0600))
+	old := time.Now().Add(-2 * staleLockAge)
+	require.NoError(t, os.Chtimes(keyPath+".lock", old, old))
+	release, err = LockKey(keyPath)
+	require.NoError(t, err)
+	release()
+}
+
+func TestProvisionOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "keybase-signed-key--cabot")
+
+	// Every process that was waiting while provisioning failed gets the same error without provisioning again
+	var lock sync.Mutex
+	calls := 0
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	provision := func() error {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		close(started)
+		<-finish
+		return &CAError{Err: fmt.Errorf("request denied")}
+	}
+	results := make(chan error, 3)
+	go func() {
+		_, err := ProvisionOnce(keyPath, provision)
+		results <- err
+	}()
+	<-started
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := ProvisionOnce(keyPath, func() error {
+				t.Error("provisioned a key while another process was provisioning it")
+				return nil
+			})
+			results <- err
+		}()
+	}
+	time.Sleep(300 * time.Millisecond)
+	close(finish)
+	for i := 0; i < 3; i++ {
+		err := <-results
+		require.Error(t, err)
+		require.IsType(t, &CAError{}, err)
+		require.Equal(t, "request denied", err.Error())
+	}
+	require.Equal(t, 1, calls)
+
+	// A failure that happened before a process started waiting is not reused
+	reused, err := ProvisionOnce(keyPath, func() error { return nil })
+	require.NoError(t, err)
+	require.False(t, reused)
+	_, err = os.Stat(keyPath + ".failed")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestProvisionFailureDenied(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	failurePath := filepath.Join(dir, "keybase-signed-key--.failed")
+
+	// Processes waiting for the lock get the same denial (and so the same remediation)
+	denied := &DeniedError{Code: "lockdown", Reason: "the CA is in lockdown", BotName: "cabot", TeamName: "team.ssh"}
+	writeProvisionFailure(failurePath, &CAError{Err: denied})
+	err = readProvisionFailure(failurePath, time.Now().Add(-time.Minute))
+	require.IsType(t, &CAError{}, err)
+	require.Equal(t, denied, err.(*CAError).Err)
+}
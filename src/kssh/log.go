@@ -1,17 +1,24 @@
 package kssh
 
-import log "github.com/sirupsen/logrus"
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
 
 // Prefix formatter adds a prefix of "kssh: " to log messages before delegating to the default text formatter
-type prefixFormatter struct{}
+type prefixFormatter struct {
+	disableColors bool
+}
 
 func (pf *prefixFormatter) Format(entry *log.Entry) ([]byte, error) {
 	entry.Message = "kssh: " + entry.Message
-	textFormatter := &log.TextFormatter{}
+	textFormatter := &log.TextFormatter{DisableColors: pf.disableColors}
 	return textFormatter.Format(entry)
 }
 
 func InitLogging() {
 	log.SetLevel(log.WarnLevel)
-	log.SetFormatter(&prefixFormatter{})
+	// Logs are written to stderr
+	log.SetFormatter(&prefixFormatter{disableColors: !ColorEnabled(os.Stderr)})
 }
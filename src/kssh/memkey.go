@@ -0,0 +1,170 @@
+package kssh
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// The comment that an in-memory key for the given key path is loaded into the ssh-agent with. Since nothing is stored
+// on disk, this is how kssh finds the key again (see GetAgentCertificate).
+func agentKeyComment(keyPath string) string {
+	return "kssh:" + keyPath
+}
+
+// Connect to the ssh-agent listening on the given socket
+func dialAgent(socket string) (agent.ExtendedAgent, func(), error) {
+	if socket == "" {
+		return nil, nil, fmt.Errorf("no ssh-agent is running ($SSH_AUTH_SOCK is not set)")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the ssh-agent at %s: %v", socket, err)
+	}
+	return agent.NewClient(conn), func() { conn.Close() }, nil
+}
+
+// GetAgentCertificate returns the unexpired certificate for the current Keybase user that ProvisionInMemoryKey loaded
+// into the ssh-agent on socket for keyPath. Returns nil if there is no such certificate or if algorithms is not empty
+// and the certificate was not signed with one of them.
+func GetAgentCertificate(socket, keyPath string, algorithms []string) (*ssh.Certificate, error) {
+	client, closeAgent, err := dialAgent(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	keys, err := client.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the keys in the ssh-agent: %v", err)
+	}
+	username, err := GetKeybaseUsername()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Comment != agentKeyComment(keyPath) {
+			continue
+		}
+		parsed, err := ssh.ParsePublicKey(key.Blob)
+		if err != nil {
+			continue
+		}
+		cert, ok := parsed.(*ssh.Certificate)
+		if !ok || !strings.HasSuffix(cert.KeyId, ":"+username) {
+			continue
+		}
+		now := time.Now()
+		if now.Before(time.Unix(int64(cert.ValidAfter), 0)) || !now.Before(time.Unix(int64(cert.ValidBefore), 0)) {
+			continue
+		}
+		if len(algorithms) > 0 && cert.SignatureKey.Type() == ssh.KeyAlgoRSA && !containsString(algorithms, cert.Signature.Format) {
+			continue
+		}
+		return cert, nil
+	}
+	return nil, nil
+}
+
+// Generate a new keypair in memory. This is an ed25519 key, or an ECDSA P-256 key in FIPS mode (see
+// shared.FIPSMode). release zeroes the private key.
+func generateInMemoryKey() (privateKey interface{}, publicKey ssh.PublicKey, release func(), err error) {
+	if shared.FIPSMode {
+		ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		release = func() {
+			words := ecdsaKey.D.Bits()
+			for i := range words {
+				words[i] = 0
+			}
+		}
+		publicKey, err = ssh.NewPublicKey(&ecdsaKey.PublicKey)
+		if err != nil {
+			release()
+			return nil, nil, nil, err
+		}
+		return ecdsaKey, publicKey, release, nil
+	}
+	ed25519PublicKey, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	release = sshutils.LockMemory(ed25519Key)
+	publicKey, err = ssh.NewPublicKey(ed25519PublicKey)
+	if err != nil {
+		release()
+		return nil, nil, nil, err
+	}
+	return ed25519Key, publicKey, release, nil
+}
+
+// ProvisionInMemoryKey provisions a new signed SSH key that never touches the disk. The keypair is generated in this
+// process, the public key is signed by the CA, and the private key and certificate are loaded straight into the
+// ssh-agent on socket with a lifetime matching the certificate. The private key is then zeroed. keyPath is where the
+// key would be stored by ProvisionNewKey and is only used to identify the key in the agent and to cache the config.
+func ProvisionInMemoryKey(requester *Requester, botName, keyPath, socket string, elevate bool) error {
+	// Connect to the agent first so that a missing agent does not cost a round trip to the CA
+	client, closeAgent, err := dialAgent(socket)
+	if err != nil {
+		return err
+	}
+	defer closeAgent()
+
+	err = RunHooks(PreProvision, HookContext{BotName: botName})
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Generating a new SSH key in memory...")
+	requester.reportProgress("Generating a new SSH key")
+	privateKey, sshPublicKey, release, err := generateInMemoryKey()
+	if err != nil {
+		return fmt.Errorf("Failed to generate a new SSH key: %v", err)
+	}
+	defer release()
+
+	conf, signedKey, err := requestCertificate(requester, botName, keyPath, string(ssh.MarshalAuthorizedKey(sshPublicKey)), elevate)
+	if err != nil {
+		return err
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedKey))
+	if err != nil {
+		return &CAError{Err: fmt.Errorf("Failed to parse the signed certificate: %v", err)}
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return &CAError{Err: fmt.Errorf("the CA did not return a certificate")}
+	}
+	lifetime := time.Until(time.Unix(int64(cert.ValidBefore), 0))
+	if lifetime <= 0 {
+		return &CAError{Err: fmt.Errorf("the signed certificate has already expired")}
+	}
+	err = client.Add(agent.AddedKey{
+		PrivateKey:   privateKey,
+		Certificate:  cert,
+		Comment:      agentKeyComment(keyPath),
+		LifetimeSecs: uint32(lifetime / time.Second),
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to add the SSH key to the ssh-agent: %v", err)
+	}
+
+	// Remember the config so that it is available (eg for CloudTunnels) when this certificate is reused
+	err = CacheClientConfig(keyPath, conf)
+	if err != nil {
+		return fmt.Errorf("Failed to cache the client config: %v", err)
+	}
+	return RunHooks(PostProvision, HookContext{BotName: botName})
+}
@@ -0,0 +1,99 @@
+package kssh
+
+import (
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Serve an in memory ssh-agent on a socket in dir
+func serveTestAgent(t *testing.T, dir string) (socket string, keyring agent.Agent) {
+	socket = filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	keyring = agent.NewKeyring()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return socket, keyring
+}
+
+func newTestCertificate(t *testing.T, keyID string, validBefore time.Time) (ed25519.PrivateKey, *ssh.Certificate) {
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	caSigner, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	require.NoError(t, err)
+	cert := &ssh.Certificate{
+		Key:             sshPublicKey,
+		KeyId:           keyID,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"team.ssh"},
+		ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()),
+		ValidBefore:     uint64(validBefore.Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, caSigner))
+	return privateKey, cert
+}
+
+func TestGetAgentCertificate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a unix socket")
+	}
+	keybaseUsernameOnce = sync.Once{}
+	setKeybaseUsername("alice")
+	defer func() { keybaseUsernameOnce = sync.Once{} }()
+	dir, err := ioutil.TempDir("", "kssh-memkey")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket, keyring := serveTestAgent(t, dir)
+	keyPath := filepath.Join(dir, "keybase-signed-key--cabot")
+
+	cert, err := GetAgentCertificate(socket, keyPath, nil)
+	require.NoError(t, err)
+	require.Nil(t, cert)
+
+	// Keys with a different comment, for a different user, or that have expired are ignored
+	privateKey, other := newTestCertificate(t, "id:alice", time.Now().Add(time.Hour))
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: privateKey, Certificate: other, Comment: "other"}))
+	privateKey, bob := newTestCertificate(t, "id:bob", time.Now().Add(time.Hour))
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: privateKey, Certificate: bob, Comment: agentKeyComment(keyPath)}))
+	privateKey, expired := newTestCertificate(t, "id:alice", time.Now().Add(-time.Second))
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: privateKey, Certificate: expired, Comment: agentKeyComment(keyPath)}))
+	cert, err = GetAgentCertificate(socket, keyPath, nil)
+	require.NoError(t, err)
+	require.Nil(t, cert)
+
+	privateKey, valid := newTestCertificate(t, "id:alice", time.Now().Add(time.Hour))
+	require.NoError(t, keyring.Add(agent.AddedKey{PrivateKey: privateKey, Certificate: valid, Comment: agentKeyComment(keyPath)}))
+	cert, err = GetAgentCertificate(socket, keyPath, nil)
+	require.NoError(t, err)
+	require.NotNil(t, cert)
+	require.Equal(t, valid.Marshal(), cert.Marshal())
+
+	_, err = GetAgentCertificate("", keyPath, nil)
+	require.Error(t, err)
+}
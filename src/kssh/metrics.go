@@ -0,0 +1,289 @@
+package kssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// If this environment variable is set, kssh never sends metrics even if the CA configured a metrics endpoint
+const NoMetricsEnvVar = "KSSH_NO_METRICS"
+
+// How long kssh waits for the metrics endpoint. Metrics are sent before running ssh so this is kept short.
+const metricsTimeout = 1 * time.Second
+
+// The names of the metrics that kssh records
+const (
+	// Counts every kssh invocation that needed a certificate, tagged with the result
+	MetricCertificates = "kssh.certificates"
+	// How long it took to provision a new certificate (or fail to), in milliseconds
+	MetricProvisionDuration = "kssh.provision.duration"
+)
+
+// A single recorded metric. Tags never contain usernames, hostnames, or anything else that identifies the user.
+type metric struct {
+	name string
+	// Either a count (value is the increment) or a timing (value is a duration in milliseconds)
+	timing bool
+	value  float64
+	tags   map[string]string
+	at     time.Time
+}
+
+// Metrics collects the anonymous usage and latency metrics of a single kssh invocation and sends them to the endpoint
+// that the CA published in its client config (see KSSH_METRICS_ENDPOINT). The endpoint is either a statsd server
+// (statsd://host:port, with tags in the DogStatsD format) or an OpenTelemetry collector that accepts OTLP over http
+// (eg https://collector:4318/v1/metrics). Metrics are disabled (and every method is a no-op) if the CA did not configure
+// an endpoint or if KSSH_NO_METRICS is set.
+type Metrics struct {
+	endpoint *url.URL
+	metrics  []metric
+	// Tags that are added to every metric
+	commonTags map[string]string
+}
+
+// NewMetrics returns the Metrics for the given client config, which may be nil if it could not be loaded
+func NewMetrics(conf *Config, version string) *Metrics {
+	m := &Metrics{commonTags: map[string]string{"os": runtime.GOOS, "version": version}}
+	if conf == nil || conf.MetricsEndpoint == "" || os.Getenv(NoMetricsEnvVar) != "" {
+		return m
+	}
+	endpoint, err := ParseMetricsEndpoint(conf.MetricsEndpoint)
+	if err != nil {
+		log.Debugf("Not sending metrics: %v", err)
+		return m
+	}
+	m.endpoint = endpoint
+	return m
+}
+
+// ParseMetricsEndpoint parses and validates a metrics endpoint (see Metrics)
+func ParseMetricsEndpoint(endpoint string) (*url.URL, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metrics endpoint '%s': %v", endpoint, err)
+	}
+	switch parsed.Scheme {
+	case "statsd":
+		if parsed.Hostname() == "" || parsed.Port() == "" {
+			return nil, fmt.Errorf("statsd metrics endpoints must be of the form statsd://host:port, '%s' is not valid", endpoint)
+		}
+	case "http", "https":
+		if parsed.Hostname() == "" {
+			return nil, fmt.Errorf("metrics endpoint '%s' does not include a host", endpoint)
+		}
+	default:
+		return nil, fmt.Errorf("metrics endpoints must be statsd://host:port or an http(s) OTLP URL, '%s' is not valid", endpoint)
+	}
+	return parsed, nil
+}
+
+// Enabled returns whether the recorded metrics are sent anywhere
+func (m *Metrics) Enabled() bool {
+	return m.endpoint != nil
+}
+
+// Count records that the named event happened once
+func (m *Metrics) Count(name string, tags map[string]string) {
+	m.record(metric{name: name, value: 1, tags: tags})
+}
+
+// Timing records how long the named operation took
+func (m *Metrics) Timing(name string, duration time.Duration, tags map[string]string) {
+	m.record(metric{name: name, timing: true, value: float64(duration) / float64(time.Millisecond), tags: tags})
+}
+
+func (m *Metrics) record(metric metric) {
+	if !m.Enabled() {
+		return
+	}
+	merged := make(map[string]string)
+	for k, v := range m.commonTags {
+		merged[k] = v
+	}
+	for k, v := range metric.tags {
+		merged[k] = v
+	}
+	metric.tags = merged
+	metric.at = time.Now()
+	m.metrics = append(m.metrics, metric)
+}
+
+// Flush sends the recorded metrics. Failures are only logged since metrics must never get in the way of connecting.
+func (m *Metrics) Flush() {
+	if !m.Enabled() || len(m.metrics) == 0 {
+		return
+	}
+	var err error
+	if m.endpoint.Scheme == "statsd" {
+		err = m.sendStatsd()
+	} else {
+		err = m.sendOTLP()
+	}
+	if err != nil {
+		log.Debugf("Failed to send metrics to %s: %v", m.endpoint.Host, err)
+		return
+	}
+	m.metrics = nil
+}
+
+// Send the metrics as statsd lines over UDP
+func (m *Metrics) sendStatsd() error {
+	conn, err := net.DialTimeout("udp", m.endpoint.Host, metricsTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var lines []string
+	for _, metric := range m.metrics {
+		lines = append(lines, formatStatsd(metric))
+	}
+	_, err = conn.Write([]byte(strings.Join(lines, "\n")))
+	return err
+}
+
+// Format the given metric as a statsd line with DogStatsD style tags (eg `kssh.certificates:1|c|#result:reused`)
+func formatStatsd(metric metric) string {
+	metricType := "c"
+	if metric.timing {
+		metricType = "ms"
+	}
+	line := fmt.Sprintf("%s:%s|%s", metric.name, strconv.FormatFloat(metric.value, 'f', -1, 64), metricType)
+	var tags []string
+	for _, key := range sortedTagKeys(metric.tags) {
+		tags = append(tags, key+":"+metric.tags[key])
+	}
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+// The subset of the OTLP JSON encoding (see opentelemetry-proto) that kssh uses
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+}
+
+// Every metric is a delta since each kssh invocation only reports what happened during it
+const otlpAggregationTemporalityDelta = 1
+
+type otlpSum struct {
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpHistogram struct {
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+}
+
+// A data point of either a sum (AsInt) or a histogram with a single sample (Count, Sum, and BucketCounts). 64 bit
+// integers are encoded as strings in OTLP JSON.
+type otlpDataPoint struct {
+	Attributes   []otlpAttribute `json:"attributes"`
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsInt        string          `json:"asInt,omitempty"`
+	Count        string          `json:"count,omitempty"`
+	Sum          *float64        `json:"sum,omitempty"`
+	BucketCounts []string        `json:"bucketCounts,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string             `json:"key"`
+	Value otlpAttributeValue `json:"value"`
+}
+
+type otlpAttributeValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// Send the metrics to an OpenTelemetry collector as OTLP/HTTP with the JSON encoding
+func (m *Metrics) sendOTLP() error {
+	body, err := json.Marshal(m.buildOTLPRequest())
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: metricsTimeout}
+	resp, err := client.Post(m.endpoint.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (m *Metrics) buildOTLPRequest() otlpRequest {
+	var metrics []otlpMetric
+	for _, metric := range m.metrics {
+		var attributes []otlpAttribute
+		for _, key := range sortedTagKeys(metric.tags) {
+			attributes = append(attributes, otlpAttribute{Key: key, Value: otlpAttributeValue{StringValue: metric.tags[key]}})
+		}
+		point := otlpDataPoint{Attributes: attributes, TimeUnixNano: strconv.FormatInt(metric.at.UnixNano(), 10)}
+		if metric.timing {
+			value := metric.value
+			point.Count = "1"
+			point.Sum = &value
+			point.BucketCounts = []string{"1"}
+			metrics = append(metrics, otlpMetric{Name: metric.name, Unit: "ms", Histogram: &otlpHistogram{
+				AggregationTemporality: otlpAggregationTemporalityDelta, DataPoints: []otlpDataPoint{point}}})
+		} else {
+			point.AsInt = strconv.FormatInt(int64(metric.value), 10)
+			metrics = append(metrics, otlpMetric{Name: metric.name, Sum: &otlpSum{
+				AggregationTemporality: otlpAggregationTemporalityDelta, IsMonotonic: true, DataPoints: []otlpDataPoint{point}}})
+		}
+	}
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     otlpResource{Attributes: []otlpAttribute{{Key: "service.name", Value: otlpAttributeValue{StringValue: "kssh"}}}},
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "kssh"}, Metrics: metrics}},
+	}}}
+}
+
+func sortedTagKeys(tags map[string]string) []string {
+	var keys []string
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,97 @@
+package kssh
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsDisabled(t *testing.T) {
+	for _, conf := range []*Config{nil, {}, {MetricsEndpoint: "udp://127.0.0.1:8125"}} {
+		metrics := NewMetrics(conf, "v1")
+		require.False(t, metrics.Enabled())
+		metrics.Count(MetricCertificates, nil)
+		metrics.Flush()
+	}
+
+	os.Setenv(NoMetricsEnvVar, "1")
+	defer os.Unsetenv(NoMetricsEnvVar)
+	require.False(t, NewMetrics(&Config{MetricsEndpoint: "statsd://127.0.0.1:8125"}, "v1").Enabled())
+}
+
+func TestParseMetricsEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"statsd://127.0.0.1:8125", "https://collector.internal:4318/v1/metrics", "http://localhost:4318/v1/metrics"} {
+		_, err := ParseMetricsEndpoint(endpoint)
+		require.NoError(t, err, endpoint)
+	}
+	for _, endpoint := range []string{"statsd://127.0.0.1", "https:///v1/metrics", "udp://127.0.0.1:8125", "collector:4318"} {
+		_, err := ParseMetricsEndpoint(endpoint)
+		require.Error(t, err, endpoint)
+	}
+}
+
+func TestStatsdMetrics(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	metrics := NewMetrics(&Config{MetricsEndpoint: "statsd://" + conn.LocalAddr().String()}, "v1")
+	require.True(t, metrics.Enabled())
+	metrics.Count(MetricCertificates, map[string]string{"result": "provisioned"})
+	metrics.Timing(MetricProvisionDuration, 1500*time.Millisecond, map[string]string{"result": "provisioned"})
+	metrics.Flush()
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 1024)
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "kssh.certificates:1|c|#os:"+runtime.GOOS+",result:provisioned,version:v1\n"+
+		"kssh.provision.duration:1500|ms|#os:"+runtime.GOOS+",result:provisioned,version:v1", string(buf[:n]))
+}
+
+func TestOTLPMetrics(t *testing.T) {
+	var received otlpRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/metrics", r.URL.Path)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		require.NoError(t, json.Unmarshal(body, &received))
+	}))
+	defer ts.Close()
+
+	metrics := NewMetrics(&Config{MetricsEndpoint: ts.URL + "/v1/metrics"}, "v1")
+	metrics.Count(MetricCertificates, map[string]string{"result": "reused"})
+	metrics.Timing(MetricProvisionDuration, 250*time.Millisecond, nil)
+	metrics.Flush()
+
+	require.Len(t, received.ResourceMetrics, 1)
+	require.Equal(t, "service.name", received.ResourceMetrics[0].Resource.Attributes[0].Key)
+	sent := received.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	require.Len(t, sent, 2)
+	require.Equal(t, MetricCertificates, sent[0].Name)
+	require.Equal(t, "1", sent[0].Sum.DataPoints[0].AsInt)
+	require.True(t, sent[0].Sum.IsMonotonic)
+	require.Equal(t, []otlpAttribute{
+		{Key: "os", Value: otlpAttributeValue{StringValue: runtime.GOOS}},
+		{Key: "result", Value: otlpAttributeValue{StringValue: "reused"}},
+		{Key: "version", Value: otlpAttributeValue{StringValue: "v1"}},
+	}, sent[0].Sum.DataPoints[0].Attributes)
+	require.Equal(t, MetricProvisionDuration, sent[1].Name)
+	require.Equal(t, "ms", sent[1].Unit)
+	require.Equal(t, "1", sent[1].Histogram.DataPoints[0].Count)
+	require.Equal(t, 250.0, *sent[1].Histogram.DataPoints[0].Sum)
+
+	// An unreachable endpoint does not cause an error
+	ts.Close()
+	metrics.Count(MetricCertificates, nil)
+	metrics.Flush()
+}
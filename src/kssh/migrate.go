@@ -0,0 +1,227 @@
+package kssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigBundleVersion is the version of the ConfigBundle format. It is incremented whenever a field is removed or
+// changes meaning.
+const ConfigBundleVersion = 1
+
+// ConfigBundle contains the kssh settings that are migrated between machines via `kssh --export-config` and
+// `kssh --import-config`. Certificates and cached client configs are not included since they are specific to the
+// keys on the old machine and are provisioned again on demand.
+type ConfigBundle struct {
+	Version        int      `json:"version"`
+	DefaultBotName string   `json:"default_bot,omitempty"`
+	DefaultBotTeam string   `json:"default_team,omitempty"`
+	DefaultSSHUser string   `json:"default_ssh_user,omitempty"`
+	KeybaseBinPath string   `json:"keybase_binary,omitempty"`
+	InstallTargets []string `json:"install_targets,omitempty"`
+	PKCS11Provider string   `json:"pkcs11_provider,omitempty"`
+	// The team#channel that kssh asks the CA bots for its configs in
+	DiscoveryChannel string `json:"discovery_channel,omitempty"`
+	// The contents of ~/.ssh/known_hosts so that host keys that were already verified stay pinned
+	KnownHosts string `json:"known_hosts,omitempty"`
+}
+
+var knownHostsLocation = shared.ExpandPathWithTilde("~/.ssh/known_hosts")
+
+// ExportConfig writes the current kssh settings to filename as a saltpack message encrypted for and signed by the
+// current Keybase user so that it can only be imported by the same user on another machine (see ImportConfig)
+func ExportConfig(filename string) error {
+	bundle, err := buildConfigBundle()
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return err
+	}
+	username, err := GetKeybaseUsername()
+	if err != nil {
+		return err
+	}
+	// `keybase encrypt` signcrypts with the sender's device key unless told to encrypt anonymously, which lets
+	// ImportConfig check who wrote the bundle
+	ciphertext, err := runKeybaseWithInput(plaintext, "encrypt", username)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt the config bundle: %v", err)
+	}
+	return ioutil.WriteFile(filename, ciphertext, 0600)
+}
+
+// ImportConfig decrypts the bundle at filename (as written by ExportConfig) and applies it to the current machine.
+// Settings in the bundle replace the current settings and known hosts are merged into ~/.ssh/known_hosts. Only bundles
+// signed by the current Keybase user are accepted: anyone can encrypt a message for the user, and a bundle written by
+// someone else could point kssh at another bot or keybase binary and pin their host keys.
+func ImportConfig(filename string) error {
+	ciphertext, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("failed to read the config bundle: %v", err)
+	}
+	username, err := GetKeybaseUsername()
+	if err != nil {
+		return err
+	}
+	plaintext, err := runKeybaseWithInput(ciphertext, "decrypt", "--signed-by", username)
+	if err != nil {
+		return fmt.Errorf("refusing to import the config bundle since it could not be decrypted or was not signed by %s "+
+			"(was it exported by a different Keybase user?): %v", username, err)
+	}
+	var bundle ConfigBundle
+	err = json.Unmarshal(plaintext, &bundle)
+	if err != nil {
+		return fmt.Errorf("failed to parse the config bundle: %v", err)
+	}
+	return applyConfigBundle(bundle)
+}
+
+// Collect the current kssh settings into a ConfigBundle
+func buildConfigBundle() (ConfigBundle, error) {
+	lcf, err := getCurrentConfigFile()
+	if err != nil {
+		return ConfigBundle{}, err
+	}
+	bundle := ConfigBundle{
+		Version:          ConfigBundleVersion,
+		DefaultBotName:   lcf.DefaultBotName,
+		DefaultBotTeam:   lcf.DefaultBotTeam,
+		DefaultSSHUser:   lcf.DefaultSSHUser,
+		KeybaseBinPath:   lcf.KeybaseBinPath,
+		InstallTargets:   lcf.InstallTargets,
+		PKCS11Provider:   lcf.PKCS11Provider,
+		DiscoveryChannel: lcf.DiscoveryChannel,
+	}
+	knownHosts, err := ioutil.ReadFile(knownHostsLocation)
+	if err != nil && !os.IsNotExist(err) {
+		return ConfigBundle{}, fmt.Errorf("failed to read %s: %v", knownHostsLocation, err)
+	}
+	bundle.KnownHosts = string(knownHosts)
+	return bundle, nil
+}
+
+// Apply the given ConfigBundle to the current machine
+func applyConfigBundle(bundle ConfigBundle) error {
+	if bundle.Version > ConfigBundleVersion {
+		return fmt.Errorf("the config bundle was exported by a newer version of kssh (version %d), please upgrade kssh", bundle.Version)
+	}
+	if strings.ContainsAny(bundle.DefaultSSHUser, " \t\n\r'\"") {
+		return fmt.Errorf("invalid default ssh user in the config bundle: %s", bundle.DefaultSSHUser)
+	}
+	err := updateConfigFile(func(lcf *LocalConfigFile) error {
+		lcf.DefaultBotName = bundle.DefaultBotName
+		lcf.DefaultBotTeam = bundle.DefaultBotTeam
+		lcf.DefaultSSHUser = bundle.DefaultSSHUser
+		if bundle.DiscoveryChannel != "" {
+			if _, _, err := ParseDiscoveryChannel(bundle.DiscoveryChannel); err != nil {
+				return fmt.Errorf("invalid discovery channel in the config bundle: %v", err)
+			}
+		}
+		lcf.DiscoveryChannel = bundle.DiscoveryChannel
+		if bundle.KeybaseBinPath != "" {
+			// The keybase binary is often installed in a different location on a different machine
+			if _, err := os.Stat(bundle.KeybaseBinPath); err == nil {
+				lcf.KeybaseBinPath = bundle.KeybaseBinPath
+			} else {
+				log.Warnf("Not importing the keybase binary path %s since it does not exist on this machine", bundle.KeybaseBinPath)
+			}
+		}
+		if len(bundle.InstallTargets) > 0 {
+			targets, err := ParseInstallTargets(strings.Join(bundle.InstallTargets, ","))
+			if err != nil {
+				return fmt.Errorf("invalid install targets in the config bundle: %v", err)
+			}
+			lcf.InstallTargets = targets
+		}
+		if bundle.PKCS11Provider != "" {
+			// Like the keybase binary, the PKCS#11 library is often installed in a different location
+			if _, err := os.Stat(bundle.PKCS11Provider); err == nil {
+				lcf.PKCS11Provider = bundle.PKCS11Provider
+			} else {
+				log.Warnf("Not importing the PKCS#11 provider %s since it does not exist on this machine", bundle.PKCS11Provider)
+			}
+		}
+		if containsString(lcf.InstallTargets, InstallTargetPKCS11) && lcf.PKCS11Provider == "" {
+			log.Warnf("Not importing the %s install target since there is no PKCS#11 provider on this machine", InstallTargetPKCS11)
+			var targets []string
+			for _, target := range lcf.InstallTargets {
+				if target != InstallTargetPKCS11 {
+					targets = append(targets, target)
+				}
+			}
+			lcf.InstallTargets = targets
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return mergeKnownHosts(bundle.KnownHosts)
+}
+
+// Append every line of knownHosts that is not already in ~/.ssh/known_hosts. Existing entries are never removed or
+// modified.
+func mergeKnownHosts(knownHosts string) error {
+	if strings.TrimSpace(knownHosts) == "" {
+		return nil
+	}
+	existing, err := ioutil.ReadFile(knownHostsLocation)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %v", knownHostsLocation, err)
+	}
+	present := make(map[string]bool)
+	for _, line := range strings.Split(string(existing), "\n") {
+		present[strings.TrimSpace(line)] = true
+	}
+	var added []string
+	for _, line := range strings.Split(knownHosts, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || present[line] {
+			continue
+		}
+		present[line] = true
+		added = append(added, line)
+	}
+	if len(added) == 0 {
+		return nil
+	}
+	err = MakeDotSSH()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(knownHostsLocation, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", knownHostsLocation, err)
+	}
+	defer f.Close()
+	if len(existing) > 0 && !bytes.HasSuffix(existing, []byte("\n")) {
+		added = append([]string{""}, added...)
+	}
+	_, err = f.WriteString(strings.Join(added, "\n") + "\n")
+	return err
+}
+
+// Run the given keybase subcommand with input as its stdin and return its stdout
+func runKeybaseWithInput(input []byte, args ...string) ([]byte, error) {
+	cmd, err := keybaseCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(stderr.String()), err)
+	}
+	return output, nil
+}
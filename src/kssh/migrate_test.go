@@ -0,0 +1,106 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-migrate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig, oldKnownHosts := localConfigFileLocation, knownHostsLocation
+	defer func() { localConfigFileLocation, knownHostsLocation = oldConfig, oldKnownHosts }()
+
+	// Export from the old machine
+	localConfigFileLocation = filepath.Join(dir, "old-config.json")
+	knownHostsLocation = filepath.Join(dir, "old-known_hosts")
+	require.NoError(t, writeConfigFile(LocalConfigFile{
+		DefaultBotName: "cabot",
+		DefaultBotTeam: "team.ssh",
+		DefaultSSHUser: "developer",
+		KeybaseBinPath: filepath.Join(dir, "missing-keybase"),
+		ClientConfigs:  map[string]Config{"key": {TeamName: "team.ssh", BotName: "cabot"}},
+	}))
+	require.NoError(t, ioutil.WriteFile(knownHostsLocation, []byte("a.example.com ssh-ed25519 AAAA\nb.example.com ssh-ed25519 BBBB\n"), 0600))
+	bundle, err := buildConfigBundle()
+	require.NoError(t, err)
+	require.Equal(t, ConfigBundleVersion, bundle.Version)
+	require.Equal(t, "cabot", bundle.DefaultBotName)
+
+	// Import on the new machine
+	localConfigFileLocation = filepath.Join(dir, "new-config.json")
+	knownHostsLocation = filepath.Join(dir, "new-known_hosts")
+	require.NoError(t, writeConfigFile(LocalConfigFile{KeybaseBinPath: "/usr/bin/keybase"}))
+	require.NoError(t, ioutil.WriteFile(knownHostsLocation, []byte("b.example.com ssh-ed25519 BBBB\nc.example.com ssh-ed25519 CCCC"), 0600))
+	require.NoError(t, applyConfigBundle(bundle))
+
+	lcf, err := getCurrentConfigFile()
+	require.NoError(t, err)
+	require.Equal(t, "cabot", lcf.DefaultBotName)
+	require.Equal(t, "team.ssh", lcf.DefaultBotTeam)
+	require.Equal(t, "developer", lcf.DefaultSSHUser)
+	// The keybase binary does not exist on the new machine so the existing setting is kept
+	require.Equal(t, "/usr/bin/keybase", lcf.KeybaseBinPath)
+	require.Empty(t, lcf.ClientConfigs)
+
+	knownHosts, err := ioutil.ReadFile(knownHostsLocation)
+	require.NoError(t, err)
+	require.Equal(t, "b.example.com ssh-ed25519 BBBB\nc.example.com ssh-ed25519 CCCC\na.example.com ssh-ed25519 AAAA\n", string(knownHosts))
+
+	// Importing again does not duplicate known hosts
+	require.NoError(t, applyConfigBundle(bundle))
+	knownHosts2, err := ioutil.ReadFile(knownHostsLocation)
+	require.NoError(t, err)
+	require.Equal(t, string(knownHosts), string(knownHosts2))
+
+	bundle.Version = ConfigBundleVersion + 1
+	require.Error(t, applyConfigBundle(bundle))
+}
+
+// A fake keybase binary that decrypts any message to an empty config bundle, but only if it is asked to check that
+// the message was signed by alice
+const fakeKeybaseDecrypt = `#!/bin/sh
+if [ "$1" = "decrypt" ] && [ "$2" = "--signed-by" ] && [ "$3" = "alice" ]; then
+	echo '{"version": 1}'
+	exit 0
+fi
+echo "wrong signer" >&2
+exit 1
+`
+
+func TestImportConfigRequiresSelfSigned(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell")
+	}
+	dir, err := ioutil.TempDir("", "kssh-migrate")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig, oldKnownHosts, oldBinary := localConfigFileLocation, knownHostsLocation, verifiedKeybaseBinaryPath
+	defer func() {
+		localConfigFileLocation, knownHostsLocation, verifiedKeybaseBinaryPath = oldConfig, oldKnownHosts, oldBinary
+		keybaseUsernameOnce = sync.Once{}
+	}()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+	knownHostsLocation = filepath.Join(dir, "known_hosts")
+	verifiedKeybaseBinaryPath = filepath.Join(dir, "keybase")
+	require.NoError(t, ioutil.WriteFile(verifiedKeybaseBinaryPath, []byte(fakeKeybaseDecrypt), 0755))
+	bundle := filepath.Join(dir, "bundle.saltpack")
+	require.NoError(t, ioutil.WriteFile(bundle, []byte("ciphertext"), 0600))
+
+	keybaseUsernameOnce = sync.Once{}
+	setKeybaseUsername("alice")
+	require.NoError(t, ImportConfig(bundle))
+
+	keybaseUsernameOnce = sync.Once{}
+	setKeybaseUsername("bob")
+	err = ImportConfig(bundle)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "not signed by bob")
+}
@@ -0,0 +1,96 @@
+package kssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// LoadMirroredConfig loads the current version of the given config from the mirrors it lists (see Config.Mirrors),
+// trying them in order. Used when the config cannot be loaded from its usual location, eg during a KBFS outage.
+// Returns nil if the config does not list any mirrors.
+func (r *Requester) LoadMirroredConfig(cached Config) (*Config, error) {
+	var lastErr error
+	for _, mirror := range cached.Mirrors {
+		location := strings.TrimSuffix(mirror, "/") + "/" + cached.TeamName + ".json"
+		value, err := r.readMirror(location)
+		if err != nil {
+			log.Debugf("Failed to read the config mirror %s: %v", location, err)
+			lastErr = err
+			continue
+		}
+		var conf Config
+		if err := json.Unmarshal([]byte(value), &conf); err != nil {
+			lastErr = fmt.Errorf("failed to parse the config mirror %s: %v", location, err)
+			continue
+		}
+		// A mirror must not be able to redirect requests to another bot or team
+		if conf.BotName != cached.BotName || conf.TeamName != cached.TeamName {
+			lastErr = fmt.Errorf("the config mirror %s is for %s in %s rather than %s in %s", location,
+				conf.BotName, conf.TeamName, cached.BotName, cached.TeamName)
+			continue
+		}
+		return &conf, nil
+	}
+	return nil, lastErr
+}
+
+// Read the file at the given mirror location, which is either a KBFS path or an https URL
+func (r *Requester) readMirror(location string) (string, error) {
+	if strings.HasPrefix(location, "https://") {
+		resp, err := r.httpClient().Get(location)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("%s returned %s", location, resp.Status)
+		}
+		bytes, err := ioutil.ReadAll(resp.Body)
+		return string(bytes), err
+	}
+	value, found, err := r.transport.ReadFile(location)
+	if err == nil && !found {
+		err = fmt.Errorf("%s does not exist", location)
+	}
+	return value, err
+}
+
+func (r *Requester) httpClient() *http.Client {
+	if r.HTTPClient != nil {
+		return r.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+// Load the config of the given bot (or of the default bot, or of the only bot kssh has used if botName is empty) from
+// the mirrors listed in the copies of its config that kssh cached when it last provisioned a key
+func (r *Requester) loadConfigFromMirrors(botName string) (*Config, error) {
+	lcf, err := getCurrentConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if botName == "" {
+		botName = lcf.DefaultBotName
+	}
+	candidates := make(map[string]Config)
+	for _, cached := range lcf.ClientConfigs {
+		if len(cached.Mirrors) == 0 || (botName != "" && cached.BotName != botName) {
+			continue
+		}
+		candidates[cached.BotName] = cached
+	}
+	if len(candidates) != 1 {
+		// Without mirrors there is nothing to fall back to, and with several bots there is no way to pick one
+		return nil, nil
+	}
+	for _, cached := range candidates {
+		return r.LoadMirroredConfig(cached)
+	}
+	return nil, nil
+}
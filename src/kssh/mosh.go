@@ -0,0 +1,82 @@
+package kssh
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The --server command passed to mosh unless the user specified their own. mosh-server is often installed somewhere
+// that is not in the $PATH of a non-interactive ssh session (eg by Homebrew or snap) so these directories are searched
+// too. mosh runs the command via the remote shell which expands $PATH.
+const defaultMoshServer = `PATH="$PATH:/usr/local/bin:/opt/homebrew/bin:/snap/bin" mosh-server`
+
+// The mosh flags that take a value as the next argument when it is not attached (eg -p 60001 or --port 60001)
+var moshFlagsWithArguments = map[string]bool{
+	"-p": true, "--port": true, "--client": true, "--server": true, "--ssh": true, "--predict": true,
+	"--bind-server": true, "--family": true, "--experimental-remote-ip": true,
+}
+
+// GetMoshDestination parses the given mosh arguments and returns the user (which may be empty) and the host that mosh
+// will connect to. Returns empty strings if no destination was found.
+func GetMoshDestination(args []string) (user string, host string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return splitDestination(args[i+1])
+			}
+			return "", ""
+		}
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			if moshFlagsWithArguments[arg] {
+				i++
+			}
+			continue
+		}
+		return splitDestination(arg)
+	}
+	return "", ""
+}
+
+// Returns whether the given mosh arguments include the given long flag (eg --server) before the destination
+func hasMoshFlag(args []string, flag string) bool {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			return false
+		}
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return true
+		}
+		if moshFlagsWithArguments[arg] {
+			i++
+		}
+	}
+	return false
+}
+
+// GetMoshArgs returns the arguments to run mosh with so that it bootstraps the connection via ssh with the given ssh
+// arguments (eg the -i and -o options that make ssh use kssh's certificate). The user's mosh arguments come last.
+// Returns an error if the user passed --ssh since that would stop mosh from using the certificate.
+func GetMoshArgs(sshArgs []string, moshArgs []string) ([]string, error) {
+	if hasMoshFlag(moshArgs, "--ssh") {
+		return nil, fmt.Errorf("--ssh cannot be passed to mosh since kssh sets it in order to use the signed key, " +
+			"pass ssh options to kssh instead")
+	}
+	// mosh splits --ssh into words like a shell does
+	args := []string{"--ssh=" + FormatCommand(append([]string{"ssh"}, sshArgs...))}
+	if !hasMoshFlag(moshArgs, "--server") {
+		args = append(args, "--server="+defaultMoshServer)
+	}
+	return append(args, moshArgs...), nil
+}
+
+// RunMosh runs mosh with the given arguments (see GetMoshArgs) like RunSSH. Returns how mosh exited.
+func RunMosh(args []string) (SSHExit, error) {
+	if _, err := shared.LookPath("mosh"); err != nil {
+		return SSHExit{}, fmt.Errorf("mosh is not installed, install it from https://mosh.org or via your package manager")
+	}
+	return runForwardingSignals("mosh", args)
+}
@@ -0,0 +1,44 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetMoshDestination(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		user string
+		host string
+	}{
+		{[]string{"server"}, "", "server"},
+		{[]string{"root@server", "tmux", "attach"}, "root", "server"},
+		{[]string{"-p", "60001", "--predict", "always", "root@server"}, "root", "server"},
+		{[]string{"--port=60001", "-4", "server"}, "", "server"},
+		{[]string{"--no-init", "--", "root@server", "top"}, "root", "server"},
+		{[]string{"-p", "60001"}, "", ""},
+	} {
+		user, host := GetMoshDestination(tc.args)
+		require.Equal(t, tc.user, user, "%v", tc.args)
+		require.Equal(t, tc.host, host, "%v", tc.args)
+	}
+}
+
+func TestGetMoshArgs(t *testing.T) {
+	args, err := GetMoshArgs([]string{"-i", "/home/alice/.ssh/kssh/key", "-o", "IdentitiesOnly=yes", "-l", "root"}, []string{"server", "tmux"})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		"--ssh=ssh -i /home/alice/.ssh/kssh/key -o IdentitiesOnly=yes -l root",
+		"--server=" + defaultMoshServer,
+		"server", "tmux",
+	}, args)
+
+	// Paths with spaces are quoted since mosh splits --ssh into words
+	args, err = GetMoshArgs([]string{"-i", "/home/alice smith/key"}, []string{"--server", "/opt/mosh/bin/mosh-server", "server"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"--ssh=ssh -i '/home/alice smith/key'", "--server", "/opt/mosh/bin/mosh-server", "server"}, args)
+
+	_, err = GetMoshArgs(nil, []string{"--ssh=ssh -p 2222", "server"})
+	require.Error(t, err)
+}
@@ -0,0 +1,106 @@
+package kssh
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+var (
+	keybaseUsernameOnce sync.Once
+	keybaseUsername     string
+	keybaseUsernameErr  error
+)
+
+// GetKeybaseUsername returns the username of the Keybase user that is currently logged in. The result is cached for
+// the lifetime of the process.
+func GetKeybaseUsername() (string, error) {
+	keybaseUsernameOnce.Do(func() {
+		cmd, err := keybaseCommand("whoami")
+		if err != nil {
+			keybaseUsernameErr = fmt.Errorf("failed to determine the current Keybase user: %v", err)
+			return
+		}
+		output, err := cmd.Output()
+		if err != nil {
+			keybaseUsernameErr = fmt.Errorf("failed to determine the current Keybase user (is Keybase running and are you logged in?): %v", err)
+			return
+		}
+		keybaseUsername = strings.TrimSpace(string(output))
+		if keybaseUsername == "" {
+			keybaseUsernameErr = fmt.Errorf("failed to determine the current Keybase user: you are not logged in")
+			return
+		}
+		keybaseUsernameErr = checkKeybaseAccount(keybaseUsername)
+	})
+	return keybaseUsername, keybaseUsernameErr
+}
+
+// setKeybaseUsername records the current Keybase user if it is already known (eg from the chat API) so that
+// GetKeybaseUsername does not need to spawn `keybase whoami`. Has no effect once GetKeybaseUsername has been called.
+func setKeybaseUsername(username string) {
+	if username == "" {
+		return
+	}
+	keybaseUsernameOnce.Do(func() {
+		keybaseUsername = username
+	})
+}
+
+// GetStateDirectory returns the directory that kssh stores its keys, locks, and sockets in. The directory is
+// namespaced by both the OS user and the Keybase user so that multiple people sharing a workstation (or a single
+// person switching between Keybase accounts) never reuse each other's certificates. The directory is created with
+// 0700 permissions if it does not exist and kssh refuses to use it if it is accessible by anyone else. Named profiles
+// (see SetProfile) each get their own subdirectory.
+func GetStateDirectory() (string, error) {
+	osUser, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the current OS user: %v", err)
+	}
+	keybaseUser, err := GetKeybaseUsername()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(shared.ExpandPathWithTilde("~/.ssh/kssh"), sanitizePathComponent(osUser.Username), sanitizePathComponent(keybaseUser))
+	if currentProfile != "" {
+		dir = filepath.Join(dir, "profiles", currentProfile)
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", fmt.Errorf("failed to create kssh state directory %s: %v", dir, err)
+	}
+	err = checkPrivateDirectory(dir)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// Replace anything that is not safe to use as a single path component (eg the backslash in DOMAIN\user on windows)
+func sanitizePathComponent(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// IsCertForCurrentUser returns whether the certificate for the key at keyPath was issued to the Keybase user that is
+// currently logged in. The CA sets the key ID of every certificate to end with ":<keybase username>".
+func IsCertForCurrentUser(keyPath string) bool {
+	cert, err := ReadCertificate(keyPath)
+	if err != nil {
+		return false
+	}
+	username, err := GetKeybaseUsername()
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(cert.KeyId, ":"+username)
+}
@@ -0,0 +1,31 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSanitizePathComponent(t *testing.T) {
+	require.Equal(t, "alice", sanitizePathComponent("alice"))
+	require.Equal(t, "DOMAIN_alice", sanitizePathComponent("DOMAIN\\alice"))
+	require.Equal(t, "_.._etc", sanitizePathComponent("/../etc"))
+}
+
+func TestCheckPrivateDirectory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not checked on windows")
+	}
+	dir, err := ioutil.TempDir("", "kssh-namespace-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	require.NoError(t, os.Chmod(dir, 0700))
+	require.NoError(t, checkPrivateDirectory(dir))
+
+	require.NoError(t, os.Chmod(dir, 0750))
+	require.Error(t, checkPrivateDirectory(dir))
+}
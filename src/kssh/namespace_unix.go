@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package kssh
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Returns an error if the given directory is not owned by the current user or is accessible by other users
+func checkPrivateDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return fmt.Errorf("refusing to use %s since it is owned by another user (uid %d)", dir, stat.Uid)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("refusing to use %s since it is accessible by other users (mode %s), run `chmod 700 %s`", dir, info.Mode().Perm(), dir)
+	}
+	return nil
+}
@@ -0,0 +1,6 @@
+package kssh
+
+// On windows the user profile directory is already protected by ACLs and unix permission bits are not meaningful
+func checkPrivateDirectory(dir string) error {
+	return nil
+}
@@ -0,0 +1,34 @@
+package kssh
+
+import (
+	"fmt"
+	"os"
+)
+
+// The environment variable that disables colored output when set to any non-empty value (see https://no-color.org)
+const NoColorEnvVar = "NO_COLOR"
+
+// Returns whether the terminal that kssh is attached to is declared as unable to move the cursor or show colors (eg
+// the terminals of screen readers and editors)
+func isDumbTerminal() bool {
+	return os.Getenv("TERM") == "dumb"
+}
+
+// ColorEnabled returns whether colors may be written to f. Colors are only written to terminals and never if NO_COLOR
+// is set or TERM is dumb.
+func ColorEnabled(f *os.File) bool {
+	return os.Getenv(NoColorEnvVar) == "" && !isDumbTerminal() && isTerminal(f)
+}
+
+// canRedraw returns whether control characters may be written to f to redraw the current line (as done by the
+// spinner). Screen readers read every redraw aloud and captured logs fill up with control characters, so this is only
+// done on terminals that are not dumb.
+func canRedraw(f *os.File) bool {
+	return !isDumbTerminal() && isTerminal(f)
+}
+
+// Statusf prints a status message (eg that a key was provisioned) on stderr. stdout is reserved for the results that
+// kssh was asked for (eg JSON, a printed config, or a completion script) so that they can be captured on their own.
+func Statusf(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, args...)
+}
@@ -0,0 +1,24 @@
+package kssh
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestColorEnabled(t *testing.T) {
+	// A pipe is never a terminal
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+	require.False(t, ColorEnabled(w))
+	require.False(t, canRedraw(w))
+
+	defer os.Setenv("TERM", os.Getenv("TERM"))
+	os.Setenv("TERM", "dumb")
+	require.True(t, isDumbTerminal())
+	os.Setenv("TERM", "xterm-256color")
+	require.False(t, isDumbTerminal())
+}
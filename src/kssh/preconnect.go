@@ -0,0 +1,324 @@
+package kssh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// The providers of the pre-connect hooks that the CA can configure (see PRE_CONNECT_HOOKS)
+const (
+	// POST the destination to an internal HTTP API (eg a port-knocking or firewall service) that opens the port for
+	// the address that the request came from
+	PreConnectProviderHTTP = "http"
+	// Allow the client's public IP address in an AWS security group (`aws ec2 authorize-security-group-ingress`)
+	PreConnectProviderAWSSecurityGroup = "aws-security-group"
+)
+
+// How long kssh waits for each request made by a pre-connect hook
+var preConnectTimeout = 10 * time.Second
+
+// Where the aws-security-group provider looks up the client's public IP address. Run by AWS.
+var publicIPURL = "https://checkip.amazonaws.com/"
+
+// Runs the aws CLI with the given arguments and returns its stdout. A variable so that tests can replace it.
+var runAWS = func(args ...string) ([]byte, error) {
+	cmd, err := shared.Command("aws", args...)
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("aws %s failed: %s (%v)", strings.Join(args[:2], " "), shared.RedactOutput(stderr.Bytes()), err)
+	}
+	return output, nil
+}
+
+// AWS security group IDs and region names. The targets and regions of hooks are checked again by kssh, rather than
+// only by keybaseca, since they are passed to the aws CLI and anyone who can write a config that kssh reads could
+// otherwise smuggle in extra arguments.
+var (
+	securityGroupIDRegex = regexp.MustCompile(`^sg-[0-9a-f]+$`)
+	awsRegionRegex       = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`)
+)
+
+// The longest that a pre-connect hook may open the firewall for, matching keybaseca's PRE_CONNECT_DURATION limit
+const maxPreConnectDuration = 24 * 60 * 60
+
+// The description of the security group rules added by the aws-security-group provider. The rule expires at the
+// given unix time, after which any kssh run that uses the same security group removes it.
+const securityGroupRulePrefix = "kssh-expires="
+
+// PreConnectHook specifies that kssh must open the firewall for hosts matching HostPattern before connecting to
+// them, eg so that port 22 can stay closed to everyone who has not just been issued a certificate
+type PreConnectHook struct {
+	// A glob (eg `*.prod.example.com`) matched against the destination host
+	HostPattern string `json:"host_pattern"`
+	// One of the PreConnectProvider constants
+	Provider string `json:"provider"`
+	// The URL of the API for the http provider or the ID of the security group for the aws-security-group provider
+	Target string `json:"target"`
+	// The cloud region to use. May be empty in which case the provider's CLI default is used.
+	Region string `json:"region,omitempty"`
+	// How long the port should stay open for, in seconds
+	Duration int `json:"duration"`
+}
+
+// The body of the requests sent by the http provider
+type preConnectRequest struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// How long the port should stay open for, in seconds
+	Duration int `json:"duration"`
+	// The Keybase user and their certificate (in authorized_keys format) so that the API can check that it was signed
+	// by the CA. Note that the certificate is not secret, so it identifies the user but does not prove who sent the
+	// request.
+	KeybaseUser string `json:"keybase_user,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// GetPreConnectHooks returns the configured pre-connect hooks that match host
+func (c *Config) GetPreConnectHooks(host string) []PreConnectHook {
+	var hooks []PreConnectHook
+	for _, hook := range c.PreConnectHooks {
+		matched, err := path.Match(hook.HostPattern, host)
+		if err == nil && matched {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// RunPreConnectHooksForArgs runs the pre-connect hooks for the destination of the given ssh arguments (see
+// RunPreConnectHooks)
+func RunPreConnectHooksForArgs(conf *Config, keyPath string, sshArgs []string) error {
+	_, host := GetSSHDestination(sshArgs)
+	return RunPreConnectHooks(conf, keyPath, host, getSSHPort(sshArgs))
+}
+
+// RunPreConnectHooks runs the pre-connect hooks that the CA configured for host, in order, so that the port that kssh
+// is about to connect to is open. keyPath is used to include the certificate in requests to an http API and may be
+// empty if the key is only in the ssh-agent. Hosts reached through a cloud tunnel are skipped since they are not
+// reached over the network directly.
+func RunPreConnectHooks(conf *Config, keyPath, host, port string) error {
+	if conf == nil || host == "" || conf.GetCloudTunnel(host) != nil {
+		return nil
+	}
+	hooks := conf.GetPreConnectHooks(host)
+	if len(hooks) == 0 {
+		return nil
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		// A named port (eg ssh) is resolved by ssh so kssh would not know which port to open
+		return fmt.Errorf("the port must be a number in order to open the firewall for %s, '%s' is not", host, port)
+	}
+	for _, hook := range hooks {
+		err = validatePreConnectHook(hook)
+		if err != nil {
+			return fmt.Errorf("refusing to run the pre-connect hook for %s: %v", host, err)
+		}
+		log.WithField("host", host).Debugf("Running the %s pre-connect hook", hook.Provider)
+		switch hook.Provider {
+		case PreConnectProviderHTTP:
+			err = callPreConnectAPI(hook, keyPath, host, portNumber)
+		case PreConnectProviderAWSSecurityGroup:
+			err = allowInSecurityGroup(hook, portNumber, time.Now())
+		}
+		if err != nil {
+			return fmt.Errorf("failed to open the firewall for %s (%s pre-connect hook): %v", host, hook.Provider, err)
+		}
+	}
+	return nil
+}
+
+// Returns an error if the given hook (from a config published by the CA) is not one that keybaseca could have written
+func validatePreConnectHook(hook PreConnectHook) error {
+	switch hook.Provider {
+	case PreConnectProviderHTTP:
+		parsed, err := url.Parse(hook.Target)
+		if err != nil || !(parsed.Scheme == "http" || parsed.Scheme == "https") || parsed.Hostname() == "" {
+			return fmt.Errorf("the http provider requires an http(s) URL, %q is not valid", hook.Target)
+		}
+	case PreConnectProviderAWSSecurityGroup:
+		if !securityGroupIDRegex.MatchString(hook.Target) {
+			return fmt.Errorf("the aws-security-group provider requires a security group ID (sg-...), %q is not valid", hook.Target)
+		}
+	default:
+		return fmt.Errorf("unsupported provider: %s", hook.Provider)
+	}
+	if hook.Region != "" && !awsRegionRegex.MatchString(hook.Region) {
+		return fmt.Errorf("%q is not a valid region", hook.Region)
+	}
+	if hook.Duration < 1 || hook.Duration > maxPreConnectDuration {
+		return fmt.Errorf("the duration must be between 1 and %d seconds, %d is not valid", maxPreConnectDuration, hook.Duration)
+	}
+	return nil
+}
+
+// Ask the API at hook.Target to open the port for this client
+func callPreConnectAPI(hook PreConnectHook, keyPath, host string, port int) error {
+	request := preConnectRequest{Host: host, Port: port, Duration: hook.Duration}
+	request.KeybaseUser, _ = GetKeybaseUsername()
+	if keyPath != "" {
+		if cert, err := ioutil.ReadFile(shared.KeyPathToCert(keyPath)); err == nil {
+			request.Certificate = strings.TrimSpace(string(cert))
+		}
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: preConnectTimeout}
+	resp, err := client.Post(hook.Target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1024))
+		return fmt.Errorf("the API returned %s: %s", resp.Status, shared.Redact(strings.TrimSpace(string(message))))
+	}
+	return nil
+}
+
+// The parts of `aws ec2 describe-security-groups` output that are needed to find kssh's rules
+type securityGroups struct {
+	SecurityGroups []struct {
+		IpPermissions []securityGroupPermission
+	}
+}
+
+type securityGroupPermission struct {
+	IpProtocol string
+	FromPort   int               `json:",omitempty"`
+	ToPort     int               `json:",omitempty"`
+	IpRanges   []securityGroupIP `json:",omitempty"`
+	Ipv6Ranges []securityGroupIP `json:",omitempty"`
+}
+
+type securityGroupIP struct {
+	CidrIp      string `json:",omitempty"`
+	CidrIpv6    string `json:",omitempty"`
+	Description string `json:",omitempty"`
+}
+
+// Allow this client's public IP address to connect to the given port in the security group hook.Target until
+// hook.Duration from now. Security group rules cannot expire on their own so expired rules added by kssh (including
+// those of other users) are removed first, along with any existing rule for this client so that its expiry is
+// extended.
+func allowInSecurityGroup(hook PreConnectHook, port int, now time.Time) error {
+	ip, err := getPublicIP()
+	if err != nil {
+		return fmt.Errorf("failed to determine the public IP address of this machine: %v", err)
+	}
+	var rule securityGroupIP
+	if ip.To4() != nil {
+		rule.CidrIp = ip.String() + "/32"
+	} else {
+		rule.CidrIpv6 = ip.String() + "/128"
+	}
+	regionArgs := []string{}
+	if hook.Region != "" {
+		regionArgs = []string{"--region", hook.Region}
+	}
+
+	output, err := runAWS(append([]string{"ec2", "describe-security-groups", "--group-ids", hook.Target, "--output", "json"}, regionArgs...)...)
+	if err != nil {
+		return err
+	}
+	var groups securityGroups
+	err = json.Unmarshal(output, &groups)
+	if err != nil {
+		return fmt.Errorf("failed to parse the security group %s: %v", hook.Target, err)
+	}
+	var stale []securityGroupPermission
+	for _, group := range groups.SecurityGroups {
+		for _, permission := range group.IpPermissions {
+			isStale := func(existing securityGroupIP) bool {
+				if !strings.HasPrefix(existing.Description, securityGroupRulePrefix) {
+					return false
+				}
+				if existing.CidrIp == rule.CidrIp && existing.CidrIpv6 == rule.CidrIpv6 && permission.FromPort == port {
+					return true
+				}
+				expiry, err := strconv.ParseInt(strings.TrimPrefix(existing.Description, securityGroupRulePrefix), 10, 64)
+				return err == nil && expiry < now.Unix()
+			}
+			revoke := securityGroupPermission{IpProtocol: permission.IpProtocol, FromPort: permission.FromPort, ToPort: permission.ToPort}
+			for _, existing := range permission.IpRanges {
+				if isStale(existing) {
+					revoke.IpRanges = append(revoke.IpRanges, securityGroupIP{CidrIp: existing.CidrIp})
+				}
+			}
+			for _, existing := range permission.Ipv6Ranges {
+				if isStale(existing) {
+					revoke.Ipv6Ranges = append(revoke.Ipv6Ranges, securityGroupIP{CidrIpv6: existing.CidrIpv6})
+				}
+			}
+			if len(revoke.IpRanges) > 0 || len(revoke.Ipv6Ranges) > 0 {
+				stale = append(stale, revoke)
+			}
+		}
+	}
+	if len(stale) > 0 {
+		permissions, err := json.Marshal(stale)
+		if err != nil {
+			return err
+		}
+		_, err = runAWS(append([]string{"ec2", "revoke-security-group-ingress", "--group-id", hook.Target, "--ip-permissions", string(permissions)}, regionArgs...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	rule.Description = securityGroupRulePrefix + strconv.FormatInt(now.Add(time.Duration(hook.Duration)*time.Second).Unix(), 10)
+	allow := securityGroupPermission{IpProtocol: "tcp", FromPort: port, ToPort: port}
+	if rule.CidrIp != "" {
+		allow.IpRanges = []securityGroupIP{rule}
+	} else {
+		allow.Ipv6Ranges = []securityGroupIP{rule}
+	}
+	permissions, err := json.Marshal([]securityGroupPermission{allow})
+	if err != nil {
+		return err
+	}
+	_, err = runAWS(append([]string{"ec2", "authorize-security-group-ingress", "--group-id", hook.Target, "--ip-permissions", string(permissions)}, regionArgs...)...)
+	return err
+}
+
+// Look up the public IP address of this machine
+func getPublicIP() (net.IP, error) {
+	client := http.Client{Timeout: preConnectTimeout}
+	resp, err := client.Get(publicIPURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, 1024))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", publicIPURL, resp.Status)
+	}
+	ip := net.ParseIP(strings.TrimSpace(string(body)))
+	if ip == nil {
+		return nil, fmt.Errorf("%s did not return an IP address", publicIPURL)
+	}
+	return ip, nil
+}
@@ -0,0 +1,145 @@
+package kssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunPreConnectHooksHTTP(t *testing.T) {
+	var requests []preConnectRequest
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request preConnectRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		requests = append(requests, request)
+		w.WriteHeader(status)
+		fmt.Fprint(w, "denied")
+	}))
+	defer server.Close()
+
+	conf := &Config{
+		PreConnectHooks: []PreConnectHook{{HostPattern: "*.prod.example.com", Provider: PreConnectProviderHTTP, Target: server.URL, Duration: 600}},
+		CloudTunnels:    []CloudTunnel{{HostPattern: "i-*", Provider: CloudProviderAWSSSM}},
+	}
+	require.NoError(t, RunPreConnectHooks(nil, "", "db.prod.example.com", "22"))
+	require.NoError(t, RunPreConnectHooksForArgs(conf, "", []string{"-p", "2222", "root@db.prod.example.com"}))
+	require.Len(t, requests, 1)
+	require.Equal(t, "db.prod.example.com", requests[0].Host)
+	require.Equal(t, 2222, requests[0].Port)
+	require.Equal(t, 600, requests[0].Duration)
+
+	// Hosts that do not match and cloud tunnels are skipped
+	require.NoError(t, RunPreConnectHooks(conf, "", "db.staging.example.com", "22"))
+	conf.PreConnectHooks[0].HostPattern = "*"
+	require.NoError(t, RunPreConnectHooks(conf, "", "i-0123456789", "22"))
+	require.Len(t, requests, 1)
+
+	require.Error(t, RunPreConnectHooks(conf, "", "db.prod.example.com", "ssh"))
+	status = http.StatusForbidden
+	err := RunPreConnectHooks(conf, "", "db.prod.example.com", "22")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "403 Forbidden: denied")
+}
+
+func TestValidatePreConnectHook(t *testing.T) {
+	valid := []PreConnectHook{
+		{Provider: PreConnectProviderHTTP, Target: "https://knock.internal.example.com/open", Duration: 600},
+		{Provider: PreConnectProviderHTTP, Target: "http://10.0.0.1:8080/open", Duration: 1},
+		{Provider: PreConnectProviderAWSSecurityGroup, Target: "sg-0123456789abcdef0", Region: "us-east-1", Duration: 86400},
+		{Provider: PreConnectProviderAWSSecurityGroup, Target: "sg-0123", Duration: 600},
+	}
+	for _, hook := range valid {
+		require.NoError(t, validatePreConnectHook(hook), hook)
+	}
+	invalid := []PreConnectHook{
+		{Provider: PreConnectProviderHTTP, Target: "file:///etc/passwd", Duration: 600},
+		{Provider: PreConnectProviderHTTP, Target: "https://", Duration: 600},
+		{Provider: PreConnectProviderAWSSecurityGroup, Target: "--profile=evil", Duration: 600},
+		{Provider: PreConnectProviderAWSSecurityGroup, Target: "sg-0123 --profile evil", Duration: 600},
+		{Provider: PreConnectProviderAWSSecurityGroup, Target: "sg-0123", Region: "--endpoint-url=https://evil.example.com", Duration: 600},
+		{Provider: PreConnectProviderAWSSecurityGroup, Target: "sg-0123", Region: "US-EAST-1", Duration: 600},
+		{Provider: PreConnectProviderAWSSecurityGroup, Target: "sg-0123", Duration: 0},
+		{Provider: PreConnectProviderAWSSecurityGroup, Target: "sg-0123", Duration: 86401},
+		{Provider: "gcp-firewall", Target: "default", Duration: 600},
+	}
+	for _, hook := range invalid {
+		require.Error(t, validatePreConnectHook(hook), hook)
+	}
+
+	// An invalid hook is refused before anything is run
+	called := false
+	oldRunAWS := runAWS
+	defer func() { runAWS = oldRunAWS }()
+	runAWS = func(args ...string) ([]byte, error) {
+		called = true
+		return nil, nil
+	}
+	conf := &Config{PreConnectHooks: []PreConnectHook{invalid[4]}}
+	conf.PreConnectHooks[0].HostPattern = "*"
+	err := RunPreConnectHooks(conf, "", "db.prod.example.com", "22")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "refusing")
+	require.False(t, called)
+}
+
+func TestAllowInSecurityGroup(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "203.0.113.7")
+	}))
+	defer server.Close()
+	oldURL, oldRunAWS := publicIPURL, runAWS
+	defer func() { publicIPURL, runAWS = oldURL, oldRunAWS }()
+	publicIPURL = server.URL
+
+	now := time.Unix(1700000000, 0)
+	var calls [][]string
+	runAWS = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		if args[1] != "describe-security-groups" {
+			return nil, nil
+		}
+		return []byte(`{"SecurityGroups": [{"IpPermissions": [
+			{"IpProtocol": "tcp", "FromPort": 22, "ToPort": 22, "IpRanges": [
+				{"CidrIp": "10.0.0.0/8", "Description": "office"},
+				{"CidrIp": "198.51.100.1/32", "Description": "kssh-expires=1699999999"},
+				{"CidrIp": "198.51.100.2/32", "Description": "kssh-expires=1700000001"},
+				{"CidrIp": "203.0.113.7/32", "Description": "kssh-expires=1700000100"}
+			]},
+			{"IpProtocol": "tcp", "FromPort": 2222, "ToPort": 2222, "IpRanges": [
+				{"CidrIp": "203.0.113.7/32", "Description": "kssh-expires=1700000100"}
+			]}
+		]}]}`), nil
+	}
+	hook := PreConnectHook{HostPattern: "*", Provider: PreConnectProviderAWSSecurityGroup, Target: "sg-0123", Region: "us-east-1", Duration: 600}
+	require.NoError(t, allowInSecurityGroup(hook, 22, now))
+	require.Len(t, calls, 3)
+	require.Equal(t, []string{"ec2", "describe-security-groups", "--group-ids", "sg-0123", "--output", "json", "--region", "us-east-1"}, calls[0])
+
+	// The expired rule and this machine's old rule for the same port are removed
+	require.Equal(t, "revoke-security-group-ingress", calls[1][1])
+	require.Equal(t, `[{"IpProtocol":"tcp","FromPort":22,"ToPort":22,"IpRanges":[{"CidrIp":"198.51.100.1/32"},{"CidrIp":"203.0.113.7/32"}]}]`, calls[1][5])
+
+	require.Equal(t, "authorize-security-group-ingress", calls[2][1])
+	require.Equal(t, `[{"IpProtocol":"tcp","FromPort":22,"ToPort":22,"IpRanges":[{"CidrIp":"203.0.113.7/32","Description":"kssh-expires=1700000600"}]}]`, calls[2][5])
+
+	// Nothing is revoked if there are no stale rules
+	calls = nil
+	runAWS = func(args ...string) ([]byte, error) {
+		calls = append(calls, args)
+		return []byte(`{"SecurityGroups": [{"IpPermissions": []}]}`), nil
+	}
+	hook.Region = ""
+	require.NoError(t, allowInSecurityGroup(hook, 22, now))
+	require.Len(t, calls, 2)
+	require.Equal(t, "authorize-security-group-ingress", calls[1][1])
+	require.False(t, strings.Contains(strings.Join(calls[1], " "), "--region"))
+}
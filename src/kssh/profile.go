@@ -0,0 +1,55 @@
+package kssh
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// The environment variable used to select a profile. It is also set by SetProfile so that any kssh processes spawned
+// by this one (eg via git's core.sshCommand or an ssh ProxyCommand) use the same profile.
+const ProfileEnvVar = "KSSH_PROFILE"
+
+// Profile names are used as part of file names
+var profileNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// The profile that is currently in use. Empty for the default profile.
+var currentProfile string
+
+// SetProfile switches kssh to the given named profile (eg work or personal). Each profile has its own local config
+// file (and so its own default bot, default user, and cached client configs), its own SSH config file, and its own
+// state directory so that keys and certificates are never shared between profiles. An empty name or "default" selects
+// the default profile. Must be called before anything else in kssh is used.
+func SetProfile(name string) error {
+	if name == "default" {
+		name = ""
+	}
+	if name != "" && !profileNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q: must only contain letters, numbers, '-', and '_'", name)
+	}
+	currentProfile = name
+	if name == "" {
+		localConfigFileLocation = shared.ExpandPathWithTilde("~/.ssh/kssh-config.json")
+		AlternateSSHConfigFile = shared.ExpandPathWithTilde("~/.ssh/kssh-config")
+		return os.Unsetenv(ProfileEnvVar)
+	}
+	localConfigFileLocation = shared.ExpandPathWithTilde(fmt.Sprintf("~/.ssh/kssh-config-%s.json", name))
+	AlternateSSHConfigFile = shared.ExpandPathWithTilde(fmt.Sprintf("~/.ssh/kssh-config-%s", name))
+	return os.Setenv(ProfileEnvVar, name)
+}
+
+// SetProfileFromEnv selects the profile named by $KSSH_PROFILE, if any
+func SetProfileFromEnv() error {
+	name := os.Getenv(ProfileEnvVar)
+	if name == "" {
+		return nil
+	}
+	return SetProfile(name)
+}
+
+// GetProfile returns the name of the profile that is currently in use. Empty for the default profile.
+func GetProfile() string {
+	return currentProfile
+}
@@ -0,0 +1,33 @@
+package kssh
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetProfile(t *testing.T) {
+	defaultConfig, defaultSSHConfig := localConfigFileLocation, AlternateSSHConfigFile
+	defer func() { require.NoError(t, SetProfile("")) }()
+
+	require.NoError(t, SetProfile("work"))
+	require.Equal(t, "work", GetProfile())
+	require.Equal(t, "work", os.Getenv(ProfileEnvVar))
+	require.NotEqual(t, defaultConfig, localConfigFileLocation)
+	require.NotEqual(t, defaultSSHConfig, AlternateSSHConfigFile)
+	workConfig := localConfigFileLocation
+
+	require.NoError(t, SetProfile("client-x"))
+	require.NotEqual(t, workConfig, localConfigFileLocation)
+
+	require.Error(t, SetProfile("../work"))
+	require.Error(t, SetProfile("work personal"))
+	require.Equal(t, "client-x", GetProfile())
+
+	require.NoError(t, SetProfile("default"))
+	require.Equal(t, "", GetProfile())
+	require.Equal(t, "", os.Getenv(ProfileEnvVar))
+	require.Equal(t, defaultConfig, localConfigFileLocation)
+	require.Equal(t, defaultSSHConfig, AlternateSSHConfigFile)
+}
@@ -0,0 +1,178 @@
+package kssh
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Verbosity controls how much kssh prints about what it is doing
+type Verbosity int
+
+const (
+	// A single line spinner (or a line per step on a dumb terminal) is shown while a new key is provisioned
+	VerbosityNormal Verbosity = iota
+	// Nothing but errors are printed (--quiet). Intended for scripts.
+	VerbosityQuiet
+	// Every step of provisioning a new key is printed along with how long it took (--verbose)
+	VerbosityVerbose
+)
+
+// The characters cycled through by the spinner. ASCII so that it renders in every terminal.
+var spinnerFrames = []string{"|", "/", "-", "\\"}
+
+// How often the spinner is redrawn
+const spinnerInterval = 100 * time.Millisecond
+
+// How the steps are shown in normal mode
+type progressDisplay int
+
+const (
+	// Nothing is shown, eg because stderr is not a terminal
+	displayNone progressDisplay = iota
+	// A spinner with the current step is redrawn on a single line
+	displaySpinner
+	// Each step is printed on its own line as it starts. Used on dumb terminals (eg screen readers) that cannot
+	// redraw a line.
+	displayLines
+)
+
+// Progress reports the steps of provisioning a new key on stderr. In normal mode a spinner with the current step is
+// shown if stderr is a terminal (or each step is printed on its own line if TERM is dumb), in verbose mode each step is
+// printed with its duration once it completes, and in quiet mode nothing is printed.
+type Progress struct {
+	out       io.Writer
+	verbosity Verbosity
+	display   progressDisplay
+
+	lock      sync.Mutex
+	start     time.Time
+	stepStart time.Time
+	step      string
+	frame     int
+	drawn     bool
+	stopCh    chan struct{}
+	stoppedCh chan struct{}
+}
+
+// StartProgress starts reporting progress on stderr with the given verbosity. Finish must be called once provisioning
+// is complete.
+func StartProgress(verbosity Verbosity) *Progress {
+	display := displayNone
+	if verbosity == VerbosityNormal && canRedraw(os.Stderr) {
+		display = displaySpinner
+	} else if verbosity == VerbosityNormal && isTerminal(os.Stderr) {
+		display = displayLines
+	}
+	return newProgress(os.Stderr, verbosity, display)
+}
+
+// Returns whether the given file is a terminal (rather than eg a pipe that a script is reading from)
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgress(out io.Writer, verbosity Verbosity, display progressDisplay) *Progress {
+	now := time.Now()
+	p := &Progress{out: out, verbosity: verbosity, display: display, start: now, stepStart: now}
+	if display == displaySpinner {
+		p.stopCh = make(chan struct{})
+		p.stoppedCh = make(chan struct{})
+		go p.runSpinner()
+	}
+	return p
+}
+
+// Step records that the given step (eg "Requesting a signature from the CA") has started. Any previous step is
+// complete.
+func (p *Progress) Step(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.completeStep(time.Now())
+	p.step = name
+	switch p.display {
+	case displaySpinner:
+		p.draw()
+	case displayLines:
+		fmt.Fprintf(p.out, "kssh: %s...\n", name)
+	}
+}
+
+// Interrupt clears the spinner while f prints to the terminal (eg instructions for the user) so that the two do not
+// overlap
+func (p *Progress) Interrupt(f func()) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.clear()
+	f()
+}
+
+// Finish stops reporting progress. err is the result of provisioning.
+func (p *Progress) Finish(err error) {
+	if p.display == displaySpinner {
+		close(p.stopCh)
+		<-p.stoppedCh
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	p.clear()
+	if err == nil {
+		p.completeStep(now)
+		if p.verbosity == VerbosityVerbose {
+			fmt.Fprintf(p.out, "kssh: Provisioned a new key in %s\n", formatStepDuration(now.Sub(p.start)))
+		}
+	} else if p.verbosity == VerbosityVerbose && p.step != "" {
+		fmt.Fprintf(p.out, "kssh: %s failed after %s\n", p.step, formatStepDuration(now.Sub(p.stepStart)))
+	}
+	p.step = ""
+}
+
+// Print the current step with its duration in verbose mode. Must be called with the lock held.
+func (p *Progress) completeStep(now time.Time) {
+	if p.step != "" && p.verbosity == VerbosityVerbose {
+		fmt.Fprintf(p.out, "kssh: %s (%s)\n", p.step, formatStepDuration(now.Sub(p.stepStart)))
+	}
+	p.stepStart = now
+}
+
+func (p *Progress) runSpinner() {
+	defer close(p.stoppedCh)
+	ticker := time.NewTicker(spinnerInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+			p.lock.Lock()
+			p.frame = (p.frame + 1) % len(spinnerFrames)
+			p.draw()
+			p.lock.Unlock()
+		}
+	}
+}
+
+// Redraw the spinner line. Must be called with the lock held.
+func (p *Progress) draw() {
+	if p.step == "" {
+		return
+	}
+	fmt.Fprintf(p.out, "\r\033[K%s %s...", spinnerFrames[p.frame], p.step)
+	p.drawn = true
+}
+
+// Erase the spinner line. Must be called with the lock held.
+func (p *Progress) clear() {
+	if p.drawn {
+		fmt.Fprint(p.out, "\r\033[K")
+		p.drawn = false
+	}
+}
+
+func formatStepDuration(d time.Duration) string {
+	return fmt.Sprintf("%.2fs", d.Seconds())
+}
@@ -0,0 +1,67 @@
+package kssh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgressVerbose(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, VerbosityVerbose, displayNone)
+	p.Step("Starting Keybase chat")
+	p.Step("Requesting a signature from the CA")
+	p.Finish(nil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	require.Regexp(t, `^kssh: Starting Keybase chat \([0-9.]+s\)$`, lines[0])
+	require.Regexp(t, `^kssh: Requesting a signature from the CA \([0-9.]+s\)$`, lines[1])
+	require.Regexp(t, `^kssh: Provisioned a new key in [0-9.]+s$`, lines[2])
+
+	buf.Reset()
+	p = newProgress(&buf, VerbosityVerbose, displayNone)
+	p.Step("Starting Keybase chat")
+	p.Finish(fmt.Errorf("keybase is not running"))
+	require.Regexp(t, `^kssh: Starting Keybase chat failed after [0-9.]+s\n$`, buf.String())
+}
+
+func TestProgressQuiet(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, VerbosityQuiet, displayNone)
+	p.Step("Starting Keybase chat")
+	p.Interrupt(func() {})
+	p.Finish(nil)
+	require.Empty(t, buf.String())
+}
+
+func TestProgressSpinner(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, VerbosityNormal, displaySpinner)
+	p.Step("Starting Keybase chat")
+	p.Interrupt(func() { buf.WriteString("instructions\n") })
+	p.Step("Waiting for you to log in")
+	p.Finish(nil)
+
+	out := buf.String()
+	require.Contains(t, out, "| Starting Keybase chat...")
+	// The spinner line is cleared before anything else is printed and once provisioning is done
+	require.Contains(t, out, "\r\033[Kinstructions\n")
+	require.Contains(t, out, "Waiting for you to log in...")
+	require.True(t, strings.HasSuffix(out, "\r\033[K"))
+}
+
+func TestProgressLines(t *testing.T) {
+	var buf bytes.Buffer
+	p := newProgress(&buf, VerbosityNormal, displayLines)
+	p.Step("Starting Keybase chat")
+	p.Interrupt(func() { buf.WriteString("instructions\n") })
+	p.Step("Waiting for you to log in")
+	p.Finish(nil)
+
+	// Nothing is redrawn so that screen readers only read each step once
+	require.Equal(t, "kssh: Starting Keybase chat...\ninstructions\nkssh: Waiting for you to log in...\n", buf.String())
+}
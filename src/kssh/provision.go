@@ -0,0 +1,280 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigError is returned by ProvisionNewKey when no usable kssh config could be found
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string {
+	return e.Err.Error()
+}
+
+// CAError is returned by ProvisionNewKey when the CA did not sign the key
+type CAError struct {
+	Err error
+}
+
+func (e *CAError) Error() string {
+	return e.Err.Error()
+}
+
+// GetSignedKeyLocation returns the path of where the signed SSH key should be stored. botName is the name of the bot
+// specified via --bot if specified. It is necessary to include the bot in the filename in order to properly
+// handle how the switch bot flow interacts with the IsValidCert function. Keys are stored in the namespaced
+// state directory (see GetStateDirectory).
+func GetSignedKeyLocation(botName string) (string, error) {
+	stateDirectory, err := GetStateDirectory()
+	if err != nil {
+		return "", err
+	}
+	signedKeyLocation := filepath.Join(stateDirectory, "keybase-signed-key--")
+	if botName != "" {
+		return signedKeyLocation + botName, nil
+	}
+	defaultBot, _, err := GetDefaultBotAndTeam()
+	if err != nil {
+		return "", err
+	}
+	return signedKeyLocation + defaultBot, nil
+}
+
+// IsValidCert returns whether or not the cert at the given path is a valid unexpired certificate
+func IsValidCert(keyPath string) bool {
+	_, err1 := os.Stat(keyPath)
+	_, err2 := os.Stat(shared.KeyPathToPubKey(keyPath))
+	_, err3 := os.Stat(shared.KeyPathToCert(keyPath))
+	if os.IsNotExist(err1) || os.IsNotExist(err2) || os.IsNotExist(err3) {
+		return false // Cert does not exist
+	}
+
+	cert, err := ReadCertificate(keyPath)
+	if err != nil {
+		// Failed to read or parse it so just provision a new cert
+		return false
+	}
+	validBefore := time.Unix(int64(cert.ValidBefore), 0)
+	validAfter := time.Unix(int64(cert.ValidAfter), 0)
+	return time.Now().After(validAfter) && time.Now().Before(validBefore)
+}
+
+// IsReusableCert returns whether the cert at the given path is valid and was issued to the current Keybase user. kssh
+// refuses to reuse a certificate that was issued to a different Keybase user.
+func IsReusableCert(keyPath string) bool {
+	if !IsValidCert(keyPath) {
+		return false
+	}
+	if !IsCertForCurrentUser(keyPath) {
+		log.WithField("keyPath", keyPath).Warn("Not reusing a certificate that was issued to a different Keybase user")
+		return false
+	}
+	return true
+}
+
+// ProvisionNewKey provisions a new signed SSH key at keyPath by asking the CA bot (see Requester.GetConfig for how
+// botName is used) to sign it
+func ProvisionNewKey(requester *Requester, botName string, keyPath string) error {
+	return provisionKey(requester, botName, keyPath, false)
+}
+
+// ProvisionElevatedKey is like ProvisionNewKey but requests an elevated certificate that also includes the elevated
+// principals configured in keybaseca. Elevated certificates are short lived and always require MFA.
+func ProvisionElevatedKey(requester *Requester, botName string, keyPath string) error {
+	return provisionKey(requester, botName, keyPath, true)
+}
+
+func provisionKey(requester *Requester, botName string, keyPath string, elevate bool) error {
+	err := RunHooks(PreProvision, HookContext{BotName: botName, KeyPath: keyPath})
+	if err != nil {
+		return err
+	}
+
+	log.Debug("Generating a new SSH key...")
+	requester.reportProgress("Generating a new SSH key")
+
+	// Make ~/.ssh/ in case it doesn't exist
+	err = MakeDotSSH()
+	if err != nil {
+		return err
+	}
+
+	// Generate the key itself and read it
+	err = sshutils.GenerateNewSSHKey(keyPath, true, false)
+	if err != nil {
+		return fmt.Errorf("Failed to generate a new SSH key: %v", err)
+	}
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(keyPath))
+	if err != nil {
+		return fmt.Errorf("Failed to read the SSH key from the filesystem: %v", err)
+	}
+
+	conf, signedKey, err := requestCertificate(requester, botName, keyPath, string(pubKey), elevate)
+	if err != nil {
+		return err
+	}
+
+	// Write it to ~/.ssh
+	err = ioutil.WriteFile(shared.KeyPathToCert(keyPath), []byte(signedKey), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write new SSH key to disk: %v", err)
+	}
+
+	// Remember the config so that it is available when this certificate is reused
+	err = CacheClientConfig(keyPath, conf)
+	if err != nil {
+		return fmt.Errorf("Failed to cache the client config: %v", err)
+	}
+
+	return RunHooks(PostProvision, HookContext{BotName: botName, KeyPath: keyPath})
+}
+
+// Ask the CA to sign the given public key and verify the returned certificate. keyPath is where the signed key is
+// (or would be) stored and is used to look up the previously cached config. Returns the config of the CA and the
+// certificate in authorized_keys format.
+func requestCertificate(requester *Requester, botName, keyPath, pubKey string, elevate bool) (Config, string, error) {
+	randomUUID, err := uuid.NewRandom()
+	if err != nil {
+		return Config{}, "", fmt.Errorf("Failed to generate a new UUID for the SignatureRequest: %v", err)
+	}
+
+	requester.reportProgress("Loading the kssh config")
+	conf, err := requester.GetConfig(botName)
+	if err != nil {
+		return conf, "", &ConfigError{Err: fmt.Errorf("Failed to get config: %v", err)}
+	}
+
+	log.Debug("Requesting signature from the CA....")
+	nonce, err := uuid.NewRandom()
+	if err != nil {
+		return conf, "", fmt.Errorf("Failed to generate a nonce for the SignatureRequest: %v", err)
+	}
+	resp, err := requester.GetSignedKeyWithConfig(conf, shared.SignatureRequest{
+		UUID:                randomUUID.String(),
+		SSHPublicKey:        pubKey,
+		Nonce:               nonce.String(),
+		Timestamp:           time.Now().Unix(),
+		Elevate:             elevate,
+		SignatureAlgorithms: requester.SignatureAlgorithms,
+		Extensions:          requester.Extensions,
+	})
+	if denied, ok := err.(*DeniedError); ok {
+		return conf, "", &CAError{Err: denied}
+	}
+	if err != nil {
+		return conf, "", &CAError{Err: fmt.Errorf("Failed to get a signed key from the CA: %v", err)}
+	}
+	log.Debug("Received signature from the CA!")
+	requester.reportProgress("Verifying the certificate")
+
+	// Make sure the CA actually signed what was requested before installing it
+	teams, err := requester.getAllTeams()
+	if err != nil {
+		return conf, "", fmt.Errorf("Failed to retrieve the list of teams you are in: %v", err)
+	}
+	allowedPrincipals := append(teams, conf.GroupPrincipals...)
+	if conf.UsernamePrincipals {
+		for _, username := range resp.UsernamePrincipals {
+			if shared.IsValidUnixUsername(username) {
+				allowedPrincipals = append(allowedPrincipals, username)
+			}
+		}
+	}
+	if elevate {
+		allowedPrincipals = append(allowedPrincipals, conf.ElevatedPrincipals...)
+	}
+	expectedCAKey := expectedCAKeyForCertificate(conf, getExpectedCAKey(conf, keyPath), resp.SignedKey)
+	cert, err := VerifySignedKey(conf.BotName, expectedCAKey, pubKey, resp.SignedKey, allowedPrincipals)
+	if err != nil {
+		log.Error(err)
+		return conf, "", &CAError{Err: err}
+	}
+	if missing := MissingExtensions(cert, requester.Extensions); len(missing) > 0 {
+		log.Warnf("The CA did not include the extensions %s since they are not allowed for your teams",
+			strings.Join(missing, ", "))
+	}
+
+	// Done after verification since verification compares against the cached CA key
+	if err = RefreshLocalConfig(conf); err != nil {
+		log.Warnf("Failed to update the local config file: %v", err)
+	}
+	return conf, resp.SignedKey, nil
+}
+
+// ProvisionSchemaVersion is the version of the JSON printed by `kssh --provision --json`. It is incremented whenever
+// a field is removed or changes meaning. New fields may be added without incrementing it.
+const ProvisionSchemaVersion = 1
+
+// ProvisionResult is printed by `kssh --provision --json` on success
+type ProvisionResult struct {
+	Version int `json:"version"`
+	// Whether an existing unexpired certificate was reused rather than a new one being signed
+	Reused          bool     `json:"reused"`
+	BotName         string   `json:"bot_name,omitempty"`
+	PrivateKeyPath  string   `json:"private_key_path"`
+	PublicKeyPath   string   `json:"public_key_path"`
+	CertificatePath string   `json:"certificate_path"`
+	KeyID           string   `json:"key_id"`
+	Principals      []string `json:"principals"`
+	// RFC3339 timestamps in UTC
+	ValidAfter  string `json:"valid_after"`
+	ValidBefore string `json:"valid_before"`
+}
+
+// ProvisionError is printed by `kssh --provision --json` on failure
+type ProvisionError struct {
+	Version  int    `json:"version"`
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code"`
+	// If the CA denied the request, one of the shared.Denial* codes and what the user can do about it
+	DenialCode  string `json:"denial_code,omitempty"`
+	Remediation string `json:"remediation,omitempty"`
+}
+
+// NewProvisionResult builds the ProvisionResult describing the signed key at keyPath
+func NewProvisionResult(keyPath string, reused bool) (ProvisionResult, error) {
+	cert, err := ReadCertificate(keyPath)
+	if err != nil {
+		return ProvisionResult{}, err
+	}
+	result := ProvisionResult{
+		Version:         ProvisionSchemaVersion,
+		Reused:          reused,
+		PrivateKeyPath:  keyPath,
+		PublicKeyPath:   shared.KeyPathToPubKey(keyPath),
+		CertificatePath: shared.KeyPathToCert(keyPath),
+		KeyID:           cert.KeyId,
+		Principals:      cert.ValidPrincipals,
+		ValidAfter:      time.Unix(int64(cert.ValidAfter), 0).UTC().Format(time.RFC3339),
+		ValidBefore:     time.Unix(int64(cert.ValidBefore), 0).UTC().Format(time.RFC3339),
+	}
+	if result.Principals == nil {
+		result.Principals = []string{}
+	}
+	conf, err := GetCachedClientConfig(keyPath)
+	if err != nil {
+		return ProvisionResult{}, err
+	}
+	if conf != nil {
+		result.BotName = conf.BotName
+	}
+	return result, nil
+}
+
+// ElevatedKeyPath returns where the elevated key for the regular key at keyPath is stored. Elevated keys are stored
+// separately so that an elevated certificate is only used when --elevate is passed.
+func ElevatedKeyPath(keyPath string) string {
+	return keyPath + "-elevated"
+}
@@ -0,0 +1,64 @@
+package kssh
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// The timeout for establishing the TCP connection in proxy mode
+const proxyDialTimeout = 30 * time.Second
+
+// Proxy connects to host:port and copies data between the connection and stdin/stdout until either side is closed.
+// This implements `kssh --proxy-mode %h %p` for use as an OpenSSH ProxyCommand. If conf has a CloudTunnel for host,
+// the tunnel's command is run in place of the TCP connection. conf may be nil.
+func Proxy(conf *Config, host, port string) error {
+	if conf != nil {
+		if tunnel := conf.GetCloudTunnel(host); tunnel != nil {
+			return proxyViaTunnel(tunnel, host, port)
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), proxyDialTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s:%s: %v", host, port, err)
+	}
+	defer conn.Close()
+
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+		// Let the server know that no more data is coming while still reading its response
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			_ = tcpConn.CloseWrite()
+		}
+	}()
+	// ssh waits for us to exit once it is done, so we are finished as soon as the server closes the connection
+	_, err = io.Copy(os.Stdout, conn)
+	if err != nil {
+		return fmt.Errorf("proxy connection to %s:%s failed: %v", host, port, err)
+	}
+	return nil
+}
+
+// Run the proxy command for the given tunnel with its %h and %p tokens expanded
+func proxyViaTunnel(tunnel *CloudTunnel, host, port string) error {
+	proxyCommand, err := tunnel.ProxyCommand()
+	if err != nil {
+		return err
+	}
+	replacer := strings.NewReplacer("%h", host, "%p", port)
+	args := strings.Fields(replacer.Replace(proxyCommand))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v", args[0], err)
+	}
+	return nil
+}
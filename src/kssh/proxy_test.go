@@ -0,0 +1,47 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	// An echo server that prefixes its response so that the test can tell the bytes came through the connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("echo:"), data...))
+	}()
+
+	stdinReader, stdinWriter, err := os.Pipe()
+	require.NoError(t, err)
+	stdoutReader, stdoutWriter, err := os.Pipe()
+	require.NoError(t, err)
+	oldStdin, oldStdout := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = stdinReader, stdoutWriter
+	defer func() { os.Stdin, os.Stdout = oldStdin, oldStdout }()
+
+	_, err = stdinWriter.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, stdinWriter.Close())
+
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, Proxy(nil, "127.0.0.1", port))
+	require.NoError(t, stdoutWriter.Close())
+
+	output, err := ioutil.ReadAll(stdoutReader)
+	require.NoError(t, err)
+	require.Equal(t, "echo:hello", string(output))
+}
@@ -0,0 +1,76 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/serversetup"
+	"github.com/keybase/bot-sshca/src/shared"
+	"golang.org/x/crypto/ssh"
+)
+
+// The long-lived public keys that `kssh --push-key` installs, in order of preference. The same keys that ssh uses by
+// default.
+var longLivedPublicKeys = []string{"id_ed25519.pub", "id_ecdsa.pub", "id_rsa.pub"}
+
+// FindLongLivedPublicKey returns the user's long-lived public key in ~/.ssh in authorized_keys format (ie not a key
+// signed by kssh) for `kssh --push-key`
+func FindLongLivedPublicKey() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range longLivedPublicKeys {
+		contents, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, _, _, _, err = ssh.ParseAuthorizedKey(contents)
+		if err != nil {
+			return "", fmt.Errorf("failed to parse ~/.ssh/%s: %v", name, err)
+		}
+		return strings.TrimSpace(string(contents)), nil
+	}
+	return "", fmt.Errorf("none of %s exist in ~/.ssh, create a key with ssh-keygen first", strings.Join(longLivedPublicKeys, ", "))
+}
+
+// PushKeyArgs returns the ssh arguments (like ssh-copy-id) that append publicKey to the authorized_keys of the user
+// that destination logs in as, unless it is already there. sshOptions are passed to ssh before the destination (eg -p
+// 2222). The connection is authenticated however plain ssh would (eg with a password) since the host does not trust
+// the CA yet.
+func PushKeyArgs(destination, publicKey string, sshOptions []string) []string {
+	script := "umask 077 && mkdir -p ~/.ssh && touch ~/.ssh/authorized_keys && " +
+		"{ grep -qxF " + shared.ShellQuote(publicKey) + " ~/.ssh/authorized_keys || " +
+		"echo " + shared.ShellQuote(publicKey) + " >> ~/.ssh/authorized_keys; } && " +
+		"{ ! command -v restorecon >/dev/null 2>&1 || restorecon -F ~/.ssh ~/.ssh/authorized_keys; }"
+	return append(append([]string{}, sshOptions...), destination, script)
+}
+
+// TrustCAArgs returns the ssh arguments that configure destination to trust certificates signed by the CA in conf via
+// sudo (see serversetup.GenerateScript), so that members of the config's team can log in as loginUser. Hosts of a team
+// that is threshold signed trust the threshold CA key. A terminal is allocated so that sudo can ask for a password.
+func TrustCAArgs(destination, loginUser string, conf Config, sshOptions []string) ([]string, error) {
+	if conf.hostCAKey() == "" {
+		return nil, fmt.Errorf("the config of %s does not include the CA public key, update keybaseca", conf.BotName)
+	}
+	script, err := serversetup.GenerateScript(serversetup.Options{CAPublicKey: conf.hostCAKey(), Teams: []string{conf.TeamName},
+		User: loginUser})
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]string{"-t"}, sshOptions...), destination, "sudo sh -c "+shared.ShellQuote(script)), nil
+}
+
+// SplitDestination splits an ssh destination of the form [user@]host. user is empty if it is not included.
+func SplitDestination(destination string) (user, host string) {
+	if at := strings.LastIndex(destination, "@"); at >= 0 {
+		return destination[:at], destination[at+1:]
+	}
+	return "", destination
+}
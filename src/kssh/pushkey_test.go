@@ -0,0 +1,67 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testUserPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHGXmBMz8z+fHpEq2u4Qp/VG2w3pBGZuM0+X7KLQmgbZ it's me"
+
+func TestFindLongLivedPublicKey(t *testing.T) {
+	home, err := ioutil.TempDir("", "kssh-push-key")
+	require.NoError(t, err)
+	defer os.RemoveAll(home)
+	defer os.Setenv("HOME", os.Getenv("HOME"))
+	require.NoError(t, os.Setenv("HOME", home))
+
+	_, err = FindLongLivedPublicKey()
+	require.Error(t, err)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(home, ".ssh"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, ".ssh", "id_rsa.pub"), []byte("not a key\n"), 0644))
+	_, err = FindLongLivedPublicKey()
+	require.Error(t, err)
+
+	// id_ed25519.pub is preferred over id_rsa.pub
+	require.NoError(t, ioutil.WriteFile(filepath.Join(home, ".ssh", "id_ed25519.pub"), []byte(testUserPublicKey+"\n"), 0644))
+	key, err := FindLongLivedPublicKey()
+	require.NoError(t, err)
+	require.Equal(t, testUserPublicKey, key)
+}
+
+func TestPushKeyArgs(t *testing.T) {
+	args := PushKeyArgs("root@server", testUserPublicKey, []string{"-p", "2222"})
+	require.Equal(t, []string{"-p", "2222", "root@server"}, args[:3])
+	require.Len(t, args, 4)
+	// The key is quoted so that its comment cannot break out of the remote command
+	require.Contains(t, args[3], `grep -qxF 'ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHGXmBMz8z+fHpEq2u4Qp/VG2w3pBGZuM0+X7KLQmgbZ it'\''s me'`)
+	require.Contains(t, args[3], ">> ~/.ssh/authorized_keys")
+}
+
+func TestTrustCAArgs(t *testing.T) {
+	conf := Config{TeamName: "team.ssh", BotName: "bot", CAPublicKey: testUserPublicKey}
+	args, err := TrustCAArgs("server", "developer", conf, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"-t", "server"}, args[:2])
+	require.True(t, strings.HasPrefix(args[2], "sudo sh -c '"))
+	require.Contains(t, args[2], "team.ssh")
+
+	_, err = TrustCAArgs("server", "developer", Config{TeamName: "team.ssh", BotName: "bot"}, nil)
+	require.Error(t, err)
+	_, err = TrustCAArgs("server", "not a user", conf, nil)
+	require.Error(t, err)
+}
+
+func TestSplitDestination(t *testing.T) {
+	user, host := SplitDestination("root@server")
+	require.Equal(t, "root", user)
+	require.Equal(t, "server", host)
+	user, host = SplitDestination("server")
+	require.Equal(t, "", user)
+	require.Equal(t, "server", host)
+}
@@ -3,68 +3,156 @@ package kssh
 import (
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/keybase/bot-sshca/src/shared"
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	log "github.com/sirupsen/logrus"
 )
 
+// The default amount of time to wait for the CA to respond to a signature request
+const DefaultRequestTimeout = 5 * time.Second
+
 type Requester struct {
-	api *kbchat.API
+	transport ChatTransport
+
+	// How long to wait for a response from the CA before giving up
+	Timeout time.Duration
+
+	// Called when the CA requires the user to complete step-up authentication before it signs the request
+	OnChallenge func(shared.SignatureChallenge)
+
+	// Called with the name of each step of provisioning a new key as it starts (see Progress). May be nil.
+	OnProgress func(step string)
+
+	// Used to read config mirrors served over https (see LoadMirroredConfig). May be nil.
+	HTTPClient *http.Client
+
+	// The signature algorithms to request when provisioning a new key (see DetectSignatureAlgorithms). May be nil.
+	SignatureAlgorithms []string
+
+	// The custom extensions to request when provisioning a new key (see `kssh --extension`). May be nil.
+	Extensions map[string]string
+
+	// The team and channel to ask the CA bots for configs in (see DiscoverConfigs). Empty if configs are read from
+	// each team.
+	DiscoveryTeam    string
+	DiscoveryChannel string
+}
+
+func (r *Requester) reportProgress(step string) {
+	if r.OnProgress != nil {
+		r.OnProgress(step)
+	}
 }
 
 // NewRequester creates a new Requester with a Keybase chat API
 func NewRequester() (r Requester, err error) {
-	runOptions := kbchat.RunOptions{KeybaseLocation: GetKeybaseBinaryPath()}
-	api, err := kbchat.Start(runOptions)
+	keybaseBinaryPath := GetKeybaseBinaryPath()
+	api, err := kbchat.Start(kbchat.RunOptions{KeybaseLocation: keybaseBinaryPath, HomeDir: keybaseHomeDir})
 	if err != nil {
 		return r, fmt.Errorf("error starting Keybase chat: %v", err)
 	}
-	return Requester{api: api}, nil
+	err = checkKeybaseAccount(api.GetUsername())
+	if err != nil {
+		return r, err
+	}
+	// The chat API already knows who is logged in so there is no need to spawn `keybase whoami` later on
+	setKeybaseUsername(api.GetUsername())
+	r = NewRequesterWithTransport(newKbchatTransport(api, keybaseBinaryPath))
+	r.DiscoveryTeam, r.DiscoveryChannel, err = GetDiscoveryChannel()
+	if err != nil {
+		return r, err
+	}
+	return r, nil
+}
+
+// NewRequesterWithTransport creates a new Requester that communicates via the given ChatTransport
+func NewRequesterWithTransport(transport ChatTransport) Requester {
+	return Requester{transport: transport, Timeout: DefaultRequestTimeout, OnChallenge: PresentChallenge}
 }
 
 // LoadConfigs loads kssh configs from the KV store. Returns a (listOfConfigs,
 // listOfBotNames, err). Both lists are deduplicated based on Config.BotName.
+// Teams are traversed parents first so that when a bot publishes its config in
+// a team and its subteams (eg via a team pattern like `acme.ssh.*`), the config
+// from the top most team is used. Teams whose config cannot be read are skipped
+// so that one inaccessible subteam does not break kssh for large hierarchies.
+// If a discovery channel is configured, the configs are requested from the CA
+// bots there instead and the teams are only read if no bot responds.
 func (r *Requester) LoadConfigs() (configs []Config, botNames []string, err error) {
+	if r.DiscoveryTeam != "" {
+		configs, botNames, err := r.DiscoverConfigs()
+		if err == nil && len(configs) > 0 {
+			return configs, botNames, nil
+		}
+		log.Debugf("Falling back to reading the config of each team since no configs were discovered in %s#%s: %v",
+			r.DiscoveryTeam, r.DiscoveryChannel, err)
+	}
 	teams, err := r.getAllTeams()
 	if err != nil {
 		return nil, nil, err
 	}
+	sortTeamsByDepth(teams)
 	botNameToConfig := make(map[string]Config)
+	var firstErr error
 	for _, team := range teams {
 		conf, err := r.LoadConfig(team)
 		if err != nil {
-			return nil, nil, err
+			log.Debugf("Skipping team %s: %v", team, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
 		}
 		if conf != nil {
 			// conf was found
-			botNameToConfig[conf.BotName] = *conf
+			if _, ok := botNameToConfig[conf.BotName]; !ok {
+				botNameToConfig[conf.BotName] = *conf
+				botNames = append(botNames, conf.BotName)
+			}
 		}
 	}
-	for _, config := range botNameToConfig {
-		configs = append(configs, config)
-		botNames = append(botNames, config.BotName)
+	if len(botNameToConfig) == 0 && firstErr != nil {
+		return nil, nil, firstErr
+	}
+	for _, botName := range botNames {
+		configs = append(configs, botNameToConfig[botName])
 	}
 	return configs, botNames, nil
 }
 
+// Sort the given team names so that parent teams come before their subteams
+func sortTeamsByDepth(teams []string) {
+	sort.SliceStable(teams, func(i, j int) bool {
+		depthI, depthJ := strings.Count(teams[i], "."), strings.Count(teams[j], ".")
+		if depthI != depthJ {
+			return depthI < depthJ
+		}
+		return teams[i] < teams[j]
+	})
+}
+
 // LoadConfig loads the kssh config for the given teamName. Will return a nil
 // Config if no config was found for the teamName (and no error occurred)
 func (r *Requester) LoadConfig(teamName string) (*Config, error) {
-	res, err := r.api.GetEntry(&teamName, shared.SSHCANamespace, shared.SSHCAConfigKey)
+	value, found, err := r.transport.GetEntry(teamName, shared.SSHCANamespace, shared.SSHCAConfigKey)
 	if err != nil {
 		// error getting the entry
 		return nil, err
 	}
-	if res.Revision > 0 && len(res.EntryValue) > 0 {
+	if found {
 		// then this entry exists
 		var conf Config
-		if err := json.Unmarshal([]byte(res.EntryValue), &conf); err != nil {
+		if err := json.Unmarshal([]byte(value), &conf); err != nil {
 			return nil, fmt.Errorf("Failed to parse config for team %s: %v", teamName, err)
 		}
 		if conf.TeamName == "" || conf.BotName == "" {
-			return nil, fmt.Errorf("Found a config for team %s with missing data: %s", teamName, res.EntryValue)
+			return nil, fmt.Errorf("Found a config for team %s with missing data: %s", teamName, value)
 		}
 		return &conf, nil
 	}
@@ -84,28 +172,76 @@ func (r *Requester) LoadConfigForBot(botName string) (Config, error) {
 			return config, nil
 		}
 	}
+	published, err := r.LoadPublishedConfig(botName)
+	if err != nil {
+		return Config{}, err
+	}
+	if published != nil {
+		return *published, nil
+	}
 	return Config{}, fmt.Errorf("did not find a client config file matching botName=%s (is the CA bot running and are you in the correct teams?)", botName)
 }
 
+// LoadPublishedConfig loads the kssh config that botName published in its public KBFS folder for one of the teams the
+// current user is in. Bots that are restricted bots publish their configs there rather than in the team KV store.
+// Returns a nil Config if the bot did not publish a config for any of the user's teams.
+func (r *Requester) LoadPublishedConfig(botName string) (*Config, error) {
+	teams, err := r.getAllTeams()
+	if err != nil {
+		return nil, err
+	}
+	sortTeamsByDepth(teams)
+	for _, team := range teams {
+		value, found, err := r.transport.ReadFile(shared.ClientConfigPath(botName, team))
+		if err != nil {
+			log.Debugf("Failed to read the published config of %s for team %s: %v", botName, team, err)
+			continue
+		}
+		if !found {
+			continue
+		}
+		var conf Config
+		if err := json.Unmarshal([]byte(value), &conf); err != nil {
+			return nil, fmt.Errorf("Failed to parse the config published by %s for team %s: %v", botName, team, err)
+		}
+		// Only the bot can write to its public folder but check the contents anyway so that a misplaced config
+		// cannot redirect requests
+		if conf.BotName != botName || conf.TeamName == "" {
+			return nil, fmt.Errorf("Found a config published by %s for team %s with invalid data: %s", botName, team, value)
+		}
+		return &conf, nil
+	}
+	return nil, nil
+}
+
 func (r *Requester) getAllTeams() (teams []string, err error) {
-	return shared.GetAllTeams(r.api)
+	return r.transport.ListTeams()
 }
 
 // Get a signed SSH key from interacting with the CA chatbot
 func (r *Requester) GetSignedKey(botName string, request shared.SignatureRequest) (shared.SignatureResponse, error) {
-	empty := shared.SignatureResponse{}
-
-	conf, err := r.getConfig(botName)
+	conf, err := r.GetConfig(botName)
 	if err != nil {
-		return empty, fmt.Errorf("failed to get config: %+v", err)
+		return shared.SignatureResponse{}, fmt.Errorf("failed to get config: %+v", err)
 	}
+	return r.GetSignedKeyWithConfig(conf, request)
+}
+
+// Get a signed SSH key from interacting with the CA chatbot described by the given config
+func (r *Requester) GetSignedKeyWithConfig(conf Config, request shared.SignatureRequest) (shared.SignatureResponse, error) {
+	empty := shared.SignatureResponse{}
 
 	// Validate that the bot user is different than the current user
-	if conf.BotName == r.api.GetUsername() {
+	if conf.BotName == r.transport.GetUsername() {
 		return empty, fmt.Errorf("cannot run kssh and keybaseca as the same user: %s", conf.BotName)
 	}
 
-	sub, err := r.api.ListenForNewTextMessages()
+	err := r.checkHeartbeat(conf.BotName)
+	if err != nil {
+		return empty, err
+	}
+
+	sub, err := r.transport.Subscribe()
 	if err != nil {
 		return empty, fmt.Errorf("error subscribing to messages: %v", err)
 	}
@@ -117,6 +253,12 @@ func (r *Requester) GetSignedKey(botName string, request shared.SignatureRequest
 	// 3. Send the signature request payload and get back a signed cert
 	// We implement this with a terminatable goroutine that just sends acks and a while(true) loop that looks for responses
 	terminateRoutineCh := make(chan interface{})
+	var terminateOnce sync.Once
+	terminateAckRequests := func() {
+		terminateOnce.Do(func() { close(terminateRoutineCh) })
+	}
+	defer terminateAckRequests()
+	r.reportProgress("Connecting to the CA")
 	go func() {
 		// Make the AckRequests send less often over time by tracking how many we've sent
 		numberSent := 0
@@ -127,52 +269,79 @@ func (r *Requester) GetSignedKey(botName string, request shared.SignatureRequest
 			default:
 
 			}
-			_, err = r.api.SendMessageByTeamName(conf.TeamName, conf.getChannel(), shared.GenerateAckRequest(r.api.GetUsername()))
+			err := r.transport.SendMessage(conf.TeamName, conf.getChannel(), shared.GenerateAckRequest(r.transport.GetUsername()), conf.getExplodingLifetime())
 			if err != nil {
-				fmt.Printf("Failed to send AckRequest: %v\n", err)
+				log.Warnf("Failed to send AckRequest: %v", err)
 			}
 			numberSent++
 			time.Sleep(time.Duration(100+(10*numberSent)) * time.Millisecond)
 		}
 	}()
 
+	messages, readErrors, stopReading := readInBackground(sub)
+	defer stopReading()
+
 	hasBeenAcked := false
-	startTime := time.Now()
+	timeout := time.After(r.Timeout)
 	for {
-		if time.Since(startTime) > 5*time.Second {
+		var msg ChatMessage
+		select {
+		case <-timeout:
 			return empty, fmt.Errorf("timed out while waiting for a response from the CA")
-		}
-		msg, err := sub.Read()
-		if err != nil {
+		case err := <-readErrors:
 			return empty, fmt.Errorf("failed to read message: %v", err)
+		case msg = <-messages:
 		}
 
-		if msg.Message.Content.TypeName != "text" {
+		if msg.Sender != conf.BotName {
 			continue
 		}
 
-		if msg.Message.Sender.Username != conf.BotName {
-			continue
-		}
-
-		messageBody := msg.Message.Content.Text.Body
+		messageBody := msg.Body
 
 		if shared.IsAckResponse(messageBody) && !hasBeenAcked {
 			// We got an Ack so we terminate our AckRequests and send the real payload
 			hasBeenAcked = true
-			terminateRoutineCh <- true
+			terminateAckRequests()
+			r.reportProgress("Waiting for the CA to sign the key")
 			marshaledRequest, err := json.Marshal(request)
 			if err != nil {
 				return empty, err
 			}
-			_, err = r.api.SendMessageByTeamName(conf.TeamName, conf.getChannel(), shared.SignatureRequestPreamble+string(marshaledRequest))
+			err = r.transport.SendMessage(conf.TeamName, conf.getChannel(), shared.SignatureRequestPreamble+string(marshaledRequest), conf.getExplodingLifetime())
 			if err != nil {
 				return empty, err
 			}
+		} else if strings.HasPrefix(messageBody, shared.SignatureChallengePreamble) {
+			challenge, err := shared.ParseSignatureChallenge(messageBody)
+			if err != nil {
+				log.Warnf("Failed to parse a message from the bot: %s", messageBody)
+				return empty, err
+			}
+			if challenge.UUID != request.UUID {
+				continue
+			}
+			if r.OnChallenge != nil {
+				r.OnChallenge(challenge)
+			}
+			r.reportProgress("Waiting for you to log in")
+			// Give the user until the challenge expires to log in
+			timeout = time.After(time.Duration(challenge.ExpiresIn)*time.Second + r.Timeout)
+		} else if strings.HasPrefix(messageBody, shared.SignatureDenialPreamble) {
+			denial, err := shared.ParseSignatureDenial(messageBody)
+			if err != nil {
+				log.Warnf("Failed to parse a message from the bot: %s", messageBody)
+				return empty, err
+			}
+			if denial.UUID != request.UUID {
+				continue
+			}
+			return empty, &DeniedError{Code: denial.Code, Reason: denial.Reason, BotName: conf.BotName, TeamName: conf.TeamName,
+				Messages: conf.Messages}
 		} else if strings.HasPrefix(messageBody, shared.SignatureResponsePreamble) {
 			resp, err := shared.ParseSignatureResponse(messageBody)
 			if err != nil {
-				fmt.Printf("Failed to parse a message from the bot: %s\n", messageBody)
+				log.Warnf("Failed to parse a message from the bot: %s", messageBody)
 				return empty, err
 			}
 
@@ -186,8 +355,107 @@ func (r *Requester) GetSignedKey(botName string, request shared.SignatureRequest
 	}
 }
 
-// Get the kssh config from the KV store. botName is the bot specified via
-// --bot, else is an empty string
+// Check the heartbeat of the given bot and return an error if it is offline so that kssh fails fast rather than
+// waiting out the timeout. Bots that do not write a heartbeat (or whose heartbeat cannot be read) are presumed to be
+// running.
+func (r *Requester) checkHeartbeat(botName string) error {
+	contents, found, err := r.transport.ReadFile(shared.HeartbeatPath(botName))
+	if err != nil {
+		log.Debugf("Failed to read the heartbeat of %s: %v", botName, err)
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	heartbeat, err := shared.ParseHeartbeat(contents)
+	if err != nil {
+		log.Debugf("Failed to parse the heartbeat of %s: %v", botName, err)
+		return nil
+	}
+	if since, offline := heartbeat.OfflineSince(time.Now()); offline {
+		return fmt.Errorf("the CA bot %s has been offline since %s", botName, since.Format(time.RFC1123))
+	}
+	return nil
+}
+
+// Read messages from the given subscription in a separate goroutine so that timeouts are enforced even if no messages
+// arrive. The returned function must be called once the caller is done reading.
+func readInBackground(sub ChatSubscription) (<-chan ChatMessage, <-chan error, func()) {
+	doneReading := make(chan struct{})
+	messages := make(chan ChatMessage)
+	readErrors := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := sub.Read()
+			if err != nil {
+				readErrors <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-doneReading:
+				return
+			}
+		}
+	}()
+	return messages, readErrors, func() { close(doneReading) }
+}
+
+// Ping sends a ping to the CA bot described by the given config and waits for it to respond. The ping is resent every
+// second until a response arrives since a response sent before the subscription is active would be missed.
+func (r *Requester) Ping(conf Config) error {
+	sub, err := r.transport.Subscribe()
+	if err != nil {
+		return fmt.Errorf("error subscribing to messages: %v", err)
+	}
+	messages, readErrors, stopReading := readInBackground(sub)
+	defer stopReading()
+
+	send := func() error {
+		return r.transport.SendMessage(conf.TeamName, conf.getChannel(), shared.GeneratePingRequest(conf.BotName), conf.getExplodingLifetime())
+	}
+	if err := send(); err != nil {
+		return err
+	}
+	timeout := time.After(r.Timeout)
+	resend := time.NewTicker(time.Second)
+	defer resend.Stop()
+	for {
+		select {
+		case <-timeout:
+			return fmt.Errorf("timed out while waiting for %s to respond to a ping", conf.BotName)
+		case err := <-readErrors:
+			return fmt.Errorf("failed to read message: %v", err)
+		case <-resend.C:
+			if err := send(); err != nil {
+				return err
+			}
+		case msg := <-messages:
+			if msg.Sender == conf.BotName && shared.IsPingResponse(msg.Body, r.transport.GetUsername()) {
+				return nil
+			}
+		}
+	}
+}
+
+// GetConfig gets the kssh config from the KV store. botName is the bot specified via
+// --bot, else is an empty string. If the config cannot be loaded, the config mirrors published by the bot are tried.
+func (r *Requester) GetConfig(botName string) (conf Config, err error) {
+	conf, err = r.getConfig(botName)
+	if err == nil {
+		return conf, nil
+	}
+	mirrored, mirrorErr := r.loadConfigFromMirrors(botName)
+	if mirrorErr != nil {
+		log.Debugf("Failed to load the config from its mirrors: %v", mirrorErr)
+	}
+	if mirrored == nil {
+		return conf, err
+	}
+	log.Warnf("Using the config of %s from a mirror since it could not be loaded from Keybase: %v", mirrored.BotName, err)
+	return *mirrored, nil
+}
+
 func (r *Requester) getConfig(botName string) (conf Config, err error) {
 	empty := Config{}
 	// They specified a bot via `kssh --bot cabot ...`
@@ -206,6 +474,10 @@ func (r *Requester) getConfig(botName string) (conf Config, err error) {
 	}
 	if defaultBot != "" && defaultTeam != "" {
 		conf, err := r.LoadConfig(defaultTeam)
+		if err == nil && conf == nil {
+			// The default bot may be a restricted bot
+			conf, err = r.LoadPublishedConfig(defaultBot)
+		}
 		if err != nil || conf == nil {
 			return empty, fmt.Errorf("Failed to load config file for default bot=%s, team=%s: %v", defaultBot, defaultTeam, err)
 		}
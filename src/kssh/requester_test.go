@@ -0,0 +1,310 @@
+package kssh_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/kssh"
+	"github.com/keybase/bot-sshca/src/kssh/ksshtest"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func signWith(signedKey string) func(shared.SignatureRequest) shared.SignatureResponse {
+	return func(sr shared.SignatureRequest) shared.SignatureResponse {
+		return shared.SignatureResponse{SignedKey: signedKey, UUID: sr.UUID}
+	}
+}
+
+func newRequester(transport *ksshtest.Transport) kssh.Requester {
+	requester := kssh.NewRequesterWithTransport(transport)
+	requester.Timeout = 500 * time.Millisecond
+	return requester
+}
+
+func TestGetSignedKey(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	requester := newRequester(transport)
+
+	resp, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1", SSHPublicKey: "ssh-ed25519 AAAA"})
+	require.NoError(t, err)
+	require.Equal(t, "signed-key", resp.SignedKey)
+	require.Equal(t, "uuid-1", resp.UUID)
+}
+
+func TestGetSignedKeyWithDelay(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	transport.Delay = 100 * time.Millisecond
+	requester := newRequester(transport)
+
+	resp, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.NoError(t, err)
+	require.Equal(t, "signed-key", resp.SignedKey)
+
+	// A bot that is slower than the timeout causes a timeout rather than hanging forever
+	transport.Delay = time.Second
+	_, err = requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-2"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+}
+
+func TestGetSignedKeyExploding(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	transport.Configs["team.ssh"] = `{"teamname": "team.ssh", "botname": "cabot", "exploding_lifetime": 300}`
+	requester := newRequester(transport)
+
+	_, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.NoError(t, err)
+	lifetimes := transport.ExplodingLifetimes()
+	require.NotEmpty(t, lifetimes)
+	for _, lifetime := range lifetimes {
+		require.Equal(t, 5*time.Minute, lifetime)
+	}
+}
+
+func TestGetSignedKeyNoBot(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", nil)
+	requester := newRequester(transport)
+
+	_, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+	// kssh should have been sending AckRequests the whole time
+	require.True(t, len(transport.Sent()) > 1)
+}
+
+func TestGetSignedKeyDuplicateAndForeignMessages(t *testing.T) {
+	bot := ksshtest.NewBot(signWith("signed-key"))
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", func(msg kssh.ChatMessage) []string {
+		responses := bot(msg)
+		if strings.HasPrefix(msg.Body, shared.SignatureRequestPreamble) {
+			// A response to someone else's request followed by duplicates of the real response
+			foreign := shared.SignatureResponsePreamble + `{"signed_key":"other-key","uuid":"other-uuid"}`
+			return append([]string{foreign}, append(responses, responses...)...)
+		}
+		// Duplicate every Ack
+		return append(responses, responses...)
+	})
+	requester := newRequester(transport)
+
+	resp, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.NoError(t, err)
+	require.Equal(t, "signed-key", resp.SignedKey)
+
+	// Exactly one SignatureRequest should have been sent despite the duplicate Acks
+	signatureRequests := 0
+	for _, msg := range transport.Sent() {
+		if strings.HasPrefix(msg.Body, shared.SignatureRequestPreamble) {
+			signatureRequests++
+		}
+	}
+	require.Equal(t, 1, signatureRequests)
+}
+
+func TestGetSignedKeyMalformedResponse(t *testing.T) {
+	bot := ksshtest.NewBot(signWith("signed-key"))
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", func(msg kssh.ChatMessage) []string {
+		if strings.HasPrefix(msg.Body, shared.SignatureRequestPreamble) {
+			return []string{shared.SignatureResponsePreamble + `{"signed_key":`}
+		}
+		return bot(msg)
+	})
+	requester := newRequester(transport)
+
+	_, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.Error(t, err)
+}
+
+func TestGetSignedKeyIgnoresImpersonators(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	transport.BotName = "mallory"
+	requester := newRequester(transport)
+
+	_, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+}
+
+func TestGetSignedKeySameUser(t *testing.T) {
+	transport := ksshtest.NewTransport("cabot", "team.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	requester := newRequester(transport)
+
+	_, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "same user")
+}
+
+func TestLoadConfigsPrefersParentTeam(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "acme.ssh.prod", "cabot", nil)
+	transport.Teams = []string{"acme.ssh.prod", "acme.ssh", "acme.ssh.staging"}
+	transport.Configs["acme.ssh"] = `{"teamname":"acme.ssh","botname":"cabot"}`
+	transport.Configs["acme.ssh.staging"] = `{"teamname":"acme.ssh.staging","botname":"cabot"}`
+	transport.Configs["acme.ssh.prod"] = `not json`
+	requester := newRequester(transport)
+
+	configs, botNames, err := requester.LoadConfigs()
+	require.NoError(t, err)
+	require.Equal(t, []string{"cabot"}, botNames)
+	require.Equal(t, "acme.ssh", configs[0].TeamName)
+}
+
+func TestLoadPublishedConfig(t *testing.T) {
+	// A restricted bot publishes its config in its public folder rather than the KV store
+	transport := ksshtest.NewTransport("alice", "acme.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	transport.Configs = map[string]string{}
+	transport.Files = map[string]string{
+		shared.ClientConfigPath("cabot", "acme.ssh"):   `{"teamname":"acme.ssh","botname":"cabot"}`,
+		shared.ClientConfigPath("evilbot", "acme.ssh"): `{"teamname":"acme.ssh","botname":"cabot"}`,
+	}
+	requester := newRequester(transport)
+
+	configs, _, err := requester.LoadConfigs()
+	require.NoError(t, err)
+	require.Empty(t, configs)
+
+	conf, err := requester.LoadConfigForBot("cabot")
+	require.NoError(t, err)
+	require.Equal(t, "acme.ssh", conf.TeamName)
+	resp, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.NoError(t, err)
+	require.Equal(t, "signed-key", resp.SignedKey)
+
+	// A config in the folder of a different bot is rejected
+	_, err = requester.LoadConfigForBot("evilbot")
+	require.Error(t, err)
+	_, err = requester.LoadConfigForBot("otherbot")
+	require.Error(t, err)
+}
+
+func TestLoadMirroredConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/mirror/acme.ssh.json":
+			fmt.Fprint(w, `{"teamname":"acme.ssh","botname":"cabot","version":"2"}`)
+		case "/evil/acme.ssh.json":
+			fmt.Fprint(w, `{"teamname":"acme.ssh","botname":"evilbot"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	transport := ksshtest.NewTransport("alice", "acme.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	transport.Files = map[string]string{"/keybase/team/acme.ssh/mirror/acme.ssh.json": `{"teamname":"acme.ssh","botname":"cabot","version":"3"}`}
+	requester := newRequester(transport)
+	requester.HTTPClient = server.Client()
+
+	// Mirrors are tried in order and mirrors that are missing or serve another bot's config are skipped
+	cached := kssh.Config{TeamName: "acme.ssh", BotName: "cabot", Mirrors: []string{
+		"/keybase/team/acme.ssh/missing", server.URL + "/evil", server.URL + "/mirror", "/keybase/team/acme.ssh/mirror",
+	}}
+	conf, err := requester.LoadMirroredConfig(cached)
+	require.NoError(t, err)
+	require.Equal(t, "2", conf.Version)
+
+	cached.Mirrors = cached.Mirrors[3:]
+	conf, err = requester.LoadMirroredConfig(cached)
+	require.NoError(t, err)
+	require.Equal(t, "3", conf.Version)
+
+	cached.Mirrors = []string{server.URL + "/evil"}
+	_, err = requester.LoadMirroredConfig(cached)
+	require.Error(t, err)
+}
+
+func TestPing(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	requester := newRequester(transport)
+	conf, err := requester.GetConfig("cabot")
+	require.NoError(t, err)
+	require.NoError(t, requester.Ping(conf))
+
+	transport.Bot = nil
+	err = requester.Ping(conf)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "timed out")
+}
+
+func TestGetSignedKeyWithChallenge(t *testing.T) {
+	var transport *ksshtest.Transport
+	bot := ksshtest.NewBot(signWith("signed-key"))
+	transport = ksshtest.NewTransport("alice", "team.ssh", "cabot", func(msg kssh.ChatMessage) []string {
+		if !strings.HasPrefix(msg.Body, shared.SignatureRequestPreamble) {
+			return bot(msg)
+		}
+		// Only sign the request once the user has "logged in", which takes longer than the usual timeout
+		go func() {
+			time.Sleep(time.Second)
+			for _, response := range bot(msg) {
+				transport.SendFromBot(response)
+			}
+		}()
+		return []string{
+			shared.SignatureChallengePreamble + `{"uuid":"other-uuid","verification_uri":"https://idp/other","user_code":"XXXX","expires_in":60}`,
+			shared.SignatureChallengePreamble + `{"uuid":"uuid-1","verification_uri":"https://idp/activate","user_code":"ABCD","expires_in":60}`,
+		}
+	})
+	requester := newRequester(transport)
+	var challenges []shared.SignatureChallenge
+	requester.OnChallenge = func(challenge shared.SignatureChallenge) {
+		challenges = append(challenges, challenge)
+	}
+
+	resp, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.NoError(t, err)
+	require.Equal(t, "signed-key", resp.SignedKey)
+	require.Equal(t, []shared.SignatureChallenge{{UUID: "uuid-1", VerificationURI: "https://idp/activate", UserCode: "ABCD", ExpiresIn: 60}}, challenges)
+}
+
+func TestGetSignedKeyOfflineBot(t *testing.T) {
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", nil)
+	transport.Files = map[string]string{shared.HeartbeatPath("cabot"): fmt.Sprintf(`{"updated_at": %d, "interval": 60}`, time.Now().Add(-time.Hour).Unix())}
+	requester := newRequester(transport)
+
+	// kssh fails straight away rather than waiting for the timeout
+	start := time.Now()
+	_, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "the CA bot cabot has been offline since")
+	require.True(t, time.Since(start) < requester.Timeout)
+	require.Empty(t, transport.Sent())
+
+	// A fresh heartbeat means that the bot is running
+	transport = ksshtest.NewTransport("alice", "team.ssh", "cabot", ksshtest.NewBot(signWith("signed-key")))
+	transport.Files = map[string]string{shared.HeartbeatPath("cabot"): fmt.Sprintf(`{"updated_at": %d, "interval": 60}`, time.Now().Unix())}
+	requester = newRequester(transport)
+	resp, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-2"})
+	require.NoError(t, err)
+	require.Equal(t, "signed-key", resp.SignedKey)
+}
+
+func TestGetSignedKeyDenied(t *testing.T) {
+	bot := ksshtest.NewBot(signWith("signed-key"))
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", func(msg kssh.ChatMessage) []string {
+		if !strings.HasPrefix(msg.Body, shared.SignatureRequestPreamble) {
+			return bot(msg)
+		}
+		return []string{
+			shared.SignatureDenialPreamble + `{"uuid":"other-uuid","code":"lockdown","reason":"the CA is in lockdown"}`,
+			shared.SignatureDenialPreamble + `{"uuid":"uuid-1","code":"not_in_team","reason":"alice is not in any of the configured teams"}`,
+		}
+	})
+	requester := newRequester(transport)
+
+	// kssh fails straight away with the reason for its own request rather than waiting for the timeout
+	start := time.Now()
+	_, err := requester.GetSignedKey("cabot", shared.SignatureRequest{UUID: "uuid-1"})
+	require.True(t, time.Since(start) < requester.Timeout)
+	require.IsType(t, &kssh.DeniedError{}, err)
+	denied := err.(*kssh.DeniedError)
+	require.Equal(t, shared.DenialNotInTeam, denied.Code)
+	require.Equal(t, "the CA bot cabot denied the request: alice is not in any of the configured teams", denied.Error())
+	require.Contains(t, denied.Remediation(), "Ask an admin of team.ssh")
+
+	// Unknown codes from newer versions of keybaseca still get a remediation
+	denied.Code = "some_new_policy"
+	require.Equal(t, "Contact the administrators of cabot for help.", denied.Remediation())
+}
@@ -0,0 +1,149 @@
+package kssh
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The number of hosts that session metadata is kept for. The least recently connected hosts are forgotten first.
+const maxSessions = 50
+
+// A Session is the metadata kssh records about the last successful connection to a host so that `kssh --last` can
+// reconnect to it
+type Session struct {
+	// The ssh (or mosh) arguments up to and including the destination, without the remote command
+	Args []string `json:"args"`
+	// Whether the connection was made with mosh (see --mosh)
+	Mosh bool `json:"mosh,omitempty"`
+	// The bot that provisioned the certificate (see --bot). Empty means the default bot.
+	BotName string `json:"bot_name,omitempty"`
+	// The user that was logged in as, if known
+	User string `json:"user,omitempty"`
+	// The principals of the certificate that was used, if known
+	Principals    []string  `json:"principals,omitempty"`
+	LastConnected time.Time `json:"last_connected"`
+}
+
+// RecordSession records session as the last connection to the given host
+func RecordSession(host string, session Session) error {
+	return updateConfigFile(func(lcf *LocalConfigFile) error {
+		if lcf.Sessions == nil {
+			lcf.Sessions = make(map[string]Session)
+		}
+		lcf.Sessions[host] = session
+		for len(lcf.Sessions) > maxSessions {
+			oldest := ""
+			for name, s := range lcf.Sessions {
+				if oldest == "" || s.LastConnected.Before(lcf.Sessions[oldest].LastConnected) {
+					oldest = name
+				}
+			}
+			delete(lcf.Sessions, oldest)
+		}
+		return nil
+	})
+}
+
+// GetLastSession returns the most recent session recorded via RecordSession
+func GetLastSession() (Session, error) {
+	lcf, err := getCurrentConfigFile()
+	if err != nil {
+		return Session{}, err
+	}
+	var last Session
+	for _, session := range lcf.Sessions {
+		if session.LastConnected.After(last.LastConnected) {
+			last = session
+		}
+	}
+	if last.LastConnected.IsZero() {
+		return Session{}, fmt.Errorf("no previous connection was found, connect to a host with kssh first")
+	}
+	return last, nil
+}
+
+// ResumeArgs returns the arguments to reconnect to the session with. The given options (eg -v or -t) are added before
+// the destination and the rest of the given arguments are used as the remote command.
+func (s Session) ResumeArgs(args []string) []string {
+	takesArgument := sshFlagTakesArgument
+	if s.Mosh {
+		takesArgument = moshFlagTakesArgument
+	}
+	var options []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "--" || !strings.HasPrefix(args[i], "-") || len(args[i]) == 1 {
+			break
+		}
+		options = append(options, args[i])
+		if takesArgument(args[i]) && i+1 < len(args) {
+			i++
+			options = append(options, args[i])
+		}
+	}
+	command := args[len(options):]
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+	resumed := append(options, s.Args...)
+	return append(resumed, command...)
+}
+
+func sshFlagTakesArgument(arg string) bool {
+	return len(arg) == 2 && strings.ContainsRune(sshFlagsWithArguments, rune(arg[1]))
+}
+
+func moshFlagTakesArgument(arg string) bool {
+	return moshFlagsWithArguments[arg]
+}
+
+// GetSSHArgsUntilDestination returns the given ssh arguments up to and including the destination, ie without the
+// remote command. Returns nil if there is no destination.
+func GetSSHArgsUntilDestination(args []string) []string {
+	return argsUntilDestination(args, sshFlagTakesArgument)
+}
+
+// GetMoshArgsUntilDestination is like GetSSHArgsUntilDestination for mosh arguments
+func GetMoshArgsUntilDestination(args []string) []string {
+	return argsUntilDestination(args, moshFlagTakesArgument)
+}
+
+// Returns the arguments up to and including the first argument that is not a flag (or the argument after --). A flag
+// for which takesArgument returns true consumes the next argument.
+func argsUntilDestination(args []string, takesArgument func(string) bool) []string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return append([]string{}, args[:i+2]...)
+			}
+			return nil
+		}
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			if takesArgument(arg) {
+				i++
+			}
+			continue
+		}
+		return append([]string{}, args[:i+1]...)
+	}
+	return nil
+}
+
+// GetSessionUser returns the remote user of a connection made with the given ssh arguments: the user in the
+// destination, the value of -l, or defaultUser (see SetDefaultSSHUser) in that order. Returns an empty string if
+// ssh picks the user (eg from ~/.ssh/config).
+func GetSessionUser(destinationUser string, sshArgs []string, defaultUser string) string {
+	if destinationUser != "" {
+		return destinationUser
+	}
+	for i := 0; i < len(sshArgs); i++ {
+		if sshArgs[i] == "-l" && i+1 < len(sshArgs) {
+			return sshArgs[i+1]
+		}
+		if strings.HasPrefix(sshArgs[i], "-l") && len(sshArgs[i]) > 2 {
+			return sshArgs[i][2:]
+		}
+	}
+	return defaultUser
+}
@@ -0,0 +1,67 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-sessions-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig := localConfigFileLocation
+	defer func() { localConfigFileLocation = oldConfig }()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+
+	_, err = GetLastSession()
+	require.Error(t, err)
+
+	now := time.Now()
+	require.NoError(t, RecordSession("web", Session{Args: []string{"web"}, LastConnected: now.Add(-time.Hour)}))
+	require.NoError(t, RecordSession("db", Session{Args: []string{"-p", "2222", "root@db"}, User: "root", LastConnected: now}))
+	last, err := GetLastSession()
+	require.NoError(t, err)
+	require.Equal(t, []string{"-p", "2222", "root@db"}, last.Args)
+	require.Equal(t, "root", last.User)
+
+	// Only the most recently connected hosts are kept
+	for i := 0; i < maxSessions; i++ {
+		require.NoError(t, RecordSession(fmt.Sprintf("host%d", i), Session{Args: []string{"host"}, LastConnected: now.Add(time.Duration(i+1) * time.Second)}))
+	}
+	lcf, err := getCurrentConfigFile()
+	require.NoError(t, err)
+	require.Len(t, lcf.Sessions, maxSessions)
+	require.NotContains(t, lcf.Sessions, "web")
+	require.NotContains(t, lcf.Sessions, "db")
+}
+
+func TestSessionResumeArgs(t *testing.T) {
+	session := Session{Args: []string{"-p", "2222", "root@db"}}
+	require.Equal(t, []string{"-p", "2222", "root@db"}, session.ResumeArgs(nil))
+	require.Equal(t, []string{"-v", "-t", "-p", "2222", "root@db", "tmux", "attach"}, session.ResumeArgs([]string{"-v", "-t", "tmux", "attach"}))
+	require.Equal(t, []string{"-L", "8080:localhost:80", "-p", "2222", "root@db", "-l"}, session.ResumeArgs([]string{"-L", "8080:localhost:80", "--", "-l"}))
+
+	session = Session{Args: []string{"root@db"}, Mosh: true}
+	require.Equal(t, []string{"--predict", "always", "root@db", "tmux"}, session.ResumeArgs([]string{"--predict", "always", "tmux"}))
+}
+
+func TestGetArgsUntilDestination(t *testing.T) {
+	require.Equal(t, []string{"-p", "2222", "root@db"}, GetSSHArgsUntilDestination([]string{"-p", "2222", "root@db", "ls", "-l"}))
+	require.Equal(t, []string{"-t", "--", "db"}, GetSSHArgsUntilDestination([]string{"-t", "--", "db", "top"}))
+	require.Nil(t, GetSSHArgsUntilDestination([]string{"-v"}))
+	require.Equal(t, []string{"--port", "60001", "db"}, GetMoshArgsUntilDestination([]string{"--port", "60001", "db", "tmux"}))
+}
+
+func TestGetSessionUser(t *testing.T) {
+	require.Equal(t, "root", GetSessionUser("root", []string{"-l", "ubuntu"}, "alice"))
+	require.Equal(t, "ubuntu", GetSessionUser("", []string{"-i", "key", "-l", "ubuntu", "db"}, "alice"))
+	require.Equal(t, "core", GetSessionUser("", []string{"-lcore", "db"}, "alice"))
+	require.Equal(t, "alice", GetSessionUser("", []string{"db"}, "alice"))
+	require.Equal(t, "", GetSessionUser("", []string{"db"}, ""))
+}
@@ -0,0 +1,109 @@
+package kssh
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// How long to wait for the destination server's version banner
+const bannerTimeout = 2 * time.Second
+
+// Matches the OpenSSH version in an SSH version banner, eg `SSH-2.0-OpenSSH_7.4p1 Debian-10`
+var openSSHBannerRegex = regexp.MustCompile(`^SSH-2\.0-OpenSSH_(\d+)\.(\d+)`)
+
+// Get the signature algorithms that a server with the given version banner accepts for certificates signed by an RSA
+// CA, in order of preference. Returns nil if the server is not a known OpenSSH version.
+func signatureAlgorithmsForBanner(banner string) []string {
+	match := openSSHBannerRegex.FindStringSubmatch(banner)
+	if match == nil {
+		return nil
+	}
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+	version := major*100 + minor
+	switch {
+	case version < 702:
+		// rsa-sha2 signatures were added in OpenSSH 7.2
+		return []string{shared.SigAlgoRSA}
+	case version < 808:
+		return []string{shared.SigAlgoRSASHA512, shared.SigAlgoRSASHA256, shared.SigAlgoRSA}
+	default:
+		// ssh-rsa signatures are disabled by default since OpenSSH 8.8
+		return []string{shared.SigAlgoRSASHA512, shared.SigAlgoRSASHA256}
+	}
+}
+
+// DetectSignatureAlgorithms returns the signature algorithms to request from the CA for connecting to the destination
+// in sshArgs, based on the version banner of the server. Detection is only needed (and only done) if the CA key in
+// conf is an RSA key and the destination is reached directly. Returns nil if the algorithms are not known, in which
+// case the CA uses its default.
+func DetectSignatureAlgorithms(conf *Config, sshArgs []string) []string {
+	if conf == nil || !strings.HasPrefix(conf.CAPublicKey, ssh.KeyAlgoRSA+" ") || hasUserSpecifiedProxy(sshArgs) {
+		return nil
+	}
+	_, host := GetSSHDestination(sshArgs)
+	if host == "" || conf.GetCloudTunnel(host) != nil {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, getSSHPort(sshArgs)), bannerTimeout)
+	if err != nil {
+		log.Debugf("Failed to connect to %s to detect its signature algorithms: %v", host, err)
+		return nil
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(bannerTimeout))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		log.Debugf("Failed to read the version banner of %s: %v", host, err)
+		return nil
+	}
+	var algorithms []string
+	for _, algorithm := range signatureAlgorithmsForBanner(strings.TrimSpace(banner)) {
+		if shared.IsFIPSSignatureAlgorithm(algorithm) {
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	log.Debugf("Detected the signature algorithms %v for %s (%s)", algorithms, host, strings.TrimSpace(banner))
+	return algorithms
+}
+
+// Get the port that ssh will connect to from the given ssh arguments
+func getSSHPort(args []string) string {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || len(arg) == 1 {
+			break
+		}
+		if arg == "-p" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(arg, "-p") {
+			return arg[2:]
+		}
+		if len(arg) == 2 && strings.ContainsRune(sshFlagsWithArguments, rune(arg[1])) {
+			i++
+		}
+	}
+	return "22"
+}
+
+// IsCertSignedWithAlgorithm returns whether the certificate at keyPath was signed with one of the given signature
+// algorithms. Always true if algorithms is empty or the certificate was not signed by an RSA key.
+func IsCertSignedWithAlgorithm(keyPath string, algorithms []string) bool {
+	if len(algorithms) == 0 {
+		return true
+	}
+	cert, err := ReadCertificate(keyPath)
+	if err != nil || cert.SignatureKey.Type() != ssh.KeyAlgoRSA {
+		return true
+	}
+	return containsString(algorithms, cert.Signature.Format)
+}
@@ -0,0 +1,30 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignatureAlgorithmsForBanner(t *testing.T) {
+	require.Equal(t, []string{shared.SigAlgoRSA}, signatureAlgorithmsForBanner("SSH-2.0-OpenSSH_6.6.1p1 Ubuntu-2ubuntu2"))
+	require.Equal(t, []string{shared.SigAlgoRSASHA512, shared.SigAlgoRSASHA256, shared.SigAlgoRSA},
+		signatureAlgorithmsForBanner("SSH-2.0-OpenSSH_7.4"))
+	require.Equal(t, []string{shared.SigAlgoRSASHA512, shared.SigAlgoRSASHA256}, signatureAlgorithmsForBanner("SSH-2.0-OpenSSH_8.8"))
+	require.Equal(t, []string{shared.SigAlgoRSASHA512, shared.SigAlgoRSASHA256}, signatureAlgorithmsForBanner("SSH-2.0-OpenSSH_10.0"))
+	require.Nil(t, signatureAlgorithmsForBanner("SSH-2.0-dropbear_2020.81"))
+}
+
+func TestGetSSHPort(t *testing.T) {
+	require.Equal(t, "22", getSSHPort([]string{"root@server"}))
+	require.Equal(t, "2222", getSSHPort([]string{"-p", "2222", "root@server"}))
+	require.Equal(t, "2222", getSSHPort([]string{"-v", "-p2222", "server", "-p", "1"}))
+	require.Equal(t, "22", getSSHPort([]string{"-i", "-p", "server"}))
+}
+
+func TestDetectSignatureAlgorithmsSkipsNonRSA(t *testing.T) {
+	conf := &Config{CAPublicKey: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIJ"}
+	require.Nil(t, DetectSignatureAlgorithms(conf, []string{"server"}))
+	require.Nil(t, DetectSignatureAlgorithms(nil, []string{"server"}))
+}
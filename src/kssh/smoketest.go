@@ -0,0 +1,75 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/sshutils"
+	"github.com/keybase/bot-sshca/src/shared"
+)
+
+// SmokeTestResult describes the certificate that SmokeTest was issued
+type SmokeTestResult struct {
+	BotName    string   `json:"bot_name"`
+	KeyID      string   `json:"key_id"`
+	Principals []string `json:"principals"`
+	// RFC3339 timestamps in UTC
+	ValidAfter  string `json:"valid_after"`
+	ValidBefore string `json:"valid_before"`
+	// The [user@]host that the certificate was used to log in to. Empty if no ssh handshake was attempted.
+	SSHDestination string `json:"ssh_destination,omitempty"`
+}
+
+// SmokeTest runs the whole request, sign, and verify loop against botName (see Requester.GetConfig for how botName
+// is used) with a throwaway key that is deleted afterwards, exactly like kssh does when provisioning a key. If
+// destination is not empty, the certificate is then used to log in to destination ([user@]host) over ssh. None of
+// the current user's keys are read or replaced. Used by `keybaseca e2e-test` to check a deployment end to end.
+func SmokeTest(requester *Requester, botName, destination string) (SmokeTestResult, error) {
+	dir, err := ioutil.TempDir("", "kssh-smoke-test")
+	if err != nil {
+		return SmokeTestResult{}, fmt.Errorf("Failed to create a directory for the throwaway key: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "throwaway")
+
+	requester.reportProgress("Generating a throwaway SSH key")
+	err = sshutils.GenerateNewSSHKey(keyPath, true, false)
+	if err != nil {
+		return SmokeTestResult{}, fmt.Errorf("Failed to generate a throwaway SSH key: %v", err)
+	}
+	pubKey, err := ioutil.ReadFile(shared.KeyPathToPubKey(keyPath))
+	if err != nil {
+		return SmokeTestResult{}, fmt.Errorf("Failed to read the throwaway SSH key: %v", err)
+	}
+	conf, signedKey, err := requestCertificate(requester, botName, keyPath, string(pubKey), false)
+	if err != nil {
+		return SmokeTestResult{}, err
+	}
+	err = ioutil.WriteFile(shared.KeyPathToCert(keyPath), []byte(signedKey), 0600)
+	if err != nil {
+		return SmokeTestResult{}, fmt.Errorf("Failed to write the certificate to disk: %v", err)
+	}
+	provisioned, err := NewProvisionResult(keyPath, false)
+	if err != nil {
+		return SmokeTestResult{}, err
+	}
+	result := SmokeTestResult{
+		BotName:     conf.BotName,
+		KeyID:       provisioned.KeyID,
+		Principals:  provisioned.Principals,
+		ValidAfter:  provisioned.ValidAfter,
+		ValidBefore: provisioned.ValidBefore,
+	}
+
+	if destination != "" {
+		requester.reportProgress("Connecting to " + destination)
+		err = CheckSSHConnection(keyPath, destination)
+		if err != nil {
+			return result, err
+		}
+		result.SSHDestination = destination
+	}
+	return result, nil
+}
@@ -0,0 +1,59 @@
+package kssh_test
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/kssh"
+	"github.com/keybase/bot-sshca/src/kssh/ksshtest"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSmokeTest(t *testing.T) {
+	if shared.FIPSMode {
+		t.Skip("uses an ed25519 CA key which is not allowed in FIPS mode")
+	}
+	_, caKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ca, err := ssh.NewSignerFromKey(caKey)
+	require.NoError(t, err)
+	var principals []string
+	sign := func(sr shared.SignatureRequest) shared.SignatureResponse {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sr.SSHPublicKey))
+		require.NoError(t, err)
+		cert := &ssh.Certificate{
+			Key:             key,
+			CertType:        ssh.UserCert,
+			KeyId:           sr.UUID + ":alice",
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(time.Now().Unix()),
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+		}
+		require.NoError(t, cert.SignCert(rand.Reader, ca))
+		return shared.SignatureResponse{SignedKey: string(ssh.MarshalAuthorizedKey(cert)), UUID: sr.UUID}
+	}
+	transport := ksshtest.NewTransport("alice", "team.ssh", "cabot", ksshtest.NewBot(sign))
+	config, err := json.Marshal(kssh.Config{TeamName: "team.ssh", BotName: "cabot",
+		CAPublicKey: string(ssh.MarshalAuthorizedKey(ca.PublicKey()))})
+	require.NoError(t, err)
+	transport.Configs["team.ssh"] = string(config)
+	requester := newRequester(transport)
+
+	principals = []string{"team.ssh"}
+	result, err := kssh.SmokeTest(&requester, "cabot", "")
+	require.NoError(t, err)
+	require.Equal(t, "cabot", result.BotName)
+	require.Equal(t, []string{"team.ssh"}, result.Principals)
+	require.Empty(t, result.SSHDestination)
+
+	// The certificate is verified like kssh would so a mis-issued certificate fails the test
+	principals = []string{"team.ssh", "root"}
+	_, err = kssh.SmokeTest(&requester, "cabot", "")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "root")
+}
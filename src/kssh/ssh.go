@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"os/signal"
+	"regexp"
 	"strings"
+	"syscall"
 
 	"github.com/keybase/bot-sshca/src/shared"
 )
@@ -21,7 +24,8 @@ func AddKeyToSSHAgent(keyPath string) error {
 
 var AlternateSSHConfigFile = shared.ExpandPathWithTilde("~/.ssh/kssh-config")
 
-// Create an SSH config file that inherits from the default SSH config file but sets a default SSH user
+// Create an SSH config file that inherits from the default SSH config file but sets a default SSH user. If keyPath is
+// empty (eg for keys that only exist in the ssh-agent), the config file does not restrict which identities are used.
 func CreateDefaultUserConfigFile(keyPath string) error {
 	user, err := GetDefaultSSHUser()
 	if err != nil {
@@ -48,11 +52,13 @@ func CreateDefaultUserConfigFile(keyPath string) error {
 	config := fmt.Sprintf("# kssh config file to set a default SSH user\n"+
 		"Include config\n"+
 		"Host *\n"+
-		"  User %s\n"+
-		"  IdentityFile %s\n"+
-		"  IdentitiesOnly yes\n", user, keyPath)
+		"  User %s\n", user)
+	if keyPath != "" {
+		config += fmt.Sprintf("  IdentityFile %s\n"+
+			"  IdentitiesOnly yes\n", keyPath)
+	}
 
-	f, err := os.OpenFile(AlternateSSHConfigFile, os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(AlternateSSHConfigFile, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
 	}
@@ -74,3 +80,142 @@ func MakeDotSSH() error {
 	}
 	return nil
 }
+
+// The ssh flags that take an argument. See ssh(1).
+const sshFlagsWithArguments = "BbcDEeFIiJLlmOoPpQRSWw"
+
+// GetSSHDestination parses the given ssh arguments and returns the user (which may be empty) and the host
+// that ssh will connect to. Returns empty strings if no destination was found.
+func GetSSHDestination(args []string) (user string, host string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			if i+1 < len(args) {
+				return splitDestination(args[i+1])
+			}
+			return "", ""
+		}
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			// A flag that takes an argument either has it attached (eg -p22) or as the next argument
+			if len(arg) == 2 && strings.ContainsRune(sshFlagsWithArguments, rune(arg[1])) {
+				i++
+			}
+			continue
+		}
+		return splitDestination(arg)
+	}
+	return "", ""
+}
+
+// Split a destination of the form [user@]host[:port] or ssh://[user@]host[:port] into the user and the host
+func splitDestination(destination string) (string, string) {
+	destination = strings.TrimPrefix(destination, "ssh://")
+	user := ""
+	if idx := strings.LastIndex(destination, "@"); idx >= 0 {
+		user = destination[:idx]
+		destination = destination[idx+1:]
+	}
+	if strings.HasPrefix(destination, "[") {
+		// An IPv6 address with a port, eg [::1]:22
+		if idx := strings.Index(destination, "]"); idx >= 0 {
+			return user, destination[1:idx]
+		}
+	}
+	if strings.Count(destination, ":") == 1 {
+		destination = destination[:strings.Index(destination, ":")]
+	}
+	return user, destination
+}
+
+// CheckSSHConnection connects to the given [user@]host with the key at keyPath, runs `true`, and disconnects. It never
+// prompts for input. Used by `kssh --benchmark` to time the SSH handshake.
+func CheckSSHConnection(keyPath, destination string) error {
+	cmd := exec.Command("ssh", "-i", keyPath, "-o", "IdentitiesOnly=yes", "-o", "BatchMode=yes", destination, "true")
+	bytes, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %s (%v)", destination, strings.TrimSpace(string(bytes)), err)
+	}
+	return nil
+}
+
+// Arguments made up of only these characters do not need to be quoted in a POSIX shell
+var shellSafeRegex = regexp.MustCompile(`^[a-zA-Z0-9@%+=:,./_-]+$`)
+
+// FormatCommand returns the given command line quoted so that it can be pasted into a POSIX shell
+func FormatCommand(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if shellSafeRegex.MatchString(arg) {
+			quoted[i] = arg
+		} else {
+			quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+// SSHExit describes how ssh exited
+type SSHExit struct {
+	// The exit code of ssh (which is the exit code of the remote command if one was run). If ssh was killed by a
+	// signal, the exit code follows the shell convention of 128 plus the signal number.
+	Code int
+	// The signal that killed ssh. Nil if ssh exited normally.
+	Signal os.Signal
+}
+
+// Exit exits kssh the same way that ssh exited so that callers (eg scripts, git, or a shell checking for ^C) see the
+// same status as if they had run ssh directly: killed by the same signal if possible and otherwise with Code.
+func (e SSHExit) Exit() {
+	if e.Signal != nil {
+		raiseSignal(e.Signal)
+	}
+	os.Exit(e.Code)
+}
+
+// RunSSH runs ssh with the given arguments connected to kssh's stdin, stdout, and stderr. The arguments are passed as
+// is so ssh allocates a TTY (or not, via -t and -T) exactly as if it had been run directly. Signals received by kssh
+// (see forwardedSignals) are forwarded to ssh so that kssh exits when (and how) ssh does. Returns how ssh exited.
+func RunSSH(args []string) (SSHExit, error) {
+	return runForwardingSignals("ssh", args)
+}
+
+// Run the given program connected to kssh's stdin, stdout, and stderr and forward signals to it like RunSSH
+func runForwardingSignals(name string, args []string) (SSHExit, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, forwardedSignals...)
+	defer signal.Stop(signals)
+
+	err := cmd.Start()
+	if err != nil {
+		return SSHExit{}, fmt.Errorf("failed to start %s: %v", name, err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				_ = cmd.Process.Signal(sig)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return SSHExit{Code: 128 + int(status.Signal()), Signal: status.Signal()}, nil
+		}
+		return SSHExit{Code: exitErr.ExitCode()}, nil
+	}
+	if err != nil {
+		return SSHExit{}, err
+	}
+	return SSHExit{}, nil
+}
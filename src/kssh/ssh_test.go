@@ -0,0 +1,14 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatCommand(t *testing.T) {
+	require.Equal(t, "ssh -i /home/alice/.ssh/kssh/key -o IdentitiesOnly=yes root@server",
+		FormatCommand([]string{"ssh", "-i", "/home/alice/.ssh/kssh/key", "-o", "IdentitiesOnly=yes", "root@server"}))
+	require.Equal(t, `ssh -o 'ProxyCommand=aws ssm start-session --target %h' root@i-0123 'ls -l' '' 'it'\''s'`,
+		FormatCommand([]string{"ssh", "-o", "ProxyCommand=aws ssm start-session --target %h", "root@i-0123", "ls -l", "", "it's"}))
+}
@@ -0,0 +1,32 @@
+//go:build !windows
+// +build !windows
+
+package kssh
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The signals that kssh forwards to ssh. SIGWINCH is included so that ssh resizes the remote terminal even when kssh
+// is signaled on its own (eg by a terminal emulator or multiplexer that only knows about the process it spawned).
+var forwardedSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT, syscall.SIGWINCH}
+
+// The signals that kssh re-raises on itself if ssh was killed by them (see SSHExit.Exit). The Go runtime dumps
+// goroutines on SIGQUIT so that one is only reported via the exit code.
+var reraisedSignals = map[syscall.Signal]bool{syscall.SIGINT: true, syscall.SIGTERM: true, syscall.SIGHUP: true, syscall.SIGKILL: true}
+
+// Kill kssh with the given signal. Returns if kssh survived it.
+func raiseSignal(sig os.Signal) {
+	s, ok := sig.(syscall.Signal)
+	if !ok || !reraisedSignals[s] {
+		return
+	}
+	signal.Reset(s)
+	if syscall.Kill(os.Getpid(), s) == nil {
+		// Signals are delivered asynchronously
+		time.Sleep(time.Second)
+	}
+}
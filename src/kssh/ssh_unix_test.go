@@ -0,0 +1,75 @@
+//go:build !windows
+// +build !windows
+
+package kssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Put a fake ssh that runs the given shell script on the PATH. Returns a function that restores the PATH.
+func fakeSSH(t *testing.T, script string) func() {
+	dir, err := ioutil.TempDir("", "kssh-fake-ssh")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	path := os.Getenv("PATH")
+	require.NoError(t, os.Setenv("PATH", dir+string(os.PathListSeparator)+path))
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRunSSHExitCode(t *testing.T) {
+	defer fakeSSH(t, `exit "$1"`)()
+
+	exit, err := RunSSH([]string{"0"})
+	require.NoError(t, err)
+	require.Equal(t, SSHExit{}, exit)
+
+	exit, err = RunSSH([]string{"42"})
+	require.NoError(t, err)
+	require.Equal(t, SSHExit{Code: 42}, exit)
+
+	exit, err = RunSSH([]string{"255"})
+	require.NoError(t, err)
+	require.Equal(t, SSHExit{Code: 255}, exit)
+}
+
+func TestRunSSHSignaled(t *testing.T) {
+	defer fakeSSH(t, `kill -TERM $$`)()
+
+	exit, err := RunSSH(nil)
+	require.NoError(t, err)
+	require.Equal(t, SSHExit{Code: 128 + int(syscall.SIGTERM), Signal: syscall.SIGTERM}, exit)
+}
+
+func TestRunSSHForwardsSignals(t *testing.T) {
+	// The fake ssh exits with a different code for each signal it receives
+	defer fakeSSH(t, `trap 'exit 10' WINCH; trap 'exit 11' INT; echo ready > "$1"; while true; do sleep 0.1; done`)()
+	ready := filepath.Join(os.TempDir(), "kssh-fake-ssh-ready")
+	defer os.Remove(ready)
+
+	for sig, code := range map[syscall.Signal]int{syscall.SIGWINCH: 10, syscall.SIGINT: 11} {
+		os.Remove(ready)
+		go func(sig syscall.Signal) {
+			for i := 0; i < 100; i++ {
+				if _, err := os.Stat(ready); err == nil {
+					break
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			_ = syscall.Kill(os.Getpid(), sig)
+		}(sig)
+		exit, err := RunSSH([]string{ready})
+		require.NoError(t, err)
+		require.Equal(t, SSHExit{Code: code}, exit, sig.String())
+	}
+}
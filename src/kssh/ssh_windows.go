@@ -0,0 +1,9 @@
+package kssh
+
+import "os"
+
+// The signals that kssh forwards to ssh. Windows does not support sending other signals to a process.
+var forwardedSignals = []os.Signal{os.Interrupt}
+
+// Windows processes cannot be killed by a signal so ssh's exit code is all there is to propagate
+func raiseSignal(sig os.Signal) {}
@@ -0,0 +1,108 @@
+package kssh
+
+import (
+	"fmt"
+	"strings"
+)
+
+// An sshOption is an option from an ssh command line. -i, -l, and -F are normalized via sshFlagOptions.
+type sshOption struct {
+	// The lower cased option name (eg identityfile or certificatefile)
+	Name  string
+	Value string
+	// The argument(s) the option was specified as, used in messages
+	Arg string
+}
+
+// The ssh options that are normalized to names that can be compared with -o options
+var sshFlagOptions = map[byte]string{'i': "identityfile", 'F': "-f", 'l': "user"}
+
+// Parse the options in the given ssh arguments. Only the arguments before the destination are considered since the
+// rest of the arguments are the remote command.
+func parseSSHOptions(args []string) []sshOption {
+	var options []sshOption
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") || len(arg) == 1 {
+			break
+		}
+		if !strings.ContainsRune(sshFlagsWithArguments, rune(arg[1])) {
+			// A flag without an argument (or several of them combined, eg -At)
+			continue
+		}
+		value := arg[2:]
+		display := arg
+		if value == "" && i+1 < len(args) {
+			i++
+			value = args[i]
+			display = arg + " " + value
+		}
+		if arg[1] == 'o' {
+			// -o accepts both Name=Value and "Name Value"
+			split := strings.SplitN(strings.TrimSpace(value), "=", 2)
+			if len(split) != 2 {
+				split = strings.SplitN(strings.TrimSpace(value), " ", 2)
+			}
+			option := sshOption{Name: strings.ToLower(strings.TrimSpace(split[0])), Arg: display}
+			if len(split) == 2 {
+				option.Value = strings.TrimSpace(split[1])
+			}
+			options = append(options, option)
+		} else if name, ok := sshFlagOptions[arg[1]]; ok {
+			options = append(options, sshOption{Name: name, Value: value, Arg: display})
+		}
+	}
+	return options
+}
+
+// An SSHOptionConflict is an ssh option passed to kssh that conflicts with an option kssh adds itself
+type SSHOptionConflict struct {
+	Message string
+	// Whether the conflict makes ssh ignore the user's option (rather than just making it unclear which key ssh uses)
+	Fatal bool
+}
+
+// Options that ssh only takes the first value of (later values, such as the ones passed by the user after kssh's own
+// options, are silently ignored) and that may legitimately be repeated with the same value
+var sshFirstValueWinsOptions = map[string]bool{"identitiesonly": true, "proxycommand": true, "pkcs11provider": true, "user": true}
+
+// FindSSHOptionConflicts returns the conflicts between the ssh options that kssh adds (ksshArgs) and the ones the user
+// passed (userArgs). Conflicts that make ssh silently ignore one of the user's options are fatal; the others make it
+// unclear which key or certificate ssh presents.
+func FindSSHOptionConflicts(ksshArgs, userArgs []string) []SSHOptionConflict {
+	ksshOptions := make(map[string]sshOption)
+	for _, option := range parseSSHOptions(ksshArgs) {
+		if _, ok := ksshOptions[option.Name]; !ok {
+			ksshOptions[option.Name] = option
+		}
+	}
+	var conflicts []SSHOptionConflict
+	for _, option := range parseSSHOptions(userArgs) {
+		switch {
+		case sshFirstValueWinsOptions[option.Name]:
+			ours, ok := ksshOptions[option.Name]
+			if ok && !strings.EqualFold(ours.Value, option.Value) {
+				conflicts = append(conflicts, SSHOptionConflict{Fatal: true, Message: fmt.Sprintf(
+					"%s conflicts with %s which kssh passes to ssh, ssh would ignore %s", option.Arg, ours.Arg, option.Arg)})
+			}
+		case option.Name == "identityfile" || option.Name == "certificatefile":
+			ours, ok := ksshOptions["identityfile"]
+			if !ok {
+				ours, ok = ksshOptions["certificatefile"]
+			}
+			if ok {
+				conflicts = append(conflicts, SSHOptionConflict{Message: fmt.Sprintf(
+					"%s is offered to the server in addition to the key provisioned by kssh (%s) so it is unclear which "+
+						"one the server accepts. Remove %s to only use kssh's key", option.Arg, ours.Arg, option.Arg)})
+			}
+		case option.Name == "-f":
+			if ours, ok := ksshOptions["-f"]; ok {
+				conflicts = append(conflicts, SSHOptionConflict{Message: fmt.Sprintf(
+					"%s replaces %s which kssh uses to implement the default SSH user, so the default user is not "+
+						"used. Either do not pass -F or run `kssh --clear-default-user` to delegate the default user to "+
+						"the CA bot", option.Arg, ours.Arg)})
+			}
+		}
+	}
+	return conflicts
+}
@@ -0,0 +1,44 @@
+package kssh
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSSHOptions(t *testing.T) {
+	require.Equal(t, []sshOption{
+		{Name: "identityfile", Value: "~/.ssh/id_ed25519", Arg: "-i ~/.ssh/id_ed25519"},
+		{Name: "identitiesonly", Value: "no", Arg: "-oIdentitiesOnly=no"},
+		{Name: "certificatefile", Value: "cert.pub", Arg: "-o CertificateFile cert.pub"},
+		{Name: "user", Value: "root", Arg: "-lroot"},
+	}, parseSSHOptions([]string{"-At", "-i", "~/.ssh/id_ed25519", "-oIdentitiesOnly=no", "-p", "22",
+		"-o", "CertificateFile cert.pub", "-lroot", "server", "-i", "remote-command-arg"}))
+}
+
+func TestFindSSHOptionConflicts(t *testing.T) {
+	ksshArgs := []string{"-i", "/keys/kssh", "-o", "IdentitiesOnly=yes", "-F", "/home/alice/.ssh/kssh-config"}
+
+	require.Empty(t, FindSSHOptionConflicts(ksshArgs, []string{"-p", "2222", "-o", "identitiesonly=YES", "root@server", "-i"}))
+
+	conflicts := FindSSHOptionConflicts(ksshArgs, []string{"-o", "IdentitiesOnly=no", "root@server"})
+	require.Len(t, conflicts, 1)
+	require.True(t, conflicts[0].Fatal)
+	require.Contains(t, conflicts[0].Message, "-o IdentitiesOnly=no conflicts with -o IdentitiesOnly=yes")
+
+	conflicts = FindSSHOptionConflicts(ksshArgs, []string{"-i", "~/.ssh/id_rsa", "-oCertificateFile=cert.pub", "-F", "my-config", "root@server"})
+	require.Len(t, conflicts, 3)
+	for _, conflict := range conflicts {
+		require.False(t, conflict.Fatal)
+	}
+	require.Contains(t, conflicts[0].Message, "-i ~/.ssh/id_rsa is offered to the server in addition to the key provisioned by kssh")
+	require.Contains(t, conflicts[2].Message, "-F my-config replaces -F /home/alice/.ssh/kssh-config")
+
+	// Without kssh's own key (eg when it is only delivered via the ssh-agent) the user's keys do not conflict
+	require.Empty(t, FindSSHOptionConflicts(nil, []string{"-i", "~/.ssh/id_rsa", "-F", "my-config", "root@server"}))
+
+	conflicts = FindSSHOptionConflicts([]string{"-o", "PKCS11Provider=/usr/lib/opensc-pkcs11.so", "-o", "CertificateFile=/keys/kssh-pkcs11-cert.pub"},
+		[]string{"-o", "PKCS11Provider=/usr/lib/other.so", "root@server"})
+	require.Len(t, conflicts, 1)
+	require.True(t, conflicts[0].Fatal)
+}
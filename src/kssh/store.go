@@ -0,0 +1,103 @@
+package kssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long to wait for another kssh process to finish updating a store. Updates only take as long as reading and
+// writing a small file so this is much shorter than lockTimeout.
+const storeLockTimeout = 30 * time.Second
+
+// errStoreUnchanged may be returned by the function passed to jsonStore.Update to skip writing the document
+var errStoreUnchanged = fmt.Errorf("the store was not changed")
+
+// jsonStore is a JSON document on disk (eg the local config file) that concurrent kssh invocations (eg from an IDE
+// that spawns many ssh processes at once) read and update. Updates are serialized via a lock file next to the
+// document so that no update is lost, and the document is replaced atomically so that readers never see a partially
+// written file.
+type jsonStore struct {
+	path string
+	perm os.FileMode
+}
+
+// Read decodes the document into v. v is left unchanged if the document does not exist yet.
+func (s jsonStore) Read(v interface{}) error {
+	bytes, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(bytes, v)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// Update reads the document into v, calls update (which modifies v), and writes v back, all while holding the lock
+// so that concurrent updates are applied one after the other. Nothing is written if update returns an error. Returning
+// errStoreUnchanged skips the write without returning an error.
+func (s jsonStore) Update(v interface{}, update func() error) error {
+	release, _, err := lockFile(s.path+".lock", storeLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+	err = s.Read(v)
+	if err != nil {
+		return err
+	}
+	err = update()
+	if err == errStoreUnchanged {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.write(v)
+}
+
+// Write replaces the document with v
+func (s jsonStore) Write(v interface{}) error {
+	release, _, err := lockFile(s.path+".lock", storeLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return s.write(v)
+}
+
+// Write v to a temporary file in the same directory and rename it over the document. The caller must hold the lock.
+func (s jsonStore) write(v interface{}) error {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(bytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(f.Name(), s.perm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
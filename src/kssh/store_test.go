@@ -0,0 +1,112 @@
+package kssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store := jsonStore{path: filepath.Join(dir, "state.json"), perm: 0600}
+
+	// A missing document leaves the value unchanged
+	counts := map[string]int{"initial": 1}
+	require.NoError(t, store.Read(&counts))
+	require.Equal(t, map[string]int{"initial": 1}, counts)
+
+	// Concurrent updates are applied one after the other so that none of them are lost
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var counts map[string]int
+			errs <- store.Update(&counts, func() error {
+				if counts == nil {
+					counts = make(map[string]int)
+				}
+				counts["total"]++
+				counts[fmt.Sprintf("process%d", i)]++
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	counts = nil
+	require.NoError(t, store.Read(&counts))
+	require.Equal(t, 20, counts["total"])
+	require.Len(t, counts, 21)
+	info, err := os.Stat(store.path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// Neither errStoreUnchanged nor a failed update write anything
+	before := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(store.path, before, before))
+	require.NoError(t, store.Update(&counts, func() error {
+		counts["total"] = 0
+		return errStoreUnchanged
+	}))
+	require.Error(t, store.Update(&counts, func() error {
+		counts["total"] = 0
+		return fmt.Errorf("update failed")
+	}))
+	info, err = os.Stat(store.path)
+	require.NoError(t, err)
+	require.True(t, info.ModTime().Before(time.Now().Add(-time.Minute)))
+
+	// No lock or temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	require.NoError(t, ioutil.WriteFile(store.path, []byte("{"), 0600))
+	require.Error(t, store.Read(&counts))
+}
+
+func TestConcurrentConfigUpdates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-store-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	oldConfig := localConfigFileLocation
+	defer func() { localConfigFileLocation = oldConfig }()
+	localConfigFileLocation = filepath.Join(dir, "config.json")
+
+	// Recording sessions for many hosts at once (eg from an IDE) does not lose any of them
+	var wg sync.WaitGroup
+	for i := 0; i < maxSessions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := RecordSession(fmt.Sprintf("host%d", i), Session{Args: []string{"host"}, LastConnected: time.Now()}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := SetDefaultSSHUser("alice"); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+	lcf, err := getCurrentConfigFile()
+	require.NoError(t, err)
+	require.Len(t, lcf.Sessions, maxSessions)
+	require.Equal(t, "alice", lcf.DefaultSSHUser)
+}
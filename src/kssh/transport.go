@@ -0,0 +1,140 @@
+package kssh
+
+import (
+	"time"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/kbfs"
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
+)
+
+// ChatMessage is a text message received over Keybase chat
+type ChatMessage struct {
+	Sender string
+	Body   string
+}
+
+// ChatSubscription is a stream of new text messages
+type ChatSubscription interface {
+	// Read blocks until the next text message is received
+	Read() (ChatMessage, error)
+}
+
+// ChatTransport is the subset of Keybase functionality that the Requester relies on. It exists so that the
+// request/response state machine can be exercised against an in memory implementation (see the ksshtest package)
+// rather than a running Keybase service.
+type ChatTransport interface {
+	// GetUsername returns the username of the current Keybase user
+	GetUsername() string
+	// ListTeams returns the names of all of the teams that the current user can read
+	ListTeams() ([]string, error)
+	// GetEntry returns the value stored in the KV store for the given team. found is false if there is no such entry.
+	GetEntry(teamName, namespace, entryKey string) (value string, found bool, err error)
+	// ReadFile returns the contents of the given KBFS file. found is false if there is no such file.
+	ReadFile(path string) (contents string, found bool, err error)
+	// SendMessage sends a text message to the given team and channel. A nil channel means the default channel. If
+	// explodingLifetime is non-zero the message is sent as an exploding message with that lifetime.
+	SendMessage(teamName string, channel *string, body string, explodingLifetime time.Duration) error
+	// Subscribe starts listening for new text messages in all conversations
+	Subscribe() (ChatSubscription, error)
+}
+
+// kbchatTransport implements ChatTransport on top of a running keybase chat API. Team and KV store lookups go through
+// persistent `keybase team api` and `keybase kvstore api` processes (see keybaseAPI) rather than kbchat, which spawns
+// a new keybase process for every call.
+type kbchatTransport struct {
+	api     *kbchat.API
+	team    *keybaseAPI
+	kvstore *keybaseAPI
+}
+
+func newKbchatTransport(api *kbchat.API, keybaseBinaryPath string) *kbchatTransport {
+	return &kbchatTransport{
+		api:     api,
+		team:    newKeybaseAPI(keybaseBinaryPath, "team"),
+		kvstore: newKeybaseAPI(keybaseBinaryPath, "kvstore"),
+	}
+}
+
+var _ ChatTransport = (*kbchatTransport)(nil)
+
+func (t *kbchatTransport) GetUsername() string {
+	return t.api.GetUsername()
+}
+
+func (t *kbchatTransport) ListTeams() ([]string, error) {
+	var memberships keybase1.AnnotatedTeamList
+	params := map[string]interface{}{"options": map[string]string{"username": t.api.GetUsername()}}
+	err := t.team.Call("list-user-memberships", params, &memberships)
+	if err != nil {
+		return nil, err
+	}
+	var teams []string
+	for _, m := range memberships.Teams {
+		if shared.CanRoleReadTeam(m.Role) {
+			teams = append(teams, m.FqName)
+		}
+	}
+	return teams, nil
+}
+
+func (t *kbchatTransport) GetEntry(teamName, namespace, entryKey string) (string, bool, error) {
+	var res keybase1.KVGetResult
+	params := map[string]interface{}{"options": map[string]string{"team": teamName, "namespace": namespace, "entryKey": entryKey}}
+	err := t.kvstore.Call("get", params, &res)
+	if err != nil {
+		return "", false, err
+	}
+	if res.Revision > 0 && len(res.EntryValue) > 0 {
+		return res.EntryValue, true, nil
+	}
+	return "", false, nil
+}
+
+func (t *kbchatTransport) ReadFile(path string) (string, bool, error) {
+	ko := kbfs.Operation{KeybaseBinaryPath: GetKeybaseBinaryPath(), HomeDir: keybaseHomeDir}
+	bytes, exists, err := ko.ReadIfExists(path)
+	if err != nil || !exists {
+		return "", false, err
+	}
+	return string(bytes), true, nil
+}
+
+func (t *kbchatTransport) SendMessage(teamName string, channel *string, body string, explodingLifetime time.Duration) error {
+	if explodingLifetime > 0 {
+		destination := map[string]interface{}{"name": teamName, "members_type": "team"}
+		if channel != nil {
+			destination["topic_name"] = *channel
+		}
+		_, err := shared.SendExplodingMessage(t.api, map[string]interface{}{"channel": destination}, body, explodingLifetime)
+		return err
+	}
+	_, err := t.api.SendMessageByTeamName(teamName, channel, body)
+	return err
+}
+
+func (t *kbchatTransport) Subscribe() (ChatSubscription, error) {
+	sub, err := t.api.ListenForNewTextMessages()
+	if err != nil {
+		return nil, err
+	}
+	return &kbchatSubscription{read: sub.Read}, nil
+}
+
+type kbchatSubscription struct {
+	read func() (kbchat.SubscriptionMessage, error)
+}
+
+func (s *kbchatSubscription) Read() (ChatMessage, error) {
+	for {
+		msg, err := s.read()
+		if err != nil {
+			return ChatMessage{}, err
+		}
+		if msg.Message.Content.TypeName != "text" {
+			continue
+		}
+		return ChatMessage{Sender: msg.Message.Sender.Username, Body: msg.Message.Content.Text.Body}, nil
+	}
+}
@@ -0,0 +1,223 @@
+package kssh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/keybase/bot-sshca/src/keybaseca/kbfs"
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+)
+
+// SelfUpdate replaces the running kssh binary with the latest release published by the given Keybase user (see
+// `keybaseca publish-release`). The manifest and the binary are only used if their signatures were made by signer.
+// signer must come from a trusted local source (see GetReleaseSigner), never from a config fetched from a team.
+// Returns the version that was installed or an empty string if kssh is already running that version.
+func SelfUpdate(signer, currentVersion string) (string, error) {
+	dir, err := ioutil.TempDir("", "kssh-update")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	releaseDir := shared.ReleaseDirectory(signer)
+	manifestPath, err := downloadSignedFile(signer, path.Join(releaseDir, shared.ReleaseManifestFilename), dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the release manifest from %s (has a release been published?): %v", releaseDir, err)
+	}
+	manifestBytes, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return "", err
+	}
+	var manifest shared.ReleaseManifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse the release manifest: %v", err)
+	}
+	binary, err := selectReleaseBinary(manifest, currentVersion, runtime.GOOS, runtime.GOARCH)
+	if err != nil || binary == nil {
+		return "", err
+	}
+
+	log.Debugf("Downloading kssh %s...", manifest.Version)
+	binaryPath, err := downloadSignedFile(signer, path.Join(releaseDir, binary.Path), dir)
+	if err != nil {
+		return "", err
+	}
+	err = checkSHA256(binaryPath, binary.SHA256)
+	if err != nil {
+		return "", err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the kssh binary: %v", err)
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return "", fmt.Errorf("failed to locate the kssh binary: %v", err)
+	}
+	err = replaceExecutable(executable, binaryPath)
+	if err != nil {
+		return "", err
+	}
+	return manifest.Version, nil
+}
+
+// Returns the binary from the manifest that should be installed on the given platform. Returns nil if currentVersion
+// is already the published version.
+func selectReleaseBinary(manifest shared.ReleaseManifest, currentVersion, goos, goarch string) (*shared.ReleaseBinary, error) {
+	if !shared.IsValidReleaseVersion(manifest.Version) {
+		return nil, fmt.Errorf("the release manifest contains an invalid version %q", manifest.Version)
+	}
+	if manifest.Version == currentVersion {
+		return nil, nil
+	}
+	platform := shared.ReleasePlatform(goos, goarch)
+	binary, ok := manifest.Binaries[platform]
+	if !ok {
+		return nil, fmt.Errorf("kssh %s was not published for %s", manifest.Version, platform)
+	}
+	// The path is relative to the release directory and must not escape it
+	if path.IsAbs(binary.Path) || strings.HasPrefix(path.Clean(binary.Path), "..") {
+		return nil, fmt.Errorf("the release manifest contains an invalid path %q", binary.Path)
+	}
+	return &binary, nil
+}
+
+// Download the given KBFS file and its detached signature into dir and verify that the signature was made by signer.
+// Returns the local path of the file.
+func downloadSignedFile(signer, remotePath, dir string) (string, error) {
+	localPath := filepath.Join(dir, path.Base(remotePath))
+	err := downloadFile(remotePath, localPath)
+	if err != nil {
+		return "", err
+	}
+	err = downloadFile(remotePath+shared.ReleaseSignatureSuffix, localPath+shared.ReleaseSignatureSuffix)
+	if err != nil {
+		return "", err
+	}
+	cmd, err := keybaseCommand("verify", "--detached", localPath+shared.ReleaseSignatureSuffix,
+		"--infile", localPath, "--signed-by", signer)
+	if err != nil {
+		return "", err
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("refusing to use %s since it was not signed by %s: %s (%v)", remotePath, signer, strings.TrimSpace(string(output)), err)
+	}
+	return localPath, nil
+}
+
+// Copy the given KBFS file to localPath
+func downloadFile(remotePath, localPath string) error {
+	ko := kbfs.Operation{KeybaseBinaryPath: GetKeybaseBinaryPath(), HomeDir: keybaseHomeDir}
+	r, err := ko.ReadStream(remotePath)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		r.Close()
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	closeErr := r.Close()
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", remotePath, err)
+	}
+	return closeErr
+}
+
+// Returns an error if the hex encoded SHA256 hash of the given file is not expected
+func checkSHA256(filename, expected string) error {
+	actual, err := fileSHA256(filename)
+	if err != nil {
+		return err
+	}
+	if actual != strings.ToLower(expected) {
+		return fmt.Errorf("the downloaded binary has the hash %s rather than %s from the release manifest", actual, expected)
+	}
+	return nil
+}
+
+// Returns the hex encoded SHA-256 of the given file
+func fileSHA256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Atomically replace the executable at target with a copy of source. The copy is written next to target first so
+// that the final rename never crosses filesystems and a failed update leaves the old binary in place. Windows does
+// not allow replacing a running executable so there the old binary is moved aside first.
+func replaceExecutable(target, source string) error {
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	newPath := target + ".new"
+	err = copyFile(source, newPath, info.Mode().Perm()|0111)
+	if err != nil {
+		os.Remove(newPath)
+		return fmt.Errorf("failed to write the new kssh binary next to %s: %v", target, err)
+	}
+	oldPath := target + ".old"
+	if runtime.GOOS == "windows" {
+		os.Remove(oldPath)
+		err = os.Rename(target, oldPath)
+		if err != nil {
+			os.Remove(newPath)
+			return fmt.Errorf("failed to move the old kssh binary aside: %v", err)
+		}
+	}
+	err = os.Rename(newPath, target)
+	if err != nil {
+		os.Remove(newPath)
+		if runtime.GOOS == "windows" {
+			os.Rename(oldPath, target)
+		}
+		return fmt.Errorf("failed to replace %s: %v", target, err)
+	}
+	return nil
+}
+
+// Copy the local file at src to dst with the given permissions
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	// The mode passed to OpenFile is subject to the umask
+	return os.Chmod(dst, perm)
+}
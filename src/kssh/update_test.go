@@ -0,0 +1,59 @@
+package kssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectReleaseBinary(t *testing.T) {
+	manifest := shared.ReleaseManifest{
+		Version: "1.1.0",
+		Binaries: map[string]shared.ReleaseBinary{
+			"linux-amd64":  {Path: "1.1.0/kssh-linux-amd64", SHA256: "aa"},
+			"darwin-amd64": {Path: "../../private/kssh-darwin-amd64", SHA256: "bb"},
+		},
+	}
+
+	binary, err := selectReleaseBinary(manifest, "1.0.0", "linux", "amd64")
+	require.NoError(t, err)
+	require.Equal(t, "1.1.0/kssh-linux-amd64", binary.Path)
+
+	binary, err = selectReleaseBinary(manifest, "1.1.0", "linux", "amd64")
+	require.NoError(t, err)
+	require.Nil(t, binary)
+
+	_, err = selectReleaseBinary(manifest, "1.0.0", "windows", "amd64")
+	require.Error(t, err)
+	_, err = selectReleaseBinary(manifest, "1.0.0", "darwin", "amd64")
+	require.Error(t, err)
+	_, err = selectReleaseBinary(shared.ReleaseManifest{Version: "../1.1.0"}, "1.0.0", "linux", "amd64")
+	require.Error(t, err)
+}
+
+func TestReplaceExecutable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kssh-update")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	target := filepath.Join(dir, "kssh")
+	source := filepath.Join(dir, "kssh-download")
+	require.NoError(t, ioutil.WriteFile(target, []byte("old"), 0755))
+	require.NoError(t, ioutil.WriteFile(source, []byte("new"), 0600))
+
+	require.NoError(t, checkSHA256(source, "11507a0e2f5e69d5dfa40a62a1bd7b6ee57e6bcd85c67c9b8431b36fff21c437"))
+	require.Error(t, checkSHA256(source, "00"))
+
+	require.NoError(t, replaceExecutable(target, source))
+	contents, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	require.Equal(t, "new", string(contents))
+	info, err := os.Stat(target)
+	require.NoError(t, err)
+	require.NotZero(t, info.Mode()&0100)
+	_, err = os.Stat(target + ".new")
+	require.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,181 @@
+package kssh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+// VerificationError is returned when the certificate returned by the CA bot does not match the request. This means
+// that the response was tampered with or that the certificate was mis-issued so it must never be installed.
+type VerificationError struct {
+	BotName string
+	Reason  string
+}
+
+func (e VerificationError) Error() string {
+	return fmt.Sprintf("refusing to use the certificate returned by %s: %s", e.BotName, e.Reason)
+}
+
+// VerifySignedKey checks that signedKey is a user certificate for publicKey that was signed by caPublicKey (or by an
+// intermediate CA key certified by caPublicKey, see shared.VerifyChain) and that every principal in it is one of the
+// given principals (the teams the current user is in plus any elevated principals if an elevated certificate was
+// requested). Verification of the CA key is
+// skipped if caPublicKey is empty. The validity period is not checked since that is enforced by the SSH server and
+// would otherwise make kssh sensitive to clock skew between this machine and the CA.
+func VerifySignedKey(botName, caPublicKey, publicKey, signedKey string, allowedPrincipals []string) (*ssh.Certificate, error) {
+	fail := func(format string, args ...interface{}) (*ssh.Certificate, error) {
+		return nil, VerificationError{BotName: botName, Reason: fmt.Sprintf(format, args...)}
+	}
+
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedKey))
+	if err != nil {
+		return fail("failed to parse the certificate: %v", err)
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if !ok {
+		return fail("the response is not an SSH certificate")
+	}
+	if cert.CertType != ssh.UserCert {
+		return fail("the certificate is not a user certificate")
+	}
+
+	requestedKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(publicKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the public key that was sent to the CA: %v", err)
+	}
+	if !bytes.Equal(cert.Key.Marshal(), requestedKey.Marshal()) {
+		return fail("the certificate is for a different public key than the one that was sent")
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		// An empty list of principals is valid for every principal
+		return fail("the certificate does not restrict which principals it is valid for")
+	}
+	for _, principal := range cert.ValidPrincipals {
+		if !containsString(allowedPrincipals, principal) {
+			return fail("the certificate includes the principal '%s' which is not one of your teams", principal)
+		}
+	}
+
+	if caPublicKey != "" {
+		caKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(caPublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the public key of the CA: %v", err)
+		}
+		if !bytes.Equal(cert.SignatureKey.Marshal(), caKey.Marshal()) {
+			if _, ok := cert.Extensions[shared.IntermediateExtension]; !ok {
+				return fail("the certificate was signed by %s rather than the CA key %s",
+					ssh.FingerprintSHA256(cert.SignatureKey), ssh.FingerprintSHA256(caKey))
+			}
+			// caPublicKey is the root CA key so the intermediate CA key must have been certified by it when the
+			// certificate was issued
+			_, err = shared.VerifyChain(cert, caKey, time.Unix(int64(cert.ValidAfter), 0))
+			if err != nil {
+				return fail("%v", err)
+			}
+		}
+		checker := ssh.CertChecker{
+			Clock:                    func() time.Time { return time.Unix(int64(cert.ValidAfter), 0) },
+			SupportedCriticalOptions: criticalOptionNames(cert),
+		}
+		// CheckCert verifies the signature
+		if err := checker.CheckCert(cert.ValidPrincipals[0], cert); err != nil {
+			return fail("%v", err)
+		}
+	}
+
+	if err := shared.CheckFIPSKey(cert.SignatureKey); err != nil {
+		return fail("the certificate was signed by a CA key that cannot be used in FIPS mode: %v", err)
+	}
+	if !shared.IsFIPSSignatureAlgorithm(cert.Signature.Format) {
+		return fail("the certificate was signed with %s which cannot be used in FIPS mode", cert.Signature.Format)
+	}
+
+	return cert, nil
+}
+
+// Returns the public key of the CA that certificates from the bot described by conf should be signed by. This is the
+// root CA key if the bot signs with an intermediate CA key. The key published in the bot's config is preferred. If the
+// bot does not publish its key (eg it is running an older version of keybaseca), the key cached when the previous
+// certificate at keyPath was issued is used.
+func getExpectedCAKey(conf Config, keyPath string) string {
+	cached, err := GetCachedClientConfig(keyPath)
+	if err != nil {
+		log.Debugf("Failed to read the cached client config for %s: %v", keyPath, err)
+		cached = nil
+	}
+	if conf.trustedCAKey() != "" {
+		if cached != nil && cached.BotName == conf.BotName && cached.trustedCAKey() != "" &&
+			strings.TrimSpace(cached.trustedCAKey()) != strings.TrimSpace(conf.trustedCAKey()) {
+			log.Warnf("The CA key used by %s has changed since your last certificate was issued. This is expected if "+
+				"the CA key was rotated.", conf.BotName)
+		}
+		return conf.trustedCAKey()
+	}
+	if cached != nil && cached.BotName == conf.BotName && cached.trustedCAKey() != "" {
+		log.Warnf("%s no longer publishes its CA key, verifying against the previously cached key", conf.BotName)
+		return cached.trustedCAKey()
+	}
+	log.Warnf("%s does not publish its CA key (is it running an old version of keybaseca?) so kssh cannot verify which "+
+		"key signed your certificate", conf.BotName)
+	return ""
+}
+
+// Returns the CA key that signedKey should be signed by given the key that the bot's certificates are expected to be
+// signed by: the threshold CA key if the certificate includes one of the bot's ThresholdTeams and otherwise expected.
+// Parse errors are left to VerifySignedKey.
+func expectedCAKeyForCertificate(conf Config, expected, signedKey string) string {
+	if conf.ThresholdCAPublicKey == "" {
+		return expected
+	}
+	parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signedKey))
+	if err != nil {
+		return expected
+	}
+	cert, ok := parsed.(*ssh.Certificate)
+	if ok && len(shared.MatchTeams(conf.ThresholdTeams, cert.ValidPrincipals)) > 0 {
+		return conf.ThresholdCAPublicKey
+	}
+	return expected
+}
+
+// Returns the CA key that hosts in conf's team should trust: the threshold CA key if the team is one of the bot's
+// ThresholdTeams and otherwise the CA key
+func (c *Config) hostCAKey() string {
+	if c.ThresholdCAPublicKey != "" && len(shared.MatchTeams(c.ThresholdTeams, []string{c.TeamName})) > 0 {
+		return c.ThresholdCAPublicKey
+	}
+	return c.CAPublicKey
+}
+
+// Returns the root CA key if the bot signs with an intermediate CA key and otherwise the CA key
+func (c *Config) trustedCAKey() string {
+	if c.RootCAPublicKey != "" {
+		return c.RootCAPublicKey
+	}
+	return c.CAPublicKey
+}
+
+// Returns the names of the critical options in the given certificate
+func criticalOptionNames(cert *ssh.Certificate) []string {
+	var names []string
+	for name := range cert.CriticalOptions {
+		names = append(names, name)
+	}
+	return names
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package kssh
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/keybase/bot-sshca/src/shared"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func generateSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+func signCert(t *testing.T, ca ssh.Signer, key ssh.PublicKey, certType uint32, principals []string) string {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        certType,
+		KeyId:           "uuid:uuid:alice",
+		ValidPrincipals: principals,
+		// Already expired to check that the validity period is left to the SSH server
+		ValidAfter:  uint64(time.Now().Add(-2 * time.Hour).Unix()),
+		ValidBefore: uint64(time.Now().Add(-time.Hour).Unix()),
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	return string(ssh.MarshalAuthorizedKey(cert))
+}
+
+func TestVerifySignedKey(t *testing.T) {
+	if shared.FIPSMode {
+		t.Skip("uses ed25519 keys which are not allowed in FIPS mode")
+	}
+	ca := generateSigner(t)
+	otherCA := generateSigner(t)
+	key := generateSigner(t).PublicKey()
+	otherKey := generateSigner(t).PublicKey()
+	caPublicKey := string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	publicKey := string(ssh.MarshalAuthorizedKey(key))
+	teams := []string{"team.ssh.prod", "team.ssh.staging"}
+
+	cert, err := VerifySignedKey("cabot", caPublicKey, publicKey, signCert(t, ca, key, ssh.UserCert, []string{"team.ssh.prod"}), teams)
+	require.NoError(t, err)
+	require.Equal(t, []string{"team.ssh.prod"}, cert.ValidPrincipals)
+
+	// Without a CA key everything except the signing key is still checked
+	_, err = VerifySignedKey("cabot", "", publicKey, signCert(t, otherCA, key, ssh.UserCert, []string{"team.ssh.prod"}), teams)
+	require.NoError(t, err)
+
+	for name, signedKey := range map[string]string{
+		"not a cert":            publicKey,
+		"garbage":               "garbage",
+		"wrong CA":              signCert(t, otherCA, key, ssh.UserCert, []string{"team.ssh.prod"}),
+		"wrong key":             signCert(t, ca, otherKey, ssh.UserCert, []string{"team.ssh.prod"}),
+		"host cert":             signCert(t, ca, key, ssh.HostCert, []string{"team.ssh.prod"}),
+		"no principals":         signCert(t, ca, key, ssh.UserCert, nil),
+		"unexpected principals": signCert(t, ca, key, ssh.UserCert, []string{"team.ssh.prod", "root"}),
+	} {
+		_, err = VerifySignedKey("cabot", caPublicKey, publicKey, signedKey, teams)
+		require.Error(t, err, name)
+		require.IsType(t, VerificationError{}, err, name)
+	}
+
+	// A tampered certificate fails the signature check
+	tampered, _, _, _, err := ssh.ParseAuthorizedKey([]byte(signCert(t, ca, key, ssh.UserCert, []string{"team.ssh.prod"})))
+	require.NoError(t, err)
+	tampered.(*ssh.Certificate).ValidPrincipals = []string{"team.ssh.staging"}
+	_, err = VerifySignedKey("cabot", caPublicKey, publicKey, string(ssh.MarshalAuthorizedKey(tampered)), teams)
+	require.Error(t, err)
+}
+
+func TestVerifySignedKeyIntermediate(t *testing.T) {
+	if shared.FIPSMode {
+		t.Skip("uses ed25519 keys which are not allowed in FIPS mode")
+	}
+	root := generateSigner(t)
+	ca := generateSigner(t)
+	key := generateSigner(t).PublicKey()
+	publicKey := string(ssh.MarshalAuthorizedKey(key))
+	teams := []string{"team.ssh.prod"}
+	issuedAt := time.Now().Add(-2 * time.Hour)
+	intermediate := &ssh.Certificate{
+		Key:             ca.PublicKey(),
+		CertType:        ssh.UserCert,
+		KeyId:           "intermediate",
+		ValidPrincipals: []string{"team.ssh.*"},
+		ValidAfter:      uint64(issuedAt.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(issuedAt.Add(time.Hour).Unix()),
+		Permissions:     ssh.Permissions{CriticalOptions: map[string]string{shared.IntermediateCriticalOption: ""}},
+	}
+	require.NoError(t, intermediate.SignCert(rand.Reader, root))
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "uuid:uuid:alice",
+		ValidPrincipals: teams,
+		ValidAfter:      uint64(issuedAt.Unix()),
+		ValidBefore:     uint64(issuedAt.Add(time.Hour).Unix()),
+		Permissions:     ssh.Permissions{Extensions: map[string]string{shared.IntermediateExtension: shared.EncodeIntermediateCert(intermediate)}},
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, ca))
+	signedKey := string(ssh.MarshalAuthorizedKey(cert))
+
+	// The chain is checked as of when the certificate was issued
+	_, err := VerifySignedKey("cabot", string(ssh.MarshalAuthorizedKey(root.PublicKey())), publicKey, signedKey, teams)
+	require.NoError(t, err)
+	_, err = VerifySignedKey("cabot", string(ssh.MarshalAuthorizedKey(generateSigner(t).PublicKey())), publicKey, signedKey, teams)
+	require.Error(t, err)
+}
+
+func TestExpectedCAKeyForCertificate(t *testing.T) {
+	if shared.FIPSMode {
+		t.Skip("uses ed25519 keys which are not allowed in FIPS mode")
+	}
+	ca := generateSigner(t)
+	thresholdCA := generateSigner(t)
+	key := generateSigner(t).PublicKey()
+	caPublicKey := string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+	thresholdCAPublicKey := string(ssh.MarshalAuthorizedKey(thresholdCA.PublicKey()))
+	conf := Config{TeamName: "team.ssh.staging", CAPublicKey: caPublicKey, ThresholdTeams: []string{"team.ssh.prod"},
+		ThresholdCAPublicKey: thresholdCAPublicKey}
+
+	// Certificates that include a threshold team must be signed by the threshold CA key
+	signedKey := signCert(t, thresholdCA, key, ssh.UserCert, []string{"team.ssh.staging", "team.ssh.prod"})
+	require.Equal(t, thresholdCAPublicKey, expectedCAKeyForCertificate(conf, caPublicKey, signedKey))
+	signedKey = signCert(t, ca, key, ssh.UserCert, []string{"team.ssh.staging", "team.ssh.prod"})
+	_, err := VerifySignedKey("cabot", expectedCAKeyForCertificate(conf, caPublicKey, signedKey),
+		string(ssh.MarshalAuthorizedKey(key)), signedKey, []string{"team.ssh.staging", "team.ssh.prod"})
+	require.Error(t, err)
+
+	signedKey = signCert(t, ca, key, ssh.UserCert, []string{"team.ssh.staging"})
+	require.Equal(t, caPublicKey, expectedCAKeyForCertificate(conf, caPublicKey, signedKey))
+	require.Equal(t, caPublicKey, expectedCAKeyForCertificate(Config{CAPublicKey: caPublicKey}, caPublicKey, signedKey))
+
+	// Hosts of a threshold team trust the threshold CA key
+	require.Equal(t, caPublicKey, conf.hostCAKey())
+	conf.TeamName = "team.ssh.prod"
+	require.Equal(t, thresholdCAPublicKey, conf.hostCAKey())
+}
@@ -7,41 +7,166 @@ responds to AckRequests with an AckResponse. Both messages contain the username
 ensure that kssh is reading AckResponses that are meant for it (as opposed to another user of kssh). Then kssh sends
 a SignatureRequest. This is a json object prefix with a specific string. The json object contains the ssh public key
 and a uuid that is used to track the request. keybaseca responds with a signature response that contains the same uuid.
+If keybaseca requires step-up authentication, it first responds with a SignatureChallenge (with the same uuid) that
+tells the user where to log in to the identity provider and only sends the signature response once they have done so.
+If keybaseca refuses the request due to policy, it responds with a SignatureDenial (with the same uuid) that says why.
+Instead of reading the config of every team it is in, kssh can also send a ConfigRequest to a discovery team that CA
+bots listen in. Each bot responds to the user directly with a ConfigResponse containing the configs of the user's teams.
 */
 
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"strings"
+	"time"
 )
 
 // The body of signature request messages sent over KB chat
 type SignatureRequest struct {
 	SSHPublicKey string `json:"ssh_public_key"`
 	UUID         string `json:"uuid"`
-	Username     string `json:"-"`
-	DeviceName   string `json:"-"`
+	// A random value that is unique to this request. Used by keybaseca to reject replayed requests.
+	Nonce string `json:"nonce,omitempty"`
+	// When the request was created in seconds since the unix epoch. Used by keybaseca to reject stale requests.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Whether to request an elevated certificate (see `kssh --elevate`)
+	Elevate    bool   `json:"elevate,omitempty"`
+	Username   string `json:"-"`
+	DeviceName string `json:"-"`
+	// When keybaseca received the request. Used as the reference time for the timestamp since step-up
+	// authentication may delay processing the request.
+	ReceivedAt time.Time `json:"-"`
+	// The signature algorithms (eg SigAlgoRSASHA512) that the destination server accepts in order of preference. Only
+	// used if the CA key is an RSA key. Empty if kssh does not know what the server accepts.
+	SignatureAlgorithms []string `json:"signature_algorithms,omitempty"`
+	// Custom certificate extensions (eg groups@acme.com=dba) that kssh asks to be included in the certificate. Maps
+	// from the name to the value. keybaseca only includes the extensions allowed for the user's teams (see
+	// ALLOWED_EXTENSIONS).
+	Extensions map[string]string `json:"extensions,omitempty"`
 }
 
 // The preamble used at the start of signature request messages
 const SignatureRequestPreamble = "Signature_Request:"
 
-// Parse the given string as a serialized SignatureRequest
+// Limits on the signature requests that keybaseca accepts. Anyone in a configured team can send a signature request
+// so keybaseca checks requests against these before doing anything else with them. kssh never sends requests that
+// come anywhere close to them.
+const (
+	// The longest signature request message, including the preamble
+	MaxSignatureRequestSize = 32 * 1024
+	// The longest public key in authorized_keys format. A 16384 bit RSA key is about 2800 bytes.
+	maxRequestPublicKeyLength = 8 * 1024
+	// The longest UUID or nonce. kssh sends UUIDs, which are 36 characters.
+	maxRequestIDLength = 64
+	// The most signature algorithms that may be requested
+	maxRequestedSignatureAlgorithms = 8
+	// The most custom extensions that may be requested (see `kssh --extension`)
+	MaxRequestedExtensions = 32
+)
+
+// Parse the given string as a serialized SignatureRequest. The message comes from chat so it is parsed strictly: the
+// request must be a single JSON object that is no larger than MaxSignatureRequestSize and passes Validate. Unknown
+// fields are ignored (the size limit still applies to them) so that a newer kssh can talk to an older keybaseca; the
+// fields that keybaseca does use are checked by Validate.
 func ParseSignatureRequest(body string) (SignatureRequest, error) {
 	if !strings.HasPrefix(body, SignatureRequestPreamble) {
 		return SignatureRequest{}, fmt.Errorf("ParseSignatureRequest called on a body without a preamble")
 	}
+	if len(body) > MaxSignatureRequestSize {
+		return SignatureRequest{}, fmt.Errorf("the signature request is %d bytes, more than the maximum of %d", len(body), MaxSignatureRequestSize)
+	}
 
-	body = strings.Replace(body, SignatureRequestPreamble, "", 1)
+	decoder := json.NewDecoder(strings.NewReader(strings.TrimPrefix(body, SignatureRequestPreamble)))
 	var sr SignatureRequest
-	err := json.Unmarshal([]byte(body), &sr)
-	return sr, err
+	err := decoder.Decode(&sr)
+	if err != nil {
+		return SignatureRequest{}, fmt.Errorf("failed to parse the signature request: %v", err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return SignatureRequest{}, fmt.Errorf("failed to parse the signature request: unexpected data after the request")
+	}
+	err = sr.Validate()
+	if err != nil {
+		return SignatureRequest{}, err
+	}
+	return sr, nil
+}
+
+// Validate checks that the fields of a signature request are well formed and within the limits above. It does not
+// check whether the request may be signed (eg whether the public key is of an allowed type).
+func (sr SignatureRequest) Validate() error {
+	if !isRequestID(sr.UUID) {
+		return fmt.Errorf("the signature request does not have a valid uuid")
+	}
+	if sr.Nonce != "" && !isRequestID(sr.Nonce) {
+		return fmt.Errorf("the signature request does not have a valid nonce")
+	}
+	if sr.Timestamp < 0 {
+		return fmt.Errorf("the signature request has a negative timestamp")
+	}
+	if len(sr.SSHPublicKey) > maxRequestPublicKeyLength {
+		return fmt.Errorf("the public key in the signature request is longer than %d bytes", maxRequestPublicKeyLength)
+	}
+	// kssh sends the contents of the public key file, which ends with a newline
+	if !isPrintableASCII(strings.TrimRight(sr.SSHPublicKey, "\r\n")) {
+		return fmt.Errorf("the public key in the signature request contains an invalid character")
+	}
+	if len(sr.SignatureAlgorithms) > maxRequestedSignatureAlgorithms {
+		return fmt.Errorf("the signature request contains more than %d signature algorithms", maxRequestedSignatureAlgorithms)
+	}
+	for _, algorithm := range sr.SignatureAlgorithms {
+		switch algorithm {
+		case SigAlgoRSASHA512, SigAlgoRSASHA256, SigAlgoRSA:
+		default:
+			return fmt.Errorf("the signature request contains an unknown signature algorithm")
+		}
+	}
+	if len(sr.Extensions) > MaxRequestedExtensions {
+		return fmt.Errorf("the signature request contains more than %d extensions", MaxRequestedExtensions)
+	}
+	for name, value := range sr.Extensions {
+		// Whether the extensions may be requested is checked when the request is processed so that the user is told
+		// which extensions were denied
+		if name == "" || len(name) > MaxExtensionNameLength || len(value) > MaxExtensionValueLength ||
+			!isPrintableASCII(name) || !isPrintableASCII(value) {
+			return fmt.Errorf("the signature request contains an invalid extension")
+		}
+	}
+	return nil
+}
+
+// Returns whether s is a valid UUID or nonce: a non-empty string of at most maxRequestIDLength letters, digits, dashes,
+// and underscores
+func isRequestID(s string) bool {
+	if s == "" || len(s) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range s {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether s only contains printable ASCII characters (including spaces)
+func isPrintableASCII(s string) bool {
+	for _, r := range s {
+		if r < ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
 }
 
 // The body of signature response messages sent over KB chat
 type SignatureResponse struct {
 	SignedKey string `json:"signed_key"`
 	UUID      string `json:"uuid"`
+	// The unix usernames that were included as principals in addition to the user's teams (see
+	// USERNAME_PRINCIPAL_TEAMS)
+	UsernamePrincipals []string `json:"username_principals,omitempty"`
 }
 
 // The preamble used at the start of signature response messages
@@ -59,6 +184,85 @@ func ParseSignatureResponse(body string) (SignatureResponse, error) {
 	return sr, err
 }
 
+// The body of signature challenge messages sent over KB chat. The user must log in to the identity provider at
+// VerificationURI with UserCode (or at VerificationURIComplete which includes the code) before the CA signs the request.
+type SignatureChallenge struct {
+	UUID                    string `json:"uuid"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	UserCode                string `json:"user_code"`
+	// The number of seconds until the challenge expires
+	ExpiresIn int `json:"expires_in"`
+}
+
+// The preamble used at the start of signature challenge messages
+const SignatureChallengePreamble = "Signature_Challenge:"
+
+// Parse the given string as a serialized SignatureChallenge
+func ParseSignatureChallenge(body string) (SignatureChallenge, error) {
+	if !strings.HasPrefix(body, SignatureChallengePreamble) {
+		return SignatureChallenge{}, fmt.Errorf("ParseSignatureChallenge called on a body without a preamble")
+	}
+
+	body = strings.Replace(body, SignatureChallengePreamble, "", 1)
+	var sc SignatureChallenge
+	err := json.Unmarshal([]byte(body), &sc)
+	return sc, err
+}
+
+// The body of signature denial messages sent over KB chat when keybaseca refuses a signature request due to policy.
+// Code is one of the Denial* constants so that kssh can tell the user what to do next. Reason is a human readable
+// description of why the request was denied.
+type SignatureDenial struct {
+	UUID   string `json:"uuid"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// The codes used in SignatureDenial messages. kssh treats an unknown code like DenialOther so that new codes can be
+// added without breaking older versions of kssh.
+const (
+	// The CA is in lockdown (see `keybaseca lockdown`)
+	DenialLockdown = "lockdown"
+	// The user is not in any of the teams that the CA is configured for
+	DenialNotInTeam = "not_in_team"
+	// The user is in a configured team but may not receive certificates for it (see TEAM_ALLOWED_USERS)
+	DenialTeamNotAllowed = "team_not_allowed"
+	// The user asked for an elevated certificate but is not in a team that may request one
+	DenialElevationNotAllowed = "elevation_not_allowed"
+	// The request timestamp is too far from the CA's clock (see REQUEST_MAX_SKEW)
+	DenialClockSkew = "clock_skew"
+	// The request was replayed
+	DenialReplay = "replay"
+	// The request was sent by a version of kssh that is too old
+	DenialOutdatedClient = "outdated_client"
+	// The user did not approve the Duo push
+	DenialApprovalDenied = "approval_denied"
+	// The user did not complete step-up authentication with the identity provider
+	DenialStepUpFailed = "step_up_failed"
+	// The CA could not look up the user's groups or unix username
+	DenialLookupFailed = "lookup_failed"
+	// The public key may not be signed (eg a key type that is not allowed in FIPS mode)
+	DenialKeyRejected = "key_rejected"
+	// Any other policy
+	DenialOther = "other"
+)
+
+// The preamble used at the start of signature denial messages
+const SignatureDenialPreamble = "Signature_Denied:"
+
+// Parse the given string as a serialized SignatureDenial
+func ParseSignatureDenial(body string) (SignatureDenial, error) {
+	if !strings.HasPrefix(body, SignatureDenialPreamble) {
+		return SignatureDenial{}, fmt.Errorf("ParseSignatureDenial called on a body without a preamble")
+	}
+
+	body = strings.Replace(body, SignatureDenialPreamble, "", 1)
+	var sd SignatureDenial
+	err := json.Unmarshal([]byte(body), &sd)
+	return sd, err
+}
+
 const AckRequestPrefix = "AckRequest--"
 
 // Generate an AckRequest for the given username
@@ -100,3 +304,41 @@ func GeneratePingResponse(username string) string {
 func IsPingResponse(msg, localUsername string) bool {
 	return strings.TrimSpace(msg) == GeneratePingResponse(localUsername)
 }
+
+// The prefix of config requests. kssh sends a config request (containing the username of the kssh user) to a
+// discovery channel that CA bots listen in (see DISCOVERY_CHANNEL) rather than reading the config of every team it is
+// in.
+const ConfigRequestPrefix = "ConfigRequest--"
+
+// Generate a ConfigRequest for the given username
+func GenerateConfigRequest(username string) string {
+	return ConfigRequestPrefix + username
+}
+
+// Returns whether the given message is a config request
+func IsConfigRequest(msg string) bool {
+	return strings.HasPrefix(msg, ConfigRequestPrefix)
+}
+
+// The body of config response messages that CA bots send directly to the user that sent a config request
+type ConfigResponse struct {
+	// The user that sent the config request
+	Username string `json:"username"`
+	// The kssh configs (as stored in the KV store) of the teams the user is in that the bot serves
+	Configs []json.RawMessage `json:"configs"`
+}
+
+// The preamble used at the start of config response messages
+const ConfigResponsePreamble = "Config_Response:"
+
+// Parse the given string as a serialized ConfigResponse
+func ParseConfigResponse(body string) (ConfigResponse, error) {
+	if !strings.HasPrefix(body, ConfigResponsePreamble) {
+		return ConfigResponse{}, fmt.Errorf("ParseConfigResponse called on a body without a preamble")
+	}
+
+	body = strings.Replace(body, ConfigResponsePreamble, "", 1)
+	var cr ConfigResponse
+	err := json.Unmarshal([]byte(body), &cr)
+	return cr, err
+}
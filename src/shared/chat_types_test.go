@@ -0,0 +1,133 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testRequestPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIO8rconZma4eLadDyrR5nFOoXDdY6lAEMclsFvId8E3l alice@laptop\n"
+
+func TestParseSignatureRequest(t *testing.T) {
+	valid := SignatureRequest{
+		SSHPublicKey:        testRequestPublicKey,
+		UUID:                "0b1c6e3a-3c1c-4b8e-9d4e-2f0c6f1d8a7b",
+		Nonce:               "5f8c0e2a-6f0d-4f4e-8a57-0c8d9f3b1e2d",
+		Timestamp:           1700000000,
+		Elevate:             true,
+		SignatureAlgorithms: []string{SigAlgoRSASHA512, SigAlgoRSASHA256},
+		Extensions:          map[string]string{"groups@acme.com": "dba", "login@acme.com": ""},
+	}
+	bytes, err := json.Marshal(valid)
+	require.NoError(t, err)
+	sr, err := ParseSignatureRequest(SignatureRequestPreamble + string(bytes))
+	require.NoError(t, err)
+	require.Equal(t, valid, sr)
+
+	for name, body := range map[string]string{
+		"no preamble":      string(bytes),
+		"not json":         "not json",
+		"not an object":    `["uuid"]`,
+		"null":             "null",
+		"missing uuid":     `{"ssh_public_key": "ssh-ed25519 AAAA"}`,
+		"trailing data":    `{"uuid": "abc"} {"uuid": "def"}`,
+		"wrong type":       `{"uuid": 1}`,
+		"invalid uuid":     `{"uuid": "abc\n"}`,
+		"long uuid":        `{"uuid": "` + strings.Repeat("a", maxRequestIDLength+1) + `"}`,
+		"invalid nonce":    `{"uuid": "abc", "nonce": "a b"}`,
+		"negative time":    `{"uuid": "abc", "timestamp": -1}`,
+		"multi-line key":   `{"uuid": "abc", "ssh_public_key": "ssh-ed25519 AAAA\nssh-ed25519 BBBB"}`,
+		"long key":         `{"uuid": "abc", "ssh_public_key": "ssh-rsa ` + strings.Repeat("A", maxRequestPublicKeyLength) + `"}`,
+		"unknown algo":     `{"uuid": "abc", "signature_algorithms": ["ssh-ed25519"]}`,
+		"too many algos":   `{"uuid": "abc", "signature_algorithms": ["` + strings.Repeat(`rsa-sha2-512", "`, maxRequestedSignatureAlgorithms) + `rsa-sha2-512"]}`,
+		"invalid ext":      `{"uuid": "abc", "extensions": {"groups@acme.com": "dba\u0000"}}`,
+		"long ext value":   `{"uuid": "abc", "extensions": {"groups@acme.com": "` + strings.Repeat("a", MaxExtensionValueLength+1) + `"}}`,
+		"too large":        `{"uuid": "abc", "ssh_public_key": "` + strings.Repeat(" ", MaxSignatureRequestSize) + `"}`,
+		"too many exts":    `{"uuid": "abc", "extensions": {` + manyExtensions(MaxRequestedExtensions+1) + `}}`,
+		"empty ext name":   `{"uuid": "abc", "extensions": {"": "dba"}}`,
+		"invalid ext name": `{"uuid": "abc", "extensions": {"groups@acme.com\t": "dba"}}`,
+	} {
+		if name != "no preamble" {
+			body = SignatureRequestPreamble + body
+		}
+		_, err := ParseSignatureRequest(body)
+		require.Error(t, err, name)
+	}
+
+	// Whether an extension may be requested is checked when the request is processed so that the user is told about it
+	sr, err = ParseSignatureRequest(SignatureRequestPreamble + `{"uuid": "abc", "extensions": {"` + SudoExtension + `": "", "permit-pty": ""}}`)
+	require.NoError(t, err)
+	require.Len(t, sr.Extensions, 2)
+	_, err = ParseSignatureRequest(SignatureRequestPreamble + `{"uuid": "abc", "extensions": {` + manyExtensions(MaxRequestedExtensions) + `}}`)
+	require.NoError(t, err)
+
+	// Unknown fields (eg from a newer kssh) are ignored, including ones that match fields that are not read from chat
+	sr, err = ParseSignatureRequest(SignatureRequestPreamble + `{"uuid": "abc", "principals": "root", "Username": "root", "future": {"a": [1]}}`)
+	require.NoError(t, err)
+	require.Equal(t, SignatureRequest{UUID: "abc"}, sr)
+	_, err = ParseSignatureRequest(SignatureRequestPreamble + `{"uuid": "abc", "future": "` + strings.Repeat("a", MaxSignatureRequestSize) + `"}`)
+	require.Error(t, err)
+}
+
+func manyExtensions(count int) string {
+	var extensions []string
+	for i := 0; i < count; i++ {
+		extensions = append(extensions, fmt.Sprintf(`"ext%d@acme.com": "value"`, i))
+	}
+	return strings.Join(extensions, ", ")
+}
+
+// Parses randomly mutated signature requests to check that the parser never panics and that everything it accepts is
+// within the limits. See fuzz.go for running the parser under go-fuzz.
+func TestFuzzParseSignatureRequest(t *testing.T) {
+	seeds := []string{
+		SignatureRequestPreamble + `{"ssh_public_key": "` + strings.TrimSpace(testRequestPublicKey) + `", "uuid": "abc", "nonce": "def", "timestamp": 1700000000}`,
+		SignatureRequestPreamble + `{"uuid": "abc", "elevate": true, "signature_algorithms": ["rsa-sha2-512"], "extensions": {"groups@acme.com": "dba"}}`,
+	}
+	// A fixed seed so that failures can be reproduced
+	random := rand.New(rand.NewSource(1))
+	tokens := []string{"{", "}", "[", "]", `"`, `\`, `\u0000`, ",", ":", "null", "true", "-1", "1e400", "\n", "\xff", "uuid",
+		"extensions", "signature_algorithms", strings.Repeat("A", 1024)}
+	for i := 0; i < 20000; i++ {
+		input := []byte(seeds[random.Intn(len(seeds))])
+		for mutations := random.Intn(8) + 1; mutations > 0; mutations-- {
+			position := len(SignatureRequestPreamble) + random.Intn(len(input)-len(SignatureRequestPreamble)+1)
+			switch random.Intn(4) {
+			case 0:
+				// Insert a token
+				token := tokens[random.Intn(len(tokens))]
+				input = append(input[:position], append([]byte(token), input[position:]...)...)
+			case 1:
+				// Delete a range
+				end := position + random.Intn(16)
+				if end > len(input) {
+					end = len(input)
+				}
+				input = append(input[:position], input[end:]...)
+			case 2:
+				// Replace a byte
+				if position < len(input) {
+					input[position] = byte(random.Intn(256))
+				}
+			case 3:
+				// Duplicate a range
+				end := position + random.Intn(64)
+				if end > len(input) {
+					end = len(input)
+				}
+				input = append(input[:end], append(append([]byte{}, input[position:end]...), input[end:]...)...)
+			}
+		}
+		sr, err := ParseSignatureRequest(string(input))
+		if err != nil {
+			continue
+		}
+		require.NoError(t, sr.Validate(), string(input))
+		require.True(t, len(input) <= MaxSignatureRequestSize)
+		require.Empty(t, sr.Username)
+	}
+}
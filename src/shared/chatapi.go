@@ -0,0 +1,76 @@
+package shared
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/keybase/go-keybase-chat-bot/kbchat"
+	"github.com/keybase/go-keybase-chat-bot/kbchat/types/chat1"
+)
+
+// The shortest and longest lifetimes that Keybase allows for exploding messages
+const (
+	MinExplodingLifetime = 30 * time.Second
+	MaxExplodingLifetime = 7 * 24 * time.Hour
+)
+
+// RunChatAPI calls the given method of `keybase chat api` with the given options and decodes the result into result
+// (which may be nil). It is used for the parts of the chat API that kbchat does not support.
+func RunChatAPI(api *kbchat.API, method string, options map[string]interface{}, result interface{}) error {
+	request, err := json.Marshal(map[string]interface{}{
+		"method": method,
+		"params": map[string]interface{}{"options": options},
+	})
+	if err != nil {
+		return err
+	}
+	output, err := api.Command("chat", "api", "-m", string(request)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s (%v)", RedactOutput(output), err)
+	}
+	var resp struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	err = json.Unmarshal(output, &resp)
+	if err != nil {
+		return fmt.Errorf("failed to parse the response to %s: %v", method, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s", resp.Error.Message)
+	}
+	if result != nil && len(resp.Result) > 0 {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// FormatExplodingLifetime formats the given lifetime the way that `keybase chat api` expects it
+func FormatExplodingLifetime(lifetime time.Duration) string {
+	return fmt.Sprintf("%ds", int64(lifetime/time.Second))
+}
+
+// SendExplodingMessage sends a text message that is deleted by Keybase once the given lifetime has passed. destination
+// holds the options that select the conversation (eg conversation_id or channel) in the format used by
+// `keybase chat api`. Returns the ID of the sent message.
+func SendExplodingMessage(api *kbchat.API, destination map[string]interface{}, body string, lifetime time.Duration) (chat1.MessageID, error) {
+	options := map[string]interface{}{
+		"message":            map[string]string{"body": body},
+		"exploding_lifetime": FormatExplodingLifetime(lifetime),
+	}
+	for key, value := range destination {
+		options[key] = value
+	}
+	var result chat1.SendRes
+	err := RunChatAPI(api, "send", options, &result)
+	if err != nil {
+		return 0, err
+	}
+	if result.MessageID == nil {
+		return 0, nil
+	}
+	return *result.MessageID, nil
+}
@@ -5,3 +5,39 @@ const SSHCANamespace = "__sshca"
 
 // The name of the KV store entry key for the kssh client config
 const SSHCAConfigKey = "kssh_config"
+
+// The certificate extension that marks a certificate as permitting sudo via keybaseca-sudo-verify
+const SudoExtension = "permit-sudo@keybase.io"
+
+// The certificate extension that carries the SHA256 hash of the signature request that the certificate was issued for
+// (see CanonicalizeSignatureRequest). The full request is kept in the ISSUANCE_STORE.
+const RequestHashExtension = "request-sha256@keybase.io"
+
+// The signature algorithms that an RSA CA key can sign certificates with. Servers running OpenSSH older than 7.2 only
+// accept SigAlgoRSA while OpenSSH 8.8 and newer reject it by default.
+const (
+	SigAlgoRSASHA512 = "rsa-sha2-512"
+	SigAlgoRSASHA256 = "rsa-sha2-256"
+	SigAlgoRSA       = "ssh-rsa"
+)
+
+// The most principals that OpenSSH accepts in a certificate (SSHKEY_CERT_MAX_PRINCIPALS). ssh-keygen refuses to sign
+// a certificate with more and sshd rejects one with more without saying why.
+const CertMaxPrincipals = 256
+
+// The certificate extension that carries the certificate of the intermediate CA key that signed a user certificate
+// (see INTERMEDIATE_CERT_LOCATION) so that servers and kssh can check it against the offline root CA key
+const IntermediateExtension = "intermediate-ca@keybase.io"
+
+// The critical option that marks a certificate as an intermediate CA certificate. sshd rejects certificates with
+// critical options that it does not know so an intermediate certificate can never be used to log in.
+const IntermediateCriticalOption = "intermediate-ca@keybase.io"
+
+// The kssh behaviors that keybaseca can roll out gradually to a percentage of users (see KSSH_FEATURE_FLAGS)
+const (
+	// Generate keys in memory and only load them into the ssh-agent, as if kssh was always run with --no-disk
+	FeatureNoDisk = "no-disk"
+)
+
+// The features that may be named in KSSH_FEATURE_FLAGS
+var KnownFeatures = []string{FeatureNoDisk}
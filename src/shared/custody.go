@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+)
+
+// The canonical form of a signature request. Unlike the request sent by kssh it includes who sent it, since that is
+// as much a part of the request as its contents.
+type canonicalSignatureRequest struct {
+	SignatureRequest
+	Username   string `json:"username"`
+	DeviceName string `json:"device_name"`
+}
+
+// CanonicalizeSignatureRequest returns the canonical JSON serialization of the given signature request (as received
+// by keybaseca, including the user and device that sent it) along with its hex encoded SHA256 hash. The hash is
+// embedded in the issued certificate (see RequestHashExtension) so that any certificate can be tied back to the exact
+// request it was issued for. The serialization only depends on the contents of the request: fields are in a fixed
+// order, maps are sorted by key, and the public key is trimmed.
+func CanonicalizeSignatureRequest(sr SignatureRequest) (canonical string, hash string, err error) {
+	sr.SSHPublicKey = strings.TrimSpace(sr.SSHPublicKey)
+	encoded, err := json.Marshal(canonicalSignatureRequest{SignatureRequest: sr, Username: sr.Username, DeviceName: sr.DeviceName})
+	if err != nil {
+		return "", "", err
+	}
+	return string(encoded), HashCanonicalSignatureRequest(string(encoded)), nil
+}
+
+// HashCanonicalSignatureRequest returns the hash of a canonical signature request as returned by
+// CanonicalizeSignatureRequest. Used to check that a stored request matches the hash in a certificate.
+func HashCanonicalSignatureRequest(canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	return hex.EncodeToString(sum[:])
+}
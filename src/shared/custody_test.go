@@ -0,0 +1,28 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalizeSignatureRequest(t *testing.T) {
+	sr := SignatureRequest{SSHPublicKey: "ssh-ed25519 AAAA alice@laptop\n", UUID: "uuid", Nonce: "nonce", Timestamp: 1600000000,
+		Username: "alice", DeviceName: "laptop", Extensions: map[string]string{"b@acme.com": "2", "a@acme.com": "1"}}
+	canonical, hash, err := CanonicalizeSignatureRequest(sr)
+	require.NoError(t, err)
+	require.Equal(t, `{"ssh_public_key":"ssh-ed25519 AAAA alice@laptop","uuid":"uuid","nonce":"nonce","timestamp":1600000000,`+
+		`"extensions":{"a@acme.com":"1","b@acme.com":"2"},"username":"alice","device_name":"laptop"}`, canonical)
+	require.Equal(t, HashCanonicalSignatureRequest(canonical), hash)
+	require.Len(t, hash, 64)
+
+	// The hash only depends on the contents of the request
+	sr.SSHPublicKey = "ssh-ed25519 AAAA alice@laptop"
+	_, same, err := CanonicalizeSignatureRequest(sr)
+	require.NoError(t, err)
+	require.Equal(t, hash, same)
+	sr.DeviceName = "phone"
+	_, other, err := CanonicalizeSignatureRequest(sr)
+	require.NoError(t, err)
+	require.NotEqual(t, hash, other)
+}
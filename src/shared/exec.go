@@ -0,0 +1,111 @@
+package shared
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Environment variables that are passed through to the binaries spawned via Command. Everything else (eg
+// LD_PRELOAD or DYLD_INSERT_LIBRARIES) is dropped so that the environment kssh or keybaseca was started with cannot
+// change what code those binaries run.
+var passthroughEnvVars = map[string]bool{
+	"HOME": true, "USER": true, "LOGNAME": true, "LANG": true, "TZ": true, "TMPDIR": true, "TERM": true,
+	"DISPLAY": true, "DBUS_SESSION_BUS_ADDRESS": true,
+	// Needed by the keybase binary on Windows
+	"SYSTEMROOT": true, "SYSTEMDRIVE": true, "WINDIR": true, "APPDATA": true, "LOCALAPPDATA": true,
+	"USERPROFILE": true, "PROGRAMDATA": true, "TEMP": true, "TMP": true, "COMSPEC": true, "PATHEXT": true,
+}
+
+// Prefixes of environment variables that are passed through to the binaries spawned via Command
+var passthroughEnvPrefixes = []string{"LC_", "XDG_", "KEYBASE_"}
+
+// ScrubPath removes the entries of the given $PATH that are empty or relative (eg "." or "bin"). These are resolved
+// against the current directory, so anyone who can write to the directory that a command is run from could shadow
+// the real binaries.
+func ScrubPath(path string) string {
+	var dirs []string
+	for _, dir := range filepath.SplitList(path) {
+		if dir != "" && filepath.IsAbs(dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return strings.Join(dirs, string(os.PathListSeparator))
+}
+
+// ScrubbedEnv returns the environment to run spawned binaries with: the current environment restricted to a known
+// set of variables, with a scrubbed $PATH (see ScrubPath)
+func ScrubbedEnv() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name := parts[0]
+		if runtime.GOOS == "windows" {
+			name = strings.ToUpper(name)
+		}
+		if name == "PATH" {
+			env = append(env, parts[0]+"="+ScrubPath(parts[1]))
+			continue
+		}
+		if passthroughEnvVars[name] {
+			env = append(env, kv)
+			continue
+		}
+		for _, prefix := range passthroughEnvPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	return env
+}
+
+// LookPath is like exec.LookPath but only searches the absolute directories in $PATH (see ScrubPath). Names that
+// contain a path separator are returned as is.
+func LookPath(file string) (string, error) {
+	if strings.ContainsRune(file, '/') || strings.ContainsRune(file, filepath.Separator) {
+		return file, nil
+	}
+	candidates := []string{file}
+	if runtime.GOOS == "windows" {
+		candidates = nil
+		for _, ext := range strings.Split(strings.ToLower(os.Getenv("PATHEXT")), ";") {
+			if ext != "" {
+				candidates = append(candidates, file+ext)
+			}
+		}
+	}
+	for _, dir := range filepath.SplitList(ScrubPath(os.Getenv("PATH"))) {
+		for _, candidate := range candidates {
+			path := filepath.Join(dir, candidate)
+			info, err := os.Stat(path)
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			if runtime.GOOS != "windows" && info.Mode()&0111 == 0 {
+				continue
+			}
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("%s: executable file not found in $PATH", file)
+}
+
+// Command is like exec.Command but resolves the binary via LookPath and runs it with a scrubbed environment (see
+// ScrubbedEnv). Callers that need extra environment variables should append them to the returned command's Env.
+func Command(name string, args ...string) (*exec.Cmd, error) {
+	path, err := LookPath(name)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Env = ScrubbedEnv()
+	return cmd, nil
+}
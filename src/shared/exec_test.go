@@ -0,0 +1,70 @@
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrubPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses unix paths")
+	}
+	require.Equal(t, "/usr/local/bin:/usr/bin", ScrubPath(".:/usr/local/bin::bin:/usr/bin:"))
+	require.Equal(t, "", ScrubPath("."))
+}
+
+func TestScrubbedEnv(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses unix paths")
+	}
+	for name, value := range map[string]string{"LD_PRELOAD": "/tmp/evil.so", "KEYBASE_RUN_MODE": "prod", "PATH": ".:/usr/bin"} {
+		old, set := os.LookupEnv(name)
+		require.NoError(t, os.Setenv(name, value))
+		if set {
+			defer os.Setenv(name, old)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+	env := ScrubbedEnv()
+	require.Contains(t, env, "KEYBASE_RUN_MODE=prod")
+	require.Contains(t, env, "PATH=/usr/bin")
+	for _, kv := range env {
+		require.False(t, strings.HasPrefix(kv, "LD_PRELOAD="))
+	}
+}
+
+func TestLookPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses unix permissions")
+	}
+	dir, err := ioutil.TempDir("", "shared-exec")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "keybase"), []byte("#!/bin/sh\n"), 0755))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notexecutable"), []byte(""), 0644))
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+	require.NoError(t, os.Setenv("PATH", dir))
+	path, err := LookPath("keybase")
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "keybase"), path)
+	_, err = LookPath("notexecutable")
+	require.Error(t, err)
+
+	// Relative entries in $PATH are never searched
+	oldWd, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(oldWd)
+	require.NoError(t, os.Chdir(dir))
+	require.NoError(t, os.Setenv("PATH", "."))
+	_, err = LookPath("keybase")
+	require.Error(t, err)
+}
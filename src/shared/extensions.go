@@ -0,0 +1,54 @@
+package shared
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// The longest name and value of a custom certificate extension that kssh may request
+const (
+	MaxExtensionNameLength  = 128
+	MaxExtensionValueLength = 256
+)
+
+// ParseExtension parses a custom certificate extension of the form name=value (eg groups@acme.com=dba). The value may
+// be empty (eg login@acme.com).
+func ParseExtension(extension string) (name, value string, err error) {
+	parts := strings.SplitN(extension, "=", 2)
+	name = parts[0]
+	if len(parts) == 2 {
+		value = parts[1]
+	}
+	return name, value, ValidateExtension(name, value)
+}
+
+// ValidateExtension checks that the given certificate extension may be requested by kssh. Only custom extensions
+// (which must be of the form name@domain per the OpenSSH certificate protocol) are allowed so that kssh cannot request
+// the standard extensions such as permit-pty or the extension that permits sudo (see SudoExtension).
+func ValidateExtension(name, value string) error {
+	at := strings.Index(name, "@")
+	if at <= 0 || at == len(name)-1 || strings.Count(name, "@") != 1 {
+		return fmt.Errorf("'%s' is not a custom extension, custom extensions must be of the form name@domain", name)
+	}
+	if len(name) > MaxExtensionNameLength {
+		return fmt.Errorf("the extension name '%s' is longer than %d characters", name, MaxExtensionNameLength)
+	}
+	if name == SudoExtension {
+		return fmt.Errorf("the %s extension cannot be requested", SudoExtension)
+	}
+	for _, r := range name {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) || unicode.IsSpace(r) || r == '=' || r == ',' {
+			return fmt.Errorf("the extension name '%s' contains an invalid character", name)
+		}
+	}
+	if len(value) > MaxExtensionValueLength {
+		return fmt.Errorf("the value of the extension %s is longer than %d characters", name, MaxExtensionValueLength)
+	}
+	for _, r := range value {
+		if r > unicode.MaxASCII || !unicode.IsPrint(r) {
+			return fmt.Errorf("the value of the extension %s contains an invalid character", name)
+		}
+	}
+	return nil
+}
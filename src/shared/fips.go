@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"crypto/rsa"
+	"fmt"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The smallest RSA key size that is allowed in FIPS mode
+const FIPSMinRSAKeySize = 2048
+
+// CheckFIPSKey returns an error if kssh and keybaseca were built in FIPS mode (see FIPSMode) and the given SSH key
+// uses an algorithm that is not FIPS approved. Only RSA keys of at least FIPSMinRSAKeySize bits and ECDSA keys on the
+// NIST curves are approved. In particular ed25519 keys are not. Always returns nil if not in FIPS mode.
+func CheckFIPSKey(key ssh.PublicKey) error {
+	if !FIPSMode {
+		return nil
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	switch key.Type() {
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		return nil
+	case ssh.KeyAlgoRSA:
+		cryptoKey, ok := key.(ssh.CryptoPublicKey)
+		if !ok {
+			return fmt.Errorf("failed to determine the size of the RSA key")
+		}
+		rsaKey, ok := cryptoKey.CryptoPublicKey().(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("failed to determine the size of the RSA key")
+		}
+		if rsaKey.N.BitLen() < FIPSMinRSAKeySize {
+			return fmt.Errorf("%d bit RSA keys are not allowed in FIPS mode, at least %d bits are required", rsaKey.N.BitLen(), FIPSMinRSAKeySize)
+		}
+		return nil
+	default:
+		return fmt.Errorf("%s keys are not allowed in FIPS mode, only RSA and ECDSA keys are", key.Type())
+	}
+}
+
+// IsFIPSSignatureAlgorithm returns whether the given SSH signature algorithm may be used in FIPS mode. ssh-rsa
+// signatures use SHA-1 and so are not allowed. Always returns true if not in FIPS mode.
+func IsFIPSSignatureAlgorithm(algorithm string) bool {
+	return !FIPSMode || algorithm != SigAlgoRSA
+}
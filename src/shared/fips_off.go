@@ -0,0 +1,7 @@
+//go:build !fips
+// +build !fips
+
+package shared
+
+// FIPSMode is whether kssh and keybaseca were built with the fips build tag (see fips_on.go)
+const FIPSMode = false
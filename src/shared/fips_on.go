@@ -0,0 +1,15 @@
+//go:build fips
+// +build fips
+
+package shared
+
+import (
+	// Restricts crypto/tls to FIPS approved settings. This package only exists in BoringCrypto Go toolchains so
+	// building with the fips tag fails with any other toolchain.
+	_ "crypto/tls/fipsonly"
+)
+
+// FIPSMode is whether kssh and keybaseca were built with the fips build tag. In FIPS mode all cryptography (including
+// random number generation) goes through the FIPS validated BoringCrypto module, ed25519 keys are neither generated nor
+// accepted, and SHA-1 (ssh-rsa) signatures are never used.
+const FIPSMode = true
@@ -0,0 +1,48 @@
+package shared
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Returns an RSA public key of the given size. The key is not a valid RSA key but only its size matters here.
+func rsaPublicKeyOfSize(t *testing.T, bits int) ssh.PublicKey {
+	n, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), uint(bits)))
+	require.NoError(t, err)
+	n.SetBit(n, bits-1, 1)
+	key, err := ssh.NewPublicKey(&rsa.PublicKey{N: n, E: 65537})
+	require.NoError(t, err)
+	return key
+}
+
+func TestCheckFIPSKey(t *testing.T) {
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecdsaPublicKey, err := ssh.NewPublicKey(&ecdsaKey.PublicKey)
+	require.NoError(t, err)
+	ed25519Key, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ed25519PublicKey, err := ssh.NewPublicKey(ed25519Key)
+	require.NoError(t, err)
+
+	require.NoError(t, CheckFIPSKey(ecdsaPublicKey))
+	require.NoError(t, CheckFIPSKey(rsaPublicKeyOfSize(t, 2048)))
+	require.True(t, IsFIPSSignatureAlgorithm(SigAlgoRSASHA512))
+	if FIPSMode {
+		require.Error(t, CheckFIPSKey(ed25519PublicKey))
+		require.Error(t, CheckFIPSKey(rsaPublicKeyOfSize(t, 1024)))
+		require.False(t, IsFIPSSignatureAlgorithm(SigAlgoRSA))
+	} else {
+		require.NoError(t, CheckFIPSKey(ed25519PublicKey))
+		require.NoError(t, CheckFIPSKey(rsaPublicKeyOfSize(t, 1024)))
+		require.True(t, IsFIPSSignatureAlgorithm(SigAlgoRSA))
+	}
+}
@@ -0,0 +1,19 @@
+//go:build gofuzz
+// +build gofuzz
+
+package shared
+
+// Fuzz is the entry point for running ParseSignatureRequest under go-fuzz (https://github.com/dvyukov/go-fuzz) since
+// it parses messages that anyone in a configured team can send to keybaseca:
+//
+//	go-fuzz-build github.com/keybase/bot-sshca/src/shared && go-fuzz -bin shared-fuzz.zip -workdir fuzz
+func Fuzz(data []byte) int {
+	sr, err := ParseSignatureRequest(SignatureRequestPreamble + string(data))
+	if err != nil {
+		return 0
+	}
+	if err := sr.Validate(); err != nil {
+		panic("ParseSignatureRequest accepted an invalid request: " + err.Error())
+	}
+	return 1
+}
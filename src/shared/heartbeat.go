@@ -0,0 +1,50 @@
+package shared
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// The number of heartbeats that a CA bot may miss before kssh considers it to be offline
+const HeartbeatMissedIntervals = 3
+
+// HeartbeatPath returns the public KBFS file that the given bot periodically writes a Heartbeat to (see
+// HEARTBEAT_INTERVAL). It is in the bot's public folder so that kssh can read it regardless of which teams the bot is
+// in.
+func HeartbeatPath(botName string) string {
+	return "/keybase/public/" + botName + "/kssh-heartbeat.json"
+}
+
+// A Heartbeat records that a CA bot was running at UpdatedAt. kssh checks it before sending a signature request so
+// that it can fail fast rather than waiting for a response from a bot that is not running.
+type Heartbeat struct {
+	// The unix time of the latest heartbeat
+	UpdatedAt int64 `json:"updated_at"`
+	// The number of seconds between heartbeats
+	Interval int `json:"interval"`
+	// The unix time at which the bot was stopped. Zero if it is running.
+	StoppedAt int64 `json:"stopped_at,omitempty"`
+}
+
+// ParseHeartbeat parses the given serialized Heartbeat
+func ParseHeartbeat(contents string) (Heartbeat, error) {
+	var heartbeat Heartbeat
+	err := json.Unmarshal([]byte(contents), &heartbeat)
+	return heartbeat, err
+}
+
+// OfflineSince returns the time since which the bot that wrote the heartbeat has been offline as of now. ok is false if
+// the bot is presumed to be running.
+func (h Heartbeat) OfflineSince(now time.Time) (since time.Time, ok bool) {
+	if h.StoppedAt != 0 {
+		return time.Unix(h.StoppedAt, 0), true
+	}
+	if h.UpdatedAt == 0 || h.Interval <= 0 {
+		return time.Time{}, false
+	}
+	updatedAt := time.Unix(h.UpdatedAt, 0)
+	if now.Sub(updatedAt) > HeartbeatMissedIntervals*time.Duration(h.Interval)*time.Second {
+		return updatedAt, true
+	}
+	return time.Time{}, false
+}
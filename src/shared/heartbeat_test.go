@@ -0,0 +1,33 @@
+package shared
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatOfflineSince(t *testing.T) {
+	now := time.Unix(10000, 0)
+
+	_, offline := Heartbeat{UpdatedAt: now.Add(-2 * time.Minute).Unix(), Interval: 60}.OfflineSince(now)
+	require.False(t, offline)
+
+	since, offline := Heartbeat{UpdatedAt: now.Add(-4 * time.Minute).Unix(), Interval: 60}.OfflineSince(now)
+	require.True(t, offline)
+	require.Equal(t, now.Add(-4*time.Minute), since)
+
+	since, offline = Heartbeat{UpdatedAt: now.Unix(), Interval: 60, StoppedAt: now.Add(-time.Second).Unix()}.OfflineSince(now)
+	require.True(t, offline)
+	require.Equal(t, now.Add(-time.Second), since)
+
+	// Heartbeats without an interval cannot go stale
+	_, offline = Heartbeat{UpdatedAt: now.Add(-time.Hour).Unix()}.OfflineSince(now)
+	require.False(t, offline)
+
+	heartbeat, err := ParseHeartbeat(`{"updated_at": 100, "interval": 60}`)
+	require.NoError(t, err)
+	require.Equal(t, Heartbeat{UpdatedAt: 100, Interval: 60}, heartbeat)
+	_, err = ParseHeartbeat("not json")
+	require.Error(t, err)
+}
@@ -0,0 +1,111 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseIntermediateCert parses an intermediate CA certificate in authorized_keys format (as written by `keybaseca
+// issue-intermediate`) or as the base64 encoded value of the IntermediateExtension
+func ParseIntermediateCert(encoded string) (*ssh.Certificate, error) {
+	var key ssh.PublicKey
+	blob, err := base64.StdEncoding.DecodeString(encoded)
+	if err == nil {
+		key, err = ssh.ParsePublicKey(blob)
+	} else {
+		key, _, _, _, err = ssh.ParseAuthorizedKey([]byte(encoded))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the intermediate certificate: %v", err)
+	}
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("the intermediate certificate is not a certificate")
+	}
+	if _, ok := cert.CriticalOptions[IntermediateCriticalOption]; !ok {
+		return nil, fmt.Errorf("the certificate %s is not an intermediate CA certificate (it does not have the %s critical option)",
+			cert.KeyId, IntermediateCriticalOption)
+	}
+	return cert, nil
+}
+
+// GetIntermediateCert returns the intermediate CA certificate carried in the IntermediateExtension of the given user
+// certificate or nil if it does not have one
+func GetIntermediateCert(cert *ssh.Certificate) (*ssh.Certificate, error) {
+	encoded, ok := cert.Extensions[IntermediateExtension]
+	if !ok {
+		return nil, nil
+	}
+	return ParseIntermediateCert(encoded)
+}
+
+// EncodeIntermediateCert returns the value of the IntermediateExtension for the given intermediate CA certificate
+func EncodeIntermediateCert(intermediate *ssh.Certificate) string {
+	return base64.StdEncoding.EncodeToString(intermediate.Marshal())
+}
+
+// VerifyIntermediateCert checks that the given intermediate CA certificate was signed by root and is valid at now
+func VerifyIntermediateCert(intermediate *ssh.Certificate, root ssh.PublicKey, now time.Time) error {
+	if !bytes.Equal(intermediate.SignatureKey.Marshal(), root.Marshal()) {
+		return fmt.Errorf("the intermediate certificate %s was signed by %s rather than the root CA key %s",
+			intermediate.KeyId, ssh.FingerprintSHA256(intermediate.SignatureKey), ssh.FingerprintSHA256(root))
+	}
+	checker := ssh.CertChecker{
+		IsUserAuthority:          func(auth ssh.PublicKey) bool { return true },
+		Clock:                    func() time.Time { return now },
+		SupportedCriticalOptions: []string{IntermediateCriticalOption},
+	}
+	principal := ""
+	if len(intermediate.ValidPrincipals) > 0 {
+		principal = intermediate.ValidPrincipals[0]
+	}
+	// CheckCert verifies the signature and the validity period
+	if err := checker.CheckCert(principal, intermediate); err != nil {
+		return fmt.Errorf("the intermediate certificate %s is not valid: %v", intermediate.KeyId, err)
+	}
+	return nil
+}
+
+// IntermediateAllows returns whether the given intermediate CA certificate may issue certificates for principal. The
+// principals of an intermediate certificate are team patterns (see MatchTeam). Unlike sshd, an intermediate
+// certificate without any principals may not issue certificates for any principal.
+func IntermediateAllows(intermediate *ssh.Certificate, principal string) bool {
+	for _, pattern := range intermediate.ValidPrincipals {
+		if MatchTeam(pattern, principal) {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyChain checks that the given user certificate was signed by an intermediate CA key whose certificate (carried
+// in the IntermediateExtension) was signed by root, is valid at now, and allows every principal of the user
+// certificate. The signature of the user certificate itself is not checked. Returns the intermediate certificate.
+func VerifyChain(cert *ssh.Certificate, root ssh.PublicKey, now time.Time) (*ssh.Certificate, error) {
+	intermediate, err := GetIntermediateCert(cert)
+	if err != nil {
+		return nil, err
+	}
+	if intermediate == nil {
+		return nil, fmt.Errorf("the certificate %s was not signed by an intermediate CA key", cert.KeyId)
+	}
+	if !bytes.Equal(intermediate.Key.Marshal(), cert.SignatureKey.Marshal()) {
+		return nil, fmt.Errorf("the certificate %s was signed by %s rather than the intermediate CA key %s", cert.KeyId,
+			ssh.FingerprintSHA256(cert.SignatureKey), ssh.FingerprintSHA256(intermediate.Key))
+	}
+	err = VerifyIntermediateCert(intermediate, root, now)
+	if err != nil {
+		return nil, err
+	}
+	for _, principal := range cert.ValidPrincipals {
+		if !IntermediateAllows(intermediate, principal) {
+			return nil, fmt.Errorf("the intermediate certificate %s does not allow issuing certificates for the principal '%s'",
+				intermediate.KeyId, principal)
+		}
+	}
+	return intermediate, nil
+}
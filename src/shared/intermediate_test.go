@@ -0,0 +1,83 @@
+package shared
+
+import (
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func generateSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(priv)
+	require.NoError(t, err)
+	return signer
+}
+
+func issueCert(t *testing.T, signer ssh.Signer, key ssh.PublicKey, principals []string, criticalOptions, extensions map[string]string, now time.Time) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             key,
+		CertType:        ssh.UserCert,
+		KeyId:           "key-id",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(now.Add(time.Hour).Unix()),
+		Permissions:     ssh.Permissions{CriticalOptions: criticalOptions, Extensions: extensions},
+	}
+	require.NoError(t, cert.SignCert(rand.Reader, signer))
+	return cert
+}
+
+func TestVerifyChain(t *testing.T) {
+	now := time.Now()
+	root := generateSigner(t)
+	ca := generateSigner(t)
+	user := generateSigner(t)
+	intermediate := issueCert(t, root, ca.PublicKey(), []string{"team.ssh.prod", "team.ssh.prod.*"},
+		map[string]string{IntermediateCriticalOption: ""}, nil, now)
+	chain := map[string]string{IntermediateExtension: EncodeIntermediateCert(intermediate)}
+
+	cert := issueCert(t, ca, user.PublicKey(), []string{"team.ssh.prod", "team.ssh.prod.db"}, nil, chain, now)
+	verified, err := VerifyChain(cert, root.PublicKey(), now)
+	require.NoError(t, err)
+	require.Equal(t, intermediate.Marshal(), verified.Marshal())
+
+	// The chain must lead to the given root
+	_, err = VerifyChain(cert, ca.PublicKey(), now)
+	require.Error(t, err)
+	// The intermediate certificate must be valid
+	_, err = VerifyChain(cert, root.PublicKey(), now.Add(2*time.Hour))
+	require.Error(t, err)
+	// Every principal must be allowed by the intermediate certificate
+	cert = issueCert(t, ca, user.PublicKey(), []string{"team.ssh.prod", "team.ssh.staging"}, nil, chain, now)
+	_, err = VerifyChain(cert, root.PublicKey(), now)
+	require.Error(t, err)
+	// The certificate must have been signed by the intermediate CA key
+	cert = issueCert(t, generateSigner(t), user.PublicKey(), []string{"team.ssh.prod"}, nil, chain, now)
+	_, err = VerifyChain(cert, root.PublicKey(), now)
+	require.Error(t, err)
+	// A certificate without the chain
+	cert = issueCert(t, ca, user.PublicKey(), []string{"team.ssh.prod"}, nil, nil, now)
+	_, err = VerifyChain(cert, root.PublicKey(), now)
+	require.Error(t, err)
+
+	// A regular certificate signed by the root cannot be used as an intermediate certificate
+	notIntermediate := issueCert(t, root, ca.PublicKey(), []string{"team.ssh.prod"}, nil, nil, now)
+	chain = map[string]string{IntermediateExtension: EncodeIntermediateCert(notIntermediate)}
+	cert = issueCert(t, ca, user.PublicKey(), []string{"team.ssh.prod"}, nil, chain, now)
+	_, err = VerifyChain(cert, root.PublicKey(), now)
+	require.Error(t, err)
+}
+
+func TestIntermediateAllows(t *testing.T) {
+	intermediate := &ssh.Certificate{ValidPrincipals: []string{"team.ssh.prod", "team.ssh.prod.*", "prod-sudo"}}
+	require.True(t, IntermediateAllows(intermediate, "team.ssh.prod"))
+	require.True(t, IntermediateAllows(intermediate, "team.ssh.prod.db"))
+	require.True(t, IntermediateAllows(intermediate, "prod-sudo"))
+	require.False(t, IntermediateAllows(intermediate, "team.ssh.staging"))
+	require.False(t, IntermediateAllows(&ssh.Certificate{}, "team.ssh.prod"))
+}
@@ -0,0 +1,53 @@
+package shared
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The name of the file in a team's KBFS folder that lists the hosts that members of the team can connect to via kssh
+// (see `keybaseca publish-inventory` and `kssh --list-hosts`)
+const InventoryFilename = "kssh-hosts"
+
+// InventoryPath returns the KBFS path of the hosts inventory for the given team. It is in the team's private folder so
+// that only members of the team can see which hosts it has access to.
+func InventoryPath(teamName string) string {
+	return "/keybase/team/" + teamName + "/" + InventoryFilename
+}
+
+// An InventoryHost is a single host in a team's hosts inventory
+type InventoryHost struct {
+	Host        string `json:"host"`
+	Description string `json:"description,omitempty"`
+}
+
+// Valid inventory hosts. Hosts are used for shell completion and passed to ssh so they must not start with a '-'.
+var inventoryHostRegex = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._:-]{0,252}$`)
+
+// IsValidInventoryHost returns whether the given host may be listed in a hosts inventory
+func IsValidInventoryHost(host string) bool {
+	return inventoryHostRegex.MatchString(host)
+}
+
+// ParseInventory parses a hosts inventory. Each line contains a host optionally followed by whitespace and a
+// description. Blank lines and lines starting with '#' are ignored.
+func ParseInventory(contents string) ([]InventoryHost, error) {
+	var hosts []InventoryHost
+	for i, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if !IsValidInventoryHost(fields[0]) {
+			return nil, fmt.Errorf("line %d of the hosts inventory contains the invalid host %q", i+1, fields[0])
+		}
+		host := InventoryHost{Host: fields[0]}
+		if len(fields) > 1 {
+			host.Description = strings.Join(fields[1:], " ")
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
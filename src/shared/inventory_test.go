@@ -0,0 +1,26 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInventory(t *testing.T) {
+	hosts, err := ParseInventory("# Production\nprod-db.example.com   Primary database\n\n  10.0.0.5\nbastion.example.com Jump host  for prod\n")
+	require.NoError(t, err)
+	require.Equal(t, []InventoryHost{
+		{Host: "prod-db.example.com", Description: "Primary database"},
+		{Host: "10.0.0.5"},
+		{Host: "bastion.example.com", Description: "Jump host for prod"},
+	}, hosts)
+
+	hosts, err = ParseInventory("")
+	require.NoError(t, err)
+	require.Empty(t, hosts)
+
+	for _, contents := range []string{"-oProxyCommand=evil", "server.example.com\nroot@server", "$(whoami)"} {
+		_, err = ParseInventory(contents)
+		require.Error(t, err, contents)
+	}
+}
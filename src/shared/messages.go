@@ -0,0 +1,146 @@
+package shared
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"text/template"
+)
+
+// The IDs of the user facing messages that can be overridden with MESSAGES_FILE. Messages sent by keybaseca start
+// with "bot." and messages shown by kssh start with "kssh.". The kssh messages are published to kssh in its config.
+const (
+	// Sent to a user in a direct message when a certificate is issued to them (see NOTIFY_USERS). Values: Summary
+	MessageCertIssuedUser = "bot.cert_issued_user"
+	// Posted to the security channel when a certificate is issued (see SECURITY_CHANNEL). Values: Username, Summary
+	MessageCertIssuedSecurity = "bot.cert_issued_security"
+	// Sent when a user who is not in ADMINS tries to change the lockdown state. Values: Username
+	MessageLockdownNotAdmin = "bot.lockdown_not_admin"
+	// Announced when lockdown is enabled. Values: ChangedBy
+	MessageLockdownEnabled = "bot.lockdown_enabled"
+	// Announced when lockdown is lifted. Values: ChangedBy
+	MessageLockdownLifted = "bot.lockdown_lifted"
+	// Announced in a team when it is added with `keybaseca add-team`. Values: BotName, Team
+	MessageTeamAdded = "bot.team_added"
+	// Sent to the channel when a message could not be processed. Values: Username, MessageID, Error
+	MessageBotError = "bot.error"
+	// Posted to the security channel (or the chat channel) when a server reports that a canary certificate was used.
+	// Values: Name, KeyID, Host, User
+	MessageCanaryTriggered = "bot.canary_triggered"
+	// The prefix of the IDs of what kssh tells the user to do when the CA denies a request, followed by the Denial*
+	// code. Values: BotName, TeamName
+	MessageDenialPrefix = "kssh.denial."
+)
+
+// DefaultMessages are the messages used unless they are overridden with MESSAGES_FILE. Each message is a text/template
+// that is given the values listed next to its ID.
+var DefaultMessages = map[string]string{
+	MessageCertIssuedUser: "A new SSH certificate was just issued for your account. If you did not just run kssh, tell " +
+		"your security team immediately.\n{{.Summary}}",
+	MessageCertIssuedSecurity: "Issued an SSH certificate to @{{.Username}}\n{{.Summary}}",
+	MessageLockdownNotAdmin:   "@{{.Username}} is not allowed to change the lockdown state",
+	MessageLockdownEnabled: "The SSH CA is in lockdown (enabled by {{.ChangedBy}}). No new certificates will be issued " +
+		"until the lockdown is lifted.",
+	MessageLockdownLifted: "The SSH CA lockdown has been lifted by {{.ChangedBy}}. Certificates are being issued again.",
+	MessageTeamAdded: "Hi! I'm @{{.BotName}}, the SSH CA bot. Members of {{.Team}} can now run kssh to get SSH " +
+		"certificates for its servers. See https://github.com/keybase/bot-sshca for how to install kssh.",
+	MessageBotError: "Encountered error while processing message from {{.Username}} (messageID:{{.MessageID}}): {{.Error}}",
+	MessageCanaryTriggered: "Someone tried to log in to {{.Host}}{{if .User}} as {{.User}}{{end}} with the canary " +
+		"certificate {{.Name}} (keyID:{{.KeyID}}). Wherever it was planted has been compromised.",
+
+	MessageDenialPrefix + DenialLockdown: "The CA is in lockdown and is not issuing certificates. Contact the " +
+		"administrators of {{.BotName}} to find out when it will be lifted.",
+	MessageDenialPrefix + DenialNotInTeam: "You are not in any of the teams that {{.BotName}} issues certificates for. " +
+		"Ask an admin of {{.TeamName}} to add you to the subteam for the servers you need (run `keybase team " +
+		"list-memberships` to see your teams).",
+	MessageDenialPrefix + DenialTeamNotAllowed: "You are in the right teams but the CA does not issue certificates to " +
+		"you for them (see TEAM_ALLOWED_USERS). Ask the administrators of {{.BotName}} to allow you.",
+	MessageDenialPrefix + DenialElevationNotAllowed: "Run kssh again without --elevate, or ask to be added to a team " +
+		"that may request elevated certificates.",
+	MessageDenialPrefix + DenialClockSkew: "Your clock is too far from the CA's. Sync it (eg `sudo timedatectl " +
+		"set-ntp true` or enable automatic time in your system settings) and run kssh again.",
+	MessageDenialPrefix + DenialReplay: "Run kssh again. If this keeps happening, report it to the administrators of " +
+		"the CA since something may be resending your requests.",
+	MessageDenialPrefix + DenialOutdatedClient: "Your version of kssh is too old for this CA. Run `kssh --self-update` " +
+		"and try again.",
+	MessageDenialPrefix + DenialApprovalDenied: "Run kssh again and approve the Duo push that is sent to your device.",
+	MessageDenialPrefix + DenialStepUpFailed: "Run kssh again and log in to the identity provider with the account " +
+		"that is linked to your Keybase user.",
+	MessageDenialPrefix + DenialLookupFailed: "The CA could not look up your account in its directory. This is " +
+		"usually temporary so try again in a few minutes and contact the administrators of {{.BotName}} if it persists.",
+	MessageDenialPrefix + DenialKeyRejected: "The CA does not sign the type of key that kssh generated. If the CA is in " +
+		"FIPS mode, install a kssh that was built with the fips build tag.",
+	MessageDenialPrefix + DenialOther: "Contact the administrators of {{.BotName}} for help.",
+}
+
+// Messages holds overrides of DefaultMessages by ID. A nil Messages uses the defaults.
+type Messages map[string]string
+
+// LoadMessages reads a JSON object that maps message IDs to templates. Every ID must be one of DefaultMessages and
+// every template must parse.
+func LoadMessages(filename string) (Messages, error) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the messages file: %v", err)
+	}
+	var messages Messages
+	err = json.Unmarshal(contents, &messages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the messages file %s: %v", filename, err)
+	}
+	for id, message := range messages {
+		if _, ok := DefaultMessages[id]; !ok {
+			return nil, fmt.Errorf("the messages file %s overrides the unknown message %s", filename, id)
+		}
+		if _, err = template.New(id).Option("missingkey=error").Parse(message); err != nil {
+			return nil, fmt.Errorf("the message %s in %s is not a valid template: %v", id, filename, err)
+		}
+	}
+	return messages, nil
+}
+
+// WithPrefix returns the overrides whose IDs start with prefix (eg the kssh messages to publish to kssh)
+func (m Messages) WithPrefix(prefix string) Messages {
+	var filtered Messages
+	for id, message := range m {
+		if strings.HasPrefix(id, prefix) {
+			if filtered == nil {
+				filtered = make(Messages)
+			}
+			filtered[id] = message
+		}
+	}
+	return filtered
+}
+
+// Render renders the message with the given ID with the given values. If the override fails to render (eg since it
+// refers to a value that this message does not have), the default message is used instead.
+func (m Messages) Render(id string, values map[string]interface{}) string {
+	if message, ok := m[id]; ok {
+		rendered, err := renderMessage(id, message, values)
+		if err == nil {
+			return rendered
+		}
+	}
+	rendered, err := renderMessage(id, DefaultMessages[id], values)
+	if err != nil {
+		// Only possible if a caller does not pass every value that the default message refers to
+		return DefaultMessages[id]
+	}
+	return rendered
+}
+
+func renderMessage(id, message string, values map[string]interface{}) (string, error) {
+	tmpl, err := template.New(id).Option("missingkey=error").Parse(message)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, values)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
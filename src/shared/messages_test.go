@@ -0,0 +1,38 @@
+package shared
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessages(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bot-sshca-messages")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "messages.json")
+	load := func(contents string) (Messages, error) {
+		require.NoError(t, ioutil.WriteFile(filename, []byte(contents), 0644))
+		return LoadMessages(filename)
+	}
+
+	_, err = load(`{"bot.unknown": "hi"}`)
+	require.Error(t, err)
+	_, err = load(`{"bot.lockdown_not_admin": "{{.Username"}`)
+	require.Error(t, err)
+	messages, err := load(`{"bot.lockdown_not_admin": "@{{.Username}} darf das nicht", "bot.lockdown_lifted": "{{.Missing}}",
+		"kssh.denial.other": "See https://wiki.example.com/ssh ({{.BotName}})"}`)
+	require.NoError(t, err)
+
+	values := map[string]interface{}{"Username": "alice", "ChangedBy": "bob"}
+	require.Equal(t, "@alice darf das nicht", messages.Render(MessageLockdownNotAdmin, values))
+	// An override that refers to a value the message does not have falls back to the default
+	require.Equal(t, "The SSH CA lockdown has been lifted by bob. Certificates are being issued again.", messages.Render(MessageLockdownLifted, values))
+	require.Equal(t, "@alice is not allowed to change the lockdown state", Messages(nil).Render(MessageLockdownNotAdmin, values))
+
+	require.Equal(t, Messages{"kssh.denial.other": "See https://wiki.example.com/ssh ({{.BotName}})"}, messages.WithPrefix("kssh."))
+	require.Nil(t, Messages(nil).WithPrefix("kssh."))
+}
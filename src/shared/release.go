@@ -0,0 +1,45 @@
+package shared
+
+import "regexp"
+
+// ReleaseManifest describes the kssh binaries published by `keybaseca publish-release` in the public KBFS folder of
+// the CA bot (see ReleaseDirectory). The manifest and every binary are signed by the bot's Keybase user with a
+// detached saltpack signature stored next to them (see ReleaseSignatureSuffix) so that `kssh --self-update` only
+// installs binaries that were published by the CA bot.
+type ReleaseManifest struct {
+	Version string `json:"version"`
+	// The published binaries keyed by platform (see ReleasePlatform)
+	Binaries map[string]ReleaseBinary `json:"binaries"`
+}
+
+// ReleaseBinary is a single kssh binary in a ReleaseManifest
+type ReleaseBinary struct {
+	// The path of the binary relative to the release directory
+	Path string `json:"path"`
+	// The hex encoded SHA256 hash of the binary
+	SHA256 string `json:"sha256"`
+}
+
+// The name of the manifest in the release directory
+const ReleaseManifestFilename = "manifest.json"
+
+// The suffix of the detached signature of each published file
+const ReleaseSignatureSuffix = ".sig"
+
+// Valid release versions. Versions are used as a directory name in KBFS.
+var releaseVersionRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+
+// IsValidReleaseVersion returns whether the given string may be used as a release version
+func IsValidReleaseVersion(version string) bool {
+	return releaseVersionRegex.MatchString(version)
+}
+
+// ReleaseDirectory returns the KBFS directory that the given bot publishes kssh releases in
+func ReleaseDirectory(botName string) string {
+	return "/keybase/public/" + botName + "/kssh-releases"
+}
+
+// ReleasePlatform returns the key used for the binary for the given GOOS and GOARCH in a ReleaseManifest
+func ReleasePlatform(goos, goarch string) string {
+	return goos + "-" + goarch
+}
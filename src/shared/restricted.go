@@ -0,0 +1,46 @@
+package shared
+
+import (
+	"regexp"
+	"strings"
+)
+
+// The file extension of the kssh configs in ClientConfigDirectory
+const clientConfigExtension = ".json"
+
+// ClientConfigDirectory returns the public KBFS directory that the given bot publishes its kssh configs in when it is
+// running as a restricted bot. Restricted bots cannot write to the team KV store so each config is stored in a file
+// named after the team it is for (see ClientConfigPath).
+func ClientConfigDirectory(botName string) string {
+	return "/keybase/public/" + botName + "/kssh-config"
+}
+
+// ClientConfigPath returns the path of the kssh config for the given team in ClientConfigDirectory
+func ClientConfigPath(botName, teamName string) string {
+	return ClientConfigDirectory(botName) + "/" + teamName + clientConfigExtension
+}
+
+// ParseClientConfigFilename returns the team that the given file in ClientConfigDirectory is the config for. ok is
+// false if the file is not a kssh config.
+func ParseClientConfigFilename(filename string) (teamName string, ok bool) {
+	if !strings.HasSuffix(filename, clientConfigExtension) {
+		return "", false
+	}
+	teamName = strings.TrimSuffix(filename, clientConfigExtension)
+	if ValidateTeamPattern(teamName) != nil || IsTeamPattern(teamName) {
+		return "", false
+	}
+	return teamName, true
+}
+
+// RestrictedBotTriggers returns the regular expressions that must be configured as triggers in the bot settings of a
+// CA bot that is a restricted bot. Restricted bots only receive the messages that match their bot settings so without
+// these the bot would never see requests from kssh.
+func RestrictedBotTriggers(botName string) []string {
+	return []string{
+		"^" + regexp.QuoteMeta(AckRequestPrefix),
+		"^" + regexp.QuoteMeta(SignatureRequestPreamble),
+		"^" + regexp.QuoteMeta(ConfigRequestPrefix),
+		"^\\s*" + regexp.QuoteMeta(GeneratePingRequest(botName)) + "\\s*$",
+	}
+}
@@ -0,0 +1,37 @@
+package shared
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientConfigFilename(t *testing.T) {
+	team, ok := ParseClientConfigFilename("acme.ssh.json")
+	require.True(t, ok)
+	require.Equal(t, "acme.ssh", team)
+
+	for _, filename := range []string{"acme.ssh", "acme.*.json", "acme..ssh.json", ".json"} {
+		_, ok := ParseClientConfigFilename(filename)
+		require.False(t, ok, filename)
+	}
+}
+
+func TestRestrictedBotTriggers(t *testing.T) {
+	matches := func(msg string) bool {
+		for _, trigger := range RestrictedBotTriggers("cabot") {
+			if regexp.MustCompile(trigger).MatchString(msg) {
+				return true
+			}
+		}
+		return false
+	}
+	require.True(t, matches(GenerateAckRequest("alice")))
+	require.True(t, matches(SignatureRequestPreamble+"{}"))
+	require.True(t, matches(GenerateConfigRequest("alice")))
+	require.True(t, matches(GeneratePingRequest("cabot")))
+	require.False(t, matches(GeneratePingRequest("otherbot")))
+	require.False(t, matches(GeneratePingRequest("cabot2")))
+	require.False(t, matches("hello @cabot"))
+}
@@ -1,6 +1,10 @@
 package shared
 
 import (
+	"fmt"
+	"path"
+	"strings"
+
 	"github.com/keybase/go-keybase-chat-bot/kbchat"
 	"github.com/keybase/go-keybase-chat-bot/kbchat/types/keybase1"
 )
@@ -35,3 +39,78 @@ func GetAllTeams(api *kbchat.API) (teams []string, err error) {
 	}
 	return teams, nil
 }
+
+// IsTeamPattern returns whether the given team name contains wildcards
+func IsTeamPattern(team string) bool {
+	return strings.ContainsAny(team, "*?[")
+}
+
+// ValidateTeamPattern returns an error if the given team pattern is malformed. Wildcards are only allowed below a fixed
+// root team (eg `acme.ssh.*`) since anyone can create a root team that matches `*.ssh` and add the bot to it.
+func ValidateTeamPattern(pattern string) error {
+	if hasWildcardRoot(pattern) {
+		return fmt.Errorf("'%s' is not a valid team pattern: the root team may not contain wildcards", pattern)
+	}
+	for _, component := range strings.Split(pattern, ".") {
+		if component == "" {
+			return fmt.Errorf("'%s' is not a valid team name or pattern", pattern)
+		}
+		if _, err := path.Match(component, ""); err != nil {
+			return fmt.Errorf("'%s' is not a valid team pattern: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// MatchTeam returns whether the given team matches the given team pattern. Each dot separated component of the
+// pattern is matched against the corresponding component of the team name using path.Match. A final `*` component
+// matches any number of subteam levels, so `acme.ssh.*` matches acme.ssh.prod and acme.ssh.prod.db but not acme.ssh.
+// A pattern without any wildcards only matches the identical team name. A pattern with a wildcard in the root team
+// (see ValidateTeamPattern) does not match anything.
+func MatchTeam(pattern, team string) bool {
+	if !IsTeamPattern(pattern) {
+		return pattern == team
+	}
+	if hasWildcardRoot(pattern) {
+		return false
+	}
+	patternComponents := strings.Split(pattern, ".")
+	teamComponents := strings.Split(team, ".")
+	if patternComponents[len(patternComponents)-1] == "*" {
+		if len(teamComponents) < len(patternComponents) {
+			return false
+		}
+		patternComponents = patternComponents[:len(patternComponents)-1]
+		teamComponents = teamComponents[:len(patternComponents)]
+	} else if len(teamComponents) != len(patternComponents) {
+		return false
+	}
+	for i, component := range patternComponents {
+		matched, err := path.Match(component, teamComponents[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns whether the root team (the first component) of the given team pattern contains wildcards
+func hasWildcardRoot(pattern string) bool {
+	return IsTeamPattern(strings.Split(pattern, ".")[0])
+}
+
+// MatchTeams returns every team in teams that matches one of the given team names or patterns. The result is
+// deduplicated and ordered by the first pattern each team matches.
+func MatchTeams(patterns []string, teams []string) []string {
+	var matches []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		for _, team := range teams {
+			if !seen[team] && MatchTeam(pattern, team) {
+				seen[team] = true
+				matches = append(matches, team)
+			}
+		}
+	}
+	return matches
+}
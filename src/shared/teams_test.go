@@ -0,0 +1,46 @@
+package shared
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTeam(t *testing.T) {
+	require.True(t, MatchTeam("acme.ssh.prod", "acme.ssh.prod"))
+	require.False(t, MatchTeam("acme.ssh.prod", "acme.ssh.prod.db"))
+
+	require.True(t, MatchTeam("acme.ssh.*", "acme.ssh.prod"))
+	require.True(t, MatchTeam("acme.ssh.*", "acme.ssh.prod.db"))
+	require.False(t, MatchTeam("acme.ssh.*", "acme.ssh"))
+	require.False(t, MatchTeam("acme.ssh.*", "acme.sshx.prod"))
+	require.False(t, MatchTeam("acme.ssh.*", "other.ssh.prod"))
+
+	require.True(t, MatchTeam("acme.*.ssh", "acme.eng.ssh"))
+	require.False(t, MatchTeam("acme.*.ssh", "acme.eng.web.ssh"))
+	require.True(t, MatchTeam("acme.ssh.prod-*", "acme.ssh.prod-us"))
+	require.False(t, MatchTeam("acme.ssh.prod-*", "acme.ssh.staging"))
+
+	// Wildcards in the root team never match since anyone can create a matching root team
+	require.False(t, MatchTeam("*.ssh", "evil.ssh"))
+	require.False(t, MatchTeam("*", "evil"))
+	require.False(t, MatchTeam("ac?e.ssh.*", "acme.ssh.prod"))
+}
+
+func TestMatchTeams(t *testing.T) {
+	teams := []string{"acme", "acme.ssh", "acme.ssh.staging", "acme.ssh.prod", "other.ssh.prod"}
+	require.Equal(t, []string{"acme.ssh.staging", "acme.ssh.prod"}, MatchTeams([]string{"acme.ssh.*"}, teams))
+	require.Equal(t, []string{"acme.ssh.prod", "acme.ssh.staging"}, MatchTeams([]string{"acme.ssh.prod", "acme.ssh.*"}, teams))
+	require.Empty(t, MatchTeams([]string{"missing"}, teams))
+}
+
+func TestValidateTeamPattern(t *testing.T) {
+	require.NoError(t, ValidateTeamPattern("acme.ssh.*"))
+	require.NoError(t, ValidateTeamPattern("acme.ssh.prod"))
+	require.Error(t, ValidateTeamPattern("acme.ssh.["))
+	require.Error(t, ValidateTeamPattern("acme..ssh"))
+	require.Error(t, ValidateTeamPattern("*"))
+	require.Error(t, ValidateTeamPattern("*.ssh"))
+	require.Error(t, ValidateTeamPattern("ac?e.ssh"))
+	require.Error(t, ValidateTeamPattern("[a-z]cme.ssh.*"))
+}
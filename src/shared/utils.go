@@ -3,9 +3,32 @@ package shared
 import (
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"strings"
 )
 
+// The portable subset of unix usernames accepted by useradd
+var unixUsernameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+
+// Returns whether the given string is a valid unix username that can be used as a principal
+func IsValidUnixUsername(username string) bool {
+	return unixUsernameRegex.MatchString(username)
+}
+
+// Keybase usernames are 2-16 characters long and only contain letters, numbers, and underscores
+var keybaseUsernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_]{2,16}$`)
+
+// Returns whether the given string is a valid Keybase username. Used by both kssh and the CA bot so that they accept
+// the same usernames.
+func IsValidKeybaseUsername(username string) bool {
+	return keybaseUsernameRegex.MatchString(username)
+}
+
+// Quote the given string for use as a single argument in a POSIX shell
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 // Returns the location of the public key associated with the given private key
 func KeyPathToPubKey(keyPath string) string {
 	return keyPath + ".pub"
@@ -0,0 +1,33 @@
+package shared
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellQuote(t *testing.T) {
+	for input, expected := range map[string]string{
+		"":                    `''`,
+		"simple":              `'simple'`,
+		"two words":           `'two words'`,
+		"it's":                `'it'\''s'`,
+		"$HOME `id` \"x\" \\": "'$HOME `id` \"x\" \\'",
+	} {
+		require.Equal(t, expected, ShellQuote(input))
+		// The shell should see exactly the original string as a single argument
+		output, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(input)).Output()
+		require.NoError(t, err)
+		require.Equal(t, input, string(output))
+	}
+}
+
+func TestIsValidKeybaseUsername(t *testing.T) {
+	for _, username := range []string{"ab", "alice", "Alice_99", "abcdefghijklmnop"} {
+		require.True(t, IsValidKeybaseUsername(username), username)
+	}
+	for _, username := range []string{"", "a", "abcdefghijklmnopq", "alice bob", "alice-bob", "alice.bob", "../alice", "alice\n"} {
+		require.False(t, IsValidKeybaseUsername(username), username)
+	}
+}
@@ -143,11 +143,17 @@ def read_file(filename: str) -> List[bytes]:
 def clear_keys():
     # Clear all keys generated by kssh
     try:
-        run_command("rm -rf ~/.ssh/keybase-signed-key*")
+        run_command("rm -rf ~/.ssh/kssh/")
     except subprocess.CalledProcessError:
         pass
 
 
+def signed_key_path(tc, bot: str = "") -> str:
+    # The location kssh stores the signed key for the given bot. kssh namespaces
+    # its keys by OS user and Keybase user.
+    return f"~/.ssh/kssh/$(whoami)/{tc.username}/keybase-signed-key--{bot}"
+
+
 def clear_local_config():
     # Clear kssh's local config file
     try:
@@ -11,6 +11,7 @@ from lib import (
     outputs_audit_log,
     run_command,
     run_command_with_agent,
+    signed_key_path,
     simulate_two_teams,
 )
 
@@ -119,12 +120,12 @@ class TestMultiTeamStrictLogging:
         with outputs_audit_log(
             test_config, filename=test_env_1_log_filename, expected_number=1
         ):
+            key_path = signed_key_path(test_config)
             run_command_with_agent(
-                "mv ~/tests/testFiles/expired ~/.ssh/keybase-signed-key-- && \
-                mv ~/tests/testFiles/expired.pub \
-                ~/.ssh/keybase-signed-key--.pub && \
-                mv ~/tests/testFiles/expired-cert.pub \
-                ~/.ssh/keybase-signed-key---cert.pub"
+                f"mkdir -p $(dirname {key_path}) && chmod 700 $(dirname {key_path}) && \
+                mv ~/tests/testFiles/expired {key_path} && \
+                mv ~/tests/testFiles/expired.pub {key_path}.pub && \
+                mv ~/tests/testFiles/expired-cert.pub {key_path}-cert.pub"
             )
             assert_contains_hash(
                 test_config.expected_hash,
@@ -154,7 +155,7 @@ class TestMultiTeamStrictLogging:
             )
             assert_contains_hash(test_config.expected_hash, output)
             assert hashlib.sha1(b"foo").hexdigest().encode("utf-8") in output
-        assert get_principals("~/.ssh/keybase-signed-key---cert.pub") == set(
+        assert get_principals(signed_key_path(test_config) + "-cert.pub") == set(
             [
                 test_config.subteam + ".ssh.staging",
                 test_config.subteam + ".ssh.root_everywhere",
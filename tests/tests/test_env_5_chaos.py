@@ -0,0 +1,35 @@
+import pytest
+from lib import (
+    TestConfig,
+    assert_contains_hash,
+    clear_keys,
+    load_env,
+    outputs_audit_log,
+    run_command_with_agent,
+)
+
+
+class TestEnv5Chaos:
+    @pytest.fixture(autouse=True, scope="class")
+    def configure_env(self):
+        assert load_env(__file__)
+
+    @pytest.fixture(autouse=True, scope="class")
+    def test_config(self):
+        return TestConfig.getDefaultTestConfig()
+
+    def test_kssh_delayed_responses(self, test_config):
+        # Test that kssh still gets a signed key when every response from the
+        # CA bot is delayed
+        with outputs_audit_log(
+            test_config, filename="/shared/ca.log", expected_number=3
+        ):
+            for s in ["user@sshd-staging", "root@sshd-staging", "root@sshd-prod"]:
+                clear_keys()
+                assert_contains_hash(
+                    test_config.expected_hash,
+                    run_command_with_agent(
+                        f"bin/kssh -q -o StrictHostKeyChecking=no {s} "
+                        f'"sha1sum /etc/unique" '
+                    ),
+                )